@@ -0,0 +1,141 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+// Package acoustid uses the fpcalc program and the AcoustID web service to identify songs
+// by their audio data.
+package acoustid
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"sort"
+	"strconv"
+
+	"golang.org/x/time/rate"
+)
+
+const (
+	// https://acoustid.org/webservice: "Do not make more than 3 requests per second."
+	maxQPS         = 3
+	rateBucketSize = 1
+)
+
+// srvURL is the base URL of the AcoustID web service. It is overridden by tests.
+var srvURL = "https://api.acoustid.org"
+
+// limiter rate-limits requests to the web service.
+var limiter = rate.NewLimiter(maxQPS, rateBucketSize)
+
+// Fingerprint uses fpcalc (part of Chromaprint) to compute the fingerprint of the audio file
+// at p. The fingerprint and the file's duration in seconds are returned.
+func Fingerprint(p string) (fp string, dur int, err error) {
+	out, err := exec.Command("fpcalc", "-json", p).Output()
+	if err != nil {
+		return "", 0, fmt.Errorf("fpcalc failed: %v", err)
+	}
+	return parseFpcalcOutput(out)
+}
+
+// parseFpcalcOutput parses JSON output from "fpcalc -json".
+func parseFpcalcOutput(out []byte) (fp string, dur int, err error) {
+	var res struct {
+		Duration    float64 `json:"duration"`
+		Fingerprint string  `json:"fingerprint"`
+	}
+	if err := json.Unmarshal(out, &res); err != nil {
+		return "", 0, fmt.Errorf("bad fpcalc output: %v", err)
+	}
+	if res.Fingerprint == "" {
+		return "", 0, errors.New("no fingerprint in fpcalc output")
+	}
+	return res.Fingerprint, int(res.Duration + 0.5), nil
+}
+
+// Match describes a MusicBrainz recording that matched a fingerprint.
+type Match struct {
+	// Score is the match's score in the range [0, 1].
+	Score float64
+	// RecordingID is the recording's MusicBrainz ID.
+	RecordingID string
+	// Releases contains the releases that include the recording.
+	Releases []Release
+}
+
+// Release describes a MusicBrainz release.
+type Release struct {
+	// ID is the release's MusicBrainz ID (i.e. db.Song.AlbumID).
+	ID string
+	// Title is the release's title.
+	Title string
+}
+
+// Lookup uses the AcoustID web service with the supplied API key to find recordings matching
+// the supplied fingerprint and duration (as returned by Fingerprint).
+// Matches are returned in descending order by score.
+func Lookup(ctx context.Context, key, fp string, dur int) ([]Match, error) {
+	if err := limiter.Wait(ctx); err != nil {
+		return nil, err
+	}
+	vals := url.Values{
+		"client":      {key},
+		"meta":        {"recordings releases"},
+		"duration":    {strconv.Itoa(dur)},
+		"fingerprint": {fp},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet,
+		srvURL+"/v2/lookup?"+vals.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return parseLookupResponse(resp.Body)
+}
+
+// parseLookupResponse parses a JSON response from the /v2/lookup endpoint.
+func parseLookupResponse(r io.Reader) ([]Match, error) {
+	var res struct {
+		Status string `json:"status"`
+		Error  struct {
+			Message string `json:"message"`
+		} `json:"error"`
+		Results []struct {
+			Score      float64 `json:"score"`
+			Recordings []struct {
+				ID       string `json:"id"`
+				Releases []struct {
+					ID    string `json:"id"`
+					Title string `json:"title"`
+				} `json:"releases"`
+			} `json:"recordings"`
+		} `json:"results"`
+	}
+	if err := json.NewDecoder(r).Decode(&res); err != nil {
+		return nil, err
+	}
+	if res.Status != "ok" {
+		return nil, fmt.Errorf("got status %q (%q)", res.Status, res.Error.Message)
+	}
+
+	var matches []Match
+	for _, result := range res.Results {
+		for _, rec := range result.Recordings {
+			m := Match{Score: result.Score, RecordingID: rec.ID}
+			for _, rel := range rec.Releases {
+				m.Releases = append(m.Releases, Release{ID: rel.ID, Title: rel.Title})
+			}
+			matches = append(matches, m)
+		}
+	}
+	sort.SliceStable(matches, func(i, j int) bool { return matches[i].Score > matches[j].Score })
+	return matches, nil
+}
@@ -0,0 +1,91 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package acoustid
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestParseFpcalcOutput(t *testing.T) {
+	fp, dur, err := parseFpcalcOutput([]byte(`{"duration": 241.63, "fingerprint": "AQADtJmSJEmS"}`))
+	if err != nil {
+		t.Fatal("parseFpcalcOutput failed: ", err)
+	}
+	if fp != "AQADtJmSJEmS" || dur != 242 {
+		t.Errorf("parseFpcalcOutput returned %q, %v; want %q, %v", fp, dur, "AQADtJmSJEmS", 242)
+	}
+
+	for _, out := range []string{"", "{}", `{"duration": 10}`, "not json"} {
+		if _, _, err := parseFpcalcOutput([]byte(out)); err == nil {
+			t.Errorf("parseFpcalcOutput(%q) unexpectedly succeeded", out)
+		}
+	}
+}
+
+func TestLookup(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got, want := r.URL.Path, "/v2/lookup"; got != want {
+			t.Errorf("Got request for %v; want %v", got, want)
+		}
+		q := r.URL.Query()
+		if q.Get("client") != "key" || q.Get("fingerprint") != "fp" || q.Get("duration") != "180" {
+			t.Errorf("Got bad query %q", r.URL.RawQuery)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{
+  "status": "ok",
+  "results": [
+    {
+      "id": "a",
+      "score": 0.5,
+      "recordings": [{"id": "rec-low"}]
+    },
+    {
+      "id": "b",
+      "score": 0.95,
+      "recordings": [
+        {
+          "id": "rec1",
+          "releases": [{"id": "rel1", "title": "Album"}, {"id": "rel2", "title": "Best Of"}]
+        },
+        {"id": "rec2"}
+      ]
+    }
+  ]
+}`))
+	}))
+	defer srv.Close()
+	defer func(orig string) { srvURL = orig }(srvURL)
+	srvURL = srv.URL
+
+	got, err := Lookup(context.Background(), "key", "fp", 180)
+	if err != nil {
+		t.Fatal("Lookup failed: ", err)
+	}
+	want := []Match{
+		{Score: 0.95, RecordingID: "rec1", Releases: []Release{{"rel1", "Album"}, {"rel2", "Best Of"}}},
+		{Score: 0.95, RecordingID: "rec2"},
+		{Score: 0.5, RecordingID: "rec-low"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Lookup returned %+v; want %+v", got, want)
+	}
+}
+
+func TestLookup_Error(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"status": "error", "error": {"code": 4, "message": "invalid API key"}}`))
+	}))
+	defer srv.Close()
+	defer func(orig string) { srvURL = orig }(srvURL)
+	srvURL = srv.URL
+
+	if _, err := Lookup(context.Background(), "bad", "fp", 180); err == nil {
+		t.Error("Lookup unexpectedly succeeded")
+	}
+}
@@ -0,0 +1,153 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package backup
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"time"
+)
+
+const (
+	// formatVersion is the version of the archive format written by the backup command.
+	// It should be incremented when incompatible changes are made.
+	formatVersion = 1
+
+	manifestName = "manifest.json" // archive's first file
+	songsName    = "songs.json"    // newline-separated JSON db.Song objects, as written by 'nup dump'
+	statsName    = "stats.json"    // JSON db.Stats object from the server's /stats endpoint
+	coversPrefix = "covers/"       // prefix for cover image files
+)
+
+// manifest describes the contents of an archive.
+type manifest struct {
+	// Version contains the archive's format version.
+	Version int `json:"version"`
+	// CreateTime contains the time at which the archive was created.
+	CreateTime time.Time `json:"createTime"`
+	// ServerURL contains the URL of the server that was backed up.
+	ServerURL string `json:"serverUrl"`
+	// Songs, Plays, and Covers contain the number of archived songs, plays, and cover images.
+	Songs  int `json:"songs"`
+	Plays  int `json:"plays"`
+	Covers int `json:"covers"`
+}
+
+// archiveWriter writes a gzip-compressed tar archive.
+type archiveWriter struct {
+	gw      *gzip.Writer
+	tw      *tar.Writer
+	modTime time.Time // used for all files
+}
+
+func newArchiveWriter(w io.Writer, modTime time.Time) *archiveWriter {
+	gw := gzip.NewWriter(w)
+	return &archiveWriter{gw: gw, tw: tar.NewWriter(gw), modTime: modTime}
+}
+
+// addFile adds a file named name containing size bytes read from r.
+func (aw *archiveWriter) addFile(name string, size int64, r io.Reader) error {
+	if err := aw.tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Size:     size,
+		Mode:     0644,
+		ModTime:  aw.modTime,
+	}); err != nil {
+		return err
+	}
+	if _, err := io.Copy(aw.tw, r); err != nil {
+		return fmt.Errorf("%v: %v", name, err)
+	}
+	return nil
+}
+
+// addJSON adds a file named name containing JSON-marshaled v.
+func (aw *archiveWriter) addJSON(name string, v interface{}) error {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	return aw.addFile(name, int64(len(b)), bytes.NewReader(b))
+}
+
+// close finishes writing the archive. It does not close the underlying writer.
+func (aw *archiveWriter) close() error {
+	if err := aw.tw.Close(); err != nil {
+		return err
+	}
+	return aw.gw.Close()
+}
+
+// readArchive reads a gzip-compressed tar archive from r. The manifest is passed to mf,
+// and the name and contents of each subsequent file are passed to fn. An error is returned
+// if the archive doesn't start with a manifest or has an unsupported version.
+func readArchive(r io.Reader, mf func(*manifest) error, fn func(name string, r io.Reader) error) error {
+	gr, err := gzip.NewReader(r)
+	if err != nil {
+		return err
+	}
+	defer gr.Close()
+
+	tr := tar.NewReader(gr)
+	first := true
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		if first {
+			if hdr.Name != manifestName {
+				return fmt.Errorf("first file is %q instead of %q", hdr.Name, manifestName)
+			}
+			var m manifest
+			if err := json.NewDecoder(tr).Decode(&m); err != nil {
+				return fmt.Errorf("bad manifest: %v", err)
+			}
+			if m.Version < 1 || m.Version > formatVersion {
+				return fmt.Errorf("unsupported format version %d", m.Version)
+			}
+			if err := mf(&m); err != nil {
+				return err
+			}
+			first = false
+			continue
+		}
+		if err := fn(hdr.Name, tr); err != nil {
+			return fmt.Errorf("%v: %v", hdr.Name, err)
+		}
+	}
+	if first {
+		return errors.New("archive is empty")
+	}
+	return nil
+}
+
+// coverName returns the name used in an archive for the cover image named fn.
+func coverName(fn string) string { return coversPrefix + fn }
+
+// coverFilename returns the cover filename corresponding to an archived file named name.
+// The empty string is returned if name doesn't describe a cover image or is unsafe.
+func coverFilename(name string) string {
+	if !strings.HasPrefix(name, coversPrefix) {
+		return ""
+	}
+	fn := strings.TrimPrefix(name, coversPrefix)
+	if fn == "" || fn == ".." || path.Clean(fn) != fn || strings.HasPrefix(fn, "/") || strings.HasPrefix(fn, "../") {
+		return ""
+	}
+	return fn
+}
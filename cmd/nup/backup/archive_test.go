@@ -0,0 +1,102 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package backup
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestArchive(t *testing.T) {
+	now := time.Date(2023, 4, 1, 12, 0, 0, 0, time.UTC)
+	mf := manifest{Version: formatVersion, CreateTime: now, ServerURL: "https://example.org/", Songs: 2}
+	files := map[string]string{
+		songsName:          `{"title":"a"}` + "\n" + `{"title":"b"}` + "\n",
+		coverName("a.jpg"): "jpeg data",
+	}
+
+	var buf bytes.Buffer
+	aw := newArchiveWriter(&buf, now)
+	if err := aw.addJSON(manifestName, &mf); err != nil {
+		t.Fatal("addJSON failed: ", err)
+	}
+	for _, name := range []string{songsName, coverName("a.jpg")} {
+		if err := aw.addFile(name, int64(len(files[name])), strings.NewReader(files[name])); err != nil {
+			t.Fatalf("addFile(%q, ...) failed: %v", name, err)
+		}
+	}
+	if err := aw.close(); err != nil {
+		t.Fatal("close failed: ", err)
+	}
+
+	var gotMf manifest
+	gotFiles := make(map[string]string)
+	if err := readArchive(bytes.NewReader(buf.Bytes()), func(m *manifest) error {
+		gotMf = *m
+		return nil
+	}, func(name string, r io.Reader) error {
+		b, err := ioutil.ReadAll(r)
+		gotFiles[name] = string(b)
+		return err
+	}); err != nil {
+		t.Fatal("readArchive failed: ", err)
+	}
+	if !reflect.DeepEqual(gotMf, mf) {
+		t.Errorf("readArchive returned manifest %+v; want %+v", gotMf, mf)
+	}
+	if !reflect.DeepEqual(gotFiles, files) {
+		t.Errorf("readArchive returned files %q; want %q", gotFiles, files)
+	}
+}
+
+func TestArchive_BadManifest(t *testing.T) {
+	for _, tc := range []struct {
+		desc string
+		name string
+		data string
+	}{
+		{"missing manifest", songsName, "{}"},
+		{"old version", manifestName, `{"version":0}`},
+		{"new version", manifestName, `{"version":1000}`},
+		{"malformed", manifestName, `{`},
+	} {
+		var buf bytes.Buffer
+		aw := newArchiveWriter(&buf, time.Now())
+		if err := aw.addFile(tc.name, int64(len(tc.data)), strings.NewReader(tc.data)); err != nil {
+			t.Fatalf("%v: addFile failed: %v", tc.desc, err)
+		}
+		if err := aw.close(); err != nil {
+			t.Fatalf("%v: close failed: %v", tc.desc, err)
+		}
+		if err := readArchive(&buf, func(*manifest) error { return nil },
+			func(string, io.Reader) error { return nil }); err == nil {
+			t.Errorf("%v: readArchive unexpectedly succeeded", tc.desc)
+		}
+	}
+}
+
+func TestCoverFilename(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		want string
+	}{
+		{"covers/a.jpg", "a.jpg"},
+		{"covers/dir/a.jpg", "dir/a.jpg"},
+		{"songs.json", ""},
+		{"covers/", ""},
+		{"covers/../a.jpg", ""},
+		{"covers/..", ""},
+		{"covers//a.jpg", ""},
+		{"covers/./a.jpg", ""},
+	} {
+		if got := coverFilename(tc.name); got != tc.want {
+			t.Errorf("coverFilename(%q) = %q; want %q", tc.name, got, tc.want)
+		}
+	}
+}
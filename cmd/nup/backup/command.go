@@ -0,0 +1,354 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+// Package backup implements the backup and restore commands.
+package backup
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/derat/nup/cmd/nup/client"
+	"github.com/derat/nup/cmd/nup/dump"
+	"github.com/derat/nup/cmd/nup/update"
+	"github.com/derat/nup/server/db"
+	"github.com/google/subcommands"
+)
+
+const (
+	songBatchSize = 400 // songs to request at a time
+	playBatchSize = 800 // plays to request at a time
+)
+
+type Command struct {
+	Cfg *client.Config
+
+	coverDir string // directory containing cover images
+	out      string // path to write archive to
+}
+
+func (*Command) Name() string     { return "backup" }
+func (*Command) Synopsis() string { return "back up songs and covers to an archive" }
+func (*Command) Usage() string {
+	return `backup <flags>:
+	Write a gzip-compressed tar archive containing all songs and plays,
+	stats, and cover images. See README.md for the archive format.
+	Cover images are read from -cover-dir if set or downloaded from the
+	server otherwise.
+
+`
+}
+
+func (cmd *Command) SetFlags(f *flag.FlagSet) {
+	f.StringVar(&cmd.coverDir, "cover-dir", "", "Directory containing cover images (defaults to config's coverDir)")
+	f.StringVar(&cmd.out, "out", "", "Path to write archive to (stdout if empty)")
+}
+
+func (cmd *Command) Execute(ctx context.Context, _ *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+	if cmd.coverDir == "" {
+		cmd.coverDir = cmd.Cfg.CoverDir
+	}
+	w := os.Stdout
+	if cmd.out != "" {
+		f, err := os.Create(cmd.out)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Failed creating archive:", err)
+			return subcommands.ExitFailure
+		}
+		w = f
+	}
+	err := cmd.writeArchive(w)
+	if cmd.out != "" {
+		if cerr := w.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed writing archive:", err)
+		return subcommands.ExitFailure
+	}
+	return subcommands.ExitSuccess
+}
+
+// writeArchive writes a backup archive to w.
+func (cmd *Command) writeArchive(w io.Writer) error {
+	// tar needs to know each file's size before it's written, so dump songs
+	// to a temporary file first.
+	tmpDir, err := ioutil.TempDir("", "nup-backup.")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	mf := manifest{Version: formatVersion, CreateTime: time.Now(), ServerURL: cmd.Cfg.ServerURL}
+	songsPath := filepath.Join(tmpDir, songsName)
+	coverSet := make(map[string]struct{})
+	if err := func() error {
+		f, err := os.Create(songsPath)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		e := json.NewEncoder(f)
+		if err := dump.Songs(cmd.Cfg, songBatchSize, playBatchSize, func(s *db.Song) error {
+			mf.Songs++
+			mf.Plays += len(s.Plays)
+			if s.CoverFilename != "" {
+				coverSet[s.CoverFilename] = struct{}{}
+			}
+			return e.Encode(s)
+		}); err != nil {
+			return err
+		}
+		return f.Close()
+	}(); err != nil {
+		return fmt.Errorf("dumping songs: %v", err)
+	}
+	fmt.Fprintf(os.Stderr, "Dumped %d songs with %d plays\n", mf.Songs, mf.Plays)
+
+	stats, err := getStats(cmd.Cfg)
+	if err != nil {
+		return fmt.Errorf("getting stats: %v", err)
+	}
+
+	// Find or download the covers.
+	coverNames := make([]string, 0, len(coverSet))
+	for fn := range coverSet {
+		coverNames = append(coverNames, fn)
+	}
+	sort.Strings(coverNames)
+	coverPaths := make(map[string]string, len(coverNames))
+	for _, fn := range coverNames {
+		var p string
+		if cmd.coverDir != "" {
+			p = filepath.Join(cmd.coverDir, fn)
+			if _, err := os.Stat(p); err != nil {
+				fmt.Fprintf(os.Stderr, "Skipping cover %v: %v\n", fn, err)
+				continue
+			}
+		} else {
+			p = filepath.Join(tmpDir, fmt.Sprintf("cover.%d", len(coverPaths)))
+			if err := downloadCover(cmd.Cfg, fn, p); err != nil {
+				fmt.Fprintf(os.Stderr, "Skipping cover %v: %v\n", fn, err)
+				continue
+			}
+		}
+		coverPaths[fn] = p
+	}
+	mf.Covers = len(coverPaths)
+
+	aw := newArchiveWriter(w, mf.CreateTime)
+	if err := aw.addJSON(manifestName, &mf); err != nil {
+		return err
+	}
+	if err := addLocalFile(aw, songsName, songsPath); err != nil {
+		return err
+	}
+	if err := aw.addJSON(statsName, stats); err != nil {
+		return err
+	}
+	for _, fn := range coverNames {
+		if p, ok := coverPaths[fn]; ok {
+			if err := addLocalFile(aw, coverName(fn), p); err != nil {
+				return err
+			}
+		}
+	}
+	if err := aw.close(); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Wrote %d songs, %d plays, and %d covers\n", mf.Songs, mf.Plays, mf.Covers)
+	return nil
+}
+
+// addLocalFile adds the local file at p to aw as name.
+func addLocalFile(aw *archiveWriter, name, p string) error {
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	return aw.addFile(name, fi.Size(), f)
+}
+
+// sendGet sends a GET request for path with the supplied query to the server.
+// The caller must close the response body.
+func sendGet(cfg *client.Config, path string, query url.Values) (*http.Response, error) {
+	u := cfg.GetURL(path)
+	u.RawQuery = query.Encode()
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	cfg.SetAuth(req)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("got status %q", resp.Status)
+	}
+	return resp, nil
+}
+
+// getStats returns the server's previously-computed stats.
+func getStats(cfg *client.Config) (*db.Stats, error) {
+	resp, err := sendGet(cfg, "/stats", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var stats db.Stats
+	err = json.NewDecoder(resp.Body).Decode(&stats)
+	return &stats, err
+}
+
+// downloadCover downloads the original version of the cover image named fn to p.
+func downloadCover(cfg *client.Config, fn, p string) error {
+	resp, err := sendGet(cfg, "/cover", url.Values{"filename": {fn}})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	f, err := os.Create(p)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, resp.Body); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+type RestoreCommand struct {
+	Cfg *client.Config
+
+	coverDir        string // directory to write cover images to
+	importUserData  bool   // replace user data on the server
+	overwriteCovers bool   // overwrite existing cover images
+}
+
+func (*RestoreCommand) Name() string     { return "restore" }
+func (*RestoreCommand) Synopsis() string { return "restore songs and covers from an archive" }
+func (*RestoreCommand) Usage() string {
+	return `restore <flags> <archive>:
+	Import songs and plays from an archive written by the backup command
+	and write its cover images to -cover-dir. Covers still need to be
+	copied to the server's cover bucket separately.
+
+`
+}
+
+func (cmd *RestoreCommand) SetFlags(f *flag.FlagSet) {
+	f.StringVar(&cmd.coverDir, "cover-dir", "",
+		"Directory to write cover images to (defaults to config's coverDir; covers are skipped if empty)")
+	f.BoolVar(&cmd.importUserData, "import-user-data", true,
+		"Replace user data (ratings, tags, plays, etc.) on the server")
+	f.BoolVar(&cmd.overwriteCovers, "overwrite-covers", false, "Overwrite existing cover images")
+}
+
+func (cmd *RestoreCommand) Execute(ctx context.Context, fs *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+	if fs.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, cmd.Usage())
+		return subcommands.ExitUsageError
+	}
+	if cmd.coverDir == "" {
+		cmd.coverDir = cmd.Cfg.CoverDir
+	}
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed opening archive:", err)
+		return subcommands.ExitFailure
+	}
+	defer f.Close()
+
+	if err := cmd.restore(f); err != nil {
+		fmt.Fprintln(os.Stderr, "Failed restoring archive:", err)
+		return subcommands.ExitFailure
+	}
+	return subcommands.ExitSuccess
+}
+
+// restore reads an archive from r, writes its covers, and imports its songs.
+func (cmd *RestoreCommand) restore(r io.Reader) error {
+	var songs []db.Song
+	var numCovers int
+	if err := readArchive(r, func(mf *manifest) error {
+		fmt.Fprintf(os.Stderr, "Restoring %d songs and %d covers from %v backup created at %v\n",
+			mf.Songs, mf.Covers, mf.ServerURL, mf.CreateTime.Format(time.RFC3339))
+		return nil
+	}, func(name string, r io.Reader) error {
+		if name == songsName {
+			d := json.NewDecoder(r)
+			for {
+				var s db.Song
+				if err := d.Decode(&s); err == io.EOF {
+					return nil
+				} else if err != nil {
+					return err
+				}
+				songs = append(songs, s)
+			}
+		}
+		if fn := coverFilename(name); fn != "" && cmd.coverDir != "" {
+			wrote, err := writeCover(filepath.Join(cmd.coverDir, fn), r, cmd.overwriteCovers)
+			if wrote {
+				numCovers++
+			}
+			return err
+		}
+		return nil // ignore stats and unknown files
+	}); err != nil {
+		return err
+	}
+	if songs == nil {
+		return errors.New("no songs in archive")
+	}
+	fmt.Fprintf(os.Stderr, "Wrote %d covers; importing %d songs\n", numCovers, len(songs))
+
+	ch := make(chan db.Song, len(songs))
+	for _, s := range songs {
+		ch <- s
+	}
+	close(ch)
+	return update.ImportSongs(cmd.Cfg, ch, cmd.importUserData, false)
+}
+
+// writeCover writes r's contents to p. If overwrite is false and p already exists,
+// nothing is written and false is returned.
+func writeCover(p string, r io.Reader, overwrite bool) (bool, error) {
+	if !overwrite {
+		if _, err := os.Stat(p); err == nil {
+			return false, nil
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return false, err
+	}
+	f, err := os.Create(p)
+	if err != nil {
+		return false, err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return false, err
+	}
+	return true, f.Close()
+}
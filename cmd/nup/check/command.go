@@ -22,6 +22,7 @@ import (
 
 	"github.com/derat/nup/cmd/nup/client"
 	"github.com/derat/nup/cmd/nup/client/files"
+	"github.com/derat/nup/cmd/nup/transcode"
 	"github.com/derat/nup/server/cover"
 	"github.com/derat/nup/server/db"
 	"github.com/google/subcommands"
@@ -34,6 +35,9 @@ const (
 	checkAlbumID checkSettings = 1 << iota
 	checkCoverSize400
 	checkCoverSize800
+	checkDupes
+	checkGCSSHA1
+	checkHiddenTracks
 	checkImported
 	checkMetadata
 	checkSongCover
@@ -48,6 +52,9 @@ var checkInfos = map[string]struct { // keys are values for -check flag
 	"album-id":       {checkAlbumID, "Songs have MusicBrainz album IDs", true},
 	"cover-size-400": {checkCoverSize400, "Cover images are at least 400x400", false},
 	"cover-size-800": {checkCoverSize800, "Cover images are at least 800x800", false},
+	"dupes":          {checkDupes, "Songs aren't duplicated (see -dupes-report)", false},
+	"gcs-sha1":       {checkGCSSHA1, "Objects in -bucket have the dumped SHA1s (downloads all songs)", false},
+	"hidden-tracks":  {checkHiddenTracks, "Songs don't have long silences or hidden tracks (needs ffmpeg)", false},
 	"imported":       {checkImported, "Local songs have been imported", true},
 	"metadata":       {checkMetadata, "Song metadata is the same in dumped and local songs", false},
 	"song-cover":     {checkSongCover, "Songs with album IDs have cover files", true},
@@ -55,9 +62,16 @@ var checkInfos = map[string]struct { // keys are values for -check flag
 }
 
 type Command struct {
-	Cfg        *client.Config
-	checksList string // comma-separated list of checks to perform
-	checks     checkSettings
+	Cfg          *client.Config
+	checksList   string // comma-separated list of checks to perform
+	checks       checkSettings
+	bucket       string // GCS bucket containing songs
+	dupesReport  string // path to write JSON report of duplicate songs
+	gcsStateFile string // path to file recording objects verified by gcs-sha1 check
+	gcsWorkers   int    // objects to download simultaneously for gcs-sha1 check
+	out          client.OutputFlags
+	rep          *client.Reporter
+	index        *client.TranscodeIndex // lossless files transcoded by "nup update -upload"
 }
 
 func (*Command) Name() string     { return "check" }
@@ -86,6 +100,14 @@ func (cmd *Command) SetFlags(f *flag.FlagSet) {
 	sort.Strings(checkDescs)
 	f.StringVar(&cmd.checksList, "checks", strings.Join(defaultChecks, ","),
 		"Comma-separated list of checks to perform:\n"+strings.Join(checkDescs, ""))
+	f.StringVar(&cmd.bucket, "bucket", "", "Google Cloud Storage bucket containing songs (for \"gcs-sha1\" check)")
+	f.StringVar(&cmd.dupesReport, "dupes-report", "",
+		"Path to write JSON report of duplicate songs found by \"dupes\" check")
+	f.StringVar(&cmd.gcsStateFile, "gcs-state-file", "",
+		"File recording objects verified by \"gcs-sha1\" check, used to resume interrupted checks")
+	f.IntVar(&cmd.gcsWorkers, "gcs-workers", defaultGCSWorkers,
+		"Maximum objects to download simultaneously for \"gcs-sha1\" check")
+	cmd.out.SetFlags(f)
 }
 
 func (cmd *Command) Execute(ctx context.Context, _ *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
@@ -102,6 +124,26 @@ func (cmd *Command) Execute(ctx context.Context, _ *flag.FlagSet, _ ...interface
 		}
 		cmd.checks |= info.setting
 	}
+	if cmd.checks&checkGCSSHA1 != 0 {
+		if cmd.bucket == "" {
+			fmt.Fprintln(os.Stderr, "gcs-sha1 check requires -bucket")
+			return subcommands.ExitUsageError
+		}
+		if cmd.gcsWorkers <= 0 {
+			fmt.Fprintln(os.Stderr, "-gcs-workers must be positive")
+			return subcommands.ExitUsageError
+		}
+	}
+
+	var err error
+	if cmd.rep, err = cmd.out.NewReporter(os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, "Bad output flags:", err)
+		return subcommands.ExitUsageError
+	}
+	if cmd.index, err = client.ReadTranscodeIndex(cmd.Cfg.TranscodeIndexFile); err != nil {
+		fmt.Fprintln(os.Stderr, "Failed reading transcode index:", err)
+		return subcommands.ExitFailure
+	}
 
 	d := json.NewDecoder(os.Stdin)
 	songs := make([]*db.Song, 0)
@@ -115,7 +157,9 @@ func (cmd *Command) Execute(ctx context.Context, _ *flag.FlagSet, _ ...interface
 		}
 		songs = append(songs, &s)
 	}
-	log.Printf("Read %d songs", len(songs))
+	if !cmd.rep.JSON() {
+		log.Printf("Read %d songs", len(songs))
+	}
 	sort.Slice(songs, func(i, j int) bool { return songs[i].Filename < songs[j].Filename })
 
 	if err := cmd.checkSongs(songs); err != nil {
@@ -126,16 +170,32 @@ func (cmd *Command) Execute(ctx context.Context, _ *flag.FlagSet, _ ...interface
 		fmt.Fprintln(os.Stderr, "Failed checking covers:", err)
 		return subcommands.ExitFailure
 	}
+	if cmd.checks&checkGCSSHA1 != 0 {
+		if err := cmd.checkGCSSHA1(ctx, songs); err != nil {
+			fmt.Fprintln(os.Stderr, "Failed checking Cloud Storage objects:", err)
+			return subcommands.ExitFailure
+		}
+	}
+	cmd.rep.Summary()
 	return subcommands.ExitSuccess
 }
 
+// localFile returns the path of s's file relative to the music dir. If s was transcoded
+// from a lossless file by "nup update -upload", the lossless file's path is returned.
+func (cmd *Command) localFile(s *db.Song) string {
+	if src, ok := cmd.index.Source(s.Filename); ok {
+		return src
+	}
+	return s.Filename
+}
+
 func (cmd *Command) checkSongs(songs []*db.Song) error {
 	seenFilenames := make(map[string]string, len(songs))
 	fs := [](func(s *db.Song) error){
 		func(s *db.Song) error {
 			if len(s.Filename) == 0 {
 				return errors.New("no song filename")
-			} else if _, err := os.Stat(filepath.Join(cmd.Cfg.MusicDir, s.Filename)); err != nil {
+			} else if _, err := os.Stat(filepath.Join(cmd.Cfg.MusicDir, cmd.localFile(s))); err != nil {
 				return errors.New("missing song file")
 			}
 			if id, ok := seenFilenames[s.Filename]; ok {
@@ -181,11 +241,12 @@ func (cmd *Command) checkSongs(songs []*db.Song) error {
 
 	if cmd.checks&checkMetadata != 0 {
 		fs = append(fs, func(s *db.Song) error {
-			abs := filepath.Join(cmd.Cfg.MusicDir, s.Filename)
+			abs := filepath.Join(cmd.Cfg.MusicDir, cmd.localFile(s))
 			local, err := files.ReadSong(cmd.Cfg, abs, nil, files.SkipAudioData, nil /* gc */)
 			if err != nil {
 				return err
 			}
+			local.Filename = s.Filename // transcoded songs are stored under their objects' names
 			dump := *s
 
 			// Clear fields that aren't set when reading only tags or when dumping.
@@ -197,6 +258,8 @@ func (cmd *Command) checkSongs(songs []*db.Song) error {
 			dump.SHA1 = ""
 			dump.SongID = ""
 			dump.CoverFilename = ""
+			dump.CoverBlurHash = ""
+			dump.CoverPalette = nil
 			dump.Length = 0
 			dump.TrackGain = 0
 			dump.AlbumGain = 0
@@ -212,11 +275,25 @@ func (cmd *Command) checkSongs(songs []*db.Song) error {
 		})
 	}
 
+	cmd.rep.AddTotal(len(fs) * len(songs))
 	for _, f := range fs {
 		for _, s := range songs {
 			if err := f(s); err != nil {
-				fmt.Printf("%s (%s): %v\n", s.SongID, s.Filename, err)
+				cmd.rep.Item(s.Filename, "songProblem", fmt.Sprintf("%s (%s): %v", s.SongID, s.Filename, err))
 			}
+			cmd.rep.Advance(1)
+		}
+	}
+
+	if cmd.checks&checkDupes != 0 {
+		if err := cmd.checkDupes(songs); err != nil {
+			return fmt.Errorf("failed checking for duplicates: %v", err)
+		}
+	}
+
+	if cmd.checks&checkHiddenTracks != 0 {
+		if err := cmd.checkHiddenTracks(songs); err != nil {
+			return fmt.Errorf("failed checking for hidden tracks: %v", err)
 		}
 	}
 
@@ -229,7 +306,11 @@ func (cmd *Command) checkSongs(songs []*db.Song) error {
 			if err != nil {
 				return err
 			}
-			if !fi.Mode().IsRegular() || !files.IsMusicPath(path) {
+			if !fi.Mode().IsRegular() {
+				return nil
+			}
+			lossless := cmd.Cfg.TranscodeFormat != "" && files.IsLosslessPath(path)
+			if !files.IsMusicPath(path) && !lossless {
 				return nil
 			}
 			pre := cmd.Cfg.MusicDir + "/"
@@ -237,8 +318,12 @@ func (cmd *Command) checkSongs(songs []*db.Song) error {
 				return fmt.Errorf("%v doesn't have expected prefix %v", path, pre)
 			}
 			path = path[len(pre):]
-			if _, ok := known[path]; !ok {
-				fmt.Printf("%v not imported\n", path)
+			fn := path
+			if lossless {
+				fn = transcode.ObjectName(path, cmd.Cfg.TranscodeFormat)
+			}
+			if _, ok := known[fn]; !ok {
+				cmd.rep.Item(path, "notImported", path+" not imported")
 			}
 			return nil
 		}); err != nil {
@@ -272,7 +357,7 @@ func (cmd *Command) checkCovers(songs []*db.Song) error {
 
 	if cmd.checks&checkUnusedCover != 0 {
 		fs = append(fs, func(fn string) error {
-			// Check for the original cover if this is a generated WebP image.
+			// Check for the original cover if this is a generated WebP or AVIF image.
 			fn = cover.OrigFilename(fn)
 			if _, ok := songFns[fn]; !ok {
 				return errors.New("unused cover")
@@ -306,6 +391,7 @@ func (cmd *Command) checkCovers(songs []*db.Song) error {
 		})
 	}
 
+	cmd.rep.AddTotal(len(fs) * len(fns))
 	for _, f := range fs {
 		for _, fn := range fns {
 			if err := f(fn); err != nil {
@@ -313,8 +399,9 @@ func (cmd *Command) checkCovers(songs []*db.Song) error {
 				if s := songFns[fn]; s != "" {
 					key += " (" + s + ")"
 				}
-				fmt.Printf("%s: %v\n", key, err)
+				cmd.rep.Item(fn, "coverProblem", fmt.Sprintf("%s: %v", key, err))
 			}
+			cmd.rep.Advance(1)
 		}
 	}
 	return nil
@@ -0,0 +1,152 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package check
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/derat/nup/cmd/nup/client/files"
+	"github.com/derat/nup/server/db"
+)
+
+// dupeReason describes why songs in a dupeGroup are considered to be duplicates.
+type dupeReason string
+
+const (
+	dupeSHA1      dupeReason = "sha1"      // identical audio data under different filenames
+	dupeMetadata  dupeReason = "metadata"  // identical artist, title, and album
+	dupeRecording dupeReason = "recording" // same MusicBrainz recording on different albums
+)
+
+// dupeGroup describes a set of songs that are likely duplicates of each other.
+// It is JSON-marshaled when writing reports.
+type dupeGroup struct {
+	Reason dupeReason `json:"reason"`
+	Key    string     `json:"key"` // shared value, e.g. SHA1 or recording ID
+	Songs  []dupeSong `json:"songs"`
+}
+
+// dupeSong identifies a song within a dupeGroup.
+type dupeSong struct {
+	SongID   string `json:"songId"`
+	Filename string `json:"filename"`
+	Artist   string `json:"artist"`
+	Title    string `json:"title"`
+	Album    string `json:"album"`
+	AlbumID  string `json:"albumId,omitempty"`
+}
+
+// findDupes returns groups of likely-duplicate songs.
+// recIDs maps from song filenames to MusicBrainz recording IDs (which aren't included in
+// dumped songs). Groups are sorted by reason and key.
+func findDupes(songs []*db.Song, recIDs map[string]string) []dupeGroup {
+	bySHA1 := make(map[string][]*db.Song)
+	byMetadata := make(map[string][]*db.Song)
+	byRecording := make(map[string][]*db.Song)
+	for _, s := range songs {
+		if s.SHA1 != "" {
+			bySHA1[s.SHA1] = append(bySHA1[s.SHA1], s)
+		}
+		if s.Artist != "" && s.Title != "" {
+			key := normalizeForDupes(s.Artist) + " - " + normalizeForDupes(s.Title) +
+				" - " + normalizeForDupes(s.Album)
+			byMetadata[key] = append(byMetadata[key], s)
+		}
+		if id := recIDs[s.Filename]; id != "" {
+			byRecording[id] = append(byRecording[id], s)
+		}
+	}
+
+	var groups []dupeGroup
+	add := func(reason dupeReason, m map[string][]*db.Song, distinct func(s *db.Song) string) {
+		for key, ss := range m {
+			vals := make(map[string]struct{})
+			for _, s := range ss {
+				vals[distinct(s)] = struct{}{}
+			}
+			if len(vals) < 2 {
+				continue
+			}
+			g := dupeGroup{Reason: reason, Key: key}
+			for _, s := range ss {
+				g.Songs = append(g.Songs, dupeSong{
+					SongID:   s.SongID,
+					Filename: s.Filename,
+					Artist:   s.Artist,
+					Title:    s.Title,
+					Album:    s.Album,
+					AlbumID:  s.AlbumID,
+				})
+			}
+			sort.Slice(g.Songs, func(i, j int) bool { return g.Songs[i].Filename < g.Songs[j].Filename })
+			groups = append(groups, g)
+		}
+	}
+	add(dupeSHA1, bySHA1, func(s *db.Song) string { return s.Filename })
+	add(dupeMetadata, byMetadata, func(s *db.Song) string { return s.Filename })
+	add(dupeRecording, byRecording, func(s *db.Song) string { return s.AlbumID })
+
+	sort.Slice(groups, func(i, j int) bool {
+		if groups[i].Reason != groups[j].Reason {
+			return groups[i].Reason < groups[j].Reason
+		}
+		return groups[i].Key < groups[j].Key
+	})
+	return groups
+}
+
+// normalizeForDupes normalizes s for comparison while looking for duplicates.
+func normalizeForDupes(s string) string {
+	if norm, err := db.Normalize(s); err == nil {
+		s = norm
+	}
+	return strings.Join(strings.Fields(strings.ToLower(s)), " ")
+}
+
+// checkDupes looks for duplicate songs and prints them to stdout.
+// If cmd.dupesReport is non-empty, a JSON report is also written to it.
+func (cmd *Command) checkDupes(songs []*db.Song) error {
+	// Recording IDs aren't sent to the server, so read them from the local files.
+	recIDs := make(map[string]string, len(songs))
+	for _, s := range songs {
+		p := filepath.Join(cmd.Cfg.MusicDir, cmd.localFile(s))
+		local, err := files.ReadSong(cmd.Cfg, p, nil, files.SkipAudioData, nil /* gc */)
+		if err != nil {
+			continue // missing files are reported by another check
+		}
+		recIDs[s.Filename] = local.RecordingID
+	}
+
+	groups := findDupes(songs, recIDs)
+	for _, g := range groups {
+		msg := fmt.Sprintf("Duplicate %s %q:", g.Reason, g.Key)
+		for _, s := range g.Songs {
+			msg += fmt.Sprintf("\n  %s (%s)", s.SongID, s.Filename)
+		}
+		cmd.rep.Item(g.Key, "duplicate", msg)
+	}
+
+	if cmd.dupesReport == "" {
+		return nil
+	}
+	f, err := os.Create(cmd.dupesReport)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	if groups == nil {
+		groups = []dupeGroup{}
+	}
+	if err := enc.Encode(groups); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
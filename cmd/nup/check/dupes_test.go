@@ -0,0 +1,39 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package check
+
+import (
+	"testing"
+
+	"github.com/derat/nup/server/db"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestFindDupes(t *testing.T) {
+	songs := []*db.Song{
+		{SongID: "1", Filename: "a.mp3", SHA1: "111", Artist: "Artist", Title: "Song", Album: "Album", AlbumID: "al1"},
+		{SongID: "2", Filename: "b.mp3", SHA1: "111", Artist: "Other", Title: "Other", Album: "Other"},
+		{SongID: "3", Filename: "c.mp3", SHA1: "333", Artist: "ARTIST", Title: "Song ", Album: "Album", AlbumID: "al2"},
+		{SongID: "4", Filename: "d.mp3", SHA1: "444", Artist: "Artist", Title: "Different", Album: "Album", AlbumID: "al1"},
+		{SongID: "5", Filename: "e.mp3", SHA1: "555", Artist: "Someone", Title: "Else", Album: "Album", AlbumID: "al1"},
+	}
+	recIDs := map[string]string{
+		"a.mp3": "rec1",
+		"c.mp3": "rec1", // different album
+		"d.mp3": "rec2",
+		"e.mp3": "rec2", // same album
+	}
+
+	ds := func(s *db.Song) dupeSong {
+		return dupeSong{s.SongID, s.Filename, s.Artist, s.Title, s.Album, s.AlbumID}
+	}
+	want := []dupeGroup{
+		{dupeMetadata, "artist - song - album", []dupeSong{ds(songs[0]), ds(songs[2])}},
+		{dupeRecording, "rec1", []dupeSong{ds(songs[0]), ds(songs[2])}},
+		{dupeSHA1, "111", []dupeSong{ds(songs[0]), ds(songs[1])}},
+	}
+	if diff := cmp.Diff(want, findDupes(songs, recIDs)); diff != "" {
+		t.Error("findDupes returned unexpected groups:\n" + diff)
+	}
+}
@@ -0,0 +1,251 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package check
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"cloud.google.com/go/storage"
+
+	"github.com/derat/nup/cmd/nup/client/files"
+	"github.com/derat/nup/server/db"
+
+	"golang.org/x/oauth2/google"
+
+	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
+)
+
+const defaultGCSWorkers = 10 // default number of objects to download simultaneously
+
+// gcsState records objects whose SHA1s have already been verified so that
+// interrupted gcs-sha1 checks can be resumed.
+type gcsState struct {
+	f    *os.File         // nil if state isn't being saved
+	done map[string]int64 // generations of verified objects, keyed by name
+	mu   sync.Mutex
+}
+
+// gcsStateEntry is written as a line in a gcsState file.
+type gcsStateEntry struct {
+	Name       string `json:"name"`
+	Generation int64  `json:"generation"`
+}
+
+// openGCSState reads the state file at p (creating it if needed) and opens it for appending.
+// If p is empty, state is only tracked in memory.
+func openGCSState(p string) (*gcsState, error) {
+	st := gcsState{done: make(map[string]int64)}
+	if p == "" {
+		return &st, nil
+	}
+	var err error
+	if st.f, err = os.OpenFile(p, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644); err != nil {
+		return nil, err
+	}
+	sc := bufio.NewScanner(st.f)
+	for sc.Scan() {
+		var ent gcsStateEntry
+		// Skip partially-written lines from interrupted runs.
+		if err := json.Unmarshal(sc.Bytes(), &ent); err == nil {
+			st.done[ent.Name] = ent.Generation
+		}
+	}
+	if err := sc.Err(); err != nil {
+		st.f.Close()
+		return nil, err
+	}
+	return &st, nil
+}
+
+// verified returns true if the specified generation of the named object was already verified.
+func (st *gcsState) verified(name string, gen int64) bool {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	g, ok := st.done[name]
+	return ok && g == gen
+}
+
+// record records that the specified generation of the named object was verified.
+func (st *gcsState) record(name string, gen int64) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.done[name] = gen
+	if st.f == nil {
+		return nil
+	}
+	b, err := json.Marshal(gcsStateEntry{name, gen})
+	if err != nil {
+		return err
+	}
+	_, err = st.f.Write(append(b, '\n'))
+	return err
+}
+
+func (st *gcsState) close() error {
+	if st.f == nil {
+		return nil
+	}
+	return st.f.Close()
+}
+
+// gcsJob describes an object whose SHA1 should be verified.
+type gcsJob struct {
+	song *db.Song
+	gen  int64 // object generation
+}
+
+// gcsResult describes the result of a gcsJob.
+type gcsResult struct {
+	gcsJob
+	sha1 string
+	err  error
+}
+
+// computeObjectSHA1 downloads the specified generation of the named object in bucket
+// and returns the SHA1 of its audio data (see files.ComputeSHA1).
+func computeObjectSHA1(ctx context.Context, bucket *storage.BucketHandle,
+	name string, gen int64) (string, error) {
+	r, err := bucket.Object(name).Generation(gen).NewReader(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+
+	// The mpeg package needs a file, so stream the object to a temporary one.
+	tf, err := ioutil.TempFile("", "nup-check-gcs.")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tf.Name())
+	defer tf.Close()
+
+	if _, err := io.Copy(tf, r); err != nil {
+		return "", err
+	}
+	if _, err := tf.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	return files.ComputeSHA1(tf)
+}
+
+// checkGCSSHA1 downloads songs' objects from cmd.bucket and compares their SHA1s
+// against the dumped SHA1s, reporting mismatched and missing objects. Objects that
+// were transcoded from lossless files are instead compared against cmd.index's MD5s.
+func (cmd *Command) checkGCSSHA1(ctx context.Context, songs []*db.Song) error {
+	st, err := openGCSState(cmd.gcsStateFile)
+	if err != nil {
+		return fmt.Errorf("failed opening state: %v", err)
+	}
+	defer st.close()
+
+	creds, err := google.FindDefaultCredentials(ctx,
+		"https://www.googleapis.com/auth/devstorage.read_only",
+	)
+	if err != nil {
+		return fmt.Errorf("failed finding credentials: %v", err)
+	}
+	client, err := storage.NewClient(ctx, option.WithCredentials(creds))
+	if err != nil {
+		return fmt.Errorf("failed creating client: %v", err)
+	}
+	defer client.Close()
+
+	byName := make(map[string]*db.Song, len(songs))
+	for _, s := range songs {
+		byName[s.Filename] = s
+	}
+
+	// List the objects synchronously so we know how many jobs we'll have.
+	var jobs []gcsJob
+	var numSkipped int
+	found := make(map[string]struct{}, len(songs))
+	bucket := client.Bucket(cmd.bucket)
+	it := bucket.Objects(ctx, &storage.Query{Prefix: ""})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		} else if err != nil {
+			return fmt.Errorf("failed listing objects in %v: %v", cmd.bucket, err)
+		}
+		s, ok := byName[attrs.Name]
+		if !ok {
+			continue
+		}
+		found[attrs.Name] = struct{}{}
+		if src, ok := cmd.index.Source(attrs.Name); ok {
+			// Dumped SHA1s of transcoded songs describe the lossless files' audio data,
+			// so compare the objects against the MD5s recorded when they were uploaded.
+			rec, _ := cmd.index.Get(src)
+			if sum := hex.EncodeToString(attrs.MD5); sum != rec.MD5 {
+				cmd.rep.Item(s.Filename, "md5Mismatch",
+					fmt.Sprintf("%s (%s): object MD5 %s doesn't match transcoded MD5 %s",
+						s.SongID, s.Filename, sum, rec.MD5))
+			} else {
+				cmd.rep.Item(s.Filename, "verified", "")
+			}
+			continue
+		}
+		if st.verified(attrs.Name, attrs.Generation) {
+			numSkipped++
+			continue
+		}
+		jobs = append(jobs, gcsJob{s, attrs.Generation})
+	}
+	cmd.rep.Count("previouslyVerified", numSkipped)
+
+	for _, s := range songs {
+		if _, ok := found[s.Filename]; !ok {
+			cmd.rep.Item(s.Filename, "missingObject",
+				fmt.Sprintf("%s (%s): object missing from %v", s.SongID, s.Filename, cmd.bucket))
+		}
+	}
+
+	// See https://gobyexample.com/worker-pools.
+	jobChan := make(chan gcsJob, len(jobs))
+	resChan := make(chan gcsResult, len(jobs))
+	for i := 0; i < cmd.gcsWorkers; i++ {
+		go func() {
+			for j := range jobChan {
+				sum, err := computeObjectSHA1(ctx, bucket, j.song.Filename, j.gen)
+				resChan <- gcsResult{j, sum, err}
+			}
+		}()
+	}
+	for _, j := range jobs {
+		jobChan <- j
+	}
+	close(jobChan)
+
+	cmd.rep.AddTotal(len(jobs))
+	for range jobs {
+		res := <-resChan
+		s := res.song
+		switch {
+		case res.err != nil:
+			cmd.rep.Item(s.Filename, "gcsError",
+				fmt.Sprintf("%s (%s): failed reading object: %v", s.SongID, s.Filename, res.err))
+		case res.sha1 != s.SHA1:
+			cmd.rep.Item(s.Filename, "sha1Mismatch",
+				fmt.Sprintf("%s (%s): object SHA1 %s doesn't match dumped SHA1 %s",
+					s.SongID, s.Filename, res.sha1, s.SHA1))
+		default:
+			if err := st.record(s.Filename, res.gen); err != nil {
+				return fmt.Errorf("failed saving state: %v", err)
+			}
+			cmd.rep.Item(s.Filename, "verified", "")
+		}
+		cmd.rep.Advance(1)
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package check
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestGCSState(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "state.json")
+	st, err := openGCSState(p)
+	if err != nil {
+		t.Fatal("openGCSState failed:", err)
+	}
+	for _, ent := range []gcsStateEntry{{"a.mp3", 1}, {"b.mp3", 2}, {"a.mp3", 3}} {
+		if err := st.record(ent.Name, ent.Generation); err != nil {
+			t.Fatalf("record(%q, %d) failed: %v", ent.Name, ent.Generation, err)
+		}
+	}
+	if err := st.close(); err != nil {
+		t.Fatal("close failed:", err)
+	}
+
+	// Simulate a line that was only partially written when the process was killed.
+	f, err := os.OpenFile(p, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteString(`{"name":"c.mp3","gen`); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	if st, err = openGCSState(p); err != nil {
+		t.Fatal("openGCSState failed on reopen:", err)
+	}
+	defer st.close()
+	for _, tc := range []struct {
+		name string
+		gen  int64
+		want bool
+	}{
+		{"a.mp3", 1, false}, // superseded by generation 3
+		{"a.mp3", 3, true},
+		{"b.mp3", 2, true},
+		{"b.mp3", 4, false},
+		{"c.mp3", 0, false},
+		{"d.mp3", 1, false},
+	} {
+		if got := st.verified(tc.name, tc.gen); got != tc.want {
+			t.Errorf("verified(%q, %d) = %v; want %v", tc.name, tc.gen, got, tc.want)
+		}
+	}
+}
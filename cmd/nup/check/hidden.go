@@ -0,0 +1,174 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package check
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/derat/nup/server/db"
+)
+
+const (
+	silenceNoise      = "-50dB" // max level considered to be silence by ffmpeg
+	minSilenceSec     = 10      // min silence duration to report
+	minHiddenAudioSec = 5       // min audio after a silence for it to be reported as a hidden track
+	silenceEdgeSec    = 0.5     // max distance from a file's start or end for leading/trailing silence
+
+	longSongFactor        = 3       // min multiple of album median length to report a song as long
+	longSongMinSec        = 10 * 60 // min length for a song to be reported as long
+	longSongMinAlbumSongs = 3       // min number of songs in an album to compute its median length
+)
+
+// silence describes a period of silence within a song, in seconds.
+type silence struct{ start, end float64 }
+
+var silenceRegexp = regexp.MustCompile(`silence_(start|end): (-?[\d.]+)`)
+
+// parseSilenceDetectOutput parses silence periods from the output of ffmpeg's silencedetect filter.
+// If the final period has no end, it is assumed to extend to length.
+func parseSilenceDetectOutput(out string, length float64) ([]silence, error) {
+	var sils []silence
+	open := false
+	for _, ln := range strings.Split(out, "\n") {
+		ms := silenceRegexp.FindStringSubmatch(ln)
+		if ms == nil {
+			continue
+		}
+		v, err := strconv.ParseFloat(ms[2], 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad value in %q", ln)
+		}
+		switch ms[1] {
+		case "start":
+			if open {
+				return nil, fmt.Errorf("unexpected start in %q", ln)
+			}
+			if v < 0 {
+				v = 0
+			}
+			sils = append(sils, silence{start: v})
+			open = true
+		case "end":
+			if !open {
+				return nil, fmt.Errorf("unexpected end in %q", ln)
+			}
+			sils[len(sils)-1].end = v
+			open = false
+		}
+	}
+	if open {
+		sils[len(sils)-1].end = length
+	}
+	return sils, nil
+}
+
+// findHiddenTrackProblems returns descriptions of long leading or trailing silences
+// or possible hidden tracks in a song of the supplied length containing sils.
+func findHiddenTrackProblems(length float64, sils []silence) []string {
+	var probs []string
+	for _, s := range sils {
+		dur := s.end - s.start
+		if dur < minSilenceSec {
+			continue
+		}
+		switch {
+		case s.end >= length-silenceEdgeSec:
+			probs = append(probs, fmt.Sprintf("%.1f sec of trailing silence at %s", dur, formatSec(s.start)))
+		case s.start <= silenceEdgeSec:
+			probs = append(probs, fmt.Sprintf("%.1f sec of leading silence", dur))
+		case length-s.end >= minHiddenAudioSec:
+			probs = append(probs, fmt.Sprintf("possible hidden track at %s after %.1f sec of silence",
+				formatSec(s.end), dur))
+		}
+	}
+	return probs
+}
+
+// findLongSongs returns songs that are much longer than the median song on their albums,
+// suggesting that they may contain multiple songs. Values are descriptions.
+func findLongSongs(songs []*db.Song) map[*db.Song]string {
+	albums := make(map[string][]*db.Song)
+	for _, s := range songs {
+		if s.AlbumID != "" {
+			albums[s.AlbumID] = append(albums[s.AlbumID], s)
+		}
+	}
+	long := make(map[*db.Song]string)
+	for _, ss := range albums {
+		if len(ss) < longSongMinAlbumSongs {
+			continue
+		}
+		lens := make([]float64, len(ss))
+		for i, s := range ss {
+			lens[i] = s.Length
+		}
+		sort.Float64s(lens)
+		med := lens[len(lens)/2]
+		if len(lens)%2 == 0 {
+			med = (lens[len(lens)/2-1] + lens[len(lens)/2]) / 2
+		}
+		for _, s := range ss {
+			if s.Length >= longSongMinSec && s.Length >= longSongFactor*med {
+				long[s] = fmt.Sprintf("length %s is much longer than album median %s",
+					formatSec(s.Length), formatSec(med))
+			}
+		}
+	}
+	return long
+}
+
+// formatSec formats sec as "m:ss".
+func formatSec(sec float64) string {
+	return fmt.Sprintf("%d:%02d", int(sec)/60, int(sec)%60)
+}
+
+// detectSilence runs ffmpeg's silencedetect filter on the file at p.
+func detectSilence(p string, length float64) ([]silence, error) {
+	cmd := exec.Command("ffmpeg", "-hide_banner", "-nostats", "-i", p,
+		"-af", fmt.Sprintf("silencedetect=noise=%s:d=%d", silenceNoise, minSilenceSec),
+		"-f", "null", "-")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		if errors.Is(err, exec.ErrNotFound) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("ffmpeg failed: %v", err)
+	}
+	return parseSilenceDetectOutput(string(out), length)
+}
+
+func (cmd *Command) checkHiddenTracks(songs []*db.Song) error {
+	long := findLongSongs(songs)
+	cmd.rep.AddTotal(len(songs))
+	for _, s := range songs {
+		var probs []string
+		if msg, ok := long[s]; ok {
+			probs = append(probs, msg)
+		}
+		p := filepath.Join(cmd.Cfg.MusicDir, cmd.localFile(s))
+		if _, err := os.Stat(p); err == nil { // missing files are reported by another check
+			sils, err := detectSilence(p, s.Length)
+			if errors.Is(err, exec.ErrNotFound) {
+				return errors.New("ffmpeg not found")
+			} else if err != nil {
+				probs = append(probs, fmt.Sprintf("failed detecting silence: %v", err))
+			} else {
+				probs = append(probs, findHiddenTrackProblems(s.Length, sils)...)
+			}
+		}
+		for _, msg := range probs {
+			cmd.rep.Item(s.Filename, "hiddenTrack", fmt.Sprintf("%s (%s): %s", s.SongID, s.Filename, msg))
+		}
+		cmd.rep.Advance(1)
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package check
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/derat/nup/server/db"
+)
+
+func TestParseSilenceDetectOutput(t *testing.T) {
+	const out = `Input #0, mp3, from 'song.mp3':
+  Duration: 00:10:00.00, start: 0.025057, bitrate: 320 kb/s
+[silencedetect @ 0x55d5c0c2a0c0] silence_start: -0.0250567
+[silencedetect @ 0x55d5c0c2a0c0] silence_end: 12.5 | silence_duration: 12.5250567
+[silencedetect @ 0x55d5c0c2a0c0] silence_start: 240.25
+[silencedetect @ 0x55d5c0c2a0c0] silence_end: 300 | silence_duration: 59.75
+[silencedetect @ 0x55d5c0c2a0c0] silence_start: 580
+size=N/A time=00:10:00.00 bitrate=N/A speed= 512x
+`
+	want := []silence{{0, 12.5}, {240.25, 300}, {580, 600}}
+	if got, err := parseSilenceDetectOutput(out, 600); err != nil {
+		t.Error("parseSilenceDetectOutput failed:", err)
+	} else if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseSilenceDetectOutput returned %v; want %v", got, want)
+	}
+
+	if _, err := parseSilenceDetectOutput("silence_end: 5 | silence_duration: 5", 10); err == nil {
+		t.Error("parseSilenceDetectOutput unexpectedly succeeded for end without start")
+	}
+}
+
+func TestFindHiddenTrackProblems(t *testing.T) {
+	for _, tc := range []struct {
+		length float64
+		sils   []silence
+		want   []string
+	}{
+		{300, nil, nil},
+		{300, []silence{{100, 105}, {298, 300}}, nil}, // too short
+		{300, []silence{{0, 12.5}}, []string{"12.5 sec of leading silence"}},
+		{300, []silence{{240, 300}}, []string{"60.0 sec of trailing silence at 4:00"}},
+		{600, []silence{{240.25, 300}}, []string{"possible hidden track at 5:00 after 59.8 sec of silence"}},
+		{303, []silence{{240, 300}}, nil}, // too little audio after silence
+	} {
+		if got := findHiddenTrackProblems(tc.length, tc.sils); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("findHiddenTrackProblems(%v, %v) = %q; want %q", tc.length, tc.sils, got, tc.want)
+		}
+	}
+}
+
+func TestFindLongSongs(t *testing.T) {
+	mk := func(album string, length float64) *db.Song {
+		return &db.Song{AlbumID: album, Length: length}
+	}
+	normal := mk("a", 240)
+	long := mk("a", 1500)
+	songs := []*db.Song{
+		normal, mk("a", 200), mk("a", 260), long,
+		mk("b", 1500), mk("b", 200), // too few songs in album
+		mk("", 3000), // not on an album
+	}
+	got := findLongSongs(songs)
+	if len(got) != 1 || got[long] == "" {
+		t.Errorf("findLongSongs returned %v; want only %v", got, long)
+	}
+	if want := "length 25:00 is much longer than album median 4:10"; got[long] != want {
+		t.Errorf("findLongSongs gave %q; want %q", got[long], want)
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"net/http"
 	"net/url"
 	"os"
 	"path/filepath"
@@ -22,11 +23,40 @@ type Config struct {
 	Username string `json:"username"`
 	// Password contains an HTTP basic auth password.
 	Password string `json:"password"`
+	// APIToken contains an API token created via the server's /create_api_token endpoint
+	// (e.g. using the token subcommand). If non-empty, it is sent instead of Username and
+	// Password.
+	APIToken string `json:"apiToken"`
+	// Library contains the name of the server library (see the server's Config.Libraries)
+	// that songs should be sent to and dumped from. If empty, the main library is used.
+	Library string `json:"library"`
 
 	// CoverDir is the base directory containing cover art.
 	CoverDir string `json:"coverDir"`
+	// CoverBucket contains the name of the Google Cloud Storage bucket containing cover art.
+	// It is used by the covers command's gc action.
+	CoverBucket string `json:"coverBucket"`
 	// MusicDir is the base directory containing song files.
 	MusicDir string `json:"musicDir"`
+	// SongBucket contains the name of the Google Cloud Storage bucket containing song files.
+	// It is used by the storage command.
+	SongBucket string `json:"songBucket"`
+	// TranscodeFormat contains the lossy format ("mp3" or "opus") that lossless FLAC files in
+	// MusicDir are transcoded to before being uploaded to SongBucket by the update command's
+	// -upload flag. The FLAC files are kept locally and songs are sent to the server with the
+	// transcoded files' names. If empty, FLAC files are ignored.
+	TranscodeFormat string `json:"transcodeFormat"`
+	// TranscodeBitrate contains the bitrate in kbit/sec used when transcoding FLAC files.
+	// If zero, 256 is used for MP3 and 160 is used for Opus.
+	TranscodeBitrate int `json:"transcodeBitrate"`
+	// TranscodeIndexFile is the path to a JSON file recording the audio hashes of transcoded
+	// FLAC files and the hashes of the uploaded lossy files, so that unchanged files aren't
+	// transcoded and uploaded again. $HOME/.nup/transcodes.json will be used by default.
+	TranscodeIndexFile string `json:"transcodeIndexFile"`
+	// StorageRules is used by the storage command to choose songs' storage classes.
+	// The first matching rule is used, and songs that don't match any rules use the
+	// STANDARD class. If empty, a single rule is created from the command's flags.
+	StorageRules []StorageRule `json:"storageRules"`
 	// MetadataDir is the base directory containing JSON files that override song metadata.
 	// $HOME/.nup/metadata will be used by default.
 	MetadataDir string `json:"metadataDir"`
@@ -37,9 +67,31 @@ type Config struct {
 	// ComputeGain indicates whether the mp3gain program should be used to compute per-song
 	// and per-album gain information so that volume can be normalized during playback.
 	ComputeGain bool `json:"computeGain"`
+	// ReadGainTags indicates whether ReplayGain information should be read from
+	// REPLAYGAIN_TRACK_GAIN, REPLAYGAIN_ALBUM_GAIN, and REPLAYGAIN_TRACK_PEAK ID3 TXXX
+	// frames (e.g. as written by beets) when present. If ComputeGain is also true,
+	// mp3gain is only used for songs that lack these frames.
+	ReadGainTags bool `json:"readGainTags"`
+	// DetectSilence indicates whether the ffmpeg program should be used to decode songs and
+	// find leading and trailing silence so that players can trim it or schedule crossfades.
+	DetectSilence bool `json:"detectSilence"`
+	// ComputeLoudness indicates whether the ffmpeg program should be used to measure songs'
+	// EBU R128 integrated loudness and true peak so that players can normalize playback
+	// to a LUFS target.
+	ComputeLoudness bool `json:"computeLoudness"`
+	// IdentifyUntagged indicates whether the fpcalc program (from Chromaprint) and the AcoustID
+	// web service should be used to look up MusicBrainz recording and album IDs for songs whose
+	// tags lack recording IDs. AcoustIDKey must also be set.
+	IdentifyUntagged bool `json:"identifyUntagged"`
+	// AcoustIDKey contains an AcoustID application API key. See https://acoustid.org/webservice.
+	AcoustIDKey string `json:"acoustidKey"`
+	// RewriteRules lists changes that should be made to metadata read from song files, in the
+	// order in which they should be applied. This can be used to fix incorrectly-tagged files
+	// without needing to reupload them.
+	RewriteRules []RewriteRule `json:"rewriteRules"`
 	// ArtistRewrites maps from original ID3 tag artist names to replacement names that should
-	// be used for updates. This can be used to fix incorrectly-tagged files without needing to
-	// reupload them.
+	// be used for updates. It is deprecated in favor of RewriteRules: LoadConfig converts its
+	// entries to exact-match artist rules at the beginning of RewriteRules and clears it.
 	ArtistRewrites map[string]string `json:"artistRewrites"`
 	// AlbumIDRewrites maps from original ID3 tag album IDs (i.e. MusicBrainz UUIDs) to
 	// replacement IDs that should be used for updates. If the album name ends with the suffix
@@ -49,6 +101,24 @@ type Config struct {
 	AlbumIDRewrites map[string]string `json:"albumIdRewrites"`
 }
 
+// StorageRule describes songs that should use a colder Google Cloud Storage class.
+// Songs must satisfy all of the rule's conditions to match.
+type StorageRule struct {
+	// Class contains the storage class for matching songs ("NEARLINE", "COLDLINE", or "ARCHIVE").
+	Class string `json:"class"`
+	// MaxRating contains the maximum rating of matching songs. If zero, songs match regardless
+	// of their ratings. Otherwise, unrated songs only match if Unrated is true.
+	MaxRating int `json:"maxRating"`
+	// Unrated indicates whether unrated songs can match when MaxRating is non-zero.
+	Unrated bool `json:"unrated"`
+	// MinIdleDays contains the minimum number of days since matching songs were last played.
+	// Songs that have never been played always satisfy this condition.
+	MinIdleDays int `json:"minIdleDays"`
+	// MaxPlays contains the maximum number of plays of matching songs.
+	// If nil, songs match regardless of their play counts.
+	MaxPlays *int `json:"maxPlays"`
+}
+
 // LoadConfig loads a JSON-marshaled Config from the file at p and updates dst.
 func LoadConfig(p string, dst *Config) error {
 	f, err := os.Open(p)
@@ -64,6 +134,20 @@ func LoadConfig(p string, dst *Config) error {
 	if err := dst.checkServerURL(); err != nil {
 		return err
 	}
+	if dst.IdentifyUntagged && dst.AcoustIDKey == "" {
+		return errors.New("identifyUntagged requires acoustidKey")
+	}
+	switch dst.TranscodeFormat {
+	case "", "mp3", "opus":
+	default:
+		return fmt.Errorf("bad transcodeFormat %q", dst.TranscodeFormat)
+	}
+	if dst.TranscodeBitrate < 0 {
+		return errors.New("transcodeBitrate must be non-negative")
+	}
+	if err := dst.initRewriteRules(); err != nil {
+		return err
+	}
 	dotDir := filepath.Join(os.Getenv("HOME"), ".nup")
 	if dst.MetadataDir == "" {
 		dst.MetadataDir = filepath.Join(dotDir, "metadata")
@@ -71,6 +155,9 @@ func LoadConfig(p string, dst *Config) error {
 	if dst.LastUpdateInfoFile == "" {
 		dst.LastUpdateInfoFile = filepath.Join(dotDir, "last_update_info.json")
 	}
+	if dst.TranscodeIndexFile == "" {
+		dst.TranscodeIndexFile = filepath.Join(dotDir, "transcodes.json")
+	}
 	return nil
 }
 
@@ -84,6 +171,15 @@ func (cfg *Config) GetURL(path string) *url.URL {
 	return u
 }
 
+// SetAuth adds credentials from cfg to req.
+func (cfg *Config) SetAuth(req *http.Request) {
+	if cfg.APIToken != "" {
+		req.Header.Set("Authorization", "Bearer "+cfg.APIToken)
+	} else {
+		req.SetBasicAuth(cfg.Username, cfg.Password)
+	}
+}
+
 // checkServerURL returns an error if cfg.ServerURL is unset or malformed.
 func (cfg *Config) checkServerURL() error {
 	if cfg.ServerURL == "" {
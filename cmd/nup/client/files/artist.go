@@ -0,0 +1,90 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package files
+
+import (
+	"strings"
+
+	"github.com/derat/nup/server/db"
+	"github.com/derat/taglib-go/taglib"
+	"github.com/derat/taglib-go/taglib/id3"
+)
+
+const (
+	artistsTag  = "ARTISTS"               // individual artist names written by Picard
+	artistIDTag = "MusicBrainz Artist Id" // MBIDs corresponding to artistsTag
+)
+
+// getCustomFrameValues returns the values from tag's TXXX frame with the supplied description.
+// taglib.GenericTag.CustomFrames only returns single-valued frames, but Picard writes
+// multiple NUL-separated values to frames like "ARTISTS" in ID3v2.4 tags. Values in
+// ID3v2.3 tags are joined with '/' by Picard and are left unsplit, since the separator
+// can't be distinguished from names like "AC/DC".
+func getCustomFrameValues(tag taglib.GenericTag, desc string) []string {
+	var frames [][]string
+	switch t := tag.(type) {
+	case *id3.Id3v23Tag:
+		for _, f := range t.Frames["TXXX"] {
+			if fields, err := id3.GetId3v23TextIdentificationFrame(f); err == nil {
+				frames = append(frames, fields)
+			}
+		}
+	case *id3.Id3v24Tag:
+		for _, f := range t.Frames["TXXX"] {
+			if fields, err := id3.GetId3v24TextIdentificationFrame(f); err == nil {
+				frames = append(frames, fields)
+			}
+		}
+	}
+
+	for _, fields := range frames {
+		if len(fields) < 2 || fields[0] != desc {
+			continue
+		}
+		var vals []string
+		for _, v := range fields[1:] {
+			if v = strings.TrimSpace(v); v != "" {
+				vals = append(vals, v)
+			}
+		}
+		return vals
+	}
+	return nil
+}
+
+// makeArtistCredits returns credits for the artists in names, which appear in the song's
+// full artist credit string (e.g. "A feat. B"). mbids is used to set the artists'
+// MusicBrainz IDs if it contains the same number of values as names. Join phrases are
+// taken from the text between the names in artist; if the names can't all be found
+// in order, the join phrases are left empty. nil is returned if names is empty.
+func makeArtistCredits(artist string, names, mbids []string) []db.ArtistCredit {
+	if len(names) == 0 {
+		return nil
+	}
+	credits := make([]db.ArtistCredit, len(names))
+	for i, name := range names {
+		credits[i].Name = name
+		if len(mbids) == len(names) {
+			credits[i].MBID = mbids[i]
+		}
+	}
+
+	phrases := make([]string, len(names))
+	var pos int // position in artist after end of previous name
+	for i, name := range names {
+		idx := strings.Index(artist[pos:], name)
+		if idx < 0 || (i == 0 && idx != 0) {
+			return credits
+		}
+		if i > 0 {
+			phrases[i-1] = artist[pos : pos+idx]
+		}
+		pos += idx + len(name)
+	}
+	phrases[len(phrases)-1] = artist[pos:]
+	for i := range credits {
+		credits[i].JoinPhrase = phrases[i]
+	}
+	return credits
+}
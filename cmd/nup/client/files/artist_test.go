@@ -0,0 +1,45 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package files
+
+import (
+	"testing"
+
+	"github.com/derat/nup/server/db"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestMakeArtistCredits(t *testing.T) {
+	for _, tc := range []struct {
+		artist string
+		names  []string
+		mbids  []string
+		want   []db.ArtistCredit
+	}{
+		{"A", nil, nil, nil},
+		{"A", []string{"A"}, []string{"id-a"}, []db.ArtistCredit{{Name: "A", MBID: "id-a"}}},
+		{"A feat. B", []string{"A", "B"}, []string{"id-a", "id-b"},
+			[]db.ArtistCredit{
+				{Name: "A", MBID: "id-a", JoinPhrase: " feat. "},
+				{Name: "B", MBID: "id-b"},
+			}},
+		{"A, B & C", []string{"A", "B", "C"}, nil,
+			[]db.ArtistCredit{{Name: "A", JoinPhrase: ", "}, {Name: "B", JoinPhrase: " & "}, {Name: "C"}}},
+		{"A (with B)", []string{"A", "B"}, nil,
+			[]db.ArtistCredit{{Name: "A", JoinPhrase: " (with "}, {Name: "B", JoinPhrase: ")"}}},
+		// MBIDs are dropped if they can't be matched up with names.
+		{"A & B", []string{"A", "B"}, []string{"id-a"},
+			[]db.ArtistCredit{{Name: "A", JoinPhrase: " & "}, {Name: "B"}}},
+		// Join phrases are left empty if the names don't all appear in order.
+		{"A & B", []string{"B", "A"}, nil, []db.ArtistCredit{{Name: "B"}, {Name: "A"}}},
+		{"The A & B", []string{"A", "B"}, nil, []db.ArtistCredit{{Name: "A"}, {Name: "B"}}},
+		{"Ａ & B", []string{"A", "B"}, nil, []db.ArtistCredit{{Name: "A"}, {Name: "B"}}},
+	} {
+		got := makeArtistCredits(tc.artist, tc.names, tc.mbids)
+		if diff := cmp.Diff(tc.want, got); diff != "" {
+			t.Errorf("makeArtistCredits(%q, %q, %q) didn't return expected credits:\n%s",
+				tc.artist, tc.names, tc.mbids, diff)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package files
+
+import (
+	"bytes"
+	"errors"
+	"os"
+
+	"github.com/derat/taglib-go/taglib"
+	"github.com/derat/taglib-go/taglib/id3"
+)
+
+// frontCoverPictureType is the APIC and FLAC PICTURE type used for front covers.
+const frontCoverPictureType = 3
+
+// embeddedPicture describes an image embedded in a song file.
+type embeddedPicture struct {
+	mimeType string
+	picType  uint32
+	data     []byte
+}
+
+// ReadEmbeddedCover returns the image embedded in an APIC frame in the ID3v2 tag or in a
+// PICTURE metadata block in the FLAC file at p. The front cover is preferred if multiple
+// images are present. The image's data and MIME type (e.g. "image/jpeg") are returned.
+// If the file doesn't contain an image, nil data and an empty MIME type are returned.
+func ReadEmbeddedCover(p string) (data []byte, mimeType string, err error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, "", err
+	}
+	defer f.Close()
+
+	var pics []embeddedPicture
+	if isFLAC, err := isFLACFile(f); err != nil {
+		return nil, "", err
+	} else if isFLAC {
+		md, err := readFLACMetadata(f)
+		if err != nil {
+			return nil, "", err
+		}
+		pics = md.pictures
+	} else if pics, err = readAPICPictures(f); err != nil {
+		return nil, "", err
+	}
+
+	for _, pic := range pics {
+		if data == nil || pic.picType == frontCoverPictureType {
+			data, mimeType = pic.data, pic.mimeType
+		}
+		if pic.picType == frontCoverPictureType {
+			break
+		}
+	}
+	return data, mimeType, nil
+}
+
+// readAPICPictures returns the images from APIC frames in the ID3v2 tag in f.
+func readAPICPictures(f *os.File) ([]embeddedPicture, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	tag, err := taglib.Decode(f, fi.Size())
+	if err != nil {
+		return nil, err
+	}
+
+	var frames [][]byte
+	switch t := tag.(type) {
+	case *id3.Id3v23Tag:
+		for _, fr := range t.Frames["APIC"] {
+			frames = append(frames, fr.Content)
+		}
+	case *id3.Id3v24Tag:
+		for _, fr := range t.Frames["APIC"] {
+			frames = append(frames, fr.Content)
+		}
+	}
+
+	pics := make([]embeddedPicture, 0, len(frames))
+	for _, b := range frames {
+		mt, pt, d, err := parseAPIC(b)
+		if err != nil {
+			return nil, err
+		}
+		pics = append(pics, embeddedPicture{mt, uint32(pt), d})
+	}
+	return pics, nil
+}
+
+// parseAPIC parses the content of an ID3v2.3 or ID3v2.4 APIC (attached picture) frame.
+func parseAPIC(b []byte) (mimeType string, picType byte, data []byte, err error) {
+	if len(b) < 1 {
+		return "", 0, nil, errors.New("empty frame")
+	}
+	enc := b[0]
+	b = b[1:]
+
+	// The MIME type is always a null-terminated ISO-8859-1 string.
+	i := bytes.IndexByte(b, 0)
+	if i < 0 || i+1 >= len(b) {
+		return "", 0, nil, errors.New("missing MIME type")
+	}
+	mimeType = string(b[:i])
+	picType = b[i+1]
+	b = b[i+2:]
+
+	// Skip the description, which is terminated by one or two null bytes depending on the
+	// text encoding: 0 is ISO-8859-1, 1 is UTF-16 with BOM, 2 is UTF-16BE, and 3 is UTF-8.
+	switch enc {
+	case 0, 3:
+		if i = bytes.IndexByte(b, 0); i < 0 {
+			return "", 0, nil, errors.New("unterminated description")
+		}
+		b = b[i+1:]
+	case 1, 2:
+		for i = 0; ; i += 2 {
+			if i+1 >= len(b) {
+				return "", 0, nil, errors.New("unterminated description")
+			}
+			if b[i] == 0 && b[i+1] == 0 {
+				break
+			}
+		}
+		b = b[i+2:]
+	default:
+		return "", 0, nil, errors.New("invalid text encoding")
+	}
+
+	if len(b) == 0 {
+		return "", 0, nil, errors.New("no image data")
+	}
+	// Some taggers write "jpg" or "png" instead of a full MIME type.
+	if mimeType != "" && !bytes.Contains([]byte(mimeType), []byte("/")) {
+		mimeType = "image/" + mimeType
+	}
+	return mimeType, picType, b, nil
+}
@@ -0,0 +1,69 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package files
+
+import (
+	"bytes"
+	"image/jpeg"
+	"path/filepath"
+	"testing"
+
+	"github.com/derat/nup/test"
+)
+
+func TestReadEmbeddedCover_FLAC(t *testing.T) {
+	dir := t.TempDir()
+	test.Must(t, test.CopySongs(dir, test.CoverFLACFile))
+	data, mimeType, err := ReadEmbeddedCover(filepath.Join(dir, test.CoverFLACFile))
+	if err != nil {
+		t.Fatal("ReadEmbeddedCover failed: ", err)
+	}
+	if mimeType != "image/jpeg" {
+		t.Errorf("ReadEmbeddedCover returned MIME type %q; want %q", mimeType, "image/jpeg")
+	}
+	if _, err := jpeg.Decode(bytes.NewReader(data)); err != nil {
+		t.Error("Failed decoding front cover: ", err)
+	}
+}
+
+func TestParseAPIC(t *testing.T) {
+	img := []byte{0xff, 0xd8, 0xff, 0x00, 0x01}
+	join := func(parts ...[]byte) []byte { return bytes.Join(parts, nil) }
+
+	for _, tc := range []struct {
+		name     string
+		frame    []byte
+		mimeType string
+		picType  byte
+		ok       bool
+	}{
+		{"latin1", join([]byte{0}, []byte("image/jpeg\x00"), []byte{3}, []byte("Cover\x00"), img),
+			"image/jpeg", 3, true},
+		{"utf8_empty_desc", join([]byte{3}, []byte("image/png\x00"), []byte{0}, []byte{0}, img),
+			"image/png", 0, true},
+		{"utf16", join([]byte{1}, []byte("image/jpeg\x00"), []byte{4},
+			[]byte{0xff, 0xfe, 'a', 0, 0, 0}, img), "image/jpeg", 4, true},
+		{"short_mime", join([]byte{0}, []byte("jpg\x00"), []byte{3}, []byte{0}, img),
+			"image/jpg", 3, true},
+		{"empty", nil, "", 0, false},
+		{"no_mime_end", join([]byte{0}, []byte("image/jpeg")), "", 0, false},
+		{"no_desc_end", join([]byte{0}, []byte("image/jpeg\x00"), []byte{3}, []byte("abc")), "", 0, false},
+		{"bad_enc", join([]byte{7}, []byte("image/jpeg\x00"), []byte{3}, []byte{0}, img), "", 0, false},
+		{"no_data", join([]byte{0}, []byte("image/jpeg\x00"), []byte{3}, []byte{0}), "", 0, false},
+	} {
+		mt, pt, data, err := parseAPIC(tc.frame)
+		if !tc.ok {
+			if err == nil {
+				t.Errorf("%s: parseAPIC unexpectedly succeeded", tc.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: parseAPIC failed: %v", tc.name, err)
+		} else if mt != tc.mimeType || pt != tc.picType || !bytes.Equal(data, img) {
+			t.Errorf("%s: parseAPIC returned %q, %v, %v; want %q, %v, %v",
+				tc.name, mt, pt, data, tc.mimeType, tc.picType, img)
+		}
+	}
+}
@@ -0,0 +1,258 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package files
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/derat/nup/cmd/nup/client"
+	"github.com/derat/nup/server/db"
+)
+
+// cueFramesPerSec is the number of frames per second in cue sheet timestamps.
+const cueFramesPerSec = 75
+
+// CueSheet describes a cue sheet listing the tracks in a single audio file
+// (e.g. a rip of an entire album).
+type CueSheet struct {
+	Performer string // album artist
+	Title     string // album title
+	File      string // audio file path relative to the cue sheet's directory
+	Tracks    []CueTrack
+}
+
+// CueTrack describes a track within a CueSheet.
+type CueTrack struct {
+	Number    int
+	Title     string
+	Performer string  // may be empty if the track's artist matches the album's
+	Start     float64 // starting position in seconds within CueSheet.File
+}
+
+// IsCuePath returns true if path p has an extension suggesting that it's a cue sheet.
+func IsCuePath(p string) bool {
+	return strings.ToLower(filepath.Ext(p)) == ".cue"
+}
+
+// ReadCueSheet reads and parses the cue sheet at p.
+func ReadCueSheet(p string) (*CueSheet, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseCueSheet(f)
+}
+
+// parseCueSheet parses a cue sheet from r. Only cue sheets referencing a single
+// MP3 file are supported.
+func parseCueSheet(r io.Reader) (*CueSheet, error) {
+	var cue CueSheet
+	var track *CueTrack // current track
+	sc := bufio.NewScanner(r)
+	for ln := 1; sc.Scan(); ln++ {
+		fields := splitCueLine(sc.Text())
+		if ln == 1 && len(fields) > 0 {
+			fields[0] = strings.TrimPrefix(fields[0], "\ufeff") // drop UTF-8 BOM
+		}
+		if len(fields) == 0 {
+			continue
+		}
+		arg := func(i int) string {
+			if i < len(fields) {
+				return fields[i]
+			}
+			return ""
+		}
+		switch strings.ToUpper(fields[0]) {
+		case "FILE":
+			if cue.File != "" {
+				return nil, fmt.Errorf("line %d: multiple files unsupported", ln)
+			}
+			if cue.File = arg(1); cue.File == "" {
+				return nil, fmt.Errorf("line %d: missing filename", ln)
+			}
+			if !IsMusicPath(cue.File) {
+				return nil, fmt.Errorf("line %d: unsupported file %q", ln, cue.File)
+			}
+		case "TRACK":
+			num, err := strconv.Atoi(arg(1))
+			if err != nil || num <= 0 {
+				return nil, fmt.Errorf("line %d: bad track number %q", ln, arg(1))
+			}
+			cue.Tracks = append(cue.Tracks, CueTrack{Number: num, Start: -1})
+			track = &cue.Tracks[len(cue.Tracks)-1]
+		case "TITLE":
+			if track != nil {
+				track.Title = arg(1)
+			} else {
+				cue.Title = arg(1)
+			}
+		case "PERFORMER":
+			if track != nil {
+				track.Performer = arg(1)
+			} else {
+				cue.Performer = arg(1)
+			}
+		case "INDEX":
+			// INDEX 00 marks the pregap, which is treated as part of the previous track.
+			if track == nil || arg(1) != "01" {
+				continue
+			}
+			start, err := parseCueTime(arg(2))
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", ln, err)
+			}
+			track.Start = start
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+
+	if cue.File == "" {
+		return nil, errors.New("no file")
+	}
+	if len(cue.Tracks) == 0 {
+		return nil, errors.New("no tracks")
+	}
+	for i, t := range cue.Tracks {
+		if t.Start < 0 {
+			return nil, fmt.Errorf("track %d lacks INDEX 01", t.Number)
+		}
+		if i > 0 && t.Start <= cue.Tracks[i-1].Start {
+			return nil, fmt.Errorf("track %d doesn't start after track %d", t.Number, cue.Tracks[i-1].Number)
+		}
+	}
+	return &cue, nil
+}
+
+// splitCueLine splits a cue sheet line into whitespace-separated fields.
+// Double-quoted fields may contain whitespace.
+func splitCueLine(ln string) []string {
+	var fields []string
+	var cur strings.Builder
+	var inField, quoted bool
+	for _, ch := range ln {
+		switch {
+		case ch == '"':
+			quoted = !quoted
+			inField = true
+		case !quoted && (ch == ' ' || ch == '\t' || ch == '\r'):
+			if inField {
+				fields = append(fields, cur.String())
+				cur.Reset()
+				inField = false
+			}
+		default:
+			cur.WriteRune(ch)
+			inField = true
+		}
+	}
+	if inField {
+		fields = append(fields, cur.String())
+	}
+	return fields
+}
+
+// parseCueTime parses a cue sheet timestamp of the form "mm:ss:ff" (where "ff"
+// contains frames) and returns the corresponding number of seconds.
+func parseCueTime(s string) (float64, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) != 3 {
+		return 0, fmt.Errorf("bad time %q", s)
+	}
+	var vals [3]int
+	for i, p := range parts {
+		v, err := strconv.Atoi(p)
+		if err != nil || v < 0 {
+			return 0, fmt.Errorf("bad time %q", s)
+		}
+		vals[i] = v
+	}
+	if vals[1] >= 60 || vals[2] >= cueFramesPerSec {
+		return 0, fmt.Errorf("bad time %q", s)
+	}
+	return float64(vals[0]*60+vals[1]) + float64(vals[2])/cueFramesPerSec, nil
+}
+
+// ReadCueSongs reads the audio file described by the cue sheet at p
+// (previously parsed as cue) and synthesizes a Song object for each track.
+// gc is used as described for ReadSong.
+func ReadCueSongs(cfg *client.Config, p string, cue *CueSheet, gc *GainsCache) ([]*db.Song, error) {
+	file, err := ReadSong(cfg, filepath.Join(filepath.Dir(p), cue.File), nil, 0, gc)
+	if err != nil {
+		return nil, err
+	}
+	return makeCueSongs(file, cue)
+}
+
+// makeCueSongs synthesizes a Song object for each of cue's tracks
+// using file, which describes the entire audio file.
+func makeCueSongs(file *db.Song, cue *CueSheet) ([]*db.Song, error) {
+	songs := make([]*db.Song, len(cue.Tracks))
+	for i, t := range cue.Tracks {
+		end := file.Length
+		if i < len(cue.Tracks)-1 {
+			end = cue.Tracks[i+1].Start
+		}
+		if t.Start >= end {
+			return nil, fmt.Errorf("track %d starts at %.1f past end of audio at %.1f",
+				t.Number, t.Start, file.Length)
+		}
+
+		s := *file
+		s.Genres = append([]string(nil), file.Genres...)
+		// Each track needs a distinct SHA1 since the server uses it to identify songs.
+		s.SHA1 = fmt.Sprintf("%x", sha1.Sum([]byte(fmt.Sprintf("%s:%d", file.SHA1, t.Number))))
+		s.RecordingID = "" // the file's recording ID doesn't describe the track
+		s.Title = t.Title
+		if t.Performer != "" {
+			s.Artist = t.Performer
+		} else if cue.Performer != "" {
+			s.Artist = cue.Performer
+		}
+		if s.Artist != file.Artist {
+			// The file's credits and sort name don't describe the track.
+			s.ArtistCredits = nil
+			s.ArtistSortName = ""
+		}
+		if cue.Title != "" && cue.Title != file.Album {
+			s.Album = cue.Title
+			s.AlbumSortName = ""
+		}
+		if cue.Performer != "" {
+			s.AlbumArtist = cue.Performer
+			if fileAA := file.AlbumArtist; cue.Performer != fileAA &&
+				!(fileAA == "" && cue.Performer == file.Artist) {
+				s.AlbumArtistSortName = ""
+			}
+		}
+		if s.AlbumArtist == s.Artist {
+			s.AlbumArtist = "" // see ReadSong
+		}
+		s.Track = t.Number
+		s.TotalTracks = len(cue.Tracks)
+		if s.Disc == 0 {
+			s.Disc = 1
+		}
+		s.FileStart = t.Start
+		s.FileEnd = end
+		s.Length = end - t.Start
+		// Silence and segments describe the entire file.
+		s.LeadingSilence = 0
+		s.TrailingSilence = 0
+		s.Segments = nil
+		songs[i] = &s
+	}
+	return songs, nil
+}
@@ -0,0 +1,134 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package files
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/derat/nup/server/db"
+)
+
+const testCueSheet = `REM GENRE Rock
+PERFORMER "The Band"
+TITLE "Live Album"
+FILE "Live Album.mp3" MP3
+  TRACK 01 AUDIO
+    TITLE "Intro"
+    INDEX 01 00:00:00
+  TRACK 02 AUDIO
+    TITLE "First Song"
+    PERFORMER "The Band feat. Guest"
+    INDEX 00 01:29:50
+    INDEX 01 01:30:15
+  TRACK 03 AUDIO
+    TITLE "Second Song"
+    INDEX 01 05:00:00
+`
+
+func TestParseCueSheet(t *testing.T) {
+	got, err := parseCueSheet(strings.NewReader("\ufeff" + strings.ReplaceAll(testCueSheet, "\n", "\r\n")))
+	if err != nil {
+		t.Fatal("parseCueSheet failed:", err)
+	}
+	want := &CueSheet{
+		Performer: "The Band",
+		Title:     "Live Album",
+		File:      "Live Album.mp3",
+		Tracks: []CueTrack{
+			{Number: 1, Title: "Intro", Start: 0},
+			{Number: 2, Title: "First Song", Performer: "The Band feat. Guest", Start: 90.2},
+			{Number: 3, Title: "Second Song", Start: 300},
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseCueSheet returned %+v; want %+v", got, want)
+	}
+
+	for _, tc := range []struct{ desc, cue string }{
+		{"empty", ""},
+		{"no tracks", "FILE a.mp3 MP3\n"},
+		{"no file", "TRACK 01 AUDIO\nINDEX 01 00:00:00\n"},
+		{"unsupported file", "FILE a.flac WAVE\nTRACK 01 AUDIO\nINDEX 01 00:00:00\n"},
+		{"multiple files", "FILE a.mp3 MP3\nFILE b.mp3 MP3\n"},
+		{"missing index", "FILE a.mp3 MP3\nTRACK 01 AUDIO\n"},
+		{"bad frame", "FILE a.mp3 MP3\nTRACK 01 AUDIO\nINDEX 01 00:00:75\n"},
+		{"out of order", "FILE a.mp3 MP3\nTRACK 01 AUDIO\nINDEX 01 01:00:00\n" +
+			"TRACK 02 AUDIO\nINDEX 01 00:30:00\n"},
+	} {
+		if _, err := parseCueSheet(strings.NewReader(tc.cue)); err == nil {
+			t.Errorf("parseCueSheet unexpectedly succeeded for %s cue sheet %q", tc.desc, tc.cue)
+		}
+	}
+}
+
+func TestSplitCueLine(t *testing.T) {
+	for _, tc := range []struct {
+		ln   string
+		want []string
+	}{
+		{"", nil},
+		{`TITLE "Some Title"`, []string{"TITLE", "Some Title"}},
+		{"  INDEX 01\t00:00:00\r", []string{"INDEX", "01", "00:00:00"}},
+		{`TITLE ""`, []string{"TITLE", ""}},
+		{`PERFORMER Unquoted`, []string{"PERFORMER", "Unquoted"}},
+	} {
+		if got := splitCueLine(tc.ln); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("splitCueLine(%q) = %q; want %q", tc.ln, got, tc.want)
+		}
+	}
+}
+
+func TestMakeCueSongs(t *testing.T) {
+	cue, err := parseCueSheet(strings.NewReader(testCueSheet))
+	if err != nil {
+		t.Fatal("parseCueSheet failed:", err)
+	}
+	file := db.Song{
+		SHA1:           "abcd",
+		Filename:       "live/Live Album.mp3",
+		Artist:         "Tagged Artist",
+		Title:          "Tagged Title",
+		Album:          "Tagged Album",
+		RecordingID:    "rec",
+		Genres:         []string{"Rock"},
+		Length:         360,
+		TrackGain:      -6,
+		LeadingSilence: 0.5,
+	}
+	songs, err := makeCueSongs(&file, cue)
+	if err != nil {
+		t.Fatal("makeCueSongs failed:", err)
+	}
+
+	shas := make(map[string]struct{})
+	var got [][]interface{}
+	for _, s := range songs {
+		shas[s.SHA1] = struct{}{}
+		got = append(got, []interface{}{s.Filename, s.Artist, s.AlbumArtist, s.Title, s.Album,
+			s.RecordingID, s.Track, s.TotalTracks, s.Disc, s.FileStart, s.FileEnd, s.Length,
+			s.TrackGain, s.LeadingSilence})
+	}
+	want := [][]interface{}{
+		{"live/Live Album.mp3", "The Band", "", "Intro", "Live Album",
+			"", 1, 3, 1, 0.0, 90.2, 90.2, -6.0, 0.0},
+		{"live/Live Album.mp3", "The Band feat. Guest", "The Band", "First Song", "Live Album",
+			"", 2, 3, 1, 90.2, 300.0, 300 - 90.2, -6.0, 0.0},
+		{"live/Live Album.mp3", "The Band", "", "Second Song", "Live Album",
+			"", 3, 3, 1, 300.0, 360.0, 60.0, -6.0, 0.0},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("makeCueSongs returned:\n%v\nwant:\n%v", got, want)
+	}
+	if len(shas) != len(songs) {
+		t.Errorf("makeCueSongs returned %d distinct SHA1(s) for %d song(s)", len(shas), len(songs))
+	}
+
+	// An error should be returned if the audio file is shorter than the cue sheet.
+	file.Length = 200
+	if _, err := makeCueSongs(&file, cue); err == nil {
+		t.Error("makeCueSongs unexpectedly succeeded for short file")
+	}
+}
@@ -0,0 +1,58 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package files
+
+import (
+	"context"
+	"strings"
+
+	"github.com/derat/nup/cmd/nup/acoustid"
+	"github.com/derat/nup/cmd/nup/client"
+	"github.com/derat/nup/server/db"
+)
+
+// minFingerprintScore is the minimum AcoustID score needed to use a match.
+const minFingerprintScore = 0.8
+
+// identifySong uses AcoustID to look up the MusicBrainz recording ID of the song file at p.
+// s.RecordingID is updated, and s.AlbumID is also set if it was empty and the matching
+// release can be determined.
+func identifySong(cfg *client.Config, p string, s *db.Song) error {
+	fp, dur, err := acoustid.Fingerprint(p)
+	if err != nil {
+		return err
+	}
+	matches, err := acoustid.Lookup(context.Background(), cfg.AcoustIDKey, fp, dur)
+	if err != nil {
+		return err
+	}
+	recID, albumID := pickFingerprintMatch(matches, s.Album)
+	if recID != "" {
+		s.RecordingID = recID
+	}
+	if s.AlbumID == "" {
+		s.AlbumID = albumID
+	}
+	return nil
+}
+
+// pickFingerprintMatch chooses a recording ID and album ID from matches, which should be
+// sorted in descending order by score. The album ID is only returned if one of the
+// recording's releases is titled album or if the recording only appears on one release.
+// Empty strings are returned if no match is good enough.
+func pickFingerprintMatch(matches []acoustid.Match, album string) (recID, albumID string) {
+	if len(matches) == 0 || matches[0].Score < minFingerprintScore {
+		return "", ""
+	}
+	m := matches[0]
+	for _, rel := range m.Releases {
+		if album != "" && strings.EqualFold(rel.Title, album) {
+			return m.RecordingID, rel.ID
+		}
+	}
+	if len(m.Releases) == 1 && (album == "" || album == NonAlbumTracksValue) {
+		return m.RecordingID, m.Releases[0].ID
+	}
+	return m.RecordingID, ""
+}
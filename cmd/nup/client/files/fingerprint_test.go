@@ -0,0 +1,45 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package files
+
+import (
+	"testing"
+
+	"github.com/derat/nup/cmd/nup/acoustid"
+)
+
+func TestPickFingerprintMatch(t *testing.T) {
+	multi := acoustid.Match{
+		Score:       0.9,
+		RecordingID: "rec1",
+		Releases:    []acoustid.Release{{ID: "rel1", Title: "Album"}, {ID: "rel2", Title: "Best Of"}},
+	}
+	single := acoustid.Match{
+		Score:       0.9,
+		RecordingID: "rec2",
+		Releases:    []acoustid.Release{{ID: "rel3", Title: "Single"}},
+	}
+	low := acoustid.Match{Score: 0.5, RecordingID: "rec3"}
+
+	for _, tc := range []struct {
+		matches        []acoustid.Match
+		album          string
+		recID, albumID string
+	}{
+		{nil, "Album", "", ""},
+		{[]acoustid.Match{low}, "", "", ""},
+		{[]acoustid.Match{multi, low}, "album", "rec1", "rel1"},
+		{[]acoustid.Match{multi}, "Best Of", "rec1", "rel2"},
+		{[]acoustid.Match{multi}, "Other", "rec1", ""},
+		{[]acoustid.Match{multi}, "", "rec1", ""},
+		{[]acoustid.Match{single}, "", "rec2", "rel3"},
+		{[]acoustid.Match{single}, NonAlbumTracksValue, "rec2", "rel3"},
+		{[]acoustid.Match{single}, "Other", "rec2", ""},
+	} {
+		if recID, albumID := pickFingerprintMatch(tc.matches, tc.album); recID != tc.recID || albumID != tc.albumID {
+			t.Errorf("pickFingerprintMatch(%v, %q) = %q, %q; want %q, %q",
+				tc.matches, tc.album, recID, albumID, tc.recID, tc.albumID)
+		}
+	}
+}
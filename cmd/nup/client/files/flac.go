@@ -0,0 +1,360 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package files
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/derat/nup/cmd/nup/mp3gain"
+	"github.com/derat/nup/server/db"
+)
+
+// flacMagic is the marker at the start of FLAC files.
+const flacMagic = "fLaC"
+
+// Types of FLAC metadata blocks.
+const (
+	flacStreamInfoBlockType    = 0
+	flacVorbisCommentBlockType = 4
+	flacPictureBlockType       = 6
+)
+
+// IsLosslessPath returns true if path p has an extension suggesting that it's a FLAC file.
+// Lossless files are only read if the config's transcodeFormat is set.
+func IsLosslessPath(p string) bool {
+	return strings.ToLower(filepath.Ext(p)) == ".flac"
+}
+
+// isFLACFile returns true if f starts with the FLAC marker.
+// f is left positioned at its beginning.
+func isFLACFile(f *os.File) (bool, error) {
+	magic := make([]byte, len(flacMagic))
+	_, err := io.ReadFull(f, magic)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return false, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return false, err
+	}
+	return err == nil && string(magic) == flacMagic, nil
+}
+
+// flacMetadata contains information read from a FLAC file's metadata blocks.
+type flacMetadata struct {
+	sampleRate   int                 // samples per second
+	totalSamples int64               // 0 if unknown
+	comments     map[string][]string // Vorbis comments keyed by upper-case field name
+	pictures     []embeddedPicture   // from PICTURE blocks
+	audioOffset  int64               // offset of first audio frame
+}
+
+// duration returns the length of the file's audio.
+func (md *flacMetadata) duration() time.Duration {
+	if md.sampleRate <= 0 {
+		return 0
+	}
+	return time.Duration(md.totalSamples * int64(time.Second) / int64(md.sampleRate))
+}
+
+// readFLACMetadata reads the metadata blocks from the FLAC file in r,
+// which should be positioned at the beginning of the file.
+func readFLACMetadata(r io.Reader) (*flacMetadata, error) {
+	magic := make([]byte, len(flacMagic))
+	if _, err := io.ReadFull(r, magic); err != nil || string(magic) != flacMagic {
+		return nil, errors.New("missing FLAC marker")
+	}
+
+	md := flacMetadata{
+		comments:    make(map[string][]string),
+		audioOffset: int64(len(flacMagic)),
+	}
+	for {
+		// Each block starts with a last-block flag, a 7-bit type, and a 24-bit length.
+		var hdr [4]byte
+		if _, err := io.ReadFull(r, hdr[:]); err != nil {
+			return nil, fmt.Errorf("reading FLAC block header: %v", err)
+		}
+		last := hdr[0]&0x80 != 0
+		typ := hdr[0] & 0x7f
+		size := int64(hdr[1])<<16 | int64(hdr[2])<<8 | int64(hdr[3])
+		md.audioOffset += int64(len(hdr)) + size
+
+		switch typ {
+		case flacStreamInfoBlockType, flacVorbisCommentBlockType, flacPictureBlockType:
+			b := make([]byte, size)
+			if _, err := io.ReadFull(r, b); err != nil {
+				return nil, fmt.Errorf("reading FLAC block: %v", err)
+			}
+			var err error
+			switch typ {
+			case flacStreamInfoBlockType:
+				err = md.parseStreamInfo(b)
+			case flacVorbisCommentBlockType:
+				err = parseVorbisComments(b, md.comments)
+			case flacPictureBlockType:
+				var pic embeddedPicture
+				if pic, err = parseFLACPicture(b); err == nil {
+					md.pictures = append(md.pictures, pic)
+				}
+			}
+			if err != nil {
+				return nil, err
+			}
+		default:
+			if _, err := io.CopyN(ioutil.Discard, r, size); err != nil {
+				return nil, fmt.Errorf("skipping FLAC block: %v", err)
+			}
+		}
+		if last {
+			return &md, nil
+		}
+	}
+}
+
+// parseStreamInfo parses the content of a FLAC STREAMINFO metadata block.
+func (md *flacMetadata) parseStreamInfo(b []byte) error {
+	// The block starts with 16-bit min and max block sizes and 24-bit min and max frame
+	// sizes, followed by a 20-bit sample rate, 3-bit channel count, 5-bit bits per sample,
+	// 36-bit total sample count, and 128-bit MD5 of the unencoded audio.
+	if len(b) < 18 {
+		return errors.New("short FLAC stream info")
+	}
+	v := binary.BigEndian.Uint64(b[10:18])
+	md.sampleRate = int(v >> 44)
+	md.totalSamples = int64(v & (1<<36 - 1))
+	return nil
+}
+
+// parseVorbisComments parses the content of a FLAC VORBIS_COMMENT metadata block
+// and adds its fields to comments, keyed by upper-case field name.
+func parseVorbisComments(b []byte, comments map[string][]string) error {
+	// Unlike the rest of FLAC, lengths here are little-endian.
+	read := func() (string, bool) {
+		if len(b) < 4 {
+			return "", false
+		}
+		n := binary.LittleEndian.Uint32(b)
+		if uint32(len(b)-4) < n {
+			return "", false
+		}
+		s := string(b[4 : 4+n])
+		b = b[4+n:]
+		return s, true
+	}
+	if _, ok := read(); !ok {
+		return errors.New("bad Vorbis comment vendor")
+	}
+	if len(b) < 4 {
+		return errors.New("missing Vorbis comment count")
+	}
+	cnt := binary.LittleEndian.Uint32(b)
+	b = b[4:]
+	for i := uint32(0); i < cnt; i++ {
+		c, ok := read()
+		if !ok {
+			return errors.New("bad Vorbis comment")
+		}
+		if parts := strings.SplitN(c, "=", 2); len(parts) == 2 {
+			k := strings.ToUpper(parts[0])
+			comments[k] = append(comments[k], parts[1])
+		}
+	}
+	return nil
+}
+
+// parseFLACPicture parses the content of a FLAC PICTURE metadata block.
+func parseFLACPicture(b []byte) (embeddedPicture, error) {
+	var pic embeddedPicture
+	readUint32 := func() (uint32, bool) {
+		if len(b) < 4 {
+			return 0, false
+		}
+		v := binary.BigEndian.Uint32(b)
+		b = b[4:]
+		return v, true
+	}
+	readString := func() ([]byte, bool) {
+		n, ok := readUint32()
+		if !ok || uint32(len(b)) < n {
+			return nil, false
+		}
+		s := b[:n]
+		b = b[n:]
+		return s, true
+	}
+
+	var ok bool
+	if pic.picType, ok = readUint32(); !ok {
+		return pic, errors.New("missing FLAC picture type")
+	}
+	mt, ok := readString()
+	if !ok {
+		return pic, errors.New("bad FLAC picture MIME type")
+	}
+	pic.mimeType = string(mt)
+	if _, ok := readString(); !ok {
+		return pic, errors.New("bad FLAC picture description")
+	}
+	// Skip the width, height, color depth, and number of colors.
+	if len(b) < 16 {
+		return pic, errors.New("missing FLAC picture dimensions")
+	}
+	b = b[16:]
+	if pic.data, ok = readString(); !ok {
+		return pic, errors.New("bad FLAC picture data")
+	}
+	if len(pic.data) == 0 {
+		return pic, errors.New("no image data")
+	}
+	return pic, nil
+}
+
+// computeFLACAudioSHA1 returns the hex-encoded SHA1 of the audio frames in f,
+// which start at offset. Unlike the file as a whole, this doesn't change when
+// the file is retagged.
+func computeFLACAudioSHA1(f *os.File, offset int64) (string, error) {
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return "", err
+	}
+	h := sha1.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Vorbis comment field names, as written by Picard.
+const (
+	vorbisArtist          = "ARTIST"
+	vorbisTitle           = "TITLE"
+	vorbisAlbum           = "ALBUM"
+	vorbisAlbumArtist     = "ALBUMARTIST"
+	vorbisAlbumID         = "MUSICBRAINZ_ALBUMID"
+	vorbisRecordingID     = "MUSICBRAINZ_TRACKID" // confusingly, this is the recording MBID
+	vorbisArtists         = "ARTISTS"
+	vorbisArtistIDs       = "MUSICBRAINZ_ARTISTID"
+	vorbisTrack           = "TRACKNUMBER"
+	vorbisTotalTracks     = "TRACKTOTAL"
+	vorbisDisc            = "DISCNUMBER"
+	vorbisTotalDiscs      = "DISCTOTAL"
+	vorbisDiscSubtitle    = "DISCSUBTITLE"
+	vorbisDate            = "DATE"
+	vorbisOriginalDate    = "ORIGINALDATE"
+	vorbisComposer        = "COMPOSER"
+	vorbisConductor       = "CONDUCTOR"
+	vorbisPerformer       = "PERFORMER" // "Name (instrument)"
+	vorbisArtistSort      = "ARTISTSORT"
+	vorbisAlbumSort       = "ALBUMSORT"
+	vorbisAlbumArtistSort = "ALBUMARTISTSORT"
+	vorbisGenre           = "GENRE"
+	vorbisBPM             = "BPM"
+	vorbisKey             = "KEY"
+	vorbisCompilation     = "COMPILATION"
+)
+
+// performerRoleRegexp matches the role appended to Picard's PERFORMER values.
+var performerRoleRegexp = regexp.MustCompile(`\s*\([^)]*\)$`)
+
+// applyVorbisComments copies metadata from FLAC Vorbis comments (keyed by upper-case
+// field name) to s. If readGain is true, ReplayGain information is returned if present.
+func applyVorbisComments(s *db.Song, comments map[string][]string, readGain bool) *mp3gain.Info {
+	get := func(k string) string {
+		if vals := comments[k]; len(vals) > 0 {
+			return strings.TrimSpace(vals[0])
+		}
+		return ""
+	}
+
+	s.Artist = get(vorbisArtist)
+	s.Title = get(vorbisTitle)
+	s.Album = get(vorbisAlbum)
+	if aa := get(vorbisAlbumArtist); aa != s.Artist {
+		s.AlbumArtist = aa
+	}
+	s.AlbumID = get(vorbisAlbumID)
+	s.RecordingID = get(vorbisRecordingID)
+	s.ArtistCredits = makeArtistCredits(s.Artist, comments[vorbisArtists], comments[vorbisArtistIDs])
+
+	// TRACKNUMBER and DISCNUMBER may also contain totals, e.g. "3/12".
+	s.Track, s.TotalTracks = parsePosition(get(vorbisTrack))
+	if n, _ := parsePosition(get(vorbisTotalTracks)); n > 0 {
+		s.TotalTracks = n
+	}
+	s.Disc, s.TotalDiscs = parsePosition(get(vorbisDisc))
+	if n, _ := parsePosition(get(vorbisTotalDiscs)); n > 0 {
+		s.TotalDiscs = n
+	}
+	s.DiscSubtitle = get(vorbisDiscSubtitle)
+	if s.Disc == 0 && s.Track > 0 && s.Album != NonAlbumTracksValue {
+		s.Disc = 1
+	}
+
+	// DATE contains the release date, while ORIGINALDATE contains the original release date.
+	s.ReleaseDate = parseVorbisDate(get(vorbisDate))
+	s.OriginalDate = parseVorbisDate(get(vorbisOriginalDate))
+	s.Date = s.OriginalDate
+	if s.Date.IsZero() {
+		s.Date = s.ReleaseDate
+	}
+
+	s.Composer = get(vorbisComposer)
+	s.Conductor = get(vorbisConductor)
+	var performers []string
+	for _, p := range comments[vorbisPerformer] {
+		if name := strings.TrimSpace(performerRoleRegexp.ReplaceAllString(p, "")); name != "" &&
+			!hasString(performers, name) {
+			performers = append(performers, name)
+		}
+	}
+	s.Performer = strings.Join(performers, ", ")
+
+	s.ArtistSortName = get(vorbisArtistSort)
+	s.AlbumSortName = get(vorbisAlbumSort)
+	s.AlbumArtistSortName = get(vorbisAlbumArtistSort)
+	s.Genres = parseGenres(strings.Join(comments[vorbisGenre], "\x00"))
+	if v, err := strconv.ParseFloat(get(vorbisBPM), 64); err == nil && v > 0 {
+		s.BPM = v
+	}
+	s.Key = get(vorbisKey)
+	s.Compilation = get(vorbisCompilation) == "1"
+
+	if !readGain {
+		return nil
+	}
+	gains := make(map[string]string)
+	for _, k := range []string{trackGainTag, albumGainTag, trackPeakTag} {
+		if v := get(k); v != "" {
+			gains[k] = v
+		}
+	}
+	if info, ok := readGainTags(gains); ok {
+		return &info
+	}
+	return nil
+}
+
+// parseVorbisDate parses a DATE or ORIGINALDATE value like "2006", "2006-01",
+// or "2006-01-02". The zero time is returned for missing or unparseable values.
+func parseVorbisDate(v string) time.Time {
+	for _, layout := range []string{"2006-01-02", "2006-01", "2006"} {
+		if len(v) >= len(layout) {
+			if t, err := time.Parse(layout, v[:len(layout)]); err == nil {
+				return t
+			}
+		}
+	}
+	return time.Time{}
+}
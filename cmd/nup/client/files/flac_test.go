@@ -0,0 +1,240 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package files
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/derat/nup/cmd/nup/client"
+	"github.com/derat/nup/server/db"
+	"github.com/derat/nup/test"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestReadFLACMetadata(t *testing.T) {
+	dir := t.TempDir()
+	test.Must(t, test.CopySongs(dir, test.CoverFLACFile))
+	p := filepath.Join(dir, test.CoverFLACFile)
+	f, err := os.Open(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	md, err := readFLACMetadata(f)
+	if err != nil {
+		t.Fatal("readFLACMetadata failed: ", err)
+	}
+	if md.sampleRate != 44100 || md.totalSamples != 0 {
+		t.Errorf("readFLACMetadata returned rate %v and samples %v; want 44100 and 0",
+			md.sampleRate, md.totalSamples)
+	}
+	if md.audioOffset != fi.Size() {
+		t.Errorf("readFLACMetadata returned audio offset %v; want %v", md.audioOffset, fi.Size())
+	}
+	var types []uint32
+	for _, pic := range md.pictures {
+		types = append(types, pic.picType)
+	}
+	if diff := cmp.Diff([]uint32{4, frontCoverPictureType}, types); diff != "" {
+		t.Error("readFLACMetadata returned bad picture types:\n" + diff)
+	}
+}
+
+func TestParseFLACPicture(t *testing.T) {
+	img := []byte{0xff, 0xd8, 0xff, 0x00, 0x01}
+	u32 := func(v uint32) []byte {
+		b := make([]byte, 4)
+		binary.BigEndian.PutUint32(b, v)
+		return b
+	}
+	str := func(s []byte) []byte { return append(u32(uint32(len(s))), s...) }
+	join := func(parts ...[]byte) []byte { return bytes.Join(parts, nil) }
+	dims := join(u32(1), u32(1), u32(24), u32(0))
+
+	for _, tc := range []struct {
+		name     string
+		block    []byte
+		mimeType string
+		picType  uint32
+		ok       bool
+	}{
+		{"front", join(u32(3), str([]byte("image/jpeg")), str([]byte("Cover")), dims, str(img)),
+			"image/jpeg", 3, true},
+		{"empty_desc", join(u32(0), str([]byte("image/png")), str(nil), dims, str(img)),
+			"image/png", 0, true},
+		{"empty", nil, "", 0, false},
+		{"short_mime", join(u32(3), u32(20), []byte("image/jpeg")), "", 0, false},
+		{"no_dims", join(u32(3), str([]byte("image/jpeg")), str(nil), u32(1)), "", 0, false},
+		{"short_data", join(u32(3), str([]byte("image/jpeg")), str(nil), dims, u32(10), img),
+			"", 0, false},
+		{"no_data", join(u32(3), str([]byte("image/jpeg")), str(nil), dims, str(nil)), "", 0, false},
+	} {
+		pic, err := parseFLACPicture(tc.block)
+		if !tc.ok {
+			if err == nil {
+				t.Errorf("%s: parseFLACPicture unexpectedly succeeded", tc.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: parseFLACPicture failed: %v", tc.name, err)
+		} else if pic.mimeType != tc.mimeType || pic.picType != tc.picType || !bytes.Equal(pic.data, img) {
+			t.Errorf("%s: parseFLACPicture returned %q, %v, %v; want %q, %v, %v",
+				tc.name, pic.mimeType, pic.picType, pic.data, tc.mimeType, tc.picType, img)
+		}
+	}
+}
+
+// makeFLAC returns a FLAC file with the supplied Vorbis comments and audio data.
+// The stream info block describes 44.1 kHz audio containing the supplied number of samples.
+func makeFLAC(comments []string, samples int64, audio []byte) []byte {
+	block := func(typ byte, last bool, data []byte) []byte {
+		if last {
+			typ |= 0x80
+		}
+		n := len(data)
+		return append([]byte{typ, byte(n >> 16), byte(n >> 8), byte(n)}, data...)
+	}
+
+	info := make([]byte, 34)
+	binary.BigEndian.PutUint64(info[10:18], uint64(44100)<<44|uint64(1)<<41|uint64(15)<<36|uint64(samples))
+
+	var vc bytes.Buffer
+	writeString := func(s string) {
+		binary.Write(&vc, binary.LittleEndian, uint32(len(s)))
+		vc.WriteString(s)
+	}
+	writeString("test vendor")
+	binary.Write(&vc, binary.LittleEndian, uint32(len(comments)))
+	for _, c := range comments {
+		writeString(c)
+	}
+
+	var b bytes.Buffer
+	b.WriteString(flacMagic)
+	b.Write(block(flacStreamInfoBlockType, false, info))
+	b.Write(block(1, false, make([]byte, 8))) // padding
+	b.Write(block(flacVorbisCommentBlockType, true, vc.Bytes()))
+	b.Write(audio)
+	return b.Bytes()
+}
+
+func TestReadSong_FLAC(t *testing.T) {
+	dir := t.TempDir()
+	cfg := &client.Config{
+		MusicDir:     filepath.Join(dir, "music"),
+		MetadataDir:  filepath.Join(dir, "metadata"),
+		ReadGainTags: true,
+	}
+	test.Must(t, os.MkdirAll(cfg.MusicDir, 0755))
+
+	audio := []byte("fake audio frames")
+	p := filepath.Join(cfg.MusicDir, "song.flac")
+	if err := ioutil.WriteFile(p, makeFLAC([]string{
+		"ARTIST=Artist feat. Guest",
+		"ARTISTS=Artist",
+		"ARTISTS=Guest",
+		"title=Song Title",
+		"ALBUM=Album Name",
+		"ALBUMARTIST=Artist",
+		"ALBUMARTISTSORT=Artist, The",
+		"MUSICBRAINZ_ALBUMID=album-id",
+		"MUSICBRAINZ_TRACKID=recording-id",
+		"TRACKNUMBER=3",
+		"TRACKTOTAL=12",
+		"DISCNUMBER=1/2",
+		"DATE=2012-05-03",
+		"ORIGINALDATE=1998",
+		"PERFORMER=Someone (piano)",
+		"PERFORMER=Someone Else",
+		"GENRE=Rock",
+		"GENRE=Pop",
+		"BPM=120",
+		"COMPILATION=1",
+		"REPLAYGAIN_TRACK_GAIN=-6.5 dB",
+		"REPLAYGAIN_ALBUM_GAIN=-7.25 dB",
+		"REPLAYGAIN_TRACK_PEAK=0.95",
+	}, 88200, audio), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	sum := sha1.Sum(audio)
+	want := db.Song{
+		SHA1:     hex.EncodeToString(sum[:]),
+		Filename: "song.flac",
+		Artist:   "Artist feat. Guest",
+		ArtistCredits: []db.ArtistCredit{
+			{Name: "Artist", JoinPhrase: " feat. "},
+			{Name: "Guest"},
+		},
+		Title:               "Song Title",
+		Album:               "Album Name",
+		AlbumArtist:         "Artist",
+		AlbumArtistSortName: "Artist, The",
+		AlbumID:             "album-id",
+		RecordingID:         "recording-id",
+		Track:               3,
+		TotalTracks:         12,
+		Disc:                1,
+		TotalDiscs:          2,
+		Date:                test.Date(1998, 1, 1),
+		OriginalDate:        test.Date(1998, 1, 1),
+		ReleaseDate:         test.Date(2012, 5, 3),
+		Performer:           "Someone, Someone Else",
+		Genres:              []string{"Rock", "Pop"},
+		BPM:                 120,
+		Compilation:         true,
+		Length:              2,
+		TrackGain:           -6.5,
+		AlbumGain:           -7.25,
+		PeakAmp:             0.95,
+	}
+	if got, err := ReadSong(cfg, p, nil /* fi */, 0, nil /* gc */); err != nil {
+		t.Fatalf("ReadSong(cfg, %q, nil, 0, nil) failed: %v", p, err)
+	} else if diff := cmp.Diff(want, *got); diff != "" {
+		t.Errorf("ReadSong(cfg, %q, nil, 0, nil) returned bad data:\n%s", p, diff)
+	}
+
+	f, err := os.Open(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if got, err := ComputeSHA1(f); err != nil {
+		t.Errorf("ComputeSHA1(%q) failed: %v", p, err)
+	} else if got != want.SHA1 {
+		t.Errorf("ComputeSHA1(%q) = %q; want %q", p, got, want.SHA1)
+	}
+}
+
+func TestParseVorbisDate(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want time.Time
+	}{
+		{"2012-05-03", test.Date(2012, 5, 3)},
+		{"2012-05", test.Date(2012, 5, 1)},
+		{"2012", test.Date(2012, 1, 1)},
+		{"2012-05-03T10:00:00", test.Date(2012, 5, 3)},
+		{"", time.Time{}},
+		{"bogus", time.Time{}},
+	} {
+		if got := parseVorbisDate(tc.in); !got.Equal(tc.want) {
+			t.Errorf("parseVorbisDate(%q) = %v; want %v", tc.in, got, tc.want)
+		}
+	}
+}
@@ -11,12 +11,51 @@ import (
 	"os"
 	"path/filepath"
 	"runtime"
+	"strconv"
+	"strings"
 
 	"github.com/derat/nup/cmd/nup/client"
 	"github.com/derat/nup/cmd/nup/mp3gain"
 	"github.com/derat/nup/server/db"
 )
 
+// Descriptions of ID3 TXXX frames containing ReplayGain information.
+const (
+	trackGainTag = "REPLAYGAIN_TRACK_GAIN" // e.g. "-6.52 dB"
+	albumGainTag = "REPLAYGAIN_ALBUM_GAIN" // e.g. "-7.10 dB"
+	trackPeakTag = "REPLAYGAIN_TRACK_PEAK" // e.g. "0.988312"
+)
+
+// readGainTags reads ReplayGain information from frames, a map from TXXX frame
+// descriptions to values (see taglib.GenericTag.CustomFrames). Descriptions are
+// matched case-insensitively since different taggers use different cases.
+// false is returned if the track or album gain is missing or malformed. The peak
+// amplitude is optional and is left as 0 if it's missing.
+func readGainTags(frames map[string]string) (info mp3gain.Info, ok bool) {
+	get := func(desc string) (float64, bool) {
+		for k, v := range frames {
+			if strings.EqualFold(k, desc) {
+				v = strings.TrimSpace(v)
+				if len(v) >= 2 && strings.EqualFold(v[len(v)-2:], "db") {
+					v = strings.TrimSpace(v[:len(v)-2])
+				}
+				f, err := strconv.ParseFloat(v, 64)
+				return f, err == nil
+			}
+		}
+		return 0, false
+	}
+
+	if info.TrackGain, ok = get(trackGainTag); !ok {
+		return info, false
+	}
+	if info.AlbumGain, ok = get(albumGainTag); !ok {
+		return info, false
+	}
+	info.PeakAmp, _ = get(trackPeakTag)
+	return info, true
+}
+
 // GainsCache is passed to ReadSong to compute gain adjustments for MP3 files.
 //
 // Gain adjustments need to be computed across entire albums, so adjustments are cached
@@ -30,14 +69,18 @@ type GainsCache struct {
 // NewGainsCache returns a new GainsCache.
 //
 // If dumpPath is non-empty, db.Song objects are JSON-unmarshaled from it to initialize the cache
-// with previously-computed gain adjustments.
-func NewGainsCache(cfg *client.Config, dumpPath string) (*GainsCache, error) {
+// with previously-computed gain adjustments. Up to maxProcs copies of mp3gain will be run
+// simultaneously; if maxProcs is 0, the number of CPUs is used.
+func NewGainsCache(cfg *client.Config, dumpPath string, maxProcs int) (*GainsCache, error) {
 	// mp3gain doesn't seem to take advantage of multiple cores, so run multiple copies in parallel:
 	//  https://hydrogenaud.io/index.php?topic=72197.0
 	//  https://sound.stackexchange.com/questions/33069/multi-core-batch-volume-gain
+	if maxProcs <= 0 {
+		maxProcs = runtime.NumCPU()
+	}
 	gc := GainsCache{
 		cfg:   cfg,
-		cache: client.NewTaskCache(runtime.NumCPU()),
+		cache: client.NewTaskCache(maxProcs),
 	}
 
 	if dumpPath != "" {
@@ -33,7 +33,7 @@ func TestGainsCache(t *testing.T) {
 	defer mp3gain.SetInfoForTest(nil)
 
 	cfg := client.Config{MusicDir: dir}
-	gc, err := NewGainsCache(&cfg, "")
+	gc, err := NewGainsCache(&cfg, "", 0)
 	if err != nil {
 		t.Fatal("NewGainsCache failed: ", err)
 	}
@@ -64,3 +64,39 @@ func TestGainsCache(t *testing.T) {
 		t.Errorf("Computed gain adjustments for %v file(s); want 3", sz)
 	}
 }
+
+func TestReadGainTags(t *testing.T) {
+	for _, tc := range []struct {
+		frames map[string]string
+		want   mp3gain.Info
+		ok     bool
+	}{
+		{
+			map[string]string{
+				"REPLAYGAIN_TRACK_GAIN": "-6.52 dB",
+				"REPLAYGAIN_ALBUM_GAIN": "-7.10 dB",
+				"REPLAYGAIN_TRACK_PEAK": "0.988312",
+			},
+			mp3gain.Info{TrackGain: -6.52, AlbumGain: -7.1, PeakAmp: 0.988312},
+			true,
+		},
+		{
+			map[string]string{
+				"replaygain_track_gain": "+1.5 db",
+				"replaygain_album_gain": "0.25",
+			},
+			mp3gain.Info{TrackGain: 1.5, AlbumGain: 0.25},
+			true,
+		},
+		{map[string]string{"REPLAYGAIN_TRACK_GAIN": "-6.52 dB"}, mp3gain.Info{}, false},
+		{map[string]string{"REPLAYGAIN_TRACK_GAIN": "bogus", "REPLAYGAIN_ALBUM_GAIN": "-1 dB"}, mp3gain.Info{}, false},
+		{nil, mp3gain.Info{}, false},
+	} {
+		got, ok := readGainTags(tc.frames)
+		if ok != tc.ok {
+			t.Errorf("readGainTags(%v) returned ok=%v; want %v", tc.frames, ok, tc.ok)
+		} else if ok && got != tc.want {
+			t.Errorf("readGainTags(%v) = %+v; want %+v", tc.frames, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package files
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// id3v1Genres contains the genres defined by ID3v1, indexed by number.
+// Winamp's extensions are omitted.
+var id3v1Genres = []string{
+	"Blues", "Classic Rock", "Country", "Dance", "Disco", "Funk", "Grunge", "Hip-Hop",
+	"Jazz", "Metal", "New Age", "Oldies", "Other", "Pop", "R&B", "Rap",
+	"Reggae", "Rock", "Techno", "Industrial", "Alternative", "Ska", "Death Metal", "Pranks",
+	"Soundtrack", "Euro-Techno", "Ambient", "Trip-Hop", "Vocal", "Jazz+Funk", "Fusion", "Trance",
+	"Classical", "Instrumental", "Acid", "House", "Game", "Sound Clip", "Gospel", "Noise",
+	"AlternRock", "Bass", "Soul", "Punk", "Space", "Meditative", "Instrumental Pop", "Instrumental Rock",
+	"Ethnic", "Gothic", "Darkwave", "Techno-Industrial", "Electronic", "Pop-Folk", "Eurodance", "Dream",
+	"Southern Rock", "Comedy", "Cult", "Gangsta", "Top 40", "Christian Rap", "Pop/Funk", "Jungle",
+	"Native American", "Cabaret", "New Wave", "Psychadelic", "Rave", "Showtunes", "Trailer", "Lo-Fi",
+	"Tribal", "Acid Punk", "Acid Jazz", "Polka", "Retro", "Musical", "Rock & Roll", "Hard Rock",
+}
+
+// genreRefRegexp matches a leading parenthesized ID3v1 genre reference in a TCON frame,
+// e.g. "(17)" or "(RX)". The remainder of the string is a refinement.
+var genreRefRegexp = regexp.MustCompile(`^\((\d+|RX|CR)\)`)
+
+// parseGenres parses the value of an ID3v2 TCON (Content type) frame, which may contain
+// multiple null-separated genres (v2.4) and numeric ID3v1 references like "(17)" or "(17)Rock"
+// (v2.3). Empty and duplicate genres are dropped.
+func parseGenres(tcon string) []string {
+	var genres []string
+	seen := make(map[string]struct{})
+	add := func(g string) {
+		g = strings.TrimSpace(g)
+		if _, ok := seen[g]; ok || g == "" {
+			return
+		}
+		seen[g] = struct{}{}
+		genres = append(genres, g)
+	}
+
+	for _, v := range strings.Split(tcon, "\x00") {
+		v = strings.TrimSpace(v)
+		// v2.3 permits multiple references followed by an optional refinement.
+		// "((" is used to escape a literal leading parenthesis.
+		var refs []string
+		for !strings.HasPrefix(v, "((") {
+			m := genreRefRegexp.FindStringSubmatch(v)
+			if m == nil {
+				break
+			}
+			refs = append(refs, m[1])
+			v = v[len(m[0]):]
+		}
+		if strings.HasPrefix(v, "((") {
+			v = v[1:]
+		}
+		if v != "" {
+			// A refinement replaces the referenced genre.
+			add(v)
+			continue
+		}
+		for _, ref := range refs {
+			add(lookupGenre(ref))
+		}
+	}
+	return genres
+}
+
+// lookupGenre returns the genre name corresponding to the supplied TCON reference,
+// e.g. "17" or "RX". An empty string is returned for unknown references.
+func lookupGenre(ref string) string {
+	switch ref {
+	case "RX":
+		return "Remix"
+	case "CR":
+		return "Cover"
+	}
+	if n, err := strconv.Atoi(ref); err == nil && n >= 0 && n < len(id3v1Genres) {
+		return id3v1Genres[n]
+	}
+	return ""
+}
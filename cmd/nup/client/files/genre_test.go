@@ -0,0 +1,33 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package files
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseGenres(t *testing.T) {
+	for _, tc := range []struct {
+		tcon string
+		want []string
+	}{
+		{"", nil},
+		{"Rock", []string{"Rock"}},
+		{" Rock ", []string{"Rock"}},
+		{"Rock\x00Jazz", []string{"Rock", "Jazz"}},
+		{"Rock\x00\x00Rock", []string{"Rock"}},
+		{"(17)", []string{"Rock"}},
+		{"(8)(30)", []string{"Jazz", "Fusion"}},
+		{"(17)Garage Rock", []string{"Garage Rock"}},
+		{"(RX)", []string{"Remix"}},
+		{"(CR)", []string{"Cover"}},
+		{"(999)", nil},
+		{"((Weird) Genre", []string{"(Weird) Genre"}},
+	} {
+		if got := parseGenres(tc.tcon); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("parseGenres(%q) = %q; want %q", tc.tcon, got, tc.want)
+		}
+	}
+}
@@ -28,12 +28,32 @@ type MetadataOverride struct {
 	Title        *string    `json:"title,omitempty"`
 	Album        *string    `json:"album,omitempty"`
 	AlbumArtist  *string    `json:"albumArtist,omitempty"`
+	Composer     *string    `json:"composer,omitempty"`
+	Conductor    *string    `json:"conductor,omitempty"`
+	Performer    *string    `json:"performer,omitempty"`
 	DiscSubtitle *string    `json:"discSubtitle,omitempty"`
 	AlbumID      *string    `json:"albumId,omitempty"`
 	RecordingID  *string    `json:"recordingId,omitempty"`
 	Track        *int       `json:"track,omitempty"`
 	Disc         *int       `json:"disc,omitempty"`
+	TotalTracks  *int       `json:"totalTracks,omitempty"`
+	TotalDiscs   *int       `json:"totalDiscs,omitempty"`
 	Date         *time.Time `json:"date,omitempty"`
+	OriginalDate *time.Time `json:"originalDate,omitempty"`
+	ReleaseDate  *time.Time `json:"releaseDate,omitempty"`
+	Genres       *[]string  `json:"genres,omitempty"`
+	BPM          *float64   `json:"bpm,omitempty"`
+	Key          *string    `json:"key,omitempty"`
+	Compilation  *bool      `json:"compilation,omitempty"`
+	// Segments can be used to list chapters (e.g. tracks within a DJ mix) for
+	// songs lacking CHAP frames.
+	Segments *[]db.Segment `json:"segments,omitempty"`
+	// ArtistCredits lists the individual artists credited in Artist.
+	ArtistCredits *[]db.ArtistCredit `json:"artistCredits,omitempty"`
+	// ArtistSortName, AlbumSortName, and AlbumArtistSortName contain the names used when sorting.
+	ArtistSortName      *string `json:"artistSortName,omitempty"`
+	AlbumSortName       *string `json:"albumSortName,omitempty"`
+	AlbumArtistSortName *string `json:"albumArtistSortName,omitempty"`
 }
 
 // MetadataOverridePath returns the path under cfg.MetadataDir for a JSON-marshaled
@@ -73,9 +93,16 @@ func genMetadataOverride(orig, updated *db.Song) *MetadataOverride {
 		{orig.Title, updated.Title, &over.Title},
 		{orig.Album, updated.Album, &over.Album},
 		{orig.AlbumArtist, updated.AlbumArtist, &over.AlbumArtist},
+		{orig.Composer, updated.Composer, &over.Composer},
+		{orig.Conductor, updated.Conductor, &over.Conductor},
+		{orig.Performer, updated.Performer, &over.Performer},
 		{orig.DiscSubtitle, updated.DiscSubtitle, &over.DiscSubtitle},
 		{orig.AlbumID, updated.AlbumID, &over.AlbumID},
 		{orig.RecordingID, updated.RecordingID, &over.RecordingID},
+		{orig.Key, updated.Key, &over.Key},
+		{orig.ArtistSortName, updated.ArtistSortName, &over.ArtistSortName},
+		{orig.AlbumSortName, updated.AlbumSortName, &over.AlbumSortName},
+		{orig.AlbumArtistSortName, updated.AlbumArtistSortName, &over.AlbumArtistSortName},
 	} {
 		if info.before != info.after {
 			*info.dst = newString(info.after)
@@ -87,9 +114,36 @@ func genMetadataOverride(orig, updated *db.Song) *MetadataOverride {
 	if orig.Disc != updated.Disc {
 		over.Disc = newInt(updated.Disc)
 	}
+	if orig.TotalTracks != updated.TotalTracks {
+		over.TotalTracks = newInt(updated.TotalTracks)
+	}
+	if orig.TotalDiscs != updated.TotalDiscs {
+		over.TotalDiscs = newInt(updated.TotalDiscs)
+	}
 	if !orig.Date.Equal(updated.Date) {
 		over.Date = newTime(updated.Date)
 	}
+	if !orig.OriginalDate.Equal(updated.OriginalDate) {
+		over.OriginalDate = newTime(updated.OriginalDate)
+	}
+	if !orig.ReleaseDate.Equal(updated.ReleaseDate) {
+		over.ReleaseDate = newTime(updated.ReleaseDate)
+	}
+	if orig.Compilation != updated.Compilation {
+		over.Compilation = newBool(updated.Compilation)
+	}
+	if orig.BPM != updated.BPM {
+		over.BPM = newFloat(updated.BPM)
+	}
+	if !stringsEqual(orig.Genres, updated.Genres) {
+		over.Genres = newStrings(updated.Genres)
+	}
+	if !segmentsEqual(orig.Segments, updated.Segments) {
+		over.Segments = newSegments(updated.Segments)
+	}
+	if !artistCreditsEqual(orig.ArtistCredits, updated.ArtistCredits) {
+		over.ArtistCredits = newArtistCredits(updated.ArtistCredits)
+	}
 
 	return &over
 }
@@ -150,7 +204,14 @@ func applyMetadataOverride(cfg *client.Config, song *db.Song) error {
 	setString(&song.Title, over.Title)
 	setString(&song.Album, over.Album)
 	setString(&song.AlbumArtist, over.AlbumArtist)
+	setString(&song.Composer, over.Composer)
+	setString(&song.Conductor, over.Conductor)
+	setString(&song.Performer, over.Performer)
 	setString(&song.DiscSubtitle, over.DiscSubtitle)
+	setString(&song.Key, over.Key)
+	setString(&song.ArtistSortName, over.ArtistSortName)
+	setString(&song.AlbumSortName, over.AlbumSortName)
+	setString(&song.AlbumArtistSortName, over.AlbumArtistSortName)
 
 	// Save the original values so they can be used to look up cover images.
 	if over.AlbumID != nil && *over.AlbumID != song.AlbumID {
@@ -164,7 +225,16 @@ func applyMetadataOverride(cfg *client.Config, song *db.Song) error {
 
 	setInt(&song.Track, over.Track)
 	setInt(&song.Disc, over.Disc)
+	setInt(&song.TotalTracks, over.TotalTracks)
+	setInt(&song.TotalDiscs, over.TotalDiscs)
 	setTime(&song.Date, over.Date)
+	setTime(&song.OriginalDate, over.OriginalDate)
+	setTime(&song.ReleaseDate, over.ReleaseDate)
+	setStrings(&song.Genres, over.Genres)
+	setFloat(&song.BPM, over.BPM)
+	setBool(&song.Compilation, over.Compilation)
+	setSegments(&song.Segments, over.Segments)
+	setArtistCredits(&song.ArtistCredits, over.ArtistCredits)
 
 	return nil
 }
@@ -173,6 +243,20 @@ func applyMetadataOverride(cfg *client.Config, song *db.Song) error {
 func newString(v string) *string     { return &v }
 func newInt(v int) *int              { return &v }
 func newTime(v time.Time) *time.Time { return &v }
+func newFloat(v float64) *float64    { return &v }
+func newBool(v bool) *bool           { return &v }
+func newStrings(v []string) *[]string {
+	c := append([]string{}, v...)
+	return &c
+}
+func newSegments(v []db.Segment) *[]db.Segment {
+	c := append([]db.Segment{}, v...)
+	return &c
+}
+func newArtistCredits(v []db.ArtistCredit) *[]db.ArtistCredit {
+	c := append([]db.ArtistCredit{}, v...)
+	return &c
+}
 
 func setString(dst, src *string) {
 	if src != nil {
@@ -184,8 +268,69 @@ func setInt(dst, src *int) {
 		*dst = *src
 	}
 }
+func setBool(dst, src *bool) {
+	if src != nil {
+		*dst = *src
+	}
+}
+func setFloat(dst, src *float64) {
+	if src != nil {
+		*dst = *src
+	}
+}
 func setTime(dst, src *time.Time) {
 	if src != nil {
 		*dst = *src
 	}
 }
+func setStrings(dst, src *[]string) {
+	if src != nil {
+		*dst = append([]string{}, *src...)
+	}
+}
+func setSegments(dst, src *[]db.Segment) {
+	if src != nil {
+		*dst = append([]db.Segment{}, *src...)
+	}
+}
+func setArtistCredits(dst, src *[]db.ArtistCredit) {
+	if src != nil {
+		*dst = append([]db.ArtistCredit{}, *src...)
+	}
+}
+
+func segmentsEqual(a, b []db.Segment) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func artistCreditsEqual(a, b []db.ArtistCredit) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func stringsEqual(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
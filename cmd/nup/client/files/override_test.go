@@ -19,27 +19,52 @@ func TestApplyMetadataOverride(t *testing.T) {
 		Title:        "Old Title",
 		Album:        "Old Album",
 		AlbumArtist:  "Old AlbumArtist",
+		Composer:     "Old Composer",
+		Conductor:    "Old Conductor",
+		Performer:    "Old Performer",
 		DiscSubtitle: "Old DiscSubtitle",
 		AlbumID:      "Old AlbumID",
 		RecordingID:  "Old RecordingID",
 		Track:        1,
 		Disc:         2,
+		TotalTracks:  10,
+		TotalDiscs:   2,
 		Date:         time.Date(2023, 4, 26, 1, 2, 0, 0, time.UTC),
+		ReleaseDate:  time.Date(2023, 4, 26, 0, 0, 0, 0, time.UTC),
+		Genres:       []string{"Rock"},
+		BPM:          120,
+		Key:          "C",
 	}
 	updated := db.Song{
-		Filename:        "some-song.mp3",
-		Artist:          "New Artist",
-		Title:           "New Title",
-		Album:           "New Album",
-		AlbumArtist:     "New AlbumArtist",
-		DiscSubtitle:    "New DiscSubtitle",
-		AlbumID:         "New AlbumID",
-		RecordingID:     "New RecordingID",
-		OrigAlbumID:     orig.AlbumID,
-		OrigRecordingID: orig.RecordingID,
-		Track:           3,
-		Disc:            4,
-		Date:            time.Date(2021, 1, 2, 3, 4, 0, 0, time.UTC),
+		Filename:            "some-song.mp3",
+		Artist:              "New Artist",
+		Title:               "New Title",
+		Album:               "New Album",
+		AlbumArtist:         "New AlbumArtist",
+		Composer:            "New Composer",
+		Conductor:           "New Conductor",
+		Performer:           "New Performer",
+		DiscSubtitle:        "New DiscSubtitle",
+		AlbumID:             "New AlbumID",
+		RecordingID:         "New RecordingID",
+		OrigAlbumID:         orig.AlbumID,
+		OrigRecordingID:     orig.RecordingID,
+		Track:               3,
+		Disc:                4,
+		TotalTracks:         12,
+		TotalDiscs:          5,
+		Date:                time.Date(2021, 1, 2, 3, 4, 0, 0, time.UTC),
+		OriginalDate:        time.Date(1971, 5, 6, 0, 0, 0, 0, time.UTC),
+		ReleaseDate:         time.Date(2021, 1, 2, 0, 0, 0, 0, time.UTC),
+		Genres:              []string{"Jazz", "Fusion"},
+		BPM:                 93.5,
+		Key:                 "F#m",
+		Compilation:         true,
+		Segments:            []db.Segment{{Title: "Intro", Start: 0}, {Title: "Main", Start: 45.5}},
+		ArtistCredits:       []db.ArtistCredit{{Name: "New", MBID: "new-id", JoinPhrase: " & "}, {Name: "Artist"}},
+		ArtistSortName:      "Artist, New",
+		AlbumSortName:       "Album, New",
+		AlbumArtistSortName: "Album Artist, New",
 	}
 
 	cfg := &client.Config{MetadataDir: t.TempDir()}
@@ -0,0 +1,114 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package files
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sort"
+	"strings"
+	"unicode/utf16"
+
+	"github.com/derat/nup/server/db"
+	"github.com/derat/taglib-go/taglib"
+	"github.com/derat/taglib-go/taglib/id3"
+)
+
+// getSegments returns the chapters described by tag's CHAP frames, sorted by start time.
+// CTOC frames aren't consulted since the chapters' start times determine their order.
+func getSegments(tag taglib.GenericTag) []db.Segment {
+	var chaps [][]byte
+	var synchsafe bool // whether sub-frame sizes are synchsafe integers
+	switch t := tag.(type) {
+	case *id3.Id3v23Tag:
+		for _, f := range t.Frames["CHAP"] {
+			chaps = append(chaps, f.Content)
+		}
+	case *id3.Id3v24Tag:
+		synchsafe = true
+		for _, f := range t.Frames["CHAP"] {
+			chaps = append(chaps, f.Content)
+		}
+	}
+
+	var segs []db.Segment
+	for _, b := range chaps {
+		if seg, ok := parseChapFrame(b, synchsafe); ok {
+			segs = append(segs, seg)
+		}
+	}
+	sort.SliceStable(segs, func(i, j int) bool { return segs[i].Start < segs[j].Start })
+	return segs
+}
+
+// parseChapFrame parses the contents of an ID3v2 CHAP frame, consisting of a null-terminated
+// element ID, start and end times in milliseconds, start and end byte offsets, and optional
+// embedded frames. The chapter's title is read from an embedded TIT2 frame.
+// If synchsafe is true, embedded frame sizes are read as ID3v2.4 synchsafe integers.
+func parseChapFrame(b []byte, synchsafe bool) (seg db.Segment, ok bool) {
+	idx := bytes.IndexByte(b, 0)
+	if idx < 0 || len(b) < idx+17 {
+		return seg, false
+	}
+	seg.Start = float64(binary.BigEndian.Uint32(b[idx+1:])) / 1000
+
+	sub := b[idx+17:]
+	for len(sub) >= 10 {
+		id := string(sub[:4])
+		var size int
+		if synchsafe {
+			size = int(sub[4]&0x7f)<<21 | int(sub[5]&0x7f)<<14 | int(sub[6]&0x7f)<<7 | int(sub[7]&0x7f)
+		} else {
+			size = int(binary.BigEndian.Uint32(sub[4:]))
+		}
+		if size < 0 || size > len(sub)-10 {
+			break
+		}
+		if id == "TIT2" {
+			seg.Title = decodeID3Text(sub[10 : 10+size])
+		}
+		sub = sub[10+size:]
+	}
+	return seg, true
+}
+
+// decodeID3Text decodes the first string in b, the contents of an ID3v2 text frame
+// starting with a text encoding byte.
+func decodeID3Text(b []byte) string {
+	if len(b) == 0 {
+		return ""
+	}
+	enc, data := b[0], b[1:]
+	var s string
+	switch enc {
+	case 0: // ISO-8859-1
+		rs := make([]rune, len(data))
+		for i, c := range data {
+			rs[i] = rune(c)
+		}
+		s = string(rs)
+	case 1, 2: // UTF-16 with BOM, UTF-16BE
+		bigEndian := enc == 2
+		if len(data) >= 2 && data[0] == 0xfe && data[1] == 0xff {
+			bigEndian, data = true, data[2:]
+		} else if len(data) >= 2 && data[0] == 0xff && data[1] == 0xfe {
+			bigEndian, data = false, data[2:]
+		}
+		units := make([]uint16, 0, len(data)/2)
+		for i := 0; i+1 < len(data); i += 2 {
+			if bigEndian {
+				units = append(units, uint16(data[i])<<8|uint16(data[i+1]))
+			} else {
+				units = append(units, uint16(data[i+1])<<8|uint16(data[i]))
+			}
+		}
+		s = string(utf16.Decode(units))
+	default: // UTF-8
+		s = string(data)
+	}
+	if i := strings.IndexByte(s, 0); i >= 0 {
+		s = s[:i]
+	}
+	return strings.TrimSpace(s)
+}
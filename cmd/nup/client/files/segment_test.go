@@ -0,0 +1,72 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package files
+
+import (
+	"testing"
+
+	"github.com/derat/nup/server/db"
+)
+
+// makeChapFrame returns the contents of a CHAP frame starting at startMs and containing
+// the supplied embedded frames.
+func makeChapFrame(id string, startMs uint32, frames ...[]byte) []byte {
+	b := append([]byte(id), 0)
+	b = append(b, byte(startMs>>24), byte(startMs>>16), byte(startMs>>8), byte(startMs))
+	b = append(b, 0xff, 0xff, 0xff, 0xff) // end time (unused)
+	b = append(b, 0xff, 0xff, 0xff, 0xff) // start offset (unused)
+	b = append(b, 0xff, 0xff, 0xff, 0xff) // end offset (unused)
+	for _, f := range frames {
+		b = append(b, f...)
+	}
+	return b
+}
+
+// makeSubFrame returns an embedded frame. Sizes are the same in ID3v2.3 and v2.4
+// (i.e. synchsafe or not) for data shorter than 128 bytes.
+func makeSubFrame(id string, data []byte) []byte {
+	return append(append([]byte(id), 0, 0, 0, byte(len(data)), 0, 0), data...)
+}
+
+func TestParseChapFrame(t *testing.T) {
+	for _, tc := range []struct {
+		data []byte
+		want db.Segment
+		ok   bool
+	}{
+		{makeChapFrame("chp0", 0, makeSubFrame("TIT2", []byte("\x03First\x00"))),
+			db.Segment{Title: "First", Start: 0}, true},
+		{makeChapFrame("chp1", 90500,
+			makeSubFrame("TIT3", []byte("\x03Subtitle")),
+			makeSubFrame("TIT2", []byte("\x01\xff\xfeS\x00e\x00c\x00"))),
+			db.Segment{Title: "Sec", Start: 90.5}, true},
+		{makeChapFrame("chp2", 1000), db.Segment{Start: 1}, true},
+		{makeChapFrame("chp3", 2000, makeSubFrame("TIT2", []byte("\x00caf\xe9"))),
+			db.Segment{Title: "café", Start: 2}, true},
+		{makeChapFrame("chp4", 3000, []byte("TIT2\x00\x00\x00\x50\x00\x00\x03x")), db.Segment{Start: 3}, true},
+		{[]byte("chp5\x00\x00\x00"), db.Segment{}, false},
+		{[]byte("no-terminator"), db.Segment{}, false},
+	} {
+		if got, ok := parseChapFrame(tc.data, true); got != tc.want || ok != tc.ok {
+			t.Errorf("parseChapFrame(%q) = %+v, %v; want %+v, %v", tc.data, got, ok, tc.want, tc.ok)
+		}
+	}
+}
+
+func TestDecodeID3Text(t *testing.T) {
+	for _, tc := range []struct {
+		data string
+		want string
+	}{
+		{"", ""},
+		{"\x00caf\xe9", "café"},
+		{"\x01\xfe\xff\x00a\x00b", "ab"},
+		{"\x02\x00a\x00b\x00\x00", "ab"},
+		{"\x03 caf\xc3\xa9 \x00other", "café"},
+	} {
+		if got := decodeID3Text([]byte(tc.data)); got != tc.want {
+			t.Errorf("decodeID3Text(%q) = %q; want %q", tc.data, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,40 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package files
+
+import (
+	"os"
+
+	"github.com/derat/mpeg"
+	"github.com/derat/taglib-go/taglib"
+)
+
+// ComputeSHA1 returns the SHA1 of the audio data in f, excluding ID3 tags or
+// FLAC metadata blocks. The result matches the SHA1 set by ReadSong.
+func ComputeSHA1(f *os.File) (string, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	if isFLAC, err := isFLACFile(f); err != nil {
+		return "", err
+	} else if isFLAC {
+		md, err := readFLACMetadata(f)
+		if err != nil {
+			return "", err
+		}
+		return computeFLACAudioSHA1(f, md.audioOffset)
+	}
+	var headerLen, footerLen int64
+	if tag, err := mpeg.ReadID3v1Footer(f, fi); err != nil {
+		return "", err
+	} else if tag != nil {
+		footerLen = mpeg.ID3v1Length
+	}
+	// ReadSong tolerates missing ID3v2 tags, so do the same here.
+	if tag, err := taglib.Decode(f, fi.Size()); err == nil {
+		headerLen = int64(tag.TagSize())
+	}
+	return mpeg.ComputeAudioSHA1(f, fi, headerLen, footerLen)
+}
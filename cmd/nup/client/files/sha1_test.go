@@ -0,0 +1,33 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package files
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/derat/nup/test"
+)
+
+func TestComputeSHA1(t *testing.T) {
+	dir := t.TempDir()
+	for _, s := range []struct{ Filename, SHA1 string }{
+		{test.Song0s.Filename, test.Song0s.SHA1},
+		{test.ID3V1Song.Filename, test.ID3V1Song.SHA1},
+		{test.Song5s.Filename, test.Song5s.SHA1},
+	} {
+		test.Must(t, test.CopySongs(dir, s.Filename))
+		f, err := os.Open(filepath.Join(dir, s.Filename))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, err := ComputeSHA1(f); err != nil {
+			t.Errorf("ComputeSHA1(%q) failed: %v", s.Filename, err)
+		} else if got != s.SHA1 {
+			t.Errorf("ComputeSHA1(%q) = %q; want %q", s.Filename, got, s.SHA1)
+		}
+		f.Close()
+	}
+}
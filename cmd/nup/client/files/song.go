@@ -7,6 +7,7 @@ package files
 import (
 	"errors"
 	"fmt"
+	"log"
 	"os"
 	"path/filepath"
 	"regexp"
@@ -16,8 +17,12 @@ import (
 
 	"github.com/derat/mpeg"
 	"github.com/derat/nup/cmd/nup/client"
+	"github.com/derat/nup/cmd/nup/loudness"
+	"github.com/derat/nup/cmd/nup/mp3gain"
+	"github.com/derat/nup/cmd/nup/silence"
 	"github.com/derat/nup/server/db"
 	"github.com/derat/taglib-go/taglib"
+	"github.com/derat/taglib-go/taglib/id3"
 )
 
 const (
@@ -34,17 +39,24 @@ type ReadSongFlag uint32
 
 const (
 	// SkipAudioData indicates that audio data (used to compute the song's SHA1,
-	// duration, and gain adjustments) will not be read.
+	// duration, gain adjustments, and silence) will not be read.
 	SkipAudioData ReadSongFlag = 1 << iota
 	// OnlyFileMetadata indicates that the returned db.Song object should only include
-	// metadata from the file's ID3 tag. cfg.ArtistRewrites and cfg.AlbumIDRewrites will
-	// not be used and metadata override files will not be read.
+	// metadata from the file's ID3 tag or Vorbis comments. cfg.RewriteRules and
+	// cfg.AlbumIDRewrites will not be used and metadata override files will not be read.
 	OnlyFileMetadata
 )
 
-// ReadSong reads the song file at p and creates a Song object.
+// ReadSong reads the song file at p and creates a Song object. p may be an MP3 file with
+// ID3 tags or a FLAC file with Vorbis comments (see IsLosslessPath).
 // If fi is non-nil, it will be used; otherwise the file will be stat-ed by this function.
-// gc is only used if cfg.ComputeGains is true and flags does not contain SkipAudioData.
+// gc is only used if cfg.ComputeGains is true, flags does not contain SkipAudioData, and
+// p is an MP3 file.
+// If cfg.DetectSilence is true, leading and trailing silence are found using ffmpeg.
+// If cfg.ComputeLoudness is true, EBU R128 loudness is measured using ffmpeg.
+// If cfg.ReadGainTags is true, gain adjustments are read from the song's tag when present.
+// If cfg.IdentifyUntagged is true and the song lacks a recording ID, AcoustID is used to
+// look up its recording and album IDs.
 func ReadSong(cfg *client.Config, p string, fi os.FileInfo, flags ReadSongFlag, gc *GainsCache) (*db.Song, error) {
 	var relPath string
 	var err error
@@ -73,8 +85,120 @@ func ReadSong(cfg *client.Config, p string, fi os.FileInfo, flags ReadSongFlag,
 	s := db.Song{Filename: relPath}
 
 	var headerLen, footerLen int64
-	if tag, err := mpeg.ReadID3v1Footer(f, fi); err != nil {
+	var tagGain *mp3gain.Info // gain info read from the tag
+	var flac *flacMetadata    // non-nil for FLAC files
+	if isFLAC, err := isFLACFile(f); err != nil {
 		return nil, err
+	} else if isFLAC {
+		if flac, err = readFLACMetadata(f); err != nil {
+			return nil, err
+		}
+		tagGain = applyVorbisComments(&s, flac.comments, cfg.ReadGainTags)
+	} else if headerLen, footerLen, tagGain, err = readID3Tags(f, fi, &s, cfg.ReadGainTags); err != nil {
+		return nil, err
+	}
+
+	if flags&OnlyFileMetadata == 0 {
+		for i := range cfg.RewriteRules {
+			if _, err := cfg.RewriteRules[i].Apply(&s); err != nil {
+				return nil, fmt.Errorf("rewrite rule %d: %v", i, err)
+			}
+		}
+		if repl, ok := cfg.AlbumIDRewrites[s.AlbumID]; ok {
+			// Look for a cover image corresponding to the original ID as well.
+			// Don't bother setting this if the rewrite didn't actually change anything
+			// (i.e. it was just defined to set the disc number).
+			if s.CoverID == "" && s.AlbumID != repl {
+				s.CoverID = s.AlbumID
+			}
+			s.AlbumID = repl
+
+			// Extract the disc number and subtitle from the album name.
+			if album, disc, subtitle := extractAlbumDisc(s.Album); disc != 0 {
+				s.Album = album
+				s.Disc = disc
+				if s.DiscSubtitle == "" {
+					s.DiscSubtitle = subtitle
+				}
+			}
+		}
+		if err := applyMetadataOverride(cfg, &s); err != nil {
+			return nil, err
+		}
+	}
+
+	if flags&SkipAudioData != 0 {
+		return &s, nil
+	}
+
+	if flac != nil {
+		if s.SHA1, err = computeFLACAudioSHA1(f, flac.audioOffset); err != nil {
+			return nil, err
+		}
+		s.Length = flac.duration().Seconds()
+	} else {
+		if s.SHA1, err = mpeg.ComputeAudioSHA1(f, fi, headerLen, footerLen); err != nil {
+			return nil, err
+		}
+		dur, _, err := mpeg.ComputeAudioDuration(f, fi, headerLen, footerLen)
+		if err != nil {
+			return nil, err
+		}
+		s.Length = dur.Seconds()
+	}
+
+	if tagGain != nil {
+		s.TrackGain = tagGain.TrackGain
+		s.AlbumGain = tagGain.AlbumGain
+		s.PeakAmp = tagGain.PeakAmp
+	} else if cfg.ComputeGain && flac == nil {
+		// mp3gain only understands MP3 files, so FLAC files need ReplayGain tags.
+		gain, err := gc.get(p, s.Album, s.AlbumID)
+		if err != nil {
+			return nil, err
+		}
+		s.TrackGain = gain.TrackGain
+		s.AlbumGain = gain.AlbumGain
+		s.PeakAmp = gain.PeakAmp
+	}
+
+	if cfg.DetectSilence {
+		info, err := silence.Detect(p)
+		if err != nil {
+			return nil, err
+		}
+		s.LeadingSilence = info.Leading
+		s.TrailingSilence = info.Trailing
+	}
+
+	if cfg.ComputeLoudness {
+		info, err := loudness.Measure(p)
+		if err != nil {
+			return nil, err
+		}
+		s.Loudness = info.Integrated
+		s.TruePeak = info.TruePeak
+	}
+
+	// This is done after computing gains since GainsCache groups songs by album ID
+	// (and doesn't read audio data for the album's other songs).
+	if cfg.IdentifyUntagged && s.RecordingID == "" {
+		if err := identifySong(cfg, p, &s); err != nil {
+			// Failing to identify a song shouldn't prevent it from being updated.
+			log.Printf("Failed identifying %v: %v", relPath, err)
+		}
+	}
+
+	return &s, nil
+}
+
+// readID3Tags copies metadata from the ID3v1 and ID3v2 tags in f to s and returns
+// the lengths of the tags at the beginning and end of the file. If readGain is true,
+// ReplayGain information is also returned if present.
+func readID3Tags(f *os.File, fi os.FileInfo, s *db.Song, readGain bool) (
+	headerLen, footerLen int64, tagGain *mp3gain.Info, err error) {
+	if tag, err := mpeg.ReadID3v1Footer(f, fi); err != nil {
+		return 0, 0, nil, err
 	} else if tag != nil {
 		footerLen = mpeg.ID3v1Length
 		s.Artist = tag.Artist
@@ -88,7 +212,7 @@ func ReadSong(cfg *client.Config, p string, fi os.FileInfo, flags ReadSongFlag,
 	if tag, err := taglib.Decode(f, fi.Size()); err != nil {
 		// Tolerate missing ID3v2 tags if we got an artist and title from ID3v1.
 		if len(s.Artist) == 0 && len(s.Title) == 0 {
-			return nil, err
+			return 0, 0, nil, err
 		}
 	} else {
 		s.Artist = tag.Artist()
@@ -97,91 +221,126 @@ func ReadSong(cfg *client.Config, p string, fi os.FileInfo, flags ReadSongFlag,
 		s.AlbumID = tag.CustomFrames()[albumIDTag]
 		s.CoverID = tag.CustomFrames()[coverIDTag]
 		s.RecordingID = tag.UniqueFileIdentifiers()[recordingIDOwner]
+		if readGain {
+			if info, ok := readGainTags(tag.CustomFrames()); ok {
+				tagGain = &info
+			}
+		}
 		s.Track = int(tag.Track())
 		s.Disc = int(tag.Disc())
 		headerLen = int64(tag.TagSize())
 
 		if date, err := getSongDate(tag); err != nil {
-			return nil, err
+			return 0, 0, nil, err
 		} else if !date.IsZero() {
 			s.Date = date
 		}
+		// TDOR (Original release time) or TORY in ID3v2.3 contains the original release date,
+		// while TDRL (Release time) and TDRC (Recording time) may describe a later reissue.
+		if s.OriginalDate, err = getFirstTime(tag, mpeg.OriginalReleaseTime); err != nil {
+			return 0, 0, nil, err
+		}
+		if s.ReleaseDate, err = getFirstTime(tag, mpeg.ReleaseTime, mpeg.RecordingTime); err != nil {
+			return 0, 0, nil, err
+		}
 
 		// ID3 v2.4 defines TPE2 (Band/orchestra/accompaniment) as
 		// "additional information about the performers in the recording".
 		// Only save the album artist if it's different from the track artist.
 		if aa, err := mpeg.GetID3v2TextFrame(tag, "TPE2"); err != nil {
-			return nil, err
+			return 0, 0, nil, err
 		} else if aa != s.Artist {
 			s.AlbumArtist = aa
 		}
 
+		// TCOM (Composer) and TPE3 (Conductor/performer refinement) contain
+		// additional credits that are often present for classical recordings.
+		if s.Composer, err = mpeg.GetID3v2TextFrame(tag, "TCOM"); err != nil {
+			return 0, 0, nil, err
+		}
+		if s.Conductor, err = mpeg.GetID3v2TextFrame(tag, "TPE3"); err != nil {
+			return 0, 0, nil, err
+		}
+		s.Performer = strings.Join(getPerformers(tag), ", ")
+
 		// TSST (Set subtitle) contains the disc's subtitle.
 		// Most multi-disc albums don't have subtitles.
 		if s.DiscSubtitle, err = mpeg.GetID3v2TextFrame(tag, "TSST"); err != nil {
-			return nil, err
+			return 0, 0, nil, err
 		}
 
-		// Some old files might be missing the TPOS "part of set" frame.
-		// Assume that they're from a single-disc album in that case:
-		// https://github.com/derat/nup/issues/37
-		if s.Disc == 0 && s.Track > 0 && s.Album != NonAlbumTracksValue {
-			s.Disc = 1
+		// TSOP (Performer sort order), TSOA (Album sort order), and the non-standard but
+		// widely-used TSO2 (Album artist sort order) contain the names used when sorting,
+		// e.g. "Beatles, The" for "The Beatles".
+		if s.ArtistSortName, err = mpeg.GetID3v2TextFrame(tag, "TSOP"); err != nil {
+			return 0, 0, nil, err
 		}
-	}
-
-	if flags&OnlyFileMetadata == 0 {
-		if repl, ok := cfg.ArtistRewrites[s.Artist]; ok {
-			s.Artist = repl
+		if s.AlbumSortName, err = mpeg.GetID3v2TextFrame(tag, "TSOA"); err != nil {
+			return 0, 0, nil, err
+		}
+		if s.AlbumArtistSortName, err = mpeg.GetID3v2TextFrame(tag, "TSO2"); err != nil {
+			return 0, 0, nil, err
 		}
-		if repl, ok := cfg.AlbumIDRewrites[s.AlbumID]; ok {
-			// Look for a cover image corresponding to the original ID as well.
-			// Don't bother setting this if the rewrite didn't actually change anything
-			// (i.e. it was just defined to set the disc number).
-			if s.CoverID == "" && s.AlbumID != repl {
-				s.CoverID = s.AlbumID
-			}
-			s.AlbumID = repl
 
-			// Extract the disc number and subtitle from the album name.
-			if album, disc, subtitle := extractAlbumDisc(s.Album); disc != 0 {
-				s.Album = album
-				s.Disc = disc
-				if s.DiscSubtitle == "" {
-					s.DiscSubtitle = subtitle
-				}
+		// TRCK (Track number/Position in set) and TPOS (Part of a set) may also contain
+		// the total number of tracks or discs, e.g. "3/12".
+		for _, info := range []struct {
+			id  string
+			dst *int
+		}{
+			{"TRCK", &s.TotalTracks},
+			{"TPOS", &s.TotalDiscs},
+		} {
+			val, err := mpeg.GetID3v2TextFrame(tag, info.id)
+			if err != nil {
+				return 0, 0, nil, err
 			}
+			_, *info.dst = parsePosition(val)
 		}
-		if err := applyMetadataOverride(cfg, &s); err != nil {
-			return nil, err
-		}
-	}
 
-	if flags&SkipAudioData != 0 {
-		return &s, nil
-	}
+		// TCON (Content type) contains the song's genres.
+		tcon, err := mpeg.GetID3v2TextFrame(tag, "TCON")
+		if err != nil {
+			return 0, 0, nil, err
+		}
+		s.Genres = parseGenres(tcon)
 
-	s.SHA1, err = mpeg.ComputeAudioSHA1(f, fi, headerLen, footerLen)
-	if err != nil {
-		return nil, err
-	}
-	dur, _, err := mpeg.ComputeAudioDuration(f, fi, headerLen, footerLen)
-	if err != nil {
-		return nil, err
-	}
-	s.Length = dur.Seconds()
+		// TBPM (BPM) and TKEY (Initial key) describe the song's tempo and musical key.
+		// TBPM is supposed to be an integer, but some taggers write fractional values.
+		// Unparseable values are ignored rather than preventing the song from being imported.
+		if bpm, err := mpeg.GetID3v2TextFrame(tag, "TBPM"); err != nil {
+			return 0, 0, nil, err
+		} else if v, err := strconv.ParseFloat(strings.TrimSpace(bpm), 64); err == nil && v > 0 {
+			s.BPM = v
+		}
+		if s.Key, err = mpeg.GetID3v2TextFrame(tag, "TKEY"); err != nil {
+			return 0, 0, nil, err
+		}
+		s.Key = strings.TrimSpace(s.Key)
 
-	if cfg.ComputeGain {
-		gain, err := gc.get(p, s.Album, s.AlbumID)
+		// TCMP (Part of a compilation) is a non-standard frame written by iTunes and others.
+		tcmp, err := mpeg.GetID3v2TextFrame(tag, "TCMP")
 		if err != nil {
-			return nil, err
+			return 0, 0, nil, err
 		}
-		s.TrackGain = gain.TrackGain
-		s.AlbumGain = gain.AlbumGain
-		s.PeakAmp = gain.PeakAmp
-	}
+		s.Compilation = strings.TrimSpace(tcmp) == "1"
 
-	return &s, nil
+		// TXXX "ARTISTS" and "MusicBrainz Artist Id" frames written by Picard list the
+		// individual artists credited in TPE1 (e.g. "A" and "B" for "A feat. B").
+		s.ArtistCredits = makeArtistCredits(s.Artist,
+			getCustomFrameValues(tag, artistsTag), getCustomFrameValues(tag, artistIDTag))
+
+		// CHAP frames describe chapters within the song, e.g. tracks within a DJ mix.
+		s.Segments = getSegments(tag)
+
+		// Some old files might be missing the TPOS "part of set" frame.
+		// Assume that they're from a single-disc album in that case:
+		// https://github.com/derat/nup/issues/37
+		if s.Disc == 0 && s.Track > 0 && s.Album != NonAlbumTracksValue {
+			s.Disc = 1
+		}
+	}
+	return headerLen, footerLen, tagGain, nil
 }
 
 // extractAlbumDisc attempts to extract a disc number and optional title from an album name.
@@ -199,6 +358,21 @@ func extractAlbumDisc(orig string) (album string, discNum int, discTitle string)
 	return orig[:len(orig)-len(ms[0])], discNum, ms[2]
 }
 
+// parsePosition parses a TRCK or TPOS frame value like "3" or "3/12" into a position
+// and an optional total. 0 is returned for missing or unparseable values.
+func parsePosition(val string) (pos, total int) {
+	parts := strings.SplitN(strings.TrimSpace(val), "/", 2)
+	if v, err := strconv.Atoi(strings.TrimSpace(parts[0])); err == nil && v > 0 {
+		pos = v
+	}
+	if len(parts) == 2 {
+		if v, err := strconv.Atoi(strings.TrimSpace(parts[1])); err == nil && v > 0 {
+			total = v
+		}
+	}
+	return pos, total
+}
+
 // albumDiscRegexp matches pre-NGS MusicBrainz album names used for multi-disc releases.
 // The first subgroup contains the disc number, while the second subgroup contains
 // the disc/medium title (if any).
@@ -206,11 +380,13 @@ var albumDiscRegexp = regexp.MustCompile(`\s+\(disc (\d+)(?::\s+([^)]+))?\)$`)
 
 // getSongDate tries to extract a song's release or recording date.
 func getSongDate(tag taglib.GenericTag) (time.Time, error) {
-	for _, tt := range []mpeg.TimeType{
-		mpeg.OriginalReleaseTime,
-		mpeg.RecordingTime,
-		mpeg.ReleaseTime,
-	} {
+	return getFirstTime(tag, mpeg.OriginalReleaseTime, mpeg.RecordingTime, mpeg.ReleaseTime)
+}
+
+// getFirstTime returns the first time of the supplied types present in tag.
+// The zero time is returned if none of them are present.
+func getFirstTime(tag taglib.GenericTag, types ...mpeg.TimeType) (time.Time, error) {
+	for _, tt := range types {
 		if tm, err := mpeg.GetID3v2Time(tag, tt); err != nil {
 			return time.Time{}, err
 		} else if !tm.Empty() {
@@ -220,9 +396,44 @@ func getSongDate(tag taglib.GenericTag) (time.Time, error) {
 	return time.Time{}, nil
 }
 
+// getPerformers returns the names listed in tag's musician credits list.
+// This is the TMCL frame in ID3v2.4 and the IPLS frame in ID3v2.3. Both frames
+// contain alternating role (e.g. instrument) and name strings.
+func getPerformers(tag taglib.GenericTag) []string {
+	var fields []string
+	switch t := tag.(type) {
+	case *id3.Id3v23Tag:
+		if frames := t.Frames["IPLS"]; len(frames) > 0 {
+			fields, _ = id3.GetId3v23TextIdentificationFrame(frames[0])
+		}
+	case *id3.Id3v24Tag:
+		if frames := t.Frames["TMCL"]; len(frames) > 0 {
+			fields, _ = id3.GetId3v24TextIdentificationFrame(frames[0])
+		}
+	}
+
+	var names []string
+	for i := 1; i < len(fields); i += 2 {
+		if name := strings.TrimSpace(fields[i]); name != "" && !hasString(names, name) {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// hasString returns true if vals contains s.
+func hasString(vals []string, s string) bool {
+	for _, v := range vals {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
 // IsMusicPath returns true if path p has an extension suggesting that it's a music file.
 func IsMusicPath(p string) bool {
-	// TODO: Add support for other file types someday, maybe.
-	// At the very least, ReadSong would need to be updated to understand non-MPEG files.
+	// Lossless files are only uploaded after being transcoded, so they're excluded here
+	// and handled separately (see IsLosslessPath).
 	return strings.ToLower(filepath.Ext(p)) == ".mp3"
 }
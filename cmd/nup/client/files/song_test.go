@@ -74,6 +74,26 @@ func TestReadSong_ID3V1(t *testing.T) {
 	}
 }
 
+func TestParsePosition(t *testing.T) {
+	for _, tc := range []struct {
+		val        string
+		pos, total int
+	}{
+		{"", 0, 0},
+		{"3", 3, 0},
+		{"3/12", 3, 12},
+		{" 3 / 12 ", 3, 12},
+		{"/12", 0, 12},
+		{"3/", 3, 0},
+		{"a/b", 0, 0},
+		{"-1/-2", 0, 0},
+	} {
+		if pos, total := parsePosition(tc.val); pos != tc.pos || total != tc.total {
+			t.Errorf("parsePosition(%q) = %d, %d; want %d, %d", tc.val, pos, total, tc.pos, tc.total)
+		}
+	}
+}
+
 func TestExtractAlbumDisc(t *testing.T) {
 	for _, tc := range []struct {
 		orig      string
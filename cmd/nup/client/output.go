@@ -0,0 +1,243 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package client
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// OutputFormat describes how subcommands report their results.
+type OutputFormat string
+
+const (
+	// TextOutput reports results as human-readable lines.
+	TextOutput OutputFormat = "text"
+	// JSONOutput reports results as a series of JSON objects, one per line.
+	// See ItemEvent, ProgressEvent, and SummaryEvent.
+	JSONOutput OutputFormat = "json"
+)
+
+// jsonProgressInterval is the minimum interval between ProgressEvents in JSON output.
+const jsonProgressInterval = time.Second
+
+// textProgressInterval is the minimum interval between progress updates in text output.
+const textProgressInterval = 100 * time.Millisecond
+
+// OutputFlags contains flags shared by subcommands to control their output.
+type OutputFlags struct {
+	Format   string // "text" or "json"
+	Progress bool   // report progress
+}
+
+// SetFlags adds -format and -progress flags to f.
+func (o *OutputFlags) SetFlags(f *flag.FlagSet) {
+	f.StringVar(&o.Format, "format", string(TextOutput), `Output format ("text" or "json")`)
+	f.BoolVar(&o.Progress, "progress", false, "Report progress")
+}
+
+// NewReporter returns a new Reporter that writes results to w.
+// An error is returned if o.Format is invalid.
+func (o *OutputFlags) NewReporter(w io.Writer) (*Reporter, error) {
+	switch f := OutputFormat(o.Format); f {
+	case TextOutput, JSONOutput:
+		return &Reporter{
+			w:        w,
+			format:   f,
+			progress: o.Progress,
+			counts:   make(map[string]int),
+			start:    time.Now(),
+		}, nil
+	default:
+		return nil, fmt.Errorf("invalid format %q", o.Format)
+	}
+}
+
+// ItemEvent is written by Reporter in JSON mode to describe the result for a single item.
+type ItemEvent struct {
+	Type    string `json:"type"` // "item"
+	Item    string `json:"item"`
+	Status  string `json:"status"`
+	Message string `json:"message,omitempty"`
+}
+
+// ProgressEvent is written by Reporter in JSON mode to report progress.
+type ProgressEvent struct {
+	Type  string `json:"type"` // "progress"
+	Done  int    `json:"done"`
+	Total int    `json:"total,omitempty"` // 0 if unknown
+}
+
+// SummaryEvent is written by Reporter in JSON mode after all items have been processed.
+type SummaryEvent struct {
+	Type       string         `json:"type"` // "summary"
+	Counts     map[string]int `json:"counts"`
+	ElapsedSec float64        `json:"elapsedSec"`
+}
+
+// Reporter reports per-item results, progress, and summary counts for a subcommand.
+// It is safe to call Reporter's methods from multiple goroutines.
+type Reporter struct {
+	// LogText indicates that text-mode lines should be written via the log package
+	// (i.e. to stderr with timestamps) instead of to the Reporter's writer.
+	LogText bool
+
+	w        io.Writer
+	format   OutputFormat
+	progress bool
+
+	mu           sync.Mutex
+	total        int            // total items, or 0 if unknown
+	done         int            // items processed so far
+	counts       map[string]int // keyed by status
+	start        time.Time      // time at which reporter was created
+	lastProgress time.Time      // last time that progress was reported
+	progressLine bool           // text progress line needs to be terminated
+}
+
+// JSON returns true if r writes JSON output.
+func (r *Reporter) JSON() bool { return r.format == JSONOutput }
+
+// AddTotal adds n to the total number of items that will be processed.
+func (r *Reporter) AddTotal(n int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.total += n
+}
+
+// Item reports the result of processing item. status is a short machine-readable string
+// (e.g. "updated") that is also used as a key in the summary's counts. In text mode, msg is
+// written as a line if it is non-empty.
+func (r *Reporter) Item(item, status, msg string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.counts[status]++
+	if r.JSON() {
+		r.writeJSON(ItemEvent{Type: "item", Item: item, Status: status, Message: msg})
+	} else if msg != "" {
+		r.writeText(msg)
+	}
+}
+
+// Textf writes a formatted informational line in text mode. It does nothing in JSON mode.
+func (r *Reporter) Textf(format string, args ...interface{}) {
+	if r.JSON() {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.writeText(fmt.Sprintf(format, args...))
+}
+
+// Advance records that n more items have been processed and reports progress if enabled.
+func (r *Reporter) Advance(n int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.done += n
+	r.reportProgress(false)
+}
+
+// Count adds n to the summary count for key without reporting an item.
+func (r *Reporter) Count(key string, n int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.counts[key] += n
+}
+
+// Summary reports the final counts. It should be called once after all items are processed.
+func (r *Reporter) Summary() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.reportProgress(true)
+	if r.progressLine {
+		fmt.Fprintln(os.Stderr)
+		r.progressLine = false
+	}
+	elapsed := time.Since(r.start)
+	if r.JSON() {
+		r.writeJSON(SummaryEvent{Type: "summary", Counts: r.counts, ElapsedSec: elapsed.Seconds()})
+		return
+	}
+	if len(r.counts) == 0 {
+		return
+	}
+	keys := make([]string, 0, len(r.counts))
+	for k := range r.counts {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := make([]string, len(keys))
+	for i, k := range keys {
+		parts[i] = fmt.Sprintf("%s=%d", k, r.counts[k])
+	}
+	r.writeText(fmt.Sprintf("Summary: %s (%v)", strings.Join(parts, " "), elapsed.Round(time.Millisecond)))
+}
+
+// reportProgress reports progress if enabled. If force is false, reports are rate-limited.
+// r.mu must be held.
+func (r *Reporter) reportProgress(force bool) {
+	if !r.progress {
+		return
+	}
+	interval := textProgressInterval
+	if r.JSON() {
+		interval = jsonProgressInterval
+	}
+	now := time.Now()
+	if !force && now.Sub(r.lastProgress) < interval {
+		return
+	}
+	r.lastProgress = now
+
+	if r.JSON() {
+		r.writeJSON(ProgressEvent{Type: "progress", Done: r.done, Total: r.total})
+		return
+	}
+	// Text progress is always written to stderr so it won't be mixed with data on stdout.
+	if r.total > 0 {
+		pct := 100 * r.done / r.total
+		fmt.Fprintf(os.Stderr, "\r%s %d/%d (%d%%)", progressBar(r.done, r.total, 30), r.done, r.total, pct)
+	} else {
+		fmt.Fprintf(os.Stderr, "\r%d done", r.done)
+	}
+	r.progressLine = true
+}
+
+// writeJSON writes v to r.w as a single line. r.mu must be held.
+func (r *Reporter) writeJSON(v interface{}) {
+	if err := json.NewEncoder(r.w).Encode(v); err != nil {
+		log.Print("Failed writing output: ", err)
+	}
+}
+
+// writeText writes s as a line. r.mu must be held.
+func (r *Reporter) writeText(s string) {
+	// Terminate the progress line first so the text isn't appended to it.
+	if r.progressLine {
+		fmt.Fprintln(os.Stderr)
+		r.progressLine = false
+	}
+	if r.LogText {
+		log.Print(s)
+	} else {
+		fmt.Fprintln(r.w, s)
+	}
+}
+
+// progressBar returns a text progress bar of the supplied width.
+func progressBar(done, total, width int) string {
+	n := width
+	if done < total {
+		n = width * done / total
+	}
+	return "[" + strings.Repeat("#", n) + strings.Repeat("-", width-n) + "]"
+}
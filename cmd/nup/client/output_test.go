@@ -0,0 +1,80 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReporter_JSON(t *testing.T) {
+	var b bytes.Buffer
+	o := OutputFlags{Format: "json"}
+	r, err := o.NewReporter(&b)
+	if err != nil {
+		t.Fatal("NewReporter failed: ", err)
+	}
+	r.AddTotal(3)
+	r.Item("a", "updated", "Updated a")
+	r.Item("b", "skipped", "")
+	r.Item("c", "updated", "Updated c")
+	r.Count("bytes", 10)
+	r.Advance(3)
+	r.Summary()
+
+	lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+	if len(lines) != 4 {
+		t.Fatalf("Got %d line(s); want 4:\n%s", len(lines), b.String())
+	}
+	var item ItemEvent
+	if err := json.Unmarshal([]byte(lines[0]), &item); err != nil {
+		t.Error("Failed unmarshaling item: ", err)
+	} else if want := (ItemEvent{"item", "a", "updated", "Updated a"}); item != want {
+		t.Errorf("Got item %+v; want %+v", item, want)
+	}
+	var sum SummaryEvent
+	if err := json.Unmarshal([]byte(lines[3]), &sum); err != nil {
+		t.Error("Failed unmarshaling summary: ", err)
+	} else if want := map[string]int{"updated": 2, "skipped": 1, "bytes": 10}; !reflect.DeepEqual(sum.Counts, want) {
+		t.Errorf("Got counts %v; want %v", sum.Counts, want)
+	}
+}
+
+func TestReporter_Text(t *testing.T) {
+	var b bytes.Buffer
+	o := OutputFlags{Format: "text"}
+	r, err := o.NewReporter(&b)
+	if err != nil {
+		t.Fatal("NewReporter failed: ", err)
+	}
+	r.Item("a", "updated", "Updated a")
+	r.Item("b", "skipped", "")
+	r.Textf("Processed %d item(s)", 2)
+	if got, want := b.String(), "Updated a\nProcessed 2 item(s)\n"; got != want {
+		t.Errorf("Got %q; want %q", got, want)
+	}
+
+	if _, err := (&OutputFlags{Format: "xml"}).NewReporter(&b); err == nil {
+		t.Error("NewReporter unexpectedly accepted bad format")
+	}
+}
+
+func TestProgressBar(t *testing.T) {
+	for _, tc := range []struct {
+		done, total, width int
+		want               string
+	}{
+		{0, 10, 5, "[-----]"},
+		{5, 10, 4, "[##--]"},
+		{10, 10, 3, "[###]"},
+		{12, 10, 3, "[###]"},
+	} {
+		if got := progressBar(tc.done, tc.total, tc.width); got != tc.want {
+			t.Errorf("progressBar(%d, %d, %d) = %q; want %q", tc.done, tc.total, tc.width, got, tc.want)
+		}
+	}
+}
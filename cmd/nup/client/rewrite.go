@@ -0,0 +1,178 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package client
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/derat/nup/server/db"
+)
+
+// RewriteMatchType describes how a RewriteRule's Match field is compared against songs.
+type RewriteMatchType string
+
+const (
+	// ExactMatch indicates that the field's entire value must equal Match.
+	ExactMatch RewriteMatchType = "exact"
+	// RegexMatch indicates that Match is an RE2 regular expression that is searched for
+	// within the field's value.
+	RegexMatch RewriteMatchType = "regex"
+)
+
+// RewriteRule describes a change to make to metadata read from song files.
+// Songs must satisfy all of the rule's conditions to be rewritten.
+type RewriteRule struct {
+	// Field contains the name of the field to rewrite: "artist", "title", "album",
+	// "albumArtist", "composer", "conductor", "performer", or "discSubtitle".
+	Field string `json:"field"`
+	// MatchType describes how Match is compared against the field's value.
+	// ExactMatch is used if it is empty.
+	MatchType RewriteMatchType `json:"matchType"`
+	// Match contains the value (for ExactMatch) or regular expression (for RegexMatch)
+	// to match.
+	Match string `json:"match"`
+	// Replace contains the field's new value. For RegexMatch, only the matched portions
+	// of the value are replaced, and submatch references like "$1" are expanded.
+	Replace string `json:"replace"`
+	// Album optionally limits the rule to songs with the supplied album name.
+	Album string `json:"album"`
+	// Path optionally limits the rule to songs whose files are within the supplied
+	// file or directory, relative to MusicDir.
+	Path string `json:"path"`
+
+	re *regexp.Regexp // compiled from Match by check
+}
+
+// check validates r and compiles its regular expression.
+func (r *RewriteRule) check() error {
+	if getRewriteField(&db.Song{}, r.Field) == nil {
+		return fmt.Errorf("bad field %q", r.Field)
+	}
+	switch r.MatchType {
+	case "", ExactMatch:
+	case RegexMatch:
+		var err error
+		if r.re, err = regexp.Compile(r.Match); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("bad match type %q", r.MatchType)
+	}
+	if r.Path != "" {
+		if p := filepath.Clean(r.Path); filepath.IsAbs(p) || p == ".." || strings.HasPrefix(p, "../") {
+			return fmt.Errorf("path %q isn't within the music dir", r.Path)
+		}
+	}
+	return nil
+}
+
+// Apply rewrites s if it satisfies r's conditions. s.Filename must be relative to the music dir.
+// A description of the change is returned, or an empty string if s wasn't changed.
+func (r *RewriteRule) Apply(s *db.Song) (string, error) {
+	if r.Album != "" && s.Album != r.Album {
+		return "", nil
+	}
+	if r.Path != "" {
+		if p := filepath.Clean(r.Path); s.Filename != p && !strings.HasPrefix(s.Filename, p+"/") {
+			return "", nil
+		}
+	}
+	p := getRewriteField(s, r.Field)
+	if p == nil {
+		return "", fmt.Errorf("bad field %q", r.Field)
+	}
+
+	var val string
+	switch r.MatchType {
+	case "", ExactMatch:
+		if *p != r.Match {
+			return "", nil
+		}
+		val = r.Replace
+	case RegexMatch:
+		re := r.re
+		if re == nil { // check wasn't called
+			var err error
+			if re, err = regexp.Compile(r.Match); err != nil {
+				return "", err
+			}
+		}
+		if !re.MatchString(*p) {
+			return "", nil
+		}
+		val = re.ReplaceAllString(*p, r.Replace)
+	default:
+		return "", fmt.Errorf("bad match type %q", r.MatchType)
+	}
+	if val == *p {
+		return "", nil
+	}
+
+	change := fmt.Sprintf("%v %q -> %q", r.Field, *p, val)
+	*p = val
+	// Credits and sort names describe the original string.
+	switch r.Field {
+	case "artist":
+		s.ArtistCredits = nil
+		s.ArtistSortName = ""
+	case "album":
+		s.AlbumSortName = ""
+	case "albumArtist":
+		s.AlbumArtistSortName = ""
+	}
+	return change, nil
+}
+
+// getRewriteField returns a pointer to s's field named name, or nil if the field
+// can't be rewritten.
+func getRewriteField(s *db.Song, name string) *string {
+	switch name {
+	case "artist":
+		return &s.Artist
+	case "title":
+		return &s.Title
+	case "album":
+		return &s.Album
+	case "albumArtist":
+		return &s.AlbumArtist
+	case "composer":
+		return &s.Composer
+	case "conductor":
+		return &s.Conductor
+	case "performer":
+		return &s.Performer
+	case "discSubtitle":
+		return &s.DiscSubtitle
+	default:
+		return nil
+	}
+}
+
+// initRewriteRules validates cfg.RewriteRules and prepends exact-match rules
+// corresponding to the deprecated cfg.ArtistRewrites map.
+func (cfg *Config) initRewriteRules() error {
+	if len(cfg.ArtistRewrites) > 0 {
+		from := make([]string, 0, len(cfg.ArtistRewrites))
+		for k := range cfg.ArtistRewrites {
+			from = append(from, k)
+		}
+		sort.Strings(from)
+		rules := make([]RewriteRule, 0, len(from)+len(cfg.RewriteRules))
+		for _, k := range from {
+			rules = append(rules, RewriteRule{Field: "artist", Match: k, Replace: cfg.ArtistRewrites[k]})
+		}
+		cfg.RewriteRules = append(rules, cfg.RewriteRules...)
+		cfg.ArtistRewrites = nil
+	}
+	for i := range cfg.RewriteRules {
+		if err := cfg.RewriteRules[i].check(); err != nil {
+			return fmt.Errorf("rewrite rule %d: %v", i, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package client
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/derat/nup/server/db"
+)
+
+func TestRewriteRule_Apply(t *testing.T) {
+	orig := db.Song{
+		Filename:      "classical/bach/01.mp3",
+		Artist:        "J.S. Bach",
+		ArtistCredits: []db.ArtistCredit{{Name: "J.S. Bach"}},
+		Title:         "Cello Suite No. 1 in G major, BWV 1007: I. Prélude",
+		Album:         "Cello Suites",
+		Composer:      "Bach",
+	}
+	for _, tc := range []struct {
+		desc   string
+		rule   RewriteRule
+		change string   // expected change description
+		want   *db.Song // expected song (orig if nil)
+	}{
+		{
+			"exact",
+			RewriteRule{Field: "artist", Match: "J.S. Bach", Replace: "Johann Sebastian Bach"},
+			`artist "J.S. Bach" -> "Johann Sebastian Bach"`,
+			&db.Song{Filename: orig.Filename, Artist: "Johann Sebastian Bach",
+				Title: orig.Title, Album: orig.Album, Composer: orig.Composer},
+		},
+		{
+			"exact mismatch",
+			RewriteRule{Field: "artist", MatchType: ExactMatch, Match: "Bach", Replace: "J.S. Bach"},
+			"", nil,
+		},
+		{
+			"regex",
+			RewriteRule{Field: "title", MatchType: RegexMatch, Match: `^.+, BWV \d+: (.+)$`, Replace: "$1"},
+			`title "Cello Suite No. 1 in G major, BWV 1007: I. Prélude" -> "I. Prélude"`,
+			&db.Song{Filename: orig.Filename, Artist: orig.Artist, ArtistCredits: orig.ArtistCredits,
+				Title: "I. Prélude", Album: orig.Album, Composer: orig.Composer},
+		},
+		{
+			"regex mismatch",
+			RewriteRule{Field: "title", MatchType: RegexMatch, Match: `BWV 1008`, Replace: ""},
+			"", nil,
+		},
+		{
+			"album",
+			RewriteRule{Field: "composer", Match: "Bach", Replace: "Johann Sebastian Bach", Album: "Cello Suites"},
+			`composer "Bach" -> "Johann Sebastian Bach"`,
+			&db.Song{Filename: orig.Filename, Artist: orig.Artist, ArtistCredits: orig.ArtistCredits,
+				Title: orig.Title, Album: orig.Album, Composer: "Johann Sebastian Bach"},
+		},
+		{
+			"album mismatch",
+			RewriteRule{Field: "composer", Match: "Bach", Replace: "Johann Sebastian Bach", Album: "Cello"},
+			"", nil,
+		},
+		{
+			"path",
+			RewriteRule{Field: "album", Match: "Cello Suites", Replace: "Suites", Path: "classical/bach/"},
+			`album "Cello Suites" -> "Suites"`,
+			&db.Song{Filename: orig.Filename, Artist: orig.Artist, ArtistCredits: orig.ArtistCredits,
+				Title: orig.Title, Album: "Suites", Composer: orig.Composer},
+		},
+		{
+			"path file",
+			RewriteRule{Field: "album", Match: "Cello Suites", Replace: "Suites", Path: "classical/bach/01.mp3"},
+			`album "Cello Suites" -> "Suites"`,
+			&db.Song{Filename: orig.Filename, Artist: orig.Artist, ArtistCredits: orig.ArtistCredits,
+				Title: orig.Title, Album: "Suites", Composer: orig.Composer},
+		},
+		{
+			"path mismatch",
+			RewriteRule{Field: "album", Match: "Cello Suites", Replace: "Suites", Path: "classical/ba"},
+			"", nil,
+		},
+	} {
+		s := orig
+		change, err := tc.rule.Apply(&s)
+		if err != nil {
+			t.Errorf("%s: Apply failed: %v", tc.desc, err)
+			continue
+		}
+		if change != tc.change {
+			t.Errorf("%s: Apply returned %q; want %q", tc.desc, change, tc.change)
+		}
+		want := tc.want
+		if want == nil {
+			want = &orig
+		}
+		if !reflect.DeepEqual(s, *want) {
+			t.Errorf("%s: Apply produced %+v; want %+v", tc.desc, s, *want)
+		}
+	}
+}
+
+func TestConfig_InitRewriteRules(t *testing.T) {
+	cfg := Config{
+		ArtistRewrites: map[string]string{"B": "b", "A": "a"},
+		RewriteRules:   []RewriteRule{{Field: "title", MatchType: RegexMatch, Match: "^x$", Replace: "y"}},
+	}
+	if err := cfg.initRewriteRules(); err != nil {
+		t.Fatal("initRewriteRules failed: ", err)
+	}
+	var got [][]string
+	for _, r := range cfg.RewriteRules {
+		got = append(got, []string{r.Field, string(r.MatchType), r.Match, r.Replace})
+	}
+	want := [][]string{
+		{"artist", "", "A", "a"},
+		{"artist", "", "B", "b"},
+		{"title", "regex", "^x$", "y"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("initRewriteRules produced %q; want %q", got, want)
+	}
+	if cfg.ArtistRewrites != nil {
+		t.Errorf("initRewriteRules didn't clear ArtistRewrites: %v", cfg.ArtistRewrites)
+	}
+
+	for _, r := range []RewriteRule{
+		{Field: "bogus", Match: "a", Replace: "b"},
+		{Field: "artist", MatchType: "bogus", Match: "a", Replace: "b"},
+		{Field: "artist", MatchType: RegexMatch, Match: "(", Replace: "b"},
+		{Field: "artist", Match: "a", Replace: "b", Path: "../foo"},
+		{Field: "artist", Match: "a", Replace: "b", Path: "/foo"},
+	} {
+		cfg := Config{RewriteRules: []RewriteRule{r}}
+		if err := cfg.initRewriteRules(); err == nil {
+			t.Errorf("initRewriteRules unexpectedly accepted %+v", r)
+		}
+	}
+}
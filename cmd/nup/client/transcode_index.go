@@ -0,0 +1,94 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package client
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+)
+
+// TranscodeIndex records lossless song files in the music dir that were transcoded to
+// lossy files and uploaded to the song bucket (see Config.TranscodeFormat).
+type TranscodeIndex struct {
+	// Files is keyed by lossless files' paths relative to the music dir.
+	Files map[string]TranscodeRecord `json:"files"`
+
+	sources map[string]string // keys are TranscodeRecord.Object, values are keys in Files
+}
+
+// TranscodeRecord describes a lossless file that was transcoded and uploaded.
+type TranscodeRecord struct {
+	// SHA1 contains the hex-encoded SHA1 of the lossless file's audio data.
+	SHA1 string `json:"sha1"`
+	// Format contains the lossy format (see Config.TranscodeFormat).
+	Format string `json:"format"`
+	// Bitrate contains the bitrate in kbit/sec used when transcoding.
+	Bitrate int `json:"bitrate"`
+	// Object contains the name of the transcoded file in the song bucket.
+	Object string `json:"object"`
+	// MD5 contains the hex-encoded MD5 of the transcoded file, as reported by
+	// Google Cloud Storage.
+	MD5 string `json:"md5"`
+}
+
+// ReadTranscodeIndex JSON-unmarshals a TranscodeIndex from the file at p.
+// If p doesn't exist, an empty index is returned.
+func ReadTranscodeIndex(p string) (*TranscodeIndex, error) {
+	var idx TranscodeIndex
+	if f, err := os.Open(p); os.IsNotExist(err) {
+		// Leave the index empty.
+	} else if err != nil {
+		return nil, err
+	} else {
+		defer f.Close()
+		if err := json.NewDecoder(f).Decode(&idx); err != nil {
+			return nil, err
+		}
+	}
+	if idx.Files == nil {
+		idx.Files = make(map[string]TranscodeRecord)
+	}
+	idx.sources = make(map[string]string, len(idx.Files))
+	for src, rec := range idx.Files {
+		idx.sources[rec.Object] = src
+	}
+	return &idx, nil
+}
+
+// Get returns the record for the lossless file at src (relative to the music dir).
+func (idx *TranscodeIndex) Get(src string) (TranscodeRecord, bool) {
+	rec, ok := idx.Files[src]
+	return rec, ok
+}
+
+// Set records that the lossless file at src (relative to the music dir) was transcoded
+// and uploaded as described by rec.
+func (idx *TranscodeIndex) Set(src string, rec TranscodeRecord) {
+	if old, ok := idx.Files[src]; ok {
+		delete(idx.sources, old.Object)
+	}
+	idx.Files[src] = rec
+	idx.sources[rec.Object] = src
+}
+
+// Source returns the path (relative to the music dir) of the lossless file that was
+// transcoded and uploaded as the named object.
+func (idx *TranscodeIndex) Source(object string) (string, bool) {
+	src, ok := idx.sources[object]
+	return src, ok
+}
+
+// Write atomically JSON-marshals idx to p.
+func (idx *TranscodeIndex) Write(p string) error {
+	b, err := json.MarshalIndent(idx, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := p + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, p)
+}
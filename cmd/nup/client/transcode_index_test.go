@@ -0,0 +1,56 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package client
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestTranscodeIndex(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "transcodes.json")
+	idx, err := ReadTranscodeIndex(p)
+	if err != nil {
+		t.Fatal("ReadTranscodeIndex with missing file failed: ", err)
+	}
+	if _, ok := idx.Get("a.flac"); ok {
+		t.Error("Get unexpectedly found a.flac in empty index")
+	}
+
+	recA := TranscodeRecord{SHA1: "aaaa", Format: "mp3", Bitrate: 256, Object: "a.mp3", MD5: "1111"}
+	recB := TranscodeRecord{SHA1: "bbbb", Format: "mp3", Bitrate: 256, Object: "b.mp3", MD5: "2222"}
+	idx.Set("a.flac", recA)
+	idx.Set("b.flac", recB)
+	// Replacing a record should also forget its old object.
+	recB2 := TranscodeRecord{SHA1: "bbbb", Format: "opus", Bitrate: 160, Object: "b.opus", MD5: "3333"}
+	idx.Set("b.flac", recB2)
+	if err := idx.Write(p); err != nil {
+		t.Fatal("Write failed: ", err)
+	}
+
+	if idx, err = ReadTranscodeIndex(p); err != nil {
+		t.Fatal("ReadTranscodeIndex failed: ", err)
+	}
+	for src, want := range map[string]TranscodeRecord{"a.flac": recA, "b.flac": recB2} {
+		if got, ok := idx.Get(src); !ok {
+			t.Errorf("Get(%q) didn't find record", src)
+		} else if !reflect.DeepEqual(got, want) {
+			t.Errorf("Get(%q) = %+v; want %+v", src, got, want)
+		}
+	}
+	for _, tc := range []struct {
+		object, src string
+		ok          bool
+	}{
+		{"a.mp3", "a.flac", true},
+		{"b.opus", "b.flac", true},
+		{"b.mp3", "", false},
+		{"c.mp3", "", false},
+	} {
+		if src, ok := idx.Source(tc.object); src != tc.src || ok != tc.ok {
+			t.Errorf("Source(%q) = %q, %v; want %q, %v", tc.object, src, ok, tc.src, tc.ok)
+		}
+	}
+}
@@ -4,12 +4,20 @@
 package config
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net/http"
+	"net/url"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"cloud.google.com/go/datastore"
 
@@ -27,27 +35,73 @@ type Command struct {
 	Cfg *client.Config
 
 	deleteInstances bool   // delete instances after set
+	dryRun          bool   // print changes without pushing
+	force           bool   // push destructive changes
 	setPath         string // path of config file to set
 	service         string // service name whose instances should be deleted
+	version         int64  // expected current version for push
 }
 
 func (*Command) Name() string     { return "config" }
 func (*Command) Synopsis() string { return "manage server configuration" }
 func (*Command) Usage() string {
-	return `config <flags>:
-	Manage the App Engine server's configuration in Datastore.
-	By default, prints the existing JSON-marshaled configuration.
+	return `config <flags> [pull | push <file>]:
+	Manage the App Engine server's configuration.
+
+	pull  Print the active JSON-marshaled configuration (fetched via the server)
+	push  Validate and save an updated configuration (sent via the server)
+
+	Before pushing, the active configuration is fetched and the changes are
+	printed. Destructive changes (e.g. removing users, libraries, or presets or
+	revoking admin access) are only saved if -force is supplied.
+
+	The server assigns a new version to each pushed configuration and makes
+	all instances reload it. The push is rejected if the active configuration's
+	version has changed since it was fetched (or differs from -version).
+
+	Without an action, the configuration is read from or written to Datastore
+	directly, which is needed before the server has a configuration.
 
 `
 }
 
 func (cmd *Command) SetFlags(f *flag.FlagSet) {
 	f.BoolVar(&cmd.deleteInstances, "delete-instances", false, "Delete running instances after setting config")
+	f.BoolVar(&cmd.dryRun, "dry-run", false, "Print changes without saving them for push")
+	f.BoolVar(&cmd.force, "force", false, "Save destructive changes (e.g. removed users) for push")
 	f.StringVar(&cmd.setPath, "set", "", "Path of updated JSON config file to save to Datastore")
 	f.StringVar(&cmd.service, "service", "default", "Service name for -delete-instances")
+	f.Int64Var(&cmd.version, "version", -1, "Expected version of active config for push")
 }
 
-func (cmd *Command) Execute(ctx context.Context, _ *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+func (cmd *Command) Execute(ctx context.Context, fs *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+	switch fs.Arg(0) {
+	case "":
+	case "pull":
+		if fs.NArg() != 1 {
+			fmt.Fprintln(os.Stderr, cmd.Usage())
+			return subcommands.ExitUsageError
+		}
+		if err := pullConfig(ctx, cmd.Cfg); err != nil {
+			fmt.Fprintln(os.Stderr, "Failed pulling config:", err)
+			return subcommands.ExitFailure
+		}
+		return subcommands.ExitSuccess
+	case "push":
+		if fs.NArg() != 2 {
+			fmt.Fprintln(os.Stderr, cmd.Usage())
+			return subcommands.ExitUsageError
+		}
+		if err := pushConfig(ctx, cmd.Cfg, fs.Arg(1), cmd.version, cmd.dryRun, cmd.force); err != nil {
+			fmt.Fprintln(os.Stderr, "Failed pushing config:", err)
+			return subcommands.ExitFailure
+		}
+		return subcommands.ExitSuccess
+	default:
+		fmt.Fprintln(os.Stderr, cmd.Usage())
+		return subcommands.ExitUsageError
+	}
+
 	projectID, err := cmd.Cfg.ProjectID()
 	if err != nil {
 		fmt.Fprintln(os.Stderr, "Failed getting project ID:", err)
@@ -98,27 +152,24 @@ func (cmd *Command) Execute(ctx context.Context, _ *flag.FlagSet, _ ...interface
 	}
 
 	// Check that the 'nup' command will still be able to access the server with the new config.
-	var foundUser bool
-	for _, u := range cfg.Users {
-		if u.Username == cmd.Cfg.Username {
-			if u.Password != cmd.Cfg.Password {
-				fmt.Fprintf(os.Stderr, "Password for user %q doesn't match client config\n", u.Username)
-				return subcommands.ExitFailure
-			} else if !u.Admin {
-				fmt.Fprintf(os.Stderr, "User %q is not an admin\n", u.Username)
-				return subcommands.ExitFailure
-			}
-			foundUser = true
-			break
-		}
-	}
-	if !foundUser {
-		fmt.Fprintf(os.Stderr, "Config doesn't contain admin user %q for 'nup' command\n", cmd.Cfg.Username)
+	if err := checkClientUser(cfg, cmd.Cfg); err != nil {
+		fmt.Fprintln(os.Stderr, "Bad config:", err)
 		return subcommands.ExitFailure
 	}
 
-	// Save the config to Datastore.
-	if _, err := cl.Put(ctx, key, &srvconfig.SavedConfig{JSON: string(data)}); err != nil {
+	// Save the config to Datastore, incrementing its version.
+	if _, err := cl.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		var saved srvconfig.SavedConfig
+		if err := tx.Get(key, &saved); err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		_, err := tx.Put(key, &srvconfig.SavedConfig{
+			JSON:        string(data),
+			Version:     saved.Version + 1,
+			UpdatedTime: time.Now(),
+		})
+		return err
+	}); err != nil {
 		fmt.Fprintln(os.Stderr, "Failed saving config:", err)
 		return subcommands.ExitFailure
 	}
@@ -133,6 +184,143 @@ func (cmd *Command) Execute(ctx context.Context, _ *flag.FlagSet, _ ...interface
 	return subcommands.ExitSuccess
 }
 
+// checkClientUser returns an error if the 'nup' command won't be able to access the server
+// as an admin using the credentials from ccfg after scfg is saved.
+func checkClientUser(scfg *srvconfig.Config, ccfg *client.Config) error {
+	for _, u := range scfg.Users {
+		if u.Username == ccfg.Username {
+			if u.Password != ccfg.Password {
+				return fmt.Errorf("password for user %q doesn't match client config", u.Username)
+			} else if !u.Admin {
+				return fmt.Errorf("user %q is not an admin", u.Username)
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("config doesn't contain admin user %q for 'nup' command", ccfg.Username)
+}
+
+// savedConfig is returned by the server's /server_config endpoint.
+type savedConfig struct {
+	Version     int64           `json:"version"`
+	UpdatedTime time.Time       `json:"updatedTime"`
+	Config      json.RawMessage `json:"config"`
+}
+
+// fetchConfig fetches the active config from the server.
+func fetchConfig(ctx context.Context, cfg *client.Config) (*savedConfig, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", cfg.GetURL("/server_config").String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	cfg.SetAuth(req)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("got status %q", resp.Status)
+	}
+	var saved savedConfig
+	if err := json.NewDecoder(resp.Body).Decode(&saved); err != nil {
+		return nil, err
+	}
+	return &saved, nil
+}
+
+// pullConfig fetches the active config from the server and prints it to stdout.
+// The config's version is printed to stderr.
+func pullConfig(ctx context.Context, cfg *client.Config) error {
+	saved, err := fetchConfig(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Version %d saved at %s\n",
+		saved.Version, saved.UpdatedTime.Local().Format(time.RFC3339))
+	var b bytes.Buffer
+	if err := json.Indent(&b, saved.Config, "", "  "); err != nil {
+		return err
+	}
+	b.WriteByte('\n')
+	_, err = os.Stdout.Write(b.Bytes())
+	return err
+}
+
+// pushConfig validates the config at p and sends it to the server. The changes from the active
+// config are printed first, and nothing is sent if dryRun is true or if destructive changes were
+// found and force is false. If version is non-negative, the server rejects the config if its
+// active config has a different version; otherwise, the active config's version is used.
+func pushConfig(ctx context.Context, cfg *client.Config, p string, version int64, dryRun, force bool) error {
+	data, err := ioutil.ReadFile(p)
+	if err != nil {
+		return err
+	}
+	scfg, err := srvconfig.Parse(data)
+	if err != nil {
+		return fmt.Errorf("bad config: %v", err)
+	}
+	if err := checkClientUser(scfg, cfg); err != nil {
+		return fmt.Errorf("bad config: %v", err)
+	}
+
+	saved, err := fetchConfig(ctx, cfg)
+	if err != nil {
+		return fmt.Errorf("failed fetching active config: %v", err)
+	}
+	if version < 0 {
+		version = saved.Version
+	}
+	var destructive bool
+	if active, err := srvconfig.Parse(saved.Config); err != nil {
+		// This can happen if the server's config format has changed since it was saved.
+		fmt.Fprintf(os.Stderr, "Unable to compare to active config version %d: %v\n", saved.Version, err)
+		destructive = true
+	} else if changes := diffConfigs(active, scfg); len(changes) == 0 {
+		fmt.Fprintf(os.Stderr, "No changes from active config version %d\n", saved.Version)
+	} else {
+		fmt.Fprintf(os.Stderr, "Changes from active config version %d:\n", saved.Version)
+		for _, c := range changes {
+			fmt.Fprintln(os.Stderr, "  "+c.String())
+			destructive = destructive || c.destructive
+		}
+	}
+	if dryRun {
+		return nil
+	}
+	if destructive && !force {
+		return errors.New("-force is required to save destructive changes")
+	}
+
+	u := cfg.GetURL("/server_config")
+	if version >= 0 {
+		u.RawQuery = url.Values{"version": {strconv.FormatInt(version, 10)}}.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", u.String(), bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	cfg.SetAuth(req)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		b, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("got status %q: %s", resp.Status, strings.TrimSpace(string(b)))
+	}
+	var res struct {
+		Version int64 `json:"version"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Saved version %d\n", res.Version)
+	return nil
+}
+
 // deleteInstances deletes all App Engine instances of service in projectID.
 func deleteInstances(ctx context.Context, projectID, service string, creds *google.Credentials) error {
 	asrv, err := appengine.NewService(ctx, option.WithCredentials(creds))
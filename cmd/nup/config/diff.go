@@ -0,0 +1,189 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	srvconfig "github.com/derat/nup/server/config"
+)
+
+// change describes a difference between two server configs.
+type change struct {
+	desc        string // human-readable description, e.g. `removed user "foo"`
+	destructive bool   // change may lock users out or discard data
+}
+
+func (c change) String() string {
+	if c.destructive {
+		return c.desc + " (destructive)"
+	}
+	return c.desc
+}
+
+// diffConfigs returns the changes needed to turn old into new.
+// Users, libraries, and presets are compared individually, while other
+// fields are just reported as having been changed.
+func diffConfigs(old, new *srvconfig.Config) []change {
+	var changes []change
+
+	oldUsers := make(map[string]srvconfig.User, len(old.Users))
+	var oldUserNames []string
+	for _, u := range old.Users {
+		oldUsers[userName(u)] = u
+		oldUserNames = append(oldUserNames, userName(u))
+	}
+	newUsers := make(map[string]srvconfig.User, len(new.Users))
+	var newUserNames []string
+	for _, u := range new.Users {
+		newUsers[userName(u)] = u
+		newUserNames = append(newUserNames, userName(u))
+	}
+	for _, name := range sortedUnion(oldUserNames, newUserNames) {
+		ou, inOld := oldUsers[name]
+		nu, inNew := newUsers[name]
+		switch {
+		case !inNew:
+			changes = append(changes, change{fmt.Sprintf("removed user %q", name), true})
+		case !inOld:
+			changes = append(changes, change{fmt.Sprintf("added user %q", name), false})
+		default:
+			if ou.Admin && !nu.Admin {
+				changes = append(changes, change{fmt.Sprintf("revoked admin for user %q", name), true})
+			} else if !ou.Admin && nu.Admin {
+				changes = append(changes, change{fmt.Sprintf("granted admin for user %q", name), false})
+			}
+			if fields := changedFields(ou, nu, "admin"); len(fields) > 0 {
+				desc := fmt.Sprintf("changed user %q: %s", name, strings.Join(fields, ", "))
+				changes = append(changes, change{desc, false})
+			}
+		}
+	}
+
+	oldLibs := make(map[string]srvconfig.Library, len(old.Libraries))
+	var oldLibNames []string
+	for _, l := range old.Libraries {
+		oldLibs[l.Name] = l
+		oldLibNames = append(oldLibNames, l.Name)
+	}
+	newLibs := make(map[string]srvconfig.Library, len(new.Libraries))
+	var newLibNames []string
+	for _, l := range new.Libraries {
+		newLibs[l.Name] = l
+		newLibNames = append(newLibNames, l.Name)
+	}
+	for _, name := range sortedUnion(oldLibNames, newLibNames) {
+		ol, inOld := oldLibs[name]
+		nl, inNew := newLibs[name]
+		switch {
+		case !inNew:
+			changes = append(changes, change{fmt.Sprintf("removed library %q", name), true})
+		case !inOld:
+			changes = append(changes, change{fmt.Sprintf("added library %q", name), false})
+		default:
+			if fields := changedFields(ol, nl); len(fields) > 0 {
+				desc := fmt.Sprintf("changed library %q: %s", name, strings.Join(fields, ", "))
+				changes = append(changes, change{desc, false})
+			}
+		}
+	}
+
+	oldPresets := make(map[string]srvconfig.SearchPreset, len(old.Presets))
+	var oldPresetNames []string
+	for _, p := range old.Presets {
+		oldPresets[p.Name] = p
+		oldPresetNames = append(oldPresetNames, p.Name)
+	}
+	newPresets := make(map[string]srvconfig.SearchPreset, len(new.Presets))
+	var newPresetNames []string
+	for _, p := range new.Presets {
+		newPresets[p.Name] = p
+		newPresetNames = append(newPresetNames, p.Name)
+	}
+	for _, name := range sortedUnion(oldPresetNames, newPresetNames) {
+		op, inOld := oldPresets[name]
+		np, inNew := newPresets[name]
+		switch {
+		case !inNew:
+			changes = append(changes, change{fmt.Sprintf("removed preset %q", name), true})
+		case !inOld:
+			changes = append(changes, change{fmt.Sprintf("added preset %q", name), false})
+		default:
+			if fields := changedFields(op, np); len(fields) > 0 {
+				desc := fmt.Sprintf("changed preset %q: %s", name, strings.Join(fields, ", "))
+				changes = append(changes, change{desc, false})
+			}
+		}
+	}
+
+	for _, f := range changedFields(old, new, "users", "libraries", "presets") {
+		changes = append(changes, change{fmt.Sprintf("changed %v", f), false})
+	}
+	return changes
+}
+
+// userName returns a name identifying u in diffs.
+func userName(u srvconfig.User) string {
+	if u.Username != "" {
+		return u.Username
+	}
+	return u.Email
+}
+
+// sortedUnion returns the sorted union of the strings in lists.
+func sortedUnion(lists ...[]string) []string {
+	seen := make(map[string]struct{})
+	var union []string
+	for _, l := range lists {
+		for _, s := range l {
+			if _, ok := seen[s]; !ok {
+				seen[s] = struct{}{}
+				union = append(union, s)
+			}
+		}
+	}
+	sort.Strings(union)
+	return union
+}
+
+// changedFields returns the sorted JSON names of top-level fields that differ between
+// a and b, which must be JSON-marshalable structs of the same type. Fields named in skip
+// are ignored.
+func changedFields(a, b interface{}, skip ...string) []string {
+	am, bm := jsonFields(a), jsonFields(b)
+	for _, s := range skip {
+		delete(am, s)
+		delete(bm, s)
+	}
+	var fields []string
+	for k, av := range am {
+		if bv, ok := bm[k]; !ok || !bytes.Equal(av, bv) {
+			fields = append(fields, k)
+		}
+	}
+	for k := range bm {
+		if _, ok := am[k]; !ok {
+			fields = append(fields, k)
+		}
+	}
+	sort.Strings(fields)
+	return fields
+}
+
+// jsonFields marshals v to a JSON object and returns its fields.
+func jsonFields(v interface{}) map[string]json.RawMessage {
+	b, err := json.Marshal(v)
+	if err != nil {
+		panic(fmt.Sprintf("failed marshaling %T: %v", v, err))
+	}
+	var m map[string]json.RawMessage
+	if err := json.Unmarshal(b, &m); err != nil {
+		panic(fmt.Sprintf("failed unmarshaling %T: %v", v, err))
+	}
+	return m
+}
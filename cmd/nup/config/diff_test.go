@@ -0,0 +1,69 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package config
+
+import (
+	"reflect"
+	"testing"
+
+	srvconfig "github.com/derat/nup/server/config"
+)
+
+func TestDiffConfigs(t *testing.T) {
+	old := &srvconfig.Config{
+		Users: []srvconfig.User{
+			{Username: "admin", Password: "pw", Admin: true},
+			{Username: "demoted", Password: "pw", Admin: true},
+			{Username: "removed", Password: "pw"},
+			{Email: "user@example.org", Library: "main"},
+		},
+		Libraries: []srvconfig.Library{
+			{Name: "lib1", SongBucket: "songs1"},
+			{Name: "lib2", SongBucket: "songs2"},
+		},
+		Presets: []srvconfig.SearchPreset{
+			{Name: "old", Tags: "rock"},
+			{Name: "same", MinRating: 4},
+		},
+		SongBucket: "songs",
+	}
+	new := &srvconfig.Config{
+		Users: []srvconfig.User{
+			{Username: "admin", Password: "pw", Admin: true},
+			{Username: "added", Password: "pw"},
+			{Username: "demoted", Password: "newpw"},
+			{Email: "user@example.org", Library: "lib1"},
+		},
+		Libraries: []srvconfig.Library{
+			{Name: "lib1", SongBucket: "songs1", Users: []string{"added"}},
+		},
+		Presets: []srvconfig.SearchPreset{
+			{Name: "same", MinRating: 4},
+			{Name: "new", Tags: "jazz"},
+		},
+		SongBucket:  "songs",
+		CoverBucket: "covers",
+	}
+
+	if got := diffConfigs(old, old); len(got) != 0 {
+		t.Errorf("diffConfigs(old, old) = %v; want none", got)
+	}
+
+	got := diffConfigs(old, new)
+	want := []change{
+		{`added user "added"`, false},
+		{`revoked admin for user "demoted"`, true},
+		{`changed user "demoted": password`, false},
+		{`removed user "removed"`, true},
+		{`changed user "user@example.org": library`, false},
+		{`changed library "lib1": users`, false},
+		{`removed library "lib2"`, true},
+		{`added preset "new"`, false},
+		{`removed preset "old"`, true},
+		{`changed coverBucket`, false},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("diffConfigs(old, new) = %q; want %q", got, want)
+	}
+}
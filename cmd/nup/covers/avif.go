@@ -0,0 +1,68 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package covers
+
+import (
+	"image"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"os/exec"
+
+	"golang.org/x/image/draw"
+)
+
+// cropSquare returns the centered square region of r.
+// This matches the cropping performed by the Scale function in server/cover/cover.go.
+func cropSquare(r image.Rectangle) image.Rectangle {
+	if r.Dx() > r.Dy() {
+		r.Min.X += (r.Dx() - r.Dy()) / 2
+		r.Max.X = r.Min.X + r.Dy()
+	} else if r.Dy() > r.Dx() {
+		r.Min.Y += (r.Dy() - r.Dx()) / 2
+		r.Max.Y = r.Min.Y + r.Dx()
+	}
+	return r
+}
+
+// scaleSquare crops src to a square and scales it to size x size.
+func scaleSquare(src image.Image, size int) *image.RGBA {
+	dst := image.NewRGBA(image.Rect(0, 0, size, size))
+	draw.CatmullRom.Scale(dst, dst.Rect, src, cropSquare(src.Bounds()), draw.Src, nil)
+	return dst
+}
+
+// writeAVIF writes the JPEG image at srcPath to destPath in AVIF format and with the
+// supplied (square) size. Unlike cwebp, avifenc can't crop or scale images, so the image
+// is cropped and scaled here and passed to avifenc as a temporary PNG file.
+func writeAVIF(srcPath, destPath string, destSize int) error {
+	sf, err := os.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	src, _, err := image.Decode(sf)
+	sf.Close()
+	if err != nil {
+		return err
+	}
+
+	tf, err := ioutil.TempFile("", "nup-cover-*.png")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tf.Name())
+	if err := png.Encode(tf, scaleSquare(src, destSize)); err != nil {
+		tf.Close()
+		return err
+	}
+	if err := tf.Close(); err != nil {
+		return err
+	}
+
+	if err := exec.Command("avifenc", "--speed", "6", tf.Name(), destPath).Run(); err != nil {
+		os.Remove(destPath)
+		return err
+	}
+	return nil
+}
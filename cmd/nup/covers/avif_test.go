@@ -0,0 +1,24 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package covers
+
+import (
+	"image"
+	"testing"
+)
+
+func TestCropSquare(t *testing.T) {
+	for _, tc := range []struct {
+		in, want image.Rectangle
+	}{
+		{image.Rect(0, 0, 100, 100), image.Rect(0, 0, 100, 100)},
+		{image.Rect(0, 0, 300, 200), image.Rect(50, 0, 250, 200)},
+		{image.Rect(0, 0, 200, 301), image.Rect(0, 50, 200, 250)},
+		{image.Rect(10, 20, 40, 30), image.Rect(20, 20, 30, 30)},
+	} {
+		if got := cropSquare(tc.in); got != tc.want {
+			t.Errorf("cropSquare(%v) = %v; want %v", tc.in, got, tc.want)
+		}
+	}
+}
@@ -4,13 +4,16 @@
 package covers
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"image"
-	_ "image/jpeg"
+	"image/jpeg"
+	_ "image/png"
 	"io"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
@@ -19,6 +22,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/derat/nup/cmd/nup/client"
 	"github.com/derat/nup/cmd/nup/client/files"
@@ -27,61 +31,122 @@ import (
 	"github.com/google/subcommands"
 )
 
-const logInterval = 100
+const (
+	logInterval         = 100
+	defaultNotFoundFile = "cover_not_found.json" // in ~/.nup
+	defaultNotFoundTTL  = 30 * 24 * time.Hour
+)
 
 type Command struct {
 	Cfg *client.Config
 
+	bucketName   string // GCS bucket containing covers for gc
 	coverDir     string // directory containing cover images
 	download     bool   // download image covers to coverDir
+	dryRun       bool   // print gc actions instead of performing them
+	generateAVIF bool   // generate AVIF versions of covers in coverDir
 	generateWebP bool   // generate WebP versions of covers in coverDir
+	maxSize      int    // max cover dimension for gc
 	maxSongs     int    // songs to inspect
 	maxRequests  int    // parallel HTTP requests
-	size         int    // image size to download (250, 500, 1200)
+	minSize      int    // min cover dimension for gc
+	notFoundFile string // JSON file recording albums without covers
+	notFoundTTL  time.Duration
+	size         int // image size to download (250, 500, 1200, or 0 for original)
+	out          client.OutputFlags
+	rep          *client.Reporter
 }
 
 func (*Command) Name() string     { return "covers" }
 func (*Command) Synopsis() string { return "manage album art" }
 func (*Command) Usage() string {
-	return `covers <flags>:
+	return `covers <flags> [gc]:
 	Manipulate album art images in a directory.
 	With -download, downloads album art from coverartarchive.org.
 	With -generate-webp, generates WebP versions of existing JPEG images.
+	With -generate-avif, generates AVIF versions of existing JPEG images.
+
+	With "gc", instead reads dumped songs from stdin and maintains the
+	cover bucket: covers not referenced by any songs are deleted, covers
+	larger than -max-size are re-encoded, and covers smaller than
+	-min-size are reported. The local cover dir is not modified.
 
 `
 }
 
 func (cmd *Command) SetFlags(f *flag.FlagSet) {
+	f.StringVar(&cmd.bucketName, "bucket", "",
+		"Google Cloud Storage bucket containing covers for gc (overrides config's coverBucket)")
 	f.StringVar(&cmd.coverDir, "cover-dir", "", "Directory containing cover images")
 	f.BoolVar(&cmd.download, "download", false,
 		"Download covers for dumped songs read from stdin or positional song files to -cover-dir")
-	f.IntVar(&cmd.size, "download-size", 1200, "Image size to download (250, 500, or 1200)")
+	f.IntVar(&cmd.size, "download-size", 1200,
+		"Image size to download (250, 500, 1200, or 0 for original image scaled to -max-size)")
+	f.BoolVar(&cmd.dryRun, "dry-run", false, "Only print what gc would change")
+	f.BoolVar(&cmd.generateAVIF, "generate-avif", false, "Generate AVIF versions of covers in -cover-dir")
 	f.BoolVar(&cmd.generateWebP, "generate-webp", false, "Generate WebP versions of covers in -cover-dir")
 	f.IntVar(&cmd.maxSongs, "max-downloads", -1, "Maximum number of songs to inspect for -download")
-	f.IntVar(&cmd.maxRequests, "max-requests", 2, "Maximum number of parallel HTTP requests for -download")
+	f.IntVar(&cmd.maxRequests, "max-requests", 2, "Maximum number of parallel HTTP requests for -download and gc")
+	f.IntVar(&cmd.maxSize, "max-size", 1200,
+		"Maximum cover width or height for gc and -download-size=0 (0 to not scale)")
+	f.IntVar(&cmd.minSize, "min-size", 400, "Minimum cover width and height for gc")
+	f.StringVar(&cmd.notFoundFile, "not-found-file", "",
+		"JSON file recording albums without covers for -download (default ~/.nup/"+defaultNotFoundFile+")")
+	f.DurationVar(&cmd.notFoundTTL, "not-found-ttl", defaultNotFoundTTL,
+		"Time before retrying albums that didn't have covers for -download")
+	cmd.out.SetFlags(f)
 }
 
 func (cmd *Command) Execute(ctx context.Context, fs *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
-	if cmd.coverDir == "" {
+	if cmd.maxRequests <= 0 {
+		fmt.Fprintln(os.Stderr, "-max-requests must be positive")
+		return subcommands.ExitUsageError
+	}
+	doGC := fs.Arg(0) == "gc" && !cmd.download
+	if doGC {
+		if cmd.bucketName == "" {
+			cmd.bucketName = cmd.Cfg.CoverBucket
+		}
+		if cmd.bucketName == "" {
+			fmt.Fprintln(os.Stderr, "Must supply bucket name with -bucket or coverBucket in config")
+			return subcommands.ExitUsageError
+		}
+	} else if cmd.coverDir == "" {
 		fmt.Fprintln(os.Stderr, "-cover-dir must be supplied")
 		return subcommands.ExitUsageError
 	}
 
+	var err error
+	if cmd.rep, err = cmd.out.NewReporter(os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, "Bad output flags:", err)
+		return subcommands.ExitUsageError
+	}
+	cmd.rep.LogText = true
+
 	switch {
+	case doGC:
+		if err := cmd.doGC(ctx); err != nil {
+			fmt.Fprintln(os.Stderr, "Failed cleaning up covers:", err)
+			return subcommands.ExitFailure
+		}
+		cmd.rep.Summary()
+		return subcommands.ExitSuccess
 	case cmd.download:
 		if err := cmd.doDownload(fs.Args()); err != nil {
 			fmt.Fprintln(os.Stderr, "Failed downloading covers:", err)
 			return subcommands.ExitFailure
 		}
+		cmd.rep.Summary()
 		return subcommands.ExitSuccess
-	case cmd.generateWebP:
-		if err := cmd.doGenerateWebP(); err != nil {
-			fmt.Fprintln(os.Stderr, "Failed generating WebP images:", err)
+	case cmd.generateWebP || cmd.generateAVIF:
+		if err := cmd.doGeneratePrescaled(); err != nil {
+			fmt.Fprintln(os.Stderr, "Failed generating images:", err)
 			return subcommands.ExitFailure
 		}
+		cmd.rep.Summary()
 		return subcommands.ExitSuccess
 	default:
-		fmt.Fprintln(os.Stderr, "Must supply one of -download and -generate-webp")
+		fmt.Fprintln(os.Stderr, "Must supply one of -download, -generate-avif, -generate-webp, and gc")
 		return subcommands.ExitUsageError
 	}
 }
@@ -96,7 +161,7 @@ func (cmd *Command) doDownload(paths []string) error {
 			if s, err := files.ReadSong(&cfg, p, nil, files.SkipAudioData, nil); err != nil {
 				return err
 			} else if s.AlbumID != "" {
-				log.Printf("%v has album ID %v", p, s.AlbumID)
+				cmd.rep.Textf("%v has album ID %v", p, s.AlbumID)
 				ids[s.AlbumID] = struct{}{}
 			}
 		}
@@ -104,19 +169,46 @@ func (cmd *Command) doDownload(paths []string) error {
 			albumIDs = append(albumIDs, id)
 		}
 	} else {
-		log.Print("Reading songs from stdin")
+		cmd.rep.Textf("Reading songs from stdin")
 		var err error
 		if albumIDs, err = readDumpedSongs(os.Stdin, cmd.coverDir, cmd.maxSongs); err != nil {
 			return err
 		}
 	}
 
-	log.Printf("Downloading cover(s) for %v album(s)", len(albumIDs))
-	downloadCovers(albumIDs, cmd.coverDir, cmd.size, cmd.maxRequests)
+	if cmd.notFoundFile == "" {
+		cmd.notFoundFile = filepath.Join(os.Getenv("HOME"), ".nup", defaultNotFoundFile)
+	}
+	nf, err := loadNotFoundCache(cmd.notFoundFile, cmd.notFoundTTL)
+	if err != nil {
+		return fmt.Errorf("failed loading %v: %v", cmd.notFoundFile, err)
+	}
+	now := time.Now()
+	var skipped int
+	filtered := albumIDs[:0]
+	for _, id := range albumIDs {
+		if nf.has(id, now) {
+			skipped++
+		} else {
+			filtered = append(filtered, id)
+		}
+	}
+	albumIDs = filtered
+	if skipped > 0 {
+		cmd.rep.Textf("Skipping %v album(s) without covers in the last %v", skipped, cmd.notFoundTTL)
+		cmd.rep.Count("skippedNotFound", skipped)
+	}
+
+	cmd.rep.Textf("Downloading cover(s) for %v album(s)", len(albumIDs))
+	downloadCovers(albumIDs, cmd.coverDir, cmd.size, cmd.maxSize, cmd.maxRequests, nf, cmd.rep)
+	if err := nf.save(time.Now()); err != nil {
+		return fmt.Errorf("failed saving %v: %v", cmd.notFoundFile, err)
+	}
 	return nil
 }
 
-func (cmd *Command) doGenerateWebP() error {
+// doGeneratePrescaled generates WebP and/or AVIF versions of the JPEG images in cmd.coverDir.
+func (cmd *Command) doGeneratePrescaled() error {
 	return filepath.Walk(cmd.coverDir, func(p string, fi os.FileInfo, err error) error {
 		if err != nil {
 			return err
@@ -125,21 +217,31 @@ func (cmd *Command) doGenerateWebP() error {
 			return nil
 		}
 
+		// Returns true if gp exists and is up-to-date.
+		upToDate := func(gp string) bool {
+			gfi, err := os.Stat(gp)
+			return err == nil && !fi.ModTime().After(gfi.ModTime())
+		}
+
 		var width, height int
 		for _, size := range cover.WebPSizes {
-			// Skip this size if we already have it and it's up-to-date.
-			gp := cover.WebPFilename(p, size)
-			if gfi, err := os.Stat(gp); err == nil && !fi.ModTime().After(gfi.ModTime()) {
-				continue
-			}
-			// Read the source image's dimensions if we haven't already.
-			if width == 0 && height == 0 {
-				if width, height, err = getDimensions(p); err != nil {
-					return fmt.Errorf("failed getting %q dimensions: %v", p, err)
+			if gp := cover.WebPFilename(p, size); cmd.generateWebP && !upToDate(gp) {
+				// Read the source image's dimensions if we haven't already.
+				if width == 0 && height == 0 {
+					if width, height, err = getDimensions(p); err != nil {
+						return fmt.Errorf("failed getting %q dimensions: %v", p, err)
+					}
 				}
+				if err := writeWebP(p, gp, width, height, size); err != nil {
+					return fmt.Errorf("failed converting %q to %q: %v", p, gp, err)
+				}
+				cmd.rep.Item(gp, "generated", "Wrote "+gp)
 			}
-			if err := writeWebP(p, gp, width, height, size); err != nil {
-				return fmt.Errorf("failed converting %q to %q: %v", p, gp, err)
+			if gp := cover.AVIFFilename(p, size); cmd.generateAVIF && !upToDate(gp) {
+				if err := writeAVIF(p, gp, size); err != nil {
+					return fmt.Errorf("failed converting %q to %q: %v", p, gp, err)
+				}
+				cmd.rep.Item(gp, "generated", "Wrote "+gp)
 			}
 		}
 		return nil
@@ -238,56 +340,132 @@ func readDumpedSongs(r io.Reader, coverDir string, maxSongs int) (albumIDs []str
 	return ret, nil
 }
 
+// caaBaseURL is the base URL of the Cover Art Archive. It is overridden by tests.
+var caaBaseURL = "https://coverartarchive.org"
+
+const (
+	maxDownloadTries  = 5               // attempts for each cover when throttled
+	initialRetryDelay = 2 * time.Second // delay after first 429 or 503 response
+	maxRetryDelay     = 2 * time.Minute // max delay between attempts
+)
+
+// retryDelayScale is multiplied by retry delays. It is overridden by tests.
+var retryDelayScale = 1.0
+
+// fetchCover fetches u, retrying with exponential backoff if the server
+// reports that it's overloaded. Nil data is returned if u wasn't found.
+func fetchCover(u string) ([]byte, error) {
+	delay := initialRetryDelay
+	for tries := 1; ; tries++ {
+		resp, err := http.Get(u)
+		if err != nil {
+			return nil, fmt.Errorf("fetching %v failed: %v", u, err)
+		}
+		switch resp.StatusCode {
+		case http.StatusOK:
+			defer resp.Body.Close()
+			data, err := ioutil.ReadAll(resp.Body)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read from %v: %v", u, err)
+			}
+			return data, nil
+		case http.StatusNotFound:
+			resp.Body.Close()
+			return nil, nil
+		case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+			resp.Body.Close()
+			if tries >= maxDownloadTries {
+				return nil, fmt.Errorf("got %v when fetching %v after %d tries", resp.StatusCode, u, tries)
+			}
+			// Honor the server's requested delay if it's longer than ours.
+			wait := delay
+			if sec, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+				if d := time.Duration(sec) * time.Second; d > wait {
+					wait = d
+				}
+			}
+			time.Sleep(time.Duration(float64(wait) * retryDelayScale))
+			if delay *= 2; delay > maxRetryDelay {
+				delay = maxRetryDelay
+			}
+		default:
+			resp.Body.Close()
+			return nil, fmt.Errorf("got %v when fetching %v", resp.StatusCode, u)
+		}
+	}
+}
+
 // downloadCover downloads cover art for albumID into dir.
-// If the cover was not found, path is empty and err is nil.
-func downloadCover(albumID, dir string, size int) (path string, err error) {
-	url := fmt.Sprintf("https://coverartarchive.org/release/%s/front-%d", albumID, size)
-	resp, err := http.Get(url)
-	if err != nil {
-		return "", fmt.Errorf("Fetching %v failed: %v", url, err)
+// If size is 0, the original image is downloaded and scaled to fit within maxSize
+// (if positive). If the cover was not found, path is empty and err is nil.
+func downloadCover(albumID, dir string, size, maxSize int) (path string, err error) {
+	u := fmt.Sprintf("%s/release/%s/front", caaBaseURL, albumID)
+	if size > 0 {
+		u += fmt.Sprintf("-%d", size)
+	}
+	data, err := fetchCover(u)
+	if err != nil || data == nil {
+		return "", err
 	}
-	if resp.StatusCode != 200 {
-		resp.Body.Close()
-		if resp.StatusCode == 404 {
-			return "", nil
+
+	// Original images can be huge and aren't necessarily JPEGs.
+	if size <= 0 {
+		img, _, err := image.Decode(bytes.NewReader(data))
+		if err != nil {
+			return "", fmt.Errorf("failed decoding %v: %v", u, err)
+		}
+		b := img.Bounds()
+		w, h := b.Dx(), b.Dy()
+		if maxSize > 0 {
+			w, h = fitSize(w, h, maxSize)
+		}
+		if w != b.Dx() || h != b.Dy() {
+			if data, err = resizeImage(img, w, h); err != nil {
+				return "", err
+			}
+		} else if http.DetectContentType(data) != "image/jpeg" {
+			var buf bytes.Buffer
+			if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: resizedQuality}); err != nil {
+				return "", err
+			}
+			data = buf.Bytes()
 		}
-		return "", fmt.Errorf("Got %v when fetching %v", resp.StatusCode, url)
 	}
-	defer resp.Body.Close()
 
 	path = filepath.Join(dir, albumID+cover.OrigExt)
-	f, err := os.Create(path)
-	if err != nil {
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
 		return "", err
 	}
-	defer f.Close()
-
-	if _, err = io.Copy(f, resp.Body); err != nil {
-		return "", fmt.Errorf("Failed to read from %v: %v", url, err)
-	}
 	return path, nil
 }
 
-func downloadCovers(albumIDs []string, dir string, size, maxRequests int) {
+// downloadCovers downloads covers for albumIDs into dir using up to maxRequests
+// parallel requests. Albums without covers are recorded in nf.
+func downloadCovers(albumIDs []string, dir string, size, maxSize, maxRequests int,
+	nf *notFoundCache, rep *client.Reporter) {
 	cache := client.NewTaskCache(maxRequests)
 	wg := sync.WaitGroup{}
 	wg.Add(len(albumIDs))
+	rep.AddTotal(len(albumIDs))
 
 	for _, id := range albumIDs {
 		go func(id string) {
 			if path, err := cache.Get(id, id, func() (map[string]interface{}, error) {
-				if p, err := downloadCover(id, dir, size); err != nil {
+				if p, err := downloadCover(id, dir, size, maxSize); err != nil {
 					return nil, err
 				} else {
 					return map[string]interface{}{id: p}, nil
 				}
 			}); err != nil {
-				log.Printf("Failed to get %v: %v", id, err)
+				rep.Item(id, "failed", fmt.Sprintf("Failed to get %v: %v", id, err))
 			} else if len(path.(string)) == 0 {
-				log.Printf("Didn't find %v", id)
+				rep.Item(id, "notFound", fmt.Sprintf("Didn't find %v", id))
+				nf.add(id, time.Now())
 			} else {
-				log.Printf("Wrote %v", path.(string))
+				rep.Item(id, "downloaded", fmt.Sprintf("Wrote %v", path.(string)))
+				nf.remove(id)
 			}
+			rep.Advance(1)
 			wg.Done()
 		}(id)
 	}
@@ -0,0 +1,68 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package covers
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDownloadCover(t *testing.T) {
+	var img bytes.Buffer
+	if err := png.Encode(&img, image.NewRGBA(image.Rect(0, 0, 300, 200))); err != nil {
+		t.Fatal(err)
+	}
+	var throttled int // number of 503s to return before succeeding
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/release/orig/front":
+			if throttled > 0 {
+				throttled--
+				w.Header().Set("Retry-After", "1")
+				http.Error(w, "slow down", http.StatusServiceUnavailable)
+				return
+			}
+			w.Write(img.Bytes())
+		case "/release/busy/front-1200":
+			http.Error(w, "slow down", http.StatusTooManyRequests)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	origURL, origScale := caaBaseURL, retryDelayScale
+	caaBaseURL, retryDelayScale = srv.URL, 0.001
+	defer func() { caaBaseURL, retryDelayScale = origURL, origScale }()
+
+	dir := t.TempDir()
+	throttled = 2
+	if p, err := downloadCover("orig", dir, 0, 150); err != nil {
+		t.Error("downloadCover failed for original image:", err)
+	} else if p != filepath.Join(dir, "orig.jpg") {
+		t.Errorf("downloadCover returned %q; want %q", p, filepath.Join(dir, "orig.jpg"))
+	} else if f, err := os.Open(p); err != nil {
+		t.Error(err)
+	} else {
+		defer f.Close()
+		if cfg, format, err := image.DecodeConfig(f); err != nil {
+			t.Error("Failed decoding downloaded image:", err)
+		} else if format != "jpeg" || cfg.Width != 150 || cfg.Height != 100 {
+			t.Errorf("Downloaded image is %dx%d %v; want 150x100 jpeg", cfg.Width, cfg.Height, format)
+		}
+	}
+
+	if p, err := downloadCover("missing", dir, 1200, 0); err != nil || p != "" {
+		t.Errorf("downloadCover for missing cover returned %q, %v; want empty path", p, err)
+	}
+	if _, err := downloadCover("busy", dir, 1200, 0); err == nil {
+		t.Error("downloadCover unexpectedly succeeded for throttled cover")
+	}
+}
@@ -0,0 +1,262 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package covers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"cloud.google.com/go/storage"
+
+	"github.com/derat/nup/server/cover"
+	"github.com/derat/nup/server/db"
+
+	"golang.org/x/image/draw"
+	"golang.org/x/oauth2/google"
+
+	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
+)
+
+// resizedQuality is the JPEG quality used when re-encoding oversized covers.
+const resizedQuality = 90
+
+// planGC classifies objects in the cover bucket using referenced, a set of
+// Song.CoverFilename values. unused contains covers (including generated WebP and AVIF images)
+// that aren't referenced by any songs, while orig contains referenced original covers.
+// Objects that don't look like cover images are ignored.
+func planGC(objects []string, referenced map[string]struct{}) (unused, orig []string) {
+	for _, name := range objects {
+		if !strings.HasSuffix(name, cover.OrigExt) && !strings.HasSuffix(name, ".webp") &&
+			!strings.HasSuffix(name, ".avif") {
+			continue
+		}
+		on := cover.OrigFilename(name)
+		if _, ok := referenced[on]; !ok {
+			unused = append(unused, name)
+		} else if on == name {
+			orig = append(orig, name)
+		}
+	}
+	sort.Strings(unused)
+	sort.Strings(orig)
+	return unused, orig
+}
+
+// fitSize returns the dimensions of a width-by-height image scaled to fit
+// within a max-by-max square while preserving its aspect ratio.
+// The original dimensions are returned if the image already fits.
+func fitSize(width, height, max int) (int, int) {
+	if width <= max && height <= max {
+		return width, height
+	}
+	if width >= height {
+		return max, (height*max + width/2) / width
+	}
+	return (width*max + height/2) / height, max
+}
+
+// resizeImage scales img to the supplied dimensions and returns JPEG data.
+func resizeImage(img image.Image, width, height int) ([]byte, error) {
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(dst, dst.Rect, img, img.Bounds(), draw.Src, nil)
+	var b bytes.Buffer
+	if err := jpeg.Encode(&b, dst, &jpeg.Options{Quality: resizedQuality}); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// readCoverFilenames reads dumped songs from r and returns the set of their cover filenames.
+func readCoverFilenames(r io.Reader) (map[string]struct{}, error) {
+	fns := make(map[string]struct{})
+	d := json.NewDecoder(r)
+	var numSongs int
+	for {
+		var s db.Song
+		if err := d.Decode(&s); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		numSongs++
+		if s.CoverFilename != "" {
+			fns[s.CoverFilename] = struct{}{}
+		}
+	}
+	// Refuse to continue if we didn't get any songs, since we'd delete every cover.
+	if numSongs == 0 {
+		return nil, errors.New("no songs read")
+	}
+	return fns, nil
+}
+
+// doGC deletes covers in cmd.bucketName that aren't referenced by dumped songs read from stdin,
+// re-encodes covers larger than cmd.maxSize, and reports covers smaller than cmd.minSize.
+func (cmd *Command) doGC(ctx context.Context) error {
+	cmd.rep.Textf("Reading songs from stdin")
+	referenced, err := readCoverFilenames(os.Stdin)
+	if err != nil {
+		return fmt.Errorf("failed reading songs: %v", err)
+	}
+
+	creds, err := google.FindDefaultCredentials(ctx,
+		"https://www.googleapis.com/auth/devstorage.read_write",
+	)
+	if err != nil {
+		return fmt.Errorf("failed finding credentials: %v", err)
+	}
+	client, err := storage.NewClient(ctx, option.WithCredentials(creds))
+	if err != nil {
+		return fmt.Errorf("failed creating client: %v", err)
+	}
+	defer client.Close()
+	bucket := client.Bucket(cmd.bucketName)
+
+	objects := make(map[string]*storage.ObjectAttrs)
+	var names []string
+	it := bucket.Objects(ctx, &storage.Query{Prefix: ""})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		} else if err != nil {
+			return fmt.Errorf("failed listing objects in %v: %v", cmd.bucketName, err)
+		}
+		objects[attrs.Name] = attrs
+		names = append(names, attrs.Name)
+	}
+	unused, orig := planGC(names, referenced)
+	cmd.rep.Textf("Found %d unused and %d referenced cover(s) in %v", len(unused), len(orig), cmd.bucketName)
+
+	type gcJob struct {
+		name   string
+		delete bool // delete the object instead of inspecting it
+	}
+	jobs := make(chan gcJob, len(unused)+len(orig))
+	for _, name := range unused {
+		jobs <- gcJob{name, true}
+	}
+	for _, name := range orig {
+		jobs <- gcJob{name, false}
+	}
+	close(jobs)
+
+	var mu sync.Mutex // protects numErrs
+	var numErrs int
+	var wg sync.WaitGroup
+	cmd.rep.AddTotal(len(unused) + len(orig))
+	for i := 0; i < cmd.maxRequests; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				var err error
+				if j.delete {
+					err = cmd.deleteCover(ctx, bucket, j.name)
+				} else {
+					err = cmd.inspectCover(ctx, bucket, objects[j.name])
+				}
+				if err != nil {
+					cmd.rep.Item(j.name, "failed", fmt.Sprintf("Failed processing %v: %v", j.name, err))
+					mu.Lock()
+					numErrs++
+					mu.Unlock()
+				}
+				cmd.rep.Advance(1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if numErrs > 0 {
+		return fmt.Errorf("%d cover(s) failed", numErrs)
+	}
+	return nil
+}
+
+// deleteCover deletes the unused cover named name from bucket.
+func (cmd *Command) deleteCover(ctx context.Context, bucket *storage.BucketHandle, name string) error {
+	if cmd.dryRun {
+		cmd.rep.Item(name, "wouldDelete", "Would delete unused "+name)
+		return nil
+	}
+	if err := bucket.Object(name).Delete(ctx); err != nil {
+		return err
+	}
+	cmd.rep.Item(name, "deleted", "Deleted unused "+name)
+	return nil
+}
+
+// inspectCover checks the dimensions of the cover described by attrs,
+// re-encoding it if it's larger than cmd.maxSize.
+func (cmd *Command) inspectCover(ctx context.Context, bucket *storage.BucketHandle,
+	attrs *storage.ObjectAttrs) error {
+	obj := bucket.Object(attrs.Name)
+	r, err := obj.NewReader(ctx)
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil {
+		return err
+	}
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("failed decoding config: %v", err)
+	}
+
+	name, w, h := attrs.Name, cfg.Width, cfg.Height
+	if w < cmd.minSize || h < cmd.minSize {
+		cmd.rep.Item(name, "small", fmt.Sprintf("%v is only %vx%v", name, w, h))
+	}
+	if cmd.maxSize <= 0 {
+		return nil
+	}
+	nw, nh := fitSize(w, h, cmd.maxSize)
+	if nw == w && nh == h {
+		return nil
+	}
+	if cmd.dryRun {
+		cmd.rep.Item(name, "wouldResize", fmt.Sprintf("Would resize %v from %vx%v to %vx%v", name, w, h, nw, nh))
+		return nil
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("failed decoding image: %v", err)
+	}
+	resized, err := resizeImage(img, nw, nh)
+	if err != nil {
+		return fmt.Errorf("failed encoding image: %v", err)
+	}
+	// Only overwrite the object if it hasn't changed since we read it.
+	ow := obj.If(storage.Conditions{GenerationMatch: attrs.Generation}).NewWriter(ctx)
+	ow.ContentType = "image/jpeg"
+	ow.CacheControl = attrs.CacheControl
+	ow.StorageClass = attrs.StorageClass
+	ow.Metadata = attrs.Metadata
+	if _, err := ow.Write(resized); err != nil {
+		ow.Close()
+		return err
+	}
+	if err := ow.Close(); err != nil {
+		return err
+	}
+	cmd.rep.Item(name, "resized", fmt.Sprintf("Resized %v from %vx%v (%d bytes) to %vx%v (%d bytes)",
+		name, w, h, len(data), nw, nh, len(resized)))
+	return nil
+}
@@ -0,0 +1,65 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package covers
+
+import (
+	"bytes"
+	"image"
+	"reflect"
+	"testing"
+)
+
+func TestPlanGC(t *testing.T) {
+	objects := []string{
+		"a.jpg",
+		"a.256.webp",
+		"a.512.webp",
+		"b.jpg",
+		"b.256.webp",
+		"b.512.avif",
+		"c.256.webp",
+		"notes.txt",
+	}
+	referenced := map[string]struct{}{"a.jpg": {}, "d.jpg": {}}
+	unused, orig := planGC(objects, referenced)
+	if want := []string{"b.256.webp", "b.512.avif", "b.jpg", "c.256.webp"}; !reflect.DeepEqual(unused, want) {
+		t.Errorf("planGC returned unused %q; want %q", unused, want)
+	}
+	if want := []string{"a.jpg"}; !reflect.DeepEqual(orig, want) {
+		t.Errorf("planGC returned orig %q; want %q", orig, want)
+	}
+}
+
+func TestFitSize(t *testing.T) {
+	for _, tc := range []struct {
+		w, h, max    int
+		wantW, wantH int
+	}{
+		{800, 600, 1200, 800, 600},
+		{1200, 1200, 1200, 1200, 1200},
+		{2400, 2400, 1200, 1200, 1200},
+		{3000, 2000, 1200, 1200, 800},
+		{1000, 3000, 1200, 400, 1200},
+		{1601, 1600, 1200, 1200, 1199},
+	} {
+		if w, h := fitSize(tc.w, tc.h, tc.max); w != tc.wantW || h != tc.wantH {
+			t.Errorf("fitSize(%d, %d, %d) = (%d, %d); want (%d, %d)",
+				tc.w, tc.h, tc.max, w, h, tc.wantW, tc.wantH)
+		}
+	}
+}
+
+func TestResizeImage(t *testing.T) {
+	data, err := resizeImage(image.NewRGBA(image.Rect(0, 0, 40, 20)), 10, 5)
+	if err != nil {
+		t.Fatal("resizeImage failed:", err)
+	}
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal("Failed decoding resized image:", err)
+	}
+	if format != "jpeg" || cfg.Width != 10 || cfg.Height != 5 {
+		t.Errorf("Resized image is %dx%d %v; want 10x5 jpeg", cfg.Width, cfg.Height, format)
+	}
+}
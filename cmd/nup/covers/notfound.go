@@ -0,0 +1,94 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package covers
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// notFoundCache records album IDs for which the Cover Art Archive didn't have covers
+// so that they won't be requested again on every run.
+type notFoundCache struct {
+	path  string        // path to JSON file
+	ttl   time.Duration // time after which entries expire
+	mu    sync.Mutex
+	times map[string]time.Time // keys are album IDs, values are times of 404s
+}
+
+// loadNotFoundCache reads a cache from the JSON file at p.
+// An empty cache is returned if the file doesn't exist.
+func loadNotFoundCache(p string, ttl time.Duration) (*notFoundCache, error) {
+	c := &notFoundCache{path: p, ttl: ttl, times: make(map[string]time.Time)}
+	data, err := ioutil.ReadFile(p)
+	if os.IsNotExist(err) {
+		return c, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &c.times); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// has returns true if id was recorded as not found within c.ttl of now.
+func (c *notFoundCache) has(id string, now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t, ok := c.times[id]
+	return ok && now.Sub(t) < c.ttl
+}
+
+// add records that id was not found at now.
+func (c *notFoundCache) add(id string, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.times[id] = now
+}
+
+// remove removes id from the cache, e.g. after its cover was found.
+func (c *notFoundCache) remove(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.times, id)
+}
+
+// save writes unexpired entries to c.path.
+func (c *notFoundCache) save(now time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for id, t := range c.times {
+		if now.Sub(t) >= c.ttl {
+			delete(c.times, id)
+		}
+	}
+	data, err := json.MarshalIndent(c.times, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// Write to a temp file and rename it so we don't lose the cache if we're interrupted.
+	if err := os.MkdirAll(filepath.Dir(c.path), 0755); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(c.path), filepath.Base(c.path)+".")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), c.path)
+}
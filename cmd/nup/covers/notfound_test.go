@@ -0,0 +1,43 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package covers
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestNotFoundCache(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "sub/not_found.json")
+	const ttl = 24 * time.Hour
+	now := time.Date(2023, 6, 1, 0, 0, 0, 0, time.UTC)
+
+	c, err := loadNotFoundCache(p, ttl)
+	if err != nil {
+		t.Fatal("loadNotFoundCache failed for missing file:", err)
+	}
+	c.add("old", now.Add(-2*ttl))
+	c.add("recent", now.Add(-ttl/2))
+	c.add("found", now)
+	c.remove("found")
+	if err := c.save(now); err != nil {
+		t.Fatal("save failed:", err)
+	}
+
+	if c, err = loadNotFoundCache(p, ttl); err != nil {
+		t.Fatal("loadNotFoundCache failed:", err)
+	}
+	for id, want := range map[string]bool{"old": false, "recent": true, "found": false, "other": false} {
+		if got := c.has(id, now); got != want {
+			t.Errorf("has(%q) = %v; want %v", id, got, want)
+		}
+	}
+	if _, ok := c.times["old"]; ok {
+		t.Error("Expired entry was saved")
+	}
+	if c.has("recent", now.Add(ttl)) {
+		t.Error("has returned true after entry expired")
+	}
+}
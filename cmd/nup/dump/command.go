@@ -9,10 +9,14 @@ import (
 	"encoding/json"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/derat/nup/cmd/nup/client"
 	"github.com/derat/nup/server/db"
@@ -26,13 +30,24 @@ const (
 	defaultSongBatchSize = 400
 	defaultPlayBatchSize = 800
 	chanSize             = 50
+
+	// playSlack is subtracted from the last dump time when fetching plays in
+	// incremental dumps to pick up plays that were reported late.
+	playSlack = 7 * 24 * time.Hour
 )
 
 type Command struct {
 	Cfg *client.Config
 
-	songBatchSize int // batch size for Song entities
-	playBatchSize int // batch size for Play entities
+	songBatchSize int    // batch size for Song entities
+	playBatchSize int    // batch size for Play entities
+	since         string // RFC 3339 time for incremental dumps
+	stateFile     string // path to JSON file with state for incremental dumps
+	mergeFile     string // path to earlier dump to merge changes into
+	library       string // library to dump (overrides config)
+	dataFormat    string // "ndjson" or "csv"
+	dataType      string // "song" or "play"
+	out           client.OutputFlags
 }
 
 func (*Command) Name() string     { return "dump" }
@@ -40,6 +55,12 @@ func (*Command) Synopsis() string { return "dump songs from the server" }
 func (*Command) Usage() string {
 	return `dump <flags>:
 	Dump JSON-marshaled song data from the server to stdout.
+	With -since or -state-file, only fetch songs changed and plays
+	reported since the last dump and merge them into -merge-file
+	(which must contain an NDJSON song dump).
+
+	With -data-format=csv, songs (without plays) or plays are written
+	as CSV with a header row, e.g. for loading into analysis tools.
 
 `
 }
@@ -47,47 +68,223 @@ func (*Command) Usage() string {
 func (cmd *Command) SetFlags(f *flag.FlagSet) {
 	f.IntVar(&cmd.songBatchSize, "song-batch-size", defaultSongBatchSize, "Size for each batch of entities")
 	f.IntVar(&cmd.playBatchSize, "play-batch-size", defaultPlayBatchSize, "Size for each batch of entities")
+	f.StringVar(&cmd.since, "since", "",
+		"RFC 3339 time (e.g. 2023-04-01T00:00:00Z) of earlier dump for incremental dump")
+	f.StringVar(&cmd.stateFile, "state-file", "",
+		"JSON file recording the last successful dump's time for incremental dumps (updated on success)")
+	f.StringVar(&cmd.mergeFile, "merge-file", "",
+		"Earlier full dump to merge changes into for incremental dumps")
+	f.StringVar(&cmd.library, "library", "", "Name of server library to dump (overrides config's library)")
+	f.StringVar(&cmd.dataFormat, "data-format", "ndjson", `Data format ("ndjson" or "csv")`)
+	f.StringVar(&cmd.dataType, "type", "song", `Data to write ("song" or "play")`)
+	cmd.out.SetFlags(f)
 }
 
 func (cmd *Command) Execute(ctx context.Context, _ *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
-	songChan := make(chan *db.Song, chanSize)
-	go getSongs(cmd.Cfg, cmd.songBatchSize, songChan)
+	// Songs are written to stdout, so write results to stderr.
+	rep, err := cmd.out.NewReporter(os.Stderr)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Bad output flags:", err)
+		return subcommands.ExitUsageError
+	}
+	rep.LogText = true
 
-	playChan := make(chan *db.PlayDump, chanSize)
-	go getPlays(cmd.Cfg, cmd.playBatchSize, playChan)
+	sw, err := newSongWriter(os.Stdout, cmd.dataFormat, cmd.dataType)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Bad data flags:", err)
+		return subcommands.ExitUsageError
+	}
+
+	if cmd.library != "" {
+		cmd.Cfg.Library = cmd.library
+	}
+
+	var since time.Time
+	if cmd.since != "" {
+		if since, err = time.Parse(time.RFC3339, cmd.since); err != nil {
+			fmt.Fprintln(os.Stderr, "Bad -since time:", err)
+			return subcommands.ExitUsageError
+		}
+	} else if cmd.stateFile != "" {
+		st, err := readState(cmd.stateFile)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Failed reading state:", err)
+			return subcommands.ExitFailure
+		}
+		since = st.LastDumpTime
+	}
+	if !since.IsZero() && cmd.mergeFile == "" {
+		fmt.Fprintln(os.Stderr, "-merge-file is required for incremental dumps")
+		return subcommands.ExitUsageError
+	}
+
+	// Get the server's time before dumping so that changes made during the dump
+	// will be picked up by the next incremental dump.
+	var start time.Time
+	if cmd.stateFile != "" {
+		if start, err = getServerTime(cmd.Cfg); err != nil {
+			fmt.Fprintln(os.Stderr, "Failed getting server time:", err)
+			return subcommands.ExitFailure
+		}
+	}
 
-	e := json.NewEncoder(os.Stdout)
+	if since.IsZero() {
+		err = cmd.dumpAll(rep, sw)
+	} else {
+		err = cmd.dumpIncremental(rep, sw, since)
+	}
+	if err == nil {
+		err = sw.close()
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed dumping songs:", err)
+		return subcommands.ExitFailure
+	}
+
+	if cmd.stateFile != "" {
+		if err := writeState(cmd.stateFile, state{LastDumpTime: start}); err != nil {
+			fmt.Fprintln(os.Stderr, "Failed writing state:", err)
+			return subcommands.ExitFailure
+		}
+	}
+	rep.Summary()
+	return subcommands.ExitSuccess
+}
 
+// dumpAll writes all songs and plays to sw.
+func (cmd *Command) dumpAll(rep *client.Reporter, sw *songWriter) error {
 	numSongs := 0
+	if err := Songs(cmd.Cfg, cmd.songBatchSize, cmd.playBatchSize, func(s *db.Song) error {
+		if err := sw.write(s); err != nil {
+			return fmt.Errorf("failed to encode song: %v", err)
+		}
+		numSongs++
+		rep.Count("songs", 1)
+		rep.Count("plays", len(s.Plays))
+		rep.Advance(1)
+		if numSongs%progressInterval == 0 {
+			rep.Textf("Wrote %d songs", numSongs)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	rep.Textf("Wrote %d songs", numSongs)
+	return nil
+}
+
+// dumpIncremental fetches songs that were changed and plays that were reported since the
+// supplied time, merges them into cmd.mergeFile, and writes the merged songs to sw.
+func (cmd *Command) dumpIncremental(rep *client.Reporter, sw *songWriter, since time.Time) error {
+	f, err := os.Open(cmd.mergeFile)
+	if err != nil {
+		return err
+	}
+	songs, err := readDump(f)
+	f.Close()
+	if err != nil {
+		return fmt.Errorf("reading %v: %v", cmd.mergeFile, err)
+	}
+
+	unmarshal := func(b []byte, dst interface{}) {
+		if err := json.Unmarshal(b, dst); err != nil {
+			log.Fatalf("Got unexpected line from server: %v", string(b))
+		}
+	}
+	songArg := fmt.Sprintf("minLastModifiedNsec=%d", since.UnixNano())
+	var updated []db.Song
+	getEntities(cmd.Cfg, "song", []string{songArg}, cmd.songBatchSize, func(b []byte) {
+		var s db.Song
+		unmarshal(b, &s)
+		updated = append(updated, s)
+	})
+	deleted := make(map[string]bool)
+	getEntities(cmd.Cfg, "song", []string{"deleted=1", songArg}, cmd.songBatchSize, func(b []byte) {
+		var s db.Song
+		unmarshal(b, &s)
+		deleted[s.SongID] = true
+	})
+	// Plays can be reported some time after they started (e.g. by offline clients),
+	// so look further back for them. mergeDump ignores duplicates.
+	playArg := fmt.Sprintf("minStartTimeNsec=%d", since.Add(-playSlack).UnixNano())
+	var plays []db.PlayDump
+	getEntities(cmd.Cfg, "play", []string{playArg}, cmd.playBatchSize, func(b []byte) {
+		var pd db.PlayDump
+		unmarshal(b, &pd)
+		plays = append(plays, pd)
+	})
+	rep.Textf("Got %d updated song(s), %d deleted song(s), and %d play(s)",
+		len(updated), len(deleted), len(plays))
+
+	merged, err := mergeDump(songs, updated, plays, deleted)
+	if err != nil {
+		return err
+	}
+	for i := range merged {
+		if err := sw.write(&merged[i]); err != nil {
+			return fmt.Errorf("failed to encode song: %v", err)
+		}
+		rep.Count("songs", 1)
+		rep.Count("plays", len(merged[i].Plays))
+	}
+	rep.Textf("Wrote %d songs", len(merged))
+	return nil
+}
+
+// getServerTime returns the server's current time.
+func getServerTime(cfg *client.Config) (time.Time, error) {
+	req, err := http.NewRequest("GET", cfg.GetURL("/now").String(), nil)
+	if err != nil {
+		return time.Time{}, err
+	}
+	cfg.SetAuth(req)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return time.Time{}, fmt.Errorf("got status %q", resp.Status)
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return time.Time{}, err
+	}
+	nsec, err := strconv.ParseInt(string(b), 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(0, nsec), nil
+}
+
+// Songs fetches all songs and their plays from the server and passes them to fn in order.
+// songBatchSize and playBatchSize are the number of songs and plays to request at a time.
+// If fn returns an error, Songs returns it immediately.
+func Songs(cfg *client.Config, songBatchSize, playBatchSize int, fn func(s *db.Song) error) error {
+	songChan := make(chan *db.Song, chanSize)
+	go getSongs(cfg, songBatchSize, songChan)
+
+	playChan := make(chan *db.PlayDump, chanSize)
+	go getPlays(cfg, playBatchSize, playChan)
+
 	pd := <-playChan
 	for {
 		s := <-songChan
 		if s == nil {
 			break
 		}
-
 		for pd != nil && pd.SongID == s.SongID {
 			s.Plays = append(s.Plays, pd.Play)
 			pd = <-playChan
 		}
-
-		if err := e.Encode(s); err != nil {
-			fmt.Fprintln(os.Stderr, "Failed to encode song:", err)
-			return subcommands.ExitFailure
-		}
-
-		numSongs++
-		if numSongs%progressInterval == 0 {
-			log.Printf("Wrote %d songs", numSongs)
+		if err := fn(s); err != nil {
+			return err
 		}
 	}
-	log.Printf("Wrote %d songs", numSongs)
-
 	if pd != nil {
-		fmt.Fprintf(os.Stderr, "Got orphaned play for song %v: %v\n", pd.SongID, pd.Play)
-		return subcommands.ExitFailure
+		return fmt.Errorf("got orphaned play for song %v: %v", pd.SongID, pd.Play)
 	}
-	return subcommands.ExitSuccess
+	return nil
 }
 
 func getEntities(cfg *client.Config, entityType string, extraArgs []string, batchSize int, f func([]byte)) {
@@ -95,6 +292,9 @@ func getEntities(cfg *client.Config, entityType string, extraArgs []string, batc
 	var cursor string
 	for {
 		u.RawQuery = fmt.Sprintf("type=%s&max=%d", entityType, batchSize)
+		if cfg.Library != "" {
+			u.RawQuery += "&library=" + url.QueryEscape(cfg.Library)
+		}
 		if len(extraArgs) > 0 {
 			u.RawQuery += "&" + strings.Join(extraArgs, "&")
 		}
@@ -106,7 +306,7 @@ func getEntities(cfg *client.Config, entityType string, extraArgs []string, batc
 		if err != nil {
 			log.Fatal("Failed to create request: ", err)
 		}
-		req.SetBasicAuth(cfg.Username, cfg.Password)
+		cfg.SetAuth(req)
 
 		resp, err := http.DefaultClient.Do(req)
 		if err != nil {
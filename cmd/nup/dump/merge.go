@@ -0,0 +1,120 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package dump
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/derat/nup/server/db"
+)
+
+// state is persisted to the file passed via -state-file.
+type state struct {
+	// LastDumpTime contains the server's time at the start of the last successful dump.
+	LastDumpTime time.Time `json:"lastDumpTime"`
+}
+
+// readState reads a JSON-marshaled state from p.
+// An empty state is returned if p doesn't exist.
+func readState(p string) (state, error) {
+	var st state
+	f, err := os.Open(p)
+	if os.IsNotExist(err) {
+		return st, nil
+	} else if err != nil {
+		return st, err
+	}
+	defer f.Close()
+	err = json.NewDecoder(f).Decode(&st)
+	return st, err
+}
+
+// writeState atomically writes st to p.
+func writeState(p string, st state) error {
+	b, err := json.Marshal(&st)
+	if err != nil {
+		return err
+	}
+	tmp := p + ".tmp"
+	if err := ioutil.WriteFile(tmp, append(b, '\n'), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, p)
+}
+
+// readDump reads newline-separated JSON-marshaled songs from r.
+func readDump(r io.Reader) ([]db.Song, error) {
+	var songs []db.Song
+	d := json.NewDecoder(r)
+	for {
+		var s db.Song
+		if err := d.Decode(&s); err == io.EOF {
+			return songs, nil
+		} else if err != nil {
+			return nil, err
+		}
+		songs = append(songs, s)
+	}
+}
+
+// mergeDump merges changes into songs, which were previously dumped.
+// updated contains songs that were added or modified since the earlier dump;
+// their metadata and user data replaces the earlier versions, but their plays are retained.
+// plays contains new plays, which are added to their songs (duplicates are ignored).
+// deleted contains the IDs of songs that were deleted since the earlier dump.
+// The merged songs are returned in ascending order by ID, matching a full dump.
+func mergeDump(songs, updated []db.Song, plays []db.PlayDump, deleted map[string]bool) ([]db.Song, error) {
+	byID := make(map[string]*db.Song, len(songs)+len(updated))
+	for i := range songs {
+		byID[songs[i].SongID] = &songs[i]
+	}
+	for i := range updated {
+		s := &updated[i]
+		if old, ok := byID[s.SongID]; ok {
+			s.Plays = old.Plays
+		}
+		byID[s.SongID] = s
+	}
+	for _, pd := range plays {
+		if deleted[pd.SongID] {
+			continue
+		}
+		s, ok := byID[pd.SongID]
+		if !ok {
+			return nil, fmt.Errorf("got play for unknown song %v", pd.SongID)
+		}
+		s.Plays = append(s.Plays, pd.Play)
+	}
+
+	merged := make([]db.Song, 0, len(byID))
+	for id, s := range byID {
+		if deleted[id] {
+			continue
+		}
+		s.Clean() // sort and dedupe plays
+		merged = append(merged, *s)
+	}
+	var err error
+	sort.Slice(merged, func(i, j int) bool {
+		a, aerr := strconv.ParseInt(merged[i].SongID, 10, 64)
+		b, berr := strconv.ParseInt(merged[j].SongID, 10, 64)
+		if aerr != nil {
+			err = aerr
+		} else if berr != nil {
+			err = berr
+		}
+		return a < b
+	})
+	if err != nil {
+		return nil, fmt.Errorf("bad song ID: %v", err)
+	}
+	return merged, nil
+}
@@ -0,0 +1,74 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package dump
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/derat/nup/server/db"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestMergeDump(t *testing.T) {
+	t1 := time.Date(2023, 4, 1, 0, 0, 0, 0, time.UTC)
+	t2 := t1.Add(time.Hour)
+	t3 := t2.Add(time.Hour)
+	p1 := db.Play{StartTime: t1, IPAddress: "1.2.3.4"}
+	p2 := db.Play{StartTime: t2, IPAddress: "1.2.3.4"}
+	p3 := db.Play{StartTime: t3, IPAddress: "5.6.7.8"}
+
+	songs := []db.Song{
+		{SongID: "2", Title: "Two", Plays: []db.Play{p1}},
+		{SongID: "10", Title: "Ten", Plays: []db.Play{p1, p2}},
+		{SongID: "3", Title: "Three"},
+	}
+	updated := []db.Song{
+		{SongID: "2", Title: "Two (updated)", Rating: 4},
+		{SongID: "11", Title: "Eleven"},
+	}
+	plays := []db.PlayDump{
+		{SongID: "2", Play: p3},
+		{SongID: "10", Play: p2}, // duplicate
+		{SongID: "11", Play: p3},
+		{SongID: "3", Play: p2}, // deleted
+	}
+	deleted := map[string]bool{"3": true}
+
+	got, err := mergeDump(songs, updated, plays, deleted)
+	if err != nil {
+		t.Fatal("mergeDump failed: ", err)
+	}
+	want := []db.Song{
+		{SongID: "2", Title: "Two (updated)", Rating: 4, Plays: []db.Play{p1, p3}},
+		{SongID: "10", Title: "Ten", Plays: []db.Play{p1, p2}},
+		{SongID: "11", Title: "Eleven", Plays: []db.Play{p3}},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Error("mergeDump returned unexpected songs:\n" + diff)
+	}
+
+	if _, err := mergeDump(nil, nil, []db.PlayDump{{SongID: "5", Play: p1}}, nil); err == nil {
+		t.Error("mergeDump unexpectedly succeeded for play for unknown song")
+	}
+}
+
+func TestState(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "state.json")
+	if st, err := readState(p); err != nil {
+		t.Fatal("readState with missing file failed: ", err)
+	} else if !st.LastDumpTime.IsZero() {
+		t.Errorf("readState with missing file returned %v", st.LastDumpTime)
+	}
+	want := state{LastDumpTime: time.Date(2023, 4, 1, 12, 34, 56, 0, time.UTC)}
+	if err := writeState(p, want); err != nil {
+		t.Fatal("writeState failed: ", err)
+	}
+	if got, err := readState(p); err != nil {
+		t.Fatal("readState failed: ", err)
+	} else if !got.LastDumpTime.Equal(want.LastDumpTime) {
+		t.Errorf("readState returned %v; want %v", got.LastDumpTime, want.LastDumpTime)
+	}
+}
@@ -0,0 +1,81 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package dump
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/derat/nup/server/db"
+)
+
+// songWriter writes dumped songs or their plays in a specific format.
+type songWriter struct {
+	plays bool          // write plays instead of songs
+	enc   *json.Encoder // non-nil for NDJSON
+	cw    *csv.Writer   // non-nil for CSV
+}
+
+// newSongWriter returns a songWriter that writes to w. format is either "ndjson" or "csv",
+// and typ is either "song" or "play". CSV headers are written immediately.
+func newSongWriter(w io.Writer, format, typ string) (*songWriter, error) {
+	var sw songWriter
+	switch typ {
+	case "song":
+	case "play":
+		sw.plays = true
+	default:
+		return nil, fmt.Errorf("invalid type %q", typ)
+	}
+	switch format {
+	case "ndjson":
+		sw.enc = json.NewEncoder(w)
+	case "csv":
+		sw.cw = csv.NewWriter(w)
+		header := db.SongCSVHeader
+		if sw.plays {
+			header = db.PlayCSVHeader
+		}
+		if err := sw.cw.Write(header); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("invalid format %q", format)
+	}
+	return &sw, nil
+}
+
+// write writes s (or its plays).
+func (sw *songWriter) write(s *db.Song) error {
+	if !sw.plays {
+		if sw.enc != nil {
+			return sw.enc.Encode(s)
+		}
+		return sw.cw.Write(s.CSVRecord())
+	}
+	for _, p := range s.Plays {
+		pd := db.PlayDump{SongID: s.SongID, Play: p}
+		var err error
+		if sw.enc != nil {
+			err = sw.enc.Encode(&pd)
+		} else {
+			err = sw.cw.Write(pd.CSVRecord())
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// close flushes any buffered data.
+func (sw *songWriter) close() error {
+	if sw.cw != nil {
+		sw.cw.Flush()
+		return sw.cw.Error()
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package dump
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/derat/nup/server/db"
+)
+
+func TestSongWriter(t *testing.T) {
+	t1 := time.Date(2023, 4, 1, 12, 30, 0, 0, time.UTC)
+	t2 := t1.Add(time.Hour)
+	songs := []db.Song{
+		{
+			SongID:   "1",
+			Filename: "a.mp3",
+			Artist:   "Artist, The",
+			Title:    `Song "One"`,
+			Album:    "Album",
+			Track:    2,
+			Disc:     1,
+			Date:     time.Date(2001, 2, 3, 0, 0, 0, 0, time.UTC),
+			Length:   123.5,
+			Rating:   4,
+			Tags:     []string{"guitar", "rock"},
+			Genres:   []string{"Rock", "Pop"},
+			Plays:    []db.Play{{StartTime: t1, IPAddress: "1.2.3.4", User: "me"}, {StartTime: t2}},
+		},
+		{SongID: "2", Filename: "b.mp3", Artist: "Other", Title: "Two"},
+	}
+
+	for _, tc := range []struct {
+		format, typ string
+		want        string
+	}{
+		{"csv", "song", "songId,sha1,filename,library,artist,title,album,albumArtist,albumId,composer," +
+			"conductor,performer,discSubtitle,genres,compilation,track,disc,totalTracks,totalDiscs,date," +
+			"length,bpm,key,trackGain,albumGain,peakAmp,rating,plays,numSkips,tags\n" +
+			`1,,a.mp3,,"Artist, The","Song ""One""",Album,,,,,,,Rock;Pop,false,2,1,0,0,2001-02-03,` +
+			"123.5,0,,0,0,0,4,2,0,guitar rock\n" +
+			"2,,b.mp3,,Other,Two,,,,,,,,,false,0,0,0,0,,0,0,,0,0,0,0,0,0,\n"},
+		{"csv", "play", "songId,startTime,ipAddress,user\n" +
+			"1,2023-04-01T12:30:00Z,1.2.3.4,me\n" +
+			"1,2023-04-01T13:30:00Z,,\n"},
+		{"ndjson", "play", `{"songId":"1","play":{"t":"2023-04-01T12:30:00Z","ip":"1.2.3.4","user":"me"}}` + "\n" +
+			`{"songId":"1","play":{"t":"2023-04-01T13:30:00Z","ip":""}}` + "\n"},
+	} {
+		var b bytes.Buffer
+		sw, err := newSongWriter(&b, tc.format, tc.typ)
+		if err != nil {
+			t.Errorf("newSongWriter(%q, %q) failed: %v", tc.format, tc.typ, err)
+			continue
+		}
+		for i := range songs {
+			if err := sw.write(&songs[i]); err != nil {
+				t.Errorf("%v/%v: write failed: %v", tc.format, tc.typ, err)
+			}
+		}
+		if err := sw.close(); err != nil {
+			t.Errorf("%v/%v: close failed: %v", tc.format, tc.typ, err)
+		}
+		if got := b.String(); got != tc.want {
+			t.Errorf("%v/%v wrote:\n%s\nwant:\n%s", tc.format, tc.typ, got, tc.want)
+		}
+	}
+
+	if _, err := newSongWriter(&bytes.Buffer{}, "xml", "song"); err == nil {
+		t.Error("newSongWriter didn't reject bad format")
+	}
+	if _, err := newSongWriter(&bytes.Buffer{}, "csv", "album"); err == nil {
+		t.Error("newSongWriter didn't reject bad type")
+	}
+}
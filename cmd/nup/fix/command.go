@@ -0,0 +1,119 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package fix
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/derat/nup/cmd/nup/client"
+	"github.com/derat/nup/cmd/nup/update"
+	"github.com/derat/nup/server/db"
+	"github.com/google/subcommands"
+)
+
+type Command struct {
+	Cfg *client.Config
+
+	dryRun  bool   // only print changes
+	fields  string // comma-separated fields to rewrite
+	regexp  string // regular expression to match
+	replace string // replacement for matches
+	out     client.OutputFlags
+	rep     *client.Reporter
+}
+
+func (*Command) Name() string     { return "fix" }
+func (*Command) Synopsis() string { return "find and replace song metadata" }
+func (*Command) Usage() string {
+	return `fix <flags>:
+	Read dumped songs from stdin, replace matches of -regexp in the
+	fields listed in -fields, and send the updated songs to the server.
+	Changes are overwritten if songs' files are reimported, so the config's
+	rewriteRules field or metadata override files should be used to make
+	persistent changes.
+
+`
+}
+
+func (cmd *Command) SetFlags(f *flag.FlagSet) {
+	f.BoolVar(&cmd.dryRun, "dry-run", false, "Only print what would be changed")
+	f.StringVar(&cmd.fields, "fields", string(albumField),
+		"Comma-separated fields to rewrite (artist, title, album, albumArtist, discSubtitle)")
+	f.StringVar(&cmd.regexp, "regexp", "", "Regular expression (RE2 syntax) to match in fields")
+	f.StringVar(&cmd.replace, "replace", "", `Replacement for matches (may contain submatches like "$1")`)
+	cmd.out.SetFlags(f)
+}
+
+func (cmd *Command) Execute(ctx context.Context, _ *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+	if cmd.regexp == "" {
+		fmt.Fprintln(os.Stderr, "-regexp must be supplied")
+		return subcommands.ExitUsageError
+	}
+	re, err := regexp.Compile(cmd.regexp)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Bad -regexp:", err)
+		return subcommands.ExitUsageError
+	}
+	fields, err := parseFields(cmd.fields)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Bad -fields:", err)
+		return subcommands.ExitUsageError
+	}
+	if cmd.rep, err = cmd.out.NewReporter(os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, "Bad output flags:", err)
+		return subcommands.ExitUsageError
+	}
+	cmd.rep.LogText = true
+
+	var songs []db.Song
+	d := json.NewDecoder(os.Stdin)
+	for {
+		var s db.Song
+		if err := d.Decode(&s); err == io.EOF {
+			break
+		} else if err != nil {
+			fmt.Fprintln(os.Stderr, "Failed reading songs:", err)
+			return subcommands.ExitFailure
+		}
+		songs = append(songs, s)
+	}
+
+	var updated []db.Song
+	cmd.rep.AddTotal(len(songs))
+	for _, s := range songs {
+		if changes := fixSong(&s, fields, re, cmd.replace); len(changes) > 0 {
+			msg := strings.Join(changes, ", ")
+			if cmd.dryRun {
+				cmd.rep.Item(s.Filename, "wouldUpdate", fmt.Sprintf("Would update %v: %v", s.Filename, msg))
+			} else {
+				cmd.rep.Item(s.Filename, "updated", fmt.Sprintf("Updated %v: %v", s.Filename, msg))
+				updated = append(updated, s)
+			}
+		}
+		cmd.rep.Advance(1)
+	}
+
+	if len(updated) > 0 {
+		// The server identifies the songs by their SHA1s and preserves their user data.
+		cmd.rep.Textf("Sending %d song(s) to server", len(updated))
+		ch := make(chan db.Song, len(updated))
+		for _, s := range updated {
+			ch <- s
+		}
+		close(ch)
+		if err := update.ImportSongs(cmd.Cfg, ch, false, false); err != nil {
+			fmt.Fprintln(os.Stderr, "Failed sending songs:", err)
+			return subcommands.ExitFailure
+		}
+	}
+	cmd.rep.Summary()
+	return subcommands.ExitSuccess
+}
@@ -0,0 +1,93 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package fix
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/derat/nup/server/db"
+)
+
+// field is a song field that can be rewritten.
+type field string
+
+const (
+	artistField       field = "artist"
+	titleField        field = "title"
+	albumField        field = "album"
+	albumArtistField  field = "albumArtist"
+	discSubtitleField field = "discSubtitle"
+)
+
+// parseFields parses a comma-separated list of fields.
+// The returned fields are in the order in which they were listed.
+func parseFields(s string) ([]field, error) {
+	var fields []field
+	seen := make(map[field]bool)
+	for _, v := range strings.Split(s, ",") {
+		switch f := field(strings.TrimSpace(v)); f {
+		case artistField, titleField, albumField, albumArtistField, discSubtitleField:
+			if !seen[f] {
+				fields = append(fields, f)
+				seen[f] = true
+			}
+		case "":
+		default:
+			return nil, fmt.Errorf("unknown field %q", f)
+		}
+	}
+	if len(fields) == 0 {
+		return nil, errors.New("no fields supplied")
+	}
+	return fields, nil
+}
+
+// getField returns a pointer to s's value for f.
+func getField(s *db.Song, f field) *string {
+	switch f {
+	case artistField:
+		return &s.Artist
+	case titleField:
+		return &s.Title
+	case albumField:
+		return &s.Album
+	case albumArtistField:
+		return &s.AlbumArtist
+	case discSubtitleField:
+		return &s.DiscSubtitle
+	default:
+		panic(fmt.Sprintf("unknown field %q", f))
+	}
+}
+
+// fixSong replaces matches of re in s's fields with repl (which may contain
+// submatch references like "$1"). Leading and trailing whitespace is trimmed from
+// changed values. Descriptions of the changes are returned.
+func fixSong(s *db.Song, fields []field, re *regexp.Regexp, repl string) []string {
+	var changes []string
+	for _, f := range fields {
+		p := getField(s, f)
+		if !re.MatchString(*p) {
+			continue
+		}
+		if val := strings.TrimSpace(re.ReplaceAllString(*p, repl)); val != *p {
+			changes = append(changes, fmt.Sprintf("%v %q -> %q", f, *p, val))
+			*p = val
+			// Credits and sort names describe the original strings.
+			switch f {
+			case artistField:
+				s.ArtistCredits = nil
+				s.ArtistSortName = ""
+			case albumField:
+				s.AlbumSortName = ""
+			case albumArtistField:
+				s.AlbumArtistSortName = ""
+			}
+		}
+	}
+	return changes
+}
@@ -0,0 +1,77 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package fix
+
+import (
+	"reflect"
+	"regexp"
+	"testing"
+
+	"github.com/derat/nup/server/db"
+)
+
+func TestParseFields(t *testing.T) {
+	const s = "album, title,album"
+	if got, err := parseFields(s); err != nil {
+		t.Errorf("parseFields(%q) failed: %v", s, err)
+	} else if want := []field{albumField, titleField}; !reflect.DeepEqual(got, want) {
+		t.Errorf("parseFields(%q) = %q; want %q", s, got, want)
+	}
+	for _, s := range []string{"", "album,bogus"} {
+		if _, err := parseFields(s); err == nil {
+			t.Errorf("parseFields(%q) unexpectedly succeeded", s)
+		}
+	}
+}
+
+func TestFixSong(t *testing.T) {
+	for _, tc := range []struct {
+		fields []field
+		re     string
+		repl   string
+		orig   db.Song
+		want   db.Song
+		nchg   int
+	}{
+		{
+			[]field{albumField}, `\(Remastered \d+\)`, "",
+			db.Song{Title: "Song (Remastered 2011)", Album: "Album (Remastered 2011)"},
+			db.Song{Title: "Song (Remastered 2011)", Album: "Album"},
+			1,
+		},
+		{
+			[]field{titleField, albumField}, `(?i)\s*\(remaster(ed)?\)$`, "",
+			db.Song{Title: "Song (Remaster)", Album: "Album (remastered)"},
+			db.Song{Title: "Song", Album: "Album"},
+			2,
+		},
+		{
+			[]field{artistField, albumArtistField}, `^(.+), The$`, "The $1",
+			db.Song{
+				Artist:        "Beatles, The",
+				ArtistCredits: []db.ArtistCredit{{Name: "Beatles, The"}},
+				AlbumArtist:   "Beatles, The",
+			},
+			db.Song{Artist: "The Beatles", AlbumArtist: "The Beatles"},
+			2,
+		},
+		{
+			// Songs without matches should be left unchanged.
+			[]field{artistField}, `^Foo$`, "Bar",
+			db.Song{Artist: "Foo Fighters", ArtistCredits: []db.ArtistCredit{{Name: "Foo Fighters"}}},
+			db.Song{Artist: "Foo Fighters", ArtistCredits: []db.ArtistCredit{{Name: "Foo Fighters"}}},
+			0,
+		},
+	} {
+		s := tc.orig
+		changes := fixSong(&s, tc.fields, regexp.MustCompile(tc.re), tc.repl)
+		if len(changes) != tc.nchg {
+			t.Errorf("fixSong(%q, %q) returned changes %q; want %d change(s)",
+				tc.re, tc.repl, changes, tc.nchg)
+		}
+		if !reflect.DeepEqual(s, tc.want) {
+			t.Errorf("fixSong(%q, %q) produced %+v; want %+v", tc.re, tc.repl, s, tc.want)
+		}
+	}
+}
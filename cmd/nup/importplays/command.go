@@ -0,0 +1,240 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package importplays
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/derat/nup/cmd/nup/client"
+	"github.com/derat/nup/server/db"
+	"github.com/google/subcommands"
+)
+
+const (
+	lastfmFormat  = "lastfm"
+	spotifyFormat = "spotify"
+
+	defaultMinPlayed = 30 * time.Second
+	postBatchSize    = 1000 // plays to send in each /played_batch request
+)
+
+type Command struct {
+	Cfg       *client.Config
+	format    string        // lastfmFormat or spotifyFormat
+	songsPath string        // path to dumped songs
+	user      string        // user to record plays for
+	minPlayed time.Duration // minimum Spotify stream duration
+	dryRun    bool          // print matches instead of sending them
+}
+
+func (*Command) Name() string     { return "import-plays" }
+func (*Command) Synopsis() string { return "import plays from other services" }
+func (*Command) Usage() string {
+	return `import-plays <flags> <file>...:
+	Import listening history exported from Last.fm (CSV) or Spotify
+	(extended streaming history JSON). Each entry is matched to a song from
+	the dumped songs supplied via -songs (or read from stdin) by artist and
+	title, using the album to choose between multiple matching songs.
+	Matched plays are sent to the server and unmatched entries are printed
+	to stderr.
+
+	Plays are recorded with the source ("lastfm" or "spotify") in place of an
+	IP address, so importing the same entries again doesn't add duplicate
+	plays.
+
+`
+}
+
+func (cmd *Command) SetFlags(f *flag.FlagSet) {
+	f.StringVar(&cmd.format, "format", "",
+		`Input format ("lastfm" or "spotify"; inferred from file extensions by default)`)
+	f.StringVar(&cmd.songsPath, "songs", "", "File containing dumped songs (default stdin)")
+	f.StringVar(&cmd.user, "user", "", "User to record plays for (admin only; default is the requester)")
+	f.DurationVar(&cmd.minPlayed, "min-played", defaultMinPlayed,
+		"Minimum duration of Spotify streams to import")
+	f.BoolVar(&cmd.dryRun, "dry-run", false, "Print matched plays to stdout instead of sending them")
+}
+
+func (cmd *Command) Execute(ctx context.Context, fs *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+	if fs.NArg() == 0 {
+		fmt.Fprintln(os.Stderr, cmd.Usage())
+		return subcommands.ExitUsageError
+	}
+	if cmd.format != "" && cmd.format != lastfmFormat && cmd.format != spotifyFormat {
+		fmt.Fprintf(os.Stderr, "Invalid -format %q\n", cmd.format)
+		return subcommands.ExitUsageError
+	}
+
+	songs, err := readSongs(cmd.songsPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed reading songs:", err)
+		return subcommands.ExitFailure
+	}
+	m := newMatcher(songs)
+
+	var plays []db.PlayDump
+	var numEntries, numUnmatched int
+	for _, p := range fs.Args() {
+		format := cmd.format
+		if format == "" {
+			if format = inferFormat(p); format == "" {
+				fmt.Fprintf(os.Stderr, "Can't infer format of %v; pass -format\n", p)
+				return subcommands.ExitUsageError
+			}
+		}
+		entries, err := cmd.readEntries(p, format)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed reading %v: %v\n", p, err)
+			return subcommands.ExitFailure
+		}
+		for i := range entries {
+			e := &entries[i]
+			numEntries++
+			s := m.match(e)
+			if s == nil {
+				numUnmatched++
+				fmt.Fprintln(os.Stderr, "Unmatched:", e)
+				continue
+			}
+			plays = append(plays, db.PlayDump{
+				SongID: s.SongID,
+				Play:   db.Play{StartTime: e.Start, IPAddress: format, User: cmd.user},
+			})
+		}
+	}
+	fmt.Fprintf(os.Stderr, "Matched %d of %d entries\n", numEntries-numUnmatched, numEntries)
+
+	if cmd.dryRun {
+		enc := json.NewEncoder(os.Stdout)
+		for i := range plays {
+			if err := enc.Encode(&plays[i]); err != nil {
+				fmt.Fprintln(os.Stderr, "Failed writing play:", err)
+				return subcommands.ExitFailure
+			}
+		}
+		return subcommands.ExitSuccess
+	}
+
+	var total playedBatchResult
+	for len(plays) > 0 {
+		n := len(plays)
+		if n > postBatchSize {
+			n = postBatchSize
+		}
+		res, err := sendPlays(ctx, cmd.Cfg, plays[:n])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Failed sending plays:", err)
+			return subcommands.ExitFailure
+		}
+		total.Added += res.Added
+		total.Duplicates += res.Duplicates
+		total.MissingSongs = append(total.MissingSongs, res.MissingSongs...)
+		plays = plays[n:]
+	}
+	fmt.Fprintf(os.Stderr, "Added %d play(s) (%d already present)\n", total.Added, total.Duplicates)
+	if len(total.MissingSongs) > 0 {
+		fmt.Fprintln(os.Stderr, "Missing songs:", strings.Join(total.MissingSongs, " "))
+	}
+	return subcommands.ExitSuccess
+}
+
+// inferFormat returns the format of the export at p based on its extension.
+// An empty string is returned if the format can't be inferred.
+func inferFormat(p string) string {
+	switch strings.ToLower(filepath.Ext(p)) {
+	case ".csv":
+		return lastfmFormat
+	case ".json":
+		return spotifyFormat
+	default:
+		return ""
+	}
+}
+
+// readEntries reads entries in the specified format from the file at p.
+func (cmd *Command) readEntries(p, format string) ([]entry, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if format == lastfmFormat {
+		return readLastfm(f)
+	}
+	return readSpotify(f, cmd.minPlayed)
+}
+
+// readSongs reads dumped songs from the file at p, or from stdin if p is empty.
+func readSongs(p string) ([]*db.Song, error) {
+	var r io.Reader = os.Stdin
+	if p != "" {
+		f, err := os.Open(p)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		r = f
+	}
+	d := json.NewDecoder(r)
+	songs := make([]*db.Song, 0)
+	for {
+		var s db.Song
+		if err := d.Decode(&s); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		songs = append(songs, &s)
+	}
+	return songs, nil
+}
+
+// playedBatchResult corresponds to the server's /played_batch response.
+type playedBatchResult struct {
+	Added        int      `json:"added"`
+	Duplicates   int      `json:"duplicates"`
+	MissingSongs []string `json:"missingSongs"`
+}
+
+// sendPlays sends plays to the server's /played_batch endpoint.
+func sendPlays(ctx context.Context, cfg *client.Config, plays []db.PlayDump) (*playedBatchResult, error) {
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	for i := range plays {
+		if err := enc.Encode(&plays[i]); err != nil {
+			return nil, err
+		}
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", cfg.GetURL("/played_batch").String(), &b)
+	if err != nil {
+		return nil, err
+	}
+	cfg.SetAuth(req)
+	req.Header.Set("Content-Type", "text/plain")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		b, _ := ioutil.ReadAll(resp.Body)
+		return nil, fmt.Errorf("got status %q: %s", resp.Status, strings.TrimSpace(string(b)))
+	}
+	var res playedBatchResult
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
@@ -0,0 +1,120 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package importplays
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/derat/nup/server/db"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestReadLastfm(t *testing.T) {
+	t1 := time.Date(2023, 1, 31, 12, 34, 0, 0, time.UTC)
+	t2 := time.Date(2023, 2, 1, 8, 5, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		name, data string
+	}{
+		{"no header", "Artist A,Album A,Title A,31 Jan 2023 12:34\n" +
+			"Artist B,,\"Title, B\",01 Feb 2023 08:05\n"},
+		{"header", "uts,utc_time,artist,artist_mbid,album,album_mbid,track,track_mbid\n" +
+			"1675168440,\"31 Jan 2023, 12:34\",Artist A,,Album A,,Title A,\n" +
+			"1675238700,\"01 Feb 2023, 08:05\",Artist B,,,,\"Title, B\",\n"},
+	} {
+		got, err := readLastfm(strings.NewReader(tc.data))
+		if err != nil {
+			t.Errorf("%v: readLastfm failed: %v", tc.name, err)
+			continue
+		}
+		want := []entry{
+			{Artist: "Artist A", Title: "Title A", Album: "Album A", Start: t1},
+			{Artist: "Artist B", Title: "Title, B", Start: t2},
+		}
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Errorf("%v: readLastfm returned bad entries:\n%s", tc.name, diff)
+		}
+	}
+}
+
+func TestReadSpotify(t *testing.T) {
+	const data = `[
+  {"ts": "2023-01-31T12:34:56Z", "ms_played": 180500,
+   "master_metadata_track_name": "Title A",
+   "master_metadata_album_artist_name": "Artist A",
+   "master_metadata_album_album_name": "Album A"},
+  {"ts": "2023-01-31T12:40:00Z", "ms_played": 5000,
+   "master_metadata_track_name": "Skipped",
+   "master_metadata_album_artist_name": "Artist A",
+   "master_metadata_album_album_name": "Album A"},
+  {"ts": "2023-01-31T13:00:00Z", "ms_played": 600000,
+   "master_metadata_track_name": null,
+   "master_metadata_album_artist_name": null,
+   "master_metadata_album_album_name": null,
+   "episode_name": "Some Podcast"}
+]`
+	got, err := readSpotify(strings.NewReader(data), 30*time.Second)
+	if err != nil {
+		t.Fatal("readSpotify failed:", err)
+	}
+	want := []entry{{
+		Artist: "Artist A",
+		Title:  "Title A",
+		Album:  "Album A",
+		Start:  time.Date(2023, 1, 31, 12, 31, 55, 0, time.UTC),
+	}}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Error("readSpotify returned bad entries:\n" + diff)
+	}
+}
+
+func TestMatcher(t *testing.T) {
+	songs := []*db.Song{
+		{SongID: "1", Artist: "Beyoncé", Title: "Halo", Album: "I Am... Sasha Fierce"},
+		{SongID: "2", Artist: "The Beatles", Title: "Let It Be", Album: "Let It Be"},
+		{SongID: "3", Artist: "The Beatles", Title: "Let It Be", Album: "Past Masters"},
+		{SongID: "4", Artist: "Simon & Garfunkel", Title: "The Boxer", Album: "Bridge over Troubled Water"},
+		{SongID: "5", Artist: "Guest", AlbumArtist: "Various", Title: "Don't Stop", Album: "Mix"},
+	}
+	m := newMatcher(songs)
+	for _, tc := range []struct {
+		artist, title, album string
+		want                 string // song ID or empty for no match
+	}{
+		{"Beyonce", "HALO", "", "1"},
+		{"The Beatles", "Let It Be", "Past Masters", "3"},
+		{"The Beatles", "Let It Be", "Let It Be (Remastered)", "2"},
+		{"The Beatles", "Let It Be", "Unknown", "2"},
+		{"The Beatles", "Let It Be - Remastered 2009", "", "2"},
+		{"Simon and Garfunkel", "The Boxer (Live)", "", "4"},
+		{"Various", "Don’t Stop", "Mix", "5"},
+		{"Guest", "Dont Stop", "", "5"},
+		{"The Beatles", "Yesterday", "", ""},
+		{"Someone Else", "Halo", "", ""},
+	} {
+		var got string
+		if s := m.match(&entry{Artist: tc.artist, Title: tc.title, Album: tc.album}); s != nil {
+			got = s.SongID
+		}
+		if got != tc.want {
+			t.Errorf("match(%q, %q, %q) = %q; want %q", tc.artist, tc.title, tc.album, got, tc.want)
+		}
+	}
+}
+
+func TestStripVersion(t *testing.T) {
+	for _, tc := range []struct{ in, want string }{
+		{"Song", "Song"},
+		{"Song (Remastered 2011)", "Song"},
+		{"Song [Live] (Remastered)", "Song"},
+		{"Song - Single Version", "Song"},
+		{"Self-Titled", "Self-Titled"},
+		{"(Untitled)", "(Untitled)"},
+	} {
+		if got := stripVersion(tc.in); got != tc.want {
+			t.Errorf("stripVersion(%q) = %q; want %q", tc.in, got, tc.want)
+		}
+	}
+}
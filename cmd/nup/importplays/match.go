@@ -0,0 +1,119 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package importplays
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/derat/nup/server/db"
+)
+
+// matcher finds songs corresponding to entries from other services.
+type matcher struct {
+	exact    map[string][]*db.Song // keyed by normalize(artist) + "\n" + normalize(title)
+	stripped map[string][]*db.Song // keyed using stripVersion on titles
+}
+
+func newMatcher(songs []*db.Song) *matcher {
+	m := matcher{
+		exact:    make(map[string][]*db.Song),
+		stripped: make(map[string][]*db.Song),
+	}
+	add := func(cands map[string][]*db.Song, artist, title string, s *db.Song) {
+		key := normalize(artist) + "\n" + normalize(title)
+		cands[key] = append(cands[key], s)
+	}
+	for _, s := range songs {
+		for _, artist := range songArtists(s) {
+			add(m.exact, artist, s.Title, s)
+			add(m.stripped, artist, stripVersion(s.Title), s)
+		}
+	}
+	// Sort candidates so matching is deterministic.
+	for _, cands := range []map[string][]*db.Song{m.exact, m.stripped} {
+		for _, ss := range cands {
+			sort.Slice(ss, func(i, j int) bool { return ss[i].SongID < ss[j].SongID })
+		}
+	}
+	return &m
+}
+
+// songArtists returns the artist names under which s may have been recorded by other services.
+func songArtists(s *db.Song) []string {
+	artists := []string{s.Artist}
+	if s.AlbumArtist != "" && s.AlbumArtist != s.Artist {
+		artists = append(artists, s.AlbumArtist) // Spotify reports album artists
+	}
+	return artists
+}
+
+// match returns the song best matching e, or nil if no song matches.
+// Artists and titles must match after normalization. If multiple songs match,
+// songs on albums with the same name as e's are preferred.
+func (m *matcher) match(e *entry) *db.Song {
+	artist := normalize(e.Artist)
+	cands := m.exact[artist+"\n"+normalize(e.Title)]
+	if len(cands) == 0 {
+		// Fall back to ignoring version suffixes like "(Remastered 2011)" or "- Live".
+		cands = m.stripped[artist+"\n"+normalize(stripVersion(e.Title))]
+	}
+	if len(cands) == 0 {
+		return nil
+	}
+	if e.Album != "" {
+		album := normalize(e.Album)
+		strippedAlbum := normalize(stripVersion(e.Album))
+		for _, s := range cands {
+			if normalize(s.Album) == album {
+				return s
+			}
+		}
+		for _, s := range cands {
+			if normalize(stripVersion(s.Album)) == strippedAlbum {
+				return s
+			}
+		}
+	}
+	return cands[0]
+}
+
+// versionRegexp matches parenthesized, bracketed, or hyphenated suffixes
+// describing versions of songs or albums, e.g. "(Remastered 2011)",
+// "[Deluxe Edition]", or " - Live at Wembley".
+var versionRegexp = regexp.MustCompile(`(?i)\s*(\([^)]*\)|\[[^\]]*\]|\s-\s.*)\s*$`)
+
+// stripVersion repeatedly removes version suffixes from s.
+// s is returned unchanged if it consists entirely of a suffix.
+func stripVersion(s string) string {
+	for {
+		stripped := versionRegexp.ReplaceAllString(s, "")
+		if stripped == s || stripped == "" {
+			return s
+		}
+		s = stripped
+	}
+}
+
+// normalize normalizes s for comparison: accents are removed, letters are lowercased,
+// "&" is replaced by "and", apostrophes are dropped, and other punctuation and
+// extra whitespace are collapsed.
+func normalize(s string) string {
+	if norm, err := db.Normalize(s); err == nil {
+		s = norm
+	}
+	s = strings.ReplaceAll(s, "&", " and ")
+	s = strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsNumber(r) || unicode.IsSpace(r) {
+			return r
+		}
+		if r == '\'' || r == '’' {
+			return -1
+		}
+		return ' '
+	}, s)
+	return strings.Join(strings.Fields(s), " ")
+}
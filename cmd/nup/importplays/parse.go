@@ -0,0 +1,178 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package importplays
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// entry describes a single play from another service's export.
+type entry struct {
+	Artist string
+	Title  string
+	Album  string
+	Start  time.Time // start of playback
+}
+
+func (e *entry) String() string {
+	return fmt.Sprintf("%s - %s (%s) at %s", e.Artist, e.Title, e.Album, e.Start.Format(time.RFC3339))
+}
+
+// Layouts used for dates in Last.fm exports.
+var lastfmDateLayouts = []string{
+	"02 Jan 2006 15:04", // used by lastfm-to-csv
+	"2 Jan 2006, 15:04", // used by Last.fm's own web export
+	time.RFC3339,
+}
+
+// readLastfm reads Last.fm scrobbles from CSV data in r.
+//
+// Exports without a header row are assumed to contain "artist,album,title,date" columns.
+// If the first row contains "artist" and "track" or "title" columns, it is used to find the
+// artist, title, album, and timestamp ("uts", "utc_time", or "date") columns.
+// Timestamps without time zones are interpreted as UTC.
+func readLastfm(r io.Reader) ([]entry, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	cr.LazyQuotes = true
+	rows, err := cr.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, nil
+	}
+
+	artistCol, albumCol, titleCol, dateCol := 0, 1, 2, 3
+	if cols := lastfmHeader(rows[0]); cols != nil {
+		artistCol, titleCol = cols["artist"], cols["title"]
+		albumCol, dateCol = -1, -1
+		if i, ok := cols["album"]; ok {
+			albumCol = i
+		}
+		if i, ok := cols["date"]; ok {
+			dateCol = i
+		} else {
+			return nil, errors.New("no timestamp column in header")
+		}
+		rows = rows[1:]
+	}
+
+	entries := make([]entry, 0, len(rows))
+	for i, row := range rows {
+		get := func(col int) string {
+			if col < 0 || col >= len(row) {
+				return ""
+			}
+			return strings.TrimSpace(row[col])
+		}
+		e := entry{Artist: get(artistCol), Title: get(titleCol), Album: get(albumCol)}
+		if e.Start, err = parseLastfmDate(get(dateCol)); err != nil {
+			return nil, fmt.Errorf("row %d: %v", i+1, err)
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// lastfmHeader returns a map from "artist", "title", "album", and "date" to the corresponding
+// column indexes in row. nil is returned if row doesn't look like a header.
+func lastfmHeader(row []string) map[string]int {
+	cols := make(map[string]int)
+	for i, v := range row {
+		switch name := strings.ToLower(strings.TrimSpace(v)); name {
+		case "artist":
+			cols["artist"] = i
+		case "track", "title":
+			cols["title"] = i
+		case "album":
+			cols["album"] = i
+		case "uts", "utc_time", "date":
+			// Prefer the numeric timestamp if multiple columns are present.
+			if _, ok := cols["date"]; !ok || name == "uts" {
+				cols["date"] = i
+			}
+		}
+	}
+	_, hasArtist := cols["artist"]
+	_, hasTitle := cols["title"]
+	if !hasArtist || !hasTitle {
+		return nil
+	}
+	return cols
+}
+
+// parseLastfmDate parses a timestamp from a Last.fm export.
+func parseLastfmDate(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, errors.New("missing timestamp")
+	}
+	if sec, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(sec, 0).UTC(), nil
+	}
+	for _, layout := range lastfmDateLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t.UTC(), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("bad timestamp %q", s)
+}
+
+// spotifyStream is an object from Spotify's extended streaming history JSON files.
+type spotifyStream struct {
+	// TS contains the time at which the stream ended as an RFC 3339 string.
+	TS string `json:"ts"`
+	// MSPlayed contains the number of milliseconds that were played.
+	MSPlayed int64 `json:"ms_played"`
+	// Track, Artist, and Album describe the played song. They are null for
+	// podcast episodes and audiobooks.
+	Track  *string `json:"master_metadata_track_name"`
+	Artist *string `json:"master_metadata_album_artist_name"`
+	Album  *string `json:"master_metadata_album_album_name"`
+}
+
+// readSpotify reads streams from Spotify extended streaming history JSON data in r.
+// Streams shorter than minPlayed and streams of non-music content are skipped.
+func readSpotify(r io.Reader, minPlayed time.Duration) ([]entry, error) {
+	var streams []spotifyStream
+	if err := json.NewDecoder(r).Decode(&streams); err != nil {
+		return nil, err
+	}
+	str := func(p *string) string {
+		if p == nil {
+			return ""
+		}
+		return strings.TrimSpace(*p)
+	}
+
+	entries := make([]entry, 0, len(streams))
+	for i, st := range streams {
+		if st.Track == nil || st.Artist == nil {
+			continue
+		}
+		played := time.Duration(st.MSPlayed) * time.Millisecond
+		if played < minPlayed {
+			continue
+		}
+		end, err := time.Parse(time.RFC3339, st.TS)
+		if err != nil {
+			return nil, fmt.Errorf("stream %d: bad timestamp %q", i, st.TS)
+		}
+		entries = append(entries, entry{
+			Artist: str(st.Artist),
+			Title:  str(st.Track),
+			Album:  str(st.Album),
+			// Truncate to seconds so repeated imports produce identical plays.
+			Start: end.Add(-played).Truncate(time.Second).UTC(),
+		})
+	}
+	return entries, nil
+}
@@ -0,0 +1,69 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+// Package loudness uses the ffmpeg program to measure songs' EBU R128 loudness.
+package loudness
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// Info describes a song's loudness as measured by ffmpeg's loudnorm filter.
+type Info struct {
+	// Integrated contains the song's integrated loudness in LUFS.
+	Integrated float64
+	// TruePeak contains the song's true peak level in dBTP.
+	TruePeak float64
+}
+
+// Measure uses ffmpeg's loudnorm filter to measure the loudness of the audio file at p.
+func Measure(p string) (Info, error) {
+	cmd := exec.Command("ffmpeg", "-nostdin", "-hide_banner", "-nostats", "-i", p,
+		"-af", "loudnorm=print_format=json", "-f", "null", "-")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return Info{}, fmt.Errorf("ffmpeg failed: %v", err)
+	}
+	return parseOutput(string(out))
+}
+
+// parseOutput parses the JSON object that ffmpeg's loudnorm filter writes at the end of out.
+func parseOutput(out string) (Info, error) {
+	start := strings.LastIndex(out, "{")
+	end := strings.LastIndex(out, "}")
+	if start < 0 || end < start {
+		return Info{}, errors.New("didn't find loudnorm output")
+	}
+	// All of the values are reported as strings.
+	var vals struct {
+		InputI  string `json:"input_i"`
+		InputTP string `json:"input_tp"`
+	}
+	if err := json.Unmarshal([]byte(out[start:end+1]), &vals); err != nil {
+		return Info{}, fmt.Errorf("bad loudnorm output: %v", err)
+	}
+
+	var info Info
+	for _, v := range []struct {
+		s   string
+		dst *float64
+	}{
+		{vals.InputI, &info.Integrated},
+		{vals.InputTP, &info.TruePeak},
+	} {
+		var err error
+		if *v.dst, err = strconv.ParseFloat(v.s, 64); err != nil {
+			return Info{}, fmt.Errorf("bad loudnorm value %q", v.s)
+		}
+	}
+	// Silent files are reported as having -inf loudness.
+	if info.Integrated < -99 {
+		return Info{}, errors.New("audio is silent")
+	}
+	return info, nil
+}
@@ -0,0 +1,41 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package loudness
+
+import "testing"
+
+func TestParseOutput(t *testing.T) {
+	const out = `Input #0, mp3, from 'song.mp3':
+  Duration: 00:03:12.04, start: 0.025057, bitrate: 320 kb/s
+[Parsed_loudnorm_0 @ 0x55d5c8a4b2c0]
+{
+	"input_i" : "-9.87",
+	"input_tp" : "0.42",
+	"input_lra" : "5.30",
+	"input_thresh" : "-19.96",
+	"output_i" : "-23.61",
+	"output_tp" : "-2.00",
+	"output_lra" : "4.80",
+	"output_thresh" : "-33.66",
+	"normalization_type" : "dynamic",
+	"target_offset" : "-0.39"
+}
+`
+	if got, err := parseOutput(out); err != nil {
+		t.Error("parseOutput failed:", err)
+	} else if want := (Info{Integrated: -9.87, TruePeak: 0.42}); got != want {
+		t.Errorf("parseOutput returned %+v; want %+v", got, want)
+	}
+
+	for _, bad := range []string{
+		"",
+		"garbage",
+		`{"input_i" : "-9.87"}`,
+		`{"input_i" : "-inf", "input_tp" : "-inf"}`,
+	} {
+		if _, err := parseOutput(bad); err == nil {
+			t.Errorf("parseOutput(%q) unexpectedly succeeded", bad)
+		}
+	}
+}
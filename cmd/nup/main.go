@@ -10,16 +10,24 @@ import (
 	"os"
 	"path/filepath"
 
+	"github.com/derat/nup/cmd/nup/backup"
 	"github.com/derat/nup/cmd/nup/check"
 	"github.com/derat/nup/cmd/nup/client"
 	"github.com/derat/nup/cmd/nup/config"
 	"github.com/derat/nup/cmd/nup/covers"
 	"github.com/derat/nup/cmd/nup/debug"
 	"github.com/derat/nup/cmd/nup/dump"
+	"github.com/derat/nup/cmd/nup/fix"
+	"github.com/derat/nup/cmd/nup/importplays"
 	"github.com/derat/nup/cmd/nup/metadata"
 	"github.com/derat/nup/cmd/nup/query"
+	"github.com/derat/nup/cmd/nup/report"
 	"github.com/derat/nup/cmd/nup/storage"
+	"github.com/derat/nup/cmd/nup/tags"
+	"github.com/derat/nup/cmd/nup/token"
+	"github.com/derat/nup/cmd/nup/trash"
 	"github.com/derat/nup/cmd/nup/update"
+	"github.com/derat/nup/cmd/nup/writeback"
 	"github.com/google/subcommands"
 )
 
@@ -33,16 +41,25 @@ func main() {
 	subcommands.Register(subcommands.HelpCommand(), "")
 
 	var cfg client.Config
+	subcommands.Register(&backup.Command{Cfg: &cfg}, "")
 	subcommands.Register(&check.Command{Cfg: &cfg}, "")
 	subcommands.Register(&config.Command{Cfg: &cfg}, "")
 	subcommands.Register(&covers.Command{Cfg: &cfg}, "")
 	subcommands.Register(&debug.Command{Cfg: &cfg}, "")
 	subcommands.Register(&dump.Command{Cfg: &cfg}, "")
+	subcommands.Register(&fix.Command{Cfg: &cfg}, "")
+	subcommands.Register(&importplays.Command{Cfg: &cfg}, "")
 	subcommands.Register(&metadata.Command{Cfg: &cfg}, "")
 	subcommands.Register(&projectidCommand{cfg: &cfg}, "")
 	subcommands.Register(&query.Command{Cfg: &cfg}, "")
+	subcommands.Register(&report.Command{Cfg: &cfg}, "")
+	subcommands.Register(&backup.RestoreCommand{Cfg: &cfg}, "")
 	subcommands.Register(&storage.Command{Cfg: &cfg}, "")
+	subcommands.Register(&tags.Command{Cfg: &cfg}, "")
+	subcommands.Register(&token.Command{Cfg: &cfg}, "")
+	subcommands.Register(&trash.Command{Cfg: &cfg}, "")
 	subcommands.Register(&update.Command{Cfg: &cfg}, "")
+	subcommands.Register(&writeback.Command{Cfg: &cfg}, "")
 
 	flag.Parse()
 
@@ -105,21 +105,30 @@ func (cmd *Command) doPrint(args []string) subcommands.ExitStatus {
 		}
 		// Use a custom struct instead of db.Song so we can choose which fields get printed.
 		enc.Encode(struct {
-			SHA1            string  `json:"sha1,omitempty"`
-			Filename        string  `json:"filename"`
-			Artist          string  `json:"artist"`
-			Title           string  `json:"title"`
-			Album           string  `json:"album"`
-			AlbumArtist     string  `json:"albumArtist"`
-			DiscSubtitle    string  `json:"discSubtitle"`
-			AlbumID         string  `json:"albumId"`
-			OrigAlbumID     string  `json:"origAlbumId"`
-			RecordingID     string  `json:"recordingId"`
-			OrigRecordingID string  `json:"origRecordingId"`
-			Track           int     `json:"track"`
-			Disc            int     `json:"disc"`
-			Date            string  `json:"date"`
-			Length          float64 `json:"length,omitempty"`
+			SHA1            string   `json:"sha1,omitempty"`
+			Filename        string   `json:"filename"`
+			Artist          string   `json:"artist"`
+			Title           string   `json:"title"`
+			Album           string   `json:"album"`
+			AlbumArtist     string   `json:"albumArtist"`
+			Composer        string   `json:"composer"`
+			Conductor       string   `json:"conductor"`
+			Performer       string   `json:"performer"`
+			DiscSubtitle    string   `json:"discSubtitle"`
+			Genres          []string `json:"genres"`
+			Compilation     bool     `json:"compilation"`
+			AlbumID         string   `json:"albumId"`
+			OrigAlbumID     string   `json:"origAlbumId"`
+			RecordingID     string   `json:"recordingId"`
+			OrigRecordingID string   `json:"origRecordingId"`
+			Track           int      `json:"track"`
+			Disc            int      `json:"disc"`
+			TotalTracks     int      `json:"totalTracks"`
+			TotalDiscs      int      `json:"totalDiscs"`
+			Date            string   `json:"date"`
+			Length          float64  `json:"length,omitempty"`
+			BPM             float64  `json:"bpm,omitempty"`
+			Key             string   `json:"key,omitempty"`
 		}{
 			SHA1:            s.SHA1,
 			Filename:        s.Filename,
@@ -127,15 +136,24 @@ func (cmd *Command) doPrint(args []string) subcommands.ExitStatus {
 			Title:           s.Title,
 			Album:           s.Album,
 			AlbumArtist:     s.AlbumArtist,
+			Composer:        s.Composer,
+			Conductor:       s.Conductor,
+			Performer:       s.Performer,
 			DiscSubtitle:    s.DiscSubtitle,
+			Genres:          s.Genres,
+			Compilation:     s.Compilation,
 			AlbumID:         s.AlbumID,
 			OrigAlbumID:     s.OrigAlbumID,
 			RecordingID:     s.RecordingID,
 			OrigRecordingID: s.OrigRecordingID,
 			Track:           s.Track,
 			Disc:            s.Disc,
+			TotalTracks:     s.TotalTracks,
+			TotalDiscs:      s.TotalDiscs,
 			Date:            date,
 			Length:          s.Length,
+			BPM:             s.BPM,
+			Key:             s.Key,
 		})
 	}
 	return subcommands.ExitSuccess
@@ -94,8 +94,18 @@ func TestScanSong_Release(t *testing.T) {
 	want := song
 	want.Title = "New Title"
 	want.Artist = "Artist A feat. B & C"
+	want.ArtistCredits = []db.ArtistCredit{
+		{Name: "Artist A", MBID: "a1b2c3d4-0000-4000-8000-000000000001", JoinPhrase: " feat. "},
+		{Name: "B", JoinPhrase: " & "},
+		{Name: "C"},
+	}
+	want.ArtistSortName = "A, Artist feat. B & C"
 	want.Album = "New Album"
 	want.AlbumArtist = "Artist A"
+	want.AlbumArtistSortName = "A, Artist"
+	want.Composer = "Composer X"
+	want.Conductor = "Conductor Y"
+	want.Performer = "Player 1, Player 2"
 	want.DiscSubtitle = "The Third Disc"
 	want.AlbumID = "5109de80-7946-41ea-9060-05d10da87219"
 	want.RecordingID = "4b834e6e-a694-4cbe-a715-f5b0e36c57e2"
@@ -103,7 +113,12 @@ func TestScanSong_Release(t *testing.T) {
 	want.OrigRecordingID = song.RecordingID
 	want.Track = 4
 	want.Disc = 3
+	want.TotalTracks = 4
+	want.TotalDiscs = 3
 	want.Date = time.Date(2020, 6, 7, 0, 0, 0, 0, time.UTC)
+	want.OriginalDate = want.Date
+	want.ReleaseDate = time.Date(2021, 3, 4, 0, 0, 0, 0, time.UTC) // reissue
+	want.Genres = []string{"pop", "rock"}
 
 	want.SHA1 = ""
 	want.Length = 0
@@ -113,7 +128,7 @@ func TestScanSong_Release(t *testing.T) {
 
 	env.releases[song.AlbumID] = release{
 		Title:   want.Album,
-		Artists: []artistCredit{{Name: "Artist A"}},
+		Artists: []artistCredit{{Name: "Artist A", Artist: artist{SortName: "A, Artist"}}},
 		ID:      want.AlbumID,
 		Media: []medium{
 			{Position: 1},
@@ -128,17 +143,31 @@ func TestScanSong_Release(t *testing.T) {
 					{
 						Title: want.Title,
 						Artists: []artistCredit{
-							{Name: "Artist A", JoinPhrase: " feat. "},
+							{Name: "Artist A", JoinPhrase: " feat. ",
+								Artist: artist{ID: want.ArtistCredits[0].MBID, SortName: "A, Artist"}},
 							{Name: "B", JoinPhrase: " & "},
 							{Name: "C"},
 						},
-						Recording: recording{ID: want.RecordingID},
-						Position:  4,
+						Recording: recording{
+							ID: want.RecordingID,
+							Relations: []relation{
+								{Type: "performance", Work: &work{
+									Relations: []relation{{Type: "composer", Artist: &artist{Name: "Composer X"}}},
+								}},
+								{Type: "conductor", Artist: &artist{Name: "Conductor Y"}},
+								{Type: "instrument", Artist: &artist{Name: "Player 1"}},
+								{Type: "vocal", Artist: &artist{Name: "Player 2"}},
+								{Type: "producer", Artist: &artist{Name: "Producer Z"}},
+							},
+						},
+						Position: 4,
 					},
 				},
 			},
 		},
 		ReleaseGroup: releaseGroup{FirstReleaseDate: date(want.Date)},
+		Date:         date(want.ReleaseDate),
+		Genres:       []genre{{Name: "rock", Count: 2}, {Name: "pop", Count: 5}},
 	}
 	env.recordings[song.RecordingID] = recording{ID: want.RecordingID}
 
@@ -250,7 +279,12 @@ func TestSetAlbum(t *testing.T) {
 				return
 			}
 			for _, s := range tc.want {
-				s.AlbumID = tc.rel.ID // set for diff
+				// Set for diff.
+				s.AlbumID = tc.rel.ID
+				if _, med := tc.rel.findTrack(s.RecordingID); med != nil {
+					s.TotalTracks = len(med.Tracks)
+				}
+				s.TotalDiscs = len(tc.rel.Media)
 			}
 			if diff := cmp.Diff(got, tc.want); diff != "" {
 				t.Error("setAlbum returned wrong results:\n" + diff)
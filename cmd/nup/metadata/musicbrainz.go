@@ -9,6 +9,8 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/derat/nup/cmd/nup/client/files"
@@ -118,7 +120,8 @@ func (api *api) getRelease(ctx context.Context, mbid string) (*release, error) {
 	}
 	api.lastRelMBID = mbid
 	api.lastRel = &release{}
-	api.lastRelErr = api.send(ctx, "/ws/2/release/"+mbid+"?inc=artist-credits+recordings+release-groups&fmt=json", api.lastRel)
+	api.lastRelErr = api.send(ctx, "/ws/2/release/"+mbid+"?inc=artist-credits+recordings+release-groups+genres"+
+		"+recording-level-rels+work-level-rels+artist-rels+work-rels&fmt=json", api.lastRel)
 	return api.lastRel, api.lastRelErr
 }
 
@@ -126,7 +129,7 @@ func (api *api) getRelease(ctx context.Context, mbid string) (*release, error) {
 // This should only be used for standalone recordings that aren't included in releases.
 func (api *api) getRecording(ctx context.Context, mbid string) (*recording, error) {
 	var rec recording
-	err := api.send(ctx, "/ws/2/recording/"+mbid+"?inc=artist-credits&fmt=json", &rec)
+	err := api.send(ctx, "/ws/2/recording/"+mbid+"?inc=artist-credits+artist-rels+work-rels+work-level-rels+genres&fmt=json", &rec)
 	return &rec, err
 }
 
@@ -137,6 +140,7 @@ type release struct {
 	Media        []medium       `json:"media"`
 	ReleaseGroup releaseGroup   `json:"release-group"`
 	Date         date           `json:"date"`
+	Genres       []genre        `json:"genres"`
 }
 
 func (rel *release) findTrack(recID string) (*track, *medium) {
@@ -178,6 +182,7 @@ type releaseGroup struct {
 type artistCredit struct {
 	Name       string `json:"name"`
 	JoinPhrase string `json:"joinphrase"`
+	Artist     artist `json:"artist"`
 }
 
 func joinArtistCredits(acs []artistCredit) string {
@@ -188,6 +193,36 @@ func joinArtistCredits(acs []artistCredit) string {
 	return s
 }
 
+// joinArtistSortNames is like joinArtistCredits but uses the artists' sort names
+// (e.g. "Beatles, The") when available. An empty string is returned if the result
+// is the same as joinArtistCredits's.
+func joinArtistSortNames(acs []artistCredit) string {
+	var s string
+	for _, ac := range acs {
+		name := ac.Artist.SortName
+		if name == "" {
+			name = ac.Name
+		}
+		s += name + ac.JoinPhrase
+	}
+	if s == joinArtistCredits(acs) {
+		return ""
+	}
+	return s
+}
+
+// songArtistCredits converts acs to the representation used by db.Song.
+func songArtistCredits(acs []artistCredit) []db.ArtistCredit {
+	if len(acs) == 0 {
+		return nil
+	}
+	credits := make([]db.ArtistCredit, len(acs))
+	for i, ac := range acs {
+		credits[i] = db.ArtistCredit{Name: ac.Name, MBID: ac.Artist.ID, JoinPhrase: ac.JoinPhrase}
+	}
+	return credits
+}
+
 type medium struct {
 	Title    string  `json:"title"`
 	Position int     `json:"position"`
@@ -209,6 +244,107 @@ type recording struct {
 	ID               string         `json:"id"`
 	Length           int64          `json:"length"` // milliseconds
 	FirstReleaseDate date           `json:"first-release-date"`
+	Relations        []relation     `json:"relations"`
+	Genres           []genre        `json:"genres"`
+}
+
+// credits returns the composers, conductors, and performers listed in rec's relationships.
+// Composers are taken from the relationships of works that the recording is a performance of.
+func (rec *recording) credits() (composers, conductors, performers []string) {
+	for _, rel := range rec.Relations {
+		switch {
+		case rel.Work != nil && rel.Type == "performance":
+			for _, wr := range rel.Work.Relations {
+				if wr.Artist != nil && wr.Type == "composer" {
+					composers = appendUnique(composers, wr.Artist.Name)
+				}
+			}
+		case rel.Artist == nil:
+			continue
+		case rel.Type == "conductor":
+			conductors = appendUnique(conductors, rel.Artist.Name)
+		case rel.Type == "performer" || rel.Type == "instrument" || rel.Type == "vocal" ||
+			rel.Type == "performing orchestra":
+			performers = appendUnique(performers, rel.Artist.Name)
+		}
+	}
+	return composers, conductors, performers
+}
+
+// appendUnique appends s to vals if it isn't already present.
+func appendUnique(vals []string, s string) []string {
+	for _, v := range vals {
+		if v == s {
+			return vals
+		}
+	}
+	return append(vals, s)
+}
+
+// relation describes a relationship between a recording or work and another entity.
+// See https://musicbrainz.org/doc/Relationships.
+type relation struct {
+	Type   string  `json:"type"`
+	Artist *artist `json:"artist"`
+	Work   *work   `json:"work"`
+}
+
+type artist struct {
+	Name     string `json:"name"`
+	SortName string `json:"sort-name"`
+	ID       string `json:"id"`
+}
+
+type work struct {
+	Title     string     `json:"title"`
+	ID        string     `json:"id"`
+	Relations []relation `json:"relations"`
+}
+
+// genre describes a genre that has been applied to an entity.
+// See https://musicbrainz.org/doc/Genre.
+type genre struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"` // number of votes
+}
+
+// genreNames returns the names of genres in descending order by vote count.
+func genreNames(genres []genre) []string {
+	sorted := append([]genre{}, genres...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Count > sorted[j].Count })
+	names := make([]string, len(sorted))
+	for i, g := range sorted {
+		names[i] = g.Name
+	}
+	return names
+}
+
+// updateSongGenres sets song's Genres field using the first non-empty list in genres.
+// The field is left unchanged if MusicBrainz doesn't list any genres so that values
+// from the song's tag aren't discarded.
+func updateSongGenres(song *db.Song, genres ...[]genre) {
+	for _, gs := range genres {
+		if len(gs) > 0 {
+			song.Genres = genreNames(gs)
+			return
+		}
+	}
+}
+
+// updateSongCredits sets song's Composer, Conductor, and Performer fields using
+// rec's relationships. Fields are left unchanged if MusicBrainz doesn't list any
+// corresponding artists so that values from the song's tag aren't discarded.
+func updateSongCredits(song *db.Song, rec *recording) {
+	composers, conductors, performers := rec.credits()
+	if len(composers) > 0 {
+		song.Composer = strings.Join(composers, ", ")
+	}
+	if len(conductors) > 0 {
+		song.Conductor = strings.Join(conductors, ", ")
+	}
+	if len(performers) > 0 {
+		song.Performer = strings.Join(performers, ", ")
+	}
 }
 
 // date unmarshals a date provided as a JSON string like "2020-10-23".
@@ -252,21 +388,36 @@ func updateSongFromRelease(song *db.Song, rel *release) bool {
 	}
 
 	song.Artist = joinArtistCredits(tr.Artists)
+	song.ArtistCredits = songArtistCredits(tr.Artists)
+	song.ArtistSortName = joinArtistSortNames(tr.Artists)
 	song.Title = tr.Title
+	if song.Album != rel.Title {
+		song.AlbumSortName = "" // MusicBrainz doesn't supply sort names for releases
+	}
 	song.Album = rel.Title
 	song.DiscSubtitle = med.Title
 	song.AlbumID = rel.ID
 	song.Track = tr.Position
 	song.Disc = med.Position
+	song.TotalTracks = len(med.Tracks)
+	song.TotalDiscs = len(rel.Media)
 	song.Date = time.Time(rel.ReleaseGroup.FirstReleaseDate)
+	song.OriginalDate = time.Time(rel.ReleaseGroup.FirstReleaseDate)
+	song.ReleaseDate = time.Time(rel.Date)
 
 	// Only set the album artist if it differs from the song artist or if it was previously set.
 	// Otherwise we're creating needless churn, since the update command won't send it to the server
 	// if it's the same as the song artist.
 	if aa := joinArtistCredits(rel.Artists); aa != song.Artist || song.AlbumArtist != "" {
 		song.AlbumArtist = aa
+		song.AlbumArtistSortName = joinArtistSortNames(rel.Artists)
+	} else {
+		song.AlbumArtistSortName = "" // ArtistSortName is used instead
 	}
 
+	updateSongCredits(song, &tr.Recording)
+	updateSongGenres(song, tr.Recording.Genres, rel.Genres)
+
 	return true
 }
 
@@ -274,8 +425,14 @@ func updateSongFromRelease(song *db.Song, rel *release) bool {
 // This should only be used for standalone recordings.
 func updateSongFromRecording(song *db.Song, rec *recording) {
 	song.Artist = joinArtistCredits(rec.Artists)
+	song.ArtistCredits = songArtistCredits(rec.Artists)
+	song.ArtistSortName = joinArtistSortNames(rec.Artists)
 	song.Title = rec.Title
 	song.Album = files.NonAlbumTracksValue
+	song.AlbumSortName = ""
 	song.AlbumID = ""
 	song.Date = time.Time(rec.FirstReleaseDate) // always zero?
+	song.OriginalDate = time.Time(rec.FirstReleaseDate)
+	updateSongCredits(song, rec)
+	updateSongGenres(song, rec.Genres)
 }
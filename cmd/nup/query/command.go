@@ -127,6 +127,6 @@ func (cmd *Command) makeRequest(ctx context.Context) (*http.Request, error) {
 	if err != nil {
 		return nil, err
 	}
-	req.SetBasicAuth(cmd.Cfg.Username, cmd.Cfg.Password)
+	cmd.Cfg.SetAuth(req)
 	return req, nil
 }
@@ -0,0 +1,82 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package report
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/derat/nup/cmd/nup/client"
+	"github.com/derat/nup/server/db"
+	"github.com/google/subcommands"
+)
+
+const defaultMaxItems = 10
+
+type Command struct {
+	Cfg      *client.Config
+	year     int    // year to summarize
+	user     string // user whose plays should be included
+	html     bool   // write HTML instead of JSON
+	maxItems int    // maximum items in each list
+}
+
+func (*Command) Name() string     { return "report" }
+func (*Command) Synopsis() string { return "generate year-in-review report" }
+func (*Command) Usage() string {
+	return `report <flags>:
+	Summarize a year of listening using dumped songs (including plays)
+	read from stdin. The report includes the top songs, artists, and albums,
+	newly-discovered artists, total listening time, and the longest streak of
+	consecutive days with plays. Dates are computed in the local time zone.
+
+`
+}
+
+func (cmd *Command) SetFlags(f *flag.FlagSet) {
+	f.IntVar(&cmd.year, "year", time.Now().Year()-1, "Year to summarize")
+	f.StringVar(&cmd.user, "user", "", "Only include plays by this user (default all users)")
+	f.BoolVar(&cmd.html, "html", false, "Write an HTML page instead of JSON")
+	f.IntVar(&cmd.maxItems, "max", defaultMaxItems, "Maximum number of songs, artists, or albums in each list")
+}
+
+func (cmd *Command) Execute(ctx context.Context, _ *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+	if cmd.maxItems <= 0 {
+		fmt.Fprintln(os.Stderr, "-max must be positive")
+		return subcommands.ExitUsageError
+	}
+
+	d := json.NewDecoder(os.Stdin)
+	songs := make([]*db.Song, 0)
+	for {
+		var s db.Song
+		if err := d.Decode(&s); err == io.EOF {
+			break
+		} else if err != nil {
+			fmt.Fprintln(os.Stderr, "Failed reading song:", err)
+			return subcommands.ExitFailure
+		}
+		songs = append(songs, &s)
+	}
+
+	rep := Generate(songs, cmd.year, cmd.user, time.Local, cmd.maxItems)
+	var err error
+	if cmd.html {
+		err = WriteHTML(os.Stdout, rep)
+	} else {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(rep)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed writing report:", err)
+		return subcommands.ExitFailure
+	}
+	return subcommands.ExitSuccess
+}
@@ -0,0 +1,120 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package report
+
+import (
+	"fmt"
+	"html/template"
+	"io"
+)
+
+// WriteHTML writes rep to w as a standalone HTML page.
+func WriteHTML(w io.Writer, rep *Report) error {
+	return htmlTemplate.Execute(w, rep)
+}
+
+// formatHours formats sec as a number of hours.
+func formatHours(sec float64) string {
+	return fmt.Sprintf("%.1f", sec/3600)
+}
+
+var htmlTemplate = template.Must(template.New("report").Funcs(template.FuncMap{
+	"hours": formatHours,
+}).Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Year}} in review{{with .User}} for {{.}}{{end}}</title>
+<style>
+  body {
+    font-family: sans-serif;
+    margin: 2em auto;
+    max-width: 40em;
+    padding: 0 1em;
+  }
+  .summary {
+    display: flex;
+    flex-wrap: wrap;
+    gap: 1em 2em;
+  }
+  .summary div {
+    font-size: 90%;
+  }
+  .summary span {
+    display: block;
+    font-size: 200%;
+    font-weight: bold;
+  }
+  table {
+    border-collapse: collapse;
+    width: 100%;
+  }
+  th, td {
+    padding: 2px 4px;
+    text-align: left;
+  }
+  th.num, td.num {
+    text-align: right;
+  }
+  tr:nth-child(even) {
+    background-color: #f4f4f4;
+  }
+</style>
+</head>
+<body>
+<h1>{{.Year}} in review{{with .User}} for {{.}}{{end}}</h1>
+
+<div class="summary">
+  <div><span>{{.Plays}}</span>plays</div>
+  <div><span>{{hours .TotalSec}}</span>hours</div>
+  <div><span>{{.Songs}}</span>songs ({{.NewSongs}} new)</div>
+  <div><span>{{.Artists}}</span>artists ({{.NewArtists}} new)</div>
+  <div><span>{{.Albums}}</span>albums</div>
+  <div><span>{{.LongestStreak.Days}}</span>day streak
+    {{- if .LongestStreak.Days}} ({{.LongestStreak.Start}} to {{.LongestStreak.End}}){{end}}</div>
+</div>
+
+{{with .TopSongs}}
+<h2>Top songs</h2>
+<table>
+  <tr><th>Title</th><th>Artist</th><th class="num">Plays</th></tr>
+  {{- range .}}
+  <tr><td>{{.Title}}</td><td>{{.Artist}}</td><td class="num">{{.Plays}}</td></tr>
+  {{- end}}
+</table>
+{{end}}
+
+{{with .TopArtists}}
+<h2>Top artists</h2>
+<table>
+  <tr><th>Artist</th><th class="num">Plays</th><th class="num">Hours</th></tr>
+  {{- range .}}
+  <tr><td>{{.Artist}}</td><td class="num">{{.Plays}}</td><td class="num">{{hours .TotalSec}}</td></tr>
+  {{- end}}
+</table>
+{{end}}
+
+{{with .TopAlbums}}
+<h2>Top albums</h2>
+<table>
+  <tr><th>Album</th><th>Artist</th><th class="num">Plays</th></tr>
+  {{- range .}}
+  <tr><td>{{.Album}}</td><td>{{.Artist}}</td><td class="num">{{.Plays}}</td></tr>
+  {{- end}}
+</table>
+{{end}}
+
+{{with .TopNewArtists}}
+<h2>New discoveries</h2>
+<table>
+  <tr><th>Artist</th><th class="num">Plays</th><th class="num">Hours</th></tr>
+  {{- range .}}
+  <tr><td>{{.Artist}}</td><td class="num">{{.Plays}}</td><td class="num">{{hours .TotalSec}}</td></tr>
+  {{- end}}
+</table>
+{{end}}
+</body>
+</html>
+`))
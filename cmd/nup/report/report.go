@@ -0,0 +1,234 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package report
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/derat/nup/server/db"
+)
+
+const dateLayout = "2006-01-02" // layout for dates in Streak
+
+// Report summarizes a year of listening.
+type Report struct {
+	// Year is the year covered by the report.
+	Year int `json:"year"`
+	// User is the user whose plays are included. If empty, all plays are included.
+	User string `json:"user,omitempty"`
+	// Plays is the total number of plays.
+	Plays int `json:"plays"`
+	// TotalSec is the total duration in seconds of played songs.
+	TotalSec float64 `json:"totalSec"`
+	// Songs, Artists, and Albums contain the number of distinct songs, artists, and albums
+	// that were played.
+	Songs   int `json:"songs"`
+	Artists int `json:"artists"`
+	Albums  int `json:"albums"`
+	// TopSongs, TopArtists, and TopAlbums contain the most-played songs, artists, and albums,
+	// sorted by descending play count.
+	TopSongs   []Item `json:"topSongs"`
+	TopArtists []Item `json:"topArtists"`
+	TopAlbums  []Item `json:"topAlbums"`
+	// NewSongs and NewArtists contain the number of songs and artists that were first played
+	// during the year.
+	NewSongs   int `json:"newSongs"`
+	NewArtists int `json:"newArtists"`
+	// TopNewArtists contains the most-played artists that were first played during the year.
+	TopNewArtists []Item `json:"topNewArtists"`
+	// LongestStreak describes the longest run of consecutive days with plays.
+	LongestStreak Streak `json:"longestStreak"`
+}
+
+// Item describes plays of a song, artist, or album.
+type Item struct {
+	Artist   string  `json:"artist"`
+	Title    string  `json:"title,omitempty"`
+	Album    string  `json:"album,omitempty"`
+	AlbumID  string  `json:"albumId,omitempty"`
+	Plays    int     `json:"plays"`
+	TotalSec float64 `json:"totalSec"`
+}
+
+// Streak describes a run of consecutive days with plays.
+type Streak struct {
+	// Days contains the number of days in the streak.
+	Days int `json:"days"`
+	// Start and End contain the first and last days of the streak as "YYYY-MM-DD".
+	Start string `json:"start,omitempty"`
+	End   string `json:"end,omitempty"`
+}
+
+// itemCount accumulates plays of a song, artist, or album.
+type itemCount struct {
+	item  Item
+	first time.Time // first play across all years
+}
+
+// add adds a play of s at t to c. inYear is true if the play was during the report's year.
+func (c *itemCount) add(s *db.Song, t time.Time, inYear bool) {
+	if inYear {
+		c.item.Plays++
+		c.item.TotalSec += s.Length
+	}
+	if c.first.IsZero() || t.Before(c.first) {
+		c.first = t
+	}
+}
+
+// Generate generates a report for year (in loc) from songs' plays.
+// If user is non-empty, only plays by the user are included. max specifies the
+// maximum number of items in each list.
+func Generate(songs []*db.Song, year int, user string, loc *time.Location, max int) *Report {
+	rep := Report{Year: year, User: user}
+	start := time.Date(year, 1, 1, 0, 0, 0, 0, loc)
+	end := start.AddDate(1, 0, 0)
+	inYear := func(t time.Time) bool { return !t.Before(start) && t.Before(end) }
+
+	songCounts := make(map[string]*itemCount)
+	artistCounts := make(map[string]*itemCount)
+	albumCounts := make(map[string]*itemCount)
+	get := func(m map[string]*itemCount, key string, item Item) *itemCount {
+		c := m[key]
+		if c == nil {
+			c = &itemCount{item: item}
+			m[key] = c
+		}
+		return c
+	}
+	days := make(map[string]struct{}) // dates with plays
+
+	for _, s := range songs {
+		artistKey := strings.ToLower(s.Artist)
+		albumKey := s.AlbumID
+		if albumKey == "" && s.Album != "" {
+			albumKey = strings.ToLower(s.Artist + "\n" + s.Album)
+		}
+		albumArtist := s.AlbumArtist
+		if albumArtist == "" {
+			albumArtist = s.Artist
+		}
+
+		for _, p := range s.Plays {
+			if user != "" && p.User != user {
+				continue
+			}
+			in := inYear(p.StartTime)
+			if in {
+				rep.Plays++
+				rep.TotalSec += s.Length
+				days[p.StartTime.In(loc).Format(dateLayout)] = struct{}{}
+			}
+			get(songCounts, s.SongID, Item{Artist: s.Artist, Title: s.Title, Album: s.Album}).
+				add(s, p.StartTime, in)
+			if artistKey != "" {
+				get(artistCounts, artistKey, Item{Artist: s.Artist}).add(s, p.StartTime, in)
+			}
+			if albumKey != "" {
+				get(albumCounts, albumKey, Item{Artist: albumArtist, Album: s.Album, AlbumID: s.AlbumID}).
+					add(s, p.StartTime, in)
+			}
+		}
+	}
+
+	var newArtists []*itemCount
+	for _, c := range songCounts {
+		if c.item.Plays > 0 {
+			rep.Songs++
+			if inYear(c.first) {
+				rep.NewSongs++
+			}
+		}
+	}
+	for _, c := range artistCounts {
+		if c.item.Plays > 0 {
+			rep.Artists++
+			if inYear(c.first) {
+				rep.NewArtists++
+				newArtists = append(newArtists, c)
+			}
+		}
+	}
+	for _, c := range albumCounts {
+		if c.item.Plays > 0 {
+			rep.Albums++
+		}
+	}
+
+	rep.TopSongs = topItems(countValues(songCounts), max)
+	rep.TopArtists = topItems(countValues(artistCounts), max)
+	rep.TopAlbums = topItems(countValues(albumCounts), max)
+	rep.TopNewArtists = topItems(newArtists, max)
+	rep.LongestStreak = longestStreak(days, loc)
+	return &rep
+}
+
+// countValues returns m's values.
+func countValues(m map[string]*itemCount) []*itemCount {
+	vals := make([]*itemCount, 0, len(m))
+	for _, c := range m {
+		vals = append(vals, c)
+	}
+	return vals
+}
+
+// topItems returns up to max items with plays from counts, sorted by descending play count.
+func topItems(counts []*itemCount, max int) []Item {
+	items := make([]Item, 0, len(counts))
+	for _, c := range counts {
+		if c.item.Plays > 0 {
+			items = append(items, c.item)
+		}
+	}
+	sort.Slice(items, func(i, j int) bool {
+		a, b := items[i], items[j]
+		if a.Plays != b.Plays {
+			return a.Plays > b.Plays
+		}
+		if a.TotalSec != b.TotalSec {
+			return a.TotalSec > b.TotalSec
+		}
+		if a.Artist != b.Artist {
+			return a.Artist < b.Artist
+		}
+		if a.Album != b.Album {
+			return a.Album < b.Album
+		}
+		return a.Title < b.Title
+	})
+	if len(items) > max {
+		items = items[:max]
+	}
+	return items
+}
+
+// longestStreak returns the longest run of consecutive dates (formatted using dateLayout) in days.
+// The earliest streak is returned in the case of ties.
+func longestStreak(days map[string]struct{}, loc *time.Location) Streak {
+	dates := make([]string, 0, len(days))
+	for d := range days {
+		dates = append(dates, d)
+	}
+	sort.Strings(dates)
+
+	var best, cur Streak
+	var last time.Time
+	for _, d := range dates {
+		t, _ := time.ParseInLocation(dateLayout, d, loc)
+		// Compare dates rather than durations to handle DST transitions.
+		if cur.Days > 0 && last.AddDate(0, 0, 1).Format(dateLayout) == d {
+			cur.Days++
+			cur.End = d
+		} else {
+			cur = Streak{Days: 1, Start: d, End: d}
+		}
+		if cur.Days > best.Days {
+			best = cur
+		}
+		last = t
+	}
+	return best
+}
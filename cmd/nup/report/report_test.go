@@ -0,0 +1,109 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package report
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/derat/nup/server/db"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestGenerate(t *testing.T) {
+	loc := time.UTC
+	date := func(y, m, d int) time.Time { return time.Date(y, time.Month(m), d, 12, 0, 0, 0, loc) }
+	play := func(t time.Time, user string) db.Play { return db.Play{StartTime: t, User: user} }
+
+	songs := []*db.Song{
+		{
+			SongID: "1", Artist: "Old Artist", Title: "Old Song", Album: "Old Album", AlbumID: "old",
+			Length: 100,
+			Plays: []db.Play{
+				play(date(2022, 12, 31), "me"),
+				play(date(2023, 1, 1), "me"),
+				play(date(2023, 1, 2), "me"),
+				play(date(2023, 1, 3), "other"), // other user
+			},
+		},
+		{
+			SongID: "2", Artist: "New Artist", Title: "New Song", Album: "New Album", AlbumID: "new",
+			Length: 200,
+			Plays: []db.Play{
+				play(date(2023, 3, 1), "me"),
+				play(date(2023, 3, 2), "me"),
+				play(date(2023, 3, 3), "me"),
+				play(date(2024, 1, 1), "me"), // next year
+			},
+		},
+		{
+			SongID: "3", Artist: "Old Artist", Title: "Another Song", Album: "Old Album", AlbumID: "old",
+			Length: 50,
+			Plays:  []db.Play{play(date(2023, 6, 1), "me")},
+		},
+		{
+			SongID: "4", Artist: "Unplayed", Title: "Unplayed", Length: 10,
+		},
+	}
+
+	got := Generate(songs, 2023, "me", loc, 2)
+	want := &Report{
+		Year:     2023,
+		User:     "me",
+		Plays:    6,
+		TotalSec: 100*2 + 200*3 + 50,
+		Songs:    3,
+		Artists:  2,
+		Albums:   2,
+		TopSongs: []Item{
+			{Artist: "New Artist", Title: "New Song", Album: "New Album", Plays: 3, TotalSec: 600},
+			{Artist: "Old Artist", Title: "Old Song", Album: "Old Album", Plays: 2, TotalSec: 200},
+		},
+		TopArtists: []Item{
+			{Artist: "New Artist", Plays: 3, TotalSec: 600},
+			{Artist: "Old Artist", Plays: 3, TotalSec: 250},
+		},
+		TopAlbums: []Item{
+			{Artist: "New Artist", Album: "New Album", AlbumID: "new", Plays: 3, TotalSec: 600},
+			{Artist: "Old Artist", Album: "Old Album", AlbumID: "old", Plays: 3, TotalSec: 250},
+		},
+		NewSongs:      2,
+		NewArtists:    1,
+		TopNewArtists: []Item{{Artist: "New Artist", Plays: 3, TotalSec: 600}},
+		LongestStreak: Streak{Days: 3, Start: "2023-03-01", End: "2023-03-03"},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Error("Bad report:\n" + diff)
+	}
+
+	var b bytes.Buffer
+	if err := WriteHTML(&b, got); err != nil {
+		t.Error("WriteHTML failed:", err)
+	} else if s := b.String(); !strings.Contains(s, "<td>New Artist</td>") {
+		t.Errorf("WriteHTML output doesn't contain new artist:\n%s", s)
+	}
+}
+
+func TestLongestStreak(t *testing.T) {
+	for _, tc := range []struct {
+		days []string
+		want Streak
+	}{
+		{nil, Streak{}},
+		{[]string{"2023-05-01"}, Streak{1, "2023-05-01", "2023-05-01"}},
+		{[]string{"2023-02-27", "2023-02-28", "2023-03-01", "2023-03-03"}, Streak{3, "2023-02-27", "2023-03-01"}},
+		{[]string{"2023-01-01", "2023-01-02", "2023-06-01", "2023-06-02"}, Streak{2, "2023-01-01", "2023-01-02"}},
+		{[]string{"2023-12-31", "2023-01-01"}, Streak{1, "2023-01-01", "2023-01-01"}},
+	} {
+		days := make(map[string]struct{})
+		for _, d := range tc.days {
+			days[d] = struct{}{}
+		}
+		if got := longestStreak(days, time.UTC); got != tc.want {
+			t.Errorf("longestStreak(%q) = %+v; want %+v", tc.days, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+// Package silence uses the ffmpeg program to find silence at the beginning and end of songs.
+package silence
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os/exec"
+	"strconv"
+)
+
+const (
+	// Audio is decoded to mono at a low sample rate to keep the pass over the file cheap.
+	// Millisecond precision is more than enough for trimming silence or scheduling crossfades.
+	sampleRate = 8000
+
+	// Samples with absolute amplitudes at or below this value (out of 32768)
+	// are considered silent. This is roughly -60 dBFS.
+	silenceThreshold = 33
+)
+
+// Info describes silence at the beginning and end of a song.
+type Info struct {
+	// Leading contains the duration in seconds of silence at the beginning of the song.
+	Leading float64
+	// Trailing contains the duration in seconds of silence at the end of the song.
+	Trailing float64
+}
+
+// Detect uses ffmpeg to decode the audio file at p and find leading and trailing silence.
+func Detect(p string) (Info, error) {
+	cmd := exec.Command("ffmpeg", "-nostdin", "-v", "error", "-i", p,
+		"-ac", "1", "-ar", strconv.Itoa(sampleRate), "-f", "s16le", "-")
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return Info{}, err
+	}
+	if err := cmd.Start(); err != nil {
+		return Info{}, fmt.Errorf("ffmpeg failed: %v", err)
+	}
+	info, readErr := analyze(stdout, sampleRate)
+	if err := cmd.Wait(); err != nil {
+		return Info{}, fmt.Errorf("ffmpeg failed: %v", err)
+	}
+	return info, readErr
+}
+
+// analyze reads signed 16-bit little-endian mono samples at the supplied rate
+// from r and returns the durations of leading and trailing silence.
+// Zero durations are returned if the audio is entirely silent, since trimming
+// the whole song is unlikely to be what anyone wants.
+func analyze(r io.Reader, rate int) (Info, error) {
+	br := bufio.NewReader(r)
+	var buf [2]byte
+	var n int64           // total samples read
+	first, last := -1, -1 // indexes of first and last non-silent samples
+	for {
+		if _, err := io.ReadFull(br, buf[:]); err == io.EOF {
+			break
+		} else if err != nil {
+			return Info{}, err
+		}
+		v := int16(binary.LittleEndian.Uint16(buf[:]))
+		if v > silenceThreshold || v < -silenceThreshold {
+			if first < 0 {
+				first = int(n)
+			}
+			last = int(n)
+		}
+		n++
+	}
+	if first < 0 {
+		return Info{}, nil
+	}
+	secs := func(samples int64) float64 {
+		return math.Round(float64(samples)/float64(rate)*1000) / 1000
+	}
+	return Info{
+		Leading:  secs(int64(first)),
+		Trailing: secs(n - 1 - int64(last)),
+	}, nil
+}
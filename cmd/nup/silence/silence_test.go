@@ -0,0 +1,56 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package silence
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func TestAnalyze(t *testing.T) {
+	const rate = 1000
+	samples := func(vals ...int16) []int16 { return vals }
+	repeat := func(v int16, n int) []int16 {
+		s := make([]int16, n)
+		for i := range s {
+			s[i] = v
+		}
+		return s
+	}
+	join := func(parts ...[]int16) []int16 {
+		var s []int16
+		for _, p := range parts {
+			s = append(s, p...)
+		}
+		return s
+	}
+
+	for _, tc := range []struct {
+		name string
+		data []int16
+		want Info
+	}{
+		{"empty", nil, Info{}},
+		{"silent", repeat(0, 2000), Info{}},
+		{"no silence", repeat(1000, 500), Info{}},
+		{"leading and trailing", join(repeat(0, 1500), repeat(-2000, 300), repeat(10, 250)), Info{1.5, 0.25}},
+		{"noise below threshold", join(repeat(-20, 100), samples(500), repeat(30, 42)), Info{0.1, 0.042}},
+	} {
+		var b bytes.Buffer
+		if err := binary.Write(&b, binary.LittleEndian, tc.data); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := analyze(&b, rate); err != nil {
+			t.Errorf("%v: analyze failed: %v", tc.name, err)
+		} else if got != tc.want {
+			t.Errorf("%v: analyze returned %+v; want %+v", tc.name, got, tc.want)
+		}
+	}
+
+	// A partial trailing sample should be reported as an error.
+	if _, err := analyze(bytes.NewReader([]byte{0, 0, 1}), rate); err == nil {
+		t.Error("analyze unexpectedly succeeded for truncated data")
+	}
+}
@@ -9,8 +9,8 @@ import (
 	"flag"
 	"fmt"
 	"io"
-	"log"
 	"os"
+	"time"
 
 	"cloud.google.com/go/storage"
 
@@ -36,34 +36,67 @@ const (
 type Command struct {
 	Cfg *client.Config
 
-	bucketName   string // GCS bucket name
-	class        string // storage class for low-rated files
-	maxUpdates   int    // files to update
-	numWorkers   int    // concurrent GCS updates
-	ratingCutoff int    // min rating for standard storage class
+	bucketName    string // GCS bucket name
+	class         string // storage class for low-rated files
+	deleteOrphans bool   // delete objects without local files when syncing
+	dryRun        bool   // print actions instead of performing them
+	maxUpdates    int    // files to update
+	minIdleDays   int    // min days since last play for colder storage class
+	numWorkers    int    // concurrent GCS updates
+	ratingCutoff  int    // min rating for standard storage class
+	out           client.OutputFlags
 }
 
 func (*Command) Name() string     { return "storage" }
 func (*Command) Synopsis() string { return "update song storage classes" }
 func (*Command) Usage() string {
-	return `storage <flags>:
+	return `storage <flags> [sync]:
 	Update song files' storage classes in Google Cloud Storage based on
-	ratings in dumped songs read from stdin.
+	ratings and plays in dumped songs read from stdin. If the config's
+	storageRules field is empty, songs rated below -rating-cutoff that
+	haven't been played in -min-idle-days use -class.
+
+	With "sync", instead upload new and changed song files from the music
+	dir to the bucket. Files are compared against objects by size and hash.
+	New objects use the STANDARD storage class, while replaced objects keep
+	their existing classes.
 
 `
 }
 
 func (cmd *Command) SetFlags(f *flag.FlagSet) {
-	f.StringVar(&cmd.bucketName, "bucket", "", "Google Cloud Storage bucket containing songs")
+	f.StringVar(&cmd.bucketName, "bucket", "",
+		"Google Cloud Storage bucket containing songs (overrides config's songBucket)")
 	f.StringVar(&cmd.class, "class", string(coldline), "Storage class for infrequently-accessed files")
+	f.BoolVar(&cmd.deleteOrphans, "delete", false, "Delete objects without local files when syncing")
+	f.BoolVar(&cmd.dryRun, "dry-run", false, "Only print what would be changed (and projected storage costs)")
 	f.IntVar(&cmd.maxUpdates, "max-updates", -1, "Maximum number of files to update")
+	f.IntVar(&cmd.minIdleDays, "min-idle-days", 0,
+		"Minimum days since last play for infrequently-accessed storage class")
 	f.IntVar(&cmd.numWorkers, "workers", 10, "Maximum concurrent Google Cloud Storage updates")
 	f.IntVar(&cmd.ratingCutoff, "rating-cutoff", 4, "Minimum song rating for standard storage class")
+	cmd.out.SetFlags(f)
 }
 
-func (cmd *Command) Execute(ctx context.Context, _ *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+func (cmd *Command) Execute(ctx context.Context, fs *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+	if cmd.bucketName == "" {
+		cmd.bucketName = cmd.Cfg.SongBucket
+	}
 	if cmd.bucketName == "" {
-		fmt.Fprintln(os.Stderr, "Must supply bucket name with -bucket")
+		fmt.Fprintln(os.Stderr, "Must supply bucket name with -bucket or songBucket in config")
+		return subcommands.ExitUsageError
+	}
+	var doSync bool
+	switch fs.Arg(0) {
+	case "":
+	case "sync":
+		if cmd.Cfg.MusicDir == "" {
+			fmt.Fprintln(os.Stderr, "musicDir not set in config")
+			return subcommands.ExitUsageError
+		}
+		doSync = true
+	default:
+		fmt.Fprintln(os.Stderr, cmd.Usage())
 		return subcommands.ExitUsageError
 	}
 	class := storageClass(cmd.class)
@@ -71,6 +104,24 @@ func (cmd *Command) Execute(ctx context.Context, _ *flag.FlagSet, _ ...interface
 		fmt.Fprintf(os.Stderr, "Invalid -class %q (valid: %v %v %v)\n", class, nearline, coldline, archive)
 		return subcommands.ExitUsageError
 	}
+	rules := cmd.Cfg.StorageRules
+	if len(rules) == 0 && cmd.ratingCutoff > 1 {
+		rules = []client.StorageRule{{
+			Class:       string(class),
+			MaxRating:   cmd.ratingCutoff - 1,
+			MinIdleDays: cmd.minIdleDays,
+		}}
+	}
+	if err := checkRules(rules); err != nil {
+		fmt.Fprintln(os.Stderr, "Bad storageRules in config:", err)
+		return subcommands.ExitUsageError
+	}
+	rep, err := cmd.out.NewReporter(os.Stdout)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Bad output flags:", err)
+		return subcommands.ExitUsageError
+	}
+	rep.LogText = true
 
 	creds, err := google.FindDefaultCredentials(ctx,
 		"https://www.googleapis.com/auth/devstorage.read_write",
@@ -86,8 +137,17 @@ func (cmd *Command) Execute(ctx context.Context, _ *flag.FlagSet, _ ...interface
 	}
 	defer client.Close()
 
+	if doSync {
+		if err := cmd.syncFiles(ctx, client.Bucket(cmd.bucketName), rep); err != nil {
+			fmt.Fprintln(os.Stderr, "Failed syncing files:", err)
+			return subcommands.ExitFailure
+		}
+		return subcommands.ExitSuccess
+	}
+
 	// Read songs from stdin and determine the proper storage class for each.
 	songClasses := make(map[string]storageClass)
+	now := time.Now()
 	d := json.NewDecoder(os.Stdin)
 	for {
 		var s db.Song
@@ -97,15 +157,12 @@ func (cmd *Command) Execute(ctx context.Context, _ *flag.FlagSet, _ ...interface
 			fmt.Fprintln(os.Stderr, "Failed to read song:", err)
 			return subcommands.ExitFailure
 		}
-		cls := standard
-		if s.Rating > 0 && s.Rating < cmd.ratingCutoff {
-			cls = class
-		}
-		songClasses[s.Filename] = cls
+		songClasses[s.Filename] = chooseClass(rules, &s, now)
 	}
 
 	// List the objects synchronously so we know how many jobs we'll have.
 	var jobs []job
+	var cost costChange
 	bucket := client.Bucket(cmd.bucketName)
 	it := bucket.Objects(ctx, &storage.Query{Prefix: ""})
 	for {
@@ -117,12 +174,25 @@ func (cmd *Command) Execute(ctx context.Context, _ *flag.FlagSet, _ ...interface
 			return subcommands.ExitFailure
 		}
 		class, ok := songClasses[attrs.Name]
-		if ok && attrs.StorageClass != string(class) {
+		if !ok {
+			continue
+		}
+		if attrs.StorageClass != string(class) && (cmd.maxUpdates <= 0 || len(jobs) < cmd.maxUpdates) {
 			jobs = append(jobs, job{*attrs, class})
-			if cmd.maxUpdates > 0 && len(jobs) >= cmd.maxUpdates {
-				break
-			}
+			cost.add(attrs.Size, attrs.StorageClass, string(class))
+		} else {
+			cost.add(attrs.Size, attrs.StorageClass, attrs.StorageClass)
+		}
+	}
+
+	if cmd.dryRun {
+		for _, j := range jobs {
+			rep.Item(j.attrs.Name, "wouldUpdate",
+				fmt.Sprintf("%q: %v -> %v", j.attrs.Name, j.attrs.StorageClass, j.class))
 		}
+		rep.Textf("Projected storage cost: %v", cost)
+		rep.Summary()
+		return subcommands.ExitSuccess
 	}
 
 	// See https://gobyexample.com/worker-pools.
@@ -142,17 +212,20 @@ func (cmd *Command) Execute(ctx context.Context, _ *flag.FlagSet, _ ...interface
 
 	// Wait for all the jobs to finish.
 	var numErrs int
+	rep.AddTotal(len(jobs))
 	for i := 0; i < len(jobs); i++ {
 		res := <-resChan
 		msg := fmt.Sprintf("[%d/%d] %q: %v -> %v", i+1, len(jobs),
 			res.attrs.Name, res.attrs.StorageClass, res.class)
 		if res.err == nil {
-			log.Print(msg)
+			rep.Item(res.attrs.Name, "updated", msg)
 		} else {
 			numErrs++
-			log.Printf("%s failed: %v", msg, res.err)
+			rep.Item(res.attrs.Name, "failed", fmt.Sprintf("%s failed: %v", msg, res.err))
 		}
+		rep.Advance(1)
 	}
+	rep.Summary()
 	if numErrs > 0 {
 		fmt.Fprintf(os.Stderr, "Failed updating %v object(s)\n", numErrs)
 		return subcommands.ExitFailure
@@ -0,0 +1,105 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package storage
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/derat/nup/cmd/nup/client"
+	"github.com/derat/nup/server/db"
+)
+
+// classPrices contains approximate monthly prices in USD per GiB for storage classes
+// in US regions. See https://cloud.google.com/storage/pricing.
+var classPrices = map[storageClass]float64{
+	standard: 0.020,
+	nearline: 0.010,
+	coldline: 0.004,
+	archive:  0.0012,
+}
+
+// classPrice returns the monthly price per GiB for cls.
+// Legacy classes like "MULTI_REGIONAL" are priced as STANDARD.
+func classPrice(cls string) float64 {
+	if p, ok := classPrices[storageClass(cls)]; ok {
+		return p
+	}
+	return classPrices[standard]
+}
+
+// checkRules returns an error if rules are invalid.
+func checkRules(rules []client.StorageRule) error {
+	for i, r := range rules {
+		if cls := storageClass(r.Class); cls != nearline && cls != coldline && cls != archive {
+			return fmt.Errorf("rule %d has invalid class %q", i, r.Class)
+		}
+		if r.MaxRating < 0 || r.MaxRating > 5 {
+			return fmt.Errorf("rule %d has invalid max rating %d", i, r.MaxRating)
+		}
+		if r.MinIdleDays < 0 {
+			return fmt.Errorf("rule %d has negative min idle days", i)
+		}
+		if r.MaxPlays != nil && *r.MaxPlays < 0 {
+			return fmt.Errorf("rule %d has negative max plays", i)
+		}
+	}
+	return nil
+}
+
+// playInfo returns the number of plays in s.Plays and the time of the last play.
+func playInfo(s *db.Song) (count int, last time.Time) {
+	for _, p := range s.Plays {
+		if p.StartTime.After(last) {
+			last = p.StartTime
+		}
+	}
+	return len(s.Plays), last
+}
+
+// ruleMatches returns true if s satisfies all of r's conditions at now.
+func ruleMatches(r *client.StorageRule, s *db.Song, now time.Time) bool {
+	if r.MaxRating > 0 {
+		if s.Rating == 0 && !r.Unrated {
+			return false
+		}
+		if s.Rating > r.MaxRating {
+			return false
+		}
+	}
+	plays, last := playInfo(s)
+	if r.MaxPlays != nil && plays > *r.MaxPlays {
+		return false
+	}
+	if r.MinIdleDays > 0 && !last.IsZero() && now.Sub(last) < time.Duration(r.MinIdleDays)*24*time.Hour {
+		return false
+	}
+	return true
+}
+
+// chooseClass returns the storage class for s using the first matching rule in rules.
+func chooseClass(rules []client.StorageRule, s *db.Song, now time.Time) storageClass {
+	for i := range rules {
+		if ruleMatches(&rules[i], s, now) {
+			return storageClass(rules[i].Class)
+		}
+	}
+	return standard
+}
+
+// costChange describes the projected effect of storage class changes.
+type costChange struct {
+	before, after float64 // monthly cost in USD of all song objects
+}
+
+// add adds an object of the supplied size changing from class from to class to.
+func (c *costChange) add(size int64, from, to string) {
+	gib := float64(size) / (1 << 30)
+	c.before += gib * classPrice(from)
+	c.after += gib * classPrice(to)
+}
+
+func (c costChange) String() string {
+	return fmt.Sprintf("$%.2f -> $%.2f per month (%+.2f)", c.before, c.after, c.after-c.before)
+}
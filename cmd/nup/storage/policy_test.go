@@ -0,0 +1,77 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package storage
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/derat/nup/cmd/nup/client"
+	"github.com/derat/nup/server/db"
+)
+
+func TestChooseClass(t *testing.T) {
+	now := time.Date(2023, 6, 1, 0, 0, 0, 0, time.UTC)
+	daysAgo := func(d int) db.Play { return db.Play{StartTime: now.AddDate(0, 0, -d)} }
+	zero, five := 0, 5
+	rules := []client.StorageRule{
+		{Class: "ARCHIVE", MaxRating: 1, Unrated: true, MaxPlays: &zero},
+		{Class: "COLDLINE", MaxRating: 2, MinIdleDays: 365},
+		{Class: "NEARLINE", MinIdleDays: 90, MaxPlays: &five},
+	}
+	for _, tc := range []struct {
+		desc string
+		song db.Song
+		want storageClass
+	}{
+		{"unrated and unplayed", db.Song{}, archive},
+		{"low rating and unplayed", db.Song{Rating: 1}, archive},
+		{"low rating but played", db.Song{Rating: 1, Plays: []db.Play{daysAgo(400)}}, coldline},
+		{"low rating and recently played", db.Song{Rating: 2, Plays: []db.Play{daysAgo(400), daysAgo(10)}}, standard},
+		{"idle with few plays", db.Song{Rating: 4, Plays: []db.Play{daysAgo(100)}}, nearline},
+		{"idle with many plays", db.Song{Rating: 4, Plays: []db.Play{
+			daysAgo(100), daysAgo(110), daysAgo(120), daysAgo(130), daysAgo(140), daysAgo(150)}}, standard},
+		{"high rating and recently played", db.Song{Rating: 5, Plays: []db.Play{daysAgo(1)}}, standard},
+		{"unrated and played", db.Song{Plays: []db.Play{daysAgo(30)}}, standard},
+	} {
+		if got := chooseClass(rules, &tc.song, now); got != tc.want {
+			t.Errorf("%v: chooseClass = %q; want %q", tc.desc, got, tc.want)
+		}
+	}
+}
+
+func TestCheckRules(t *testing.T) {
+	neg := -1
+	for _, tc := range []struct {
+		rule client.StorageRule
+		ok   bool
+	}{
+		{client.StorageRule{Class: "COLDLINE", MaxRating: 3, MinIdleDays: 30}, true},
+		{client.StorageRule{Class: "STANDARD"}, false},
+		{client.StorageRule{Class: "coldline"}, false},
+		{client.StorageRule{Class: "NEARLINE", MaxRating: 6}, false},
+		{client.StorageRule{Class: "NEARLINE", MinIdleDays: -1}, false},
+		{client.StorageRule{Class: "NEARLINE", MaxPlays: &neg}, false},
+	} {
+		if err := checkRules([]client.StorageRule{tc.rule}); err != nil && tc.ok {
+			t.Errorf("checkRules(%+v) failed: %v", tc.rule, err)
+		} else if err == nil && !tc.ok {
+			t.Errorf("checkRules(%+v) unexpectedly succeeded", tc.rule)
+		}
+	}
+}
+
+func TestCostChange(t *testing.T) {
+	var c costChange
+	c.add(10<<30, "STANDARD", "COLDLINE")
+	c.add(5<<30, "MULTI_REGIONAL", "MULTI_REGIONAL")
+	const eps = 1e-9
+	if want := 10*0.020 + 5*0.020; math.Abs(c.before-want) > eps {
+		t.Errorf("before = %v; want %v", c.before, want)
+	}
+	if want := 10*0.004 + 5*0.020; math.Abs(c.after-want) > eps {
+		t.Errorf("after = %v; want %v", c.after, want)
+	}
+}
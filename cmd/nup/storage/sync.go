@@ -0,0 +1,290 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"mime"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"cloud.google.com/go/storage"
+
+	"github.com/derat/nup/cmd/nup/client"
+	"github.com/derat/nup/cmd/nup/client/files"
+
+	"google.golang.org/api/iterator"
+)
+
+// localFile describes a song file in the music dir.
+type localFile struct {
+	name string // path relative to music dir, used as object name
+	path string // absolute path
+	size int64
+}
+
+// objectInfo contains the parts of storage.ObjectAttrs used when syncing.
+type objectInfo struct {
+	size   int64
+	md5    []byte // nil for composite objects
+	crc32c uint32
+	class  string // storage class
+}
+
+// syncUpload describes a file that should be uploaded.
+type syncUpload struct {
+	localFile
+	class string // storage class for the new object
+	isNew bool   // true if the object doesn't exist yet
+}
+
+// planSync compares local against objects (keyed by name) and returns the files that
+// need to be uploaded and the names of objects that don't correspond to local files.
+// Objects that index lists as transcoded from lossless files are left alone, since they're
+// managed by "nup update -upload". matches is called to compare the contents of files and
+// objects with the same size.
+func planSync(local []localFile, objects map[string]objectInfo, index *client.TranscodeIndex,
+	matches func(localFile, objectInfo) (bool, error)) ([]syncUpload, []string, error) {
+	var uploads []syncUpload
+	seen := make(map[string]struct{}, len(local))
+	for _, lf := range local {
+		seen[lf.name] = struct{}{}
+		obj, ok := objects[lf.name]
+		if !ok {
+			uploads = append(uploads, syncUpload{lf, string(standard), true})
+			continue
+		}
+		if obj.size == lf.size {
+			if same, err := matches(lf, obj); err != nil {
+				return nil, nil, err
+			} else if same {
+				continue
+			}
+		}
+		uploads = append(uploads, syncUpload{lf, obj.class, false})
+	}
+
+	var orphans []string
+	for name := range objects {
+		if _, ok := seen[name]; ok || !files.IsMusicPath(name) {
+			continue
+		}
+		if _, ok := index.Source(name); ok {
+			continue
+		}
+		orphans = append(orphans, name)
+	}
+	sort.Strings(orphans)
+	return uploads, orphans, nil
+}
+
+// crc32cTable is used to compute CRC32C checksums like those used by GCS.
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// fileMatches returns true if lf's contents match obj's hash.
+// The MD5 hash is used if available; otherwise the CRC32C checksum is used.
+func fileMatches(lf localFile, obj objectInfo) (bool, error) {
+	f, err := os.Open(lf.path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	if obj.md5 != nil {
+		h := md5.New()
+		if _, err := io.Copy(h, f); err != nil {
+			return false, err
+		}
+		return bytes.Equal(h.Sum(nil), obj.md5), nil
+	}
+	h := crc32.New(crc32cTable)
+	if _, err := io.Copy(h, f); err != nil {
+		return false, err
+	}
+	return h.Sum32() == obj.crc32c, nil
+}
+
+// contentType returns the Content-Type to use for the object named name.
+func contentType(name string) string {
+	ext := strings.ToLower(filepath.Ext(name))
+	if ext == ".mp3" {
+		return "audio/mpeg" // not present in all systems' MIME databases
+	}
+	if t := mime.TypeByExtension(ext); t != "" {
+		return t
+	}
+	return "application/octet-stream"
+}
+
+// listLocalFiles returns the song files within dir.
+func listLocalFiles(dir string) ([]localFile, error) {
+	var local []localFile
+	err := filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !fi.Mode().IsRegular() || !files.IsMusicPath(p) {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		local = append(local, localFile{filepath.ToSlash(rel), p, fi.Size()})
+		return nil
+	})
+	return local, err
+}
+
+// uploadFile uploads up to bucket.
+func uploadFile(ctx context.Context, bucket *storage.BucketHandle, up syncUpload) error {
+	f, err := os.Open(up.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// Compute the checksum first so that GCS can reject corrupted uploads.
+	h := crc32.New(crc32cTable)
+	if _, err := io.Copy(h, f); err != nil {
+		return err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	w := bucket.Object(up.name).NewWriter(ctx)
+	w.ContentType = contentType(up.name)
+	w.StorageClass = up.class
+	w.CRC32C = h.Sum32()
+	w.SendCRC32C = true
+	if _, err := io.Copy(w, f); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+// syncFiles uploads new and changed files from the music dir to bucket.
+// If cmd.deleteOrphans is true, objects without local files are deleted.
+func (cmd *Command) syncFiles(ctx context.Context, bucket *storage.BucketHandle,
+	rep *client.Reporter) error {
+	local, err := listLocalFiles(cmd.Cfg.MusicDir)
+	if err != nil {
+		return fmt.Errorf("failed listing %v: %v", cmd.Cfg.MusicDir, err)
+	}
+
+	objects := make(map[string]objectInfo)
+	it := bucket.Objects(ctx, &storage.Query{Prefix: ""})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		} else if err != nil {
+			return fmt.Errorf("failed listing objects in %v: %v", cmd.bucketName, err)
+		}
+		objects[attrs.Name] = objectInfo{attrs.Size, attrs.MD5, attrs.CRC32C, attrs.StorageClass}
+	}
+
+	index, err := client.ReadTranscodeIndex(cmd.Cfg.TranscodeIndexFile)
+	if err != nil {
+		return fmt.Errorf("failed reading transcode index: %v", err)
+	}
+	uploads, orphans, err := planSync(local, objects, index, fileMatches)
+	if err != nil {
+		return err
+	}
+	if cmd.maxUpdates > 0 && len(uploads) > cmd.maxUpdates {
+		uploads = uploads[:cmd.maxUpdates]
+	}
+	if !cmd.deleteOrphans {
+		for _, name := range orphans {
+			rep.Item(name, "orphaned", fmt.Sprintf("%q has no local file (pass -delete to delete)", name))
+		}
+		orphans = nil
+	}
+
+	if cmd.dryRun {
+		for _, up := range uploads {
+			if up.isNew {
+				rep.Item(up.name, "wouldUpload", fmt.Sprintf("Would upload %q (%v)", up.name, up.class))
+			} else {
+				rep.Item(up.name, "wouldReplace", fmt.Sprintf("Would replace %q (%v)", up.name, up.class))
+			}
+		}
+		for _, name := range orphans {
+			rep.Item(name, "wouldDelete", fmt.Sprintf("Would delete %q", name))
+		}
+		rep.Summary()
+		return nil
+	}
+
+	// Each job either uploads a file or deletes an orphaned object.
+	type syncJob struct {
+		up     *syncUpload
+		delete string
+	}
+	type syncResult struct {
+		syncJob
+		err error
+	}
+	numJobs := len(uploads) + len(orphans)
+	jobChan := make(chan syncJob, numJobs)
+	resChan := make(chan syncResult, numJobs)
+	for i := 0; i < cmd.numWorkers; i++ {
+		go func() {
+			for j := range jobChan {
+				var err error
+				if j.up != nil {
+					err = uploadFile(ctx, bucket, *j.up)
+				} else {
+					err = bucket.Object(j.delete).Delete(ctx)
+				}
+				resChan <- syncResult{j, err}
+			}
+		}()
+	}
+	for i := range uploads {
+		jobChan <- syncJob{up: &uploads[i]}
+	}
+	for _, name := range orphans {
+		jobChan <- syncJob{delete: name}
+	}
+	close(jobChan)
+
+	var numErrs int
+	rep.AddTotal(numJobs)
+	for i := 0; i < numJobs; i++ {
+		res := <-resChan
+		var name, status, msg string
+		switch {
+		case res.up != nil && res.up.isNew:
+			name, status, msg = res.up.name, "uploaded", "Uploaded"
+		case res.up != nil:
+			name, status, msg = res.up.name, "replaced", "Replaced"
+		default:
+			name, status, msg = res.delete, "deleted", "Deleted"
+		}
+		msg = fmt.Sprintf("[%d/%d] %s %q", i+1, numJobs, msg, name)
+		if res.err != nil {
+			numErrs++
+			rep.Item(name, "failed", fmt.Sprintf("%s failed: %v", msg, res.err))
+		} else {
+			rep.Item(name, status, msg)
+		}
+		rep.Advance(1)
+	}
+	rep.Summary()
+	if numErrs > 0 {
+		return fmt.Errorf("%d operation(s) failed", numErrs)
+	}
+	return nil
+}
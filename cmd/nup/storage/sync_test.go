@@ -0,0 +1,89 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package storage
+
+import (
+	"crypto/md5"
+	"hash/crc32"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/derat/nup/cmd/nup/client"
+)
+
+func TestPlanSync(t *testing.T) {
+	local := []localFile{
+		{name: "new.mp3", size: 10},
+		{name: "same.mp3", size: 20},
+		{name: "changed.mp3", size: 30},
+		{name: "resized.mp3", size: 40},
+	}
+	objects := map[string]objectInfo{
+		"same.mp3":     {size: 20, class: "COLDLINE"},
+		"changed.mp3":  {size: 30, class: "COLDLINE"},
+		"resized.mp3":  {size: 41, class: "NEARLINE"},
+		"orphan.mp3":   {size: 50, class: "STANDARD"},
+		"notes.txt":    {size: 60, class: "STANDARD"},
+		"lossless.mp3": {size: 70, class: "STANDARD"},
+	}
+	index, err := client.ReadTranscodeIndex(filepath.Join(t.TempDir(), "transcodes.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	index.Set("lossless.flac", client.TranscodeRecord{Format: "mp3", Object: "lossless.mp3"})
+	var compared []string
+	matches := func(lf localFile, obj objectInfo) (bool, error) {
+		compared = append(compared, lf.name)
+		return lf.name == "same.mp3", nil
+	}
+
+	uploads, orphans, err := planSync(local, objects, index, matches)
+	if err != nil {
+		t.Fatal("planSync failed:", err)
+	}
+	wantUploads := []syncUpload{
+		{local[0], "STANDARD", true},
+		{local[2], "COLDLINE", false},
+		{local[3], "NEARLINE", false},
+	}
+	if !reflect.DeepEqual(uploads, wantUploads) {
+		t.Errorf("planSync returned uploads %+v; want %+v", uploads, wantUploads)
+	}
+	if want := []string{"orphan.mp3"}; !reflect.DeepEqual(orphans, want) {
+		t.Errorf("planSync returned orphans %q; want %q", orphans, want)
+	}
+	if want := []string{"same.mp3", "changed.mp3"}; !reflect.DeepEqual(compared, want) {
+		t.Errorf("planSync compared %q; want %q", compared, want)
+	}
+}
+
+func TestFileMatches(t *testing.T) {
+	data := []byte("some song data")
+	p := filepath.Join(t.TempDir(), "song.mp3")
+	if err := ioutil.WriteFile(p, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	lf := localFile{name: "song.mp3", path: p, size: int64(len(data))}
+	sum := md5.Sum(data)
+	crc := crc32.Checksum(data, crc32.MakeTable(crc32.Castagnoli))
+
+	for _, tc := range []struct {
+		desc string
+		obj  objectInfo
+		want bool
+	}{
+		{"md5 match", objectInfo{md5: sum[:], crc32c: crc + 1}, true},
+		{"md5 mismatch", objectInfo{md5: make([]byte, md5.Size), crc32c: crc}, false},
+		{"crc32c match", objectInfo{crc32c: crc}, true},
+		{"crc32c mismatch", objectInfo{crc32c: crc + 1}, false},
+	} {
+		if got, err := fileMatches(lf, tc.obj); err != nil {
+			t.Errorf("%v: fileMatches failed: %v", tc.desc, err)
+		} else if got != tc.want {
+			t.Errorf("%v: fileMatches = %v; want %v", tc.desc, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package tags
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/derat/nup/cmd/nup/client"
+	"github.com/derat/nup/server/tagrules"
+	"github.com/google/subcommands"
+)
+
+type Command struct {
+	Cfg *client.Config
+}
+
+func (*Command) Name() string     { return "tags" }
+func (*Command) Synopsis() string { return "manage tag aliases and hierarchy" }
+func (*Command) Usage() string {
+	return `tags list|alias|parent|remove [args]...:
+	Manage aliases and parent/child relations between tags.
+	Queries for a tag also match its aliases and descendants.
+
+	list                     List rules (one per line)
+	alias <alias> <tag>      Make <alias> an alias of <tag>
+	parent <child> <parent>  Make <parent> the parent of <child>
+	remove <tag>             Remove <tag>'s alias or parent
+
+`
+}
+
+func (cmd *Command) SetFlags(f *flag.FlagSet) {}
+
+func (cmd *Command) Execute(ctx context.Context, fs *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+	if fs.NArg() == 0 {
+		fmt.Fprintln(os.Stderr, cmd.Usage())
+		return subcommands.ExitUsageError
+	}
+
+	action, args := fs.Arg(0), fs.Args()[1:]
+	var vals url.Values
+	switch action {
+	case "list":
+		if len(args) != 0 {
+			fmt.Fprintln(os.Stderr, "list doesn't take arguments")
+			return subcommands.ExitUsageError
+		}
+		var rules tagrules.Rules
+		if err := sendRequest(ctx, cmd.Cfg, "GET", nil, &rules); err != nil {
+			fmt.Fprintln(os.Stderr, "Failed listing rules:", err)
+			return subcommands.ExitFailure
+		}
+		printRules(&rules)
+		return subcommands.ExitSuccess
+	case "alias", "parent":
+		if len(args) != 2 {
+			fmt.Fprintf(os.Stderr, "%v takes two tags\n", action)
+			return subcommands.ExitUsageError
+		}
+		vals = url.Values{"action": {action}, "tag": {args[0]}, "target": {args[1]}}
+	case "remove":
+		if len(args) != 1 {
+			fmt.Fprintln(os.Stderr, "remove takes a single tag")
+			return subcommands.ExitUsageError
+		}
+		vals = url.Values{"action": {action}, "tag": {args[0]}}
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown action %q\n", action)
+		return subcommands.ExitUsageError
+	}
+
+	if err := sendRequest(ctx, cmd.Cfg, "POST", vals, nil); err != nil {
+		fmt.Fprintln(os.Stderr, "Failed updating rules:", err)
+		return subcommands.ExitFailure
+	}
+	return subcommands.ExitSuccess
+}
+
+// printRules prints rules to stdout, with aliases first and then parents.
+func printRules(rules *tagrules.Rules) {
+	printMap := func(m map[string]string, sep string) {
+		keys := make([]string, 0, len(m))
+		for k := range m {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			fmt.Printf("%s %s %s\n", k, sep, m[k])
+		}
+	}
+	printMap(rules.Aliases, "=")
+	printMap(rules.Parents, "<")
+}
+
+// sendRequest sends a request to /tag_rules with the supplied query.
+// If dst is non-nil, the JSON response is unmarshaled into it.
+func sendRequest(ctx context.Context, cfg *client.Config, method string,
+	vals url.Values, dst interface{}) error {
+	u := cfg.GetURL("/tag_rules")
+	u.RawQuery = vals.Encode()
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	cfg.SetAuth(req)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		b, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("got status %q: %s", resp.Status, strings.TrimSpace(string(b)))
+	}
+	if dst == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(dst)
+}
@@ -0,0 +1,138 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package token
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/derat/nup/cmd/nup/client"
+	"github.com/derat/nup/server/db"
+	"github.com/google/subcommands"
+)
+
+type Command struct {
+	Cfg *client.Config
+
+	desc  string // description for created tokens
+	scope string // scope for created tokens
+	user  string // user for created or listed tokens
+}
+
+func (*Command) Name() string     { return "token" }
+func (*Command) Synopsis() string { return "manage API tokens" }
+func (*Command) Usage() string {
+	return `token <flags> create|list|revoke [token-id]...:
+	Manage API tokens that can be used to authenticate to the server.
+	Tokens can be added to the config's apiToken field.
+
+	create  Create a token and print it to stdout
+	list    List tokens (one per line, starting with the token ID)
+	revoke  Revoke the tokens with the specified IDs
+
+`
+}
+
+func (cmd *Command) SetFlags(f *flag.FlagSet) {
+	f.StringVar(&cmd.desc, "desc", "", "Description for created token")
+	f.StringVar(&cmd.scope, "scope", string(db.ReadScope),
+		`Scope for created token ("read", "update", or "admin")`)
+	f.StringVar(&cmd.user, "user", "", "User for created token (defaults to config's user), "+
+		"or user whose tokens should be listed (defaults to all users)")
+}
+
+func (cmd *Command) Execute(ctx context.Context, fs *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+	if fs.NArg() == 0 {
+		fmt.Fprintln(os.Stderr, cmd.Usage())
+		return subcommands.ExitUsageError
+	}
+
+	ids := fs.Args()[1:]
+	if action := fs.Arg(0); action != "revoke" && len(ids) > 0 {
+		fmt.Fprintf(os.Stderr, "%v doesn't take token IDs\n", action)
+		return subcommands.ExitUsageError
+	}
+
+	switch action := fs.Arg(0); action {
+	case "create":
+		vals := url.Values{"scope": {cmd.scope}}
+		if cmd.user != "" {
+			vals.Set("user", cmd.user)
+		}
+		if cmd.desc != "" {
+			vals.Set("desc", cmd.desc)
+		}
+		var res struct {
+			Token string `json:"token"`
+		}
+		if err := sendRequest(ctx, cmd.Cfg, "POST", "/create_api_token", vals, &res); err != nil {
+			fmt.Fprintln(os.Stderr, "Failed creating token:", err)
+			return subcommands.ExitFailure
+		}
+		fmt.Println(res.Token)
+	case "list":
+		vals := make(url.Values)
+		if cmd.user != "" {
+			vals.Set("user", cmd.user)
+		}
+		var tokens []db.APIToken
+		if err := sendRequest(ctx, cmd.Cfg, "GET", "/api_tokens", vals, &tokens); err != nil {
+			fmt.Fprintln(os.Stderr, "Failed listing tokens:", err)
+			return subcommands.ExitFailure
+		}
+		for _, t := range tokens {
+			fmt.Printf("%s\t%s\t%s\t%s\t%s\n", t.ID, t.User, t.Scope,
+				t.Created.Local().Format("2006-01-02 15:04"), t.Desc)
+		}
+	case "revoke":
+		if len(ids) == 0 {
+			fmt.Fprintln(os.Stderr, "No token IDs supplied")
+			return subcommands.ExitUsageError
+		}
+		for _, id := range ids {
+			if err := sendRequest(ctx, cmd.Cfg, "POST", "/revoke_api_token",
+				url.Values{"id": {id}}, nil); err != nil {
+				fmt.Fprintf(os.Stderr, "Failed revoking token %v: %v\n", id, err)
+				return subcommands.ExitFailure
+			}
+		}
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown action %q\n", action)
+		return subcommands.ExitUsageError
+	}
+	return subcommands.ExitSuccess
+}
+
+// sendRequest sends a request for path with the supplied query to the server.
+// If dst is non-nil, the JSON response is unmarshaled into it.
+func sendRequest(ctx context.Context, cfg *client.Config, method, path string,
+	vals url.Values, dst interface{}) error {
+	u := cfg.GetURL(path)
+	u.RawQuery = vals.Encode()
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	cfg.SetAuth(req)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		b, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("got status %q: %s", resp.Status, strings.TrimSpace(string(b)))
+	}
+	if dst == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(dst)
+}
@@ -0,0 +1,65 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+// Package transcode uses the ffmpeg program to transcode lossless songs to lossy formats.
+package transcode
+
+import (
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Lossy formats that songs can be transcoded to.
+const (
+	MP3  = "mp3"
+	Opus = "opus"
+)
+
+// DefaultBitrate returns the default bitrate in kbit/sec for format.
+func DefaultBitrate(format string) int {
+	if format == Opus {
+		return 160
+	}
+	return 256
+}
+
+// ObjectName returns the name to use for the file at the relative path rel after it's been
+// transcoded to format, e.g. "artist/album/01-song.mp3" for "artist/album/01-song.flac".
+func ObjectName(rel, format string) string {
+	return strings.TrimSuffix(rel, filepath.Ext(rel)) + "." + format
+}
+
+// File transcodes the lossless audio file at src to format at the supplied bitrate
+// (in kbit/sec) and writes the result to dst, which is overwritten if it exists.
+func File(src, dst, format string, bitrate int) error {
+	args, err := getArgs(src, dst, format, bitrate)
+	if err != nil {
+		return err
+	}
+	if out, err := exec.Command("ffmpeg", args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("ffmpeg failed: %v (%s)", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// getArgs returns arguments for ffmpeg to transcode src to dst.
+func getArgs(src, dst, format string, bitrate int) ([]string, error) {
+	args := []string{"-nostdin", "-v", "error", "-i", src,
+		// Skip embedded images, which are sent to the server separately.
+		"-map", "0:a",
+		"-map_metadata", "0",
+		"-b:a", strconv.Itoa(bitrate) + "k",
+	}
+	switch format {
+	case MP3:
+		args = append(args, "-c:a", "libmp3lame", "-id3v2_version", "3", "-f", "mp3")
+	case Opus:
+		args = append(args, "-c:a", "libopus", "-f", "opus")
+	default:
+		return nil, fmt.Errorf("unsupported format %q", format)
+	}
+	return append(args, "-y", dst), nil
+}
@@ -0,0 +1,47 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package transcode
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestObjectName(t *testing.T) {
+	for _, tc := range []struct{ rel, format, want string }{
+		{"a/b/01-song.flac", MP3, "a/b/01-song.mp3"},
+		{"a/b/01-song.FLAC", Opus, "a/b/01-song.opus"},
+		{"song.v2.flac", MP3, "song.v2.mp3"},
+	} {
+		if got := ObjectName(tc.rel, tc.format); got != tc.want {
+			t.Errorf("ObjectName(%q, %q) = %q; want %q", tc.rel, tc.format, got, tc.want)
+		}
+	}
+}
+
+func TestGetArgs(t *testing.T) {
+	for _, tc := range []struct {
+		format  string
+		bitrate int
+		want    []string // nil if error expected
+	}{
+		{MP3, 256, []string{"-nostdin", "-v", "error", "-i", "in.flac", "-map", "0:a",
+			"-map_metadata", "0", "-b:a", "256k", "-c:a", "libmp3lame", "-id3v2_version", "3",
+			"-f", "mp3", "-y", "out"}},
+		{Opus, 160, []string{"-nostdin", "-v", "error", "-i", "in.flac", "-map", "0:a",
+			"-map_metadata", "0", "-b:a", "160k", "-c:a", "libopus", "-f", "opus", "-y", "out"}},
+		{"aac", 256, nil},
+	} {
+		got, err := getArgs("in.flac", "out", tc.format, tc.bitrate)
+		if tc.want == nil {
+			if err == nil {
+				t.Errorf("getArgs(..., %q, %d) unexpectedly succeeded", tc.format, tc.bitrate)
+			}
+		} else if err != nil {
+			t.Errorf("getArgs(..., %q, %d) failed: %v", tc.format, tc.bitrate, err)
+		} else if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("getArgs(..., %q, %d) = %q; want %q", tc.format, tc.bitrate, got, tc.want)
+		}
+	}
+}
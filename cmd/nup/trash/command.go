@@ -0,0 +1,172 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package trash
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/derat/nup/cmd/nup/client"
+	"github.com/derat/nup/server/db"
+	"github.com/google/subcommands"
+)
+
+const listBatchSize = 500 // songs to request in each /export call
+
+type Command struct {
+	Cfg *client.Config
+}
+
+func (*Command) Name() string     { return "trash" }
+func (*Command) Synopsis() string { return "manage deleted songs" }
+func (*Command) Usage() string {
+	return `trash list|restore|purge [song-id]...:
+	Manage songs that have been deleted from the server.
+
+	list     List deleted songs (one per line, starting with the song ID)
+	restore  Restore the specified deleted songs and their plays
+	purge    Permanently delete the specified deleted songs and their plays
+
+`
+}
+
+func (cmd *Command) SetFlags(f *flag.FlagSet) {}
+
+func (cmd *Command) Execute(ctx context.Context, fs *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+	if fs.NArg() == 0 {
+		fmt.Fprintln(os.Stderr, cmd.Usage())
+		return subcommands.ExitUsageError
+	}
+
+	var ids []int64
+	for _, arg := range fs.Args()[1:] {
+		id, err := strconv.ParseInt(arg, 10, 64)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Bad song ID %q\n", arg)
+			return subcommands.ExitUsageError
+		}
+		ids = append(ids, id)
+	}
+
+	var path string
+	switch action := fs.Arg(0); action {
+	case "list":
+		if len(ids) > 0 {
+			fmt.Fprintln(os.Stderr, "list doesn't take song IDs")
+			return subcommands.ExitUsageError
+		}
+		if err := listSongs(ctx, cmd.Cfg); err != nil {
+			fmt.Fprintln(os.Stderr, "Failed listing deleted songs:", err)
+			return subcommands.ExitFailure
+		}
+		return subcommands.ExitSuccess
+	case "restore":
+		path = "/undelete_song"
+	case "purge":
+		path = "/purge_deleted_song"
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown action %q\n", action)
+		return subcommands.ExitUsageError
+	}
+
+	if len(ids) == 0 {
+		fmt.Fprintln(os.Stderr, "No song IDs supplied")
+		return subcommands.ExitUsageError
+	}
+	for _, id := range ids {
+		vals := url.Values{"songId": {strconv.FormatInt(id, 10)}}
+		if err := sendPost(ctx, cmd.Cfg, path, vals); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed updating song %v: %v\n", id, err)
+			return subcommands.ExitFailure
+		}
+	}
+	return subcommands.ExitSuccess
+}
+
+// listSongs prints all deleted songs to stdout.
+func listSongs(ctx context.Context, cfg *client.Config) error {
+	var cursor string
+	for {
+		var err error
+		if cursor, err = listBatch(ctx, cfg, cursor); err != nil {
+			return err
+		} else if cursor == "" {
+			return nil
+		}
+	}
+}
+
+// listBatch prints a batch of deleted songs starting at cursor to stdout.
+// The cursor for the next batch is returned, or an empty string if all songs were listed.
+func listBatch(ctx context.Context, cfg *client.Config, cursor string) (string, error) {
+	vals := url.Values{
+		"type":    {"song"},
+		"deleted": {"1"},
+		"max":     {strconv.Itoa(listBatchSize)},
+		"omit":    {"coverFilename,plays,sha1"},
+	}
+	if cursor != "" {
+		vals.Set("cursor", cursor)
+	}
+	u := cfg.GetURL("/export")
+	u.RawQuery = vals.Encode()
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	cfg.SetAuth(req)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("got status %q", resp.Status)
+	}
+
+	// Each line contains a song, except for an optional final line with a cursor.
+	var next string
+	sc := bufio.NewScanner(resp.Body)
+	for sc.Scan() {
+		if err := json.Unmarshal(sc.Bytes(), &next); err == nil {
+			continue
+		}
+		var s db.Song
+		if err := json.Unmarshal(sc.Bytes(), &s); err != nil {
+			return "", fmt.Errorf("bad line %q: %v", sc.Text(), err)
+		}
+		fmt.Printf("%s\t%s - %s (%s)\n", s.SongID, s.Artist, s.Title, s.Filename)
+	}
+	return next, sc.Err()
+}
+
+// sendPost sends a POST request for path with the supplied query to the server.
+func sendPost(ctx context.Context, cfg *client.Config, path string, vals url.Values) error {
+	u := cfg.GetURL(path)
+	u.RawQuery = vals.Encode()
+	req, err := http.NewRequestWithContext(ctx, "POST", u.String(), nil)
+	if err != nil {
+		return err
+	}
+	cfg.SetAuth(req)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		b, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("got status %q: %s", resp.Status, strings.TrimSpace(string(b)))
+	}
+	return nil
+}
@@ -0,0 +1,173 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package update
+
+import (
+	"errors"
+	"image"
+	"math"
+	"os"
+	"path/filepath"
+
+	_ "image/jpeg"
+	_ "image/png"
+
+	"golang.org/x/image/draw"
+)
+
+const (
+	// Number of horizontal and vertical components used for cover BlurHashes.
+	coverBlurHashX = 4
+	coverBlurHashY = 4
+
+	// Covers are downscaled to this size before computing their BlurHashes and palettes.
+	// The hash only captures low frequencies, so there's no benefit to using more pixels.
+	coverThumbSize = 32
+)
+
+// coverSummary contains information derived from a cover image.
+type coverSummary struct {
+	blurHash string   // for Song.CoverBlurHash
+	palette  []string // for Song.CoverPalette
+}
+
+// summarizeCover returns a coverSummary for the cover image at fn within coverDir.
+func summarizeCover(coverDir, fn string) (coverSummary, error) {
+	f, err := os.Open(filepath.Join(coverDir, fn))
+	if err != nil {
+		return coverSummary{}, err
+	}
+	defer f.Close()
+	src, _, err := image.Decode(f)
+	if err != nil {
+		return coverSummary{}, err
+	}
+	dr := image.Rect(0, 0, coverThumbSize, coverThumbSize)
+	dst := image.NewRGBA(dr)
+	draw.ApproxBiLinear.Scale(dst, dr, src, src.Bounds(), draw.Src, nil)
+	hash, err := encodeBlurHash(dst, coverBlurHashX, coverBlurHashY)
+	if err != nil {
+		return coverSummary{}, err
+	}
+	return coverSummary{hash, extractPalette(dst, coverPaletteSize)}, nil
+}
+
+// encodeBlurHash returns a BlurHash string (see https://blurha.sh/) describing img
+// using the supplied number of horizontal and vertical components (each in [1, 9]).
+func encodeBlurHash(img image.Image, xComp, yComp int) (string, error) {
+	if xComp < 1 || xComp > 9 || yComp < 1 || yComp > 9 {
+		return "", errors.New("components must be in [1, 9]")
+	}
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	if w == 0 || h == 0 {
+		return "", errors.New("empty image")
+	}
+
+	// Convert the image to linear RGB up front since each pixel is visited once per component.
+	lin := make([][3]float64, w*h)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			r, g, b, _ := img.At(bounds.Min.X+x, bounds.Min.Y+y).RGBA()
+			lin[y*w+x] = [3]float64{srgbToLinear(r >> 8), srgbToLinear(g >> 8), srgbToLinear(b >> 8)}
+		}
+	}
+
+	factors := make([][3]float64, 0, xComp*yComp)
+	for j := 0; j < yComp; j++ {
+		for i := 0; i < xComp; i++ {
+			norm := 2.0
+			if i == 0 && j == 0 {
+				norm = 1
+			}
+			var f [3]float64
+			for y := 0; y < h; y++ {
+				for x := 0; x < w; x++ {
+					basis := norm * math.Cos(math.Pi*float64(i*x)/float64(w)) *
+						math.Cos(math.Pi*float64(j*y)/float64(h))
+					p := lin[y*w+x]
+					f[0] += basis * p[0]
+					f[1] += basis * p[1]
+					f[2] += basis * p[2]
+				}
+			}
+			scale := 1 / float64(w*h)
+			factors = append(factors, [3]float64{f[0] * scale, f[1] * scale, f[2] * scale})
+		}
+	}
+
+	var hash []byte
+	hash = appendBase83(hash, (xComp-1)+(yComp-1)*9, 1)
+
+	maxVal := 1.0
+	if len(factors) > 1 {
+		var actualMax float64
+		for _, f := range factors[1:] {
+			for _, v := range f {
+				actualMax = math.Max(actualMax, math.Abs(v))
+			}
+		}
+		quantMax := clampInt(int(math.Floor(actualMax*166-0.5)), 0, 82)
+		maxVal = float64(quantMax+1) / 166
+		hash = appendBase83(hash, quantMax, 1)
+	} else {
+		hash = appendBase83(hash, 0, 1)
+	}
+
+	dc := factors[0]
+	hash = appendBase83(hash, linearToSRGB(dc[0])<<16+linearToSRGB(dc[1])<<8+linearToSRGB(dc[2]), 4)
+	for _, f := range factors[1:] {
+		quant := func(v float64) int {
+			return clampInt(int(math.Floor(signPow(v/maxVal, 0.5)*9+9.5)), 0, 18)
+		}
+		hash = appendBase83(hash, quant(f[0])*19*19+quant(f[1])*19+quant(f[2]), 2)
+	}
+	return string(hash), nil
+}
+
+const base83Chars = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~"
+
+// appendBase83 appends val to b as n base-83 digits.
+func appendBase83(b []byte, val, n int) []byte {
+	for i := 1; i <= n; i++ {
+		div := 1
+		for j := 0; j < n-i; j++ {
+			div *= 83
+		}
+		b = append(b, base83Chars[(val/div)%83])
+	}
+	return b
+}
+
+// srgbToLinear converts an 8-bit sRGB value to a linear value in [0, 1].
+func srgbToLinear(v uint32) float64 {
+	f := float64(v) / 255
+	if f <= 0.04045 {
+		return f / 12.92
+	}
+	return math.Pow((f+0.055)/1.055, 2.4)
+}
+
+// linearToSRGB converts a linear value in [0, 1] to an 8-bit sRGB value.
+func linearToSRGB(v float64) int {
+	v = math.Max(0, math.Min(1, v))
+	if v <= 0.0031308 {
+		return int(math.Round(v * 12.92 * 255))
+	}
+	return int(math.Round((1.055*math.Pow(v, 1/2.4) - 0.055) * 255))
+}
+
+// signPow returns |v|^exp with v's sign.
+func signPow(v, exp float64) float64 {
+	return math.Copysign(math.Pow(math.Abs(v), exp), v)
+}
+
+func clampInt(v, min, max int) int {
+	if v < min {
+		return min
+	} else if v > max {
+		return max
+	}
+	return v
+}
@@ -0,0 +1,48 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package update
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestEncodeBlurHash(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 8, 8))
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			img.Set(x, y, color.White)
+		}
+	}
+
+	// A solid white image should have a white DC component.
+	if got, err := encodeBlurHash(img, 1, 1); err != nil {
+		t.Error("encodeBlurHash failed:", err)
+	} else if want := "00TSUA"; got != want {
+		t.Errorf("encodeBlurHash(white, 1, 1) = %q; want %q", got, want)
+	}
+	white, err := encodeBlurHash(img, 4, 3)
+	if err != nil {
+		t.Fatal("encodeBlurHash failed:", err)
+	} else if len(white) != 6+2*11 || white[0] != 'L' || white[2:6] != "TSUA" {
+		t.Errorf("encodeBlurHash(white, 4, 3) = %q; want \"L?TSUA\" followed by 11 AC components", white)
+	}
+
+	// Making half of the image black should change the hash.
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 4; x++ {
+			img.Set(x, y, color.Black)
+		}
+	}
+	if got, err := encodeBlurHash(img, 4, 3); err != nil {
+		t.Error("encodeBlurHash failed:", err)
+	} else if len(got) != len(white) || got == white {
+		t.Errorf("encodeBlurHash(half, 4, 3) = %q; want different %v-char hash", got, len(white))
+	}
+
+	if _, err := encodeBlurHash(img, 0, 3); err == nil {
+		t.Error("encodeBlurHash(img, 0, 3) unexpectedly succeeded")
+	}
+}
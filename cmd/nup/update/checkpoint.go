@@ -0,0 +1,81 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package update
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+// checkpoint records the songs that were successfully sent to the server by a scan-based
+// update that didn't finish (e.g. because the server was unreachable), so that a subsequent
+// update can skip them instead of rereading and resending them.
+type checkpoint struct {
+	// Time is the time at which the interrupted update was started.
+	Time time.Time `json:"time"`
+	// Files contains the paths (relative to config.MusicDir) of songs that were sent.
+	Files []string `json:"files"`
+
+	sent map[string]struct{} // keys are Files
+}
+
+// getCheckpointPath returns the path of the checkpoint file corresponding to the
+// last-update-info file at infoPath.
+func getCheckpointPath(infoPath string) string { return infoPath + ".checkpoint" }
+
+// readCheckpoint JSON-unmarshals a checkpoint from p.
+// If p doesn't exist, an empty checkpoint with the supplied start time is returned.
+func readCheckpoint(p string, start time.Time) (*checkpoint, error) {
+	cp := checkpoint{Time: start}
+	f, err := os.Open(p)
+	if os.IsNotExist(err) {
+		cp.sent = make(map[string]struct{})
+		return &cp, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if err := json.NewDecoder(f).Decode(&cp); err != nil {
+		return nil, err
+	}
+	cp.sent = make(map[string]struct{}, len(cp.Files))
+	for _, fn := range cp.Files {
+		cp.sent[fn] = struct{}{}
+	}
+	return &cp, nil
+}
+
+// add records that the songs with the supplied relative paths were sent.
+func (cp *checkpoint) add(files []string) {
+	for _, fn := range files {
+		if _, ok := cp.sent[fn]; !ok {
+			cp.sent[fn] = struct{}{}
+			cp.Files = append(cp.Files, fn)
+		}
+	}
+}
+
+// sentUnchanged returns true if the song at the supplied relative path was sent by the
+// interrupted update and hasn't been modified since the update was started.
+func (cp *checkpoint) sentUnchanged(rel string, fi os.FileInfo) bool {
+	if _, ok := cp.sent[rel]; !ok {
+		return false
+	}
+	return fi.ModTime().Before(cp.Time) && getCtime(fi).Before(cp.Time)
+}
+
+// write atomically JSON-marshals cp to p.
+func (cp *checkpoint) write(p string) error {
+	b, err := json.Marshal(cp)
+	if err != nil {
+		return err
+	}
+	tmp := p + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, p)
+}
@@ -0,0 +1,69 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package update
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCheckpoint(t *testing.T) {
+	dir := t.TempDir()
+	p := filepath.Join(dir, "checkpoint")
+	start := time.Now().Add(time.Hour) // after the test files' mtimes and ctimes
+
+	cp, err := readCheckpoint(p, start)
+	if err != nil {
+		t.Fatal("readCheckpoint with missing file failed: ", err)
+	}
+	cp.add([]string{"a.mp3", "b.mp3"})
+	cp.add([]string{"b.mp3", "c.mp3"})
+	if err := cp.write(p); err != nil {
+		t.Fatal("write failed: ", err)
+	}
+
+	if cp, err = readCheckpoint(p, time.Now()); err != nil {
+		t.Fatal("readCheckpoint failed: ", err)
+	}
+	if !cp.Time.Equal(start) {
+		t.Errorf("readCheckpoint returned time %v; want %v", cp.Time, start)
+	}
+	if want := []string{"a.mp3", "b.mp3", "c.mp3"}; !reflect.DeepEqual(cp.Files, want) {
+		t.Errorf("readCheckpoint returned files %q; want %q", cp.Files, want)
+	}
+
+	for _, tc := range []struct {
+		rel  string
+		want bool
+	}{
+		{"a.mp3", true},
+		{"d.mp3", false},
+	} {
+		fp := filepath.Join(dir, tc.rel)
+		if err := ioutil.WriteFile(fp, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+		fi, err := os.Stat(fp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := cp.sentUnchanged(tc.rel, fi); got != tc.want {
+			t.Errorf("sentUnchanged(%q) = %v; want %v", tc.rel, got, tc.want)
+		}
+	}
+
+	// Files modified after the update started shouldn't be skipped.
+	cp.Time = time.Now().Add(-time.Hour)
+	fi, err := os.Stat(filepath.Join(dir, "a.mp3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cp.sentUnchanged("a.mp3", fi) {
+		t.Error("sentUnchanged returned true for modified file")
+	}
+}
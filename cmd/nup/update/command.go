@@ -12,11 +12,16 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/derat/nup/cmd/nup/client"
 	"github.com/derat/nup/cmd/nup/client/files"
 	"github.com/derat/nup/cmd/nup/mp3gain"
+	"github.com/derat/nup/cmd/nup/transcode"
 	"github.com/derat/nup/server/cover"
 	"github.com/derat/nup/server/db"
 	"github.com/google/subcommands"
@@ -25,22 +30,39 @@ import (
 type Command struct {
 	Cfg *client.Config
 
+	autoMerge        bool   // merge songs reported by the server as duplicates
 	compareDumpFile  string // path of file with song dumps to compare against
-	deleteAfterMerge bool   // delete source song if mergeSongIDs is true
+	coverBucket      string // GCS bucket to upload extracted covers to
+	deleteAfterMerge bool   // delete source song if mergeSongIDs or autoMerge is true
+	deleteMissing    bool   // delete songs in compareDumpFile without local files
 	deleteSongID     int64  // ID of song to delete
+	detectMoves      bool   // identify moved songs using compareDumpFile
 	dryRun           bool   // print actions instead of doing anything
 	dumpedGainsFile  string // path to dump file with pre-computed gains
+	extractCovers    bool   // extract embedded images when cover files are missing
+	fetchCovers      bool   // download missing covers from coverartarchive.org
+	fetchITunes      bool   // fall back to iTunes Search API when fetchCovers is true
+	force            bool   // don't ask for confirmation for deleteMissing
 	forceGlob        string // files to force updating
 	importJSONFile   string // path to JSON file with Song objects to import
 	importUserData   bool   // replace user data when using importJSONFile
+	jobs             int    // number of simultaneous mp3gain processes
+	library          string // library to update (overrides config)
 	limit            int    // maximum number of songs to update
+	out              client.OutputFlags
 	mergeSongIDs     string // IDs of songs to merge, as "from:to"
 	printCoverID     string // path to song file whose cover ID should be printed
+	ratingScale      string // scale of ratings in importJSONFile
 	reindexSongs     bool   // ask the server to reindex all songs
 	requireCovers    bool   // die if cover images are missing
 	songPathsFile    string // path to list of songs to force updating
+	subdirs          string // comma-separated dirs under music dir to scan
 	testGainInfo     string // hardcoded gain info as "track:album:amp" for testing
+	testRules        bool   // print files changed by each rewrite rule
+	upload           bool   // upload song files to the config's song bucket
 	useFilenames     bool   // use filenames instead of SHA1s to identify songs
+	watch            bool   // watch for changes after updating
+	watchDelay       time.Duration
 }
 
 func (*Command) Name() string     { return "update" }
@@ -53,43 +75,86 @@ func (*Command) Usage() string {
 }
 
 func (cmd *Command) SetFlags(f *flag.FlagSet) {
+	f.BoolVar(&cmd.autoMerge, "auto-merge", false,
+		"Merge user data from songs that the server reports as duplicates into songs with local files")
 	f.StringVar(&cmd.compareDumpFile, "compare-dump-file", "", "Path to JSON file with songs to compare updates against")
-	f.BoolVar(&cmd.deleteAfterMerge, "delete-after-merge", false, "Delete source song if -merge-songs is true")
+	f.StringVar(&cmd.coverBucket, "cover-bucket", "",
+		"Google Cloud Storage bucket to upload covers written by -extract-covers and -fetch-covers to")
+	f.BoolVar(&cmd.deleteAfterMerge, "delete-after-merge", false, "Delete source song if -merge-songs or -auto-merge is true")
+	f.BoolVar(&cmd.deleteMissing, "delete-missing", false,
+		"Delete songs in -compare-dump-file whose files are missing from the music dir")
 	f.Int64Var(&cmd.deleteSongID, "delete-song", 0, "Delete song with given ID")
+	f.BoolVar(&cmd.detectMoves, "detect-moves", false,
+		"Send songs moved within the music dir without reading them, using -compare-dump-file to find old paths")
 	f.BoolVar(&cmd.dryRun, "dry-run", false, "Only print what would be updated")
 	f.StringVar(&cmd.dumpedGainsFile, "dumped-gains-file", "",
 		"Path to dump file from which songs' gains will be read (instead of being computed)")
+	f.BoolVar(&cmd.extractCovers, "extract-covers", false,
+		"Write images embedded in song files to the cover dir when cover files are missing")
+	f.BoolVar(&cmd.fetchCovers, "fetch-covers", false,
+		"Download missing covers for songs with album IDs from coverartarchive.org to the cover dir")
+	f.BoolVar(&cmd.fetchITunes, "fetch-covers-itunes", false,
+		"Fall back to searching iTunes by artist and album for -fetch-covers")
+	f.BoolVar(&cmd.force, "force", false, "Don't ask for confirmation before deleting songs for -delete-missing")
 	f.StringVar(&cmd.forceGlob, "force-glob", "",
 		"Glob pattern relative to music dir for files to scan and update even if they haven't changed")
 	f.StringVar(&cmd.importJSONFile, "import-json-file", "", "Path to JSON file with songs to import")
 	f.BoolVar(&cmd.importUserData, "import-user-data", true,
 		"When importing from JSON, replace user data (ratings, tags, plays, etc.)")
+	f.IntVar(&cmd.jobs, "jobs", runtime.NumCPU(),
+		"Number of songs' gain adjustments to compute in parallel (song files are also read in parallel)")
+	f.StringVar(&cmd.library, "library", "",
+		"Name of server library to update (overrides config's library)")
 	f.IntVar(&cmd.limit, "limit", 0, "Limit the number of songs to update (for testing)")
+	cmd.out.SetFlags(f)
 	f.StringVar(&cmd.mergeSongIDs, "merge-songs", "",
 		`Merge one song's user data into another song, with IDs as "src:dst"`)
 	f.StringVar(&cmd.printCoverID, "print-cover-id", "", `Print cover ID for specified song file`)
+	f.StringVar(&cmd.ratingScale, "rating-scale", string(db.AutoRatingScale),
+		`Scale of ratings in -import-json-file ("stars" for 0-5 ints, "legacy" for 0.0-1.0 floats, `+
+			`or "auto" to detect; dumps with only 0 and 1 ratings are treated as "stars")`)
 	f.BoolVar(&cmd.reindexSongs, "reindex-songs", false,
 		"Ask server to reindex all songs' search-related fields (not typically needed)")
 	f.BoolVar(&cmd.requireCovers, "require-covers", false,
 		"Die if cover images aren't found for any songs that have album IDs")
 	f.StringVar(&cmd.songPathsFile, "song-paths-file", "",
 		"Path to file with one relative path per line for songs to force updating")
+	f.StringVar(&cmd.subdirs, "subdir", "",
+		"Comma-separated directories relative to music dir to scan instead of the whole music dir")
 	f.StringVar(&cmd.testGainInfo, "test-gain-info", "",
 		"Hardcoded gain info as \"track:album:amp\" (for testing)")
+	f.BoolVar(&cmd.testRules, "test-rules", false,
+		"Print files in the music dir (or -subdir) that each of the config's rewriteRules would change")
+	f.BoolVar(&cmd.upload, "upload", false,
+		"Upload new and changed song files to the config's songBucket (transcoding FLAC files if "+
+			"transcodeFormat is set)")
 	f.BoolVar(&cmd.useFilenames, "use-filenames", false,
 		"Identify songs by filename rather than audio data hash (useful when modifying files)")
+	f.BoolVar(&cmd.watch, "watch", false,
+		"After updating, watch the music dir and send new or modified songs to the server")
+	f.DurationVar(&cmd.watchDelay, "watch-delay", 10*time.Second,
+		"Time to wait after the last change before sending songs in -watch mode")
 }
 
 func (cmd *Command) Execute(ctx context.Context, _ *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
-	if countBools(cmd.deleteSongID > 0, cmd.importJSONFile != "", cmd.mergeSongIDs != "",
-		cmd.printCoverID != "", cmd.reindexSongs, cmd.songPathsFile != "") > 1 {
-		fmt.Fprintln(os.Stderr, "-delete-song, -import-json-file, -merge-songs, -print-cover-id, "+
-			"-reindex-songs, and -song-paths-file are mutually exclusive")
+	if countBools(cmd.autoMerge, cmd.deleteMissing, cmd.deleteSongID > 0, cmd.importJSONFile != "",
+		cmd.mergeSongIDs != "", cmd.printCoverID != "", cmd.reindexSongs, cmd.songPathsFile != "",
+		cmd.testRules) > 1 {
+		fmt.Fprintln(os.Stderr, "-auto-merge, -delete-missing, -delete-song, -import-json-file, -merge-songs, "+
+			"-print-cover-id, -reindex-songs, -song-paths-file, and -test-rules are mutually exclusive")
 		return subcommands.ExitUsageError
 	}
 
+	if cmd.library != "" {
+		cmd.Cfg.Library = cmd.library
+	}
+
 	// Handle flags that don't use the normal update process.
 	switch {
+	case cmd.autoMerge:
+		return cmd.doAutoMerge()
+	case cmd.deleteMissing:
+		return cmd.doDeleteMissing()
 	case cmd.deleteSongID > 0:
 		return cmd.doDeleteSong()
 	case cmd.mergeSongIDs != "":
@@ -98,6 +163,8 @@ func (cmd *Command) Execute(ctx context.Context, _ *flag.FlagSet, _ ...interface
 		return cmd.doPrintCoverID()
 	case cmd.reindexSongs:
 		return cmd.doReindexSongs()
+	case cmd.testRules:
+		return cmd.doTestRules()
 	}
 
 	var err error
@@ -105,9 +172,63 @@ func (cmd *Command) Execute(ctx context.Context, _ *flag.FlagSet, _ ...interface
 	var scannedDirs []string
 	var replaceUserData, didFullScan bool
 	var oldSongs map[string]*db.Song
+	var oldInfo lastUpdateInfo // last-update info read before scanning
+	var cp *checkpoint         // non-nil when checkpointing a scan-based update
+	var cpPath string
+	var opts scanOptions
+	var w *watcher
 	readChan := make(chan songOrErr)
 	startTime := time.Now()
 
+	// Songs are written to stdout in dry-run mode, so write results to stderr instead.
+	out := os.Stdout
+	if cmd.dryRun {
+		out = os.Stderr
+	}
+	var rep *client.Reporter
+	if rep, err = cmd.out.NewReporter(out); err != nil {
+		fmt.Fprintln(os.Stderr, "Bad output flags:", err)
+		return subcommands.ExitUsageError
+	}
+	rep.LogText = true
+
+	if cmd.jobs <= 0 {
+		fmt.Fprintln(os.Stderr, "-jobs must be positive")
+		return subcommands.ExitUsageError
+	}
+	if cmd.fetchITunes && !cmd.fetchCovers {
+		fmt.Fprintln(os.Stderr, "-fetch-covers-itunes requires -fetch-covers")
+		return subcommands.ExitUsageError
+	}
+	subdirs, err := parseSubdirs(cmd.subdirs)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Bad -subdir:", err)
+		return subcommands.ExitUsageError
+	}
+	if len(subdirs) > 0 && (cmd.watch || cmd.importJSONFile != "" || cmd.songPathsFile != "" || cmd.forceGlob != "") {
+		fmt.Fprintln(os.Stderr, "-subdir is incompatible with -watch, -import-json-file, -song-paths-file, and -force-glob")
+		return subcommands.ExitUsageError
+	}
+	if cmd.detectMoves && (cmd.compareDumpFile == "" || cmd.useFilenames || cmd.importJSONFile != "") {
+		fmt.Fprintln(os.Stderr, "-detect-moves requires -compare-dump-file and is incompatible with "+
+			"-use-filenames and -import-json-file")
+		return subcommands.ExitUsageError
+	}
+	if cmd.watch && (cmd.importJSONFile != "" || cmd.songPathsFile != "" || cmd.limit > 0) {
+		fmt.Fprintln(os.Stderr, "-watch is incompatible with -import-json-file, -song-paths-file, and -limit")
+		return subcommands.ExitUsageError
+	}
+	if cmd.upload && (cmd.Cfg.SongBucket == "" || cmd.importJSONFile != "") {
+		fmt.Fprintln(os.Stderr, "-upload requires songBucket in config and is incompatible with -import-json-file")
+		return subcommands.ExitUsageError
+	}
+
+	ratingScale, err := db.ParseRatingScale(cmd.ratingScale)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Bad -rating-scale:", err)
+		return subcommands.ExitUsageError
+	}
+
 	if cmd.testGainInfo != "" {
 		var info mp3gain.Info
 		if _, err := fmt.Sscanf(cmd.testGainInfo, "%f:%f:%f",
@@ -126,7 +247,7 @@ func (cmd *Command) Execute(ctx context.Context, _ *flag.FlagSet, _ ...interface
 	}
 
 	if len(cmd.importJSONFile) > 0 {
-		if numSongs, err = readSongsFromJSONFile(cmd.importJSONFile, readChan); err != nil {
+		if numSongs, err = readSongsFromJSONFile(cmd.importJSONFile, ratingScale, readChan); err != nil {
 			fmt.Fprintln(os.Stderr, "Failed reading songs:", err)
 			return subcommands.ExitFailure
 		}
@@ -139,10 +260,14 @@ func (cmd *Command) Execute(ctx context.Context, _ *flag.FlagSet, _ ...interface
 
 		// Not all these options will necessarily be used (e.g. readSongList doesn't need forceGlob
 		// or logProgress), but it doesn't hurt to pass them.
-		opts := scanOptions{
+		opts = scanOptions{
 			forceGlob:       cmd.forceGlob,
 			logProgress:     true,
 			dumpedGainsPath: cmd.dumpedGainsFile,
+			jobs:            cmd.jobs,
+		}
+		if cmd.detectMoves {
+			opts.moves = newMoveDetector(cmd.Cfg.MusicDir, oldSongs)
 		}
 
 		if len(cmd.songPathsFile) > 0 {
@@ -161,7 +286,33 @@ func (cmd *Command) Execute(ctx context.Context, _ *flag.FlagSet, _ ...interface
 				fmt.Fprintln(os.Stderr, "Unable to get last update info:", err)
 				return subcommands.ExitFailure
 			}
-			log.Printf("Scanning for songs in %v updated since %v", cmd.Cfg.MusicDir, info.Time.Local())
+			oldInfo = info
+			opts.subdirs = subdirs
+			opts.dirTimes = info.DirTimes
+			if !cmd.dryRun {
+				cpPath = getCheckpointPath(cmd.Cfg.LastUpdateInfoFile)
+				if cp, err = readCheckpoint(cpPath, startTime); err != nil {
+					fmt.Fprintln(os.Stderr, "Unable to read checkpoint:", err)
+					return subcommands.ExitFailure
+				}
+				if len(cp.Files) > 0 {
+					log.Printf("Resuming update started at %v", cp.Time.Local())
+				}
+				opts.checkpoint = cp
+			}
+			if cmd.watch {
+				// Start watching before scanning so we won't miss any changes made during the scan.
+				if w, err = newWatcher(cmd.Cfg.MusicDir, cmd.Cfg.TranscodeFormat != ""); err != nil {
+					fmt.Fprintln(os.Stderr, "Failed watching music dir:", err)
+					return subcommands.ExitFailure
+				}
+				defer w.close()
+			}
+			scanDesc := cmd.Cfg.MusicDir
+			if len(subdirs) > 0 {
+				scanDesc = strings.Join(subdirs, ", ") + " in " + scanDesc
+			}
+			log.Printf("Scanning for songs in %v updated since %v", scanDesc, info.Time.Local())
 			numSongs, scannedDirs, err = scanForUpdatedSongs(cmd.Cfg, info.Time, info.Dirs, readChan, &opts)
 			if err != nil {
 				fmt.Fprintln(os.Stderr, "Scanning failed:", err)
@@ -175,12 +326,192 @@ func (cmd *Command) Execute(ctx context.Context, _ *flag.FlagSet, _ ...interface
 		numSongs = cmd.limit
 	}
 
-	log.Printf("Processing %v song(s)", numSongs)
+	rep.Textf("Processing %v song(s)", numSongs)
+	rep.AddTotal(numSongs)
+
+	var uploader *coverUploader
+	if cmd.coverBucket != "" {
+		if uploader, err = newCoverUploader(ctx, cmd.coverBucket); err != nil {
+			fmt.Fprintln(os.Stderr, "Failed creating cover uploader:", err)
+			return subcommands.ExitFailure
+		}
+		defer uploader.close()
+	}
+	var songUp *songUploader
+	if cmd.upload && !cmd.dryRun {
+		if songUp, err = newSongUploader(ctx, cmd.Cfg); err != nil {
+			fmt.Fprintln(os.Stderr, "Failed creating song uploader:", err)
+			return subcommands.ExitFailure
+		}
+		defer songUp.close()
+	}
+	var fetcher *coverFetcher
+	if cmd.fetchCovers {
+		if cmd.Cfg.CoverDir == "" {
+			fmt.Fprintln(os.Stderr, "-fetch-covers requires coverDir in config")
+			return subcommands.ExitUsageError
+		}
+		itunesURL := ""
+		if cmd.fetchITunes {
+			itunesURL = defaultITunesURL
+		}
+		fetcher = newCoverFetcher(defaultCAAURL, itunesURL)
+	}
+
+	var onBatch func([]db.Song) error
+	if cp != nil {
+		// Record the songs that have been sent so far so they can be skipped
+		// if this update is interrupted and then rerun.
+		onBatch = func(songs []db.Song) error {
+			fns := make([]string, len(songs))
+			for i, s := range songs {
+				fns[i] = s.Filename
+			}
+			cp.add(fns)
+			return cp.write(cpPath)
+		}
+	}
+	if err := cmd.sendSongs(ctx, rep, readChan, numSongs, oldSongs, uploader, songUp, fetcher,
+		replaceUserData, onBatch); err != nil {
+		fmt.Fprintln(os.Stderr, "Update failed:", err)
+		return subcommands.ExitFailure
+	}
+
+	if !cmd.dryRun && didFullScan {
+		info := lastUpdateInfo{Time: startTime, Dirs: scannedDirs}
+		if len(subdirs) > 0 {
+			info = oldInfo.mergePartialScan(subdirs, scannedDirs, startTime)
+		}
+		if err := writeLastUpdateInfo(cmd.Cfg.LastUpdateInfoFile, info); err != nil {
+			fmt.Fprintln(os.Stderr, "Failed saving update info:", err)
+			return subcommands.ExitFailure
+		}
+		if err := os.Remove(cpPath); err != nil && !os.IsNotExist(err) {
+			fmt.Fprintln(os.Stderr, "Failed removing checkpoint:", err)
+			return subcommands.ExitFailure
+		}
+	}
+	rep.Summary()
+
+	if w != nil {
+		opts.checkpoint = nil
+		if err := cmd.watchForUpdates(ctx, rep, w, uploader, songUp, fetcher, &opts, scannedDirs); err != nil {
+			fmt.Fprintln(os.Stderr, "Watching failed:", err)
+			return subcommands.ExitFailure
+		}
+	}
+	return subcommands.ExitSuccess
+}
 
+// watchForUpdates uses w to watch for new and modified song files and sends them to the
+// server once cmd.watchDelay has elapsed without further changes. dirs contains the
+// directories seen by the initial scan. This method only returns on failure.
+func (cmd *Command) watchForUpdates(ctx context.Context, rep *client.Reporter, w *watcher,
+	uploader *coverUploader, songUp *songUploader, fetcher *coverFetcher, opts *scanOptions,
+	dirs []string) error {
+	type readResult struct {
+		paths []string
+		err   error
+	}
+	readChan := make(chan readResult)
+	go func() {
+		for {
+			paths, err := w.read()
+			readChan <- readResult{paths, err}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	seenDirs := make(map[string]struct{}, len(dirs))
+	for _, d := range dirs {
+		seenDirs[d] = struct{}{}
+	}
+
+	pending := make(map[string]struct{}) // relative paths of changed songs
+	var firstChange time.Time            // time at which first pending change was seen
+	var timer <-chan time.Time
+	log.Printf("Watching %v for changes", cmd.Cfg.MusicDir)
+	for {
+		select {
+		case res := <-readChan:
+			if res.err != nil {
+				return res.err
+			}
+			for _, p := range res.paths {
+				rel, err := filepath.Rel(cmd.Cfg.MusicDir, p)
+				if err != nil {
+					return err
+				}
+				pending[rel] = struct{}{}
+			}
+			if len(pending) > 0 {
+				if firstChange.IsZero() {
+					firstChange = time.Now()
+				}
+				timer = time.After(cmd.watchDelay)
+			}
+		case <-timer:
+			var paths []string
+			for rel := range pending {
+				// Skip files that were deleted or renamed after they were written.
+				if _, err := os.Stat(filepath.Join(cmd.Cfg.MusicDir, rel)); err == nil {
+					paths = append(paths, rel)
+				}
+			}
+			sort.Strings(paths)
+			changeTime := firstChange
+			pending = make(map[string]struct{})
+			firstChange = time.Time{}
+			timer = nil
+			if len(paths) == 0 {
+				continue
+			}
+
+			ch := make(chan songOrErr, len(paths))
+			numSongs, err := readSongPaths(cmd.Cfg, paths, ch, opts)
+			if err != nil {
+				return err
+			}
+			rep.Textf("Processing %v changed song(s)", numSongs)
+			rep.AddTotal(numSongs)
+			if err := cmd.sendSongs(ctx, rep, ch, numSongs, nil, uploader, songUp, fetcher, false, nil); err != nil {
+				return err
+			}
+
+			// Update the last-update info so that the next normal update won't need to
+			// rescan these songs. Later changes were seen after changeTime, so they'll
+			// still be picked up if watching is interrupted.
+			if !cmd.dryRun {
+				for _, p := range paths {
+					seenDirs[filepath.Dir(p)] = struct{}{}
+				}
+				info := lastUpdateInfo{Time: changeTime}
+				for d := range seenDirs {
+					info.Dirs = append(info.Dirs, d)
+				}
+				sort.Strings(info.Dirs)
+				if err := writeLastUpdateInfo(cmd.Cfg.LastUpdateInfoFile, info); err != nil {
+					return fmt.Errorf("failed saving update info: %v", err)
+				}
+			}
+		}
+	}
+}
+
+// sendSongs reads numSongs songs from readChan, looks up their covers, uploads their files
+// if songUp is non-nil, and sends them to the server (or writes them to stdout if cmd.dryRun
+// is true). Songs whose metadata matches oldSongs are skipped. uploader, songUp, fetcher, and
+// onBatch may be nil; onBatch is passed to importSongs.
+func (cmd *Command) sendSongs(ctx context.Context, rep *client.Reporter, readChan chan songOrErr,
+	numSongs int, oldSongs map[string]*db.Song, uploader *coverUploader, songUp *songUploader,
+	fetcher *coverFetcher, replaceUserData bool, onBatch func([]db.Song) error) error {
 	// Look up covers and feed songs to the updater.
 	updateChan := make(chan db.Song)
 	errChan := make(chan error, 1)
 	go func() {
+		summaries := make(map[string]coverSummary) // keyed by cover filename
 		for i := 0; i < numSongs; i++ {
 			soe := <-readChan
 			if soe.err != nil {
@@ -192,12 +523,85 @@ func (cmd *Command) Execute(ctx context.Context, _ *flag.FlagSet, _ ...interface
 				break
 			}
 			s := *soe.song
+			src := s.Filename // path relative to music dir
+			if files.IsLosslessPath(src) {
+				// Lossless files are sent to the server with their transcoded files' names.
+				s.Filename = transcode.ObjectName(src, cmd.Cfg.TranscodeFormat)
+			}
+			if songUp != nil {
+				if uploaded, err := songUp.upload(ctx, src, &s); err != nil {
+					errChan <- fmt.Errorf("failed uploading %v: %v", src, err)
+					break
+				} else if uploaded {
+					rep.Textf("Uploaded %v", s.Filename)
+					rep.Count("uploadedSongs", 1)
+				}
+			}
+			if soe.moved {
+				// Moved songs already have the server's cover and metadata,
+				// so just send them with their new filenames.
+				rep.Item(s.Filename, "moved", "Sending moved "+s.Filename)
+				rep.Advance(1)
+				s.Rating = 0
+				s.Tags = nil
+				s.Plays = nil
+				updateChan <- s
+				continue
+			}
 			s.CoverFilename = getCoverFilename(cmd.Cfg.CoverDir, &s)
+			ids := getCoverIDs(&s)
+			var newCover string // cover written to cmd.Cfg.CoverDir
+			if s.CoverFilename == "" && cmd.extractCovers && !cmd.dryRun && len(ids) > 0 {
+				p := filepath.Join(cmd.Cfg.MusicDir, src)
+				if fn, err := extractCover(p, cmd.Cfg.CoverDir, ids[0]); err != nil {
+					log.Printf("Failed extracting cover from %v: %v", s.Filename, err)
+				} else if fn != "" {
+					rep.Textf("Extracted cover %v from %v", fn, s.Filename)
+					rep.Count("extractedCovers", 1)
+					newCover = fn
+				}
+			}
+			if s.CoverFilename == "" && newCover == "" && fetcher != nil && !cmd.dryRun && s.AlbumID != "" {
+				artist := s.AlbumArtist
+				if artist == "" {
+					artist = s.Artist
+				}
+				if fn, src, err := fetcher.fetch(ctx, cmd.Cfg.CoverDir, s.AlbumID, artist, s.Album); err != nil {
+					log.Printf("Failed fetching cover for %v: %v", s.Filename, err)
+				} else if fn != "" {
+					rep.Textf("Fetched cover %v from %v", fn, src)
+					rep.Count("fetchedCovers", 1)
+					newCover = fn
+				}
+			}
+			if newCover != "" {
+				s.CoverFilename = newCover
+				if uploader != nil {
+					if err := uploader.upload(ctx, cmd.Cfg.CoverDir, newCover); err != nil {
+						errChan <- fmt.Errorf("failed uploading %v: %v", newCover, err)
+						break
+					}
+				}
+			}
+			if s.CoverFilename != "" {
+				sum, ok := summaries[s.CoverFilename]
+				if !ok {
+					var err error
+					if sum, err = summarizeCover(cmd.Cfg.CoverDir, s.CoverFilename); err != nil {
+						log.Printf("Failed summarizing %v: %v", s.CoverFilename, err)
+					}
+					summaries[s.CoverFilename] = sum
+				}
+				s.CoverBlurHash = sum.blurHash
+				s.CoverPalette = sum.palette
+			}
 			if cmd.requireCovers && len(s.CoverFilename) == 0 && (len(s.AlbumID) > 0 || len(s.CoverID) > 0) {
 				errChan <- fmt.Errorf("missing cover for %v (album=%v, cover=%v)", s.Filename, s.AlbumID, s.CoverID)
 				break
 			}
-			s.RecordingID = ""
+			if cmd.Cfg.Library != "" {
+				s.Library = cmd.Cfg.Library
+			}
 
 			// Check that the metadata actually changed to avoid unnecessary datastore writes.
 			key := s.SHA1
@@ -205,7 +609,8 @@ func (cmd *Command) Execute(ctx context.Context, _ *flag.FlagSet, _ ...interface
 				key = s.Filename
 			}
 			if old, ok := oldSongs[key]; ok && s.MetadataEquals(old) {
-				log.Print("Skipping unchanged ", s.Filename)
+				rep.Item(s.Filename, "unchanged", "Skipping unchanged "+s.Filename)
+				rep.Advance(1)
 				continue
 			}
 
@@ -216,7 +621,8 @@ func (cmd *Command) Execute(ctx context.Context, _ *flag.FlagSet, _ ...interface
 				s.Plays = nil
 			}
 
-			log.Print("Sending ", s.Filename)
+			rep.Item(s.Filename, "sent", "Sending "+s.Filename)
+			rep.Advance(1)
 			updateChan <- s
 		}
 		close(updateChan)
@@ -227,8 +633,7 @@ func (cmd *Command) Execute(ctx context.Context, _ *flag.FlagSet, _ ...interface
 		enc := json.NewEncoder(os.Stdout)
 		for s := range updateChan {
 			if err := enc.Encode(s); err != nil {
-				fmt.Fprintln(os.Stderr, "Failed encoding song:", err)
-				return subcommands.ExitFailure
+				return fmt.Errorf("failed encoding song: %v", err)
 			}
 		}
 	} else {
@@ -239,27 +644,15 @@ func (cmd *Command) Execute(ctx context.Context, _ *flag.FlagSet, _ ...interface
 		if cmd.useFilenames {
 			flags |= importUseFilenames
 		}
-		if err := importSongs(cmd.Cfg, updateChan, flags); err != nil {
-			fmt.Fprintln(os.Stderr, "Failed updating songs:", err)
-			return subcommands.ExitFailure
+		if err := importSongs(cmd.Cfg, updateChan, flags, onBatch); err != nil {
+			return fmt.Errorf("failed updating songs: %v", err)
 		}
 	}
 
 	if err := <-errChan; err != nil {
-		fmt.Fprintln(os.Stderr, "Failed scanning song files:", err)
-		return subcommands.ExitFailure
+		return fmt.Errorf("failed scanning song files: %v", err)
 	}
-
-	if !cmd.dryRun && didFullScan {
-		if err := writeLastUpdateInfo(cmd.Cfg.LastUpdateInfoFile, lastUpdateInfo{
-			Time: startTime,
-			Dirs: scannedDirs,
-		}); err != nil {
-			fmt.Fprintln(os.Stderr, "Failed saving update info:", err)
-			return subcommands.ExitFailure
-		}
-	}
-	return subcommands.ExitSuccess
+	return nil
 }
 
 func (cmd *Command) doDeleteSong() subcommands.ExitStatus {
@@ -284,16 +677,81 @@ func (cmd *Command) doMergeSongs() subcommands.ExitStatus {
 		fmt.Fprintf(os.Stderr, "Can't merge song %d into itself\n", srcID)
 		return subcommands.ExitUsageError
 	}
+	if err := cmd.mergeSong(srcID, dstID); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return subcommands.ExitFailure
+	}
+	return subcommands.ExitSuccess
+}
 
+func (cmd *Command) doAutoMerge() subcommands.ExitStatus {
+	groups, err := getMergeCandidates(cmd.Cfg)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed getting merge candidates:", err)
+		return subcommands.ExitFailure
+	}
+	for _, group := range groups {
+		dst, srcs, err := pickMergeDest(group, func(fn string) bool {
+			_, err := os.Stat(filepath.Join(cmd.Cfg.MusicDir, fn))
+			return err == nil
+		})
+		if err != nil {
+			log.Printf("Skipping %q by %q: %v", group[0].Title, group[0].Artist, err)
+			continue
+		}
+		dstID, err := strconv.ParseInt(dst.SongID, 10, 64)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Bad song ID %q: %v\n", dst.SongID, err)
+			return subcommands.ExitFailure
+		}
+		for _, src := range srcs {
+			srcID, err := strconv.ParseInt(src.SongID, 10, 64)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Bad song ID %q: %v\n", src.SongID, err)
+				return subcommands.ExitFailure
+			}
+			log.Printf("Merging song %v (%v) into %v (%v)", srcID, src.Filename, dstID, dst.Filename)
+			if err := cmd.mergeSong(srcID, dstID); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				return subcommands.ExitFailure
+			}
+		}
+	}
+	return subcommands.ExitSuccess
+}
+
+// pickMergeDest chooses the song in group that other songs' user data should be merged into.
+// exists is called to check whether a song's file exists within the music dir. An error is
+// returned unless exactly one song's file exists.
+func pickMergeDest(group []db.Song, exists func(fn string) bool) (
+	dst db.Song, srcs []db.Song, err error) {
+	var found bool
+	for _, s := range group {
+		if exists(s.Filename) {
+			if found {
+				return dst, nil, fmt.Errorf("multiple songs have files")
+			}
+			dst, found = s, true
+		} else {
+			srcs = append(srcs, s)
+		}
+	}
+	if !found {
+		return dst, nil, fmt.Errorf("no songs have files")
+	}
+	return dst, srcs, nil
+}
+
+// mergeSong merges the user data from the song identified by srcID into the song identified
+// by dstID. If cmd.deleteAfterMerge is true, the source song is deleted afterward.
+func (cmd *Command) mergeSong(srcID, dstID int64) error {
 	var err error
 	var src, dst db.Song
 	if src, err = dumpSong(cmd.Cfg, srcID); err != nil {
-		fmt.Fprintf(os.Stderr, "Failed dumping song %v: %v\n", srcID, err)
-		return subcommands.ExitFailure
+		return fmt.Errorf("failed dumping song %v: %v", srcID, err)
 	}
 	if dst, err = dumpSong(cmd.Cfg, dstID); err != nil {
-		fmt.Fprintf(os.Stderr, "Failed dumping song %v: %v\n", dstID, err)
-		return subcommands.ExitFailure
+		return fmt.Errorf("failed dumping song %v: %v", dstID, err)
 	}
 	if src.Rating > dst.Rating {
 		dst.Rating = src.Rating
@@ -304,25 +762,23 @@ func (cmd *Command) doMergeSongs() subcommands.ExitStatus {
 
 	if cmd.dryRun {
 		if err := json.NewEncoder(os.Stdout).Encode(dst); err != nil {
-			fmt.Fprintln(os.Stderr, "Failed encoding song:", err)
-			return subcommands.ExitFailure
-		}
-	} else {
-		ch := make(chan db.Song, 1)
-		ch <- dst
-		close(ch)
-		if err := importSongs(cmd.Cfg, ch, importReplaceUserData); err != nil {
-			fmt.Fprintf(os.Stderr, "Failed updating song %v: %v\n", dstID, err)
-			return subcommands.ExitFailure
+			return fmt.Errorf("failed encoding song: %v", err)
 		}
-		if cmd.deleteAfterMerge {
-			if err := deleteSong(cmd.Cfg, srcID); err != nil {
-				fmt.Fprintf(os.Stderr, "Failed deleting song %v: %v\n", srcID, err)
-				return subcommands.ExitFailure
-			}
+		return nil
+	}
+
+	ch := make(chan db.Song, 1)
+	ch <- dst
+	close(ch)
+	if err := importSongs(cmd.Cfg, ch, importReplaceUserData, nil); err != nil {
+		return fmt.Errorf("failed updating song %v: %v", dstID, err)
+	}
+	if cmd.deleteAfterMerge {
+		if err := deleteSong(cmd.Cfg, srcID); err != nil {
+			return fmt.Errorf("failed deleting song %v: %v", srcID, err)
 		}
 	}
-	return subcommands.ExitSuccess
+	return nil
 }
 
 func (cmd *Command) doPrintCoverID() subcommands.ExitStatus {
@@ -360,9 +816,83 @@ func (cmd *Command) doReindexSongs() subcommands.ExitStatus {
 	return subcommands.ExitSuccess
 }
 
+// doTestRules reads song files in the music dir (or in cmd.subdirs) and prints the
+// files that each of the config's rewrite rules would change.
+func (cmd *Command) doTestRules() subcommands.ExitStatus {
+	if cmd.Cfg.MusicDir == "" {
+		fmt.Fprintln(os.Stderr, "musicDir not set in config")
+		return subcommands.ExitUsageError
+	}
+	rules := cmd.Cfg.RewriteRules
+	if len(rules) == 0 {
+		fmt.Fprintln(os.Stderr, "rewriteRules not set in config")
+		return subcommands.ExitUsageError
+	}
+	subdirs, err := parseSubdirs(cmd.subdirs)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Bad -subdir:", err)
+		return subcommands.ExitUsageError
+	}
+	dirs := []string{cmd.Cfg.MusicDir}
+	if len(subdirs) > 0 {
+		dirs = dirs[:0]
+		for _, d := range subdirs {
+			dirs = append(dirs, filepath.Join(cmd.Cfg.MusicDir, d))
+		}
+	}
+
+	changes := make([][]string, len(rules)) // "[path]: [change]" for each rule
+	var numErrs int
+	for _, dir := range dirs {
+		if err := filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if !fi.Mode().IsRegular() || !files.IsMusicPath(p) {
+				return nil
+			}
+			// Read the original metadata so the rules can be applied in order.
+			s, err := files.ReadSong(cmd.Cfg, p, fi, files.SkipAudioData|files.OnlyFileMetadata, nil)
+			if err != nil {
+				log.Printf("Failed reading %v: %v", p, err)
+				numErrs++
+				return nil
+			}
+			for i := range rules {
+				if change, err := rules[i].Apply(s); err != nil {
+					return fmt.Errorf("rule %d: %v", i, err)
+				} else if change != "" {
+					changes[i] = append(changes[i], s.Filename+": "+change)
+				}
+			}
+			return nil
+		}); err != nil {
+			fmt.Fprintln(os.Stderr, "Failed testing rules:", err)
+			return subcommands.ExitFailure
+		}
+	}
+
+	for i, r := range rules {
+		b, err := json.Marshal(r)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Failed marshaling rule:", err)
+			return subcommands.ExitFailure
+		}
+		fmt.Printf("Rule %d %s: %d file(s)\n", i, b, len(changes[i]))
+		for _, ch := range changes[i] {
+			fmt.Println("  " + ch)
+		}
+	}
+	if numErrs > 0 {
+		return subcommands.ExitFailure
+	}
+	return subcommands.ExitSuccess
+}
+
 type songOrErr struct {
-	song *db.Song
-	err  error
+	song  *db.Song
+	err   error
+	moved bool // song is a dumped song that was moved to a new path (see moveDetector)
 }
 
 func countBools(vals ...bool) int {
@@ -382,6 +912,57 @@ type lastUpdateInfo struct {
 	Time time.Time `json:"time"`
 	// Dirs contains all song-containing directories that were seen (relative to config.MusicDir).
 	Dirs []string `json:"dirs"`
+	// DirTimes contains the times at which directories in Dirs were scanned by partial
+	// updates (see -subdir) that were started after Time.
+	DirTimes map[string]time.Time `json:"dirTimes,omitempty"`
+}
+
+// mergePartialScan returns a copy of info updated to reflect a partial update started at t
+// that scanned subdirs (relative to config.MusicDir) and saw the song-containing directories
+// in dirs. Time is left unchanged since other directories weren't scanned.
+func (info lastUpdateInfo) mergePartialScan(subdirs, dirs []string, t time.Time) lastUpdateInfo {
+	inSubdir := func(d string) bool {
+		for _, sd := range subdirs {
+			if d == sd || strings.HasPrefix(d, sd+"/") {
+				return true
+			}
+		}
+		return false
+	}
+	merged := lastUpdateInfo{Time: info.Time, DirTimes: make(map[string]time.Time)}
+	// Directories within subdirs that weren't seen by the scan must have been removed.
+	for _, d := range info.Dirs {
+		if !inSubdir(d) {
+			merged.Dirs = append(merged.Dirs, d)
+		}
+	}
+	for d, dt := range info.DirTimes {
+		if !inSubdir(d) && dt.After(info.Time) {
+			merged.DirTimes[d] = dt
+		}
+	}
+	for _, d := range dirs {
+		merged.Dirs = append(merged.Dirs, d)
+		merged.DirTimes[d] = t
+	}
+	sort.Strings(merged.Dirs)
+	return merged
+}
+
+// parseSubdirs parses a comma-separated list of directories relative to config.MusicDir.
+func parseSubdirs(s string) ([]string, error) {
+	var dirs []string
+	for _, d := range strings.Split(s, ",") {
+		if d = strings.TrimSpace(d); d == "" {
+			continue
+		}
+		d = filepath.Clean(d)
+		if filepath.IsAbs(d) || d == "." || d == ".." || strings.HasPrefix(d, "../") {
+			return nil, fmt.Errorf("%q isn't a subdirectory of the music dir", d)
+		}
+		dirs = append(dirs, d)
+	}
+	return dirs, nil
 }
 
 // readLastUpdateInfo JSON-unmarshals a lastUpdateInfo struct from the file at p.
@@ -0,0 +1,57 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package update
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseSubdirs(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want []string
+		ok   bool
+	}{
+		{"", nil, true},
+		{"a", []string{"a"}, true},
+		{"a/b/, c ,", []string{"a/b", "c"}, true},
+		{"a/../b", []string{"b"}, true},
+		{".", nil, false},
+		{"../a", nil, false},
+		{"/abs", nil, false},
+	} {
+		got, err := parseSubdirs(tc.in)
+		if !tc.ok {
+			if err == nil {
+				t.Errorf("parseSubdirs(%q) unexpectedly succeeded", tc.in)
+			}
+		} else if err != nil {
+			t.Errorf("parseSubdirs(%q) failed: %v", tc.in, err)
+		} else if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("parseSubdirs(%q) = %q; want %q", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestLastUpdateInfo_MergePartialScan(t *testing.T) {
+	t1 := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	t2 := t1.Add(time.Hour)
+	t3 := t1.Add(2 * time.Hour)
+	info := lastUpdateInfo{
+		Time:     t1,
+		Dirs:     []string{"a/old", "a/removed", "b", "c"},
+		DirTimes: map[string]time.Time{"a/old": t2, "c": t2, "stale": t1},
+	}
+	got := info.mergePartialScan([]string{"a"}, []string{"a/new", "a/old"}, t3)
+	want := lastUpdateInfo{
+		Time:     t1,
+		Dirs:     []string{"a/new", "a/old", "b", "c"},
+		DirTimes: map[string]time.Time{"a/new": t3, "a/old": t3, "c": t2},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("mergePartialScan returned %+v; want %+v", got, want)
+	}
+}
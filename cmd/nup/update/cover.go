@@ -0,0 +1,98 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package update
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/jpeg"
+	_ "image/png" // register PNG decoder
+	"io/ioutil"
+	"path/filepath"
+
+	"cloud.google.com/go/storage"
+
+	"github.com/derat/nup/cmd/nup/client/files"
+	"github.com/derat/nup/server/cover"
+
+	"golang.org/x/oauth2/google"
+
+	"google.golang.org/api/option"
+)
+
+// extractedCoverQuality is the JPEG quality used when converting non-JPEG images.
+const extractedCoverQuality = 90
+
+// extractCover reads the embedded image from the song file at songPath and writes it
+// as a JPEG file named after id in coverDir. The cover's filename relative to coverDir
+// is returned, or an empty string if the song file doesn't contain an image.
+func extractCover(songPath, coverDir, id string) (string, error) {
+	data, mimeType, err := files.ReadEmbeddedCover(songPath)
+	if err != nil || data == nil {
+		return "", err
+	}
+	return writeCover(coverDir, id, data, mimeType == "image/jpeg" || mimeType == "image/jpg")
+}
+
+// writeCover writes the image in data as a JPEG file named after id in coverDir and
+// returns its filename relative to coverDir. isJPEG should be false if data contains
+// an image in a different format (i.e. PNG).
+func writeCover(coverDir, id string, data []byte, isJPEG bool) (string, error) {
+	// Covers are always stored as JPEGs, so convert other formats.
+	if !isJPEG {
+		img, format, err := image.Decode(bytes.NewReader(data))
+		if err != nil {
+			return "", fmt.Errorf("decoding image: %v", err)
+		}
+		var b bytes.Buffer
+		if err := jpeg.Encode(&b, img, &jpeg.Options{Quality: extractedCoverQuality}); err != nil {
+			return "", fmt.Errorf("encoding %v image: %v", format, err)
+		}
+		data = b.Bytes()
+	}
+	fn := id + cover.OrigExt
+	if err := ioutil.WriteFile(filepath.Join(coverDir, fn), data, 0644); err != nil {
+		return "", err
+	}
+	return fn, nil
+}
+
+// coverUploader uploads cover images to a Google Cloud Storage bucket.
+type coverUploader struct {
+	client *storage.Client
+	bucket *storage.BucketHandle
+}
+
+func newCoverUploader(ctx context.Context, bucketName string) (*coverUploader, error) {
+	creds, err := google.FindDefaultCredentials(ctx,
+		"https://www.googleapis.com/auth/devstorage.read_write",
+	)
+	if err != nil {
+		return nil, fmt.Errorf("finding credentials: %v", err)
+	}
+	client, err := storage.NewClient(ctx, option.WithCredentials(creds))
+	if err != nil {
+		return nil, err
+	}
+	return &coverUploader{client, client.Bucket(bucketName)}, nil
+}
+
+// upload copies the file fn within coverDir to the bucket.
+func (u *coverUploader) upload(ctx context.Context, coverDir, fn string) error {
+	data, err := ioutil.ReadFile(filepath.Join(coverDir, fn))
+	if err != nil {
+		return err
+	}
+	w := u.bucket.Object(fn).NewWriter(ctx)
+	w.ContentType = "image/jpeg"
+	if _, err := w.Write(data); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+func (u *coverUploader) close() error { return u.client.Close() }
@@ -0,0 +1,165 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package update
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+const (
+	defaultCAAURL    = "https://coverartarchive.org"
+	defaultITunesURL = "https://itunes.apple.com"
+
+	fetchedCoverSize = 1200 // size passed to the Cover Art Archive and the iTunes artwork URL
+	fetchUserAgent   = "nup/0 ( https://github.com/derat/nup )"
+	fetchTimeout     = time.Minute // includes time spent waiting for rate limiters
+
+	// The Cover Art Archive doesn't document a rate limit, but it's run by MusicBrainz,
+	// which allows one request per second. The iTunes Search API is documented as allowing
+	// approximately 20 requests per minute.
+	caaQPS    = 1
+	itunesQPS = rate.Limit(20.0 / 60)
+)
+
+// coverFetcher downloads missing cover images from the Cover Art Archive and
+// (optionally) from the iTunes Search API.
+type coverFetcher struct {
+	caaURL        string // base URL for Cover Art Archive, e.g. defaultCAAURL
+	itunesURL     string // base URL for iTunes Search API, e.g. defaultITunesURL; empty to disable
+	caaLimiter    *rate.Limiter
+	itunesLimiter *rate.Limiter
+	attempted     map[string]struct{} // album IDs that we've already tried to fetch
+}
+
+// newCoverFetcher returns a coverFetcher that uses the supplied base URLs.
+// If itunesURL is empty, the iTunes Search API won't be used.
+func newCoverFetcher(caaURL, itunesURL string) *coverFetcher {
+	return &coverFetcher{
+		caaURL:        caaURL,
+		itunesURL:     itunesURL,
+		caaLimiter:    rate.NewLimiter(caaQPS, 1),
+		itunesLimiter: rate.NewLimiter(itunesQPS, 1),
+		attempted:     make(map[string]struct{}),
+	}
+}
+
+// fetch attempts to download a cover for the album with the supplied MusicBrainz ID,
+// artist, and title, and write it to coverDir. The cover's filename relative to
+// coverDir and a description of its source are returned. An empty filename is
+// returned without an error if the cover wasn't found or if albumID was already
+// attempted, so that each album is only looked up once.
+func (f *coverFetcher) fetch(ctx context.Context, coverDir, albumID, artist, album string) (
+	fn, src string, err error) {
+	if _, ok := f.attempted[albumID]; ok {
+		return "", "", nil
+	}
+	f.attempted[albumID] = struct{}{}
+
+	src = "Cover Art Archive"
+	data, err := f.get(ctx, f.caaLimiter,
+		fmt.Sprintf("%s/release/%s/front-%d", f.caaURL, url.PathEscape(albumID), fetchedCoverSize))
+	if err != nil {
+		return "", "", fmt.Errorf("Cover Art Archive: %v", err)
+	}
+	if data == nil && f.itunesURL != "" && artist != "" && album != "" {
+		src = "iTunes"
+		var u string
+		if u, err = f.findITunesArtwork(ctx, artist, album); err != nil {
+			return "", "", fmt.Errorf("iTunes: %v", err)
+		} else if u != "" {
+			if data, err = f.get(ctx, f.itunesLimiter, u); err != nil {
+				return "", "", fmt.Errorf("iTunes: %v", err)
+			}
+		}
+	}
+	if data == nil {
+		return "", "", nil
+	}
+	isJPEG := http.DetectContentType(data) == "image/jpeg"
+	if fn, err = writeCover(coverDir, albumID, data, isJPEG); err != nil {
+		return "", "", err
+	}
+	return fn, src, nil
+}
+
+// get waits for lim and then fetches u, returning its body.
+// Nil data and a nil error are returned if the server reports that u wasn't found.
+func (f *coverFetcher) get(ctx context.Context, lim *rate.Limiter, u string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, fetchTimeout)
+	defer cancel()
+
+	if err := lim.Wait(ctx); err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", fetchUserAgent)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return ioutil.ReadAll(resp.Body)
+	case http.StatusNotFound:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("got status %q", resp.Status)
+	}
+}
+
+// itunesSearchResponse is the top-level object returned by the iTunes Search API.
+// See https://developer.apple.com/library/archive/documentation/AudioVideo/Conceptual/iTuneSearchAPI/.
+type itunesSearchResponse struct {
+	Results []struct {
+		ArtistName     string `json:"artistName"`
+		CollectionName string `json:"collectionName"`
+		ArtworkURL100  string `json:"artworkUrl100"`
+	} `json:"results"`
+}
+
+// findITunesArtwork searches for an album with the supplied artist and title using the
+// iTunes Search API and returns the URL of its artwork. An empty URL is returned if no
+// matching album is found.
+func (f *coverFetcher) findITunesArtwork(ctx context.Context, artist, album string) (string, error) {
+	vals := url.Values{}
+	vals.Set("term", artist+" "+album)
+	vals.Set("media", "music")
+	vals.Set("entity", "album")
+	vals.Set("limit", "10")
+	data, err := f.get(ctx, f.itunesLimiter, f.itunesURL+"/search?"+vals.Encode())
+	if err != nil || data == nil {
+		return "", err
+	}
+	var res itunesSearchResponse
+	if err := json.Unmarshal(data, &res); err != nil {
+		return "", err
+	}
+	for _, r := range res.Results {
+		if r.ArtworkURL100 == "" || !strings.EqualFold(r.ArtistName, artist) ||
+			!strings.EqualFold(r.CollectionName, album) {
+			continue
+		}
+		// The URL ends with e.g. "/100x100bb.jpg", but larger sizes can be requested.
+		u := r.ArtworkURL100
+		if i := strings.LastIndex(u, "/100x100"); i >= 0 {
+			u = fmt.Sprintf("%s/%dx%d%s", u[:i], fetchedCoverSize, fetchedCoverSize, u[i+len("/100x100"):])
+		}
+		return u, nil
+	}
+	return "", nil
+}
@@ -0,0 +1,110 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package update
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"golang.org/x/time/rate"
+)
+
+func TestCoverFetcher(t *testing.T) {
+	encode := func(enc func(*bytes.Buffer, image.Image) error) []byte {
+		var b bytes.Buffer
+		if err := enc(&b, image.NewRGBA(image.Rect(0, 0, 4, 4))); err != nil {
+			t.Fatal("Failed encoding image:", err)
+		}
+		return b.Bytes()
+	}
+	jpegData := encode(func(b *bytes.Buffer, img image.Image) error { return jpeg.Encode(b, img, nil) })
+	pngData := encode(func(b *bytes.Buffer, img image.Image) error { return png.Encode(b, img) })
+
+	var srv *httptest.Server
+	var reqs []string
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reqs = append(reqs, r.URL.Path)
+		switch r.URL.Path {
+		case "/release/caa/front-1200":
+			w.Write(jpegData)
+		case "/search":
+			if r.FormValue("term") != "Artist Album" || r.FormValue("entity") != "album" {
+				http.Error(w, "bad query", http.StatusBadRequest)
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"results": []map[string]string{
+				{"artistName": "Other", "collectionName": "Album", "artworkUrl100": srv.URL + "/wrong/100x100bb.jpg"},
+				{"artistName": "artist", "collectionName": "ALBUM", "artworkUrl100": srv.URL + "/art/100x100bb.jpg"},
+			}})
+		case "/art/1200x1200bb.jpg":
+			w.Write(pngData)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	ctx := context.Background()
+	dir := t.TempDir()
+	newFetcher := func(itunes bool) *coverFetcher {
+		var itunesURL string
+		if itunes {
+			itunesURL = srv.URL
+		}
+		f := newCoverFetcher(srv.URL, itunesURL)
+		f.caaLimiter = rate.NewLimiter(rate.Inf, 1)
+		f.itunesLimiter = rate.NewLimiter(rate.Inf, 1)
+		return f
+	}
+	checkJPEG := func(fn string) {
+		data, err := ioutil.ReadFile(filepath.Join(dir, fn))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, format, err := image.DecodeConfig(bytes.NewReader(data)); err != nil {
+			t.Errorf("Failed decoding %v: %v", fn, err)
+		} else if format != "jpeg" {
+			t.Errorf("%v has format %q; want jpeg", fn, format)
+		}
+	}
+
+	f := newFetcher(false)
+	if fn, src, err := f.fetch(ctx, dir, "caa", "Artist", "Album"); err != nil {
+		t.Error("fetch from Cover Art Archive failed:", err)
+	} else if fn != "caa.jpg" || src != "Cover Art Archive" {
+		t.Errorf("fetch from Cover Art Archive returned %q, %q; want %q, %q", fn, src, "caa.jpg", "Cover Art Archive")
+	} else {
+		checkJPEG(fn)
+	}
+	if fn, _, err := f.fetch(ctx, dir, "missing", "Artist", "Album"); err != nil || fn != "" {
+		t.Errorf("fetch without iTunes returned %q, %v; want empty filename", fn, err)
+	}
+
+	f = newFetcher(true)
+	reqs = nil
+	if fn, src, err := f.fetch(ctx, dir, "itunes", "Artist", "Album"); err != nil {
+		t.Error("fetch from iTunes failed:", err)
+	} else if fn != "itunes.jpg" || src != "iTunes" {
+		t.Errorf("fetch from iTunes returned %q, %q; want %q, %q", fn, src, "itunes.jpg", "iTunes")
+	} else {
+		checkJPEG(fn)
+	}
+	// The album shouldn't be looked up again.
+	if fn, _, err := f.fetch(ctx, dir, "itunes", "Artist", "Album"); err != nil || fn != "" {
+		t.Errorf("Second fetch returned %q, %v; want empty filename", fn, err)
+	}
+	if want := []string{"/release/itunes/front-1200", "/search", "/art/1200x1200bb.jpg"}; !reflect.DeepEqual(reqs, want) {
+		t.Errorf("Server got requests %v; want %v", reqs, want)
+	}
+}
@@ -4,8 +4,7 @@
 package update
 
 import (
-	"encoding/json"
-	"io"
+	"log"
 	"os"
 
 	"github.com/derat/nup/server/db"
@@ -13,7 +12,8 @@ import (
 
 // readSongsFromJSONFile JSON-unmarshals db.Song objects from path and
 // asynchronously sends them to ch. The total number of songs is returned.
-func readSongsFromJSONFile(path string, ch chan songOrErr) (int, error) {
+// Ratings are converted from scale (see db.DecodeSongs).
+func readSongsFromJSONFile(path string, scale db.RatingScale, ch chan songOrErr) (int, error) {
 	f, err := os.Open(path)
 	if err != nil {
 		return 0, err
@@ -26,21 +26,17 @@ func readSongsFromJSONFile(path string, ch chan songOrErr) (int, error) {
 	// best way to handle this. This function previously started a goroutine
 	// for each song, but that results in songs getting sent in an arbitrary
 	// order instead of the order in the file.
-	var songs []db.Song
-	d := json.NewDecoder(f)
-	for {
-		var s db.Song
-		if err = d.Decode(&s); err == io.EOF {
-			break
-		} else if err != nil {
-			return 0, err
-		}
-		songs = append(songs, s)
+	songs, used, err := db.DecodeSongs(f, scale)
+	if err != nil {
+		return 0, err
+	}
+	if scale == db.AutoRatingScale && used == db.LegacyRatingScale {
+		log.Printf("Converting legacy ratings in %v", path)
 	}
 
 	go func() {
-		for i := range songs {
-			ch <- songOrErr{&songs[i], nil}
+		for _, s := range songs {
+			ch <- songOrErr{song: s}
 		}
 	}()
 	return len(songs), nil
@@ -18,7 +18,7 @@ func TestJSON(t *testing.T) {
 	if err != nil {
 		t.Error("Failed writing JSON file: ", err)
 	}
-	num, err := readSongsFromJSONFile(p, ch)
+	num, err := readSongsFromJSONFile(p, db.AutoRatingScale, ch)
 	if err != nil {
 		t.Error("Failed reading songs from JSON: ", err)
 	}
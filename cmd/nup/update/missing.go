@@ -0,0 +1,124 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package update
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/derat/nup/cmd/nup/client"
+	"github.com/derat/nup/server/db"
+	"github.com/google/subcommands"
+)
+
+// findMissingSongs returns the songs in dumped (keyed by filename) from library whose
+// files don't exist under musicDir, sorted by filename. Songs that index lists as
+// transcoded are checked using their lossless files. An error is returned if none
+// of the songs' files exist, since the music dir is probably just unavailable.
+func findMissingSongs(musicDir, library string, dumped map[string]*db.Song,
+	index *client.TranscodeIndex) ([]*db.Song, error) {
+	var missing []*db.Song
+	var total int
+	for fn, s := range dumped {
+		if s.Library != library {
+			continue
+		}
+		total++
+		if src, ok := index.Source(fn); ok {
+			fn = src
+		}
+		if _, err := os.Stat(filepath.Join(musicDir, fn)); os.IsNotExist(err) {
+			missing = append(missing, s)
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	if total > 0 && len(missing) == total {
+		return nil, fmt.Errorf("all %d song(s) are missing from %v", total, musicDir)
+	}
+	sort.Slice(missing, func(i, j int) bool { return missing[i].Filename < missing[j].Filename })
+	return missing, nil
+}
+
+// confirm writes prompt to w and returns true if the line read from r starts with 'y'.
+func confirm(r io.Reader, w io.Writer, prompt string) (bool, error) {
+	fmt.Fprint(w, prompt+" [y/N] ")
+	ln, err := bufio.NewReader(r).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return false, err
+	}
+	return strings.HasPrefix(strings.ToLower(strings.TrimSpace(ln)), "y"), nil
+}
+
+func (cmd *Command) doDeleteMissing() subcommands.ExitStatus {
+	if cmd.Cfg.MusicDir == "" {
+		fmt.Fprintln(os.Stderr, "musicDir not set in config")
+		return subcommands.ExitUsageError
+	}
+	if cmd.compareDumpFile == "" {
+		fmt.Fprintln(os.Stderr, "-delete-missing requires -compare-dump-file")
+		return subcommands.ExitUsageError
+	}
+	if cmd.dryRun && cmd.force {
+		fmt.Fprintln(os.Stderr, "-dry-run and -force are mutually exclusive")
+		return subcommands.ExitUsageError
+	}
+
+	dumped, err := readDumpedSongs(cmd.compareDumpFile, true /* useFilenames */)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed reading songs from -compare-dump-file:", err)
+		return subcommands.ExitFailure
+	}
+	index, err := client.ReadTranscodeIndex(cmd.Cfg.TranscodeIndexFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed reading transcode index:", err)
+		return subcommands.ExitFailure
+	}
+	missing, err := findMissingSongs(cmd.Cfg.MusicDir, cmd.Cfg.Library, dumped, index)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed finding missing songs:", err)
+		return subcommands.ExitFailure
+	}
+	if len(missing) == 0 {
+		fmt.Fprintln(os.Stderr, "No missing songs")
+		return subcommands.ExitSuccess
+	}
+
+	ids := make([]int64, len(missing))
+	for i, s := range missing {
+		if ids[i], err = strconv.ParseInt(s.SongID, 10, 64); err != nil {
+			fmt.Fprintf(os.Stderr, "Bad song ID %q for %v: %v\n", s.SongID, s.Filename, err)
+			return subcommands.ExitFailure
+		}
+		fmt.Printf("%v\t%v\t%v - %v\n", s.SongID, s.Filename, s.Artist, s.Title)
+	}
+	if cmd.dryRun {
+		return subcommands.ExitSuccess
+	}
+	if !cmd.force {
+		if ok, err := confirm(os.Stdin, os.Stderr,
+			fmt.Sprintf("Delete %d song(s) from the server?", len(missing))); err != nil {
+			fmt.Fprintln(os.Stderr, "Failed reading confirmation:", err)
+			return subcommands.ExitFailure
+		} else if !ok {
+			fmt.Fprintln(os.Stderr, "Not deleting songs")
+			return subcommands.ExitFailure
+		}
+	}
+
+	for i, id := range ids {
+		if err := deleteSong(cmd.Cfg, id); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed deleting song %v (%v): %v\n", id, missing[i].Filename, err)
+			return subcommands.ExitFailure
+		}
+	}
+	fmt.Fprintf(os.Stderr, "Deleted %d song(s)\n", len(ids))
+	return subcommands.ExitSuccess
+}
@@ -0,0 +1,85 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package update
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/derat/nup/cmd/nup/client"
+	"github.com/derat/nup/server/db"
+)
+
+func TestFindMissingSongs(t *testing.T) {
+	dir := t.TempDir()
+	for _, fn := range []string{"present.mp3", "present.flac"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, fn), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	dumped := make(map[string]*db.Song)
+	for _, s := range []db.Song{
+		{SongID: "1", Filename: "present.mp3"},
+		{SongID: "2", Filename: "b/missing.mp3"},
+		{SongID: "3", Filename: "a/missing.mp3"},
+		{SongID: "4", Filename: "other.mp3", Library: "other"},
+		{SongID: "5", Filename: "present.opus"},
+		{SongID: "6", Filename: "missing.opus"},
+	} {
+		s := s
+		dumped[s.Filename] = &s
+	}
+
+	// Transcoded songs should be checked using their lossless files.
+	index, err := client.ReadTranscodeIndex(filepath.Join(dir, "transcodes.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	index.Set("present.flac", client.TranscodeRecord{Format: "opus", Object: "present.opus"})
+	index.Set("missing.flac", client.TranscodeRecord{Format: "opus", Object: "missing.opus"})
+
+	missing, err := findMissingSongs(dir, "", dumped, index)
+	if err != nil {
+		t.Fatal("findMissingSongs failed:", err)
+	}
+	var ids []string
+	for _, s := range missing {
+		ids = append(ids, s.SongID)
+	}
+	if want := []string{"3", "2", "6"}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("findMissingSongs returned songs %v; want %v", ids, want)
+	}
+
+	// If all of the songs are missing, the music dir is probably unavailable.
+	if _, err := findMissingSongs(filepath.Join(dir, "bogus"), "", dumped, index); err == nil {
+		t.Error("findMissingSongs unexpectedly succeeded for missing dir")
+	}
+}
+
+func TestConfirm(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want bool
+	}{
+		{"y\n", true},
+		{"Yes\n", true},
+		{"n\n", false},
+		{"\n", false},
+		{"", false},
+	} {
+		var out bytes.Buffer
+		if got, err := confirm(strings.NewReader(tc.in), &out, "Delete?"); err != nil {
+			t.Errorf("confirm(%q) failed: %v", tc.in, err)
+		} else if got != tc.want {
+			t.Errorf("confirm(%q) = %v; want %v", tc.in, got, tc.want)
+		}
+		if want := "Delete? [y/N] "; out.String() != want {
+			t.Errorf("confirm(%q) wrote %q; want %q", tc.in, out.String(), want)
+		}
+	}
+}
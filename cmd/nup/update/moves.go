@@ -0,0 +1,82 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package update
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/derat/nup/cmd/nup/client/files"
+	"github.com/derat/nup/server/db"
+)
+
+// moveDetector identifies song files that were moved or renamed within the music dir
+// by matching the SHA1s of files at new paths against dumped songs whose files are missing.
+// This lets moved songs be sent to the server without reading their metadata or
+// computing their gain adjustments.
+type moveDetector struct {
+	known   map[string]struct{} // filenames of all dumped songs
+	mu      sync.Mutex          // protects missing
+	missing map[string]*db.Song // dumped songs without files, keyed by SHA1
+	// hash returns the SHA1 of the audio data in the file at p.
+	// It's a field so it can be replaced by tests.
+	hash func(p string) (string, error)
+}
+
+// newMoveDetector returns a moveDetector for dumped, a map from SHA1s to dumped songs
+// (e.g. from readDumpedSongs). Songs are looked for under musicDir.
+func newMoveDetector(musicDir string, dumped map[string]*db.Song) *moveDetector {
+	md := &moveDetector{
+		known:   make(map[string]struct{}, len(dumped)),
+		missing: make(map[string]*db.Song),
+		hash:    hashFile,
+	}
+	for sha1, s := range dumped {
+		md.known[s.Filename] = struct{}{}
+		if _, err := os.Stat(filepath.Join(musicDir, s.Filename)); os.IsNotExist(err) {
+			md.missing[sha1] = s
+		}
+	}
+	return md
+}
+
+// check returns a copy of the dumped song that was moved to req's path,
+// or nil if the file wasn't moved. Each dumped song is only returned once.
+func (md *moveDetector) check(req readRequest) (*db.Song, error) {
+	if _, ok := md.known[req.rel]; ok {
+		return nil, nil
+	}
+	md.mu.Lock()
+	empty := len(md.missing) == 0
+	md.mu.Unlock()
+	if empty {
+		return nil, nil // don't bother hashing the file
+	}
+
+	sha1, err := md.hash(req.path)
+	if err != nil {
+		return nil, err
+	}
+	md.mu.Lock()
+	defer md.mu.Unlock()
+	old, ok := md.missing[sha1]
+	if !ok {
+		return nil, nil
+	}
+	delete(md.missing, sha1)
+	s := *old
+	s.Filename = req.rel
+	return &s, nil
+}
+
+// hashFile returns the SHA1 of the audio data in the song file at p.
+func hashFile(p string) (string, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	return files.ComputeSHA1(f)
+}
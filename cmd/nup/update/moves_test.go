@@ -0,0 +1,71 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package update
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/derat/nup/server/db"
+)
+
+func TestMoveDetector(t *testing.T) {
+	dir := t.TempDir()
+	for _, fn := range []string{"kept.mp3", "new/moved.mp3", "new/added.mp3"} {
+		p := filepath.Join(dir, fn)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(fn), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dumped := map[string]*db.Song{
+		"kept":  {SHA1: "kept", Filename: "kept.mp3", Artist: "A"},
+		"moved": {SHA1: "moved", Filename: "old/moved.mp3", Artist: "B", CoverFilename: "b.jpg"},
+	}
+	md := newMoveDetector(dir, dumped)
+	hashes := map[string]string{"new/moved.mp3": "moved", "new/added.mp3": "added"}
+	var hashed []string
+	md.hash = func(p string) (string, error) {
+		rel, _ := filepath.Rel(dir, p)
+		hashed = append(hashed, rel)
+		return hashes[rel], nil
+	}
+
+	check := func(rel string) *db.Song {
+		s, err := md.check(readRequest{path: filepath.Join(dir, rel), rel: rel})
+		if err != nil {
+			t.Fatalf("check(%q) failed: %v", rel, err)
+		}
+		return s
+	}
+
+	if s := check("kept.mp3"); s != nil {
+		t.Errorf("check(%q) = %+v; want nil", "kept.mp3", s)
+	}
+	if s := check("new/added.mp3"); s != nil {
+		t.Errorf("check(%q) = %+v; want nil", "new/added.mp3", s)
+	}
+	if s := check("new/moved.mp3"); s == nil {
+		t.Errorf("check(%q) = nil; want moved song", "new/moved.mp3")
+	} else if s.Filename != "new/moved.mp3" || s.SHA1 != "moved" || s.CoverFilename != "b.jpg" {
+		t.Errorf("check(%q) = %+v; want moved song with new filename", "new/moved.mp3", s)
+	}
+	if dumped["moved"].Filename != "old/moved.mp3" {
+		t.Errorf("Dumped song's filename was changed to %q", dumped["moved"].Filename)
+	}
+
+	// Once all missing songs have been found, new files shouldn't be hashed.
+	hashed = nil
+	if s := check("new/moved.mp3"); s != nil {
+		t.Errorf("Second check(%q) = %+v; want nil", "new/moved.mp3", s)
+	}
+	if len(hashed) != 0 {
+		t.Errorf("Files were hashed after all missing songs were found: %q", hashed)
+	}
+}
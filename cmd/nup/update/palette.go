@@ -0,0 +1,106 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package update
+
+import (
+	"fmt"
+	"image"
+	"sort"
+)
+
+// coverPaletteSize is the maximum number of colors in Song.CoverPalette.
+const coverPaletteSize = 5
+
+// extractPalette returns up to n dominant colors in img as "#rrggbb" strings, ordered by
+// decreasing prevalence. Colors are chosen using the median cut algorithm: pixels are
+// repeatedly divided near the median of the color channel with the widest range, and
+// each final group's average color is returned. Mostly-transparent pixels are ignored.
+func extractPalette(img image.Image, n int) []string {
+	b := img.Bounds()
+	pixels := make([][3]uint8, 0, b.Dx()*b.Dy())
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			r, g, b, a := img.At(x, y).RGBA()
+			if a < 0x8000 {
+				continue
+			}
+			pixels = append(pixels, [3]uint8{uint8(r >> 8), uint8(g >> 8), uint8(b >> 8)})
+		}
+	}
+	if len(pixels) == 0 || n <= 0 {
+		return nil
+	}
+
+	boxes := [][][3]uint8{pixels}
+	for len(boxes) < n {
+		// Find the box and channel with the widest range.
+		bi, ch, rng := -1, 0, 0
+		for i, box := range boxes {
+			if c, r := widestChannel(box); r > rng {
+				bi, ch, rng = i, c, r
+			}
+		}
+		if bi < 0 {
+			break // all remaining boxes contain a single color
+		}
+		box := boxes[bi]
+		sort.Slice(box, func(i, j int) bool { return box[i][ch] < box[j][ch] })
+		// Split at the median, but move the split point so that pixels with the same value
+		// in the channel don't end up in different boxes.
+		mid := len(box) / 2
+		for mid < len(box) && box[mid][ch] == box[mid-1][ch] {
+			mid++
+		}
+		if mid == len(box) {
+			for mid = len(box) / 2; box[mid][ch] == box[mid-1][ch]; mid-- {
+			}
+		}
+		boxes[bi] = box[:mid]
+		boxes = append(boxes, box[mid:])
+	}
+	sort.SliceStable(boxes, func(i, j int) bool { return len(boxes[i]) > len(boxes[j]) })
+
+	colors := make([]string, 0, len(boxes))
+	seen := make(map[string]struct{}, len(boxes))
+	for _, box := range boxes {
+		var sum [3]int
+		for _, p := range box {
+			sum[0] += int(p[0])
+			sum[1] += int(p[1])
+			sum[2] += int(p[2])
+		}
+		avg := func(c int) int { return (sum[c] + len(box)/2) / len(box) }
+		col := fmt.Sprintf("#%02x%02x%02x", avg(0), avg(1), avg(2))
+		if _, ok := seen[col]; !ok {
+			seen[col] = struct{}{}
+			colors = append(colors, col)
+		}
+	}
+	return colors
+}
+
+// widestChannel returns the index of the channel with the largest range in box
+// along with the range.
+func widestChannel(box [][3]uint8) (ch, rng int) {
+	if len(box) == 0 {
+		return 0, 0
+	}
+	min, max := box[0], box[0]
+	for _, p := range box[1:] {
+		for c := 0; c < 3; c++ {
+			if p[c] < min[c] {
+				min[c] = p[c]
+			}
+			if p[c] > max[c] {
+				max[c] = p[c]
+			}
+		}
+	}
+	for c := 0; c < 3; c++ {
+		if r := int(max[c]) - int(min[c]); r > rng {
+			ch, rng = c, r
+		}
+	}
+	return ch, rng
+}
@@ -0,0 +1,43 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package update
+
+import (
+	"image"
+	"image/color"
+	"reflect"
+	"testing"
+)
+
+func TestExtractPalette(t *testing.T) {
+	red := color.RGBA{255, 0, 0, 255}
+	blue := color.RGBA{0, 0, 255, 255}
+	clear := color.RGBA{0, 255, 0, 0}
+
+	// Create an image that's mostly red with a blue stripe and a transparent stripe.
+	img := image.NewRGBA(image.Rect(0, 0, 8, 8))
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			switch {
+			case x < 2:
+				img.Set(x, y, blue)
+			case x == 7:
+				img.Set(x, y, clear)
+			default:
+				img.Set(x, y, red)
+			}
+		}
+	}
+	if got, want := extractPalette(img, 5), []string{"#ff0000", "#0000ff"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("extractPalette(img, 5) = %q; want %q", got, want)
+	}
+	if got, want := extractPalette(img, 1), []string{"#b60049"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("extractPalette(img, 1) = %q; want %q", got, want)
+	}
+
+	empty := image.NewRGBA(image.Rect(0, 0, 4, 4))
+	if got := extractPalette(empty, 5); got != nil {
+		t.Errorf("extractPalette(empty, 5) = %q; want nil", got)
+	}
+}
@@ -9,7 +9,9 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"runtime"
 	"sort"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -19,12 +21,12 @@ import (
 )
 
 const (
-	// Maximum number of songs to read at once. This needs to not be too high to avoid
-	// running out of FDs when readSong calls block on computing gain adjustments (my system
-	// has a default soft limit of 1024 per "ulimit -Sn"), but it should also be high enough
-	// that we're processing songs from different albums simultaneously so we can run
-	// multiple copies of mp3gain in parallel on multicore systems.
-	maxScanWorkers = 64
+	// Number of song-reading workers to start per job. ReadSong calls block while gain
+	// adjustments are computed for entire albums, so this needs to be high enough that
+	// songs from different albums are read simultaneously so that multiple copies of mp3gain
+	// can run in parallel, but not so high that we run out of FDs (my system has a default
+	// soft limit of 1024 per "ulimit -Sn").
+	scanWorkersPerJob = 16
 
 	logProgressInterval = 100
 )
@@ -50,23 +52,31 @@ func readSongList(cfg *client.Config, listPath string, ch chan songOrErr,
 		return 0, err
 	}
 
-	gains, err := files.NewGainsCache(cfg, opts.dumpedGainsPath)
+	// Now read the files asynchronously.
+	return readSongPaths(cfg, paths, ch, opts)
+}
+
+// readSongPaths asynchronously reads the songs at the supplied relative (to cfg.MusicDir)
+// paths and sends the resulting Song structs to ch. Paths may also refer to cue sheets.
+// The number of songs that will be sent to the channel is returned.
+func readSongPaths(cfg *client.Config, paths []string, ch chan songOrErr,
+	opts *scanOptions) (numSongs int, err error) {
+	gains, err := files.NewGainsCache(cfg, opts.dumpedGainsPath, opts.jobs)
 	if err != nil {
 		return 0, err
 	}
-
-	// Now read the files asynchronously (but one at a time).
-	// TODO: Consider reading multiple songs simultaneously as in scanForUpdatedSongs
-	// so that gain calculation is parallelized.
-	go func() {
-		for _, rel := range paths {
-			full := filepath.Join(cfg.MusicDir, rel)
-			s, err := files.ReadSong(cfg, full, nil, 0, gains)
-			ch <- songOrErr{s, err}
+	reqs := make([]readRequest, len(paths))
+	for i, rel := range paths {
+		reqs[i] = readRequest{path: filepath.Join(cfg.MusicDir, rel), rel: rel}
+		if files.IsCuePath(rel) {
+			if reqs[i].cue, err = files.ReadCueSheet(reqs[i].path); err != nil {
+				return 0, fmt.Errorf("%v: %v", rel, err)
+			}
 		}
-	}()
-
-	return len(paths), nil
+		numSongs += reqs[i].numSongs()
+	}
+	readSongs(cfg, reqs, ch, gains, opts)
+	return numSongs, nil
 }
 
 // scanOptions contains options for scanForUpdatedSongs and readSongList.
@@ -75,15 +85,114 @@ type scanOptions struct {
 	forceGlob       string // glob matching files to update even if unchanged
 	logProgress     bool   // periodically log progress while scanning
 	dumpedGainsPath string // file with JSON-marshaled db.Song objects
+	jobs            int    // number of simultaneous mp3gain processes (0 for number of CPUs)
+	// checkpoint, if non-nil, contains songs to skip since they were already sent by an
+	// interrupted update.
+	checkpoint *checkpoint
+	// moves, if non-nil, is used to identify moved songs, which are sent without being read.
+	moves *moveDetector
+	// subdirs, if non-empty, contains directories relative to cfg.MusicDir that
+	// scanForUpdatedSongs should scan instead of scanning all of cfg.MusicDir.
+	subdirs []string
+	// dirTimes contains times at which directories (relative to cfg.MusicDir) were last
+	// scanned by partial updates. Times before scanForUpdatedSongs's lastUpdateTime are ignored.
+	dirTimes map[string]time.Time
+}
+
+// readRequest describes a song file to be read by readSongs.
+type readRequest struct {
+	path string      // absolute path
+	rel  string      // path relative to music dir
+	fi   os.FileInfo // may be nil
+	// cue is non-nil if path is a cue sheet describing multiple songs in a single file.
+	cue *files.CueSheet
+}
+
+// numSongs returns the number of songs that readSongs will send for req.
+func (req *readRequest) numSongs() int {
+	if req.cue != nil {
+		return len(req.cue.Tracks)
+	}
+	return 1
+}
+
+// readSongs asynchronously reads the songs described by reqs using a pool of worker
+// goroutines and sends the resulting Song structs to ch. Songs may be sent in any order.
+// Each request results in numSongs songs being sent.
+func readSongs(cfg *client.Config, reqs []readRequest, ch chan songOrErr,
+	gains *files.GainsCache, opts *scanOptions) {
+	jobs := opts.jobs
+	if jobs <= 0 {
+		jobs = runtime.NumCPU()
+	}
+	nworkers := jobs * scanWorkersPerJob
+	if nworkers > len(reqs) {
+		nworkers = len(reqs)
+	}
+
+	reqChan := make(chan readRequest, len(reqs))
+	for _, req := range reqs {
+		reqChan <- req
+	}
+	close(reqChan)
+
+	var numRead int32
+	for i := 0; i < nworkers; i++ {
+		go func() {
+			for req := range reqChan {
+				var results []songOrErr
+				if req.cue != nil {
+					results = readCueSongs(cfg, req, gains)
+				} else {
+					var s *db.Song
+					var err error
+					var moved bool
+					if opts.moves != nil {
+						s, err = opts.moves.check(req)
+						moved = s != nil
+					}
+					if s == nil && err == nil {
+						s, err = files.ReadSong(cfg, req.path, req.fi, 0, gains)
+					}
+					if err != nil && s == nil {
+						s = &db.Song{Filename: req.rel} // return the filename for error reporting
+					}
+					results = []songOrErr{{s, err, moved}}
+				}
+				if n := atomic.AddInt32(&numRead, 1); opts.logProgress && n%logProgressInterval == 0 {
+					log.Printf("Read %v of %v files", n, len(reqs))
+				}
+				for _, res := range results {
+					ch <- res
+				}
+			}
+		}()
+	}
+}
+
+// readCueSongs reads the songs described by req.cue. If the songs can't be read,
+// an error is returned for each of them.
+func readCueSongs(cfg *client.Config, req readRequest, gains *files.GainsCache) []songOrErr {
+	songs, err := files.ReadCueSongs(cfg, req.path, req.cue, gains)
+	results := make([]songOrErr, req.numSongs())
+	for i := range results {
+		if err != nil {
+			results[i] = songOrErr{song: &db.Song{Filename: req.rel}, err: err}
+		} else {
+			results[i] = songOrErr{song: songs[i]}
+		}
+	}
+	return results
 }
 
-// scanForUpdatedSongs looks for songs under cfg.MusicDir updated more recently than lastUpdateTime or
-// in directories not listed in lastUpdateDirs and asynchronously sends the resulting Song structs
-// to ch. The number of songs that will be sent to the channel and seen directories (relative to
-// musicDir) are returned.
+// scanForUpdatedSongs looks for songs under cfg.MusicDir (or opts.subdirs) updated more recently
+// than lastUpdateTime (or opts.dirTimes) or in directories not listed in lastUpdateDirs and
+// asynchronously sends the resulting Song structs to ch. The number of songs that will be sent
+// to the channel and seen directories (relative to musicDir) are returned.
 func scanForUpdatedSongs(cfg *client.Config, lastUpdateTime time.Time, lastUpdateDirs []string,
 	ch chan songOrErr, opts *scanOptions) (numUpdates int, seenDirs []string, err error) {
-	var numSongs int // total number of songs under cfg.MusicDir
+	var numSongs int   // total number of songs under cfg.MusicDir
+	var numSkipped int // songs skipped due to opts.checkpoint
 
 	oldDirs := make(map[string]struct{}, len(lastUpdateDirs))
 	for _, d := range lastUpdateDirs {
@@ -91,17 +200,19 @@ func scanForUpdatedSongs(cfg *client.Config, lastUpdateTime time.Time, lastUpdat
 	}
 	newDirs := make(map[string]struct{})
 
-	gains, err := files.NewGainsCache(cfg, opts.dumpedGainsPath)
+	gains, err := files.NewGainsCache(cfg, opts.dumpedGainsPath, opts.jobs)
 	if err != nil {
 		return 0, nil, err
 	}
 
-	workers := make(chan struct{}, maxScanWorkers)
-	if err := filepath.Walk(cfg.MusicDir, func(path string, fi os.FileInfo, err error) error {
+	var reqs []readRequest
+	cues := make(map[string]readRequest) // keyed by audio file path relative to cfg.MusicDir
+	walkFunc := func(path string, fi os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
-		if !fi.Mode().IsRegular() || !files.IsMusicPath(path) {
+		if !fi.Mode().IsRegular() ||
+			!(isSongPath(path, cfg.TranscodeFormat != "") || files.IsCuePath(path)) {
 			return nil
 		}
 		relPath, err := filepath.Rel(cfg.MusicDir, path)
@@ -117,6 +228,16 @@ func scanForUpdatedSongs(cfg *client.Config, lastUpdateTime time.Time, lastUpdat
 		relDir := filepath.Dir(relPath)
 		newDirs[relDir] = struct{}{}
 
+		// Cue sheets are always read so their audio files can be skipped below.
+		var cue *files.CueSheet
+		if files.IsCuePath(path) {
+			if cue, err = files.ReadCueSheet(path); err != nil {
+				log.Printf("Skipping cue sheet %v: %v", relPath, err)
+				return nil
+			}
+			cues[filepath.Join(relDir, cue.File)] = readRequest{path: path, rel: relPath, fi: fi, cue: cue}
+		}
+
 		if opts.forceGlob != "" {
 			if matched, err := filepath.Match(opts.forceGlob, relPath); err != nil {
 				return fmt.Errorf("invalid glob %q: %v", opts.forceGlob, err)
@@ -128,7 +249,12 @@ func scanForUpdatedSongs(cfg *client.Config, lastUpdateTime time.Time, lastUpdat
 			// We need to check for new directories to handle the situation described at
 			// https://github.com/derat/nup/issues/22 where a directory containing files
 			// with old timestamps is moved into the tree.
-			oldFile := fi.ModTime().Before(lastUpdateTime) && getCtime(fi).Before(lastUpdateTime)
+			// Directories scanned by partial updates may have been scanned more recently.
+			scanTime := lastUpdateTime
+			if t, ok := opts.dirTimes[relDir]; ok && t.After(scanTime) {
+				scanTime = t
+			}
+			oldFile := fi.ModTime().Before(scanTime) && getCtime(fi).Before(scanTime)
 			_, oldDir := oldDirs[relDir]
 
 			// Handle old configs that don't include previously-seen directories.
@@ -159,28 +285,41 @@ func scanForUpdatedSongs(cfg *client.Config, lastUpdateTime time.Time, lastUpdat
 			}
 		}
 
-		go func() {
-			// Avoid having too many parallel readSong calls, as we can run out of FDs.
-			// TODO: Find a better way to rate-limit this that also avoids creating so many
-			// simultaneous goroutines. Updating 10,000 songs brought my computer to its knees.
-			workers <- struct{}{}
-			s, err := files.ReadSong(cfg, path, fi, 0, gains)
-			<-workers
-			if err != nil && s == nil {
-				s = &db.Song{Filename: relPath} // return the filename for error reporting
-			}
-			ch <- songOrErr{s, err}
-		}()
+		if opts.checkpoint != nil && opts.checkpoint.sentUnchanged(relPath, fi) {
+			numSkipped++
+			return nil
+		}
 
-		numUpdates++
+		reqs = append(reqs, readRequest{path: path, rel: relPath, fi: fi, cue: cue})
 		return nil
-	}); err != nil {
-		return 0, nil, err
+	}
+
+	roots := []string{cfg.MusicDir}
+	if len(opts.subdirs) > 0 {
+		roots = nil
+		for _, d := range opts.subdirs {
+			roots = append(roots, filepath.Join(cfg.MusicDir, d))
+		}
+	}
+	for _, root := range roots {
+		if err := filepath.Walk(root, walkFunc); err != nil {
+			return 0, nil, err
+		}
+	}
+
+	reqs = applyCueSheets(reqs, cues)
+	for _, req := range reqs {
+		numUpdates += req.numSongs()
 	}
 
 	if opts.logProgress {
 		log.Printf("Found %v update(s) among %v files", numUpdates, numSongs)
+		if numSkipped > 0 {
+			log.Printf("Skipped %v song(s) already sent by interrupted update", numSkipped)
+		}
 	}
+	readSongs(cfg, reqs, ch, gains, opts)
+
 	for d := range newDirs {
 		seenDirs = append(seenDirs, d)
 	}
@@ -188,6 +327,36 @@ func scanForUpdatedSongs(cfg *client.Config, lastUpdateTime time.Time, lastUpdat
 	return numUpdates, seenDirs, nil
 }
 
+// applyCueSheets returns a copy of reqs in which requests for audio files described by
+// cue sheets in cues (keyed by audio file paths relative to the music dir) are replaced
+// by requests for the cue sheets, so that the cue sheets' tracks are sent instead.
+func applyCueSheets(reqs []readRequest, cues map[string]readRequest) []readRequest {
+	if len(cues) == 0 {
+		return reqs
+	}
+	var out []readRequest
+	seenCues := make(map[string]struct{})
+	for _, req := range reqs {
+		if cr, ok := cues[req.rel]; ok {
+			req = cr
+		}
+		if req.cue != nil {
+			if _, ok := seenCues[req.rel]; ok {
+				continue // already added for cue sheet or audio file
+			}
+			seenCues[req.rel] = struct{}{}
+		}
+		out = append(out, req)
+	}
+	return out
+}
+
+// isSongPath returns true if path p has an extension suggesting that it's a song file.
+// Lossless files are only included if lossless is true (i.e. they're being transcoded).
+func isSongPath(p string, lossless bool) bool {
+	return files.IsMusicPath(p) || (lossless && files.IsLosslessPath(p))
+}
+
 // getCtime returns fi's ctime (i.e. when its metadata was last changed).
 func getCtime(fi os.FileInfo) time.Time {
 	stat := fi.Sys().(*syscall.Stat_t)
@@ -33,11 +33,13 @@ func getSongsFromChannel(ch chan songOrErr, num int) ([]db.Song, error) {
 }
 
 type scanTestOptions struct {
-	metadataDir     string            // client.Config.MetadataDir
-	artistRewrites  map[string]string // client.Config.ArtistRewrites
-	albumIDRewrites map[string]string // client.Config.AlbumIDRewrites
-	lastUpdateDirs  []string          // scanForUpdatedSongs lastUpdateDirs param
-	forceGlob       string            // scanOptions.forceGlob
+	metadataDir     string               // client.Config.MetadataDir
+	rewriteRules    []client.RewriteRule // client.Config.RewriteRules
+	albumIDRewrites map[string]string    // client.Config.AlbumIDRewrites
+	lastUpdateDirs  []string             // scanForUpdatedSongs lastUpdateDirs param
+	forceGlob       string               // scanOptions.forceGlob
+	subdirs         []string             // scanOptions.subdirs
+	dirTimes        map[string]time.Time // scanOptions.dirTimes
 }
 
 func scanAndCompareSongs(t *testing.T, desc, dir string, lastUpdateTime time.Time,
@@ -47,9 +49,11 @@ func scanAndCompareSongs(t *testing.T, desc, dir string, lastUpdateTime time.Tim
 	var lastUpdateDirs []string
 	if testOpts != nil {
 		cfg.MetadataDir = testOpts.metadataDir
-		cfg.ArtistRewrites = testOpts.artistRewrites
+		cfg.RewriteRules = testOpts.rewriteRules
 		cfg.AlbumIDRewrites = testOpts.albumIDRewrites
 		opts.forceGlob = testOpts.forceGlob
+		opts.subdirs = testOpts.subdirs
+		opts.dirTimes = testOpts.dirTimes
 		lastUpdateDirs = testOpts.lastUpdateDirs
 	}
 	ch := make(chan songOrErr)
@@ -151,13 +155,23 @@ func TestScanAndCompareSongs_Rewrite(t *testing.T) {
 	newSong5s.Disc = 3
 	newSong5s.DiscSubtitle = "The Third Disc"
 
+	newSong10s := test.Song10s
+	newSong10s.Title = "Ten Long Seconds"
+
 	// This also verifies that Song10s's TSST frame is used to fill DiscSubtitle.
 	test.Must(t, test.CopySongs(dir, test.Song1s.Filename, test.Song5s.Filename, test.Song10s.Filename))
 	opts := &scanTestOptions{
-		artistRewrites:  map[string]string{test.Song1s.Artist: newSong1s.Artist},
+		rewriteRules: []client.RewriteRule{
+			{Field: "artist", Match: test.Song1s.Artist, Replace: newSong1s.Artist},
+			// Only Song10s is on the specified album.
+			{Field: "title", MatchType: client.RegexMatch, Match: `^(\w+) Seconds$`, Replace: "$1 Long Seconds",
+				Album: test.Song10s.Album},
+			// None of the songs are in the specified directory.
+			{Field: "artist", Match: test.Song5s.Artist, Replace: "Ignored", Path: "other"},
+		},
 		albumIDRewrites: map[string]string{test.Song5s.AlbumID: newSong5s.AlbumID},
 	}
-	scanAndCompareSongs(t, "initial", dir, time.Time{}, opts, []db.Song{newSong1s, newSong5s, test.Song10s})
+	scanAndCompareSongs(t, "initial", dir, time.Time{}, opts, []db.Song{newSong1s, newSong5s, newSong10s})
 }
 
 func TestScanAndCompareSongs_NewFiles(t *testing.T) {
@@ -231,6 +245,32 @@ func TestScanAndCompareSongs_NewFiles(t *testing.T) {
 	}
 }
 
+func TestScanAndCompareSongs_Subdirs(t *testing.T) {
+	dir := t.TempDir()
+	test.Must(t, test.CopySongs(filepath.Join(dir, "a"), test.Song0s.Filename))
+	test.Must(t, test.CopySongs(filepath.Join(dir, "b"), test.Song1s.Filename))
+	gs := func(s db.Song, dir string) db.Song {
+		s.Filename = filepath.Join(dir, s.Filename)
+		return s
+	}
+
+	// Only the requested subdir should be scanned.
+	scanTime := time.Now()
+	dirs := scanAndCompareSongs(t, "partial", dir, time.Time{},
+		&scanTestOptions{subdirs: []string{"a"}}, []db.Song{gs(test.Song0s, "a")})
+	if want := []string{"a"}; !reflect.DeepEqual(dirs, want) {
+		t.Errorf("Partial scan returned dirs %v; want %v", dirs, want)
+	}
+
+	// A full scan should use the partially-scanned dir's time.
+	dirs = scanAndCompareSongs(t, "full", dir, time.Time{},
+		&scanTestOptions{lastUpdateDirs: dirs, dirTimes: map[string]time.Time{"a": scanTime}},
+		[]db.Song{gs(test.Song1s, "b")})
+	if want := []string{"a", "b"}; !reflect.DeepEqual(dirs, want) {
+		t.Errorf("Full scan returned dirs %v; want %v", dirs, want)
+	}
+}
+
 func TestScanAndCompareSongs_OverrideMetadata(t *testing.T) {
 	td := t.TempDir()
 	musicDir := filepath.Join(td, "music")
@@ -294,3 +334,29 @@ func waitCtime(t *testing.T, dir string, ref time.Time) {
 		time.Sleep(time.Millisecond)
 	}
 }
+
+func TestApplyCueSheets(t *testing.T) {
+	cue := &files.CueSheet{File: "album.mp3", Tracks: []files.CueTrack{{Number: 1}, {Number: 2}}}
+	cueReq := readRequest{path: "/music/a/album.cue", rel: "a/album.cue", cue: cue}
+	cues := map[string]readRequest{"a/album.mp3": cueReq}
+	song := readRequest{path: "/music/b/song.mp3", rel: "b/song.mp3"}
+	audio := readRequest{path: "/music/a/album.mp3", rel: "a/album.mp3"}
+
+	for _, tc := range []struct {
+		desc string
+		reqs []readRequest
+		want []readRequest
+	}{
+		{"no cue sheets", []readRequest{song}, []readRequest{song}},
+		{"updated cue sheet", []readRequest{cueReq, song}, []readRequest{cueReq, song}},
+		{"updated audio file", []readRequest{audio, song}, []readRequest{cueReq, song}},
+		{"updated both", []readRequest{cueReq, audio, song}, []readRequest{cueReq, song}},
+	} {
+		if got := applyCueSheets(tc.reqs, cues); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("applyCueSheets for %v returned %+v; want %+v", tc.desc, got, tc.want)
+		}
+	}
+	if n := cueReq.numSongs(); n != 2 {
+		t.Errorf("numSongs() = %v for cue sheet; want 2", n)
+	}
+}
@@ -6,6 +6,7 @@ package update
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -21,9 +22,9 @@ import (
 
 const (
 	tlsTimeout       = time.Minute
-	importBatchSize  = 50 // max songs to import per HTTP request
-	importTries      = 3
-	importRetryDelay = 3 * time.Second
+	importBatchSize  = 100 // max songs to import per HTTP request
+	importTries      = 5
+	importRetryDelay = 3 * time.Second // doubled after each failed attempt
 )
 
 // I started seeing "net/http: TLS handshake timeout" errors when trying to import songs.
@@ -46,7 +47,7 @@ func sendRequest(cfg *client.Config, method, path, query string,
 	if err != nil {
 		return nil, err
 	}
-	req.SetBasicAuth(cfg.Username, cfg.Password)
+	cfg.SetAuth(req)
 	if ctype != "" {
 		req.Header.Set("Content-Type", ctype)
 	}
@@ -61,11 +62,29 @@ func sendRequest(cfg *client.Config, method, path, query string,
 		return b, err
 	}
 	if resp.StatusCode != http.StatusOK {
-		return b, fmt.Errorf("got status %q", resp.Status)
+		return b, &statusError{resp.StatusCode, resp.Status}
 	}
 	return b, nil
 }
 
+// statusError is returned by sendRequest if the server returned a non-200 status.
+type statusError struct {
+	code   int    // e.g. 500
+	status string // e.g. "500 Internal Server Error"
+}
+
+func (e *statusError) Error() string { return fmt.Sprintf("got status %q", e.status) }
+
+// isTransientError returns true if err, returned by sendRequest, may go away if the
+// request is retried. Network errors and server errors are considered to be transient.
+func isTransientError(err error) bool {
+	var se *statusError
+	if errors.As(err, &se) {
+		return se.code >= 500 || se.code == http.StatusTooManyRequests
+	}
+	return true
+}
+
 // importSongsFlag values can be masked together to configure importSongs's behavior.
 type importSongsFlag uint32
 
@@ -84,7 +103,10 @@ const (
 )
 
 // importSongs reads all songs from ch and sends them to the server.
-func importSongs(cfg *client.Config, ch chan db.Song, flags importSongsFlag) error {
+// If onBatch is non-nil, it is called with each batch of songs after the batch has been
+// successfully imported.
+func importSongs(cfg *client.Config, ch chan db.Song, flags importSongsFlag,
+	onBatch func([]db.Song) error) error {
 	var args []string
 	if flags&importReplaceUserData != 0 {
 		args = append(args, "replaceUserData=1")
@@ -94,19 +116,30 @@ func importSongs(cfg *client.Config, ch chan db.Song, flags importSongsFlag) err
 	}
 	query := strings.Join(args, "&")
 
-	sendFunc := func(body []byte) error {
+	// Imports that span multiple requests use a bulk import session so the server can defer
+	// flushing cached queries and updating stats until all of the songs have been imported.
+	bulk := false
+	bulkQuery := strings.Join(append(args, "bulk=1"), "&")
+
+	sendFunc := func(path, params string, body []byte) error {
 		var err error
+		delay := importRetryDelay
 		for try := 1; try <= importTries; try++ {
-			r := bytes.NewReader(body)
-			if _, err = sendRequest(cfg, "POST", "/import", query, r, "text/plain"); err == nil {
+			var r io.Reader
+			if body != nil {
+				r = bytes.NewReader(body)
+			}
+			if _, err = sendRequest(cfg, "POST", path, params, r, "text/plain"); err == nil {
 				break
+			} else if !isTransientError(err) {
+				return err
 			} else if try < importTries {
-				delay := importRetryDelay
 				if flags&importNoRetryDelay != 0 {
 					delay = 0
 				}
 				log.Printf("Sleeping %v before retrying after error: %v", delay, err)
 				time.Sleep(delay)
+				delay *= 2
 			}
 		}
 		return err
@@ -115,29 +148,72 @@ func importSongs(cfg *client.Config, ch chan db.Song, flags importSongsFlag) err
 	// Ideally these results could just be streamed, but dev_appserver.py doesn't seem to support
 	// chunked encoding: https://code.google.com/p/googleappengine/issues/detail?id=129
 	// Might be for the best, as the max request duration could probably be hit otherwise.
-	var numSongs int
+	var batch []db.Song
 	var buf bytes.Buffer
 	e := json.NewEncoder(&buf)
-	for s := range ch {
-		numSongs++
-		if err := e.Encode(s); err != nil {
-			return fmt.Errorf("failed to encode song: %v", err)
+	sendBatch := func(params string) error {
+		// Pass the underlying bytes rather than an io.Reader so sendFunc() can re-read the
+		// data if it needs to retry due to network issues or App Engine flakiness.
+		if err := sendFunc("/import", params, buf.Bytes()); err != nil {
+			return err
 		}
-		if numSongs%importBatchSize == 0 {
-			// Pass the underlying bytes rather than an io.Reader so sendFunc() can re-read the
-			// data if it needs to retry due to network issues or App Engine flakiness.
-			if err := sendFunc(buf.Bytes()); err != nil {
+		if onBatch != nil {
+			if err := onBatch(batch); err != nil {
 				return err
 			}
-			buf.Reset()
 		}
+		buf.Reset()
+		batch = batch[:0]
+		return nil
 	}
-	if buf.Len() > 0 {
-		if err := sendFunc(buf.Bytes()); err != nil {
-			return err
+
+	err := func() error {
+		for s := range ch {
+			if err := e.Encode(s); err != nil {
+				return fmt.Errorf("failed to encode song: %v", err)
+			}
+			if batch = append(batch, s); len(batch) == importBatchSize {
+				bulk = true
+				if err := sendBatch(bulkQuery); err != nil {
+					return err
+				}
+			}
+		}
+		if len(batch) > 0 {
+			q := query
+			if bulk {
+				q = bulkQuery
+			}
+			if err := sendBatch(q); err != nil {
+				return err
+			}
+		}
+		return nil
+	}()
+
+	if bulk {
+		// End the bulk import session even if we failed partway through so the server
+		// won't continue deferring work.
+		if eerr := sendFunc("/end_import", "", nil); err == nil {
+			err = eerr
 		}
 	}
-	return nil
+	return err
+}
+
+// ImportSongs reads all songs from ch and sends them to the server.
+// If replaceUserData is true, the songs' existing user data (e.g. ratings, tags, plays)
+// is replaced; otherwise it's preserved. If useFilenames is true, the server identifies
+// existing songs by their filenames rather than by SHA1s of their audio data.
+func ImportSongs(cfg *client.Config, ch chan db.Song, replaceUserData, useFilenames bool) error {
+	var flags importSongsFlag
+	if replaceUserData {
+		flags |= importReplaceUserData
+	}
+	if useFilenames {
+		flags |= importUseFilenames
+	}
+	return importSongs(cfg, ch, flags, nil)
 }
 
 // dumpSong dumps the song with the specified ID from the server.
@@ -152,6 +228,17 @@ func dumpSong(cfg *client.Config, songID int64) (db.Song, error) {
 	return s, err
 }
 
+// getMergeCandidates asks the server for groups of songs that appear to be duplicates.
+func getMergeCandidates(cfg *client.Config) ([][]db.Song, error) {
+	b, err := sendRequest(cfg, "GET", "/merge_candidates", "", nil, "")
+	if err != nil {
+		return nil, err
+	}
+	var groups [][]db.Song
+	err = json.Unmarshal(b, &groups)
+	return groups, err
+}
+
 // deleteSong deletes the song with the specified ID from the server.
 func deleteSong(cfg *client.Config, songID int64) error {
 	params := fmt.Sprintf("songId=%v", songID)
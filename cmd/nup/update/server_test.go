@@ -8,6 +8,7 @@ import (
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"reflect"
 	"strconv"
 	"testing"
 
@@ -17,13 +18,21 @@ import (
 )
 
 func TestImportSongs(t *testing.T) {
-	var numReqs int
+	var numReqs, numBulkReqs, numEndReqs int
 	recv := make([]db.Song, 0)
 	replace := ""
 
 	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		replace = r.FormValue("replaceUserData")
 		defer r.Body.Close()
+		if r.URL.Path == "/end_import" {
+			numEndReqs++
+			w.Write([]byte("ok"))
+			return
+		}
+		replace = r.FormValue("replaceUserData")
+		if r.FormValue("bulk") == "1" {
+			numBulkReqs++
+		}
 
 		// Make the first request fail to test the retry logic.
 		if numReqs++; numReqs == 1 {
@@ -84,7 +93,7 @@ func TestImportSongs(t *testing.T) {
 		ch <- s1
 		close(ch)
 	}()
-	if err := importSongs(cfg, ch, importReplaceUserData|importNoRetryDelay); err != nil {
+	if err := importSongs(cfg, ch, importReplaceUserData|importNoRetryDelay, nil); err != nil {
 		t.Fatalf("Failed to send songs: %v", err)
 	}
 	if err := test.CompareSongs([]db.Song{s0, s1}, recv, test.CompareOrder); err != nil {
@@ -93,8 +102,17 @@ func TestImportSongs(t *testing.T) {
 	if replace != "1" {
 		t.Errorf("replaceUserData param was %q instead of 1", replace)
 	}
+	if numBulkReqs != 0 || numEndReqs != 0 {
+		t.Errorf("Got %d bulk and %d end request(s) for small import; want 0 and 0",
+			numBulkReqs, numEndReqs)
+	}
 
 	recv = recv[:0]
+	var batchSizes []int
+	onBatch := func(songs []db.Song) error {
+		batchSizes = append(batchSizes, len(songs))
+		return nil
+	}
 	sent := make([]db.Song, 250, 250)
 	ch = make(chan db.Song)
 	go func() {
@@ -104,7 +122,7 @@ func TestImportSongs(t *testing.T) {
 		}
 		close(ch)
 	}()
-	if err := importSongs(cfg, ch, importNoRetryDelay); err != nil {
+	if err := importSongs(cfg, ch, importNoRetryDelay, onBatch); err != nil {
 		t.Fatalf("Failed to send songs: %v", err)
 	}
 	if err := test.CompareSongs(sent, recv, test.CompareOrder); err != nil {
@@ -113,4 +131,31 @@ func TestImportSongs(t *testing.T) {
 	if len(replace) > 0 {
 		t.Errorf("replaceUserData param was %q instead of empty", replace)
 	}
+	if numBulkReqs != 3 || numEndReqs != 1 {
+		t.Errorf("Got %d bulk and %d end request(s) for large import; want 3 and 1",
+			numBulkReqs, numEndReqs)
+	}
+	if want := []int{100, 100, 50}; !reflect.DeepEqual(batchSizes, want) {
+		t.Errorf("onBatch got batches of sizes %v; want %v", batchSizes, want)
+	}
+}
+
+func TestImportSongs_NonTransientError(t *testing.T) {
+	var numReqs int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		numReqs++
+		http.Error(w, "Bad request", http.StatusBadRequest)
+	}))
+	defer server.Close()
+
+	ch := make(chan db.Song, 1)
+	ch <- db.Song{SHA1: "1"}
+	close(ch)
+	cfg := &client.Config{ServerURL: server.URL}
+	if err := importSongs(cfg, ch, importNoRetryDelay, nil); err == nil {
+		t.Error("importSongs unexpectedly succeeded")
+	}
+	if numReqs != 1 {
+		t.Errorf("importSongs sent %d request(s); want 1", numReqs)
+	}
 }
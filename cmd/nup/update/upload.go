@@ -0,0 +1,215 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package update
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"cloud.google.com/go/storage"
+
+	"github.com/derat/nup/cmd/nup/client"
+	"github.com/derat/nup/cmd/nup/client/files"
+	"github.com/derat/nup/cmd/nup/transcode"
+	"github.com/derat/nup/server/db"
+
+	"golang.org/x/oauth2/google"
+
+	"google.golang.org/api/option"
+)
+
+// songBucket is the subset of a Google Cloud Storage bucket used by songUploader.
+type songBucket interface {
+	// md5 returns the MD5 of the named object, or nil if the object doesn't exist.
+	md5(ctx context.Context, name string) ([]byte, error)
+	// put uploads the file at p as the named object.
+	put(ctx context.Context, name, p string) error
+}
+
+// songUploader uploads song files to a bucket. Lossless files are transcoded first,
+// and a client.TranscodeIndex is used to avoid transcoding and uploading them again
+// if they're unchanged.
+type songUploader struct {
+	cfg     *client.Config
+	client  *storage.Client // nil in tests
+	bucket  songBucket
+	index   *client.TranscodeIndex
+	tempDir string // holds transcoded files before they're uploaded
+	// transcode transcodes the lossless file at src to dst (see transcode.File).
+	// It's a field so it can be replaced by tests.
+	transcode func(src, dst, format string, bitrate int) error
+}
+
+// newSongUploader returns a songUploader that uploads to cfg.SongBucket.
+// The index is read from and written to cfg.TranscodeIndexFile.
+func newSongUploader(ctx context.Context, cfg *client.Config) (*songUploader, error) {
+	index, err := client.ReadTranscodeIndex(cfg.TranscodeIndexFile)
+	if err != nil {
+		return nil, fmt.Errorf("reading transcode index: %v", err)
+	}
+	creds, err := google.FindDefaultCredentials(ctx,
+		"https://www.googleapis.com/auth/devstorage.read_write",
+	)
+	if err != nil {
+		return nil, fmt.Errorf("finding credentials: %v", err)
+	}
+	sc, err := storage.NewClient(ctx, option.WithCredentials(creds))
+	if err != nil {
+		return nil, err
+	}
+	tempDir, err := ioutil.TempDir("", "nup-update-upload.")
+	if err != nil {
+		sc.Close()
+		return nil, err
+	}
+	return &songUploader{
+		cfg:       cfg,
+		client:    sc,
+		bucket:    gcsBucket{sc.Bucket(cfg.SongBucket)},
+		index:     index,
+		tempDir:   tempDir,
+		transcode: transcode.File,
+	}, nil
+}
+
+// close removes u's temporary directory and closes its storage client.
+func (u *songUploader) close() error {
+	os.RemoveAll(u.tempDir)
+	if u.client == nil {
+		return nil
+	}
+	return u.client.Close()
+}
+
+// upload uploads the song file at src (relative to the music dir) as s.Filename if the
+// bucket doesn't already contain it. If src is a lossless file, it's transcoded to
+// cfg.TranscodeFormat first unless the index shows that it was previously transcoded
+// and uploaded with the same audio data and settings. true is returned if a file was
+// uploaded.
+func (u *songUploader) upload(ctx context.Context, src string, s *db.Song) (bool, error) {
+	p := filepath.Join(u.cfg.MusicDir, src)
+	if !files.IsLosslessPath(src) {
+		sum, err := fileMD5(p)
+		if err != nil {
+			return false, err
+		}
+		if old, err := u.bucket.md5(ctx, s.Filename); err != nil {
+			return false, err
+		} else if bytes.Equal(old, sum) {
+			return false, nil
+		}
+		return true, u.bucket.put(ctx, s.Filename, p)
+	}
+
+	format := u.cfg.TranscodeFormat
+	bitrate := u.cfg.TranscodeBitrate
+	if bitrate == 0 {
+		bitrate = transcode.DefaultBitrate(format)
+	}
+	want := client.TranscodeRecord{SHA1: s.SHA1, Format: format, Bitrate: bitrate, Object: s.Filename}
+	if rec, ok := u.index.Get(src); ok {
+		oldMD5 := rec.MD5
+		rec.MD5 = ""
+		if rec == want {
+			// Make sure that the object wasn't deleted or replaced.
+			if cur, err := u.bucket.md5(ctx, s.Filename); err != nil {
+				return false, err
+			} else if hex.EncodeToString(cur) == oldMD5 {
+				return false, nil
+			}
+		}
+	}
+
+	dst := filepath.Join(u.tempDir, "song."+format)
+	defer os.Remove(dst)
+	if err := u.transcode(p, dst, format, bitrate); err != nil {
+		return false, fmt.Errorf("transcoding: %v", err)
+	}
+	sum, err := fileMD5(dst)
+	if err != nil {
+		return false, err
+	}
+	if err := u.bucket.put(ctx, s.Filename, dst); err != nil {
+		return false, err
+	}
+	want.MD5 = hex.EncodeToString(sum)
+	u.index.Set(src, want)
+	if err := u.index.Write(u.cfg.TranscodeIndexFile); err != nil {
+		return false, fmt.Errorf("writing transcode index: %v", err)
+	}
+	return true, nil
+}
+
+// fileMD5 returns the MD5 of the file at p.
+func fileMD5(p string) ([]byte, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	h := md5.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// gcsBucket implements songBucket for a Google Cloud Storage bucket.
+type gcsBucket struct{ *storage.BucketHandle }
+
+func (b gcsBucket) md5(ctx context.Context, name string) ([]byte, error) {
+	attrs, err := b.Object(name).Attrs(ctx)
+	if err == storage.ErrObjectNotExist {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return attrs.MD5, nil
+}
+
+// crc32cTable is used to compute CRC32C checksums like those used by GCS.
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+func (b gcsBucket) put(ctx context.Context, name, p string) error {
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// Compute the checksum first so that GCS can reject corrupted uploads.
+	h := crc32.New(crc32cTable)
+	if _, err := io.Copy(h, f); err != nil {
+		return err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	w := b.Object(name).NewWriter(ctx)
+	w.ContentType = songContentType(name)
+	w.CRC32C = h.Sum32()
+	w.SendCRC32C = true
+	if _, err := io.Copy(w, f); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+// songContentType returns the Content-Type to use for the song object named name.
+func songContentType(name string) string {
+	if filepath.Ext(name) == "."+transcode.Opus {
+		return "audio/ogg"
+	}
+	return "audio/mpeg"
+}
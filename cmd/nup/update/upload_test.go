@@ -0,0 +1,144 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package update
+
+import (
+	"context"
+	"crypto/md5"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/derat/nup/cmd/nup/client"
+	"github.com/derat/nup/server/db"
+)
+
+// fakeSongBucket implements songBucket using an in-memory map.
+type fakeSongBucket struct {
+	objects map[string][]byte // object data keyed by name
+	puts    []string          // names of uploaded objects
+}
+
+func (b *fakeSongBucket) md5(ctx context.Context, name string) ([]byte, error) {
+	data, ok := b.objects[name]
+	if !ok {
+		return nil, nil
+	}
+	sum := md5.Sum(data)
+	return sum[:], nil
+}
+
+func (b *fakeSongBucket) put(ctx context.Context, name, p string) error {
+	data, err := ioutil.ReadFile(p)
+	if err != nil {
+		return err
+	}
+	b.objects[name] = data
+	b.puts = append(b.puts, name)
+	return nil
+}
+
+func TestSongUploader(t *testing.T) {
+	dir := t.TempDir()
+	cfg := &client.Config{
+		MusicDir:           filepath.Join(dir, "music"),
+		TranscodeFormat:    "opus",
+		TranscodeIndexFile: filepath.Join(dir, "transcodes.json"),
+	}
+	if err := os.MkdirAll(cfg.MusicDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	write := func(fn, data string) {
+		if err := ioutil.WriteFile(filepath.Join(cfg.MusicDir, fn), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("a.mp3", "mp3 data")
+	write("b.flac", "flac data")
+
+	index, err := client.ReadTranscodeIndex(cfg.TranscodeIndexFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bucket := &fakeSongBucket{objects: make(map[string][]byte)}
+	var transcodes []string
+	u := &songUploader{
+		cfg:     cfg,
+		bucket:  bucket,
+		index:   index,
+		tempDir: filepath.Join(dir, "tmp"),
+		transcode: func(src, dst, format string, bitrate int) error {
+			transcodes = append(transcodes, filepath.Base(src))
+			data, err := ioutil.ReadFile(src)
+			if err != nil {
+				return err
+			}
+			return ioutil.WriteFile(dst, append(data, []byte(" as "+format)...), 0644)
+		},
+	}
+	if err := os.MkdirAll(u.tempDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	mp3 := db.Song{Filename: "a.mp3", SHA1: "aaaa"}
+	flac := db.Song{Filename: "b.opus", SHA1: "bbbb"}
+	upload := func(desc, src string, s db.Song, want bool) {
+		if got, err := u.upload(context.Background(), src, &s); err != nil {
+			t.Errorf("%v: upload(%q) failed: %v", desc, src, err)
+		} else if got != want {
+			t.Errorf("%v: upload(%q) = %v; want %v", desc, src, got, want)
+		}
+	}
+	checkPuts := func(desc string, want ...string) {
+		if !reflect.DeepEqual(bucket.puts, want) {
+			t.Errorf("%v: uploaded %q; want %q", desc, bucket.puts, want)
+		}
+		bucket.puts = nil
+	}
+
+	upload("initial", "a.mp3", mp3, true)
+	upload("initial", "b.flac", flac, true)
+	checkPuts("initial", "a.mp3", "b.opus")
+	if want := "flac data as opus"; string(bucket.objects["b.opus"]) != want {
+		t.Errorf("Uploaded %q for b.opus; want %q", bucket.objects["b.opus"], want)
+	}
+
+	// The index should be written so that future updates recognize the transcoded file.
+	if index, err := client.ReadTranscodeIndex(cfg.TranscodeIndexFile); err != nil {
+		t.Error("Failed reading index: ", err)
+	} else if src, ok := index.Source("b.opus"); !ok || src != "b.flac" {
+		t.Errorf("Index has source %q, %v for b.opus; want %q, true", src, ok, "b.flac")
+	}
+
+	// Unchanged files shouldn't be transcoded or uploaded again.
+	upload("unchanged", "a.mp3", mp3, false)
+	upload("unchanged", "b.flac", flac, false)
+	checkPuts("unchanged")
+
+	// Changing the MP3 file should result in it being uploaded again.
+	write("a.mp3", "new mp3 data")
+	upload("changed", "a.mp3", mp3, true)
+	checkPuts("changed", "a.mp3")
+
+	// Retagging the FLAC file without changing its audio shouldn't matter,
+	// but changing its audio or the transcoding settings should.
+	write("b.flac", "retagged flac data")
+	upload("retagged", "b.flac", flac, false)
+	flac.SHA1 = "cccc"
+	upload("new audio", "b.flac", flac, true)
+	cfg.TranscodeBitrate = 96
+	upload("new bitrate", "b.flac", flac, true)
+	checkPuts("changed flac", "b.opus", "b.opus")
+
+	// The file should also be uploaded again if the object was deleted.
+	delete(bucket.objects, "b.opus")
+	upload("deleted", "b.flac", flac, true)
+	checkPuts("deleted", "b.opus")
+
+	if want := []string{"b.flac", "b.flac", "b.flac", "b.flac"}; !reflect.DeepEqual(transcodes, want) {
+		t.Errorf("Transcoded %q; want %q", transcodes, want)
+	}
+}
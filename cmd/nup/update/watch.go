@@ -0,0 +1,107 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package update
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// Events watched for directories under the music dir.
+	watchMask = unix.IN_CLOSE_WRITE | unix.IN_MOVED_TO | unix.IN_CREATE
+
+	watchBufSize = 64 * 1024 // size of buffer for reading inotify events
+)
+
+// watcher uses inotify to watch for new and modified song files within a directory tree.
+type watcher struct {
+	fd       int                // inotify file descriptor
+	wds      map[int32]string   // watch descriptors to absolute dir paths
+	lossless bool               // report lossless files (see isSongPath)
+	buf      [watchBufSize]byte // buffer for reading events
+}
+
+// newWatcher returns a new watcher that watches dir and all of its subdirectories.
+// Lossless files are only reported if lossless is true.
+func newWatcher(dir string, lossless bool) (*watcher, error) {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+	w := &watcher{fd: fd, wds: make(map[int32]string), lossless: lossless}
+	if _, err := w.addTree(dir); err != nil {
+		w.close()
+		return nil, err
+	}
+	return w, nil
+}
+
+// close closes w's inotify file descriptor.
+func (w *watcher) close() error { return unix.Close(w.fd) }
+
+// addTree adds watches for dir and all of its subdirectories.
+// The absolute paths of all song files within the tree are returned.
+func (w *watcher) addTree(dir string) ([]string, error) {
+	var paths []string
+	err := filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			wd, err := unix.InotifyAddWatch(w.fd, p, watchMask)
+			if err != nil {
+				return fmt.Errorf("watching %v: %v", p, err)
+			}
+			w.wds[int32(wd)] = p
+		} else if fi.Mode().IsRegular() && isSongPath(p, w.lossless) {
+			paths = append(paths, p)
+		}
+		return nil
+	})
+	return paths, err
+}
+
+// read blocks until events are available and then returns the absolute paths of song files
+// that were written or moved into the tree. New subdirectories are also watched, and any
+// song files within them are returned. The same path may be returned multiple times.
+func (w *watcher) read() ([]string, error) {
+	n, err := unix.Read(w.fd, w.buf[:])
+	if err != nil {
+		return nil, err
+	}
+
+	var paths []string
+	for off := 0; off+unix.SizeofInotifyEvent <= n; {
+		ev := (*unix.InotifyEvent)(unsafe.Pointer(&w.buf[off]))
+		nameStart := off + unix.SizeofInotifyEvent
+		name := string(bytes.TrimRight(w.buf[nameStart:nameStart+int(ev.Len)], "\x00"))
+		off = nameStart + int(ev.Len)
+
+		dir, ok := w.wds[ev.Wd]
+		if !ok || name == "" {
+			continue
+		}
+		p := filepath.Join(dir, name)
+		switch {
+		case ev.Mask&unix.IN_ISDIR != 0 && ev.Mask&(unix.IN_CREATE|unix.IN_MOVED_TO) != 0:
+			// Files may have been added to the directory before we started watching it.
+			sub, err := w.addTree(p)
+			if err != nil && !os.IsNotExist(err) {
+				return nil, err
+			}
+			paths = append(paths, sub...)
+		case ev.Mask&unix.IN_ISDIR == 0 && ev.Mask&(unix.IN_CLOSE_WRITE|unix.IN_MOVED_TO) != 0:
+			if isSongPath(p, w.lossless) {
+				paths = append(paths, p)
+			}
+		}
+	}
+	return paths, nil
+}
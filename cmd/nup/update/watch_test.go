@@ -0,0 +1,61 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package update
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestWatcher(t *testing.T) {
+	dir := t.TempDir()
+	w, err := newWatcher(dir, false)
+	if err != nil {
+		t.Fatal("newWatcher failed: ", err)
+	}
+	defer w.close()
+
+	write := func(p string) {
+		if err := ioutil.WriteFile(p, []byte("data"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkRead := func(desc string, want ...string) {
+		// Keep reading until we get paths, since events for ignored files may be
+		// returned by themselves.
+		var got []string
+		for len(got) == 0 {
+			var err error
+			if got, err = w.read(); err != nil {
+				t.Fatalf("%v: read failed: %v", desc, err)
+			}
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%v: read returned %q; want %q", desc, got, want)
+		}
+	}
+
+	// Non-song files should be ignored.
+	write(filepath.Join(dir, "notes.txt"))
+	write(filepath.Join(dir, "a.mp3"))
+	checkRead("new file", filepath.Join(dir, "a.mp3"))
+
+	// Songs in directories that are moved into the tree should be reported.
+	sub := filepath.Join(t.TempDir(), "sub")
+	if err := os.Mkdir(sub, 0755); err != nil {
+		t.Fatal(err)
+	}
+	write(filepath.Join(sub, "b.mp3"))
+	if err := os.Rename(sub, filepath.Join(dir, "sub")); err != nil {
+		t.Fatal(err)
+	}
+	checkRead("moved dir", filepath.Join(dir, "sub/b.mp3"))
+
+	// The new directory should also be watched.
+	write(filepath.Join(dir, "sub/c.mp3"))
+	checkRead("file in moved dir", filepath.Join(dir, "sub/c.mp3"))
+}
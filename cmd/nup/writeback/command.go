@@ -0,0 +1,161 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package writeback
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/derat/nup/cmd/nup/client"
+	"github.com/derat/nup/cmd/nup/client/files"
+	"github.com/derat/nup/cmd/nup/update"
+	"github.com/derat/nup/server/db"
+	"github.com/google/subcommands"
+)
+
+type Command struct {
+	Cfg *client.Config
+
+	dryRun   bool   // only print changes
+	fields   string // comma-separated fields to write
+	doImport bool   // send rewritten songs to the server
+	out      client.OutputFlags
+	rep      *client.Reporter
+}
+
+func (*Command) Name() string     { return "writeback" }
+func (*Command) Synopsis() string { return "write server-side song data to local files" }
+func (*Command) Usage() string {
+	return `writeback <flags>:
+	Read dumped songs from stdin and write their server-side data
+	to the ID3v2 tags of the corresponding files in the music dir.
+	Ratings are written to POPM frames and tags are written to a
+	"` + tagsDesc + `" TXXX frame. Rewritten songs are then sent to the
+	server using their filenames so their SHA1s stay consistent.
+
+`
+}
+
+func (cmd *Command) SetFlags(f *flag.FlagSet) {
+	f.BoolVar(&cmd.dryRun, "dry-run", false, "Only print what would be changed")
+	f.StringVar(&cmd.fields, "fields", defaultFields,
+		"Comma-separated fields to write (artist, title, album, rating, tags)")
+	f.BoolVar(&cmd.doImport, "import", true, "Send rewritten songs to the server")
+	cmd.out.SetFlags(f)
+}
+
+func (cmd *Command) Execute(ctx context.Context, _ *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+	if cmd.Cfg.MusicDir == "" {
+		fmt.Fprintln(os.Stderr, "musicDir not set in config")
+		return subcommands.ExitUsageError
+	}
+	fields, err := parseFields(cmd.fields)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Bad -fields:", err)
+		return subcommands.ExitUsageError
+	}
+	if cmd.rep, err = cmd.out.NewReporter(os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, "Bad output flags:", err)
+		return subcommands.ExitUsageError
+	}
+	cmd.rep.LogText = true
+
+	var songs []db.Song
+	d := json.NewDecoder(os.Stdin)
+	for {
+		var s db.Song
+		if err := d.Decode(&s); err == io.EOF {
+			break
+		} else if err != nil {
+			fmt.Fprintln(os.Stderr, "Failed reading songs:", err)
+			return subcommands.ExitFailure
+		}
+		// Dumps include songs from all libraries, but the music dir only contains one.
+		if s.Library == cmd.Cfg.Library {
+			songs = append(songs, s)
+		}
+	}
+
+	var updated []db.Song
+	var numErrs int
+	cmd.rep.AddTotal(len(songs))
+	for _, s := range songs {
+		if changes, sha1, err := cmd.writeSong(&s, fields); err != nil {
+			cmd.rep.Item(s.Filename, "failed", fmt.Sprintf("Failed writing %v: %v", s.Filename, err))
+			numErrs++
+		} else if len(changes) > 0 {
+			msg := strings.Join(changes, ", ")
+			if cmd.dryRun {
+				cmd.rep.Item(s.Filename, "wouldUpdate", fmt.Sprintf("Would update %v: %v", s.Filename, msg))
+			} else {
+				cmd.rep.Item(s.Filename, "updated", fmt.Sprintf("Updated %v: %v", s.Filename, msg))
+				s.SHA1 = sha1
+				updated = append(updated, s)
+			}
+		}
+		cmd.rep.Advance(1)
+	}
+
+	if cmd.doImport && len(updated) > 0 {
+		cmd.rep.Textf("Sending %d song(s) to server", len(updated))
+		ch := make(chan db.Song, len(updated))
+		for _, s := range updated {
+			ch <- s
+		}
+		close(ch)
+		if err := update.ImportSongs(cmd.Cfg, ch, false, true); err != nil {
+			fmt.Fprintln(os.Stderr, "Failed sending songs:", err)
+			return subcommands.ExitFailure
+		}
+	}
+	cmd.rep.Summary()
+
+	if numErrs > 0 {
+		return subcommands.ExitFailure
+	}
+	return subcommands.ExitSuccess
+}
+
+// writeSong writes s's fields to its file and returns descriptions of the changes.
+// The SHA1 of the file's audio data is also returned. It's recomputed after writing
+// to verify that the audio data wasn't modified.
+func (cmd *Command) writeSong(s *db.Song, fields map[field]bool) (changes []string, sha1 string, err error) {
+	p := filepath.Join(cmd.Cfg.MusicDir, s.Filename)
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, "", err
+	}
+	tag, err := readID3Tag(f)
+	if err == nil {
+		sha1, err = files.ComputeSHA1(f)
+	}
+	f.Close()
+	if err != nil {
+		return nil, "", err
+	}
+
+	if changes = updateTag(tag, s, fields); len(changes) == 0 || cmd.dryRun {
+		return changes, sha1, nil
+	}
+	if err := writeID3Tag(p, tag); err != nil {
+		return nil, "", err
+	}
+
+	if f, err = os.Open(p); err != nil {
+		return nil, "", err
+	}
+	defer f.Close()
+	if newSHA1, err := files.ComputeSHA1(f); err != nil {
+		return nil, "", err
+	} else if newSHA1 != sha1 {
+		return nil, "", fmt.Errorf("audio SHA1 changed from %v to %v", sha1, newSHA1)
+	}
+	return changes, sha1, nil
+}
@@ -0,0 +1,400 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package writeback
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"unicode/utf16"
+)
+
+const (
+	id3HeaderLen  = 10   // length of ID3v2 tag header, footer, and frame headers
+	id3Padding    = 2048 // padding added when a tag needs to grow
+	id3FlagUnsync = 0x80 // header flag for unsynchronization
+	id3FlagExt    = 0x40 // header flag for extended header
+	id3FlagFooter = 0x10 // header flag for ID3v2.4 footer
+
+	// ID3v2 text encodings.
+	encLatin1  = 0
+	encUTF16   = 1 // with BOM
+	encUTF16BE = 2
+	encUTF8    = 3
+)
+
+// id3Frame is an undecoded ID3v2 frame.
+type id3Frame struct {
+	id    string // e.g. "TPE1"
+	flags [2]byte
+	data  []byte
+}
+
+// id3Tag holds the frames from an ID3v2.3 or ID3v2.4 tag.
+// Frames that aren't modified are written back unchanged.
+type id3Tag struct {
+	version byte // major version, i.e. 3 or 4
+	size    int  // size of the original tag in bytes (including header and footer), or 0 if none
+	frames  []id3Frame
+}
+
+// readID3Tag reads the ID3v2 tag at the beginning of r.
+// An empty ID3v2.4 tag is returned if r doesn't start with a tag.
+func readID3Tag(r io.ReaderAt) (*id3Tag, error) {
+	head := make([]byte, id3HeaderLen)
+	if n, err := r.ReadAt(head, 0); err != nil && err != io.EOF {
+		return nil, err
+	} else if n < id3HeaderLen || string(head[:3]) != "ID3" {
+		return &id3Tag{version: 4}, nil
+	}
+
+	t := &id3Tag{version: head[3]}
+	if t.version != 3 && t.version != 4 {
+		return nil, fmt.Errorf("unsupported ID3v2.%d tag", t.version)
+	}
+	flags := head[5]
+	if flags&id3FlagUnsync != 0 {
+		return nil, errors.New("unsynchronized tags are unsupported")
+	}
+	body := make([]byte, readSynchsafe(head[6:]))
+	if _, err := r.ReadAt(body, id3HeaderLen); err != nil {
+		return nil, fmt.Errorf("reading tag: %v", err)
+	}
+	t.size = id3HeaderLen + len(body)
+	if t.version == 4 && flags&id3FlagFooter != 0 {
+		t.size += id3HeaderLen
+	}
+
+	var pos int
+	if flags&id3FlagExt != 0 {
+		if len(body) < 4 {
+			return nil, errors.New("truncated extended header")
+		}
+		// The ID3v2.4 extended header size includes itself, but the ID3v2.3 size doesn't.
+		if t.version == 4 {
+			pos = readSynchsafe(body)
+		} else {
+			pos = 4 + int(binary.BigEndian.Uint32(body))
+		}
+	}
+	for pos+id3HeaderLen <= len(body) && body[pos] != 0 { // padding starts with a zero byte
+		f := id3Frame{id: string(body[pos : pos+4])}
+		var size int
+		if t.version == 4 {
+			size = readSynchsafe(body[pos+4:])
+		} else {
+			size = int(binary.BigEndian.Uint32(body[pos+4:]))
+		}
+		copy(f.flags[:], body[pos+8:])
+		pos += id3HeaderLen
+		if pos+size > len(body) {
+			return nil, fmt.Errorf("%v frame overflows tag", f.id)
+		}
+		f.data = append([]byte(nil), body[pos:pos+size]...)
+		t.frames = append(t.frames, f)
+		pos += size
+	}
+	return t, nil
+}
+
+// encode serializes t without a footer, adding padding so it's at least minSize bytes.
+func (t *id3Tag) encode(minSize int) []byte {
+	var body bytes.Buffer
+	for _, f := range t.frames {
+		body.WriteString(f.id)
+		if t.version == 4 {
+			body.Write(writeSynchsafe(len(f.data)))
+		} else {
+			var b [4]byte
+			binary.BigEndian.PutUint32(b[:], uint32(len(f.data)))
+			body.Write(b[:])
+		}
+		body.Write(f.flags[:])
+		body.Write(f.data)
+	}
+	if n := minSize - id3HeaderLen - body.Len(); n > 0 {
+		body.Write(make([]byte, n))
+	}
+	b := append([]byte{'I', 'D', '3', t.version, 0, 0}, writeSynchsafe(body.Len())...)
+	return append(b, body.Bytes()...)
+}
+
+// replaceFrame replaces the first frame matched by match with nf and removes other
+// matching frames. nf is appended if no frames match, and matching frames are
+// just removed if nf is nil.
+func (t *id3Tag) replaceFrame(match func(f *id3Frame) bool, nf *id3Frame) {
+	frames := t.frames[:0]
+	for i := range t.frames {
+		if !match(&t.frames[i]) {
+			frames = append(frames, t.frames[i])
+		} else if nf != nil {
+			frames = append(frames, *nf)
+			nf = nil
+		}
+	}
+	if nf != nil {
+		frames = append(frames, *nf)
+	}
+	t.frames = frames
+}
+
+// text returns the first value from the first text frame with the supplied ID.
+func (t *id3Tag) text(id string) string {
+	for _, f := range t.frames {
+		if f.id == id {
+			if vals := decodeText(f.data); len(vals) > 0 {
+				return vals[0]
+			}
+			return ""
+		}
+	}
+	return ""
+}
+
+// setText sets the text frame with the supplied ID to val.
+// The frame is removed if val is empty.
+func (t *id3Tag) setText(id, val string) {
+	var nf *id3Frame
+	if val != "" {
+		nf = &id3Frame{id: id, data: t.encodeText(val)}
+	}
+	t.replaceFrame(func(f *id3Frame) bool { return f.id == id }, nf)
+}
+
+// isUserText returns true if f is a TXXX frame with description desc.
+func isUserText(f *id3Frame, desc string) bool {
+	if f.id != "TXXX" {
+		return false
+	}
+	vals := decodeText(f.data)
+	return len(vals) > 0 && vals[0] == desc
+}
+
+// userText returns the value of the TXXX frame with description desc.
+func (t *id3Tag) userText(desc string) string {
+	for i := range t.frames {
+		if f := &t.frames[i]; isUserText(f, desc) {
+			if vals := decodeText(f.data); len(vals) > 1 {
+				return vals[1]
+			}
+			return ""
+		}
+	}
+	return ""
+}
+
+// setUserText sets the TXXX frame with description desc to val.
+// The frame is removed if val is empty.
+func (t *id3Tag) setUserText(desc, val string) {
+	var nf *id3Frame
+	if val != "" {
+		nf = &id3Frame{id: "TXXX", data: t.encodeText(desc, val)}
+	}
+	t.replaceFrame(func(f *id3Frame) bool { return isUserText(f, desc) }, nf)
+}
+
+// parsePOPM parses a POPM (popularimeter) frame's data into its email address, rating
+// byte, and play counter bytes. ok is false if data is malformed.
+func parsePOPM(data []byte) (email string, rating byte, counter []byte, ok bool) {
+	i := bytes.IndexByte(data, 0)
+	if i < 0 || i+1 >= len(data) {
+		return "", 0, nil, false
+	}
+	return decodeLatin1(data[:i]), data[i+1], data[i+2:], true
+}
+
+// isPOPM returns true if f is a POPM frame with the supplied email address.
+func isPOPM(f *id3Frame, email string) bool {
+	if f.id != "POPM" {
+		return false
+	}
+	e, _, _, ok := parsePOPM(f.data)
+	return ok && e == email
+}
+
+// popularity returns the rating byte from the POPM frame with the supplied email address,
+// or 0 if the frame isn't present.
+func (t *id3Tag) popularity(email string) byte {
+	for i := range t.frames {
+		if f := &t.frames[i]; isPOPM(f, email) {
+			_, rating, _, _ := parsePOPM(f.data)
+			return rating
+		}
+	}
+	return 0
+}
+
+// setPopularity sets the rating byte in the POPM frame with the supplied email address.
+// The existing play counter is preserved. The frame is removed if rating is 0.
+func (t *id3Tag) setPopularity(email string, rating byte) {
+	var nf *id3Frame
+	if rating != 0 {
+		var counter []byte
+		for i := range t.frames {
+			if f := &t.frames[i]; isPOPM(f, email) {
+				_, _, counter, _ = parsePOPM(f.data)
+				break
+			}
+		}
+		data := append(append([]byte(email), 0, rating), counter...)
+		nf = &id3Frame{id: "POPM", data: data}
+	}
+	t.replaceFrame(func(f *id3Frame) bool { return isPOPM(f, email) }, nf)
+}
+
+// encodeText encodes vals as the data for a text frame. UTF-8 is used for ID3v2.4 tags,
+// while UTF-16 is used for ID3v2.3 tags (which don't support UTF-8).
+func (t *id3Tag) encodeText(vals ...string) []byte {
+	if t.version == 4 {
+		b := []byte{encUTF8}
+		for i, v := range vals {
+			if i > 0 {
+				b = append(b, 0)
+			}
+			b = append(b, v...)
+		}
+		return b
+	}
+	b := []byte{encUTF16}
+	for i, v := range vals {
+		if i > 0 {
+			b = append(b, 0, 0)
+		}
+		b = append(b, 0xff, 0xfe) // little-endian BOM
+		for _, u := range utf16.Encode([]rune(v)) {
+			b = append(b, byte(u), byte(u>>8))
+		}
+	}
+	return b
+}
+
+// decodeText decodes the null-separated strings in a text frame's data.
+func decodeText(data []byte) []string {
+	if len(data) == 0 {
+		return nil
+	}
+	enc, data := data[0], data[1:]
+	var vals []string
+	switch enc {
+	case encUTF16, encUTF16BE:
+		for len(data) > 0 {
+			end := len(data)
+			for i := 0; i+1 < len(data); i += 2 {
+				if data[i] == 0 && data[i+1] == 0 {
+					end = i
+					break
+				}
+			}
+			vals = append(vals, decodeUTF16(data[:end], enc == encUTF16BE))
+			if end+2 > len(data) {
+				break
+			}
+			data = data[end+2:]
+		}
+	default:
+		for _, b := range bytes.Split(bytes.TrimRight(data, "\x00"), []byte{0}) {
+			if enc == encLatin1 {
+				vals = append(vals, decodeLatin1(b))
+			} else {
+				vals = append(vals, string(b))
+			}
+		}
+	}
+	return vals
+}
+
+// decodeLatin1 decodes ISO-8859-1 data.
+func decodeLatin1(b []byte) string {
+	rs := make([]rune, len(b))
+	for i, c := range b {
+		rs[i] = rune(c)
+	}
+	return string(rs)
+}
+
+// decodeUTF16 decodes UTF-16 data. A leading BOM overrides bigEndian.
+func decodeUTF16(b []byte, bigEndian bool) string {
+	if len(b) >= 2 {
+		if b[0] == 0xff && b[1] == 0xfe {
+			bigEndian, b = false, b[2:]
+		} else if b[0] == 0xfe && b[1] == 0xff {
+			bigEndian, b = true, b[2:]
+		}
+	}
+	us := make([]uint16, len(b)/2)
+	for i := range us {
+		if bigEndian {
+			us[i] = uint16(b[2*i])<<8 | uint16(b[2*i+1])
+		} else {
+			us[i] = uint16(b[2*i+1])<<8 | uint16(b[2*i])
+		}
+	}
+	return string(utf16.Decode(us))
+}
+
+// readSynchsafe reads a 28-bit synchsafe integer from the first four bytes of b.
+func readSynchsafe(b []byte) int {
+	return int(b[0]&0x7f)<<21 | int(b[1]&0x7f)<<14 | int(b[2]&0x7f)<<7 | int(b[3]&0x7f)
+}
+
+// writeSynchsafe encodes v as a 28-bit synchsafe integer.
+func writeSynchsafe(v int) []byte {
+	return []byte{byte(v>>21) & 0x7f, byte(v>>14) & 0x7f, byte(v>>7) & 0x7f, byte(v) & 0x7f}
+}
+
+// writeID3Tag replaces the ID3v2 tag at the beginning of the file at p with t.
+// If t fits in the space used by the file's original tag, it's written in place;
+// otherwise, the file is rewritten with additional padding after the tag.
+func writeID3Tag(p string, t *id3Tag) error {
+	if data := t.encode(t.size); t.size > 0 && len(data) == t.size {
+		f, err := os.OpenFile(p, os.O_WRONLY, 0)
+		if err != nil {
+			return err
+		}
+		if _, err := f.WriteAt(data, 0); err != nil {
+			f.Close()
+			return err
+		}
+		return f.Close()
+	}
+
+	src, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	fi, err := src.Stat()
+	if err != nil {
+		return err
+	}
+
+	// Write to a temp file and rename it so the song won't be truncated if we're interrupted.
+	dst, err := ioutil.TempFile(filepath.Dir(p), "."+filepath.Base(p)+".")
+	if err != nil {
+		return err
+	}
+	if err := func() error {
+		if _, err := dst.Write(t.encode(len(t.encode(0)) + id3Padding)); err != nil {
+			return err
+		}
+		audio := io.NewSectionReader(src, int64(t.size), fi.Size()-int64(t.size))
+		if _, err := io.Copy(dst, audio); err != nil {
+			return err
+		}
+		if err := dst.Chmod(fi.Mode()); err != nil {
+			return err
+		}
+		return dst.Close()
+	}(); err != nil {
+		dst.Close()
+		os.Remove(dst.Name())
+		return err
+	}
+	return os.Rename(dst.Name(), p)
+}
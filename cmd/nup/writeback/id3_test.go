@@ -0,0 +1,193 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package writeback
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// makeFrame returns a serialized frame for an ID3v2 tag with the supplied version.
+func makeFrame(version byte, id string, data []byte) []byte {
+	b := []byte(id)
+	if version == 4 {
+		b = append(b, writeSynchsafe(len(data))...)
+	} else {
+		n := len(data)
+		b = append(b, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+	}
+	return append(append(b, 0, 0), data...)
+}
+
+// makeTag returns a serialized ID3v2 tag containing frames and padding zero bytes.
+func makeTag(version byte, padding int, frames ...[]byte) []byte {
+	var body []byte
+	for _, f := range frames {
+		body = append(body, f...)
+	}
+	body = append(body, make([]byte, padding)...)
+	return append(append([]byte{'I', 'D', '3', version, 0, 0}, writeSynchsafe(len(body))...), body...)
+}
+
+func TestReadID3Tag(t *testing.T) {
+	for _, tc := range []struct {
+		version byte
+		frames  [][]byte
+	}{
+		{4, [][]byte{
+			makeFrame(4, "TPE1", []byte("\x03Artist")),
+			makeFrame(4, "TXXX", []byte("\x03nup Tags\x00drums guitar")),
+		}},
+		{3, [][]byte{
+			makeFrame(3, "TPE1", []byte("\x01\xff\xfeA\x00r\x00t\x00")),
+			makeFrame(3, "POPM", []byte("nup\x00\xc4\x00\x00\x00\x05")),
+		}},
+	} {
+		data := append(makeTag(tc.version, 20, tc.frames...), "audio"...)
+		tag, err := readID3Tag(bytes.NewReader(data))
+		if err != nil {
+			t.Errorf("readID3Tag failed for v2.%d tag: %v", tc.version, err)
+			continue
+		}
+		if want := len(data) - len("audio"); tag.size != want {
+			t.Errorf("v2.%d tag has size %d; want %d", tc.version, tag.size, want)
+		}
+		if len(tag.frames) != len(tc.frames) {
+			t.Errorf("v2.%d tag has %d frame(s); want %d", tc.version, len(tag.frames), len(tc.frames))
+		}
+		// Unmodified tags should be re-encoded identically.
+		if got := tag.encode(tag.size); !bytes.Equal(got, data[:tag.size]) {
+			t.Errorf("v2.%d tag encoded as %q; want %q", tc.version, got, data[:tag.size])
+		}
+	}
+
+	if tag, err := readID3Tag(bytes.NewReader([]byte("audio data"))); err != nil {
+		t.Error("readID3Tag failed for untagged data:", err)
+	} else if tag.size != 0 || tag.version != 4 || len(tag.frames) != 0 {
+		t.Errorf("readID3Tag returned %+v for untagged data", tag)
+	}
+}
+
+func TestID3Tag_Frames(t *testing.T) {
+	for _, version := range []byte{3, 4} {
+		tag := &id3Tag{version: version}
+		tag.setText("TPE1", "Björk")
+		tag.setUserText(tagsDesc, "electronic vocals")
+		tag.setPopularity(popmEmail, 128)
+		if got := tag.text("TPE1"); got != "Björk" {
+			t.Errorf("v2.%d TPE1 is %q; want %q", version, got, "Björk")
+		}
+		if got := tag.userText(tagsDesc); got != "electronic vocals" {
+			t.Errorf("v2.%d tags are %q; want %q", version, got, "electronic vocals")
+		}
+		if got := tag.popularity(popmEmail); got != 128 {
+			t.Errorf("v2.%d popularity is %d; want 128", version, got)
+		}
+
+		// Clearing values should remove their frames.
+		tag.setText("TPE1", "")
+		tag.setUserText(tagsDesc, "")
+		tag.setPopularity(popmEmail, 0)
+		if len(tag.frames) != 0 {
+			t.Errorf("v2.%d tag has %d frame(s) after clearing; want 0", version, len(tag.frames))
+		}
+	}
+}
+
+func TestID3Tag_SetPopularityPreservesCounter(t *testing.T) {
+	tag := &id3Tag{version: 4, frames: []id3Frame{
+		{id: "POPM", data: []byte("other\x00\x40")},
+		{id: "POPM", data: []byte("nup\x00\x40\x00\x00\x01\x00")},
+	}}
+	tag.setPopularity(popmEmail, 255)
+	want := []id3Frame{
+		{id: "POPM", data: []byte("other\x00\x40")},
+		{id: "POPM", data: []byte("nup\x00\xff\x00\x00\x01\x00")},
+	}
+	if !reflect.DeepEqual(tag.frames, want) {
+		t.Errorf("setPopularity produced %q; want %q", tag.frames, want)
+	}
+}
+
+func TestDecodeText(t *testing.T) {
+	for _, tc := range []struct {
+		data string
+		want []string
+	}{
+		{"\x00caf\xe9", []string{"café"}},
+		{"\x03caf\xc3\xa9\x00second\x00", []string{"café", "second"}},
+		{"\x01\xff\xfea\x00\x00\x00\xfe\xff\x00b", []string{"a", "b"}},
+		{"\x02\x00a\x00b\x00\x00", []string{"ab"}},
+		{"", nil},
+	} {
+		if got := decodeText([]byte(tc.data)); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("decodeText(%q) = %q; want %q", tc.data, got, tc.want)
+		}
+	}
+}
+
+func TestWriteID3Tag(t *testing.T) {
+	dir := t.TempDir()
+	p := filepath.Join(dir, "song.mp3")
+	audio := []byte("audio data")
+	orig := append(makeTag(4, 16, makeFrame(4, "TPE1", []byte("\x03Old"))), audio...)
+
+	// Reads p and checks that it has the expected artist and audio data.
+	check := func(artist string) *id3Tag {
+		data, err := ioutil.ReadFile(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tag, err := readID3Tag(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal("Failed reading tag:", err)
+		}
+		if got := tag.text("TPE1"); got != artist {
+			t.Errorf("Artist is %q; want %q", got, artist)
+		}
+		if got := data[tag.size:]; !bytes.Equal(got, audio) {
+			t.Errorf("Audio data is %q; want %q", got, audio)
+		}
+		return tag
+	}
+
+	if err := ioutil.WriteFile(p, orig, 0644); err != nil {
+		t.Fatal(err)
+	}
+	tag, err := readID3Tag(bytes.NewReader(orig))
+	if err != nil {
+		t.Fatal("Failed reading tag:", err)
+	}
+
+	// A short value should fit in the existing padding.
+	tag.setText("TPE1", "New")
+	if err := writeID3Tag(p, tag); err != nil {
+		t.Fatal("writeID3Tag failed:", err)
+	}
+	if tag := check("New"); tag.size != len(orig)-len(audio) {
+		t.Errorf("Tag size changed from %d to %d", len(orig)-len(audio), tag.size)
+	}
+
+	// A longer value requires the file to be rewritten with more padding.
+	long := string(bytes.Repeat([]byte("x"), 100))
+	tag.setText("TPE1", long)
+	if err := writeID3Tag(p, tag); err != nil {
+		t.Fatal("writeID3Tag failed:", err)
+	}
+	check(long)
+
+	// Tags should also be added to untagged files.
+	if err := ioutil.WriteFile(p, audio, 0644); err != nil {
+		t.Fatal(err)
+	}
+	tag = &id3Tag{version: 4}
+	tag.setText("TPE1", "Added")
+	if err := writeID3Tag(p, tag); err != nil {
+		t.Fatal("writeID3Tag failed:", err)
+	}
+	check("Added")
+}
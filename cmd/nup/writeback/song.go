@@ -0,0 +1,92 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package writeback
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/derat/nup/server/db"
+)
+
+const (
+	// popmEmail is the email address used in POPM frames written for ratings.
+	popmEmail = "nup"
+	// tagsDesc is the description of the TXXX frame containing space-separated tags.
+	tagsDesc = "nup Tags"
+)
+
+// popmRatings maps from db.Song.Rating values (indexes) to POPM rating bytes,
+// using the same values as Windows Media Player and other popular players.
+var popmRatings = [...]byte{0, 1, 64, 128, 196, 255}
+
+// field is a song field that can be written to files.
+type field string
+
+const (
+	artistField field = "artist" // TPE1 frame
+	titleField  field = "title"  // TIT2 frame
+	albumField  field = "album"  // TALB frame
+	ratingField field = "rating" // POPM frame
+	tagsField   field = "tags"   // TXXX frame
+)
+
+// defaultFields contains the fields that are written by default.
+// Titles and albums are excluded since the server's values can differ from
+// files' values due to rewrites (e.g. disc numbers extracted from album names).
+const defaultFields = "artist,rating,tags"
+
+// parseFields parses a comma-separated list of fields.
+func parseFields(s string) (map[field]bool, error) {
+	fields := make(map[field]bool)
+	for _, v := range strings.Split(s, ",") {
+		switch f := field(strings.TrimSpace(v)); f {
+		case artistField, titleField, albumField, ratingField, tagsField:
+			fields[f] = true
+		case "":
+		default:
+			return nil, fmt.Errorf("unknown field %q", f)
+		}
+	}
+	if len(fields) == 0 {
+		return nil, errors.New("no fields supplied")
+	}
+	return fields, nil
+}
+
+// updateTag updates t to contain the values from s's fields that are listed in fields.
+// Descriptions of the changes are returned.
+func updateTag(t *id3Tag, s *db.Song, fields map[field]bool) []string {
+	var changes []string
+	update := func(f field, old, val string, set func(string)) {
+		if fields[f] && old != val {
+			set(val)
+			changes = append(changes, fmt.Sprintf("%v %q -> %q", f, old, val))
+		}
+	}
+	for _, info := range []struct {
+		f   field
+		id  string
+		val string
+	}{
+		{artistField, "TPE1", s.Artist},
+		{titleField, "TIT2", s.Title},
+		{albumField, "TALB", s.Album},
+	} {
+		id := info.id
+		update(info.f, t.text(id), info.val, func(v string) { t.setText(id, v) })
+	}
+
+	if fields[ratingField] && s.Rating >= 0 && s.Rating < len(popmRatings) {
+		if old, val := t.popularity(popmEmail), popmRatings[s.Rating]; old != val {
+			t.setPopularity(popmEmail, val)
+			changes = append(changes, fmt.Sprintf("%v %d -> %d", ratingField, old, val))
+		}
+	}
+	update(tagsField, t.userText(tagsDesc), strings.Join(s.Tags, " "),
+		func(v string) { t.setUserText(tagsDesc, v) })
+
+	return changes
+}
@@ -0,0 +1,50 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package writeback
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/derat/nup/server/db"
+)
+
+func TestParseFields(t *testing.T) {
+	if got, err := parseFields(defaultFields); err != nil {
+		t.Errorf("parseFields(%q) failed: %v", defaultFields, err)
+	} else if want := map[field]bool{artistField: true, ratingField: true, tagsField: true}; !reflect.DeepEqual(got, want) {
+		t.Errorf("parseFields(%q) = %v; want %v", defaultFields, got, want)
+	}
+	for _, s := range []string{"", "artist,bogus"} {
+		if _, err := parseFields(s); err == nil {
+			t.Errorf("parseFields(%q) unexpectedly succeeded", s)
+		}
+	}
+}
+
+func TestUpdateTag(t *testing.T) {
+	tag := &id3Tag{version: 4}
+	tag.setText("TPE1", "Old Artist")
+	tag.setText("TIT2", "Old Title")
+	tag.setUserText(tagsDesc, "rock")
+
+	s := db.Song{Artist: "New Artist", Title: "New Title", Rating: 4, Tags: []string{"guitar", "rock"}}
+	fields := map[field]bool{artistField: true, ratingField: true, tagsField: true}
+	want := []string{
+		`artist "Old Artist" -> "New Artist"`,
+		`rating 0 -> 196`,
+		`tags "rock" -> "guitar rock"`,
+	}
+	if got := updateTag(tag, &s, fields); !reflect.DeepEqual(got, want) {
+		t.Errorf("updateTag returned %q; want %q", got, want)
+	}
+	if got := tag.text("TIT2"); got != "Old Title" {
+		t.Errorf("Title is %q; want %q", got, "Old Title")
+	}
+
+	// Updating the tag again shouldn't change anything.
+	if got := updateTag(tag, &s, fields); len(got) != 0 {
+		t.Errorf("Second updateTag returned %q; want no changes", got)
+	}
+}
@@ -8,6 +8,7 @@ require (
 	github.com/derat/mpeg v0.0.0-20230408141713-c1dd2fd5e8e8
 	github.com/derat/taglib-go v0.0.0-20200408183415-49d1875d1328
 	github.com/evanw/esbuild v0.14.39
+	github.com/golang/protobuf v1.3.3
 	github.com/google/go-cmp v0.4.0
 	github.com/google/subcommands v1.2.0
 	github.com/mitchellh/go-ps v1.0.0
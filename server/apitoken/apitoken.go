@@ -0,0 +1,143 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+// Package apitoken manages API tokens that can be used to authorize requests
+// from non-browser clients.
+package apitoken
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/derat/nup/server/db"
+
+	"google.golang.org/appengine/v2/datastore"
+)
+
+const (
+	tokenBytes   = 32        // random bytes in each token
+	bearerPrefix = "Bearer " // Authorization header prefix preceding tokens
+)
+
+// ErrNotFound is returned by Lookup and Revoke if the token doesn't exist.
+var ErrNotFound = errors.New("token not found")
+
+// FromRequest returns the token passed in r's Authorization header.
+// An empty string is returned if the header doesn't contain a bearer token.
+func FromRequest(r *http.Request) string {
+	h := r.Header.Get("Authorization")
+	if len(h) < len(bearerPrefix) || !strings.EqualFold(h[:len(bearerPrefix)], bearerPrefix) {
+		return ""
+	}
+	return strings.TrimSpace(h[len(bearerPrefix):])
+}
+
+// ValidScope returns true if scope is a known scope.
+func ValidScope(scope db.TokenScope) bool {
+	switch scope {
+	case db.ReadScope, db.UpdateScope, db.AdminScope:
+		return true
+	default:
+		return false
+	}
+}
+
+// hash returns the hex-encoded SHA-256 hash of token, which is used as its key name.
+func hash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Create generates and saves a new token that acts as user with the supplied scope.
+// The token is returned along with its (hashed) datastore representation.
+func Create(ctx context.Context, user string, scope db.TokenScope, desc string) (string, *db.APIToken, error) {
+	if user == "" {
+		return "", nil, errors.New("no user supplied")
+	} else if !ValidScope(scope) {
+		return "", nil, fmt.Errorf("invalid scope %q", scope)
+	}
+	b := make([]byte, tokenBytes)
+	if _, err := rand.Read(b); err != nil {
+		return "", nil, err
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+	t := db.APIToken{
+		ID:      hash(token),
+		User:    user,
+		Scope:   scope,
+		Desc:    desc,
+		Created: time.Now(),
+	}
+	key := datastore.NewKey(ctx, db.APITokenKind, t.ID, 0, nil)
+	if _, err := datastore.Put(ctx, key, &t); err != nil {
+		return "", nil, err
+	}
+	return token, &t, nil
+}
+
+// Lookup returns the saved token matching token.
+// ErrNotFound is returned if the token doesn't exist or has been revoked.
+func Lookup(ctx context.Context, token string) (*db.APIToken, error) {
+	var t db.APIToken
+	t.ID = hash(token)
+	key := datastore.NewKey(ctx, db.APITokenKind, t.ID, 0, nil)
+	if err := datastore.Get(ctx, key, &t); err == datastore.ErrNoSuchEntity {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// List returns all tokens, or only the tokens acting as user if it is non-empty.
+// Tokens are sorted by creation time.
+func List(ctx context.Context, user string) ([]db.APIToken, error) {
+	q := datastore.NewQuery(db.APITokenKind)
+	if user != "" {
+		q = q.Filter("User =", user)
+	}
+	tokens := make([]db.APIToken, 0)
+	keys, err := q.GetAll(ctx, &tokens)
+	if err != nil {
+		return nil, err
+	}
+	for i, k := range keys {
+		tokens[i].ID = k.StringID()
+	}
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].Created.Before(tokens[j].Created) })
+	return tokens, nil
+}
+
+// Revoke deletes the token with the supplied ID (i.e. db.APIToken.ID).
+// ErrNotFound is returned if the token doesn't exist.
+func Revoke(ctx context.Context, id string) error {
+	return datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+		key := datastore.NewKey(ctx, db.APITokenKind, id, 0, nil)
+		var t db.APIToken
+		if err := datastore.Get(ctx, key, &t); err == datastore.ErrNoSuchEntity {
+			return ErrNotFound
+		} else if err != nil {
+			return err
+		}
+		return datastore.Delete(ctx, key)
+	}, nil)
+}
+
+// Clear deletes all tokens from datastore for testing.
+func Clear(ctx context.Context) error {
+	if keys, err := datastore.NewQuery(db.APITokenKind).KeysOnly().GetAll(ctx, nil); err != nil {
+		return fmt.Errorf("getting %v keys failed: %v", db.APITokenKind, err)
+	} else if err := datastore.DeleteMulti(ctx, keys); err != nil {
+		return fmt.Errorf("deleting all %v entities failed: %v", db.APITokenKind, err)
+	}
+	return nil
+}
@@ -0,0 +1,45 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package apitoken
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestFromRequest(t *testing.T) {
+	for _, tc := range []struct {
+		header string
+		want   string
+	}{
+		{"", ""},
+		{"Bearer abc123", "abc123"},
+		{"bearer abc123", "abc123"},
+		{"Bearer  abc123 ", "abc123"},
+		{"Basic dXNlcjpwYXNz", ""},
+		{"Bearer", ""},
+	} {
+		r, err := http.NewRequest("GET", "https://example.org/query", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tc.header != "" {
+			r.Header.Set("Authorization", tc.header)
+		}
+		if got := FromRequest(r); got != tc.want {
+			t.Errorf("FromRequest() with %q = %q; want %q", tc.header, got, tc.want)
+		}
+	}
+}
+
+func TestHash(t *testing.T) {
+	const token = "abc"
+	if got, want := hash(token),
+		"ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"; got != want {
+		t.Errorf("hash(%q) = %q; want %q", token, got, want)
+	}
+	if hash("abd") == hash(token) {
+		t.Error("Different tokens produced identical hashes")
+	}
+}
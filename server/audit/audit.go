@@ -0,0 +1,110 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+// Package audit records modifications of songs and user data.
+package audit
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/derat/nup/server/db"
+
+	"google.golang.org/appengine/v2/datastore"
+)
+
+const (
+	defaultListSize = 100  // default number of entries returned by List
+	maxListSize     = 1000 // max number of entries returned by List
+)
+
+// Record saves an entry describing a modification made by user via endpoint.
+// songID should be 0 if the modification wasn't limited to a single song.
+func Record(ctx context.Context, user, endpoint string, songID int64, before, after string) error {
+	e := db.AuditEntry{
+		User:     user,
+		Time:     time.Now(),
+		Endpoint: endpoint,
+		SongID:   songID,
+		Before:   before,
+		After:    after,
+	}
+	_, err := datastore.Put(ctx, datastore.NewIncompleteKey(ctx, db.AuditEntryKind, nil), &e)
+	return err
+}
+
+// List returns up to max of the most recent entries, newest first.
+// If songID or user are non-zero, only matching entries are returned.
+// If max is non-positive, a default size is used.
+func List(ctx context.Context, songID int64, user string, max int) ([]db.AuditEntry, error) {
+	if max <= 0 {
+		max = defaultListSize
+	} else if max > maxListSize {
+		max = maxListSize
+	}
+	q := datastore.NewQuery(db.AuditEntryKind)
+	if songID != 0 {
+		q = q.Filter("SongID =", songID)
+	}
+	if user != "" {
+		q = q.Filter("User =", user)
+	}
+	entries := make([]db.AuditEntry, 0)
+	if _, err := q.Order("-Time").Limit(max).GetAll(ctx, &entries); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// Summarize returns a short description of s's user data for use in entries.
+// An empty string is returned if s is nil.
+func Summarize(s *db.Song) string {
+	if s == nil {
+		return ""
+	}
+	plays := s.NumPlays
+	if len(s.Plays) > plays {
+		plays = len(s.Plays)
+	}
+	return fmt.Sprintf("%s - %s: rating=%d tags=[%s] plays=%d",
+		s.Artist, s.Title, s.Rating, strings.Join(s.Tags, " "), plays)
+}
+
+// SummarizeMetadata returns a short description of s's user-editable metadata
+// for use in entries. An empty string is returned if s is nil.
+func SummarizeMetadata(s *db.Song) string {
+	if s == nil {
+		return ""
+	}
+	var date string
+	if !s.Date.IsZero() {
+		date = s.Date.Format("2006-01-02")
+	}
+	return fmt.Sprintf("artist=%q title=%q album=%q date=%s track=%d disc=%d",
+		s.Artist, s.Title, s.Album, date, s.Track, s.Disc)
+}
+
+// SongSummary loads the song identified by id from datastore and summarizes it using Summarize.
+// An empty string is returned if the song doesn't exist.
+func SongSummary(ctx context.Context, id int64) (string, error) {
+	var s db.Song
+	key := datastore.NewKey(ctx, db.SongKind, "", id, nil)
+	if err := datastore.Get(ctx, key, &s); err == datastore.ErrNoSuchEntity {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	return Summarize(&s), nil
+}
+
+// Clear deletes all entries from datastore for testing.
+func Clear(ctx context.Context) error {
+	if keys, err := datastore.NewQuery(db.AuditEntryKind).KeysOnly().GetAll(ctx, nil); err != nil {
+		return fmt.Errorf("getting %v keys failed: %v", db.AuditEntryKind, err)
+	} else if err := datastore.DeleteMulti(ctx, keys); err != nil {
+		return fmt.Errorf("deleting all %v entities failed: %v", db.AuditEntryKind, err)
+	}
+	return nil
+}
@@ -11,6 +11,8 @@ import (
 	"fmt"
 	"strconv"
 
+	"github.com/derat/nup/server/metrics"
+
 	"google.golang.org/appengine/v2/datastore"
 	"google.golang.org/appengine/v2/memcache"
 )
@@ -44,10 +46,12 @@ var jsonCodec = memcache.Codec{
 // If the object isn't present, ok is false and err is nil.
 func GetMemcache(ctx context.Context, key string, dst interface{}) (ok bool, err error) {
 	if _, err := jsonCodec.Get(ctx, key, dst); err == memcache.ErrCacheMiss {
+		recordLookup(Memcache, key, false)
 		return false, nil
 	} else if err != nil {
 		return false, err
 	}
+	recordLookup(Memcache, key, true)
 	return true, nil
 }
 
@@ -77,10 +81,12 @@ func DeleteMemcache(ctx context.Context, key string) error {
 // If the object isn't present, ok is false and err is nil.
 func GetDatastore(ctx context.Context, key *datastore.Key, dst interface{}) (ok bool, err error) {
 	if err := datastore.Get(ctx, key, dst); err == datastore.ErrNoSuchEntity {
+		recordLookup(Datastore, key.StringID(), false)
 		return false, nil
 	} else if err != nil {
 		return false, err
 	}
+	recordLookup(Datastore, key.StringID(), true)
 	return true, nil
 }
 
@@ -106,6 +112,15 @@ func DeleteDatastore(ctx context.Context, key *datastore.Key) error {
 	return nil
 }
 
+// recordLookup records a lookup of key in t for metrics.CacheLookups.
+func recordLookup(t Type, key string, hit bool) {
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+	metrics.Add(metrics.CacheLookups, metrics.Labels{"type": t.String(), "key": key, "result": result}, 1)
+}
+
 // joinErrors returns a new error all messages from any non-nil errors in errs.
 // If no non-nil errors are present, nil is returned.
 func joinErrors(errs []error) error {
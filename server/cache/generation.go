@@ -0,0 +1,146 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package cache
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+
+	"google.golang.org/appengine/v2/memcache"
+)
+
+// DefaultGenerationCheckInterval is the default minimum interval between checks
+// of a Generation's shared number.
+const DefaultGenerationCheckInterval = time.Second
+
+// Generation tracks a generation number that is shared between all of the app's instances via
+// memcache. Instances call Bump after making changes that invalidate other instances' in-memory
+// caches and call Check before using their caches. When Check observes a different generation
+// number than it saw previously, it runs all functions registered via OnChange.
+//
+// Memcache may evict the number at any time. If that happens, all instances treat the
+// disappearance as a change and the next Bump call initializes the number to the current
+// time so that it's unlikely to match a number that was seen earlier.
+type Generation struct {
+	store genStore
+	now   func() time.Time
+
+	// CheckInterval is the minimum interval between reads of the shared number by Check.
+	CheckInterval time.Duration
+
+	mu        sync.Mutex // guards following fields
+	seen      uint64     // last-seen shared number
+	lastCheck time.Time  // last time that the shared number was read
+	funcs     []func()   // called when the number changes
+}
+
+// NewGeneration returns a new Generation that stores its number in memcache at key.
+func NewGeneration(key string) *Generation {
+	return newGeneration(&memcacheGenStore{key}, time.Now)
+}
+
+func newGeneration(store genStore, now func() time.Time) *Generation {
+	return &Generation{store: store, now: now, CheckInterval: DefaultGenerationCheckInterval}
+}
+
+// OnChange registers f to be called synchronously by Check or Bump when a new generation is seen.
+func (g *Generation) OnChange(f func()) {
+	g.mu.Lock()
+	g.funcs = append(g.funcs, f)
+	g.mu.Unlock()
+}
+
+// Check reads the shared generation number and runs the functions registered via OnChange
+// if it differs from the previously-seen number. The number is read at most once per
+// CheckInterval; Check returns immediately if it was read more recently than that.
+func (g *Generation) Check(ctx context.Context) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	now := g.now()
+	if !g.lastCheck.IsZero() && now.Sub(g.lastCheck) < g.CheckInterval {
+		return nil
+	}
+	n, err := g.store.get(ctx)
+	if err != nil {
+		return err
+	}
+	g.lastCheck = now
+	g.update(n)
+	return nil
+}
+
+// Bump increments the shared generation number, causing other instances to run their
+// OnChange functions the next time that they call Check. g's own functions are run immediately.
+func (g *Generation) Bump(ctx context.Context) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	n, err := g.store.incr(ctx)
+	if err != nil {
+		return err
+	}
+	g.lastCheck = g.now()
+	// Run the functions even if we somehow already saw the new number,
+	// since the caller has presumably just changed something.
+	g.seen = n
+	g.runFuncs()
+	return nil
+}
+
+// Number returns the current shared generation number without running any OnChange functions.
+// If the number is unset (e.g. because memcache evicted it), it is initialized so that the
+// returned number is unlikely to match one that was returned earlier.
+func (g *Generation) Number(ctx context.Context) (uint64, error) {
+	n, err := g.store.get(ctx)
+	if err != nil || n != 0 {
+		return n, err
+	}
+	return g.store.incr(ctx)
+}
+
+// update records n as the latest shared number and runs g.funcs if it differs from g.seen.
+// g.mu must be held.
+func (g *Generation) update(n uint64) {
+	if n == g.seen {
+		return
+	}
+	g.seen = n
+	g.runFuncs()
+}
+
+// runFuncs runs all of g.funcs. g.mu must be held.
+func (g *Generation) runFuncs() {
+	for _, f := range g.funcs {
+		f()
+	}
+}
+
+// genStore stores a shared generation number.
+type genStore interface {
+	// get returns the current number, or 0 if it is unset.
+	get(ctx context.Context) (uint64, error)
+	// incr increments the number and returns its new value.
+	incr(ctx context.Context) (uint64, error)
+}
+
+// memcacheGenStore implements genStore using memcache.
+type memcacheGenStore struct{ key string }
+
+func (s *memcacheGenStore) get(ctx context.Context) (uint64, error) {
+	item, err := memcache.Get(ctx, s.key)
+	if err == memcache.ErrCacheMiss {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	// memcache.Increment stores numbers as decimal strings.
+	return strconv.ParseUint(string(item.Value), 10, 64)
+}
+
+func (s *memcacheGenStore) incr(ctx context.Context) (uint64, error) {
+	return memcache.Increment(ctx, s.key, 1, uint64(time.Now().UnixNano()))
+}
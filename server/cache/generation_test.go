@@ -0,0 +1,144 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package cache
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeGenStore implements genStore in memory.
+type fakeGenStore struct {
+	mu   sync.Mutex
+	n    uint64
+	init uint64 // initial value used by incr when n is 0
+}
+
+func (s *fakeGenStore) get(ctx context.Context) (uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.n, nil
+}
+
+func (s *fakeGenStore) incr(ctx context.Context) (uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.n == 0 {
+		s.n = s.init
+	}
+	s.n++
+	return s.n, nil
+}
+
+// evict simulates memcache evicting the number.
+func (s *fakeGenStore) evict() {
+	s.mu.Lock()
+	s.n = 0
+	s.mu.Unlock()
+}
+
+func TestGeneration_MultipleInstances(t *testing.T) {
+	ctx := context.Background()
+	store := &fakeGenStore{init: 100}
+	now := time.Date(2023, 4, 1, 0, 0, 0, 0, time.UTC)
+	clock := func() time.Time { return now }
+
+	// Simulate several instances, each of which has its own in-memory cache.
+	const numInstances = 3
+	gens := make([]*Generation, numInstances)
+	changes := make([]int, numInstances)
+	for i := range gens {
+		i := i
+		gens[i] = newGeneration(store, clock)
+		gens[i].OnChange(func() { changes[i]++ })
+	}
+
+	bump := func(i int) {
+		t.Helper()
+		if err := gens[i].Bump(ctx); err != nil {
+			t.Fatalf("Instance %d: Bump failed: %v", i, err)
+		}
+	}
+	checkAll := func(desc string, want []int) {
+		t.Helper()
+		for i, g := range gens {
+			if err := g.Check(ctx); err != nil {
+				t.Fatalf("%v: instance %d: Check failed: %v", desc, i, err)
+			}
+		}
+		for i := range changes {
+			if changes[i] != want[i] {
+				t.Errorf("%v: instance %d saw %d change(s); want %d", desc, i, changes[i], want[i])
+			}
+		}
+	}
+
+	checkAll("initial", []int{0, 0, 0})
+
+	// The bumping instance should see the change immediately, but other instances
+	// shouldn't notice it until their check interval has elapsed.
+	bump(0)
+	checkAll("after bump", []int{1, 0, 0})
+	now = now.Add(DefaultGenerationCheckInterval)
+	checkAll("after interval", []int{1, 1, 1})
+	now = now.Add(DefaultGenerationCheckInterval)
+	checkAll("unchanged", []int{1, 1, 1})
+
+	// Concurrent bumps from multiple instances should be picked up by everyone.
+	bump(1)
+	bump(2)
+	now = now.Add(DefaultGenerationCheckInterval)
+	checkAll("after multiple bumps", []int{2, 3, 2})
+
+	// Evictions should be treated as changes, and the next bump should produce a
+	// different number than was seen before.
+	store.evict()
+	now = now.Add(DefaultGenerationCheckInterval)
+	checkAll("after eviction", []int{3, 4, 3})
+	store.init = 200
+	bump(0)
+	now = now.Add(DefaultGenerationCheckInterval)
+	checkAll("after bump following eviction", []int{4, 5, 4})
+}
+
+func TestGeneration_Number(t *testing.T) {
+	ctx := context.Background()
+	store := &fakeGenStore{init: 100}
+	now := time.Date(2023, 4, 1, 0, 0, 0, 0, time.UTC)
+	g := newGeneration(store, func() time.Time { return now })
+
+	number := func(desc string) uint64 {
+		t.Helper()
+		n, err := g.Number(ctx)
+		if err != nil {
+			t.Fatalf("%v: Number failed: %v", desc, err)
+		}
+		return n
+	}
+
+	// The number should be initialized if it's unset.
+	first := number("initial")
+	if first == 0 {
+		t.Fatal("Initial number is 0")
+	}
+	if n := number("unchanged"); n != first {
+		t.Errorf("Unchanged number is %d; want %d", n, first)
+	}
+	if err := g.Bump(ctx); err != nil {
+		t.Fatal("Bump failed: ", err)
+	}
+	bumped := number("after bump")
+	if bumped == first {
+		t.Errorf("Number after bump is still %d", bumped)
+	}
+
+	// After an eviction, the number shouldn't match any earlier number.
+	store.evict()
+	store.init = 200
+	if n := number("after eviction"); n == 0 || n == first || n == bumped {
+		t.Errorf("Number after eviction is %d", n)
+	}
+}
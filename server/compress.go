@@ -0,0 +1,111 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package main
+
+import (
+	"compress/gzip"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// compressibleTypes contains MIME types (in addition to text/*) of responses that
+// are compressed by gzipResponseWriter.
+var compressibleTypes = map[string]bool{
+	"application/javascript":    true,
+	"application/json":          true,
+	"application/manifest+json": true,
+	"application/xml":           true,
+	"image/svg+xml":             true,
+}
+
+// acceptsGzip returns true if header, an Accept-Encoding header value, permits gzip.
+func acceptsGzip(header string) bool {
+	for _, v := range strings.Split(header, ",") {
+		parts := strings.Split(v, ";")
+		if coding := strings.ToLower(strings.TrimSpace(parts[0])); coding != "gzip" && coding != "*" {
+			continue
+		}
+		ok := true
+		for _, p := range parts[1:] {
+			if p = strings.TrimSpace(p); strings.HasPrefix(p, "q=") {
+				if q, err := strconv.ParseFloat(p[2:], 64); err != nil || q <= 0 {
+					ok = false
+				}
+			}
+		}
+		return ok
+	}
+	return false
+}
+
+// isCompressible returns true if a response with the supplied Content-Type header
+// value should be compressed.
+func isCompressible(ctype string) bool {
+	mt, _, err := mime.ParseMediaType(ctype)
+	if err != nil {
+		return false
+	}
+	return strings.HasPrefix(mt, "text/") || compressibleTypes[mt]
+}
+
+// gzipResponseWriter wraps an http.ResponseWriter and compresses the response using gzip
+// if it has a compressible type. Data is compressed as it's written, so streamed responses
+// don't need to be buffered in memory. Close must be called after the response is written.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	gw      *gzip.Writer // nil if the response isn't being compressed
+	decided bool         // true after the response's headers have been written
+}
+
+func newGzipResponseWriter(w http.ResponseWriter) *gzipResponseWriter {
+	return &gzipResponseWriter{ResponseWriter: w}
+}
+
+func (w *gzipResponseWriter) WriteHeader(code int) {
+	if !w.decided {
+		w.decided = true
+		h := w.Header()
+		h.Add("Vary", "Accept-Encoding")
+		if code == http.StatusOK && h.Get("Content-Encoding") == "" && isCompressible(h.Get("Content-Type")) {
+			h.Set("Content-Encoding", "gzip")
+			h.Del("Content-Length") // no longer accurate
+			w.gw = gzip.NewWriter(w.ResponseWriter)
+		}
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *gzipResponseWriter) Write(b []byte) (int, error) {
+	if !w.decided {
+		// Match the behavior of http.ResponseWriter.
+		if w.Header().Get("Content-Type") == "" {
+			w.Header().Set("Content-Type", http.DetectContentType(b))
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.gw != nil {
+		return w.gw.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Flush implements http.Flusher.
+func (w *gzipResponseWriter) Flush() {
+	if w.gw != nil {
+		w.gw.Flush()
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Close writes any remaining compressed data.
+func (w *gzipResponseWriter) Close() error {
+	if w.gw != nil {
+		return w.gw.Close()
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package main
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAcceptsGzip(t *testing.T) {
+	for _, tc := range []struct {
+		header string
+		want   bool
+	}{
+		{"", false},
+		{"gzip", true},
+		{"deflate, gzip, br", true},
+		{"GZIP", true},
+		{"gzip;q=0.5", true},
+		{"gzip;q=0", false},
+		{"gzip; q=0.0", false},
+		{"*", true},
+		{"br", false},
+		{"identity", false},
+	} {
+		if got := acceptsGzip(tc.header); got != tc.want {
+			t.Errorf("acceptsGzip(%q) = %v; want %v", tc.header, got, tc.want)
+		}
+	}
+}
+
+func TestGzipResponseWriter(t *testing.T) {
+	body := strings.Repeat(`{"artist":"Some Artist","title":"Some Title"}`+"\n", 100)
+	for _, tc := range []struct {
+		ctype    string // Content-Type header set by handler
+		code     int    // status code written by handler
+		compress bool
+	}{
+		{"application/json", http.StatusOK, true},
+		{"text/plain; charset=utf-8", http.StatusOK, true},
+		{"", http.StatusOK, true}, // detected as text/plain
+		{"audio/mpeg", http.StatusOK, false},
+		{"image/jpeg", http.StatusOK, false},
+		{"application/json", http.StatusPartialContent, false},
+		{"text/plain", http.StatusInternalServerError, false},
+	} {
+		rec := httptest.NewRecorder()
+		w := newGzipResponseWriter(rec)
+		if tc.ctype != "" {
+			w.Header().Set("Content-Type", tc.ctype)
+		}
+		w.Header().Set("Content-Length", "1234")
+		if tc.code != http.StatusOK {
+			w.WriteHeader(tc.code)
+		}
+		for _, ln := range strings.SplitAfter(body, "\n") {
+			if _, err := w.Write([]byte(ln)); err != nil {
+				t.Fatalf("%q/%d: Write failed: %v", tc.ctype, tc.code, err)
+			}
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("%q/%d: Close failed: %v", tc.ctype, tc.code, err)
+		}
+
+		res := rec.Result()
+		if got := res.Header.Get("Vary"); got != "Accept-Encoding" {
+			t.Errorf("%q/%d: Vary is %q", tc.ctype, tc.code, got)
+		}
+		got := rec.Body.String()
+		if tc.compress {
+			if enc := res.Header.Get("Content-Encoding"); enc != "gzip" {
+				t.Errorf("%q/%d: Content-Encoding is %q; want gzip", tc.ctype, tc.code, enc)
+			}
+			if cl := res.Header.Get("Content-Length"); cl != "" {
+				t.Errorf("%q/%d: Content-Length is %q; want empty", tc.ctype, tc.code, cl)
+			}
+			r, err := gzip.NewReader(rec.Body)
+			if err != nil {
+				t.Fatalf("%q/%d: gzip.NewReader failed: %v", tc.ctype, tc.code, err)
+			}
+			b, err := ioutil.ReadAll(r)
+			if err != nil {
+				t.Fatalf("%q/%d: Reading compressed body failed: %v", tc.ctype, tc.code, err)
+			}
+			got = string(b)
+		} else if enc := res.Header.Get("Content-Encoding"); enc != "" {
+			t.Errorf("%q/%d: Content-Encoding is %q; want empty", tc.ctype, tc.code, enc)
+		}
+		if got != body {
+			t.Errorf("%q/%d: Got body %q; want %q", tc.ctype, tc.code, got, body)
+		}
+	}
+}
@@ -12,6 +12,10 @@ import (
 	"fmt"
 	"net/http"
 	"os"
+	"strings"
+	"time"
+
+	"github.com/derat/nup/server/queue"
 
 	"google.golang.org/appengine/v2"
 	"google.golang.org/appengine/v2/datastore"
@@ -26,8 +30,15 @@ const (
 // SavedConfig is used to store a JSON-marshaled Config in Datastore.
 type SavedConfig struct {
 	JSON string `datastore:"json,noindex"`
+	// Version is incremented each time that the config is saved.
+	Version int64 `datastore:"version,noindex"`
+	// UpdatedTime contains the time at which the config was last saved.
+	UpdatedTime time.Time `datastore:"updated,noindex"`
 }
 
+// ErrVersionMismatch is returned by Save if the saved config has an unexpected version.
+var ErrVersionMismatch = errors.New("config version mismatch")
+
 // User contains information about a user allowed to access the server.
 type User struct {
 	// Email contains an email address for Google authentication, used for the web interface.
@@ -53,6 +64,10 @@ type User struct {
 
 	// ExcludedTags contains a list of tags used to filter songs.
 	ExcludedTags []string `json:"excludedTags"`
+
+	// Library contains the name of the library from Config.Libraries that is used by default
+	// for this user's requests. If empty, the server's main library is used.
+	Library string `json:"library,omitempty"`
 }
 
 // Name returns a human-readable string identifying u.
@@ -63,6 +78,21 @@ func (u *User) Name() string {
 	return u.Username
 }
 
+// FindPreset returns the preset named name from u's presets, or from defaults
+// if u doesn't have any custom presets. Nil is returned if the preset isn't found.
+func (u *User) FindPreset(name string, defaults []SearchPreset) *SearchPreset {
+	presets := u.Presets
+	if len(presets) == 0 {
+		presets = defaults
+	}
+	for i := range presets {
+		if presets[i].Name == name {
+			return &presets[i]
+		}
+	}
+	return nil
+}
+
 // Type returns u's type.
 func (u *User) Type() UserType {
 	switch {
@@ -89,6 +119,8 @@ const (
 	GuestUser
 	// CronUser indicates a request issued by App Engine cron jobs.
 	CronUser
+	// TaskUser indicates a request issued by App Engine task queues.
+	TaskUser
 )
 
 // SearchPreset specifies a search preset to display.
@@ -121,10 +153,22 @@ type SearchPreset struct {
 	// MaxPlays specifies the maximum number of times that each song has been played.
 	// -1 specifies that there is no restriction on the number of plays.
 	MaxPlays int `json:"maxPlays"`
+	// MaxSkipRatio specifies the maximum fraction of each song's playbacks that were skipped
+	// (see db.Song.SkipRatio), e.g. 0.5 to avoid frequently-skipped songs. 0 specifies that
+	// there is no restriction.
+	MaxSkipRatio float64 `json:"maxSkipRatio,omitempty"`
+	// MinBPM and MaxBPM restrict results to songs with tempos within the given range in beats
+	// per minute, e.g. for workout playlists. 0 specifies that there is no restriction.
+	// Songs without BPM metadata are excluded if either field is set.
+	MinBPM float64 `json:"minBpm,omitempty"`
+	MaxBPM float64 `json:"maxBpm,omitempty"`
 	// FirstTrack specifies that only albums' first tracks should be returned.
 	FirstTrack bool `json:"firstTrack"`
 	// Shuffle specifies that the returned songs should be shuffled.
 	Shuffle bool `json:"shuffle"`
+	// ShuffleAlbums specifies that random albums should be returned, with each album's
+	// songs kept together in disc and track order. Useful for playing full albums.
+	ShuffleAlbums bool `json:"shuffleAlbums,omitempty"`
 	// Play specifies that returned songs should be played automatically.
 	// The current playlist is replaced.
 	Play bool `json:"play"`
@@ -137,10 +181,126 @@ func (p *SearchPreset) UnmarshalJSON(data []byte) error {
 	// Use json.Decoder rather than json.Unmarshal so we can reject unknown fields.
 	dec := json.NewDecoder(bytes.NewReader(data))
 	dec.DisallowUnknownFields()
-	type searchPreset *SearchPreset // avoid stack overflow
-	return dec.Decode(searchPreset(p))
+	type alias SearchPreset // lacks UnmarshalJSON, avoiding infinite recursion
+	return dec.Decode((*alias)(p))
+}
+
+// MirrorConfig configures the server as a read-only mirror of a primary server.
+type MirrorConfig struct {
+	// PrimaryURL contains the base URL of the primary server, e.g. "https://example.appspot.com/".
+	PrimaryURL string `json:"primaryUrl"`
+	// Username and Password contain HTTP basic auth credentials for an admin user on the
+	// primary server.
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// CacheConfig describes how long clients and intermediate caches (e.g. Cloud CDN)
+// may cache /cover and /song responses.
+type CacheConfig struct {
+	// CoverSec and SongSec contain the max-age in seconds for /cover and /song responses.
+	// Each defaults to a day if zero.
+	CoverSec int `json:"coverSec"`
+	SongSec  int `json:"songSec"`
+	// VersionedSec contains the max-age in seconds for /cover and /song responses to
+	// requests whose "v" parameter matches the current version of the Cloud Storage object
+	// (derived from its checksum). If positive, requests without a matching version are
+	// redirected to the object's versioned URL, and the redirect is cached for CoverSec or
+	// SongSec. Replacing an object thus only requires waiting out the shorter lifetime.
+	// Versioned URLs are disabled if zero.
+	VersionedSec int `json:"versionedSec"`
+}
+
+// defaultCacheSec is the default value for CacheConfig.CoverSec and SongSec.
+const defaultCacheSec = 86400
+
+// ScheduledPreset describes a search preset that is evaluated at scheduled times
+// to replace a user's server-side queue (see the /queue endpoint).
+type ScheduledPreset struct {
+	// User contains the email address or username of the user whose queue is replaced.
+	User string `json:"user"`
+	// Preset contains the name of a SearchPreset from User.Presets (or Config.Presets
+	// if the user doesn't have custom presets).
+	Preset string `json:"preset"`
+	// Times contains 24-hour times of day formatted as "HH:MM" at which the preset
+	// should be evaluated.
+	Times []string `json:"times"`
+	// TimeZone contains the IANA name of the time zone used to interpret Times,
+	// e.g. "America/Los_Angeles". UTC is used if empty.
+	TimeZone string `json:"timeZone,omitempty"`
 }
 
+// Location returns the time zone used to interpret p.Times.
+func (p *ScheduledPreset) Location() (*time.Location, error) {
+	return time.LoadLocation(p.TimeZone)
+}
+
+// RateLimit limits the rate at which users can send requests to an endpoint.
+type RateLimit struct {
+	// Path contains the endpoint's path, e.g. "/query".
+	Path string `json:"path"`
+	// Users contains the email addresses or usernames of users to whom the limit applies.
+	// If empty, the limit applies to all users.
+	Users []string `json:"users,omitempty"`
+	// GuestOnly indicates that the limit only applies to guest users.
+	GuestOnly bool `json:"guestOnly,omitempty"`
+	// MaxRequests contains the maximum number of requests that each user can send
+	// to Path within the interval.
+	MaxRequests int `json:"maxRequests"`
+	// IntervalSec contains the interval's length in seconds.
+	IntervalSec int `json:"intervalSec"`
+}
+
+// Interval returns rl.IntervalSec as a time.Duration.
+func (rl *RateLimit) Interval() time.Duration {
+	return time.Duration(rl.IntervalSec) * time.Second
+}
+
+// appliesTo returns true if rl applies to the user identified by name with type utype.
+func (rl *RateLimit) appliesTo(name string, utype UserType) bool {
+	if rl.GuestOnly && utype != GuestUser {
+		return false
+	}
+	if len(rl.Users) == 0 {
+		return true
+	}
+	for _, u := range rl.Users {
+		if u == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Library describes a collection of songs that is stored separately from the server's
+// main library (i.e. the songs in SongBucket).
+type Library struct {
+	// Name uniquely identifies the library. It is stored in db.Song.Library.
+	Name string `json:"name"`
+	// SongBucket contains the name of the Google Cloud Storage bucket holding the library's
+	// song files.
+	SongBucket string `json:"songBucket"`
+	// CoverBucket contains the name of the Google Cloud Storage bucket holding the library's
+	// album cover images. Scaled covers are cached in memcache by filename, so cover
+	// filenames shouldn't collide with ones used by other libraries.
+	CoverBucket string `json:"coverBucket"`
+	// Users contains the names (see User.Name) of non-admin users who can access the library.
+	// Admin users can access all libraries.
+	Users []string `json:"users"`
+}
+
+// ClientType describes how a client authenticates to the server.
+type ClientType string
+
+const (
+	// WebClient is a client authenticated via a Google account, e.g. the web interface.
+	WebClient ClientType = "web"
+	// BasicAuthClient is a client authenticated via HTTP basic auth, e.g. the Android app.
+	BasicAuthClient ClientType = "basic"
+	// TokenClient is a client authenticated via an API token.
+	TokenClient ClientType = "token"
+)
+
 // Config holds the App Engine server's configuration.
 type Config struct {
 	// Users contains information about users who can access the server.
@@ -159,6 +319,25 @@ type Config struct {
 	// This is used for testing.
 	// Exactly one of CoverBucket and CoverBaseURL must be set.
 	CoverBaseURL string `json:"coverBaseUrl,omitempty"`
+	// CoverCacheBucket contains the name of the Google Cloud Storage bucket used to cache
+	// scaled versions of album cover images so they don't need to be regenerated by
+	// later /cover requests. It may be the same as CoverBucket. Scaled images are
+	// stored as e.g. "foo.256.jpg" alongside "foo.jpg". If empty, scaled images are
+	// only cached in memcache.
+	CoverCacheBucket string `json:"coverCacheBucket,omitempty"`
+
+	// SignedSongURLs lists the types of clients that should be redirected to short-lived
+	// signed Cloud Storage URLs by the /song endpoint instead of having song data proxied
+	// through App Engine. Valid values are WebClient, BasicAuthClient, and TokenClient.
+	// The song bucket must have a CORS configuration permitting GET requests from the
+	// server's origin, since the web client processes audio using the Web Audio API.
+	// Requests from guest users and requests using access tokens are always proxied so
+	// that rate limits can be enforced.
+	SignedSongURLs []ClientType `json:"signedSongUrls,omitempty"`
+
+	// Libraries contains additional libraries of songs stored in separate buckets.
+	// All users can access the main library described by SongBucket and CoverBucket.
+	Libraries []Library `json:"libraries,omitempty"`
 
 	// Presets contains default search presets.
 	Presets []SearchPreset `json:"presets"`
@@ -169,7 +348,60 @@ type Config struct {
 
 	// MaxGuestSongRequestsPerHour contains the maximum rate at which each guest
 	// user can send requests to the /song endpoint. Unlimited if 0 or negative.
+	// This is shorthand for an equivalent entry in RateLimits.
 	MaxGuestSongRequestsPerHour int `json:"maxGuestSongRequestsPerHour,omitempty"`
+
+	// RateLimits contains limits on the rate at which users can send requests to endpoints.
+	// Requests exceeding a limit are rejected with 429 Too Many Requests.
+	RateLimits []RateLimit `json:"rateLimits,omitempty"`
+
+	// PlayDecayDays contains a half-life in days used to decay the weight of old plays
+	// when ordering songs by last played or shuffling songs. When positive, songs that
+	// were played heavily long ago but not recently are treated as "fresh" again:
+	// ordered queries prefer songs with the fewest decayed plays, and shuffled queries
+	// are weighted toward them. Disabled if 0.
+	PlayDecayDays float64 `json:"playDecayDays,omitempty"`
+
+	// TrashRetentionDays contains the number of days that deleted songs are kept so they can
+	// be restored via /undelete_song. Older deleted songs and their plays are permanently
+	// deleted by the /purge_trash cron job (and are no longer included in deletion counts in
+	// stats). Deleted songs are kept forever if 0.
+	TrashRetentionDays int `json:"trashRetentionDays,omitempty"`
+
+	// ShareSecret contains a secret key used to sign publicly-shareable song and album links.
+	// Share links pass a signed token instead of user credentials, and they only grant access
+	// to a minimal page with Open Graph metadata and a cover image for the shared item.
+	// The key is also used to sign read-only access tokens created via /access_token.
+	// Share links and access tokens are disabled if empty.
+	ShareSecret string `json:"shareSecret,omitempty"`
+	// ShareKeyGeneration is signed into share links and access tokens, which are only accepted
+	// while it is unchanged. Incrementing it revokes all existing links and tokens.
+	ShareKeyGeneration int `json:"shareKeyGeneration,omitempty"`
+	// ShareLinkDays contains the number of days for which links returned by /share_link are
+	// valid. Links are valid for 30 days if zero.
+	ShareLinkDays int `json:"shareLinkDays,omitempty"`
+	// ShareBaseURL contains the server's public base URL, e.g. "https://nup.example.org/".
+	// It is used to build absolute share link, cover, and oEmbed URLs. If empty, the app's
+	// default App Engine hostname is used.
+	ShareBaseURL string `json:"shareBaseUrl,omitempty"`
+
+	// ScheduledPresets contains search presets that are periodically evaluated to
+	// replace users' queues, e.g. so that a "morning mix" is ready when a user opens
+	// the web interface on any device.
+	ScheduledPresets []ScheduledPreset `json:"scheduledPresets,omitempty"`
+
+	// Mirror configures the server as a read-only mirror that syncs its songs and plays
+	// from a primary server every 15 minutes via the /sync cron job. The server's own
+	// SongBucket and CoverBucket should contain copies of the primary server's buckets.
+	Mirror *MirrorConfig `json:"mirror,omitempty"`
+
+	// Cache configures HTTP caching of cover images and song data.
+	// Default lifetimes are used if nil.
+	Cache *CacheConfig `json:"cache,omitempty"`
+
+	// Version contains the version of the SavedConfig that the config was loaded from.
+	// It is zero if the config wasn't loaded from Datastore.
+	Version int64 `json:"-"`
 }
 
 // Parse unmarshals jsonData, validates it, and returns the resulting config.
@@ -217,35 +449,248 @@ func Parse(jsonData []byte) (*Config, error) {
 		return nil, errors.New("no admin user")
 	}
 
+	libs := make(map[string]struct{}, len(cfg.Libraries))
+	for i, l := range cfg.Libraries {
+		if l.Name == "" {
+			return nil, fmt.Errorf("library %d has empty name", i)
+		} else if _, ok := libs[l.Name]; ok {
+			return nil, fmt.Errorf("library %q is listed multiple times", l.Name)
+		} else if l.SongBucket == "" || l.CoverBucket == "" {
+			return nil, fmt.Errorf("library %q is missing song or cover bucket", l.Name)
+		}
+		for _, u := range l.Users {
+			if cfg.UserByName(u) == nil {
+				return nil, fmt.Errorf("library %q has unknown user %q", l.Name, u)
+			}
+		}
+		libs[l.Name] = struct{}{}
+	}
+	for _, u := range cfg.Users {
+		if u.Library == "" {
+			continue
+		}
+		if _, ok := libs[u.Library]; !ok {
+			return nil, fmt.Errorf("user %q has unknown library %q", u.Name(), u.Library)
+		} else if !cfg.CanAccessLibrary(&u, u.Library) {
+			return nil, fmt.Errorf("user %q can't access library %q", u.Name(), u.Library)
+		}
+	}
+
+	for _, ct := range cfg.SignedSongURLs {
+		switch ct {
+		case WebClient, BasicAuthClient, TokenClient:
+		default:
+			return nil, fmt.Errorf("bad signed song URL client type %q", ct)
+		}
+	}
+
+	if cfg.PlayDecayDays < 0 {
+		return nil, fmt.Errorf("negative play decay %v", cfg.PlayDecayDays)
+	}
+
+	for _, p := range cfg.ScheduledPresets {
+		user := cfg.UserByName(p.User)
+		if user == nil {
+			return nil, fmt.Errorf("scheduled preset %q has unknown user %q", p.Preset, p.User)
+		}
+		if user.FindPreset(p.Preset, cfg.Presets) == nil {
+			return nil, fmt.Errorf("scheduled preset %q not found for user %q", p.Preset, p.User)
+		}
+		if len(p.Times) == 0 {
+			return nil, fmt.Errorf("scheduled preset %q has no times", p.Preset)
+		}
+		for _, t := range p.Times {
+			if _, err := time.Parse(queue.TimeOfDayLayout, t); err != nil {
+				return nil, fmt.Errorf("scheduled preset %q has bad time %q", p.Preset, t)
+			}
+		}
+		if _, err := p.Location(); err != nil {
+			return nil, fmt.Errorf("scheduled preset %q has bad time zone: %v", p.Preset, err)
+		}
+	}
+
+	for _, rl := range cfg.RateLimits {
+		if !strings.HasPrefix(rl.Path, "/") {
+			return nil, fmt.Errorf("rate limit has bad path %q", rl.Path)
+		}
+		if rl.MaxRequests <= 0 || rl.IntervalSec <= 0 {
+			return nil, fmt.Errorf("rate limit for %v has non-positive max requests or interval", rl.Path)
+		}
+		for _, u := range rl.Users {
+			if cfg.UserByName(u) == nil {
+				return nil, fmt.Errorf("rate limit for %v has unknown user %q", rl.Path, u)
+			}
+		}
+	}
+
+	if cfg.ShareKeyGeneration < 0 || cfg.ShareLinkDays < 0 {
+		return nil, errors.New("negative share key generation or link lifetime")
+	}
+	cleanBaseURL(&cfg.ShareBaseURL)
+
+	if m := cfg.Mirror; m != nil {
+		if m.PrimaryURL == "" {
+			return nil, errors.New("mirror has empty primary URL")
+		}
+		cleanBaseURL(&m.PrimaryURL)
+	}
+
+	if cfg.Cache == nil {
+		cfg.Cache = &CacheConfig{}
+	}
+	if c := cfg.Cache; c.CoverSec < 0 || c.SongSec < 0 || c.VersionedSec < 0 {
+		return nil, errors.New("cache has negative lifetime")
+	}
+	if cfg.Cache.CoverSec == 0 {
+		cfg.Cache.CoverSec = defaultCacheSec
+	}
+	if cfg.Cache.SongSec == 0 {
+		cfg.Cache.SongSec = defaultCacheSec
+	}
+
 	return &cfg, nil
 }
 
 // Load attempts to load the server's config from various locations.
 // ctx must be an App Engine context.
 func Load(ctx context.Context) (*Config, error) {
-	b, err := func() ([]byte, error) {
-		// Tests can override the config file via a NUP_CONFIG environment variable.
-		if b := []byte(os.Getenv("NUP_CONFIG")); len(b) != 0 {
-			return b, nil
+	// Tests can override the config file via a NUP_CONFIG environment variable.
+	if b := []byte(os.Getenv("NUP_CONFIG")); len(b) != 0 {
+		return Parse(b)
+	}
+	// Try to get the JSON data from Datastore by default.
+	saved, err := LoadSaved(ctx)
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := Parse([]byte(saved.JSON))
+	if err != nil {
+		return nil, err
+	}
+	cfg.Version = saved.Version
+	return cfg, nil
+}
+
+// savedKey returns the Datastore key of the SavedConfig entity.
+func savedKey(ctx context.Context) *datastore.Key {
+	return datastore.NewKey(ctx, DatastoreKind, DatastoreKeyName, 0, nil)
+}
+
+// LoadSaved loads the active config from Datastore.
+func LoadSaved(ctx context.Context) (*SavedConfig, error) {
+	var saved SavedConfig
+	if err := datastore.Get(ctx, savedKey(ctx), &saved); err != nil {
+		return nil, err
+	}
+	return &saved, nil
+}
+
+// Save validates data (a JSON-marshaled Config) and saves it to Datastore as the
+// active config, incrementing the saved version. If version is non-negative and
+// doesn't match the version of the currently-saved config, an error wrapping
+// ErrVersionMismatch is returned. The new version is returned on success.
+func Save(ctx context.Context, data []byte, version int64) (int64, error) {
+	if _, err := Parse(data); err != nil {
+		return 0, err
+	}
+	var saved SavedConfig
+	err := datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+		key := savedKey(ctx)
+		if err := datastore.Get(ctx, key, &saved); err != nil && err != datastore.ErrNoSuchEntity {
+			return err
 		}
-		// Try to get the JSON data from Datastore by default.
-		var saved SavedConfig
-		key := datastore.NewKey(ctx, DatastoreKind, DatastoreKeyName, 0, nil)
-		if err := datastore.Get(ctx, key, &saved); err != nil {
-			return nil, err
+		if version >= 0 && saved.Version != version {
+			return fmt.Errorf("%w: saved config has version %d", ErrVersionMismatch, saved.Version)
 		}
-		return []byte(saved.JSON), nil
-	}()
-
+		saved = SavedConfig{JSON: string(data), Version: saved.Version + 1, UpdatedTime: time.Now()}
+		_, err := datastore.Put(ctx, key, &saved)
+		return err
+	}, nil)
 	if err != nil {
-		return nil, err
+		return 0, err
+	}
+	return saved.Version, nil
+}
+
+// UserByName returns the user whose email address or username is name.
+// Nil is returned if the user isn't found. The returned user is a shallow copy from cfg.
+func (cfg *Config) UserByName(name string) *User {
+	for _, u := range cfg.Users {
+		if u.Name() == name {
+			return &u
+		}
+	}
+	return nil
+}
+
+// LibraryByName returns the library from cfg.Libraries named name.
+// Nil is returned if the library isn't found (including if name is empty).
+func (cfg *Config) LibraryByName(name string) *Library {
+	for i := range cfg.Libraries {
+		if cfg.Libraries[i].Name == name {
+			return &cfg.Libraries[i]
+		}
+	}
+	return nil
+}
+
+// LibraryNames returns the names of all libraries in cfg.Libraries.
+func (cfg *Config) LibraryNames() []string {
+	names := make([]string, len(cfg.Libraries))
+	for i, l := range cfg.Libraries {
+		names[i] = l.Name
+	}
+	return names
+}
+
+// CanAccessLibrary returns true if user can access the library named name.
+// All users (including nil ones, e.g. for unauthenticated requests) can access the main
+// library, identified by an empty name.
+func (cfg *Config) CanAccessLibrary(user *User, name string) bool {
+	if name == "" {
+		return true
+	}
+	lib := cfg.LibraryByName(name)
+	if lib == nil || user == nil {
+		return false
+	} else if user.Admin {
+		return true
+	}
+	for _, u := range lib.Users {
+		if u == user.Name() {
+			return true
+		}
 	}
-	return Parse(b)
+	return false
+}
+
+// tokenUserKey is a context key used to associate a tokenUser with a request.
+type tokenUserKey struct{}
+
+// tokenUser describes the user that an API token acts as.
+type tokenUser struct {
+	name  string // value from User.Name
+	admin bool   // whether admin privileges are granted
+}
+
+// WithTokenUser returns a shallow copy of req indicating that it was authorized by an
+// API token acting as the user identified by name (see User.Name). If admin is false,
+// the user is treated as a non-admin user even if its Admin field is true.
+func WithTokenUser(req *http.Request, name string, admin bool) *http.Request {
+	ctx := context.WithValue(req.Context(), tokenUserKey{}, tokenUser{name, admin})
+	return req.WithContext(ctx)
 }
 
 // findUser is a helper method for GetUser and GetUserType.
 // The user return value is a shallow copy from cfg.
 func (cfg *Config) findUser(req *http.Request) (user *User, name string) {
+	if tu, ok := req.Context().Value(tokenUserKey{}).(tokenUser); ok {
+		u := cfg.UserByName(tu.name)
+		if u != nil && !tu.admin {
+			u.Admin = false
+		}
+		return u, tu.name
+	}
 	if username, password, ok := req.BasicAuth(); ok {
 		for _, u := range cfg.Users {
 			if username == u.Username && password == u.Password {
@@ -266,7 +711,7 @@ func (cfg *Config) findUser(req *http.Request) (user *User, name string) {
 }
 
 // GetUser attempts to find the user from cfg.Users that sent req.
-// This method does not identify cron requests; use GetUserType for that.
+// This method does not identify cron or task queue requests; use GetUserType for that.
 // The returned User object is a shallow copy of the entry from cfg with its Password field cleared.
 // If the request was unauthenticated or the user is not listed in cfg.Users, nil is returned.
 // A username or email address that can be used in logging is returned if possible,
@@ -280,6 +725,46 @@ func (cfg *Config) GetUser(req *http.Request) (user *User, name string) {
 	}
 }
 
+// UseSignedSongURL returns true if req's song data should be served via a signed Cloud
+// Storage URL rather than being proxied by the server (see SignedSongURLs).
+func (cfg *Config) UseSignedSongURL(req *http.Request) bool {
+	if len(cfg.SignedSongURLs) == 0 {
+		return false
+	}
+	user, _ := cfg.findUser(req)
+	if user == nil || user.Guest {
+		return false
+	}
+	ct := WebClient
+	if _, ok := req.Context().Value(tokenUserKey{}).(tokenUser); ok {
+		ct = TokenClient
+	} else if _, _, ok := req.BasicAuth(); ok {
+		ct = BasicAuthClient
+	}
+	for _, t := range cfg.SignedSongURLs {
+		if t == ct {
+			return true
+		}
+	}
+	return false
+}
+
+// GetRateLimits returns the rate limits that apply to requests to path from the user
+// identified by name with type utype. The limit described by MaxGuestSongRequestsPerHour
+// is included.
+func (cfg *Config) GetRateLimits(path, name string, utype UserType) []RateLimit {
+	var limits []RateLimit
+	if max := cfg.MaxGuestSongRequestsPerHour; max > 0 && path == "/song" && utype == GuestUser {
+		limits = append(limits, RateLimit{Path: path, GuestOnly: true, MaxRequests: max, IntervalSec: 3600})
+	}
+	for _, rl := range cfg.RateLimits {
+		if rl.Path == path && rl.appliesTo(name, utype) {
+			limits = append(limits, rl)
+		}
+	}
+	return limits
+}
+
 // GetUserType returns a UserType describing the user who sent req.
 // If the request was unauthenticated or the user is not listed in cfg.Users, 0 is returned.
 // A username or email address that can be used in logging is returned if possible,
@@ -288,6 +773,10 @@ func (cfg *Config) GetUserType(req *http.Request) (utype UserType, name string)
 	// https://cloud.google.com/appengine/docs/standard/go/scheduling-jobs-with-cron-yaml#validating_cron_requests
 	if req.Header.Get("X-Appengine-Cron") == "true" {
 		return CronUser, "cron"
+	}
+	// https://cloud.google.com/appengine/docs/standard/go/taskqueue/push/creating-handlers#reading_request_headers
+	if req.Header.Get("X-Appengine-Queuename") != "" {
+		return TaskUser, "task"
 	} else if user, name := cfg.findUser(req); user == nil {
 		return 0, name
 	} else {
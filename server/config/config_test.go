@@ -4,6 +4,7 @@
 package config
 
 import (
+	"fmt"
 	"net/http"
 	"reflect"
 	"testing"
@@ -68,6 +69,68 @@ func TestGetUser(t *testing.T) {
 	}
 }
 
+func TestGetUserType_Token(t *testing.T) {
+	cfg := Config{
+		Users: []User{
+			{Username: "user", Password: "upass"},
+			{Username: "admin", Password: "apass", Admin: true},
+			{Email: "guest@example.org", Guest: true},
+		},
+	}
+
+	for _, tc := range []struct {
+		name  string
+		admin bool
+		utype UserType
+	}{
+		{"user", true, NormalUser},
+		{"admin", true, AdminUser},
+		{"admin", false, NormalUser},
+		{"guest@example.org", true, GuestUser},
+		{"bogus", true, 0},
+	} {
+		// Basic auth credentials should be ignored if a token was used.
+		req := WithTokenUser(makeReq(t, "admin", "apass"), tc.name, tc.admin)
+		if utype, name := cfg.GetUserType(req); utype != tc.utype || name != tc.name {
+			t.Errorf("GetUserType for token %q (admin=%v) returned %v and %q; want %v and %q",
+				tc.name, tc.admin, utype, name, tc.utype, tc.name)
+		}
+	}
+	if !cfg.Users[1].Admin {
+		t.Error("Original user was modified")
+	}
+}
+
+func TestUseSignedSongURL(t *testing.T) {
+	cfg := Config{
+		Users: []User{
+			{Username: "user", Password: "upass"},
+			{Username: "guest", Password: "gpass", Guest: true},
+		},
+	}
+	for _, tc := range []struct {
+		types []ClientType
+		req   *http.Request
+		want  bool
+	}{
+		{nil, makeReq(t, "user", "upass"), false},
+		{[]ClientType{BasicAuthClient}, makeReq(t, "user", "upass"), true},
+		{[]ClientType{BasicAuthClient}, makeReq(t, "user", "bogus"), false},
+		{[]ClientType{BasicAuthClient}, makeReq(t, "guest", "gpass"), false},
+		{[]ClientType{BasicAuthClient}, makeReq(t, "", ""), false},
+		{[]ClientType{TokenClient}, makeReq(t, "user", "upass"), false},
+		{[]ClientType{TokenClient}, WithTokenUser(makeReq(t, "", ""), "user", false), true},
+		{[]ClientType{TokenClient}, WithTokenUser(makeReq(t, "", ""), "guest", false), false},
+		{[]ClientType{BasicAuthClient}, WithTokenUser(makeReq(t, "", ""), "user", false), false},
+		{[]ClientType{WebClient, TokenClient}, WithTokenUser(makeReq(t, "", ""), "user", false), true},
+	} {
+		cfg.SignedSongURLs = tc.types
+		if got := cfg.UseSignedSongURL(tc.req); got != tc.want {
+			t.Errorf("UseSignedSongURL(%v) with %v = %v; want %v", tc.req.Header, tc.types, got, tc.want)
+		}
+	}
+}
+
 // makeReq returns an *http.Request with the supplied HTTP basic auth credentials.
 func makeReq(t *testing.T, user, pass string) *http.Request {
 	req, err := http.NewRequest("GET", "https://example.org", nil)
@@ -79,3 +142,183 @@ func makeReq(t *testing.T, user, pass string) *http.Request {
 	}
 	return req
 }
+
+func TestParse_ScheduledPresets(t *testing.T) {
+	const base = `{
+  "users": [
+    {"username": "admin", "password": "pw", "admin": true},
+    {"username": "user", "password": "pw", "presets": [{"name": "morning"}]}
+  ],
+  "presets": [{"name": "default"}],
+  "songBaseUrl": "https://example.org/songs/",
+  "coverBaseUrl": "https://example.org/covers/",
+  "scheduledPresets": [%s]
+}`
+	for _, tc := range []struct {
+		sched string
+		ok    bool
+	}{
+		{`{"user": "user", "preset": "morning", "times": ["07:30"], "timeZone": "America/New_York"}`, true},
+		{`{"user": "admin", "preset": "default", "times": ["07:30", "18:00"]}`, true},
+		{`{"user": "bogus", "preset": "morning", "times": ["07:30"]}`, false},
+		{`{"user": "user", "preset": "default", "times": ["07:30"]}`, false},
+		{`{"user": "user", "preset": "morning", "times": []}`, false},
+		{`{"user": "user", "preset": "morning", "times": ["25:00"]}`, false},
+		{`{"user": "user", "preset": "morning", "times": ["07:30"], "timeZone": "Bogus/Zone"}`, false},
+	} {
+		if _, err := Parse([]byte(fmt.Sprintf(base, tc.sched))); err != nil && tc.ok {
+			t.Errorf("Parse failed for %v: %v", tc.sched, err)
+		} else if err == nil && !tc.ok {
+			t.Errorf("Parse unexpectedly succeeded for %v", tc.sched)
+		}
+	}
+}
+
+func TestGetRateLimits(t *testing.T) {
+	query := RateLimit{Path: "/query", MaxRequests: 10, IntervalSec: 60}
+	played := RateLimit{Path: "/played", Users: []string{"user"}, MaxRequests: 5, IntervalSec: 60}
+	guest := RateLimit{Path: "/query", GuestOnly: true, MaxRequests: 2, IntervalSec: 60}
+	cfg := Config{
+		MaxGuestSongRequestsPerHour: 3,
+		RateLimits:                  []RateLimit{query, played, guest},
+	}
+	guestSong := RateLimit{Path: "/song", GuestOnly: true, MaxRequests: 3, IntervalSec: 3600}
+
+	for _, tc := range []struct {
+		path, name string
+		utype      UserType
+		want       []RateLimit
+	}{
+		{"/query", "user", NormalUser, []RateLimit{query}},
+		{"/query", "guest", GuestUser, []RateLimit{query, guest}},
+		{"/played", "user", NormalUser, []RateLimit{played}},
+		{"/played", "other", NormalUser, nil},
+		{"/song", "user", NormalUser, nil},
+		{"/song", "guest", GuestUser, []RateLimit{guestSong}},
+		{"/tags", "user", NormalUser, nil},
+	} {
+		if got := cfg.GetRateLimits(tc.path, tc.name, tc.utype); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("GetRateLimits(%q, %q, %v) = %+v; want %+v", tc.path, tc.name, tc.utype, got, tc.want)
+		}
+	}
+}
+
+func TestParse_RateLimits(t *testing.T) {
+	const base = `{
+  "users": [
+    {"username": "admin", "password": "pw", "admin": true},
+    {"username": "user", "password": "pw"}
+  ],
+  "songBaseUrl": "https://example.org/songs/",
+  "coverBaseUrl": "https://example.org/covers/",
+  "rateLimits": [%s]
+}`
+	for _, tc := range []struct {
+		limit string
+		ok    bool
+	}{
+		{`{"path": "/query", "maxRequests": 10, "intervalSec": 60}`, true},
+		{`{"path": "/played", "users": ["user"], "guestOnly": true, "maxRequests": 1, "intervalSec": 1}`, true},
+		{`{"path": "query", "maxRequests": 10, "intervalSec": 60}`, false},
+		{`{"path": "/query", "maxRequests": 0, "intervalSec": 60}`, false},
+		{`{"path": "/query", "maxRequests": 10}`, false},
+		{`{"path": "/query", "users": ["bogus"], "maxRequests": 10, "intervalSec": 60}`, false},
+	} {
+		if _, err := Parse([]byte(fmt.Sprintf(base, tc.limit))); err != nil && tc.ok {
+			t.Errorf("Parse failed for %v: %v", tc.limit, err)
+		} else if err == nil && !tc.ok {
+			t.Errorf("Parse unexpectedly succeeded for %v", tc.limit)
+		}
+	}
+}
+
+func TestParse_Libraries(t *testing.T) {
+	const base = `{
+  "users": [
+    {"username": "admin", "password": "pw", "admin": true},
+    {"username": "user", "password": "pw"%s}
+  ],
+  "songBaseUrl": "https://example.org/songs/",
+  "coverBaseUrl": "https://example.org/covers/",
+  "libraries": [%s]
+}`
+	const lib = `{"name": "lib", "songBucket": "songs", "coverBucket": "covers", "users": ["user"]}`
+	for _, tc := range []struct {
+		user, libs string
+		ok         bool
+	}{
+		{"", lib, true},
+		{`, "library": "lib"`, lib, true},
+		{`, "library": "bogus"`, lib, false},
+		{`, "library": "lib"`, `{"name": "lib", "songBucket": "s", "coverBucket": "c"}`, false},
+		{"", `{"songBucket": "s", "coverBucket": "c"}`, false},
+		{"", `{"name": "lib", "coverBucket": "c"}`, false},
+		{"", lib + ", " + lib, false},
+		{"", `{"name": "lib", "songBucket": "s", "coverBucket": "c", "users": ["bogus"]}`, false},
+	} {
+		if _, err := Parse([]byte(fmt.Sprintf(base, tc.user, tc.libs))); err != nil && tc.ok {
+			t.Errorf("Parse failed for %v/%v: %v", tc.user, tc.libs, err)
+		} else if err == nil && !tc.ok {
+			t.Errorf("Parse unexpectedly succeeded for %v/%v", tc.user, tc.libs)
+		}
+	}
+}
+
+func TestParse_Cache(t *testing.T) {
+	const base = `{
+  "users": [{"username": "admin", "password": "pw", "admin": true}],
+  "songBaseUrl": "https://example.org/songs/",
+  "coverBaseUrl": "https://example.org/covers/"%s
+}`
+	for _, tc := range []struct {
+		cache string
+		want  *CacheConfig // nil if error expected
+	}{
+		{"", &CacheConfig{CoverSec: 86400, SongSec: 86400}},
+		{`, "cache": {"coverSec": 60}`, &CacheConfig{CoverSec: 60, SongSec: 86400}},
+		{`, "cache": {"songSec": 30, "versionedSec": 1000}`,
+			&CacheConfig{CoverSec: 86400, SongSec: 30, VersionedSec: 1000}},
+		{`, "cache": {"coverSec": -1}`, nil},
+		{`, "cache": {"versionedSec": -1}`, nil},
+	} {
+		cfg, err := Parse([]byte(fmt.Sprintf(base, tc.cache)))
+		if tc.want == nil {
+			if err == nil {
+				t.Errorf("Parse unexpectedly succeeded for %q", tc.cache)
+			}
+		} else if err != nil {
+			t.Errorf("Parse failed for %q: %v", tc.cache, err)
+		} else if !reflect.DeepEqual(cfg.Cache, tc.want) {
+			t.Errorf("Parse for %q gave cache %+v; want %+v", tc.cache, *cfg.Cache, *tc.want)
+		}
+	}
+}
+
+func TestCanAccessLibrary(t *testing.T) {
+	admin := &User{Username: "admin", Admin: true}
+	user := &User{Username: "user"}
+	other := &User{Email: "other@example.org"}
+	cfg := Config{
+		Users:     []User{*admin, *user, *other},
+		Libraries: []Library{{Name: "lib", Users: []string{"user"}}},
+	}
+	for _, tc := range []struct {
+		user *User
+		lib  string
+		want bool
+	}{
+		{admin, "", true},
+		{admin, "lib", true},
+		{admin, "bogus", false},
+		{user, "", true},
+		{user, "lib", true},
+		{other, "", true},
+		{other, "lib", false},
+		{nil, "", true},
+		{nil, "lib", false},
+	} {
+		if got := cfg.CanAccessLibrary(tc.user, tc.lib); got != tc.want {
+			t.Errorf("CanAccessLibrary(%+v, %q) = %v; want %v", tc.user, tc.lib, got, tc.want)
+		}
+	}
+}
@@ -72,7 +72,9 @@ import (
 
 	"golang.org/x/image/draw"
 
+	"google.golang.org/api/iterator"
 	"google.golang.org/api/option"
+	"google.golang.org/appengine/v2"
 	"google.golang.org/appengine/v2/log"
 	"google.golang.org/appengine/v2/memcache"
 )
@@ -101,8 +103,11 @@ func cacheKey(fn string, size int, it imageType) string {
 	// https://godoc.org/google.golang.org/appengine/memcache#Get says that the
 	// key can be at most 250 bytes.
 	key := fmt.Sprintf("%s-%d-", cacheKeyPrefix, size)
-	if it == webpType {
+	switch it {
+	case webpType:
 		key += "webp-"
+	case avifType:
+		key += "avif-"
 	}
 	return key + fn
 }
@@ -110,7 +115,7 @@ func cacheKey(fn string, size int, it imageType) string {
 // OrigExt is the extension for original (non-WebP) cover images.
 const OrigExt = ".jpg"
 
-// WebPSizes contains the sizes for which WebP versions of images can be requested.
+// WebPSizes contains the sizes for which WebP and AVIF versions of images can be requested.
 // See the package comment for the origin of these numbers.
 var WebPSizes = []int{256, 512}
 
@@ -124,13 +129,32 @@ func WebPFilename(fn string, size int) string {
 	return fmt.Sprintf("%s.%d.webp", fn, size)
 }
 
-var webpRegexp = regexp.MustCompile(`(.+)\.\d+\.webp$`)
+// AVIFFilename is like WebPFilename but for AVIF versions of images.
+// Given fn "foo/bar.jpg" and size 256, returns "foo/bar.256.avif".
+func AVIFFilename(fn string, size int) string {
+	if strings.HasSuffix(fn, OrigExt) {
+		fn = fn[:len(fn)-4]
+	}
+	return fmt.Sprintf("%s.%d.avif", fn, size)
+}
 
-// OrigFilename attempts to return the original JPEG filename for the supplied WebP cover image
-// (generated by WebPFilename). Given "foo/bar.256.webp", returns "foo/bar.jpeg".
-// fn is returned unchanged if it doesn't appear to be a generated image.
+// ScaledFilename returns the filename that should be used for a JPEG version of
+// fn scaled to the specified size in the scaled-cover cache bucket.
+// Given fn "foo/bar.jpg" and size 256, returns "foo/bar.256.jpg".
+func ScaledFilename(fn string, size int) string {
+	if strings.HasSuffix(fn, OrigExt) {
+		fn = fn[:len(fn)-4]
+	}
+	return fmt.Sprintf("%s.%d%s", fn, size, OrigExt)
+}
+
+var prescaledRegexp = regexp.MustCompile(`(.+)\.\d+\.(webp|avif)$`)
+
+// OrigFilename attempts to return the original JPEG filename for the supplied WebP or AVIF
+// cover image (generated by WebPFilename or AVIFFilename). Given "foo/bar.256.webp", returns
+// "foo/bar.jpeg". fn is returned unchanged if it doesn't appear to be a generated image.
 func OrigFilename(fn string) string {
-	ms := webpRegexp.FindStringSubmatch(fn)
+	ms := prescaledRegexp.FindStringSubmatch(fn)
 	if ms == nil {
 		return fn
 	}
@@ -142,35 +166,26 @@ func OrigFilename(fn string) string {
 // size, and writes it in JPEG format to w.
 //
 // If size is zero or negative, the original (possibly non-square) cover data is written.
-// If webp is true, a prescaled WebP version of the image will be returned if available.
+// If avif or webp is true, a prescaled AVIF or WebP version of the image will be returned
+// if available, with AVIF preferred over WebP.
 // The bucket and baseURL args correspond to CoverBucket and CoverBaseURL in ServerConfig.
+// If cacheBucket (corresponding to CoverCacheBucket) is non-empty, scaled JPEG images
+// are read from and written to it so they don't need to be regenerated by later calls.
 // If w is an http.ResponseWriter, its Content-Type header will be set.
 // os.ErrNotExist is replied if the specified file does not exist.
-func Scale(ctx context.Context, bucket, baseURL, fn string,
-	size, quality int, webp bool, w io.Writer) error {
-	// If WebP was requested, try to load it first before falling back to JPEG.
-	// There's sadly still no native Go library for encoding to WebP (only decoding),
-	// so we rely on files generated by the "nup covers" command.
-	if webp {
-		log.Debugf(ctx, "Checking cache for WebP cover")
-		if data, _ := getCachedCover(ctx, fn, size, webpType); len(data) > 0 {
-			log.Debugf(ctx, "Writing %d-byte cached WebP cover", len(data))
-			setContentType(w, webpType)
-			_, err := w.Write(data)
+func Scale(ctx context.Context, bucket, baseURL, cacheBucket, fn string,
+	size, quality int, webp, avif bool, w io.Writer) error {
+	// If AVIF or WebP was requested, try to load it first before falling back to JPEG.
+	// There's sadly still no native Go library for encoding to WebP or AVIF (only decoding
+	// WebP), so we rely on files generated by the "nup covers" command.
+	if avif {
+		if ok, err := writePrescaled(ctx, bucket, baseURL, fn, size, avifType, w); ok {
 			return err
 		}
-		log.Debugf(ctx, "Loading WebP cover")
-		wfn := WebPFilename(fn, size)
-		if data, err := load(ctx, bucket, baseURL, wfn); err != nil {
-			log.Debugf(ctx, "Failed loading WebP cover: %v", err)
-		} else {
-			setContentType(w, webpType)
-			_, werr := w.Write(data)
-			log.Debugf(ctx, "Caching %v-byte WebP cover", len(data))
-			if err := setCachedCover(ctx, fn, size, webpType, data); err != nil {
-				log.Errorf(ctx, "Cache write failed: %v", err) // swallow error
-			}
-			return werr
+	}
+	if webp {
+		if ok, err := writePrescaled(ctx, bucket, baseURL, fn, size, webpType, w); ok {
+			return err
 		}
 	}
 
@@ -182,6 +197,24 @@ func Scale(ctx context.Context, bucket, baseURL, fn string,
 		return err
 	}
 
+	if size > 0 && cacheBucket != "" {
+		sfn := ScaledFilename(fn, size)
+		log.Debugf(ctx, "Loading scaled cover from cache bucket")
+		if data, err := loadFromBucket(ctx, cacheBucket, sfn); err != nil {
+			if !os.IsNotExist(err) {
+				log.Errorf(ctx, "Failed loading scaled cover %q: %v", sfn, err) // swallow error
+			}
+		} else {
+			setContentType(w, jpegType)
+			_, werr := w.Write(data)
+			log.Debugf(ctx, "Caching %v-byte scaled cover", len(data))
+			if err := setCachedCover(ctx, fn, size, jpegType, data); err != nil {
+				log.Errorf(ctx, "Cache write failed: %v", err) // swallow error
+			}
+			return werr
+		}
+	}
+
 	var data []byte
 	var err error
 	log.Debugf(ctx, "Checking cache for original cover")
@@ -245,60 +278,188 @@ func Scale(ctx context.Context, bucket, baseURL, fn string,
 	if err := setCachedCover(ctx, fn, size, jpegType, b.Bytes()); err != nil {
 		log.Errorf(ctx, "Cache write failed: %v", err) // swallow error
 	}
+	if cacheBucket != "" {
+		sfn := ScaledFilename(fn, size)
+		log.Debugf(ctx, "Writing %v-byte scaled cover to cache bucket", b.Len())
+		if err := writeToBucket(ctx, cacheBucket, sfn, jpegType, b.Bytes()); err != nil {
+			log.Errorf(ctx, "Failed writing scaled cover %q: %v", sfn, err) // swallow error
+		}
+	}
 	return nil
 }
 
-// load loads and returns the cover image with the supplied original filename (see Song.CoverFilename).
-func load(ctx context.Context, bucket, baseURL, fn string) ([]byte, error) {
-	var r io.ReadCloser
-	if bucket != "" {
-		// It would seem more reasonable to call NewClient from an init()
-		// function instead, but that produces an error like the following:
-		//
-		//   dialing: google: could not find default credentials. See
-		//   https://developers.google.com/accounts/docs/application-default-credentials for more information.
-		//
-		// This happens regardless of whether I pass context.Background() or
-		// appengine.BackgroundContext(). It feels wrong to use the credentials
-		// from the first request for all later requests, but it seems to work.
-		// Requests are only accepted from a specific list of users and are all
-		// satisfied using the same GCS bucket, so hopefully there are no
-		// security implications from doing this.
-		var err error
-		clientOnce.Do(func() {
-			log.Debugf(ctx, "Initializing storage client")
-			client, err = storage.NewClient(ctx, option.WithGRPCConnectionPool(grpcPoolSize))
-		})
-		if err != nil {
-			return nil, err
+// writePrescaled attempts to write a prescaled version of the cover image at fn in format it
+// (either webpType or avifType) to w. ok is false if the image wasn't available, in which case
+// nothing was written.
+func writePrescaled(ctx context.Context, bucket, baseURL, fn string, size int,
+	it imageType, w io.Writer) (ok bool, err error) {
+	log.Debugf(ctx, "Checking cache for %v cover", it)
+	if data, _ := getCachedCover(ctx, fn, size, it); len(data) > 0 {
+		log.Debugf(ctx, "Writing %d-byte cached %v cover", len(data), it)
+		setContentType(w, it)
+		_, err := w.Write(data)
+		return true, err
+	}
+	log.Debugf(ctx, "Loading %v cover", it)
+	pfn := WebPFilename(fn, size)
+	if it == avifType {
+		pfn = AVIFFilename(fn, size)
+	}
+	data, err := load(ctx, bucket, baseURL, pfn)
+	if err != nil {
+		log.Debugf(ctx, "Failed loading %v cover: %v", it, err)
+		return false, nil
+	}
+	setContentType(w, it)
+	_, werr := w.Write(data)
+	log.Debugf(ctx, "Caching %v-byte %v cover", len(data), it)
+	if err := setCachedCover(ctx, fn, size, it, data); err != nil {
+		log.Errorf(ctx, "Cache write failed: %v", err) // swallow error
+	}
+	return true, werr
+}
+
+// Forget deletes cached scaled copies of the cover image at fn (corresponding to
+// Song.CoverFilename) so that later Scale calls will use the image's current data.
+// Memcache entries are only deleted for the original image and for WebPSizes; entries for
+// other sizes expire after an hour. If cacheBucket is non-empty, all scaled JPEG images
+// that were generated from fn are deleted from it. WebP and AVIF images are not deleted,
+// since they are generated by the "nup covers" command rather than by the server.
+func Forget(ctx context.Context, cacheBucket, fn string) error {
+	keys := []string{cacheKey(fn, 0, jpegType)}
+	for _, size := range WebPSizes {
+		keys = append(keys, cacheKey(fn, size, jpegType), cacheKey(fn, size, webpType),
+			cacheKey(fn, size, avifType))
+	}
+	if err := memcache.DeleteMulti(ctx, keys); err != nil {
+		if me, ok := err.(appengine.MultiError); ok {
+			for _, err := range me {
+				if err != nil && err != memcache.ErrCacheMiss {
+					return err
+				}
+			}
+		} else {
+			return err
 		}
-		log.Debugf(ctx, "Opening object %q from bucket %q", fn, bucket)
-		if r, err = client.Bucket(bucket).Object(fn).NewReader(ctx); err == storage.ErrObjectNotExist {
-			return nil, os.ErrNotExist
+	}
+	if cacheBucket == "" {
+		return nil
+	}
+
+	c, err := getClient(ctx)
+	if err != nil {
+		return err
+	}
+	bucket := c.Bucket(cacheBucket)
+	prefix := strings.TrimSuffix(fn, OrigExt) + "."
+	it := bucket.Objects(ctx, &storage.Query{Prefix: prefix})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			return nil
 		} else if err != nil {
-			return nil, err
+			return err
 		}
-	} else if baseURL != "" {
-		url := baseURL + fn
-		log.Debugf(ctx, "Opening %v", url)
-		resp, err := http.Get(url)
-		if err != nil {
-			return nil, err
-		} else if resp.StatusCode >= 300 {
-			resp.Body.Close()
-			if resp.StatusCode == 404 {
-				return nil, os.ErrNotExist
-			}
-			return nil, fmt.Errorf("server replied with %q", resp.Status)
+		if !scaledRegexp.MatchString(attrs.Name[len(prefix)-1:]) {
+			continue
 		}
-		r = resp.Body
-	} else {
-		return nil, errors.New("neither CoverBucket nor CoverBaseURL is set")
+		log.Debugf(ctx, "Deleting %q from bucket %q", attrs.Name, cacheBucket)
+		if err := bucket.Object(attrs.Name).Delete(ctx); err != nil &&
+			err != storage.ErrObjectNotExist {
+			return err
+		}
+	}
+}
+
+// scaledRegexp matches the suffix added to filenames by ScaledFilename.
+var scaledRegexp = regexp.MustCompile(`^\.\d+\` + OrigExt + `$`)
+
+// getClient returns the shared storage.Client, initializing it if needed.
+func getClient(ctx context.Context) (*storage.Client, error) {
+	// It would seem more reasonable to call NewClient from an init()
+	// function instead, but that produces an error like the following:
+	//
+	//   dialing: google: could not find default credentials. See
+	//   https://developers.google.com/accounts/docs/application-default-credentials for more information.
+	//
+	// This happens regardless of whether I pass context.Background() or
+	// appengine.BackgroundContext(). It feels wrong to use the credentials
+	// from the first request for all later requests, but it seems to work.
+	// Requests are only accepted from a specific list of users and are all
+	// satisfied using the same GCS bucket, so hopefully there are no
+	// security implications from doing this.
+	var err error
+	clientOnce.Do(func() {
+		log.Debugf(ctx, "Initializing storage client")
+		client, err = storage.NewClient(ctx, option.WithGRPCConnectionPool(grpcPoolSize))
+	})
+	if err != nil {
+		return nil, err
+	}
+	if client == nil {
+		return nil, errors.New("storage client initialization previously failed")
+	}
+	return client, nil
+}
+
+// loadFromBucket reads the object named fn from the supplied Cloud Storage bucket.
+// os.ErrNotExist is returned if the object does not exist.
+func loadFromBucket(ctx context.Context, bucket, fn string) ([]byte, error) {
+	c, err := getClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	log.Debugf(ctx, "Opening object %q from bucket %q", fn, bucket)
+	r, err := c.Bucket(bucket).Object(fn).NewReader(ctx)
+	if err == storage.ErrObjectNotExist {
+		return nil, os.ErrNotExist
+	} else if err != nil {
+		return nil, err
 	}
 	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+// writeToBucket writes data to an object named fn in the supplied Cloud Storage bucket.
+func writeToBucket(ctx context.Context, bucket, fn string, it imageType, data []byte) error {
+	c, err := getClient(ctx)
+	if err != nil {
+		return err
+	}
+	w := c.Bucket(bucket).Object(fn).NewWriter(ctx)
+	w.ContentType = string(it)
+	if _, err := w.Write(data); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+// load loads and returns the cover image with the supplied original filename (see Song.CoverFilename).
+func load(ctx context.Context, bucket, baseURL, fn string) ([]byte, error) {
+	if bucket != "" {
+		return loadFromBucket(ctx, bucket, fn)
+	}
+	if baseURL == "" {
+		return nil, errors.New("neither CoverBucket nor CoverBaseURL is set")
+	}
+
+	url := baseURL + fn
+	log.Debugf(ctx, "Opening %v", url)
+	resp, err := http.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		if resp.StatusCode == 404 {
+			return nil, os.ErrNotExist
+		}
+		return nil, fmt.Errorf("server replied with %q", resp.Status)
+	}
 
 	log.Debugf(ctx, "Reading cover data")
-	return ioutil.ReadAll(r)
+	return ioutil.ReadAll(resp.Body)
 }
 
 // setCachedCover caches a cover image with the supplied filename, requested size,
@@ -329,6 +490,7 @@ type imageType string
 const (
 	jpegType imageType = "image/jpeg"
 	webpType imageType = "image/webp"
+	avifType imageType = "image/avif"
 )
 
 // setContentType sets w's Content-Type to it if w is an http.ResponseWriter.
@@ -0,0 +1,86 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"net/http"
+
+	"github.com/derat/nup/server/apitoken"
+
+	"google.golang.org/appengine/v2"
+	"google.golang.org/appengine/v2/log"
+)
+
+const (
+	// csrfCookie is the name of the cookie containing the token issued with the index page.
+	// The web client copies the token to csrfHeader in state-changing requests, which
+	// cross-site requests are unable to do.
+	csrfCookie = "nup_csrf"
+	// csrfHeader is the name of the request header that must match csrfCookie.
+	csrfHeader = "X-Nup-CSRF-Token"
+
+	csrfTokenBytes = 16 // random bytes in CSRF tokens
+)
+
+// setCSRFCookie sets a cookie containing a new CSRF token in w if r doesn't already have one.
+func setCSRFCookie(w http.ResponseWriter, r *http.Request) error {
+	if c, err := r.Cookie(csrfCookie); err == nil && c.Value != "" {
+		return nil
+	}
+	b := make([]byte, csrfTokenBytes)
+	if _, err := rand.Read(b); err != nil {
+		return err
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     csrfCookie,
+		Value:    base64.RawURLEncoding.EncodeToString(b),
+		Path:     "/",
+		Secure:   !appengine.IsDevAppServer(),
+		SameSite: http.SameSiteStrictMode,
+		// The cookie can't be HttpOnly since the web client needs to read it.
+	})
+	return nil
+}
+
+// needsCSRFCheck returns true if r is a state-changing request that was authorized by
+// cookies (i.e. Google authentication) and is thus vulnerable to cross-site request forgery.
+// Requests using HTTP basic auth or API tokens and requests from cron or task queues
+// are exempt.
+func needsCSRFCheck(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return false
+	}
+	if _, _, ok := r.BasicAuth(); ok {
+		return false
+	}
+	if apitoken.FromRequest(r) != "" ||
+		r.Header.Get("X-Appengine-Cron") == "true" ||
+		r.Header.Get("X-Appengine-Queuename") != "" {
+		return false
+	}
+	return true
+}
+
+// checkCSRF verifies that r's csrfHeader header matches its csrfCookie cookie if needed.
+// If false is returned, the request was rejected and an error was written to w.
+func checkCSRF(ctx context.Context, w http.ResponseWriter, r *http.Request) bool {
+	if !needsCSRFCheck(r) {
+		return true
+	}
+	c, err := r.Cookie(csrfCookie)
+	hdr := r.Header.Get(csrfHeader)
+	if err != nil || c.Value == "" || hdr == "" ||
+		subtle.ConstantTimeCompare([]byte(c.Value), []byte(hdr)) != 1 {
+		log.Debugf(ctx, "Rejecting %v request for %v from %v with missing or bad CSRF token",
+			r.Method, r.URL.String(), r.RemoteAddr)
+		http.Error(w, "Missing or invalid CSRF token", http.StatusForbidden)
+		return false
+	}
+	return true
+}
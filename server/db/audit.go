@@ -0,0 +1,26 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package db
+
+import "time"
+
+// AuditEntryKind is the AuditEntry struct's Datastore kind.
+const AuditEntryKind = "AuditEntry"
+
+// AuditEntry records a modification of songs or user data made by a request to the server.
+type AuditEntry struct {
+	// User contains the username of the user who made the request.
+	User string `json:"user"`
+	// Time is the time at which the modification was made.
+	Time time.Time `json:"time"`
+	// Endpoint contains the path of the server endpoint that handled the request, e.g. "/import".
+	Endpoint string `json:"endpoint"`
+	// SongID contains the modified Song entity's key ID from Datastore.
+	// It is 0 if the modification wasn't limited to a single song.
+	SongID int64 `json:"songId,omitempty"`
+	// Before and After contain human-readable summaries of the state before and after
+	// the modification.
+	Before string `datastore:",noindex" json:"before,omitempty"`
+	After  string `datastore:",noindex" json:"after,omitempty"`
+}
@@ -0,0 +1,24 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package db
+
+import "time"
+
+const (
+	// BulkImportKind is the BulkImport struct's Datastore kind.
+	BulkImportKind = "BulkImport"
+	// BulkImportKeyName is the BulkImport struct's key name in Datastore.
+	BulkImportKeyName = "bulk"
+)
+
+// BulkImport describes an in-progress bulk import session. While a session is active,
+// query cache flushes and stats updates are deferred until the session is ended.
+type BulkImport struct {
+	// StartTime is the time at which the session was started.
+	StartTime time.Time `json:"startTime"`
+	// UpdateTime is the time at which songs were most recently imported in the session.
+	UpdateTime time.Time `json:"updateTime"`
+	// NumSongs is the number of songs that have been imported in the session.
+	NumSongs int `json:"numSongs"`
+}
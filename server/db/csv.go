@@ -0,0 +1,112 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package db
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SongCSVHeader contains the column names for rows returned by Song.CSVRecord.
+// Columns are only ever appended so that existing consumers aren't broken.
+var SongCSVHeader = []string{
+	"songId",
+	"sha1",
+	"filename",
+	"library",
+	"artist",
+	"title",
+	"album",
+	"albumArtist",
+	"albumId",
+	"composer",
+	"conductor",
+	"performer",
+	"discSubtitle",
+	"genres",
+	"compilation",
+	"track",
+	"disc",
+	"totalTracks",
+	"totalDiscs",
+	"date",
+	"length",
+	"bpm",
+	"key",
+	"trackGain",
+	"albumGain",
+	"peakAmp",
+	"rating",
+	"plays",
+	"numSkips",
+	"tags",
+}
+
+// CSVRecord returns a row describing s with the columns in SongCSVHeader.
+// Genres are separated by semicolons and tags by spaces. The plays column
+// contains the number of plays in s.Plays.
+func (s *Song) CSVRecord() []string {
+	var date string
+	if !s.Date.IsZero() {
+		date = s.Date.UTC().Format("2006-01-02")
+	}
+	return []string{
+		s.SongID,
+		s.SHA1,
+		s.Filename,
+		s.Library,
+		s.Artist,
+		s.Title,
+		s.Album,
+		s.AlbumArtist,
+		s.AlbumID,
+		s.Composer,
+		s.Conductor,
+		s.Performer,
+		s.DiscSubtitle,
+		strings.Join(s.Genres, ";"),
+		strconv.FormatBool(s.Compilation),
+		strconv.Itoa(s.Track),
+		strconv.Itoa(s.Disc),
+		strconv.Itoa(s.TotalTracks),
+		strconv.Itoa(s.TotalDiscs),
+		date,
+		formatCSVFloat(s.Length),
+		formatCSVFloat(s.BPM),
+		s.Key,
+		formatCSVFloat(s.TrackGain),
+		formatCSVFloat(s.AlbumGain),
+		formatCSVFloat(s.PeakAmp),
+		strconv.Itoa(s.Rating),
+		strconv.Itoa(len(s.Plays)),
+		strconv.Itoa(s.NumSkips),
+		strings.Join(s.Tags, " "),
+	}
+}
+
+// PlayCSVHeader contains the column names for rows returned by PlayDump.CSVRecord.
+// Columns are only ever appended so that existing consumers aren't broken.
+var PlayCSVHeader = []string{
+	"songId",
+	"startTime",
+	"ipAddress",
+	"user",
+}
+
+// CSVRecord returns a row describing pd with the columns in PlayCSVHeader.
+// The start time is formatted as an RFC 3339 UTC timestamp.
+func (pd *PlayDump) CSVRecord() []string {
+	return []string{
+		pd.SongID,
+		pd.Play.StartTime.UTC().Format(time.RFC3339Nano),
+		pd.Play.IPAddress,
+		pd.Play.User,
+	}
+}
+
+// formatCSVFloat formats v as compactly as possible without losing precision.
+func formatCSVFloat(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
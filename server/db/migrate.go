@@ -0,0 +1,35 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package db
+
+// Functions that upgrade entities written using older schemas. These are set by SetMigrators.
+var (
+	songMigrator func(*Song) error
+	playMigrator func(*Play) error
+)
+
+// SetMigrators sets functions that are called to upgrade Song and Play entities when they
+// are loaded from or saved to Datastore. The functions should apply any migrations newer than
+// the entity's SchemaVersion field and then update the field. This is called by the
+// migrate package.
+func SetMigrators(song func(*Song) error, play func(*Play) error) {
+	songMigrator = song
+	playMigrator = play
+}
+
+// migrateSong passes s to songMigrator if it is set.
+func migrateSong(s *Song) error {
+	if songMigrator == nil {
+		return nil
+	}
+	return songMigrator(s)
+}
+
+// migratePlay passes p to playMigrator if it is set.
+func migratePlay(p *Play) error {
+	if playMigrator == nil {
+		return nil
+	}
+	return playMigrator(p)
+}
@@ -0,0 +1,27 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package db
+
+import "time"
+
+const (
+	// MirrorStateKind is the MirrorState struct's Datastore kind.
+	MirrorStateKind = "MirrorState"
+	// MirrorStateKeyName is the MirrorState struct's key name in Datastore.
+	MirrorStateKeyName = "state"
+)
+
+// MirrorState records a read-only mirror's progress in syncing data from its primary server.
+type MirrorState struct {
+	// LastSyncTime is the primary server's time at the start of the last completed sync.
+	// The next sync requests songs modified and plays reported since this time.
+	LastSyncTime time.Time `json:"lastSyncTime"`
+	// SyncTime is the primary server's time at the start of the in-progress sync.
+	// It is zero if no sync is in progress.
+	SyncTime time.Time `json:"syncTime"`
+	// Stage identifies the in-progress sync's current stage.
+	Stage int `json:"stage"`
+	// Cursor contains the cursor for resuming the current stage's export from the primary.
+	Cursor string `datastore:",noindex" json:"cursor"`
+}
@@ -0,0 +1,122 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+)
+
+// RatingScale describes how ratings in JSON-marshaled songs are represented.
+type RatingScale string
+
+const (
+	// AutoRatingScale indicates that the scale should be detected from the ratings themselves.
+	AutoRatingScale RatingScale = "auto"
+	// StarsRatingScale is the current scale: ints in the range [1, 5], or 0 if unrated.
+	StarsRatingScale RatingScale = "stars"
+	// LegacyRatingScale is the original scale: floats in the range [0.0, 1.0], or negative if unrated.
+	LegacyRatingScale RatingScale = "legacy"
+)
+
+// ParseRatingScale parses s as a RatingScale. An empty string is treated as AutoRatingScale.
+func ParseRatingScale(s string) (RatingScale, error) {
+	switch sc := RatingScale(s); sc {
+	case "":
+		return AutoRatingScale, nil
+	case AutoRatingScale, StarsRatingScale, LegacyRatingScale:
+		return sc, nil
+	default:
+		return "", fmt.Errorf("invalid rating scale %q", s)
+	}
+}
+
+// LegacyRatingToStars converts a rating in LegacyRatingScale to StarsRatingScale.
+func LegacyRatingToStars(v float64) int {
+	if v < 0 {
+		return 0
+	}
+	return int(math.Round(4*v)) + 1
+}
+
+// DetectRatingScale returns the scale used by ratings.
+// LegacyRatingScale is returned if any ratings are negative or fractional,
+// and StarsRatingScale is returned otherwise. Since ratings of 0 and 1 are valid
+// in both scales, ok is false if all ratings are 0 or 1.
+func DetectRatingScale(ratings []float64) (scale RatingScale, ok bool) {
+	for _, v := range ratings {
+		if v < 0 || v != math.Trunc(v) {
+			return LegacyRatingScale, true
+		}
+	}
+	for _, v := range ratings {
+		if v > 1 {
+			return StarsRatingScale, true
+		}
+	}
+	return StarsRatingScale, false
+}
+
+// convertRating converts v in scale to StarsRatingScale.
+func convertRating(v float64, scale RatingScale) (int, error) {
+	switch scale {
+	case StarsRatingScale:
+		if v < 0 || v > 5 || v != math.Trunc(v) {
+			return 0, fmt.Errorf("rating %v not in %v scale", v, scale)
+		}
+		return int(v), nil
+	case LegacyRatingScale:
+		if v > 1 {
+			return 0, fmt.Errorf("rating %v not in %v scale", v, scale)
+		}
+		return LegacyRatingToStars(v), nil
+	default:
+		return 0, fmt.Errorf("can't convert from %q scale", scale)
+	}
+}
+
+// songJSON is used to decode JSON-marshaled songs with ratings in any scale.
+// The outer Rating field takes precedence over Song.Rating.
+type songJSON struct {
+	*Song
+	Rating *float64 `json:"rating"`
+}
+
+// DecodeSongs reads JSON-marshaled songs from r until EOF.
+// Ratings are converted from scale to StarsRatingScale. If scale is AutoRatingScale,
+// DetectRatingScale is used to choose a single scale for all of the songs.
+// The scale that was used is returned.
+func DecodeSongs(r io.Reader, scale RatingScale) ([]*Song, RatingScale, error) {
+	var songs []*Song
+	var ratings []float64
+	var rated []*Song // songs with ratings, corresponding to ratings
+	d := json.NewDecoder(r)
+	for {
+		s := &Song{}
+		sj := songJSON{Song: s}
+		if err := d.Decode(&sj); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, "", err
+		}
+		songs = append(songs, s)
+		if sj.Rating != nil {
+			ratings = append(ratings, *sj.Rating)
+			rated = append(rated, s)
+		}
+	}
+
+	if scale == AutoRatingScale {
+		scale, _ = DetectRatingScale(ratings)
+	}
+	for i, s := range rated {
+		var err error
+		if s.Rating, err = convertRating(ratings[i], scale); err != nil {
+			return nil, "", fmt.Errorf("song %q: %v", s.SHA1, err)
+		}
+	}
+	return songs, scale, nil
+}
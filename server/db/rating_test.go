@@ -0,0 +1,66 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package db
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDetectRatingScale(t *testing.T) {
+	for _, tc := range []struct {
+		ratings []float64
+		scale   RatingScale
+		ok      bool
+	}{
+		{nil, StarsRatingScale, false},
+		{[]float64{0, 1, 1}, StarsRatingScale, false},
+		{[]float64{0, 1, 4}, StarsRatingScale, true},
+		{[]float64{1, 0.75}, LegacyRatingScale, true},
+		{[]float64{1, -1}, LegacyRatingScale, true},
+	} {
+		if scale, ok := DetectRatingScale(tc.ratings); scale != tc.scale || ok != tc.ok {
+			t.Errorf("DetectRatingScale(%v) = %q, %v; want %q, %v",
+				tc.ratings, scale, ok, tc.scale, tc.ok)
+		}
+	}
+}
+
+func TestDecodeSongs(t *testing.T) {
+	for _, tc := range []struct {
+		data      string
+		scale     RatingScale
+		wantScale RatingScale
+		ratings   []int // nil if error expected
+	}{
+		{`{"rating":4}{"rating":0}{}`, AutoRatingScale, StarsRatingScale, []int{4, 0, 0}},
+		{`{"rating":0.75}{"rating":-1}{"rating":1}{"rating":0}`,
+			AutoRatingScale, LegacyRatingScale, []int{4, 0, 5, 1}},
+		{`{"rating":1}{"rating":0}`, AutoRatingScale, StarsRatingScale, []int{1, 0}},
+		{`{"rating":1}{"rating":0}`, LegacyRatingScale, LegacyRatingScale, []int{5, 1}},
+		{`{"rating":0.5}`, StarsRatingScale, "", nil},
+		{`{"rating":3}`, LegacyRatingScale, "", nil},
+		{`{"rating":0.5}{"rating":3}`, AutoRatingScale, "", nil},
+	} {
+		songs, scale, err := DecodeSongs(strings.NewReader(tc.data), tc.scale)
+		if tc.ratings == nil {
+			if err == nil {
+				t.Errorf("DecodeSongs(%q, %q) didn't fail", tc.data, tc.scale)
+			}
+			continue
+		} else if err != nil {
+			t.Errorf("DecodeSongs(%q, %q) failed: %v", tc.data, tc.scale, err)
+			continue
+		}
+		ratings := make([]int, len(songs))
+		for i, s := range songs {
+			ratings[i] = s.Rating
+		}
+		if scale != tc.wantScale || !reflect.DeepEqual(ratings, tc.ratings) {
+			t.Errorf("DecodeSongs(%q, %q) returned %v with %q; want %v with %q",
+				tc.data, tc.scale, ratings, scale, tc.ratings, tc.wantScale)
+		}
+	}
+}
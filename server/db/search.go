@@ -0,0 +1,68 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package db
+
+import (
+	"sort"
+	"strings"
+	"unicode"
+)
+
+const (
+	// MinKeywordPrefixLen is the minimum length in runes of prefixes returned by KeywordPrefixes.
+	MinKeywordPrefixLen = 2
+	// MinFuzzyKeywordLen is the minimum length in runes of words for which
+	// KeywordVariants generates deletion variants. Shorter words are too likely
+	// to match unrelated words after a single edit.
+	MinFuzzyKeywordLen = 4
+)
+
+// KeywordFields splits s into words for Song.Keywords.
+// Letters and numbers are preserved, while all other characters are treated as separators.
+// s should have already been normalized using Normalize.
+func KeywordFields(s string) []string {
+	return strings.FieldsFunc(s, func(c rune) bool {
+		return !unicode.IsLetter(c) && !unicode.IsNumber(c)
+	})
+}
+
+// KeywordPrefixes returns the sorted and deduped prefixes of the supplied words.
+// Each word is included in its entirety, along with all of its proper prefixes
+// that are at least MinKeywordPrefixLen runes long.
+func KeywordPrefixes(words []string) []string {
+	var prefixes []string
+	for _, w := range words {
+		rs := []rune(w)
+		for n := MinKeywordPrefixLen; n < len(rs); n++ {
+			prefixes = append(prefixes, string(rs[:n]))
+		}
+		prefixes = append(prefixes, w)
+	}
+	sort.Strings(prefixes)
+	return dedupeSortedStrings(prefixes)
+}
+
+// KeywordVariants returns the sorted and deduped supplied words along with all
+// strings that can be produced by deleting a single rune from words that are
+// at least MinFuzzyKeywordLen runes long.
+//
+// If two words differ by a single inserted, deleted, or substituted rune or by
+// a transposition of adjacent runes, their variants intersect, so the variants
+// can be used to match misspelled words without needing to scan all keywords.
+// (Some words that differ by both an insertion and a deletion also share variants.)
+func KeywordVariants(words []string) []string {
+	var variants []string
+	for _, w := range words {
+		variants = append(variants, w)
+		rs := []rune(w)
+		if len(rs) < MinFuzzyKeywordLen {
+			continue
+		}
+		for i := range rs {
+			variants = append(variants, string(rs[:i])+string(rs[i+1:]))
+		}
+	}
+	sort.Strings(variants)
+	return dedupeSortedStrings(variants)
+}
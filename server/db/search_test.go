@@ -0,0 +1,44 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package db
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestKeywordPrefixes(t *testing.T) {
+	for _, tc := range []struct {
+		words []string
+		want  []string
+	}{
+		{nil, nil},
+		{[]string{"a"}, []string{"a"}},
+		{[]string{"ab"}, []string{"ab"}},
+		{[]string{"abcd"}, []string{"ab", "abc", "abcd"}},
+		{[]string{"abc", "abd"}, []string{"ab", "abc", "abd"}},
+		{[]string{"éte"}, []string{"ét", "éte"}},
+	} {
+		if got := KeywordPrefixes(tc.words); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("KeywordPrefixes(%q) = %q; want %q", tc.words, got, tc.want)
+		}
+	}
+}
+
+func TestKeywordVariants(t *testing.T) {
+	for _, tc := range []struct {
+		words []string
+		want  []string
+	}{
+		{nil, nil},
+		{[]string{"abc"}, []string{"abc"}},
+		{[]string{"abcd"}, []string{"abc", "abcd", "abd", "acd", "bcd"}},
+		{[]string{"aabb"}, []string{"aab", "aabb", "abb"}},
+		{[]string{"abc", "abcd"}, []string{"abc", "abcd", "abd", "acd", "bcd"}},
+	} {
+		if got := KeywordVariants(tc.words); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("KeywordVariants(%q) = %q; want %q", tc.words, got, tc.want)
+		}
+	}
+}
@@ -6,7 +6,7 @@ package db
 import (
 	"encoding/json"
 	"fmt"
-	"math"
+	"math/rand"
 	"regexp"
 	"sort"
 	"strconv"
@@ -44,12 +44,26 @@ type Song struct {
 	// song's music data.
 	Filename string `json:"filename,omitempty"`
 
+	// Library contains the name of the server library (see config.Library) containing
+	// the song. It is empty for songs in the server's main library.
+	Library string `json:"library,omitempty"`
+
 	// CoverFilename is a relative path from the base of the covers directory.
 	// Must be escaped for Cloud Storage when constructing CoverURL.
 	// Clients can pass this to the server's /cover endpoint to get a scaled
 	// copy of the cover.
 	CoverFilename string `datastore:",noindex" json:"coverFilename,omitempty"`
 
+	// CoverBlurHash contains a BlurHash (https://blurha.sh/) string describing the
+	// image at CoverFilename. Clients can use it to display a placeholder while the
+	// cover is being loaded.
+	CoverBlurHash string `datastore:",noindex" json:"coverBlurHash,omitempty"`
+
+	// CoverPalette contains the dominant colors of the image at CoverFilename as
+	// "#rrggbb" strings, ordered by decreasing prevalence. Clients can use it to
+	// theme their UIs to match the cover.
+	CoverPalette []string `datastore:",noindex" json:"coverPalette,omitempty"`
+
 	// Canonical versions used for display.
 	Artist string `datastore:",noindex" json:"artist"`
 	Title  string `datastore:",noindex" json:"title"`
@@ -61,18 +75,58 @@ type Song struct {
 	TitleLower  string `json:"-"`
 	AlbumLower  string `json:"-"`
 
+	// ArtistCredits contains the individual artists credited in Artist, e.g. "Artist A"
+	// (with join phrase " feat. ") and "Artist B" for "Artist A feat. Artist B".
+	// It is taken from MusicBrainz artist credits or the TXXX "ARTISTS" ID3 frame
+	// and is empty if unknown. Artist is still used for display.
+	ArtistCredits []ArtistCredit `datastore:",noindex" json:"artistCredits,omitempty"`
+	// ArtistsLower contains ArtistLower and the normalized names from ArtistCredits.
+	// It is used for searching so that any of a song's credited artists will match.
+	ArtistsLower []string `json:"-"`
+
+	// ArtistSortName, AlbumSortName, and AlbumArtistSortName contain versions of Artist,
+	// Album, and AlbumArtist that should be used when sorting songs, e.g. "Beatles, The" for
+	// "The Beatles". They correspond to the TSOP, TSOA, and TSO2 ID3 frames or to MusicBrainz
+	// artist sort names and are empty if unknown.
+	ArtistSortName      string `datastore:",noindex" json:"artistSortName,omitempty"`
+	AlbumSortName       string `datastore:",noindex" json:"albumSortName,omitempty"`
+	AlbumArtistSortName string `datastore:",noindex" json:"albumArtistSortName,omitempty"`
+
 	// AlbumArtist contains the album's artist if it isn't the same as Artist.
 	// This corresponds to the TPE2 ID3 tag, which may hold the performer name
 	// in the case of a classical album, or the remixer name in the case of an
 	// album consisting of songs remixed by a single artist.
 	AlbumArtist string `datastore:",noindex" json:"albumArtist,omitempty"`
 
+	// Composer, Conductor, and Performer contain additional artists credited for the song.
+	// They correspond to the TCOM, TPE3, and TMCL (or IPLS in ID3v2.3) ID3 frames or to
+	// MusicBrainz relationships. Performer may contain multiple comma-separated names.
+	Composer  string `datastore:",noindex" json:"composer,omitempty"`
+	Conductor string `datastore:",noindex" json:"conductor,omitempty"`
+	Performer string `datastore:",noindex" json:"performer,omitempty"`
+
 	// DiscSubtitle contains the disc's subtitle, if any.
 	DiscSubtitle string `json:"discSubtitle,omitempty"`
 
-	// Keywords contains words from ArtistLower, TitleLower, AlbumLower, and
-	// AlbumArtist and DiscSubtitle (after normalization). It is used for searching.
+	// Genres contains the song's genres, e.g. from the TCON ID3 frame or MusicBrainz.
+	Genres []string `datastore:",noindex" json:"genres,omitempty"`
+	// GenresLower contains normalized versions of Genres. It is used for searching.
+	GenresLower []string `json:"-"`
+
+	// Compilation is true if the song is from a compilation of songs by various artists,
+	// as indicated by the iTunes TCMP ID3 frame.
+	Compilation bool `json:"compilation,omitempty"`
+
+	// Keywords contains words from ArtistLower, TitleLower, AlbumLower, and AlbumArtist,
+	// Composer, Conductor, Performer, DiscSubtitle, and Notes (after normalization).
+	// It is used for searching.
 	Keywords []string `json:"-"`
+	// KeywordPrefixes contains prefixes of Keywords (see KeywordPrefixes).
+	// It is used for prefix searches.
+	KeywordPrefixes []string `json:"-"`
+	// KeywordVariants contains Keywords and their single-deletion variants
+	// (see KeywordVariants). It is used for fuzzy searches.
+	KeywordVariants []string `json:"-"`
 
 	// AlbumID is an opaque ID uniquely identifying the album
 	// (generally, a MusicBrainz release ID taken from a "MusicBrainz Album Id" ID3v2 tag).
@@ -85,8 +139,9 @@ type Song struct {
 	// RecordingID is an opaque ID uniquely identifying the recording (generally, the MusicBrainz ID
 	// corresponding to the MusicBrainz recording entity, taken from a UFID ID3v2 tag).
 	// This is used to find cover art if neither AlbumID nor CoverID is set.
-	// It is also used to find updated metadata for the song in MusicBrainz.
-	RecordingID string `datastore:"-" json:"-"`
+	// It is also used to find updated metadata for the song in MusicBrainz and to find
+	// different versions of the same recording on the server.
+	RecordingID string `datastore:"RecordingId,noindex" json:"recordingId,omitempty"`
 
 	// OrigAlbumID and OrigRecordingID contain the original values of AlbumID and RecordingID
 	// if they were overridden by JSON files. These are only used by the client.
@@ -97,16 +152,44 @@ type Song struct {
 	Track int `json:"track"`
 	// Disc is the song's disc number, or 0 if unset.
 	Disc int `json:"disc"`
+	// TotalTracks is the number of tracks on the song's disc, or 0 if unknown.
+	TotalTracks int `json:"totalTracks,omitempty"`
+	// TotalDiscs is the number of discs in the song's album, or 0 if unknown.
+	TotalDiscs int `json:"totalDiscs,omitempty"`
 
 	// Date is the date on which this song was recorded or released in UTC.
 	// It is used when listing songs or albums in chronological order.
 	// This is vaguely defined because the ID3v2 fields related to it are a mess:
 	// https://github.com/derat/nup/issues/42
 	Date time.Time `json:"date,omitempty"`
+	// OriginalDate is the date on which the song was first released in UTC
+	// (from the TDOR or TORY ID3 frame), or zero if unknown. Unlike Date and
+	// ReleaseDate, it isn't affected by reissues and remasters.
+	OriginalDate time.Time `json:"originalDate,omitempty"`
+	// ReleaseDate is the date on which the song's release was issued in UTC
+	// (from the TDRL or TDRC ID3 frame), or zero if unknown.
+	ReleaseDate time.Time `json:"releaseDate,omitempty"`
 
 	// Length is the song's duration in seconds.
 	Length float64 `json:"length"`
 
+	// FileStart and FileEnd contain the song's starting and ending positions in seconds
+	// within Filename. They are only set for songs synthesized from tracks in cue sheets
+	// (i.e. multiple songs stored in a single file), for which FileEnd is positive.
+	FileStart float64 `datastore:",noindex" json:"fileStart,omitempty"`
+	FileEnd   float64 `datastore:",noindex" json:"fileEnd,omitempty"`
+
+	// Segments contains chapters within the song (e.g. tracks within a DJ mix) in
+	// ascending order by start time. It is read from ID3v2 CHAP frames or from
+	// metadata override files.
+	Segments []Segment `datastore:",noindex" json:"segments,omitempty"`
+
+	// BPM is the song's tempo in beats per minute (from the TBPM ID3 frame), or 0 if unknown.
+	BPM float64 `json:"bpm,omitempty"`
+	// Key is the song's musical key (from the TKEY ID3 frame), e.g. "A", "Ebm", or "o" for
+	// off-key. Empty if unknown.
+	Key string `datastore:",noindex" json:"key,omitempty"`
+
 	// TrackGain is the song's dB gain adjustment independent of its album. More info:
 	//  https://en.wikipedia.org/wiki/ReplayGain
 	//  https://wiki.hydrogenaud.io/index.php?title=ReplayGain_specification
@@ -118,6 +201,20 @@ type Song struct {
 	// amplitude that can be played without clipping.
 	PeakAmp float64 `datastore:",noindex" json:"peakAmp"`
 
+	// Loudness is the song's EBU R128 integrated loudness in LUFS, or 0 if unknown.
+	// Unlike TrackGain (which uses ReplayGain's 89 dB reference), this lets players
+	// normalize songs to an arbitrary target (e.g. -14 LUFS).
+	Loudness float64 `datastore:",noindex" json:"loudness,omitempty"`
+	// TruePeak is the song's EBU R128 true peak level in dBTP.
+	// It is only meaningful if Loudness is nonzero.
+	TruePeak float64 `datastore:",noindex" json:"truePeak,omitempty"`
+
+	// LeadingSilence and TrailingSilence contain the durations in seconds of silence
+	// at the beginning and end of the song's audio data, so that players can trim
+	// silence or schedule crossfades. They are 0 if unknown.
+	LeadingSilence  float64 `datastore:",noindex" json:"leadingSilence,omitempty"`
+	TrailingSilence float64 `datastore:",noindex" json:"trailingSilence,omitempty"`
+
 	// Rating is the song's rating in the range [1, 5], or 0 if unrated.
 	// The server should call SetRating to additionally update the RatingAtLeast* fields.
 	Rating int `json:"rating"`
@@ -142,11 +239,51 @@ type Song struct {
 	// Only used for importing data -- in Datastore, Play is a descendant of Song.
 	Plays []Play `datastore:"-" json:"plays,omitempty"`
 
+	// RecentPlays contains the song's most recent plays (at most MaxRecentPlays) in
+	// ascending order by start time. All plays are also stored as Play entities;
+	// this denormalized copy lets common operations avoid querying them.
+	// It may be empty for songs that were last updated before it was added
+	// (see RecentPlaysValid).
+	RecentPlays []Play `datastore:",noindex" json:"-"`
+
+	// NumSkips is the number of times the song has been skipped before it finished playing.
+	NumSkips int `json:"numSkips,omitempty"`
+	// RecentSkips contains the song's most recent skips (at most MaxRecentSkips)
+	// in ascending order by start time.
+	RecentSkips []Skip `datastore:",noindex" json:"-"`
+
 	// Tags contains tags assigned to the song by the user.
 	Tags []string `json:"tags"`
+	// Notes contains free-form notes about the song written by the user.
+	// The server should call SetNotes to additionally update the Keywords* fields.
+	Notes string `datastore:",noindex" json:"notes,omitempty"`
 
 	// LastModifiedTime is the time that the song was modified.
 	LastModifiedTime time.Time `json:"-"`
+	// LastModifiedNsec contains LastModifiedTime as nanoseconds since the Unix epoch.
+	// It is only set in search results, and clients can pass it back to the server's
+	// /rate_and_tag endpoint to avoid overwriting concurrent updates. It is marshaled
+	// as a string since JavaScript numbers can't represent it precisely.
+	LastModifiedNsec int64 `datastore:"-" json:"lastModifiedNsec,string,omitempty"`
+	// CreatedTime is the time that the song was first added to the database.
+	// It is unset for songs that were added before this field was introduced.
+	CreatedTime time.Time `json:"-"`
+
+	// SchemaVersion is the version of the most-recent schema migration that was applied
+	// to the song (see SetMigrators).
+	SchemaVersion int `json:"-"`
+
+	// RandomKey is a random value in (0, 1) assigned when the song is added to the database.
+	// It's used to cheaply select random songs without loading all matching songs.
+	// It is unset for songs that haven't been reindexed since this field was introduced.
+	RandomKey float64 `json:"-"`
+}
+
+// AssignRandomKey sets RandomKey to a random nonzero value if it isn't already set.
+func (s *Song) AssignRandomKey() {
+	for s.RandomKey == 0 {
+		s.RandomKey = rand.Float64()
+	}
 }
 
 // Load implements datastore.PropertyLoadSaver.
@@ -163,20 +300,23 @@ func (s *Song) Load(orig []datastore.Property) error {
 			if v, ok := p.Value.(float64); ok {
 				// datastore.Property seems to use int64 internally for all int types:
 				// https://github.com/golang/appengine/blob/v2.0.1/v2/datastore/load.go
-				var stars int64
-				if v >= 0 {
-					stars = int64(math.Round(4*v)) + 1
-				}
-				p.Value = stars
+				p.Value = int64(LegacyRatingToStars(v))
 			}
 		}
 		props = append(props, p)
 	}
-	return datastore.LoadStruct(s, props)
+	if err := datastore.LoadStruct(s, props); err != nil {
+		return err
+	}
+	return migrateSong(s)
 }
 
 // Save implements datastore.PropertyLoadSaver.
+// Pending schema migrations are applied to s before it is saved.
 func (s *Song) Save() ([]datastore.Property, error) {
+	if err := migrateSong(s); err != nil {
+		return nil, err
+	}
 	return datastore.SaveStruct(s)
 }
 
@@ -184,19 +324,26 @@ func (s *Song) Save() ([]datastore.Property, error) {
 var _ datastore.PropertyLoadSaver = (*Song)(nil)
 
 // MarshalJSON uses a disgusting hack from https://stackoverflow.com/a/60567000 to
-// omit "Date" fields that have the zero value.
+// omit "Date", "OriginalDate", and "ReleaseDate" fields that have the zero value.
 func (s Song) MarshalJSON() ([]byte, error) {
 	type Alias Song
-	if s.Date.IsZero() {
-		return json.Marshal(&struct {
-			Date string `json:"date,omitempty"`
-			*Alias
-		}{
-			Date:  "",
-			Alias: (*Alias)(&s),
-		})
+	nonZero := func(t time.Time) *time.Time {
+		if t.IsZero() {
+			return nil
+		}
+		return &t
 	}
-	return json.Marshal(&struct{ *Alias }{Alias: (*Alias)(&s)})
+	return json.Marshal(&struct {
+		Date         *time.Time `json:"date,omitempty"`
+		OriginalDate *time.Time `json:"originalDate,omitempty"`
+		ReleaseDate  *time.Time `json:"releaseDate,omitempty"`
+		*Alias
+	}{
+		Date:         nonZero(s.Date),
+		OriginalDate: nonZero(s.OriginalDate),
+		ReleaseDate:  nonZero(s.ReleaseDate),
+		Alias:        (*Alias)(&s),
+	})
 }
 
 // MetadataEquals returns true if s and o have identical metadata.
@@ -204,87 +351,130 @@ func (s Song) MarshalJSON() ([]byte, error) {
 func (s *Song) MetadataEquals(o *Song) bool {
 	return s.SHA1 == o.SHA1 &&
 		s.Filename == o.Filename &&
+		s.Library == o.Library &&
 		s.CoverFilename == o.CoverFilename &&
+		s.CoverBlurHash == o.CoverBlurHash &&
+		stringsEqual(s.CoverPalette, o.CoverPalette) &&
 		s.Artist == o.Artist &&
+		artistCreditsEqual(s.ArtistCredits, o.ArtistCredits) &&
+		s.ArtistSortName == o.ArtistSortName &&
+		s.AlbumSortName == o.AlbumSortName &&
+		s.AlbumArtistSortName == o.AlbumArtistSortName &&
 		s.Title == o.Title &&
 		s.Album == o.Album &&
 		s.AlbumArtist == o.AlbumArtist &&
+		s.Composer == o.Composer &&
+		s.Conductor == o.Conductor &&
+		s.Performer == o.Performer &&
 		s.AlbumID == o.AlbumID &&
-		// RecordingID isn't sent to the server, but the nup executable's 'metadata'
-		// subcommand calls this method to check for differences after fetching new
-		// metadata, and it needs to see recording changes.
 		s.RecordingID == o.RecordingID &&
 		s.Track == o.Track &&
 		s.Disc == o.Disc &&
+		s.TotalTracks == o.TotalTracks &&
+		s.TotalDiscs == o.TotalDiscs &&
 		s.DiscSubtitle == o.DiscSubtitle &&
+		stringsEqual(s.Genres, o.Genres) &&
+		s.Compilation == o.Compilation &&
 		s.Date.Equal(o.Date) &&
+		s.OriginalDate.Equal(o.OriginalDate) &&
+		s.ReleaseDate.Equal(o.ReleaseDate) &&
 		s.Length == o.Length &&
+		s.FileStart == o.FileStart &&
+		s.FileEnd == o.FileEnd &&
+		segmentsEqual(s.Segments, o.Segments) &&
+		s.BPM == o.BPM &&
+		s.Key == o.Key &&
 		s.TrackGain == o.TrackGain &&
 		s.AlbumGain == o.AlbumGain &&
-		s.PeakAmp == o.PeakAmp
+		s.PeakAmp == o.PeakAmp &&
+		s.Loudness == o.Loudness &&
+		s.TruePeak == o.TruePeak &&
+		s.LeadingSilence == o.LeadingSilence &&
+		s.TrailingSilence == o.TrailingSilence
 }
 
 // Update copies fields from src to dst.
 //
 // If copyUserData is true, the Rating*, FirstStartTime, LastStartTime,
-// NupPlays, and Tags fields are also copied; otherwise they are left unchanged.
+// NupPlays, Tags, and Notes fields are also copied; otherwise they are left unchanged.
 //
-// ArtistLower, TitleLower, AlbumLower, and Keywords are also initialized in dst,
-// and Clean is called.
+// ArtistLower, ArtistsLower, TitleLower, AlbumLower, GenresLower, Keywords, KeywordPrefixes,
+// and KeywordVariants are also initialized in dst, and Clean is called.
 func (dst *Song) Update(src *Song, copyUserData bool) error {
 	dst.SHA1 = src.SHA1
 	dst.Filename = src.Filename
+	dst.Library = src.Library
 	dst.CoverFilename = src.CoverFilename
+	dst.CoverBlurHash = src.CoverBlurHash
+	dst.CoverPalette = src.CoverPalette
 	dst.Artist = src.Artist
+	dst.ArtistCredits = append([]ArtistCredit(nil), src.ArtistCredits...)
+	dst.ArtistSortName = src.ArtistSortName
+	dst.AlbumSortName = src.AlbumSortName
+	dst.AlbumArtistSortName = src.AlbumArtistSortName
 	dst.Title = src.Title
 	dst.Album = src.Album
 	dst.AlbumArtist = src.AlbumArtist
+	dst.Composer = src.Composer
+	dst.Conductor = src.Conductor
+	dst.Performer = src.Performer
 	dst.AlbumID = src.AlbumID
+	dst.RecordingID = src.RecordingID
 	dst.Track = src.Track
 	dst.Disc = src.Disc
+	dst.TotalTracks = src.TotalTracks
+	dst.TotalDiscs = src.TotalDiscs
 	dst.DiscSubtitle = src.DiscSubtitle
+	dst.Genres = append([]string(nil), src.Genres...)
+	dst.Compilation = src.Compilation
 	dst.Date = src.Date
+	dst.OriginalDate = src.OriginalDate
+	dst.ReleaseDate = src.ReleaseDate
 	dst.Length = src.Length
+	dst.FileStart = src.FileStart
+	dst.FileEnd = src.FileEnd
+	dst.Segments = append([]Segment(nil), src.Segments...)
+	dst.BPM = src.BPM
+	dst.Key = src.Key
 	dst.TrackGain = src.TrackGain
 	dst.AlbumGain = src.AlbumGain
 	dst.PeakAmp = src.PeakAmp
+	dst.Loudness = src.Loudness
+	dst.TruePeak = src.TruePeak
+	dst.LeadingSilence = src.LeadingSilence
+	dst.TrailingSilence = src.TrailingSilence
 
 	var err error
 	if dst.ArtistLower, err = Normalize(dst.Artist); err != nil {
 		return fmt.Errorf("normalizing %q: %v", src.Artist, err)
 	}
+	dst.ArtistsLower = nil
+	if dst.ArtistLower != "" {
+		dst.ArtistsLower = append(dst.ArtistsLower, dst.ArtistLower)
+	}
+	for _, ac := range dst.ArtistCredits {
+		norm, err := Normalize(ac.Name)
+		if err != nil {
+			return fmt.Errorf("normalizing %q: %v", ac.Name, err)
+		}
+		if norm != "" {
+			dst.ArtistsLower = append(dst.ArtistsLower, norm)
+		}
+	}
 	if dst.TitleLower, err = Normalize(dst.Title); err != nil {
 		return fmt.Errorf("normalizing %q: %v", src.Title, err)
 	}
 	if dst.AlbumLower, err = Normalize(dst.Album); err != nil {
 		return fmt.Errorf("normalizing %q: %v", src.Album, err)
 	}
-
-	// AlbumArtist is empty if it's the same as Artist. The normalized
-	// version of it isn't stored, but it gets included in Keywords.
-	albumArtistNorm, err := Normalize(dst.AlbumArtist)
-	if err != nil {
-		return fmt.Errorf("normalizing %q: %v", dst.AlbumArtist, err)
-	}
-	// DiscSubtitle is also included in Keywords.
-	discSubtitleNorm, err := Normalize(dst.DiscSubtitle)
-	if err != nil {
-		return fmt.Errorf("normalizing %q: %v", dst.DiscSubtitle, err)
-	}
-
-	// Keywords are sorted and deduped in the later call to Clean.
-	dst.Keywords = nil
-	for _, str := range []string{
-		dst.ArtistLower,
-		dst.TitleLower,
-		dst.AlbumLower,
-		albumArtistNorm,
-		discSubtitleNorm,
-	} {
-		for _, w := range strings.FieldsFunc(str, func(c rune) bool {
-			return !unicode.IsLetter(c) && !unicode.IsNumber(c)
-		}) {
-			dst.Keywords = append(dst.Keywords, w)
+	dst.GenresLower = nil
+	for _, g := range dst.Genres {
+		norm, err := Normalize(g)
+		if err != nil {
+			return fmt.Errorf("normalizing %q: %v", g, err)
+		}
+		if norm != "" {
+			dst.GenresLower = append(dst.GenresLower, norm)
 		}
 	}
 
@@ -293,13 +483,65 @@ func (dst *Song) Update(src *Song, copyUserData bool) error {
 		dst.FirstStartTime = src.FirstStartTime
 		dst.LastStartTime = src.LastStartTime
 		dst.NumPlays = src.NumPlays
+		dst.RecentPlays = append([]Play(nil), src.RecentPlays...)
+		dst.NumSkips = src.NumSkips
+		dst.RecentSkips = append([]Skip(nil), src.RecentSkips...)
 		dst.Tags = append([]string(nil), src.Tags...)
+		dst.Notes = src.Notes
 	}
 
+	if err := dst.updateKeywords(); err != nil {
+		return err
+	}
 	dst.Clean()
 	return nil
 }
 
+// SetNotes sets Notes to notes (after trimming whitespace) and updates Keywords,
+// KeywordPrefixes, and KeywordVariants. ArtistLower, TitleLower, and AlbumLower
+// must have already been initialized.
+func (s *Song) SetNotes(notes string) error {
+	s.Notes = strings.TrimSpace(notes)
+	return s.updateKeywords()
+}
+
+// updateKeywords initializes Keywords, KeywordPrefixes, and KeywordVariants from KeywordSources.
+func (s *Song) updateKeywords() error {
+	srcs, err := s.KeywordSources()
+	if err != nil {
+		return err
+	}
+	s.Keywords = nil
+	for _, str := range srcs {
+		s.Keywords = append(s.Keywords, KeywordFields(str)...)
+	}
+	sort.Strings(s.Keywords)
+	s.Keywords = dedupeSortedStrings(s.Keywords)
+	s.KeywordPrefixes = KeywordPrefixes(s.Keywords)
+	s.KeywordVariants = KeywordVariants(s.Keywords)
+	return nil
+}
+
+// KeywordSources returns the normalized strings from which s's Keywords are derived.
+// ArtistLower, ArtistsLower, TitleLower, and AlbumLower must have already been initialized.
+func (s *Song) KeywordSources() ([]string, error) {
+	srcs := []string{s.ArtistLower, s.TitleLower, s.AlbumLower}
+	srcs = append(srcs, s.ArtistsLower...) // credited artists' names may differ from Artist
+
+	// AlbumArtist is empty if it's the same as Artist. The normalized version of it isn't
+	// stored, but it gets included in Keywords. Composer, Conductor, Performer,
+	// DiscSubtitle, and Notes are also included.
+	for _, str := range []string{s.AlbumArtist, s.Composer, s.Conductor, s.Performer,
+		s.DiscSubtitle, s.Notes} {
+		norm, err := Normalize(str)
+		if err != nil {
+			return nil, fmt.Errorf("normalizing %q: %v", str, err)
+		}
+		srcs = append(srcs, norm)
+	}
+	return srcs, nil
+}
+
 // SetRating sets Rating to r and updates RatingAtLeast*.
 func (s *Song) SetRating(r int) {
 	s.Rating = r
@@ -321,15 +563,63 @@ func (s *Song) UpdatePlayStats(startTime time.Time) {
 	}
 }
 
-// RebuildPlayStats regenerates NumPlays, FirstStartTime, and LastStartTime based
-// on the supplied plays.
+// RebuildPlayStats regenerates NumPlays, FirstStartTime, LastStartTime, and
+// RecentPlays based on the supplied plays.
 func (s *Song) RebuildPlayStats(plays []Play) {
 	s.NumPlays = 0
 	s.FirstStartTime = time.Time{}
 	s.LastStartTime = time.Time{}
+	s.RecentPlays = nil
 	for _, p := range plays {
 		s.UpdatePlayStats(p.StartTime)
+		s.AddRecentPlay(p)
+	}
+}
+
+// MaxRecentPlays is the maximum number of plays stored in Song.RecentPlays.
+const MaxRecentPlays = 20
+
+// AddRecentPlay inserts p into RecentPlays, dropping the oldest play if needed.
+// p is ignored if it's already present or is older than all plays in a full list.
+func (s *Song) AddRecentPlay(p Play) {
+	if s.HasRecentPlay(&p) {
+		return
+	}
+	i := sort.Search(len(s.RecentPlays), func(i int) bool {
+		return s.RecentPlays[i].StartTime.After(p.StartTime)
+	})
+	s.RecentPlays = append(s.RecentPlays, Play{})
+	copy(s.RecentPlays[i+1:], s.RecentPlays[i:])
+	s.RecentPlays[i] = p
+	if n := len(s.RecentPlays); n > MaxRecentPlays {
+		s.RecentPlays = append([]Play(nil), s.RecentPlays[n-MaxRecentPlays:]...)
+	}
+}
+
+// HasRecentPlay returns true if RecentPlays contains p.
+func (s *Song) HasRecentPlay(p *Play) bool {
+	for i := range s.RecentPlays {
+		if s.RecentPlays[i].Equal(p) {
+			return true
+		}
 	}
+	return false
+}
+
+// RecentPlaysValid returns true if RecentPlays appears to have been populated,
+// i.e. it contains as many plays as expected given NumPlays. If false is returned,
+// Play entities must be queried instead.
+func (s *Song) RecentPlaysValid() bool {
+	n := s.NumPlays
+	if n > MaxRecentPlays {
+		n = MaxRecentPlays
+	}
+	return len(s.RecentPlays) == n
+}
+
+// HasAllPlays returns true if RecentPlays is valid and contains all of the song's plays.
+func (s *Song) HasAllPlays() bool {
+	return s.RecentPlaysValid() && s.NumPlays <= MaxRecentPlays
 }
 
 // Clean sorts and removes duplicates from slice fields in s.
@@ -340,10 +630,54 @@ func (s *Song) Clean() {
 	sort.Strings(s.Tags)
 	s.Tags = dedupeSortedStrings(s.Tags)
 
+	sort.Strings(s.GenresLower)
+	s.GenresLower = dedupeSortedStrings(s.GenresLower)
+
+	sort.Strings(s.ArtistsLower)
+	s.ArtistsLower = dedupeSortedStrings(s.ArtistsLower)
+
 	sort.Sort(PlayArray(s.Plays))
 	s.Plays = dedupeSortedPlays(s.Plays)
 }
 
+// stringsEqual returns true if a and b contain the same strings in the same order.
+// Nil and empty slices are considered equal.
+func stringsEqual(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func artistCreditsEqual(a, b []ArtistCredit) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func segmentsEqual(a, b []Segment) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
 func dedupeSortedStrings(full []string) []string {
 	var src, dst int
 	for ; src < len(full); src++ {
@@ -377,20 +711,120 @@ func Normalize(s string) (string, error) {
 	return strings.ToLower(string(b[:n])), nil
 }
 
+// MaxRecentSkips is the maximum number of skips stored in Song.RecentSkips.
+const MaxRecentSkips = 20
+
+// AddSkip records sk in NumSkips and RecentSkips, dropping the oldest skip if needed.
+// false is returned if RecentSkips already contains a skip with the same start time.
+func (s *Song) AddSkip(sk Skip) bool {
+	for i := range s.RecentSkips {
+		if s.RecentSkips[i].StartTime.Equal(sk.StartTime) {
+			return false
+		}
+	}
+	s.NumSkips++
+	i := sort.Search(len(s.RecentSkips), func(i int) bool {
+		return s.RecentSkips[i].StartTime.After(sk.StartTime)
+	})
+	s.RecentSkips = append(s.RecentSkips, Skip{})
+	copy(s.RecentSkips[i+1:], s.RecentSkips[i:])
+	s.RecentSkips[i] = sk
+	if n := len(s.RecentSkips); n > MaxRecentSkips {
+		s.RecentSkips = append([]Skip(nil), s.RecentSkips[n-MaxRecentSkips:]...)
+	}
+	return true
+}
+
+// SkipRatio returns the fraction of the song's playbacks that were skipped,
+// i.e. NumSkips / (NumPlays + NumSkips). 0 is returned if the song hasn't been played.
+func (s *Song) SkipRatio() float64 {
+	if s.NumSkips == 0 {
+		return 0
+	}
+	return float64(s.NumSkips) / float64(s.NumPlays+s.NumSkips)
+}
+
+// ArtistCredit describes one of the artists credited for a Song.
+type ArtistCredit struct {
+	// Name is the artist's name as credited.
+	Name string `json:"name"`
+	// MBID is the artist's MusicBrainz ID, if known.
+	MBID string `json:"mbid,omitempty"`
+	// JoinPhrase is appended after Name when constructing the full credit, e.g. " feat. ".
+	JoinPhrase string `json:"joinPhrase,omitempty"`
+}
+
+// JoinArtistCredits returns the full credit string described by acs.
+func JoinArtistCredits(acs []ArtistCredit) string {
+	var s string
+	for _, ac := range acs {
+		s += ac.Name + ac.JoinPhrase
+	}
+	return s
+}
+
+// Segment describes a chapter within a Song.
+type Segment struct {
+	// Title is the segment's title, e.g. "Artist - Title" for a track within a mix.
+	Title string `json:"title"`
+	// Start is the segment's starting position in seconds within the song.
+	Start float64 `json:"start"`
+}
+
 // Play represents one playback of a Song.
 type Play struct {
 	// StartTime is the time at which playback started.
 	StartTime time.Time `json:"t"`
 	// IPAddress is the IPv4 or IPv6 address of the client playing the song.
 	IPAddress string `datastore:"IpAddress" json:"ip"`
+	// User is the username or email address of the user who reported the play.
+	// It is empty for plays that were reported anonymously or before users were recorded.
+	User string `json:"user,omitempty"`
+	// ReportTime is the time at which the play was saved by the server.
+	// It is used to find plays that were reported after a mirror's last sync.
+	// It is zero for plays that were saved before it was recorded.
+	ReportTime time.Time `json:"-"`
+	// SchemaVersion is the version of the most-recent schema migration that was applied
+	// to the play (see SetMigrators).
+	SchemaVersion int `datastore:",noindex" json:"-"`
+}
+
+func NewPlay(t time.Time, ip string) Play { return Play{StartTime: t, IPAddress: ip} }
+
+// Load implements datastore.PropertyLoadSaver.
+func (p *Play) Load(props []datastore.Property) error {
+	if err := datastore.LoadStruct(p, props); err != nil {
+		return err
+	}
+	return migratePlay(p)
 }
 
-func NewPlay(t time.Time, ip string) Play { return Play{t, ip} }
+// Save implements datastore.PropertyLoadSaver.
+// Pending schema migrations are applied to p before it is saved.
+func (p *Play) Save() ([]datastore.Property, error) {
+	if err := migratePlay(p); err != nil {
+		return nil, err
+	}
+	return datastore.SaveStruct(p)
+}
+
+// Assert that the interface is implemented.
+var _ datastore.PropertyLoadSaver = (*Play)(nil)
 
 func (p *Play) Equal(o *Play) bool {
 	return p.StartTime.Equal(o.StartTime) && p.IPAddress == o.IPAddress
 }
 
+// Skip represents a Song being skipped before it finished playing.
+type Skip struct {
+	// StartTime is the time at which playback started.
+	StartTime time.Time `json:"t"`
+	// Position is the playback position in seconds at which the song was skipped.
+	Position float64 `json:"pos"`
+	// User is the username or email address of the user who skipped the song.
+	User string `json:"user,omitempty"`
+}
+
 // PlayDump is used when dumping data.
 type PlayDump struct {
 	// Song entity's key ID from Datastore.
@@ -11,7 +11,12 @@ import (
 )
 
 func TestSong_MarshalJSON(t *testing.T) {
-	src := Song{Artist: "The Artist", Date: time.Date(2022, 4, 10, 13, 24, 45, 0, time.UTC)}
+	src := Song{
+		Artist:       "The Artist",
+		Date:         time.Date(2022, 4, 10, 13, 24, 45, 0, time.UTC),
+		OriginalDate: time.Date(1985, 3, 1, 0, 0, 0, 0, time.UTC),
+		ReleaseDate:  time.Date(2022, 4, 10, 0, 0, 0, 0, time.UTC),
+	}
 	var dst Song
 	if b, err := json.Marshal(src); err != nil {
 		t.Errorf("Marshaling %v failed: %v", src, err)
@@ -22,6 +27,8 @@ func TestSong_MarshalJSON(t *testing.T) {
 	}
 
 	src.Date = time.Time{}
+	src.OriginalDate = time.Time{}
+	src.ReleaseDate = time.Time{}
 	dst = Song{}
 	if b, err := json.Marshal(src); err != nil {
 		t.Errorf("Marshaling %v failed: %v", src, err)
@@ -30,12 +37,16 @@ func TestSong_MarshalJSON(t *testing.T) {
 	} else if !reflect.DeepEqual(dst, src) {
 		t.Errorf("Round-trip failed: got %v, want %v", dst, src)
 	} else {
-		// Check that the JSON object doesn't include a "date" property.
+		// Check that the JSON object doesn't include any date properties.
 		var obj map[string]interface{}
 		if err := json.Unmarshal(b, &obj); err != nil {
 			t.Errorf("Unmarshaling %q to map failed: %v", b, err)
-		} else if _, ok := obj["date"]; ok {
-			t.Errorf("Zero date is included in %q", b)
+		} else {
+			for _, prop := range []string{"date", "originalDate", "releaseDate"} {
+				if _, ok := obj[prop]; ok {
+					t.Errorf("Zero %v is included in %q", prop, b)
+				}
+			}
 		}
 	}
 }
@@ -47,27 +58,54 @@ func TestSong_Update(t *testing.T) {
 	t4 := t1.Add(3 * time.Second)
 
 	src := Song{
-		SHA1:           "deadbeef",
-		Filename:       "foo/bar.mp3",
-		CoverFilename:  "cover.jpg",
-		Artist:         "The Artist",
-		Title:          "The Title",
-		Album:          "The Album",
-		AlbumArtist:    "AlbumArtist",
-		DiscSubtitle:   "First Disc",
-		AlbumID:        "album-id",
-		Track:          13,
-		Disc:           2,
-		Date:           time.Date(2022, 4, 10, 13, 24, 45, 0, time.UTC),
-		Length:         154.3,
-		TrackGain:      -5.6,
-		AlbumGain:      -7.2,
-		PeakAmp:        1.1,
-		Rating:         3,
-		FirstStartTime: t1,
-		LastStartTime:  t2,
-		NumPlays:       2,
-		Tags:           []string{"rock", "guitar", "rock"},
+		SHA1:                "deadbeef",
+		Filename:            "foo/bar.mp3",
+		Library:             "lib",
+		CoverFilename:       "cover.jpg",
+		CoverBlurHash:       "LEHV6nWB2yk8pyo0adR*.7kCMdnj",
+		CoverPalette:        []string{"#102030", "#e0d0c0"},
+		Artist:              "The Artist feat. Guest",
+		ArtistCredits:       []ArtistCredit{{"The Artist", "artist-id", " feat. "}, {"Guest", "", ""}},
+		ArtistSortName:      "Artist, The feat. Guest",
+		AlbumSortName:       "Album, The",
+		AlbumArtistSortName: "Album Artist, The",
+		Title:               "The Title",
+		Album:               "The Album",
+		AlbumArtist:         "AlbumArtist",
+		Composer:            "Composer",
+		Conductor:           "Some Conductor",
+		Performer:           "Performer One, Performer Two",
+		DiscSubtitle:        "First Disc",
+		Genres:              []string{"Rock", "Électronique", "rock"},
+		Compilation:         true,
+		AlbumID:             "album-id",
+		RecordingID:         "recording-id",
+		Track:               13,
+		Disc:                2,
+		TotalTracks:         15,
+		TotalDiscs:          3,
+		Date:                time.Date(2022, 4, 10, 13, 24, 45, 0, time.UTC),
+		OriginalDate:        time.Date(1998, 1, 1, 0, 0, 0, 0, time.UTC),
+		ReleaseDate:         time.Date(2022, 4, 10, 0, 0, 0, 0, time.UTC),
+		Length:              154.3,
+		Segments:            []Segment{{"Intro", 0}, {"Verse", 12.5}},
+		BPM:                 128.5,
+		Key:                 "Ebm",
+		TrackGain:           -5.6,
+		AlbumGain:           -7.2,
+		PeakAmp:             1.1,
+		Loudness:            -9.5,
+		TruePeak:            0.3,
+		LeadingSilence:      0.25,
+		TrailingSilence:     1.5,
+		Rating:              3,
+		FirstStartTime:      t1,
+		LastStartTime:       t2,
+		NumPlays:            2,
+		NumSkips:            1,
+		RecentSkips:         []Skip{{StartTime: t1, Position: 12.5}},
+		Tags:                []string{"rock", "guitar", "rock"},
+		Notes:               "Great solo",
 	}
 
 	dst := Song{
@@ -76,23 +114,34 @@ func TestSong_Update(t *testing.T) {
 		FirstStartTime: t3,
 		LastStartTime:  t4,
 		NumPlays:       4,
+		NumSkips:       3,
 		Tags:           []string{"instrumental", "electronic", "instrumental"},
+		Notes:          "Needs replacing",
 	}
 
 	want := src
 
 	// Set some automatically-generated fields.
-	want.ArtistLower = "the artist"
+	want.ArtistLower = "the artist feat. guest"
+	want.ArtistsLower = []string{"guest", "the artist", "the artist feat. guest"} // sorted
 	want.TitleLower = "the title"
 	want.AlbumLower = "the album"
-	want.Keywords = []string{"album", "albumartist", "artist", "disc", "first", "the", "title"}
+	want.GenresLower = []string{"electronique", "rock"} // sort and dedupe
+	want.Keywords = []string{"album", "albumartist", "artist", "composer", "conductor",
+		"disc", "feat", "first", "guest", "needs", "one", "performer", "replacing", "some",
+		"the", "title", "two"}
+	want.KeywordPrefixes = KeywordPrefixes(want.Keywords)
+	want.KeywordVariants = KeywordVariants(want.Keywords)
 
 	// User data should also be preserved.
 	want.Rating = dst.Rating
 	want.FirstStartTime = dst.FirstStartTime
 	want.LastStartTime = dst.LastStartTime
 	want.NumPlays = dst.NumPlays
+	want.NumSkips = dst.NumSkips
+	want.RecentSkips = dst.RecentSkips
 	want.Tags = []string{"electronic", "instrumental"} // sort and dedupe
+	want.Notes = dst.Notes
 
 	if err := dst.Update(&src, false /* copyUserData */); err != nil {
 		t.Fatal("Update failed: ", err)
@@ -110,7 +159,15 @@ func TestSong_Update(t *testing.T) {
 	want.FirstStartTime = src.FirstStartTime
 	want.LastStartTime = src.LastStartTime
 	want.NumPlays = src.NumPlays
+	want.NumSkips = src.NumSkips
+	want.RecentSkips = src.RecentSkips
 	want.Tags = []string{"guitar", "rock"} // sort and dedupe
+	want.Notes = src.Notes
+	want.Keywords = []string{"album", "albumartist", "artist", "composer", "conductor",
+		"disc", "feat", "first", "great", "guest", "one", "performer", "solo", "some", "the",
+		"title", "two"}
+	want.KeywordPrefixes = KeywordPrefixes(want.Keywords)
+	want.KeywordVariants = KeywordVariants(want.Keywords)
 
 	if err := dst.Update(&src, true /* copyUserData */); err != nil {
 		t.Fatal("Update failed: ", err)
@@ -142,6 +199,83 @@ func TestSong_Clean(t *testing.T) {
 	}
 }
 
+func TestSong_AddRecentPlay(t *testing.T) {
+	t0 := time.Date(2022, 6, 5, 10, 15, 0, 0, time.UTC)
+	play := func(i int) Play { return NewPlay(t0.Add(time.Duration(i)*time.Minute), "1.2.3.4") }
+
+	s := Song{NumPlays: 3}
+	for _, i := range []int{3, 1, 2, 2} { // duplicate play should be ignored
+		s.AddRecentPlay(play(i))
+	}
+	if want := []Play{play(1), play(2), play(3)}; !reflect.DeepEqual(s.RecentPlays, want) {
+		t.Errorf("RecentPlays = %v; want %v", s.RecentPlays, want)
+	}
+	if !s.RecentPlaysValid() {
+		t.Error("RecentPlaysValid returned false after adding plays")
+	}
+
+	// Only the most recent plays should be kept.
+	var plays []Play
+	for i := 0; i < MaxRecentPlays+5; i++ {
+		plays = append(plays, play(i))
+	}
+	s.RebuildPlayStats(plays)
+	if want := plays[5:]; !reflect.DeepEqual(s.RecentPlays, want) {
+		t.Errorf("RecentPlays after rebuild = %v; want %v", s.RecentPlays, want)
+	}
+	if !s.RecentPlaysValid() {
+		t.Error("RecentPlaysValid returned false after rebuild")
+	} else if s.HasAllPlays() {
+		t.Error("HasAllPlays returned true after dropping plays")
+	}
+	s.AddRecentPlay(play(0)) // older than all plays, so should be ignored
+	if want := plays[5:]; !reflect.DeepEqual(s.RecentPlays, want) {
+		t.Errorf("RecentPlays after adding old play = %v; want %v", s.RecentPlays, want)
+	}
+
+	// Songs that were saved before RecentPlays was added should be detected.
+	old := Song{NumPlays: 2}
+	if old.RecentPlaysValid() {
+		t.Error("RecentPlaysValid returned true for unpopulated song")
+	}
+}
+
+func TestSong_AddSkip(t *testing.T) {
+	t0 := time.Date(2022, 6, 5, 10, 15, 0, 0, time.UTC)
+	skip := func(i int) Skip { return Skip{StartTime: t0.Add(time.Duration(i) * time.Minute), Position: 5} }
+
+	s := Song{NumPlays: 1}
+	if got := s.SkipRatio(); got != 0 {
+		t.Errorf("SkipRatio() = %v for unskipped song; want 0", got)
+	}
+	for _, i := range []int{3, 1, 2} {
+		if !s.AddSkip(skip(i)) {
+			t.Errorf("AddSkip(%v) returned false", i)
+		}
+	}
+	if s.AddSkip(skip(2)) {
+		t.Error("AddSkip returned true for duplicate skip")
+	}
+	if want := []Skip{skip(1), skip(2), skip(3)}; !reflect.DeepEqual(s.RecentSkips, want) {
+		t.Errorf("RecentSkips = %v; want %v", s.RecentSkips, want)
+	}
+	if s.NumSkips != 3 {
+		t.Errorf("NumSkips = %v; want 3", s.NumSkips)
+	}
+	if got, want := s.SkipRatio(), 0.75; got != want {
+		t.Errorf("SkipRatio() = %v; want %v", got, want)
+	}
+
+	for i := 4; i < MaxRecentSkips+5; i++ {
+		s.AddSkip(skip(i))
+	}
+	if n := len(s.RecentSkips); n != MaxRecentSkips {
+		t.Errorf("Got %v recent skips; want %v", n, MaxRecentSkips)
+	} else if want := skip(5); !reflect.DeepEqual(s.RecentSkips[0], want) {
+		t.Errorf("Oldest recent skip is %v; want %v", s.RecentSkips[0], want)
+	}
+}
+
 func TestNormalize(t *testing.T) {
 	for _, tc := range []struct {
 		in, want string
@@ -10,6 +10,18 @@ const (
 	StatsKind = "Stats"
 	// StatsKeyName is the Stats struct's key name for both Datastore and memcache.
 	StatsKeyName = "stats"
+
+	// IncompleteAlbumsKind is the Datastore kind for the list of IncompleteAlbum structs.
+	IncompleteAlbumsKind = "IncompleteAlbums"
+	// IncompleteAlbumsKeyName is the key name for the list of IncompleteAlbum structs for both
+	// Datastore and memcache.
+	IncompleteAlbumsKeyName = "incompleteAlbums"
+
+	// TagCooccurrenceKind is the Datastore kind for tag co-occurrence counts.
+	TagCooccurrenceKind = "TagCooccurrence"
+	// TagCooccurrenceKeyName is the key name for tag co-occurrence counts for both
+	// Datastore and memcache.
+	TagCooccurrenceKeyName = "tagCooccurrence"
 )
 
 // Stats summarizes information from the database.
@@ -24,12 +36,47 @@ type Stats struct {
 	// Ratings maps from a rating in [1, 5] (or 0 for unrated) to number of songs with that rating.
 	Ratings map[int]int `json:"ratings"`
 	// SongDecades maps from the year at the beginning of a decade (e.g. 1990) to the number of
-	// songs in the database with a Date field in the decade. 0 is used for songs with unset dates.
+	// songs in the database with an OriginalDate field (or Date field, if OriginalDate is unset)
+	// in the decade. 0 is used for songs with unset dates.
 	SongDecades map[int]int `json:"songDecades"`
+	// BPMs maps from the beginning of a 10-BPM range (e.g. 120 for [120, 130)) to the number of
+	// songs in the database with a BPM field in the range. Songs without BPMs are not included.
+	BPMs map[int]int `json:"bpms"`
 	// Tags maps from tag to number of songs with that tag.
 	Tags map[string]int `json:"tags"`
+	// Genres maps from normalized genre (i.e. Song.GenresLower) to number of songs with that genre.
+	Genres map[string]int `json:"genres"`
 	// Years maps from year (e.g. 2020) to stats about plays in that year.
 	Years map[int]PlayStats `json:"years"`
+	// UserYears maps from Play.User to year to stats about the user's plays in that year.
+	// Only the Plays and TotalSec fields are set. Plays without users are not included.
+	UserYears map[string]map[int]PlayStats `json:"userYears,omitempty"`
+	// TopArtists contains the artists whose songs have been played the most, by either play
+	// count or playtime, sorted by descending play count. The Album and AlbumID fields are unset.
+	TopArtists []PlayedItem `json:"topArtists"`
+	// TopAlbums is similar to TopArtists but describes albums. Songs without album IDs are
+	// grouped by artist and album name.
+	TopAlbums []PlayedItem `json:"topAlbums"`
+	// Hours contains the number of plays that started in each hour of the day
+	// (in the server's time zone).
+	Hours [24]int `json:"hours"`
+	// Weekdays contains the number of plays that started on each day of the week
+	// (in the server's time zone), starting with Sunday.
+	Weekdays [7]int `json:"weekdays"`
+	// Months maps from month as "YYYY-MM" (e.g. "2020-04") to stats about changes
+	// made to the library in that month.
+	Months map[string]ChangeStats `json:"months"`
+	// Transfers maps from Song.Filename to stats about the song's data being sent by /song.
+	// Songs in libraries other than the main library are keyed as "library:filename".
+	Transfers map[string]TransferStats `json:"transfers"`
+	// PresetUses maps from the querying user's name to SearchPreset.Name to stats about
+	// queries that used the preset. Only queries from the web interface are included.
+	PresetUses map[string]map[string]PresetStats `json:"presetUses,omitempty"`
+	// SchemaVersion is the current schema version of Song entities (see Song.SchemaVersion).
+	SchemaVersion int `json:"schemaVersion"`
+	// SchemaVersions maps from schema version to the number of songs using that version.
+	// It can be used to monitor the progress of migrations.
+	SchemaVersions map[int]int `json:"schemaVersions"`
 	// UpdateTime is the time at which these stats were generated.
 	UpdateTime time.Time `json:"updateTime"`
 }
@@ -37,10 +84,17 @@ type Stats struct {
 // NewStats returns a new Stats struct with all fields initialized to 0.
 func NewStats() *Stats {
 	return &Stats{
-		Ratings:     make(map[int]int),
-		SongDecades: make(map[int]int),
-		Tags:        make(map[string]int),
-		Years:       make(map[int]PlayStats),
+		Ratings:        make(map[int]int),
+		SongDecades:    make(map[int]int),
+		BPMs:           make(map[int]int),
+		Tags:           make(map[string]int),
+		Genres:         make(map[string]int),
+		SchemaVersions: make(map[int]int),
+		Years:          make(map[int]PlayStats),
+		UserYears:      make(map[string]map[int]PlayStats),
+		Months:         make(map[string]ChangeStats),
+		Transfers:      make(map[string]TransferStats),
+		PresetUses:     make(map[string]map[string]PresetStats),
 	}
 }
 
@@ -55,3 +109,68 @@ type PlayStats struct {
 	// LastPlays is the number of songs that were last played in the interval.
 	LastPlays int `json:"lastPlays"`
 }
+
+// ChangeStats summarizes changes made to the library in a time interval.
+type ChangeStats struct {
+	// Added is the number of songs that were added.
+	// Songs added before Song.CreatedTime was introduced are not counted.
+	Added int `json:"added"`
+	// Deleted is the number of songs that were deleted.
+	Deleted int `json:"deleted"`
+	// Retagged is the number of times that songs' tags were changed.
+	Retagged int `json:"retagged"`
+	// Rerated is the number of times that songs' ratings were changed.
+	Rerated int `json:"rerated"`
+}
+
+// TransferStats summarizes requests for a song's data.
+type TransferStats struct {
+	// Starts is the number of requests for the beginning of the song's data, i.e. requests
+	// without Range headers or with ranges starting at the first byte. Browsers typically
+	// send additional range requests while buffering or seeking, so this approximates the
+	// number of times that the song was streamed.
+	Starts int `json:"starts"`
+	// Full is the number of requests that transferred the song's entire data.
+	Full int `json:"full"`
+	// Partial is the number of requests that transferred only part of the song's data.
+	Partial int `json:"partial"`
+	// Bytes is the total number of bytes transferred.
+	Bytes int64 `json:"bytes"`
+}
+
+// PlayedItem summarizes plays of an artist's or album's songs.
+type PlayedItem struct {
+	// Artist contains the artist's name (or the album's artist).
+	Artist string `json:"artist"`
+	// Album contains the album's name.
+	Album string `json:"album,omitempty"`
+	// AlbumID contains the album's MusicBrainz ID, if known.
+	AlbumID string `json:"albumId,omitempty"`
+	// Plays is the number of plays.
+	Plays int `json:"plays"`
+	// TotalSec is the total duration in seconds of played songs.
+	TotalSec float64 `json:"totalSec"`
+}
+
+// PresetStats summarizes a user's queries using a search preset.
+type PresetStats struct {
+	// Queries is the number of queries that used the preset.
+	Queries int `json:"queries"`
+	// LastTime is the time of the most recent query that used the preset.
+	LastTime time.Time `json:"lastTime"`
+}
+
+// IncompleteAlbum describes an album that is missing one or more tracks.
+// Only albums containing songs with TotalTracks values are checked.
+type IncompleteAlbum struct {
+	// AlbumID is the album's Song.AlbumID value.
+	AlbumID string `json:"albumId"`
+	// Library is the album's Song.Library value.
+	Library string `json:"library,omitempty"`
+	// SongIDs contains the IDs of the album's songs in ascending order.
+	SongIDs []int64 `json:"songIds"`
+	// Missing describes the missing tracks as "disc-track" strings, e.g. "1-3".
+	// Discs that are entirely missing and whose track counts are unknown are
+	// described by just their disc numbers.
+	Missing []string `json:"missing"`
+}
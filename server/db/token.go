@@ -0,0 +1,38 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package db
+
+import "time"
+
+// APITokenKind is the APIToken struct's Datastore kind.
+// Entities are keyed by the hex-encoded SHA-256 hash of the token.
+const APITokenKind = "APIToken"
+
+// TokenScope describes the requests that an APIToken can be used to authorize.
+type TokenScope string
+
+const (
+	// ReadScope permits read-only requests to endpoints that accept GET requests.
+	ReadScope TokenScope = "read"
+	// UpdateScope permits requests to endpoints that aren't limited to admin users,
+	// e.g. /rate_and_tag and /played.
+	UpdateScope TokenScope = "update"
+	// AdminScope permits all requests that the token's user is allowed to make.
+	AdminScope TokenScope = "admin"
+)
+
+// APIToken describes a token that can be passed in an "Authorization: Bearer" header
+// instead of user credentials. The token itself is not stored.
+type APIToken struct {
+	// ID contains the entity's key name from Datastore.
+	ID string `datastore:"-" json:"id"`
+	// User contains the username (or email address) of the user that the token acts as.
+	User string `json:"user"`
+	// Scope limits the requests that the token can authorize.
+	Scope TokenScope `datastore:",noindex" json:"scope"`
+	// Desc contains an optional human-readable description of the token.
+	Desc string `datastore:",noindex" json:"desc,omitempty"`
+	// Created is the time at which the token was created.
+	Created time.Time `json:"created"`
+}
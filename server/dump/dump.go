@@ -13,6 +13,7 @@ import (
 	"time"
 
 	"github.com/derat/nup/server/db"
+	"google.golang.org/appengine/v2"
 	"google.golang.org/appengine/v2/datastore"
 )
 
@@ -55,7 +56,9 @@ func Songs(ctx context.Context, max int64, cursor string, deleted bool, minLastM
 // Plays returns plays from datastore.
 // max contains the maximum number of plays to return in this call.
 // If cursor is non-empty, it is used to resume an already-started query.
-func Plays(ctx context.Context, max int64, cursor string) (
+// minStartTime specifies a minimum start time for returned plays.
+// minReportTime specifies a minimum report time; if non-zero, minStartTime is ignored.
+func Plays(ctx context.Context, max int64, cursor string, minStartTime, minReportTime time.Time) (
 	plays []db.PlayDump, nextCursor string, err error) {
 	plays = make([]db.PlayDump, max)
 	playPtrs := make([]*db.Play, max)
@@ -63,8 +66,16 @@ func Plays(ctx context.Context, max int64, cursor string) (
 		playPtrs[i] = &plays[i].Play
 	}
 
-	_, pids, nextCursor, err := getEntities(
-		ctx, datastore.NewQuery(db.PlayKind).Order(keyProperty), cursor, playPtrs)
+	query := datastore.NewQuery(db.PlayKind)
+	switch {
+	case !minReportTime.IsZero():
+		query = query.Filter("ReportTime >= ", minReportTime)
+	case !minStartTime.IsZero():
+		query = query.Filter("StartTime >= ", minStartTime)
+	default:
+		query = query.Order(keyProperty)
+	}
+	_, pids, nextCursor, err := getEntities(ctx, query, cursor, playPtrs)
 	if err != nil {
 		return nil, "", err
 	}
@@ -76,6 +87,126 @@ func Plays(ctx context.Context, max int64, cursor string) (
 	return plays, nextCursor, nil
 }
 
+// HistoryPlay describes a single play returned by PlayHistory.
+type HistoryPlay struct {
+	// Song contains the played song's metadata and user data. Plays is unset.
+	Song db.Song `json:"song"`
+	// StartTime is the time at which playback started.
+	StartTime time.Time `json:"startTime"`
+}
+
+// PlayHistory returns plays from datastore in descending order by start time.
+// max specifies the maximum number of plays to return in this call.
+// cursor contains an optional cursor for continuing an earlier request.
+// If user is non-empty, only plays reported by the specified user are returned.
+// If songID is non-zero, only the specified song's plays are returned.
+// If minStartTime or maxStartTime are non-zero, only plays starting within
+// [minStartTime, maxStartTime) are returned.
+// Plays belonging to songs that no longer exist are omitted.
+func PlayHistory(ctx context.Context, max int64, cursor, user string, songID int64,
+	minStartTime, maxStartTime time.Time) (plays []HistoryPlay, nextCursor string, err error) {
+	query := datastore.NewQuery(db.PlayKind).Order("-StartTime")
+	if user != "" {
+		query = query.Filter("User =", user)
+	}
+	if songID != 0 {
+		query = query.Ancestor(datastore.NewKey(ctx, db.SongKind, "", songID, nil))
+	}
+	if !minStartTime.IsZero() {
+		query = query.Filter("StartTime >= ", minStartTime)
+	}
+	if !maxStartTime.IsZero() {
+		query = query.Filter("StartTime < ", maxStartTime)
+	}
+
+	dps := make([]db.Play, max)
+	_, sids, nextCursor, err := getEntities(ctx, query, cursor, dps)
+	if err != nil {
+		return nil, "", err
+	}
+
+	// Load each distinct song once.
+	songs := make(map[int64]*db.Song)
+	var keys []*datastore.Key
+	for _, sid := range sids {
+		if _, ok := songs[sid]; !ok {
+			songs[sid] = nil
+			keys = append(keys, datastore.NewKey(ctx, db.SongKind, "", sid, nil))
+		}
+	}
+	if len(keys) > 0 {
+		loaded := make([]db.Song, len(keys))
+		err := datastore.GetMulti(ctx, keys, loaded)
+		merr, _ := err.(appengine.MultiError)
+		if err != nil && merr == nil {
+			return nil, "", fmt.Errorf("failed to get %v songs: %v", len(keys), err)
+		}
+		for i, k := range keys {
+			if merr != nil && merr[i] != nil {
+				if merr[i] == datastore.ErrNoSuchEntity {
+					continue
+				}
+				return nil, "", fmt.Errorf("failed to get song %v: %v", k.IntID(), merr[i])
+			}
+			s := &loaded[i]
+			s.SongID = strconv.FormatInt(k.IntID(), 10)
+			s.Plays = nil
+			songs[k.IntID()] = s
+		}
+	}
+
+	plays = make([]HistoryPlay, 0, len(sids))
+	for i, sid := range sids {
+		if s := songs[sid]; s != nil {
+			plays = append(plays, HistoryPlay{Song: *s, StartTime: dps[i].StartTime})
+		}
+	}
+	return plays, nextCursor, nil
+}
+
+// CoverFilenames returns distinct non-empty Song.CoverFilename values from datastore.
+// max specifies the maximum number of filenames to return in this call.
+// cursor contains an optional cursor for continuing an earlier request.
+// Only songs in library (see db.Song.Library) are examined.
+// Songs are scanned in key order, so a filename that was returned by an earlier
+// call may be returned again if it is shared by songs in different batches.
+func CoverFilenames(ctx context.Context, max int64, cursor, library string) (
+	filenames []string, nextCursor string, err error) {
+	q := datastore.NewQuery(db.SongKind).Order(keyProperty)
+	if len(cursor) > 0 {
+		dc, err := datastore.DecodeCursor(cursor)
+		if err != nil {
+			return nil, "", fmt.Errorf("unable to decode cursor %q: %v", cursor, err)
+		}
+		q = q.Start(dc)
+	}
+	it := q.Run(ctx)
+
+	seen := make(map[string]struct{})
+	for int64(len(filenames)) < max {
+		var s db.Song
+		if _, err := it.Next(&s); err == datastore.Done {
+			return filenames, "", nil
+		} else if err != nil {
+			return nil, "", err
+		}
+		if s.CoverFilename == "" || s.Library != library {
+			continue
+		}
+		if _, ok := seen[s.CoverFilename]; ok {
+			continue
+		}
+		seen[s.CoverFilename] = struct{}{}
+		filenames = append(filenames, s.CoverFilename)
+	}
+
+	nc, err := it.Cursor()
+	if err != nil {
+		return nil, "", fmt.Errorf("unable to get cursor: %v", err)
+	}
+	return filenames, nc.String(), nil
+}
+
 // SingleSong returns the song identified by id.
 func SingleSong(ctx context.Context, id int64) (*db.Song, error) {
 	sk := datastore.NewKey(ctx, db.SongKind, "", id, nil)
@@ -85,6 +216,12 @@ func SingleSong(ctx context.Context, id int64) (*db.Song, error) {
 	}
 	s.SongID = strconv.FormatInt(id, 10)
 
+	// Avoid querying Play entities if the song's recent plays contain all of its plays.
+	if s.HasAllPlays() {
+		s.Plays = append([]db.Play{}, s.RecentPlays...)
+		return s, nil
+	}
+
 	s.Plays = make([]db.Play, maxPlaysForSongDump)
 	pids, _, _, err := getEntities(ctx, datastore.NewQuery(db.PlayKind).Ancestor(sk), "", s.Plays)
 	if err != nil {
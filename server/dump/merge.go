@@ -0,0 +1,116 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package dump
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/derat/nup/server/db"
+)
+
+const mergeCandidatesBatchSize = 1000
+
+// MergeCandidates scans all songs in datastore and returns groups of songs that appear to be
+// the same recording but have differing user data (ratings, tags, or play history), e.g.
+// because a song file was replaced by a new version with different audio data.
+//
+// Songs with MusicBrainz recording IDs are grouped by them. Other songs are grouped by
+// their normalized artists, albums, and titles.
+//
+// Groups are sorted by artist, title, and album, and songs within each group are sorted by ID.
+func MergeCandidates(ctx context.Context) ([][]db.Song, error) {
+	var songs []db.Song
+	var cursor string
+	for {
+		batch, nextCursor, err := Songs(ctx, mergeCandidatesBatchSize, cursor, false, time.Time{})
+		if err != nil {
+			return nil, err
+		}
+		songs = append(songs, batch...)
+		if cursor = nextCursor; cursor == "" {
+			break
+		}
+	}
+	return findMergeCandidates(songs), nil
+}
+
+// findMergeCandidates implements MergeCandidates's grouping logic.
+func findMergeCandidates(songs []db.Song) [][]db.Song {
+	type songKey struct{ recordingID, artist, album, title string }
+	groups := make(map[songKey][]db.Song)
+	var keys []songKey
+	for _, s := range songs {
+		k := songKey{recordingID: s.RecordingID}
+		if k.recordingID == "" {
+			if s.ArtistLower == "" || s.TitleLower == "" {
+				continue
+			}
+			k = songKey{artist: s.ArtistLower, album: s.AlbumLower, title: s.TitleLower}
+		}
+		if _, ok := groups[k]; !ok {
+			keys = append(keys, k)
+		}
+		groups[k] = append(groups[k], s)
+	}
+
+	res := make([][]db.Song, 0)
+	for _, k := range keys {
+		group := groups[k]
+		if len(group) < 2 || !userDataDiffers(group) {
+			continue
+		}
+		sort.Slice(group, func(i, j int) bool {
+			a, _ := strconv.ParseInt(group[i].SongID, 10, 64)
+			b, _ := strconv.ParseInt(group[j].SongID, 10, 64)
+			return a < b
+		})
+		res = append(res, group)
+	}
+	// Songs grouped by recording ID may have differing metadata, so use each group's first song.
+	sort.SliceStable(res, func(i, j int) bool {
+		a, b := &res[i][0], &res[j][0]
+		if a.ArtistLower != b.ArtistLower {
+			return a.ArtistLower < b.ArtistLower
+		}
+		if a.TitleLower != b.TitleLower {
+			return a.TitleLower < b.TitleLower
+		}
+		if a.AlbumLower != b.AlbumLower {
+			return a.AlbumLower < b.AlbumLower
+		}
+		return a.RecordingID < b.RecordingID
+	})
+	return res
+}
+
+// userDataDiffers returns true if the supplied songs don't all have the same user data.
+func userDataDiffers(songs []db.Song) bool {
+	first := &songs[0]
+	for i := 1; i < len(songs); i++ {
+		s := &songs[i]
+		if s.Rating != first.Rating || s.NumPlays != first.NumPlays ||
+			!s.FirstStartTime.Equal(first.FirstStartTime) ||
+			!s.LastStartTime.Equal(first.LastStartTime) ||
+			!tagsEqual(s.Tags, first.Tags) {
+			return true
+		}
+	}
+	return false
+}
+
+// tagsEqual returns true if a and b contain the same tags in the same order.
+func tagsEqual(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
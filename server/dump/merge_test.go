@@ -0,0 +1,71 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package dump
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/derat/nup/server/db"
+)
+
+func TestFindMergeCandidates(t *testing.T) {
+	mk := func(id, artist, title string, rating, plays int, tags ...string) db.Song {
+		return db.Song{SongID: id, ArtistLower: artist, TitleLower: title,
+			Rating: rating, NumPlays: plays, Tags: tags}
+	}
+	songs := []db.Song{
+		mk("10", "b", "song", 4, 2, "rock"),
+		mk("2", "a", "song", 3, 0),
+		mk("3", "a", "song", 0, 5),
+		mk("4", "a", "other", 0, 0),
+		mk("5", "b", "song", 4, 2, "rock"),
+		mk("6", "c", "song", 1, 1, "jazz"),
+		mk("7", "c", "song", 1, 1),
+		mk("8", "", "", 1, 0),
+		mk("9", "", "", 2, 0),
+	}
+	var got [][]string
+	for _, group := range findMergeCandidates(songs) {
+		var ids []string
+		for _, s := range group {
+			ids = append(ids, s.SongID)
+		}
+		got = append(got, ids)
+	}
+	// Songs 10 and 5 have identical user data, and songs without artists and titles are skipped.
+	if want := [][]string{{"2", "3"}, {"6", "7"}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("findMergeCandidates() = %v; want %v", got, want)
+	}
+}
+
+func TestFindMergeCandidates_RecordingAndAlbum(t *testing.T) {
+	mk := func(id, rec, artist, album, title string, rating int) db.Song {
+		return db.Song{SongID: id, RecordingID: rec, ArtistLower: artist, AlbumLower: album,
+			TitleLower: title, Rating: rating}
+	}
+	songs := []db.Song{
+		// Songs with the same recording ID should be grouped even if their metadata differs.
+		mk("1", "rec-a", "artist", "album", "song", 4),
+		mk("2", "rec-a", "artist", "album", "song (remastered)", 0),
+		// Songs with different recording IDs shouldn't be grouped.
+		mk("3", "rec-b", "artist", "other album", "other song", 1),
+		mk("4", "rec-c", "artist", "other album", "other song", 2),
+		// Songs without recording IDs should only be grouped if their albums match.
+		mk("5", "", "artist", "live", "tune", 3),
+		mk("6", "", "artist", "live", "tune", 5),
+		mk("7", "", "artist", "studio", "tune", 1),
+	}
+	var got [][]string
+	for _, group := range findMergeCandidates(songs) {
+		var ids []string
+		for _, s := range group {
+			ids = append(ids, s.SongID)
+		}
+		got = append(got, ids)
+	}
+	if want := [][]string{{"1", "2"}, {"5", "6"}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("findMergeCandidates() = %v; want %v", got, want)
+	}
+}
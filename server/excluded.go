@@ -0,0 +1,44 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package main
+
+import (
+	"net/http"
+
+	"github.com/derat/nup/server/config"
+	"github.com/derat/nup/server/db"
+)
+
+// tagSet contains tags that should be hidden from a user (see config.User.ExcludedTags).
+type tagSet map[string]struct{}
+
+// getExcludedTags returns the tags that should be hidden from the user making r.
+// Nil is returned if no tags are excluded.
+func getExcludedTags(cfg *config.Config, r *http.Request) tagSet {
+	user, _ := cfg.GetUser(r)
+	if user == nil || len(user.ExcludedTags) == 0 {
+		return nil
+	}
+	ts := make(tagSet, len(user.ExcludedTags))
+	for _, t := range user.ExcludedTags {
+		ts[t] = struct{}{}
+	}
+	return ts
+}
+
+// has returns true if tag is in ts.
+func (ts tagSet) has(tag string) bool {
+	_, ok := ts[tag]
+	return ok
+}
+
+// hides returns true if s should be hidden since it has one or more tags from ts.
+func (ts tagSet) hides(s *db.Song) bool {
+	for _, t := range s.Tags {
+		if ts.has(t) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,96 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/derat/nup/server/config"
+	"github.com/derat/nup/server/db"
+	"github.com/derat/nup/server/storage"
+
+	"google.golang.org/appengine/v2"
+	"google.golang.org/appengine/v2/datastore"
+	"google.golang.org/appengine/v2/log"
+)
+
+// addProbeHandler registers fn to handle unauthenticated GET requests to path from uptime
+// checks. Unlike addHandler, the config isn't loaded before fn is called, so probes still
+// work if the config is missing or broken.
+func addProbeHandler(path string, fn func(ctx context.Context, w http.ResponseWriter, r *http.Request)) {
+	http.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", http.MethodGet)
+			http.Error(w, "Invalid method", http.StatusMethodNotAllowed)
+			return
+		}
+		// Probes shouldn't be cached by intermediate caches.
+		w.Header().Set("Cache-Control", "no-store")
+		fn(appengine.NewContext(r), w, r)
+	})
+}
+
+func handleHealthz(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	writeTextResponse(w, "ok")
+}
+
+// readyCheck describes the status of one of the server's dependencies.
+type readyCheck struct {
+	OK bool `json:"ok"`
+	// Error describes the failure. It's only included for admin users, since it
+	// may contain e.g. bucket names.
+	Error string `json:"error,omitempty"`
+}
+
+// readyStatus is returned by /readyz.
+type readyStatus struct {
+	OK     bool                  `json:"ok"`     // true if all checks passed
+	Checks map[string]readyCheck `json:"checks"` // keyed by dependency name
+}
+
+func handleReadyz(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	st := readyStatus{OK: true, Checks: make(map[string]readyCheck)}
+	errs := make(map[string]error)
+	check := func(name string, err error) {
+		st.Checks[name] = readyCheck{OK: err == nil}
+		if err != nil {
+			log.Errorf(ctx, "Readiness check %q failed: %v", name, err)
+			st.OK = false
+			errs[name] = err
+		}
+	}
+
+	cfg, err := getConfig(ctx)
+	check("config", err)
+	_, err = datastore.NewQuery(db.SongKind).KeysOnly().Limit(1).GetAll(ctx, nil)
+	check("datastore", err)
+	if cfg != nil {
+		if cfg.SongBucket != "" {
+			check("songBucket", storage.CheckBucket(ctx, cfg.SongBucket))
+		}
+		if cfg.CoverBucket != "" {
+			check("coverBucket", storage.CheckBucket(ctx, cfg.CoverBucket))
+		}
+	}
+
+	if cfg != nil {
+		if utype, _ := cfg.GetUserType(r); utype == config.AdminUser {
+			for name, err := range errs {
+				st.Checks[name] = readyCheck{OK: false, Error: err.Error()}
+			}
+		}
+	}
+	b, err := json.Marshal(st)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if !st.OK {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	w.Write(b)
+}
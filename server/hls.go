@@ -0,0 +1,70 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+)
+
+const (
+	// hlsFormat is the /song "format" parameter value used to request an HLS playlist.
+	hlsFormat = "hls"
+	// hlsSegmentSec is the approximate duration in seconds of segments in HLS playlists.
+	hlsSegmentSec = 10
+)
+
+// hlsSegment describes a range of MP3 frames listed in an HLS playlist.
+type hlsSegment struct {
+	off  int64   // byte offset of first frame
+	size int64   // size in bytes
+	dur  float64 // duration in seconds
+}
+
+// getHLSSegments divides the frames in the MP3 data in r into segments
+// that are each at least segSec seconds long (except for the last one).
+func getHLSSegments(r io.Reader, segSec float64) ([]hlsSegment, error) {
+	var segs []hlsSegment
+	if _, _, err := walkFrames(r, func(off int64, size int, pos, dur float64) bool {
+		if len(segs) == 0 || segs[len(segs)-1].dur >= segSec {
+			segs = append(segs, hlsSegment{off: off})
+		}
+		seg := &segs[len(segs)-1]
+		seg.size += int64(size)
+		seg.dur += dur
+		return true
+	}); err != nil {
+		return nil, err
+	}
+	if len(segs) == 0 {
+		return nil, errors.New("no audio frames")
+	}
+	return segs, nil
+}
+
+// makeHLSPlaylist returns an HLS media playlist listing byte ranges of segs within uri.
+// MP3 data can be used directly as HLS "packed audio" segments, so no re-encoding is needed.
+func makeHLSPlaylist(segs []hlsSegment, uri string) string {
+	var maxDur float64
+	for _, seg := range segs {
+		maxDur = math.Max(maxDur, seg.dur)
+	}
+
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n")
+	b.WriteString("#EXT-X-VERSION:4\n") // needed for EXT-X-BYTERANGE
+	fmt.Fprintf(&b, "#EXT-X-TARGETDURATION:%d\n", int(math.Ceil(maxDur)))
+	b.WriteString("#EXT-X-MEDIA-SEQUENCE:0\n")
+	b.WriteString("#EXT-X-PLAYLIST-TYPE:VOD\n")
+	for _, seg := range segs {
+		fmt.Fprintf(&b, "#EXTINF:%.3f,\n", seg.dur)
+		fmt.Fprintf(&b, "#EXT-X-BYTERANGE:%d@%d\n", seg.size, seg.off)
+		b.WriteString(uri + "\n")
+	}
+	b.WriteString("#EXT-X-ENDLIST\n")
+	return b.String()
+}
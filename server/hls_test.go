@@ -0,0 +1,57 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestGetHLSSegments(t *testing.T) {
+	// Each 10-second segment should contain 383 frames (i.e. 10.005 seconds).
+	const numFrames = 1000
+	segs, err := getHLSSegments(bytes.NewReader(makeTestMP3(numFrames)), 10)
+	if err != nil {
+		t.Fatal("getHLSSegments failed:", err)
+	}
+	want := []hlsSegment{
+		{testTagSize, 383 * testFrameSize, 383 * testFrameDur},
+		{testTagSize + 383*testFrameSize, 383 * testFrameSize, 383 * testFrameDur},
+		{testTagSize + 766*testFrameSize, 234 * testFrameSize, 234 * testFrameDur},
+	}
+	if len(segs) != len(want) {
+		t.Fatalf("getHLSSegments returned %+v; want %+v", segs, want)
+	}
+	for i := range segs {
+		// Avoid floating-point errors from summing frame durations.
+		if got := segs[i]; got.off != want[i].off || got.size != want[i].size ||
+			got.dur < want[i].dur-0.001 || got.dur > want[i].dur+0.001 {
+			t.Errorf("Segment %d is %+v; want %+v", i, got, want[i])
+		}
+	}
+
+	if _, err := getHLSSegments(bytes.NewReader([]byte("not an mp3")), 10); err == nil {
+		t.Error("getHLSSegments unexpectedly succeeded for non-MP3 data")
+	}
+}
+
+func TestMakeHLSPlaylist(t *testing.T) {
+	segs := []hlsSegment{{20, 1000, 10.005}, {1020, 500, 4.5}}
+	got := makeHLSPlaylist(segs, "/song?filename=a.mp3")
+	want := "#EXTM3U\n" +
+		"#EXT-X-VERSION:4\n" +
+		"#EXT-X-TARGETDURATION:11\n" +
+		"#EXT-X-MEDIA-SEQUENCE:0\n" +
+		"#EXT-X-PLAYLIST-TYPE:VOD\n" +
+		"#EXTINF:10.005,\n" +
+		"#EXT-X-BYTERANGE:1000@20\n" +
+		"/song?filename=a.mp3\n" +
+		"#EXTINF:4.500,\n" +
+		"#EXT-X-BYTERANGE:500@1020\n" +
+		"/song?filename=a.mp3\n" +
+		"#EXT-X-ENDLIST\n"
+	if got != want {
+		t.Errorf("makeHLSPlaylist returned:\n%s\nwant:\n%s", got, want)
+	}
+}
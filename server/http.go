@@ -5,33 +5,96 @@ package main
 
 import (
 	"context"
+	"crypto/sha1"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
 	"net/http"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/derat/nup/server/apitoken"
+	"github.com/derat/nup/server/cache"
 	"github.com/derat/nup/server/config"
+	"github.com/derat/nup/server/db"
+	"github.com/derat/nup/server/metrics"
+	"github.com/derat/nup/server/pin"
+	"github.com/derat/nup/server/ratelimit"
+	"github.com/derat/nup/server/share"
 
 	"google.golang.org/appengine/v2"
 	"google.golang.org/appengine/v2/log"
 	"google.golang.org/appengine/v2/user"
 )
 
+// configReloadInterval is the maximum time that a loaded config is used before it's
+// reloaded from datastore. Changes made via /server_config are picked up sooner via instanceGen,
+// so this just handles other updates (e.g. from "nup config -set") and memcache evictions.
+const configReloadInterval = 5 * time.Minute
+
 var loadedCfg *config.Config  // previously-loaded config
-var loadedCfgMutex sync.Mutex // guards loadedCfg
+var loadedCfgTime time.Time   // time at which loadedCfg was loaded
+var loadedCfgMutex sync.Mutex // guards loadedCfg and loadedCfgTime
+
+// instanceGen is bumped by /invalidate_caches to make all instances drop their in-memory caches.
+var instanceGen = cache.NewGeneration("instance_generation")
+
+func init() {
+	instanceGen.OnChange(clearInstanceCaches)
+}
+
+// clearInstanceCaches clears in-memory caches that may hold stale data,
+// e.g. after the config has been updated in datastore.
+func clearInstanceCaches() {
+	loadedCfgMutex.Lock()
+	loadedCfg = nil
+	loadedCfgMutex.Unlock()
+
+	setSongData("", nil, time.Time{})
+	clearStaticFileCaches()
+}
+
+// clearStaticFileCaches clears in-memory caches of processed static files,
+// which depend on the config.
+func clearStaticFileCaches() {
+	for _, m := range []*sync.Map{&staticFiles, &staticFileETags} {
+		m.Range(func(k, _ interface{}) bool {
+			m.Delete(k)
+			return true
+		})
+	}
+}
 
 // getConfig returns the server's configuration, loading it if necessary.
+// The config is periodically reloaded from datastore. If reloading fails,
+// the previously-loaded config continues to be used.
 func getConfig(ctx context.Context) (*config.Config, error) {
 	loadedCfgMutex.Lock()
 	defer loadedCfgMutex.Unlock()
 
-	if loadedCfg != nil {
+	if loadedCfg != nil && time.Since(loadedCfgTime) < configReloadInterval {
 		return loadedCfg, nil
 	}
-	var err error
-	loadedCfg, err = config.Load(ctx)
-	return loadedCfg, err
+	cfg, err := config.Load(ctx)
+	if err != nil {
+		if loadedCfg == nil {
+			return nil, err
+		}
+		log.Errorf(ctx, "Reloading config failed: %v", err)
+		loadedCfgTime = time.Now() // don't retry on every request
+		return loadedCfg, nil
+	}
+	if loadedCfg != nil && cfg.Version != loadedCfg.Version {
+		log.Infof(ctx, "Reloaded config version %v (was %v)", cfg.Version, loadedCfg.Version)
+		clearStaticFileCaches()
+	}
+	loadedCfg = cfg
+	loadedCfgTime = time.Now()
+	return loadedCfg, nil
 }
 
 // writeJSONResponse serializes v to JSON and writes it to w.
@@ -45,6 +108,73 @@ func writeJSONResponse(w http.ResponseWriter, v interface{}) {
 	}
 }
 
+// writeJSONResponseWithETag is like writeJSONResponse, but it also sets an ETag header
+// containing a hash of the serialized data. If r's If-None-Match header matches the ETag,
+// 304 Not Modified is written instead so that clients can cheaply revalidate old responses.
+// Handlers that can identify their response without generating it should use
+// checkETag instead.
+func writeJSONResponseWithETag(w http.ResponseWriter, r *http.Request, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	sum := sha1.Sum(b)
+	if checkETag(w, r, fmt.Sprintf(`"%s"`, hex.EncodeToString(sum[:]))) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+// checkETag sets w's ETag header to etag. If r's If-None-Match header matches etag,
+// 304 Not Modified is written and true is returned, in which case the caller should
+// not write a body.
+func checkETag(w http.ResponseWriter, r *http.Request, etag string) bool {
+	w.Header().Set("ETag", etag)
+	// Responses can depend on the user, and clients should always revalidate them.
+	w.Header().Set("Cache-Control", "private, no-cache")
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return true
+	}
+	return false
+}
+
+// etagMatches returns true if header, an If-None-Match header value, matches etag.
+// Weak comparison is used as described in RFC 7232.
+func etagMatches(header, etag string) bool {
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, v := range strings.Split(header, ",") {
+		v = strings.TrimSpace(v)
+		if v == "*" || strings.TrimPrefix(v, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// acceptsMediaType returns true if header, an Accept header value, explicitly lists
+// mediaType (e.g. "image/avif") with a non-zero quality value. Wildcards like "image/*"
+// are ignored, since clients send them even for types that they can't handle.
+func acceptsMediaType(header, mediaType string) bool {
+	for _, v := range strings.Split(header, ",") {
+		parts := strings.Split(v, ";")
+		if !strings.EqualFold(strings.TrimSpace(parts[0]), mediaType) {
+			continue
+		}
+		for _, p := range parts[1:] {
+			if p = strings.TrimSpace(p); strings.HasPrefix(p, "q=") {
+				if q, err := strconv.ParseFloat(p[2:], 64); err != nil || q <= 0 {
+					return false
+				}
+			}
+		}
+		return true
+	}
+	return false
+}
+
 // writeTextResponse writes s to w as a text response.
 func writeTextResponse(w http.ResponseWriter, s string) {
 	w.Header().Set("Content-Type", "text/plain; charset=UTF-8")
@@ -60,24 +190,93 @@ const (
 	allowUnauth                      // allow unauthorized access
 )
 
+// getOrPost can be passed to addHandler for read-only endpoints that also accept POST
+// requests so that clients can send parameters that are too large for URLs.
+const getOrPost = http.MethodGet + ", " + http.MethodPost
+
+// methodAllowed returns true if method is listed in allowed, a comma-separated list of
+// HTTP methods as passed to addHandler.
+func methodAllowed(allowed, method string) bool {
+	for _, m := range strings.Split(allowed, ",") {
+		if strings.TrimSpace(m) == method {
+			return true
+		}
+	}
+	return false
+}
+
+// mirrorPostPaths contains the paths of POST endpoints that are still handled when the server
+// is configured as a read-only mirror. Other POST and PUT requests are rejected.
+var mirrorPostPaths = map[string]bool{
+	"/clear":         true,
+	"/config":        true,
+	"/flush_cache":   true,
+	"/reindex":       true,
+	"/server_config": true,
+	"/songs_by_id":   true,
+}
+
 // handlerFunc handles HTTP requests to a single endpoint.
 type handlerFunc func(ctx context.Context, cfg *config.Config, w http.ResponseWriter, r *http.Request)
 
 // addHandler registers fn to handle HTTP requests to the specified path.
 // Requests are verified to meet authorization requirements and use
-// the specified HTTP method before they are passed to fn.
+// the specified HTTP method (or one of a comma-separated list of methods)
+// before they are passed to fn.
 func addHandler(path, method string, allowed config.UserType, action authAction, fn handlerFunc) {
 	http.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
-		ctx := appengine.NewContext(r)
-		cfg, err := getConfig(ctx)
-		if err != nil {
+		start := time.Now()
+		ctx := metrics.CountDatastoreCalls(appengine.NewContext(r))
+		reqID := newRequestID(ctx)
+		w.Header().Set(requestIDHeader, reqID)
+		cw := &countingResponseWriter{ResponseWriter: w}
+		w = cw
+
+		var cfg *config.Config
+		defer func() {
+			writeErrorRequestID(cw, r, reqID)
+			code := cw.code
+			if code == 0 {
+				code = http.StatusOK
+			}
+			dur := time.Since(start)
+			var username string
+			if cfg != nil {
+				_, username = cfg.GetUserType(r)
+			}
+			logRequest(r, reqID, username, code, dur)
+			metrics.Add(metrics.Requests, metrics.Labels{"handler": path, "code": strconv.Itoa(code)}, 1)
+			metrics.Observe(metrics.RequestDuration, metrics.Labels{"handler": path}, dur)
+			if err := metrics.Flush(ctx, false); err != nil {
+				log.Errorf(ctx, "Failed flushing metrics: %v", err)
+			}
+		}()
+
+		if err := instanceGen.Check(ctx); err != nil {
+			log.Errorf(ctx, "Failed checking cache generation: %v", err)
+		}
+		var err error
+		if cfg, err = getConfig(ctx); err != nil {
 			log.Criticalf(ctx, "Failed getting config: %v", err)
 			http.Error(w, "Failed getting config", http.StatusInternalServerError)
 			return
 		}
 
+		if token := apitoken.FromRequest(r); token != "" {
+			var ok bool
+			if r, ok = authorizeToken(ctx, w, r, token); !ok {
+				return
+			}
+		}
+
 		if action != allowUnauth {
-			if utype, username := cfg.GetUserType(r); allowed&utype == 0 {
+			utype, username := cfg.GetUserType(r)
+			if utype == 0 && accessPaths[path] && r.FormValue(share.AccessParam) != "" {
+				// Unauthenticated requests can pass access tokens to some read-only endpoints.
+				if !checkAccess(ctx, cfg, w, r, path) {
+					return
+				}
+			} else if allowed&utype == 0 {
 				switch action {
 				case rejectUnauth:
 					code := http.StatusUnauthorized // no creds or invalid creds
@@ -104,17 +303,146 @@ func addHandler(path, method string, allowed config.UserType, action authAction,
 			}
 		}
 
-		if r.Method != method {
+		if !methodAllowed(method, r.Method) {
 			log.Debugf(ctx, "Invalid %v request for %v (expected %v)", r.Method, r.URL.String(), method)
 			w.Header().Set("Allow", method)
 			http.Error(w, "Invalid method", http.StatusMethodNotAllowed)
 			return
 		}
 
+		if !checkCSRF(ctx, w, r) {
+			return
+		}
+
+		if cfg.Mirror != nil && (r.Method == http.MethodPost || r.Method == http.MethodPut) &&
+			!mirrorPostPaths[path] {
+			log.Debugf(ctx, "Rejecting request for %v on read-only mirror", r.URL.String())
+			http.Error(w, "Server is a read-only mirror", http.StatusForbidden)
+			return
+		}
+
+		if !checkRateLimits(ctx, cfg, w, r, path) {
+			return
+		}
+
+		// Compress responses if the client supports it. Range requests are excluded
+		// since the ranges apply to the uncompressed data.
+		if acceptsGzip(r.Header.Get("Accept-Encoding")) && r.Header.Get("Range") == "" {
+			gw := newGzipResponseWriter(w)
+			defer func() {
+				if err := gw.Close(); err != nil {
+					log.Errorf(ctx, "Failed compressing response for %v: %v", r.URL.String(), err)
+				}
+			}()
+			w = gw
+		}
+
 		fn(ctx, cfg, w, r)
 	})
 }
 
+// authorizeToken looks up the API token passed in r's Authorization header. If the token
+// is valid, a copy of r associated with the token's user is returned. If false is returned,
+// the request was rejected and an error was written to w.
+func authorizeToken(ctx context.Context, w http.ResponseWriter, r *http.Request,
+	token string) (*http.Request, bool) {
+	t, err := apitoken.Lookup(ctx, token)
+	if err == apitoken.ErrNotFound {
+		log.Debugf(ctx, "Unknown API token for %v from %v", r.URL.String(), r.RemoteAddr)
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return nil, false
+	} else if err != nil {
+		log.Errorf(ctx, "Looking up API token failed: %v", err)
+		http.Error(w, "Failed looking up token", http.StatusInternalServerError)
+		return nil, false
+	}
+	// Read-only tokens can only be used for GET and HEAD requests. Some endpoints
+	// (e.g. /queue and /settings) accept both reads and writes.
+	if t.Scope == db.ReadScope && r.Method != http.MethodGet && r.Method != http.MethodHead {
+		log.Debugf(ctx, "Read-only API token %v used for %v %v", t.ID, r.Method, r.URL.String())
+		http.Error(w, "Token is read-only", http.StatusForbidden)
+		return nil, false
+	}
+	return config.WithTokenUser(r, t.User, t.Scope == db.AdminScope), true
+}
+
+// checkRateLimits enforces cfg's rate limits for a request to path.
+// If false is returned, the request was rejected and an error was written to w.
+func checkRateLimits(ctx context.Context, cfg *config.Config, w http.ResponseWriter,
+	r *http.Request, path string) bool {
+	utype, name := cfg.GetUserType(r)
+	var token bool
+	if utype == 0 {
+		// Unauthenticated requests can only get this far by passing access tokens (see
+		// checkAccess). Limit them like guests' requests, keyed on the token.
+		t := r.FormValue(share.AccessParam)
+		if t == "" || !accessPaths[path] {
+			return true
+		}
+		utype, name, token = config.GuestUser, accessTokenName(t), true
+	} else if utype == config.CronUser || utype == config.TaskUser {
+		return true
+	}
+	// Browsers send multiple range requests while playing a song, so only count requests
+	// for the beginning of the song's data. Requests that will just be redirected to
+	// versioned URLs also aren't counted, and neither are requests for HLS playlists
+	// (since the first segment's request is).
+	if path == "/song" && (!isStreamStart(r) || needsSongVersionRedirect(cfg, r) ||
+		r.FormValue("format") == hlsFormat) {
+		return true
+	}
+	limits := cfg.GetRateLimits(path, name, utype)
+	// Guests' re-downloads of songs that they've pinned for offline playback (e.g. after
+	// the service worker's cache was evicted) aren't counted against guest-only limits.
+	// The first download after pinning is still counted so that pinning can't be used to
+	// bypass the limits.
+	var skipGuest, markDownloaded bool
+	fn := r.FormValue("filename")
+	if path == "/song" && utype == config.GuestUser && !token && hasGuestOnlyLimit(limits) {
+		if p, err := pin.Get(ctx, name); err != nil {
+			log.Errorf(ctx, "Getting pins for %q failed: %v", name, err)
+		} else if p.HasFilename(fn) {
+			skipGuest = p.IsDownloaded(fn)
+			markDownloaded = !skipGuest
+		}
+	}
+	for _, rl := range limits {
+		if rl.GuestOnly && skipGuest {
+			continue
+		}
+		id := fmt.Sprintf("%s %s %v", name, path, rl.Interval())
+		err := ratelimit.Attempt(ctx, id, time.Now(), rl.MaxRequests, rl.Interval())
+		var exceeded *ratelimit.ExceededError
+		if errors.As(err, &exceeded) {
+			log.Errorf(ctx, "Request for %v from %q rejected: %v", r.URL.String(), name, err)
+			secs := int(math.Ceil(exceeded.RetryAfter.Seconds()))
+			w.Header().Set("Retry-After", strconv.Itoa(secs))
+			http.Error(w, "Rate limit exceeded", http.StatusTooManyRequests)
+			return false
+		} else if err != nil {
+			log.Errorf(ctx, "Checking rate limit for %v failed: %v", r.URL.String(), err)
+			http.Error(w, "Failed checking rate limit", http.StatusInternalServerError)
+			return false
+		}
+	}
+	if markDownloaded {
+		if err := pin.SetDownloaded(ctx, name, fn); err != nil {
+			log.Errorf(ctx, "Marking %q as downloaded for %q failed: %v", fn, name, err)
+		}
+	}
+	return true
+}
+
+// hasGuestOnlyLimit returns true if any of limits only applies to guest users.
+func hasGuestOnlyLimit(limits []config.RateLimit) bool {
+	for _, rl := range limits {
+		if rl.GuestOnly {
+			return true
+		}
+	}
+	return false
+}
+
 // getLoginURL returns a login URL for the app.
 func getLoginURL(ctx context.Context) (string, error) {
 	u, err := user.LoginURL(ctx, "/")
@@ -144,6 +472,21 @@ func parseIntParam(ctx context.Context, w http.ResponseWriter, r *http.Request,
 	return v, true
 }
 
+// parseFloatParam parses and returns the named float64 form parameter from r.
+// If the parameter is missing or unparseable, a bad request error is written
+// to w, an error is logged, and the ok return value is false.
+func parseFloatParam(ctx context.Context, w http.ResponseWriter, r *http.Request,
+	name string) (v float64, ok bool) {
+	s := r.FormValue(name)
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		log.Errorf(ctx, "Unable to parse %v param %q", name, s)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return v, false
+	}
+	return v, true
+}
+
 // parseDateParam parses and returns the named form parameter from r.
 // The paramater is parsed as an RFC 3339 date before falling back to float Unix time.
 // If the parameter is missing or unparseable, a bad request error is written
@@ -163,11 +506,11 @@ func parseDateParam(ctx context.Context, w http.ResponseWriter, r *http.Request,
 	return time.Unix(0, int64(v*float64(time.Second/time.Nanosecond))), true
 }
 
-// addLongCacheHeaders adds headers to w such that it will be cached for a long time.
-// See https://developer.mozilla.org/en-US/docs/Web/HTTP/Headers/Cache-Control.
-func addLongCacheHeaders(w http.ResponseWriter) {
+// addCacheHeaders adds headers to w such that it will be cached for maxAge seconds.
+func addCacheHeaders(w http.ResponseWriter, maxAge int) {
 	// App Engine "helpfully" rewrites Cache-Control to "no-cache, must-revalidate" in
 	// response to requests from admin users: https://github.com/derat/nup/issues/1
-	w.Header().Set("Cache-Control", "public, max-age=86400")
-	w.Header().Set("Expires", time.Now().UTC().Add(24*time.Hour).Format(time.RFC1123))
+	w.Header().Set("Cache-Control", "public, max-age="+strconv.Itoa(maxAge))
+	exp := time.Now().UTC().Add(time.Duration(maxAge) * time.Second)
+	w.Header().Set("Expires", exp.Format(time.RFC1123))
 }
@@ -58,6 +58,8 @@ func TestAddHandler(t *testing.T) {
 		},
 		SongBucket:  "test-songs",
 		CoverBucket: "test-covers",
+		// config.Parse fills in default cache lifetimes.
+		Cache: &config.CacheConfig{CoverSec: 86400, SongSec: 86400},
 	}
 	b, err := json.Marshal(origCfg)
 	if err != nil {
@@ -98,62 +100,72 @@ func TestAddHandler(t *testing.T) {
 	addHandler("/admin", http.MethodPost, admin, rejectUnauth, handleReq)
 	addHandler("/cron", http.MethodGet, norm|admin|cron, rejectUnauth, handleReq)
 	addHandler("/allow", http.MethodGet, norm|admin, allowUnauth, handleReq)
+	addHandler("/both", getOrPost, norm|admin, rejectUnauth, handleReq)
 
 	for _, tc := range []struct {
 		method, path string
 		email        string // google auth
 		user, pass   string // basic auth
 		cron         bool   // set X-Appengine-Cron header
+		csrf         string // CSRF header value to send with "csrf" cookie
 		code         int    // expected HTTP status code
 	}{
-		{"GET", "/", normEmail, "", "", false, 200},
-		{"GET", "/", "", normUser, normPass, false, 200},
-		{"GET", "/", "", adminUser, adminPass, false, 200},
-		{"GET", "/", "", guestUser, guestPass, false, 200},
-		{"GET", "/", normEmail, badUser, badPass, false, 302}, // bad basic user; don't check google
-		{"GET", "/", badEmail, "", "", false, 302},            // bad google user
-		{"GET", "/", "", badUser, badPass, false, 302},        // bad basic user
-		{"GET", "/", "", normUser, badPass, false, 302},       // bad basic password
-		{"GET", "/", "", normUser, "", false, 302},            // no basic password
-		{"GET", "/", "", "", "", false, 302},                  // no auth
-		{"POST", "/", "", "", "", false, 302},                 // no auth, wrong method
-		{"POST", "/", normEmail, "", "", false, 405},          // valid auth, wrong method
-
-		{"GET", "/get", normEmail, "", "", false, 200},
-		{"GET", "/get", "", adminUser, adminPass, false, 200},
-		{"GET", "/get", "", guestUser, guestPass, false, 200},
-		{"GET", "/get", badEmail, "", "", false, 401},
-		{"GET", "/get", "", "", "", false, 401},         // no auth
-		{"POST", "/get", "", "", "", false, 401},        // no auth, wrong method
-		{"POST", "/get", normEmail, "", "", false, 405}, // valid auth, wrong method
-
-		{"POST", "/post", normEmail, "", "", false, 200},
-		{"POST", "/post", "", adminUser, adminPass, false, 200},
-		{"POST", "/post", badEmail, "", "", false, 401},
-		{"POST", "/post", "", "", "", false, 401},               // no auth
-		{"GET", "/post", "", "", "", false, 401},                // no auth, wrong method
-		{"POST", "/post", "", guestUser, guestPass, false, 403}, // guest not allowed
-		{"GET", "/post", normEmail, "", "", false, 405},         // valid auth, wrong method
-
-		{"POST", "/admin", "", adminUser, adminPass, false, 200},
-		{"POST", "/admin", normEmail, "", "", false, 403},      // not admin
-		{"POST", "/admin", "", normUser, normPass, false, 403}, // not admin
-		{"POST", "/post", "", "", "", false, 401},              // no auth
-
-		{"GET", "/cron", normEmail, "", "", false, 200},
-		{"GET", "/cron", "", normUser, normPass, false, 200},
-		{"GET", "/cron", "", adminUser, adminPass, false, 200},
-		{"GET", "/cron", "", "", "", true, 200},
-		{"GET", "/cron", "", "", "", false, 401},       // no auth
-		{"GET", "/cron", badEmail, "", "", false, 401}, // bad google user
-		{"POST", "/cron", "", "", "", true, 405},       // wrong method
-
-		{"GET", "/allow", "", "", "", false, 200},               // no auth
-		{"GET", "/allow", normEmail, "", "", false, 200},        // valid user
-		{"GET", "/allow", "", normUser, normPass, false, 200},   // valid auth
-		{"GET", "/allow", "", adminUser, adminPass, false, 200}, // valid auth
-		{"GET", "/allow", "", guestUser, guestPass, false, 200}, // unlisted auth
-		{"POST", "/allow", "", "", "", false, 405},              // wrong method
+		{"GET", "/", normEmail, "", "", false, "", 200},
+		{"GET", "/", "", normUser, normPass, false, "", 200},
+		{"GET", "/", "", adminUser, adminPass, false, "", 200},
+		{"GET", "/", "", guestUser, guestPass, false, "", 200},
+		{"GET", "/", normEmail, badUser, badPass, false, "", 302}, // bad basic user; don't check google
+		{"GET", "/", badEmail, "", "", false, "", 302},            // bad google user
+		{"GET", "/", "", badUser, badPass, false, "", 302},        // bad basic user
+		{"GET", "/", "", normUser, badPass, false, "", 302},       // bad basic password
+		{"GET", "/", "", normUser, "", false, "", 302},            // no basic password
+		{"GET", "/", "", "", "", false, "", 302},                  // no auth
+		{"POST", "/", "", "", "", false, "", 302},                 // no auth, wrong method
+		{"POST", "/", normEmail, "", "", false, "", 405},          // valid auth, wrong method
+
+		{"GET", "/get", normEmail, "", "", false, "", 200},
+		{"GET", "/get", "", adminUser, adminPass, false, "", 200},
+		{"GET", "/get", "", guestUser, guestPass, false, "", 200},
+		{"GET", "/get", badEmail, "", "", false, "", 401},
+		{"GET", "/get", "", "", "", false, "", 401},         // no auth
+		{"POST", "/get", "", "", "", false, "", 401},        // no auth, wrong method
+		{"POST", "/get", normEmail, "", "", false, "", 405}, // valid auth, wrong method
+
+		{"POST", "/post", normEmail, "", "", false, "csrf", 200},
+		{"POST", "/post", normEmail, "", "", false, "", 403},      // missing CSRF token
+		{"POST", "/post", normEmail, "", "", false, "bogus", 403}, // bad CSRF token
+		{"POST", "/post", "", adminUser, adminPass, false, "", 200},
+		{"POST", "/post", badEmail, "", "", false, "", 401},
+		{"POST", "/post", "", "", "", false, "", 401},               // no auth
+		{"GET", "/post", "", "", "", false, "", 401},                // no auth, wrong method
+		{"POST", "/post", "", guestUser, guestPass, false, "", 403}, // guest not allowed
+		{"GET", "/post", normEmail, "", "", false, "", 405},         // valid auth, wrong method
+
+		{"POST", "/admin", "", adminUser, adminPass, false, "", 200},
+		{"POST", "/admin", normEmail, "", "", false, "", 403},      // not admin
+		{"POST", "/admin", "", normUser, normPass, false, "", 403}, // not admin
+		{"POST", "/post", "", "", "", false, "", 401},              // no auth
+
+		{"GET", "/cron", normEmail, "", "", false, "", 200},
+		{"GET", "/cron", "", normUser, normPass, false, "", 200},
+		{"GET", "/cron", "", adminUser, adminPass, false, "", 200},
+		{"GET", "/cron", "", "", "", true, "", 200},
+		{"GET", "/cron", "", "", "", false, "", 401},       // no auth
+		{"GET", "/cron", badEmail, "", "", false, "", 401}, // bad google user
+		{"POST", "/cron", "", "", "", true, "", 405},       // wrong method
+
+		{"GET", "/allow", "", "", "", false, "", 200},               // no auth
+		{"GET", "/allow", normEmail, "", "", false, "", 200},        // valid user
+		{"GET", "/allow", "", normUser, normPass, false, "", 200},   // valid auth
+		{"GET", "/allow", "", adminUser, adminPass, false, "", 200}, // valid auth
+		{"GET", "/allow", "", guestUser, guestPass, false, "", 200}, // unlisted auth
+		{"POST", "/allow", "", "", "", false, "", 405},              // wrong method
+
+		{"GET", "/both", normEmail, "", "", false, "", 200},
+		{"POST", "/both", normEmail, "", "", false, "csrf", 200},
+		{"POST", "/both", normEmail, "", "", false, "", 403}, // missing CSRF token
+		{"PUT", "/both", normEmail, "", "", false, "", 405},  // wrong method
+		{"POST", "/both", "", "", "", false, "", 401},        // no auth
 	} {
 		desc := tc.method + " " + tc.path
 		req, err := inst.NewRequest(tc.method, tc.path, nil)
@@ -175,6 +187,11 @@ func TestAddHandler(t *testing.T) {
 		if tc.cron {
 			req.Header.Set("X-Appengine-Cron", "true")
 		}
+		if tc.csrf != "" {
+			req.AddCookie(&http.Cookie{Name: csrfCookie, Value: "csrf"})
+			req.Header.Set(csrfHeader, tc.csrf)
+			desc += " csrf=" + tc.csrf
+		}
 
 		lastMethod, lastPath = "", ""
 		rec := httptest.NewRecorder()
@@ -205,3 +222,46 @@ func TestAddHandler(t *testing.T) {
 		}
 	}
 }
+
+func TestEtagMatches(t *testing.T) {
+	const etag = `"abc"`
+	for _, tc := range []struct {
+		header string
+		want   bool
+	}{
+		{``, false},
+		{`"abc"`, true},
+		{`W/"abc"`, true},
+		{`"def"`, false},
+		{`"def", "abc"`, true},
+		{`"def","abc"`, true},
+		{`"abcd"`, false},
+		{`abc`, false},
+		{`*`, true},
+	} {
+		if got := etagMatches(tc.header, etag); got != tc.want {
+			t.Errorf("etagMatches(%q, %q) = %v; want %v", tc.header, etag, got, tc.want)
+		}
+	}
+}
+
+func TestAcceptsMediaType(t *testing.T) {
+	const mt = "image/avif"
+	for _, tc := range []struct {
+		header string
+		want   bool
+	}{
+		{"", false},
+		{"image/avif", true},
+		{"image/avif,image/webp,image/apng,image/*,*/*;q=0.8", true},
+		{"image/webp, IMAGE/AVIF", true},
+		{"image/avif;q=0.5", true},
+		{"image/avif; q=0", false},
+		{"image/webp,image/*,*/*", false},
+		{"image/avif2", false},
+	} {
+		if got := acceptsMediaType(tc.header, mt); got != tc.want {
+			t.Errorf("acceptsMediaType(%q, %q) = %v; want %v", tc.header, mt, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,242 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+// Package jobs runs long-running maintenance operations in the background using App Engine
+// task queues.
+package jobs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/derat/nup/server/db"
+	"github.com/derat/nup/server/migrate"
+	"github.com/derat/nup/server/stats"
+	"github.com/derat/nup/server/update"
+
+	"google.golang.org/appengine/v2/datastore"
+	"google.golang.org/appengine/v2/log"
+	"google.golang.org/appengine/v2/taskqueue"
+)
+
+const (
+	jobKind = "Job" // datastore kind for Job entities
+
+	// RunPath is the server path that tasks are posted to. The server should pass
+	// requests to this path to Run.
+	RunPath = "/run_job"
+
+	renameBatchSize = 200 // max songs to retag in each chunk of a RenameTagJob
+	maxListedJobs   = 20  // max jobs to return from List
+)
+
+// Type describes the operation performed by a job.
+type Type string
+
+const (
+	// ReindexJob regenerates search-related fields for all songs (see update.ReindexSongs).
+	ReindexJob Type = "reindex"
+	// StatsJob updates stats (see stats.Update).
+	StatsJob Type = "stats"
+	// RenameTagJob renames a tag across all songs.
+	RenameTagJob Type = "renameTag"
+	// MigrateJob upgrades all songs and plays to the current schema (see migrate.Run).
+	MigrateJob Type = "migrate"
+)
+
+// State describes a job's progress.
+type State string
+
+const (
+	Queued  State = "queued"  // waiting for its first chunk to run
+	Running State = "running" // at least one chunk has run
+	Done    State = "done"    // finished successfully
+	Failed  State = "failed"  // finished unsuccessfully
+)
+
+// Job describes a background operation. Each job is processed in one or more chunks,
+// each run by a separate task.
+type Job struct {
+	// ID is the Job entity's key ID from Datastore.
+	ID int64 `datastore:"-" json:"id"`
+	// Type describes the operation performed by the job.
+	Type Type `json:"type"`
+	// State describes the job's progress.
+	State State `json:"state"`
+	// From and To contain the old and new tags for RenameTagJob.
+	From string `datastore:",noindex" json:"from,omitempty"`
+	To   string `datastore:",noindex" json:"to,omitempty"`
+	// Kind contains the Datastore kind being processed by MigrateJob.
+	Kind string `datastore:",noindex" json:"kind,omitempty"`
+	// Cursor contains the Datastore cursor at which the next chunk should start.
+	Cursor string `datastore:",noindex" json:"-"`
+	// Chunks contains the number of chunks that have been run.
+	Chunks int `datastore:",noindex" json:"chunks"`
+	// Scanned and Updated contain the number of songs that have been scanned and updated.
+	Scanned int `datastore:",noindex" json:"scanned"`
+	Updated int `datastore:",noindex" json:"updated"`
+	// Error describes the failure if State is Failed.
+	Error string `datastore:",noindex" json:"error,omitempty"`
+	// CreatedTime is the time at which the job was started.
+	CreatedTime time.Time `json:"createdTime"`
+	// UpdatedTime is the time at which the job was last updated.
+	UpdatedTime time.Time `datastore:",noindex" json:"updatedTime"`
+}
+
+// Start creates a job of the supplied type and enqueues a task to run its first chunk.
+// from and to are only used by RenameTagJob.
+func Start(ctx context.Context, typ Type, from, to string) (*Job, error) {
+	switch typ {
+	case ReindexJob, StatsJob, MigrateJob:
+	case RenameTagJob:
+		if from == "" || to == "" {
+			return nil, errors.New("tags not supplied")
+		} else if from == to {
+			return nil, errors.New("tags are identical")
+		}
+	default:
+		return nil, fmt.Errorf("unknown job type %q", typ)
+	}
+
+	now := time.Now()
+	job := Job{Type: typ, State: Queued, From: from, To: to, CreatedTime: now, UpdatedTime: now}
+	if err := datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+		key, err := datastore.Put(ctx, datastore.NewIncompleteKey(ctx, jobKind, nil), &job)
+		if err != nil {
+			return err
+		}
+		job.ID = key.IntID()
+		return enqueue(ctx, job.ID)
+	}, nil); err != nil {
+		return nil, err
+	}
+	log.Debugf(ctx, "Started %v job %v", job.Type, job.ID)
+	return &job, nil
+}
+
+// Active returns true if a job of the supplied type is queued or running.
+func Active(ctx context.Context, typ Type) (bool, error) {
+	for _, st := range []State{Queued, Running} {
+		n, err := datastore.NewQuery(jobKind).Filter("Type =", string(typ)).
+			Filter("State =", string(st)).KeysOnly().Limit(1).Count(ctx)
+		if err != nil {
+			return false, err
+		} else if n > 0 {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// enqueue adds a task to run the next chunk of the job identified by id.
+// If ctx is transactional, the task is only added if the transaction commits.
+func enqueue(ctx context.Context, id int64) error {
+	task := taskqueue.NewPOSTTask(RunPath, url.Values{"id": {strconv.FormatInt(id, 10)}})
+	_, err := taskqueue.Add(ctx, task, "")
+	return err
+}
+
+// Run runs the next chunk of the job identified by id and enqueues a task to run the
+// following chunk if needed. Errors from the chunk are recorded in the job rather than
+// returned, since returning an error would cause the task queue to retry the chunk.
+func Run(ctx context.Context, id int64) error {
+	key := datastore.NewKey(ctx, jobKind, "", id, nil)
+	var job Job
+	if err := datastore.Get(ctx, key, &job); err != nil {
+		return err
+	}
+	if job.State == Done || job.State == Failed {
+		log.Debugf(ctx, "Ignoring finished job %v", id)
+		return nil
+	}
+
+	done, err := runChunk(ctx, &job)
+	job.Chunks++
+	job.UpdatedTime = time.Now()
+	if err != nil {
+		log.Errorf(ctx, "Job %v failed: %v", id, err)
+		job.State = Failed
+		job.Error = err.Error()
+	} else if done {
+		log.Debugf(ctx, "Job %v finished after %v chunk(s)", id, job.Chunks)
+		job.State = Done
+	} else {
+		job.State = Running
+	}
+
+	return datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+		if _, err := datastore.Put(ctx, key, &job); err != nil {
+			return err
+		}
+		if job.State == Running {
+			return enqueue(ctx, id)
+		}
+		return nil
+	}, nil)
+}
+
+// runChunk runs the next chunk of job and updates its progress.
+func runChunk(ctx context.Context, job *Job) (done bool, err error) {
+	switch job.Type {
+	case ReindexJob:
+		cursor, scanned, updated, err := update.ReindexSongs(ctx, job.Cursor)
+		job.Cursor = cursor
+		job.Scanned += scanned
+		job.Updated += updated
+		return cursor == "", err
+	case StatsJob:
+		return true, stats.Update(ctx)
+	case MigrateJob:
+		// Songs are migrated before plays.
+		if job.Kind == "" {
+			job.Kind = db.SongKind
+		}
+		cursor, scanned, updated, err := migrate.Run(ctx, job.Kind, job.Cursor)
+		job.Cursor = cursor
+		job.Scanned += scanned
+		job.Updated += updated
+		if err != nil || cursor != "" {
+			return false, err
+		}
+		if job.Kind == db.SongKind {
+			job.Kind = db.PlayKind
+			return false, nil
+		}
+		return true, nil
+	case RenameTagJob:
+		updated, done, err := update.RenameTag(ctx, job.From, job.To, renameBatchSize)
+		job.Scanned += updated
+		job.Updated += updated
+		return done, err
+	default:
+		return false, fmt.Errorf("unknown job type %q", job.Type)
+	}
+}
+
+// List returns the most-recently-started jobs, newest first.
+func List(ctx context.Context) ([]*Job, error) {
+	jobs := make([]*Job, 0)
+	keys, err := datastore.NewQuery(jobKind).Order("-CreatedTime").Limit(maxListedJobs).
+		GetAll(ctx, &jobs)
+	if err != nil {
+		return nil, err
+	}
+	for i, k := range keys {
+		jobs[i].ID = k.IntID()
+	}
+	return jobs, nil
+}
+
+// Clear deletes all jobs from datastore for testing.
+func Clear(ctx context.Context) error {
+	if keys, err := datastore.NewQuery(jobKind).KeysOnly().GetAll(ctx, nil); err != nil {
+		return fmt.Errorf("getting %v keys failed: %v", jobKind, err)
+	} else if err := datastore.DeleteMulti(ctx, keys); err != nil {
+		return fmt.Errorf("deleting all %v entities failed: %v", jobKind, err)
+	}
+	return nil
+}
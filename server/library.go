@@ -0,0 +1,139 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/derat/nup/server/config"
+	"github.com/derat/nup/server/db"
+	"github.com/derat/nup/server/query"
+
+	"google.golang.org/appengine/v2/log"
+)
+
+// libraryStorage describes where a library's files are stored.
+// Fields correspond to those in config.Config.
+type libraryStorage struct {
+	songBucket       string
+	songBaseURL      string
+	coverBucket      string
+	coverBaseURL     string
+	coverCacheBucket string
+}
+
+// getLibraryStorage returns the storage used by the library named name.
+// The main library is used if name is empty or unknown.
+func getLibraryStorage(cfg *config.Config, name string) libraryStorage {
+	if lib := cfg.LibraryByName(name); lib != nil {
+		// Scaled covers from other libraries are only cached in memcache.
+		return libraryStorage{songBucket: lib.SongBucket, coverBucket: lib.CoverBucket}
+	}
+	return libraryStorage{
+		songBucket:       cfg.SongBucket,
+		songBaseURL:      cfg.SongBaseURL,
+		coverBucket:      cfg.CoverBucket,
+		coverBaseURL:     cfg.CoverBaseURL,
+		coverCacheBucket: cfg.CoverCacheBucket,
+	}
+}
+
+// getLibrary returns the name of the library that should be used for r.
+// The "library" parameter is used if it was supplied (an empty value specifies the main library);
+// otherwise, the requesting user's default library is used. If the user can't access the library,
+// an error is written to w and false is returned.
+func getLibrary(ctx context.Context, cfg *config.Config, w http.ResponseWriter, r *http.Request) (
+	string, bool) {
+	user, name := cfg.GetUser(r)
+	var lib string
+	if user != nil {
+		lib = user.Library
+	}
+	r.FormValue("library") // parse the form if it hasn't been parsed already
+	if vals, ok := r.Form["library"]; ok {
+		lib = vals[0]
+	}
+	if !cfg.CanAccessLibrary(user, lib) {
+		log.Errorf(ctx, "Rejecting request from %q for library %q", name, lib)
+		http.Error(w, "Library not accessible", http.StatusForbidden)
+		return "", false
+	}
+	return lib, true
+}
+
+// canAccessSong returns true if the user making r can access s's library.
+func canAccessSong(cfg *config.Config, r *http.Request, s *db.Song) bool {
+	user, _ := cfg.GetUser(r)
+	return cfg.CanAccessLibrary(user, s.Library)
+}
+
+// canAccessAllLibraries returns true if the user making r can access every library.
+func canAccessAllLibraries(cfg *config.Config, r *http.Request) bool {
+	user, _ := cfg.GetUser(r)
+	for _, lib := range cfg.Libraries {
+		if !cfg.CanAccessLibrary(user, lib.Name) {
+			return false
+		}
+	}
+	return true
+}
+
+// checkSongAccess verifies that the user making r can access the song identified by id.
+// Nonexistent songs are only reported if the user can't access all libraries.
+// If false is returned, an error was written to w.
+func checkSongAccess(ctx context.Context, cfg *config.Config, w http.ResponseWriter,
+	r *http.Request, id int64) bool {
+	if canAccessAllLibraries(cfg, r) {
+		return true
+	}
+	songs, err := query.SongsByID(ctx, []int64{id})
+	if err != nil {
+		log.Errorf(ctx, "Getting song %v failed: %v", id, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return false
+	}
+	if s := songs[0]; s == nil || !canAccessSong(cfg, r, s) {
+		http.Error(w, "Song not found", http.StatusNotFound)
+		return false
+	}
+	return true
+}
+
+// filterPlayDumps returns the plays from plays that belong to songs for which keep returns true.
+// Plays belonging to songs that no longer exist are omitted.
+func filterPlayDumps(ctx context.Context, plays []db.PlayDump, keep func(s *db.Song) bool) (
+	[]db.PlayDump, error) {
+	var ids []int64
+	seen := make(map[int64]struct{})
+	for _, p := range plays {
+		id, err := strconv.ParseInt(p.SongID, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad song ID %q: %v", p.SongID, err)
+		}
+		if _, ok := seen[id]; !ok {
+			seen[id] = struct{}{}
+			ids = append(ids, id)
+		}
+	}
+	songs, err := query.SongsByID(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+	kept := make(map[string]struct{}, len(songs))
+	for _, s := range songs {
+		if s != nil && keep(s) {
+			kept[s.SongID] = struct{}{}
+		}
+	}
+	filtered := make([]db.PlayDump, 0, len(plays))
+	for _, p := range plays {
+		if _, ok := kept[p.SongID]; ok {
+			filtered = append(filtered, p)
+		}
+	}
+	return filtered, nil
+}
@@ -5,35 +5,53 @@
 package main
 
 import (
+	"archive/tar"
 	"bytes"
+	"compress/gzip"
 	"context"
-	"crypto/sha1"
-	"encoding/hex"
+	"encoding/csv"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"math/rand"
 	"net"
 	"net/http"
 	"os"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/derat/nup/server/apitoken"
+	"github.com/derat/nup/server/audit"
 	"github.com/derat/nup/server/cache"
 	"github.com/derat/nup/server/config"
 	"github.com/derat/nup/server/cover"
 	"github.com/derat/nup/server/db"
 	"github.com/derat/nup/server/dump"
+	"github.com/derat/nup/server/jobs"
+	"github.com/derat/nup/server/metrics"
+	"github.com/derat/nup/server/migrate"
+	"github.com/derat/nup/server/mirror"
+	"github.com/derat/nup/server/nowplaying"
+	"github.com/derat/nup/server/pin"
 	"github.com/derat/nup/server/query"
+	"github.com/derat/nup/server/queue"
 	"github.com/derat/nup/server/ratelimit"
+	"github.com/derat/nup/server/settings"
+	"github.com/derat/nup/server/share"
 	"github.com/derat/nup/server/stats"
+	"github.com/derat/nup/server/storage"
+	"github.com/derat/nup/server/tagrules"
 	"github.com/derat/nup/server/update"
 
 	"google.golang.org/appengine/v2"
+	"google.golang.org/appengine/v2/datastore"
 	"google.golang.org/appengine/v2/log"
 )
 
@@ -43,6 +61,27 @@ const (
 
 	maxCoverSize     = 800 // max size permitted in /cover scale requests
 	coverJPEGQuality = 90  // quality to use when encoding /cover replies
+
+	defaultCoversBundleSize  = 100            // default number of covers in /covers_bundle replies
+	maxCoversBundleSize      = 200            // max number of covers in /covers_bundle replies
+	coversBundleParallelism  = 8              // max covers scaled concurrently for /covers_bundle
+	coversBundleCursorHeader = "X-Nup-Cursor" // header containing /covers_bundle cursor
+
+	defaultPlaysBatchSize = 50  // default number of plays in /plays replies
+	maxPlaysBatchSize     = 500 // max number of plays in /plays replies
+
+	maxPlayedBatchSize = 5000 // max number of plays in /played_batch requests
+	playedBatchTxnSize = 100  // max number of plays of a song added per transaction
+
+	maxSongsByIDCount = 1000 // max number of songs in /songs_by_id requests
+	defaultSimilarMax = 20   // default number of songs in /similar replies
+	maxQueueSize      = 1000 // max number of songs in /queue POST requests
+	maxQueueDeviceLen = 100  // max length of device names in /queue POST requests
+
+	maxScheduledPresetDelay = time.Hour // max delay before a scheduled preset is no longer evaluated
+
+	defaultAccessTokenDays = 7.0 // default lifetime of tokens returned by /access_token
+	defaultShareLinkDays   = 30  // default lifetime of links returned by /share_link
 )
 
 // forceUpdateFailures can be set by tests via /config to indicate that failures should be reported
@@ -58,38 +97,87 @@ var staticFileETags sync.Map
 
 func main() {
 	rand.Seed(time.Now().UnixNano())
+	migrate.Install()
 
 	// Get masks for various types of users.
 	norm := config.NormalUser
 	admin := config.AdminUser
 	guest := config.GuestUser
 	cron := config.CronUser
+	task := config.TaskUser
 
 	// Use a wrapper instead of calling http.HandleFunc directly to reduce the risk
 	// that a handler neglects checking that requests are authorized.
 	addHandler("/", http.MethodGet, norm|admin|guest, redirectUnauth, handleStatic)
 	addHandler("/manifest.json", http.MethodGet, norm|admin|guest, allowUnauth, handleStatic)
 
+	addHandler("/access_token", http.MethodGet, admin, rejectUnauth, handleAccessToken)
+	addHandler("/albums", http.MethodGet, norm|admin|guest, rejectUnauth, handleAlbums)
+	addHandler("/api_tokens", http.MethodGet, admin, rejectUnauth, handleAPITokens)
+	addHandler("/audit", http.MethodGet, admin, rejectUnauth, handleAudit)
 	addHandler("/cover", http.MethodGet, norm|admin|guest, rejectUnauth, handleCover)
+	addHandler("/covers_bundle", http.MethodGet, norm|admin|guest, rejectUnauth, handleCoversBundle)
+	addHandler("/create_api_token", http.MethodPost, admin, rejectUnauth, handleCreateAPIToken)
 	addHandler("/delete_song", http.MethodPost, admin, rejectUnauth, handleDeleteSong)
 	addHandler("/dump_song", http.MethodGet, norm|admin|guest, rejectUnauth, handleDumpSong)
+	addHandler("/edit_song", http.MethodPost, admin, rejectUnauth, handleEditSong)
+	addHandler("/end_import", http.MethodPost, admin, rejectUnauth, handleEndImport)
 	addHandler("/export", http.MethodGet, norm|admin|guest, rejectUnauth, handleExport)
 	addHandler("/import", http.MethodPost, admin, rejectUnauth, handleImport)
+	addHandler("/invalidate_caches", http.MethodPost, admin, rejectUnauth, handleInvalidateCaches)
+	addHandler("/jobs", http.MethodGet, admin, rejectUnauth, handleJobs)
+	addHandler("/merge_candidates", http.MethodGet, admin, rejectUnauth, handleMergeCandidates)
+	addHandler("/metrics", http.MethodGet, admin|cron, rejectUnauth, handleMetrics)
+	addHandler("/migrate", http.MethodGet, admin|cron, rejectUnauth, handleMigrate)
 	addHandler("/now", http.MethodGet, norm|admin|guest, rejectUnauth, handleNow)
+	addHandler("/now_playing", http.MethodGet+", "+http.MethodPost, norm|admin, rejectUnauth, handleNowPlaying)
+	addHandler("/oembed", http.MethodGet, norm|admin|guest, allowUnauth, handleOEmbed)
+	addHandler("/pin", http.MethodPost, norm|admin|guest, rejectUnauth, handlePin)
+	addHandler("/pinned", http.MethodGet, norm|admin|guest, rejectUnauth, handlePinned)
 	addHandler("/played", http.MethodPost, norm|admin, rejectUnauth, handlePlayed)
+	addHandler("/played_batch", http.MethodPost, norm|admin, rejectUnauth, handlePlayedBatch)
+	addHandler("/plays", http.MethodGet, norm|admin|guest, rejectUnauth, handlePlays)
+	addHandler("/precache_manifest", http.MethodGet, norm|admin|guest, rejectUnauth, handlePrecacheManifest)
 	addHandler("/presets", http.MethodGet, norm|admin|guest, rejectUnauth, handlePresets)
+	addHandler("/purge_deleted_song", http.MethodPost, admin, rejectUnauth, handlePurgeDeletedSong)
+	addHandler("/purge_trash", http.MethodGet, admin|cron, rejectUnauth, handlePurgeTrash)
 	addHandler("/query", http.MethodGet, norm|admin|guest, rejectUnauth, handleQuery)
+	addHandler("/queue", http.MethodGet+", "+http.MethodPost, norm|admin|guest, rejectUnauth, handleQueue)
+	addHandler("/random", http.MethodGet, norm|admin|guest, rejectUnauth, handleRandom)
 	addHandler("/rate_and_tag", http.MethodPost, norm|admin, rejectUnauth, handleRateAndTag)
 	addHandler("/reindex", http.MethodPost, admin, rejectUnauth, handleReindex)
+	addHandler("/revoke_api_token", http.MethodPost, admin, rejectUnauth, handleRevokeAPIToken)
+	addHandler(jobs.RunPath, http.MethodPost, task, rejectUnauth, handleRunJob)
+	addHandler("/scheduled_presets", http.MethodGet, admin|cron, rejectUnauth, handleScheduledPresets)
+	addHandler("/server_config", http.MethodGet+", "+http.MethodPost, admin, rejectUnauth, handleServerConfig)
+	addHandler("/settings", http.MethodGet+", "+http.MethodPut, norm|admin, rejectUnauth, handleSettings)
+	addHandler("/share", http.MethodGet, norm|admin|guest, allowUnauth, handleShare)
+	addHandler("/share_cover", http.MethodGet, norm|admin|guest, allowUnauth, handleShareCover)
+	addHandler("/share_link", http.MethodGet, norm|admin, rejectUnauth, handleShareLink)
+	addHandler("/similar", http.MethodGet, norm|admin|guest, rejectUnauth, handleSimilar)
+	addHandler("/simulate_query", http.MethodGet, admin, rejectUnauth, handleSimulateQuery)
+	addHandler("/skipped", http.MethodPost, norm|admin, rejectUnauth, handleSkipped)
 	addHandler("/song", http.MethodGet, norm|admin|guest, rejectUnauth, handleSong)
+	addHandler("/songs_by_id", getOrPost, norm|admin|guest, rejectUnauth, handleSongsByID)
+	addHandler("/start_job", http.MethodPost, admin, rejectUnauth, handleStartJob)
 	addHandler("/stats", http.MethodGet, norm|admin|guest|cron, rejectUnauth, handleStats)
+	addHandler("/suggest", http.MethodGet, norm|admin|guest, rejectUnauth, handleSuggest)
+	addHandler("/sync", http.MethodGet, admin|cron, rejectUnauth, handleSync)
+	addHandler("/tag_rules", http.MethodGet+", "+http.MethodPost, admin, rejectUnauth, handleTagRules)
+	addHandler("/tag_suggestions", http.MethodGet, norm|admin, rejectUnauth, handleTagSuggestions)
 	addHandler("/tags", http.MethodGet, norm|admin|guest, rejectUnauth, handleTags)
+	addHandler("/undelete_song", http.MethodPost, admin, rejectUnauth, handleUndeleteSong)
 	addHandler("/user", http.MethodGet, norm|admin|guest, rejectUnauth, handleUser)
 
+	// Uptime checks need to be able to call these without credentials.
+	addProbeHandler("/healthz", handleHealthz)
+	addProbeHandler("/readyz", handleReadyz)
+
 	if appengine.IsDevAppServer() {
 		addHandler("/clear", http.MethodPost, admin, rejectUnauth, handleClear)
 		addHandler("/config", http.MethodPost, admin, rejectUnauth, handleConfig)
 		addHandler("/flush_cache", http.MethodPost, admin, rejectUnauth, handleFlushCache)
+		addHandler("/ratelimit_status", http.MethodGet, admin, rejectUnauth, handleRateLimitStatus)
 	}
 
 	// Generate the index file and JS bundle so we're ready to serve them.
@@ -139,6 +227,115 @@ func main() {
 	appengine.Main()
 }
 
+func handleAccessToken(ctx context.Context, cfg *config.Config, w http.ResponseWriter, r *http.Request) {
+	if cfg.ShareSecret == "" {
+		http.Error(w, "Sharing disabled", http.StatusNotFound)
+		return
+	}
+	a := share.Access{Query: r.FormValue("query")}
+	for _, s := range strings.FieldsFunc(r.FormValue("songIds"), func(r rune) bool { return r == ',' }) {
+		id, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Bad ID %q", s), http.StatusBadRequest)
+			return
+		}
+		a.SongIDs = append(a.SongIDs, id)
+	}
+	days := defaultAccessTokenDays
+	if r.FormValue("days") != "" {
+		var ok bool
+		if days, ok = parseFloatParam(ctx, w, r, "days"); !ok {
+			return
+		} else if days <= 0 {
+			http.Error(w, "Non-positive days", http.StatusBadRequest)
+			return
+		}
+	}
+	a.Expires = time.Now().Add(time.Duration(days * float64(24*time.Hour))).UTC()
+	a.Generation = cfg.ShareKeyGeneration
+	token, err := share.AccessToken(cfg.ShareSecret, a)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSONResponse(w, struct {
+		Token   string    `json:"token"`
+		Expires time.Time `json:"expires"`
+	}{token, a.Expires})
+}
+
+func handleAlbums(ctx context.Context, cfg *config.Config, w http.ResponseWriter, r *http.Request) {
+	albums, err := stats.IncompleteAlbums(ctx)
+	if err != nil {
+		log.Errorf(ctx, "Getting incomplete albums failed: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	user, _ := cfg.GetUser(r)
+	var num int
+	for _, a := range albums {
+		if cfg.CanAccessLibrary(user, a.Library) {
+			albums[num] = a
+			num++
+		}
+	}
+	writeJSONResponse(w, albums[:num])
+}
+
+func handleAPITokens(ctx context.Context, cfg *config.Config, w http.ResponseWriter, r *http.Request) {
+	tokens, err := apitoken.List(ctx, r.FormValue("user"))
+	if err != nil {
+		log.Errorf(ctx, "Listing API tokens failed: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSONResponse(w, tokens)
+}
+
+func handleAudit(ctx context.Context, cfg *config.Config, w http.ResponseWriter, r *http.Request) {
+	var songID int64
+	if r.FormValue("songId") != "" {
+		var ok bool
+		if songID, ok = parseIntParam(ctx, w, r, "songId"); !ok {
+			return
+		}
+	}
+	var max int64
+	if r.FormValue("max") != "" {
+		var ok bool
+		if max, ok = parseIntParam(ctx, w, r, "max"); !ok {
+			return
+		}
+	}
+	entries, err := audit.List(ctx, songID, r.FormValue("user"), int(max))
+	if err != nil {
+		log.Errorf(ctx, "Listing audit entries failed: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSONResponse(w, entries)
+}
+
+// recordAudit records an audit entry describing a modification made by r.
+// Failures are logged but not returned, since the modification has already been made.
+func recordAudit(ctx context.Context, cfg *config.Config, r *http.Request,
+	songID int64, before, after string) {
+	_, user := cfg.GetUserType(r)
+	if err := audit.Record(ctx, user, r.URL.Path, songID, before, after); err != nil {
+		log.Errorf(ctx, "Recording audit entry for %v failed: %v", r.URL.Path, err)
+	}
+}
+
+// songSummary returns audit.SongSummary for the song identified by id.
+// Failures are logged and result in an empty string being returned.
+func songSummary(ctx context.Context, id int64) string {
+	sum, err := audit.SongSummary(ctx, id)
+	if err != nil {
+		log.Errorf(ctx, "Summarizing song %v failed: %v", id, err)
+	}
+	return sum
+}
+
 func handleClear(ctx context.Context, cfg *config.Config, w http.ResponseWriter, r *http.Request) {
 	if err := update.ClearData(ctx); err != nil {
 		log.Errorf(ctx, "Clearing songs and plays failed: %v", err)
@@ -155,11 +352,59 @@ func handleClear(ctx context.Context, cfg *config.Config, w http.ResponseWriter,
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	if err := queue.Clear(ctx); err != nil {
+		log.Errorf(ctx, "Clearing queues failed: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := pin.Clear(ctx); err != nil {
+		log.Errorf(ctx, "Clearing pins failed: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := nowplaying.Clear(ctx); err != nil {
+		log.Errorf(ctx, "Clearing now-playing states failed: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := settings.Clear(ctx); err != nil {
+		log.Errorf(ctx, "Clearing settings failed: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := tagrules.Clear(ctx); err != nil {
+		log.Errorf(ctx, "Clearing tag rules failed: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := jobs.Clear(ctx); err != nil {
+		log.Errorf(ctx, "Clearing jobs failed: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := audit.Clear(ctx); err != nil {
+		log.Errorf(ctx, "Clearing audit entries failed: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := apitoken.Clear(ctx); err != nil {
+		log.Errorf(ctx, "Clearing API tokens failed: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 	writeTextResponse(w, "ok")
 }
 
 func handleConfig(ctx context.Context, cfg *config.Config, w http.ResponseWriter, r *http.Request) {
 	forceUpdateFailures = r.FormValue("forceUpdateFailures") == "1"
+	var bulkTimeout float64
+	if r.FormValue("bulkImportTimeoutSec") != "" {
+		var ok bool
+		if bulkTimeout, ok = parseFloatParam(ctx, w, r, "bulkImportTimeoutSec"); !ok {
+			return
+		}
+	}
+	update.SetBulkImportTimeout(time.Duration(bulkTimeout * float64(time.Second)))
 	writeTextResponse(w, "ok")
 }
 
@@ -181,12 +426,29 @@ func handleCover(ctx context.Context, cfg *config.Config, w http.ResponseWriter,
 			return
 		}
 	}
-	webp := r.FormValue("webp") == "1"
+	// Prescaled AVIF and WebP images are only available for specific sizes. Honor the
+	// webp parameter if it was supplied, and otherwise negotiate using the Accept header.
+	var webp, avif bool
+	if v := r.FormValue("webp"); v != "" {
+		webp = v == "1"
+	} else if size > 0 {
+		accept := r.Header.Get("Accept")
+		avif = acceptsMediaType(accept, "image/avif")
+		webp = acceptsMediaType(accept, "image/webp")
+	}
+	lib, ok := getLibrary(ctx, cfg, w, r)
+	if !ok {
+		return
+	}
+	st := getLibraryStorage(cfg, lib)
+	if !checkVersion(ctx, cfg, w, r, st.coverBucket, fn, cfg.Cache.CoverSec) {
+		return
+	}
 
 	// cover.Scale will set the Content-Type header.
-	addLongCacheHeaders(w)
-	if err := cover.Scale(ctx, cfg.CoverBucket, cfg.CoverBaseURL, fn, int(size),
-		coverJPEGQuality, webp, w); err != nil {
+	w.Header().Add("Vary", "Accept")
+	if err := cover.Scale(ctx, st.coverBucket, st.coverBaseURL, st.coverCacheBucket,
+		fn, int(size), coverJPEGQuality, webp, avif, w); err != nil {
 		log.Errorf(ctx, "Scaling cover %q failed: %v", fn, err)
 		if os.IsNotExist(err) {
 			http.Error(w, "Not found", http.StatusNotFound)
@@ -197,15 +459,150 @@ func handleCover(ctx context.Context, cfg *config.Config, w http.ResponseWriter,
 	}
 }
 
+func handleCoversBundle(ctx context.Context, cfg *config.Config, w http.ResponseWriter, r *http.Request) {
+	var size int64
+	if r.FormValue("size") != "" {
+		var ok bool
+		if size, ok = parseIntParam(ctx, w, r, "size"); !ok {
+			return
+		} else if size <= 0 || size > maxCoverSize {
+			log.Errorf(ctx, "Invalid cover size %v", size)
+			http.Error(w, "Invalid size", http.StatusBadRequest)
+			return
+		}
+	}
+	var max int64 = defaultCoversBundleSize
+	if r.FormValue("max") != "" {
+		var ok bool
+		if max, ok = parseIntParam(ctx, w, r, "max"); !ok {
+			return
+		} else if max <= 0 {
+			log.Errorf(ctx, "Invalid max %v", max)
+			http.Error(w, "Invalid max", http.StatusBadRequest)
+			return
+		}
+	}
+	if max > maxCoversBundleSize {
+		max = maxCoversBundleSize
+	}
+	webp := r.FormValue("webp") == "1"
+	lib, ok := getLibrary(ctx, cfg, w, r)
+	if !ok {
+		return
+	}
+	st := getLibraryStorage(cfg, lib)
+
+	fns, nextCursor, err := dump.CoverFilenames(ctx, max, r.FormValue("cursor"), lib)
+	if err != nil {
+		log.Errorf(ctx, "Getting cover filenames failed: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// The cursor is passed in a header since we've already started streaming
+	// the archive by the time that we'd be able to append it to the body.
+	w.Header().Set("Content-Type", "application/gzip")
+	if nextCursor != "" {
+		w.Header().Set(coversBundleCursorHeader, nextCursor)
+	}
+	gw := gzip.NewWriter(w)
+	tw := tar.NewWriter(gw)
+	now := time.Now()
+
+	// Scale covers in parallel, but add them to the archive in order.
+	bufs := make([]*bytes.Buffer, len(fns))
+	done := make([]chan struct{}, len(fns))
+	sem := make(chan struct{}, coversBundleParallelism)
+	for i, fn := range fns {
+		done[i] = make(chan struct{})
+		go func(i int, fn string) {
+			defer close(done[i])
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			var b bytes.Buffer
+			if err := cover.Scale(ctx, st.coverBucket, st.coverBaseURL, st.coverCacheBucket,
+				fn, int(size), coverJPEGQuality, webp, false /* avif */, &b); err != nil {
+				// We can't report errors to the client after streaming has started,
+				// so just omit the cover from the archive.
+				log.Errorf(ctx, "Scaling cover %q failed: %v", fn, err)
+				return
+			}
+			bufs[i] = &b
+		}(i, fn)
+	}
+
+	for i, fn := range fns {
+		<-done[i]
+		b := bufs[i]
+		if b == nil {
+			continue
+		}
+		name := fn
+		if size > 0 && http.DetectContentType(b.Bytes()) == "image/webp" {
+			name = cover.WebPFilename(fn, int(size))
+		}
+		if err := tw.WriteHeader(&tar.Header{
+			Name:    name,
+			Mode:    0644,
+			Size:    int64(b.Len()),
+			ModTime: now,
+		}); err != nil {
+			log.Errorf(ctx, "Writing tar header for %q failed: %v", name, err)
+			return
+		}
+		if _, err := tw.Write(b.Bytes()); err != nil {
+			log.Errorf(ctx, "Writing tar data for %q failed: %v", name, err)
+			return
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		log.Errorf(ctx, "Closing tar writer failed: %v", err)
+		return
+	}
+	if err := gw.Close(); err != nil {
+		log.Errorf(ctx, "Closing gzip writer failed: %v", err)
+	}
+}
+
+func handleCreateAPIToken(ctx context.Context, cfg *config.Config, w http.ResponseWriter, r *http.Request) {
+	name := r.FormValue("user")
+	if name == "" {
+		_, name = cfg.GetUser(r)
+	} else if cfg.UserByName(name) == nil {
+		http.Error(w, fmt.Sprintf("Unknown user %q", name), http.StatusBadRequest)
+		return
+	}
+	scope := db.TokenScope(r.FormValue("scope"))
+	if !apitoken.ValidScope(scope) {
+		http.Error(w, fmt.Sprintf("Invalid scope %q", scope), http.StatusBadRequest)
+		return
+	}
+	token, t, err := apitoken.Create(ctx, name, scope, r.FormValue("desc"))
+	if err != nil {
+		log.Errorf(ctx, "Creating API token for %q failed: %v", name, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Debugf(ctx, "Created %v API token %v for %q", scope, t.ID, name)
+	writeJSONResponse(w, struct {
+		Token string `json:"token"`
+		*db.APIToken
+	}{token, t})
+}
+
 func handleDeleteSong(ctx context.Context, cfg *config.Config, w http.ResponseWriter, r *http.Request) {
 	id, ok := parseIntParam(ctx, w, r, "songId")
 	if !ok {
 		return
 	}
+	before := songSummary(ctx, id)
 	if err := update.DeleteSong(ctx, id); err != nil {
 		log.Errorf(ctx, "Deleting song %v failed: %v", id, err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
+	recordAudit(ctx, cfg, r, id, before, "deleted")
 	writeTextResponse(w, "ok")
 }
 
@@ -221,6 +618,10 @@ func handleDumpSong(ctx context.Context, cfg *config.Config, w http.ResponseWrit
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	if getExcludedTags(cfg, r).hides(s) || !canAccessSong(cfg, r, s) {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
 
 	b, err := json.Marshal(s)
 	if err != nil {
@@ -233,6 +634,86 @@ func handleDumpSong(ctx context.Context, cfg *config.Config, w http.ResponseWrit
 	writeTextResponse(w, out.String())
 }
 
+func handleEditSong(ctx context.Context, cfg *config.Config, w http.ResponseWriter, r *http.Request) {
+	id, ok := parseIntParam(ctx, w, r, "songId")
+	if !ok {
+		return
+	}
+
+	var edit update.SongEdit
+	for name, dst := range map[string]**string{
+		"artist": &edit.Artist,
+		"title":  &edit.Title,
+		"album":  &edit.Album,
+	} {
+		if _, ok := r.Form[name]; ok {
+			v := strings.TrimSpace(r.FormValue(name))
+			*dst = &v
+		}
+	}
+	if _, ok := r.Form["date"]; ok {
+		var date time.Time // empty param clears the date
+		if r.FormValue("date") != "" {
+			if date, ok = parseDateParam(ctx, w, r, "date"); !ok {
+				return
+			}
+		}
+		edit.Date = &date
+	}
+	for name, dst := range map[string]**int{
+		"track": &edit.Track,
+		"disc":  &edit.Disc,
+	} {
+		if _, ok := r.Form[name]; ok {
+			v, ok := parseIntParam(ctx, w, r, name)
+			if !ok {
+				return
+			} else if v < 0 {
+				http.Error(w, fmt.Sprintf("Negative %v", name), http.StatusBadRequest)
+				return
+			}
+			n := int(v)
+			*dst = &n
+		}
+	}
+	if edit == (update.SongEdit{}) {
+		http.Error(w, "No fields supplied", http.StatusBadRequest)
+		return
+	}
+
+	orig, song, err := update.EditSong(ctx, id, &edit)
+	if err == datastore.ErrNoSuchEntity {
+		http.Error(w, "Song not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Errorf(ctx, "Editing song %v failed: %v", id, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if before, after := audit.SummarizeMetadata(orig), audit.SummarizeMetadata(song); after != before {
+		recordAudit(ctx, cfg, r, id, before, after)
+	}
+	query.CleanSong(song, id)
+	writeJSONResponse(w, song)
+}
+
+func handleEndImport(ctx context.Context, cfg *config.Config, w http.ResponseWriter, r *http.Request) {
+	numSongs, err := update.EndBulkImport(ctx)
+	if err != nil {
+		log.Errorf(ctx, "Ending bulk import failed: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if numSongs > 0 {
+		if err := stats.Update(ctx); err != nil {
+			log.Errorf(ctx, "Updating stats failed: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	writeTextResponse(w, "ok")
+}
+
 func handleExport(ctx context.Context, cfg *config.Config, w http.ResponseWriter, r *http.Request) {
 	var max int64 = defaultDumpBatchSize
 	if len(r.FormValue("max")) > 0 {
@@ -244,16 +725,30 @@ func handleExport(ctx context.Context, cfg *config.Config, w http.ResponseWriter
 	if max > maxDumpBatchSize {
 		max = maxDumpBatchSize
 	}
+	// Only objects from a single library are exported. Filtering happens after loading each
+	// batch, so batches may contain fewer than max objects.
+	lib, ok := getLibrary(ctx, cfg, w, r)
+	if !ok {
+		return
+	}
+	excluded := getExcludedTags(cfg, r)
 
-	w.Header().Set("Content-Type", "text/plain")
-	e := json.NewEncoder(w)
+	format := r.FormValue("format")
+	switch format {
+	case "", "ndjson", "csv":
+	default:
+		http.Error(w, "Invalid format", http.StatusBadRequest)
+		return
+	}
 
 	var objectPtrs []interface{}
+	var csvHeader []string
 	var nextCursor string
 	var err error
 
 	switch r.FormValue("type") {
 	case "song":
+		csvHeader = db.SongCSVHeader
 		var lastMod time.Time
 		if len(r.FormValue("minLastModifiedNsec")) > 0 {
 			if ns, ok := parseIntParam(ctx, w, r, "minLastModifiedNsec"); !ok {
@@ -277,9 +772,12 @@ func handleExport(ctx context.Context, cfg *config.Config, w http.ResponseWriter
 		for _, s := range strings.Split(r.FormValue("omit"), ",") {
 			omit[s] = true
 		}
-		objectPtrs = make([]interface{}, len(songs))
+		objectPtrs = make([]interface{}, 0, len(songs))
 		for i := range songs {
 			s := &songs[i]
+			if s.Library != lib || excluded.hides(s) {
+				continue
+			}
 			if omit["coverFilename"] {
 				s.CoverFilename = ""
 			}
@@ -289,16 +787,41 @@ func handleExport(ctx context.Context, cfg *config.Config, w http.ResponseWriter
 			if omit["sha1"] {
 				s.SHA1 = ""
 			}
-			objectPtrs[i] = s
+			objectPtrs = append(objectPtrs, s)
 		}
 	case "play":
+		csvHeader = db.PlayCSVHeader
+		var minStart, minReport time.Time
+		if len(r.FormValue("minStartTimeNsec")) > 0 {
+			if ns, ok := parseIntParam(ctx, w, r, "minStartTimeNsec"); !ok {
+				return
+			} else if ns > 0 {
+				minStart = time.Unix(0, ns)
+			}
+		}
+		if len(r.FormValue("minReportTimeNsec")) > 0 {
+			if ns, ok := parseIntParam(ctx, w, r, "minReportTimeNsec"); !ok {
+				return
+			} else if ns > 0 {
+				minReport = time.Unix(0, ns)
+			}
+		}
 		var plays []db.PlayDump
-		plays, nextCursor, err = dump.Plays(ctx, max, r.FormValue("cursor"))
+		plays, nextCursor, err = dump.Plays(ctx, max, r.FormValue("cursor"), minStart, minReport)
 		if err != nil {
 			log.Errorf(ctx, "Dumping plays failed: %v", err)
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
+		if len(cfg.Libraries) > 0 || excluded != nil {
+			if plays, err = filterPlayDumps(ctx, plays, func(s *db.Song) bool {
+				return s.Library == lib && !excluded.hides(s)
+			}); err != nil {
+				log.Errorf(ctx, "Filtering plays failed: %v", err)
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
 		objectPtrs = make([]interface{}, len(plays))
 		for i := range plays {
 			objectPtrs[i] = &plays[i]
@@ -308,6 +831,13 @@ func handleExport(ctx context.Context, cfg *config.Config, w http.ResponseWriter
 		return
 	}
 
+	if format == "csv" {
+		writeCSVExport(ctx, w, r, csvHeader, objectPtrs, nextCursor)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	e := json.NewEncoder(w)
 	for i := 0; i < len(objectPtrs); i++ {
 		if err = e.Encode(objectPtrs[i]); err != nil {
 			log.Errorf(ctx, "Encoding object failed: %v", err)
@@ -324,6 +854,31 @@ func handleExport(ctx context.Context, cfg *config.Config, w http.ResponseWriter
 	}
 }
 
+// exportCursorHeader is the response header used by /export to return the next cursor
+// in CSV mode, since it can't be included in the body.
+const exportCursorHeader = "X-Nup-Cursor"
+
+// writeCSVExport writes objectPtrs (which must implement CSVRecord) to w as CSV for handleExport.
+// header is only written for the first batch (i.e. if r doesn't contain a cursor).
+func writeCSVExport(ctx context.Context, w http.ResponseWriter, r *http.Request,
+	header []string, objectPtrs []interface{}, nextCursor string) {
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	if nextCursor != "" {
+		w.Header().Set(exportCursorHeader, nextCursor)
+	}
+	cw := csv.NewWriter(w)
+	if r.FormValue("cursor") == "" {
+		cw.Write(header)
+	}
+	for _, o := range objectPtrs {
+		cw.Write(o.(interface{ CSVRecord() []string }).CSVRecord())
+	}
+	if cw.Flush(); cw.Error() != nil {
+		// Too late to report an HTTP error.
+		log.Errorf(ctx, "Writing CSV failed: %v", cw.Error())
+	}
+}
+
 func handleFlushCache(ctx context.Context, cfg *config.Config, w http.ResponseWriter, r *http.Request) {
 	if err := query.FlushCache(ctx, cache.Memcache); err != nil {
 		log.Errorf(ctx, "Flushing query cache from memcache failed: %v", err)
@@ -360,38 +915,352 @@ func handleImport(ctx context.Context, cfg *config.Config, w http.ResponseWriter
 		}
 	}
 
+	// In bulk mode, cache flushes and stats updates are deferred until /end_import is called.
+	bulk := r.FormValue("bulk") == "1"
+
+	scale, err := db.ParseRatingScale(r.FormValue("ratingScale"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	songs, scale, err := db.DecodeSongs(r.Body, scale)
+	if err != nil {
+		log.Errorf(ctx, "Decode songs failed: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if scale == db.LegacyRatingScale {
+		log.Debugf(ctx, "Converting legacy ratings for %d song(s)", len(songs))
+	}
+
 	numSongs := 0
-	d := json.NewDecoder(r.Body)
-	for {
-		s := &db.Song{}
-		if err := d.Decode(s); err == io.EOF {
-			break
-		} else if err != nil {
-			log.Errorf(ctx, "Decode song failed: %v", err)
-			http.Error(w, err.Error(), http.StatusBadRequest)
+	for _, s := range songs {
+		if s.Library != "" && cfg.LibraryByName(s.Library) == nil {
+			log.Errorf(ctx, "Song with SHA1 %v has unknown library %q", s.SHA1, s.Library)
+			http.Error(w, fmt.Sprintf("Unknown library %q", s.Library), http.StatusBadRequest)
 			return
 		}
-		if err := update.UpdateOrInsertSong(ctx, s, dataPolicy, keyType, delay); err != nil {
+		id, prev, err := update.UpdateOrInsertSong(ctx, s, dataPolicy, keyType, delay)
+		if err != nil {
 			log.Errorf(ctx, "Update song with SHA1 %v failed: %v", s.SHA1, err)
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
+		// Record each song whose user data was replaced, since these are the imports that
+		// can clobber ratings, tags, and plays (e.g. when merging songs).
+		if dataPolicy == update.ReplaceUserData {
+			recordAudit(ctx, cfg, r, id, audit.Summarize(prev), audit.Summarize(s))
+		}
 		numSongs++
 	}
-	if err := query.FlushCacheForUpdate(ctx, query.MetadataUpdate); err != nil {
+	if dataPolicy != update.ReplaceUserData && numSongs > 0 {
+		recordAudit(ctx, cfg, r, 0, "", fmt.Sprintf("imported %d song(s)", numSongs))
+	}
+	if bulk {
+		if err := update.NoteBulkImport(ctx, numSongs); err != nil {
+			log.Errorf(ctx, "Noting bulk import failed: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	} else if err := query.FlushCacheForUpdate(ctx, query.MetadataUpdate); err != nil {
 		log.Errorf(ctx, "Flushing query cache for update failed: %v", err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
 	log.Debugf(ctx, "Updated %v song(s)", numSongs)
 	writeTextResponse(w, "ok")
 }
 
-func handleNow(ctx context.Context, cfg *config.Config, w http.ResponseWriter, r *http.Request) {
-	writeTextResponse(w, strconv.FormatInt(time.Now().UnixNano(), 10))
-}
-
-func handlePlayed(ctx context.Context, cfg *config.Config, w http.ResponseWriter, r *http.Request) {
-	id, ok := parseIntParam(ctx, w, r, "songId")
+func handleInvalidateCaches(ctx context.Context, cfg *config.Config, w http.ResponseWriter, r *http.Request) {
+	lib := r.FormValue("library")
+	if lib != "" && cfg.LibraryByName(lib) == nil {
+		http.Error(w, fmt.Sprintf("Unknown library %q", lib), http.StatusBadRequest)
+		return
+	}
+	st := getLibraryStorage(cfg, lib)
+	if fn := r.FormValue("cover"); fn != "" {
+		if err := cover.Forget(ctx, st.coverCacheBucket, fn); err != nil {
+			log.Errorf(ctx, "Forgetting cover %q failed: %v", fn, err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if st.coverBucket != "" {
+			if err := forgetObjectVersion(ctx, st.coverBucket, fn); err != nil {
+				log.Errorf(ctx, "Forgetting version of cover %q failed: %v", fn, err)
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+	}
+	if fn := r.FormValue("song"); fn != "" && st.songBucket != "" {
+		if err := forgetObjectVersion(ctx, st.songBucket, fn); err != nil {
+			log.Errorf(ctx, "Forgetting version of song %q failed: %v", fn, err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if err := instanceGen.Bump(ctx); err != nil {
+		log.Errorf(ctx, "Bumping cache generation failed: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeTextResponse(w, "ok")
+}
+
+func handleJobs(ctx context.Context, cfg *config.Config, w http.ResponseWriter, r *http.Request) {
+	list, err := jobs.List(ctx)
+	if err != nil {
+		log.Errorf(ctx, "Listing jobs failed: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSONResponse(w, list)
+}
+
+func handleMergeCandidates(ctx context.Context, cfg *config.Config, w http.ResponseWriter, r *http.Request) {
+	groups, err := dump.MergeCandidates(ctx)
+	if err != nil {
+		log.Errorf(ctx, "Finding merge candidates failed: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSONResponse(w, groups)
+}
+
+func handleMetrics(ctx context.Context, cfg *config.Config, w http.ResponseWriter, r *http.Request) {
+	// Make sure that this instance's latest metrics are included.
+	if err := metrics.Flush(ctx, true); err != nil {
+		log.Errorf(ctx, "Flushing metrics failed: %v", err)
+	}
+	var b bytes.Buffer
+	if err := metrics.Write(ctx, &b); err != nil {
+		log.Errorf(ctx, "Writing metrics failed: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(b.Bytes())
+}
+
+func handleMigrate(ctx context.Context, cfg *config.Config, w http.ResponseWriter, r *http.Request) {
+	// Updates would be better suited to POST than to GET, but App Engine cron uses GET.
+	if active, err := jobs.Active(ctx, jobs.MigrateJob); err != nil {
+		log.Errorf(ctx, "Checking for migration job failed: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	} else if active {
+		log.Debugf(ctx, "Migration job is already active")
+		writeTextResponse(w, "ok")
+		return
+	}
+	if _, err := jobs.Start(ctx, jobs.MigrateJob, "", ""); err != nil {
+		log.Errorf(ctx, "Starting migration job failed: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeTextResponse(w, "ok")
+}
+
+func handleNow(ctx context.Context, cfg *config.Config, w http.ResponseWriter, r *http.Request) {
+	writeTextResponse(w, strconv.FormatInt(time.Now().UnixNano(), 10))
+}
+
+// nowPlayingResult is written in response to /now_playing GET requests.
+type nowPlayingResult struct {
+	// Song contains the song being played. It is nil if nothing is being played.
+	Song *db.Song `json:"song,omitempty"`
+	// Position contains the estimated current playback position in seconds.
+	Position float64 `json:"position,omitempty"`
+	// Paused is true if playback is paused.
+	Paused bool `json:"paused,omitempty"`
+	// UpdateTime contains the time at which the state was last reported.
+	UpdateTime *time.Time `json:"updateTime,omitempty"`
+}
+
+func handleNowPlaying(ctx context.Context, cfg *config.Config, w http.ResponseWriter, r *http.Request) {
+	_, name := cfg.GetUser(r)
+
+	if r.Method == http.MethodPost {
+		// Playback was stopped if no song was supplied.
+		if r.FormValue("songId") == "" {
+			if err := nowplaying.Delete(ctx, name); err != nil {
+				log.Errorf(ctx, "Deleting now-playing state for %q failed: %v", name, err)
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			writeTextResponse(w, "ok")
+			return
+		}
+		st := nowplaying.State{
+			Paused:     r.FormValue("paused") == "1",
+			UpdateTime: time.Now(),
+		}
+		var ok bool
+		if st.SongID, ok = parseIntParam(ctx, w, r, "songId"); !ok {
+			return
+		}
+		if r.FormValue("position") != "" {
+			if st.Position, ok = parseFloatParam(ctx, w, r, "position"); !ok {
+				return
+			}
+		}
+		if err := nowplaying.Put(ctx, name, &st); err != nil {
+			log.Errorf(ctx, "Saving now-playing state for %q failed: %v", name, err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeTextResponse(w, "ok")
+		return
+	}
+
+	st, err := nowplaying.Get(ctx, name)
+	if err != nil {
+		log.Errorf(ctx, "Getting now-playing state for %q failed: %v", name, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var res nowPlayingResult
+	if st != nil {
+		songs, err := query.SongsByID(ctx, []int64{st.SongID})
+		if err != nil {
+			log.Errorf(ctx, "Getting song %v failed: %v", st.SongID, err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		// Report nothing if the song was deleted or if the state is stale.
+		now := time.Now()
+		if s := songs[0]; s != nil && !getExcludedTags(cfg, r).hides(s) && canAccessSong(cfg, r, s) &&
+			st.Active(now, s.Length) {
+			res = nowPlayingResult{
+				Song:       s,
+				Position:   st.CurrentPosition(now, s.Length),
+				Paused:     st.Paused,
+				UpdateTime: &st.UpdateTime,
+			}
+		}
+	}
+	writeJSONResponse(w, res)
+}
+
+func handleOEmbed(ctx context.Context, cfg *config.Config, w http.ResponseWriter, r *http.Request) {
+	if cfg.ShareSecret == "" {
+		http.Error(w, "Sharing disabled", http.StatusNotFound)
+		return
+	}
+	if f := r.FormValue("format"); f != "" && f != "json" {
+		http.Error(w, "Unsupported format", http.StatusNotImplemented)
+		return
+	}
+	kind, id, exp, err := share.ParsePageURL(cfg.ShareSecret, cfg.ShareKeyGeneration,
+		r.FormValue("url"), time.Now())
+	if err != nil {
+		log.Errorf(ctx, "Rejecting oEmbed request for %q: %v", r.FormValue("url"), err)
+		http.Error(w, "Invalid share link", http.StatusNotFound)
+		return
+	}
+	info, err := getShareInfo(ctx, cfg, kind, id, exp)
+	if err != nil {
+		log.Errorf(ctx, "Getting shared %v %q failed: %v", kind, id, err)
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	writeJSONResponse(w, share.NewOEmbed(info))
+}
+
+func handlePin(ctx context.Context, cfg *config.Config, w http.ResponseWriter, r *http.Request) {
+	strs := strings.FieldsFunc(r.FormValue("songIds"), func(r rune) bool { return r == ',' || r == ' ' })
+	if len(strs) == 0 {
+		http.Error(w, "Missing song IDs", http.StatusBadRequest)
+		return
+	} else if len(strs) > pin.MaxSongs {
+		http.Error(w, fmt.Sprintf("Too many IDs (max %d)", pin.MaxSongs), http.StatusBadRequest)
+		return
+	}
+	ids := make([]int64, len(strs))
+	for i, str := range strs {
+		var err error
+		if ids[i], err = strconv.ParseInt(str, 10, 64); err != nil {
+			http.Error(w, fmt.Sprintf("Bad ID %q", str), http.StatusBadRequest)
+			return
+		}
+	}
+	unpin := r.FormValue("unpin") == "1"
+
+	// Look up the songs' filenames so that /song requests can be checked against the pins.
+	var songs []*db.Song
+	if !unpin {
+		var err error
+		if songs, err = query.SongsByID(ctx, ids); err != nil {
+			log.Errorf(ctx, "Getting %d song(s) by ID failed: %v", len(ids), err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		excluded := getExcludedTags(cfg, r)
+		for i, s := range songs {
+			if s == nil || excluded.hides(s) || !canAccessSong(cfg, r, s) {
+				http.Error(w, fmt.Sprintf("Song %d not found", ids[i]), http.StatusNotFound)
+				return
+			}
+		}
+	}
+
+	_, name := cfg.GetUser(r)
+	p, err := pin.Update(ctx, name, time.Now(), func(p *pin.Pins) error {
+		for i, id := range ids {
+			if unpin {
+				p.Remove(id)
+			} else {
+				p.Add(id, songs[i].Filename)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Errorf(ctx, "Updating pins for %q failed: %v", name, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSONResponse(w, struct {
+		SongIDs []int64 `json:"songIds"`
+	}{p.SongIDs})
+}
+
+func handlePinned(ctx context.Context, cfg *config.Config, w http.ResponseWriter, r *http.Request) {
+	_, name := cfg.GetUser(r)
+	p, err := pin.Get(ctx, name)
+	if err != nil {
+		log.Errorf(ctx, "Getting pins for %q failed: %v", name, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	songs, err := query.SongsByID(ctx, p.SongIDs)
+	if err != nil {
+		log.Errorf(ctx, "Getting %d pinned song(s) failed: %v", len(p.SongIDs), err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// Skip songs that have been deleted since they were pinned (or that have excluded tags
+	// or are in inaccessible libraries).
+	excluded := getExcludedTags(cfg, r)
+	valid := make([]*db.Song, 0, len(songs))
+	for _, s := range songs {
+		if s != nil && !excluded.hides(s) && canAccessSong(cfg, r, s) {
+			valid = append(valid, s)
+		}
+	}
+	res := struct {
+		Songs      []*db.Song `json:"songs"`
+		UpdateTime *time.Time `json:"updateTime,omitempty"`
+	}{Songs: valid}
+	if !p.UpdateTime.IsZero() {
+		res.UpdateTime = &p.UpdateTime
+	}
+	writeJSONResponse(w, res)
+}
+
+func handlePlayed(ctx context.Context, cfg *config.Config, w http.ResponseWriter, r *http.Request) {
+	id, ok := parseIntParam(ctx, w, r, "songId")
 	if !ok {
 		return
 	}
@@ -399,192 +1268,1248 @@ func handlePlayed(ctx context.Context, cfg *config.Config, w http.ResponseWriter
 	if !ok {
 		return
 	}
+	prevID, ok := parsePrevSongID(ctx, w, r)
+	if !ok {
+		return
+	}
 
-	if forceUpdateFailures && appengine.IsDevAppServer() {
-		http.Error(w, "Returning an error, as requested", http.StatusInternalServerError)
+	if !checkSongAccess(ctx, cfg, w, r, id) {
 		return
 	}
 
-	// SplitHostPort removes brackets for us.
-	ip, _, err := net.SplitHostPort(r.RemoteAddr)
-	if err != nil {
-		// Drop the trailing colon and port number. We can't just split on ':' and
-		// take the first item since we may get an IPv6 address like "[::1]:12345".
-		ip = regexp.MustCompile(":\\d+$").ReplaceAllString(r.RemoteAddr, "")
+	if forceUpdateFailures && appengine.IsDevAppServer() {
+		http.Error(w, "Returning an error, as requested", http.StatusInternalServerError)
+		return
 	}
 
-	if err := update.AddPlay(ctx, id, startTime, ip); err != nil {
+	_, user := cfg.GetUser(r)
+	if err := update.AddPlay(ctx, id, startTime, requestIP(r), user); err != nil {
 		log.Errorf(ctx, "Recording play of %v at %v failed: %v", id, startTime, err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
+	recordTransition(ctx, prevID, id, startTime, false, user)
 	writeTextResponse(w, "ok")
 }
 
-func handlePresets(ctx context.Context, cfg *config.Config, w http.ResponseWriter, r *http.Request) {
-	presets := cfg.Presets
-	if user, _ := cfg.GetUser(r); user != nil && len(user.Presets) > 0 {
-		presets = user.Presets
+// parsePrevSongID parses the optional prevSongId parameter from r.
+// 0 is returned if the parameter wasn't supplied. If the parameter is unparseable,
+// an error is written to w and the ok return value is false.
+func parsePrevSongID(ctx context.Context, w http.ResponseWriter, r *http.Request) (id int64, ok bool) {
+	if r.FormValue("prevSongId") == "" {
+		return 0, true
 	}
-	writeJSONResponse(w, presets)
+	return parseIntParam(ctx, w, r, "prevSongId")
 }
 
-func handleQuery(ctx context.Context, cfg *config.Config, w http.ResponseWriter, r *http.Request) {
-	var flags query.SongsFlags
-	if r.FormValue("cacheOnly") == "1" {
-		flags |= query.CacheOnly
+// recordTransition records that user started the song identified by next at startTime
+// after the song identified by prev. Nothing is done if prev is 0. Errors are logged
+// but otherwise ignored, since transitions are only used to improve shuffling.
+func recordTransition(ctx context.Context, prev, next int64, startTime time.Time, skipped bool, user string) {
+	if prev == 0 || prev == next {
+		return
 	}
-	if v := r.FormValue("fallback"); v == "force" {
-		flags |= query.ForceFallback
-	} else if v == "never" {
-		flags |= query.NoFallback
+	if err := stats.RecordTransition(ctx, prev, next, startTime, skipped, user); err != nil {
+		log.Errorf(ctx, "Recording transition from %v to %v failed: %v", prev, next, err)
 	}
+}
 
-	q := query.SongQuery{
-		Artist:               r.FormValue("artist"),
-		Title:                r.FormValue("title"),
-		Album:                r.FormValue("album"),
-		AlbumID:              r.FormValue("albumId"),
-		Filename:             r.FormValue("filename"),
-		Keywords:             strings.Fields(r.FormValue("keywords")),
-		MaxPlays:             -1,
-		Shuffle:              r.FormValue("shuffle") == "1",
-		OrderByLastStartTime: r.FormValue("orderByLastPlayed") == "1",
+// requestIP returns the IP address from which r was sent.
+func requestIP(r *http.Request) string {
+	// SplitHostPort removes brackets for us.
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		// Drop the trailing colon and port number. We can't just split on ':' and
+		// take the first item since we may get an IPv6 address like "[::1]:12345".
+		ip = regexp.MustCompile(":\\d+$").ReplaceAllString(r.RemoteAddr, "")
 	}
+	return ip
+}
 
-	if r.FormValue("firstTrack") == "1" {
-		q.Track = 1
-		q.Disc = 1
-	}
+// playedBatchResult is written in response to /played_batch requests.
+type playedBatchResult struct {
+	// Added contains the number of plays that were added.
+	Added int `json:"added"`
+	// Duplicates contains the number of plays that were already present.
+	Duplicates int `json:"duplicates"`
+	// MissingSongs contains the IDs of nonexistent songs. Their plays were dropped.
+	MissingSongs []string `json:"missingSongs,omitempty"`
+}
 
-	if r.FormValue("rating") != "" {
-		if v, ok := parseIntParam(ctx, w, r, "rating"); !ok {
+func handlePlayedBatch(ctx context.Context, cfg *config.Config, w http.ResponseWriter, r *http.Request) {
+	utype, user := cfg.GetUserType(r)
+	reqIP := requestIP(r)
+
+	// Group the plays by song so each song only needs to be updated once per chunk.
+	plays := make(map[int64][]db.Play)
+	var ids []int64
+	numPlays := 0
+	d := json.NewDecoder(r.Body)
+	for {
+		var pd db.PlayDump
+		if err := d.Decode(&pd); err == io.EOF {
+			break
+		} else if err != nil {
+			log.Errorf(ctx, "Decode play failed: %v", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
-		} else {
-			q.Rating = int(v)
 		}
-	} else if r.FormValue("minRating") != "" {
-		if v, ok := parseIntParam(ctx, w, r, "minRating"); !ok {
+		if numPlays++; numPlays > maxPlayedBatchSize {
+			http.Error(w, fmt.Sprintf("Too many plays (max %d)", maxPlayedBatchSize), http.StatusBadRequest)
 			return
-		} else {
-			q.MinRating = int(v)
 		}
-	} else if r.FormValue("maxRating") != "" {
-		if v, ok := parseIntParam(ctx, w, r, "maxRating"); !ok {
+		id, err := strconv.ParseInt(pd.SongID, 10, 64)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Bad song ID %q", pd.SongID), http.StatusBadRequest)
 			return
-		} else {
-			q.MaxRating = int(v)
 		}
-	} else if r.FormValue("unrated") == "1" {
-		q.Unrated = true
+		if pd.Play.StartTime.IsZero() {
+			http.Error(w, fmt.Sprintf("Missing start time for song %v", id), http.StatusBadRequest)
+			return
+		}
+		// Only admins can record plays on behalf of other users.
+		if pd.Play.User == "" || utype != config.AdminUser {
+			pd.Play.User = user
+		}
+		if pd.Play.IPAddress == "" {
+			pd.Play.IPAddress = reqIP
+		}
+		if _, ok := plays[id]; !ok {
+			ids = append(ids, id)
+		}
+		plays[id] = append(plays[id], pd.Play)
 	}
 
-	if len(r.FormValue("maxPlays")) > 0 {
-		var ok bool
-		if q.MaxPlays, ok = parseIntParam(ctx, w, r, "maxPlays"); !ok {
+	if forceUpdateFailures && appengine.IsDevAppServer() {
+		http.Error(w, "Returning an error, as requested", http.StatusInternalServerError)
+		return
+	}
+
+	var res playedBatchResult
+
+	// Report songs in inaccessible libraries as missing.
+	if !canAccessAllLibraries(cfg, r) {
+		songs, err := query.SongsByID(ctx, ids)
+		if err != nil {
+			log.Errorf(ctx, "Getting %d song(s) by ID failed: %v", len(ids), err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
+		var num int
+		for i, s := range songs {
+			if s != nil && canAccessSong(cfg, r, s) {
+				ids[num] = ids[i]
+				num++
+			} else {
+				res.MissingSongs = append(res.MissingSongs, strconv.FormatInt(ids[i], 10))
+			}
+		}
+		ids = ids[:num]
 	}
 
-	for name, dst := range map[string]*time.Time{
-		"minDate":        &q.MinDate,
-		"maxDate":        &q.MaxDate,
-		"minFirstPlayed": &q.MinFirstStartTime,
-		"maxLastPlayed":  &q.MaxLastStartTime,
-	} {
-		if len(r.FormValue(name)) > 0 {
-			var ok bool
-			if *dst, ok = parseDateParam(ctx, w, r, name); !ok {
+	for _, id := range ids {
+		sp := plays[id]
+		for len(sp) > 0 {
+			n := len(sp)
+			if n > playedBatchTxnSize {
+				n = playedBatchTxnSize
+			}
+			added, err := update.AddPlays(ctx, id, sp[:n])
+			if err == datastore.ErrNoSuchEntity {
+				res.MissingSongs = append(res.MissingSongs, strconv.FormatInt(id, 10))
+				break
+			} else if err != nil {
+				log.Errorf(ctx, "Recording %d play(s) of %v failed: %v", n, id, err)
+				http.Error(w, err.Error(), http.StatusInternalServerError)
 				return
 			}
+			res.Added += added
+			res.Duplicates += n - added
+			sp = sp[n:]
+		}
+	}
+	log.Debugf(ctx, "Added %d play(s) with %d duplicate(s) and %d missing song(s)",
+		res.Added, res.Duplicates, len(res.MissingSongs))
+	if res.Added > 0 {
+		recordAudit(ctx, cfg, r, 0, "", fmt.Sprintf("imported %d play(s)", res.Added))
+	}
+	writeJSONResponse(w, res)
+}
+
+func handlePlays(ctx context.Context, cfg *config.Config, w http.ResponseWriter, r *http.Request) {
+	var max int64 = defaultPlaysBatchSize
+	if r.FormValue("max") != "" {
+		var ok bool
+		if max, ok = parseIntParam(ctx, w, r, "max"); !ok {
+			return
+		} else if max <= 0 {
+			log.Errorf(ctx, "Invalid max %v", max)
+			http.Error(w, "Invalid max", http.StatusBadRequest)
+			return
 		}
 	}
+	if max > maxPlaysBatchSize {
+		max = maxPlaysBatchSize
+	}
 
-	for _, t := range strings.Fields(r.FormValue("tags")) {
-		if t[0] == '-' {
-			q.NotTags = append(q.NotTags, t[1:len(t)])
-		} else {
-			q.Tags = append(q.Tags, t)
+	var songID int64
+	if r.FormValue("songId") != "" {
+		var ok bool
+		if songID, ok = parseIntParam(ctx, w, r, "songId"); !ok {
+			return
+		}
+	}
+	var minStart, maxStart time.Time
+	if r.FormValue("minStartTime") != "" {
+		var ok bool
+		if minStart, ok = parseDateParam(ctx, w, r, "minStartTime"); !ok {
+			return
+		}
+	}
+	if r.FormValue("maxStartTime") != "" {
+		var ok bool
+		if maxStart, ok = parseDateParam(ctx, w, r, "maxStartTime"); !ok {
+			return
+		}
+	}
+
+	// Only return the requesting user's own plays.
+	_, user := cfg.GetUser(r)
+	plays, nextCursor, err := dump.PlayHistory(ctx, max, r.FormValue("cursor"), user,
+		songID, minStart, maxStart)
+	if err != nil {
+		log.Errorf(ctx, "Getting play history failed: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	excluded := getExcludedTags(cfg, r)
+	var num int
+	for _, p := range plays {
+		if !excluded.hides(&p.Song) && canAccessSong(cfg, r, &p.Song) {
+			plays[num] = p
+			num++
+		}
+	}
+	plays = plays[:num]
+	writeJSONResponse(w, struct {
+		Plays  []dump.HistoryPlay `json:"plays"`
+		Cursor string             `json:"cursor,omitempty"`
+	}{plays, nextCursor})
+}
+
+func handlePrecacheManifest(ctx context.Context, cfg *config.Config, w http.ResponseWriter, r *http.Request) {
+	minify := cfg.Minify == nil || *cfg.Minify
+	m, err := getPrecacheManifest(minify)
+	if err != nil {
+		log.Errorf(ctx, "Getting precache manifest failed: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSONResponseWithETag(w, r, m)
+}
+
+func handlePresets(ctx context.Context, cfg *config.Config, w http.ResponseWriter, r *http.Request) {
+	presets := cfg.Presets
+	if user, _ := cfg.GetUser(r); user != nil && len(user.Presets) > 0 {
+		presets = user.Presets
+	}
+	writeJSONResponse(w, presets)
+}
+
+func handlePurgeDeletedSong(ctx context.Context, cfg *config.Config, w http.ResponseWriter, r *http.Request) {
+	id, ok := parseIntParam(ctx, w, r, "songId")
+	if !ok {
+		return
+	}
+	if err := update.PurgeDeletedSong(ctx, id); err != nil {
+		log.Errorf(ctx, "Purging deleted song %v failed: %v", id, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeTextResponse(w, "ok")
+}
+
+func handlePurgeTrash(ctx context.Context, cfg *config.Config, w http.ResponseWriter, r *http.Request) {
+	if cfg.TrashRetentionDays <= 0 {
+		writeTextResponse(w, "ok")
+		return
+	}
+	before := time.Now().Add(-time.Duration(cfg.TrashRetentionDays) * 24 * time.Hour)
+	n, err := update.PurgeDeletedSongs(ctx, before)
+	if err != nil {
+		log.Errorf(ctx, "Purging trash failed after %d song(s): %v", n, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Debugf(ctx, "Purged %d deleted song(s)", n)
+	writeTextResponse(w, "ok")
+}
+
+func handleQuery(ctx context.Context, cfg *config.Config, w http.ResponseWriter, r *http.Request) {
+	// Unauthenticated requests with access tokens (already verified by addHandler) receive
+	// the token's songs regardless of the other parameters.
+	if utype, _ := cfg.GetUserType(r); utype == 0 && r.FormValue(share.AccessParam) != "" {
+		a, ok := parseAccessToken(ctx, cfg, w, r)
+		if !ok {
+			return
+		}
+		if songs, ok := getAccessSongs(ctx, cfg, w, r, a); ok {
+			writeJSONResponseWithETag(w, r, songs)
+		}
+		return
+	}
+
+	if artist, albumID := r.FormValue("radioArtist"), r.FormValue("radioAlbumId"); artist != "" || albumID != "" {
+		handleRadioQuery(ctx, cfg, w, r, query.RadioSeed{Artist: artist, AlbumID: albumID})
+		return
+	}
+
+	var flags query.SongsFlags
+	if r.FormValue("cacheOnly") == "1" {
+		flags |= query.CacheOnly
+	}
+	if v := r.FormValue("fallback"); v == "force" {
+		flags |= query.ForceFallback
+	} else if v == "never" {
+		flags |= query.NoFallback
+	}
+
+	q, ok := parseSongQuery(ctx, cfg, w, r)
+	if !ok {
+		return
+	}
+	if etag, err := query.ResultsETag(ctx, q, flags); err != nil {
+		// Just serve the results without an ETag.
+		log.Errorf(ctx, "Unable to get ETag for query: %v", err)
+	} else if etag != "" && checkETag(w, r, etag) {
+		recordPresetUse(ctx, cfg, r)
+		return
+	}
+	songs, err := query.Songs(ctx, q, flags)
+	if err != nil {
+		log.Errorf(ctx, "Unable to query songs: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSONResponse(w, songs)
+	recordPresetUse(ctx, cfg, r)
+}
+
+// recordPresetUse records the preset that the web interface used for a /query request (if any)
+// so unused presets can be identified.
+func recordPresetUse(ctx context.Context, cfg *config.Config, r *http.Request) {
+	if name := r.FormValue("preset"); name != "" {
+		if user, uname := cfg.GetUser(r); user != nil && user.FindPreset(name, cfg.Presets) != nil {
+			if err := stats.RecordPresetUse(ctx, uname, name, time.Now()); err != nil {
+				log.Errorf(ctx, "Recording use of preset %q by %q failed: %v", name, uname, err)
+			}
+		}
+	}
+}
+
+// handleRadioQuery handles a /query request with the radioArtist or radioAlbumId parameter.
+func handleRadioQuery(ctx context.Context, cfg *config.Config, w http.ResponseWriter,
+	r *http.Request, seed query.RadioSeed) {
+	lib, ok := getLibrary(ctx, cfg, w, r)
+	if !ok {
+		return
+	}
+	var notTags []string
+	if user, _ := cfg.GetUser(r); user != nil {
+		notTags = user.ExcludedTags
+	}
+	songs, err := query.RadioSongs(ctx, seed, notTags, lib, time.Now())
+	if err != nil {
+		log.Errorf(ctx, "Unable to get radio songs: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSONResponse(w, songs)
+}
+
+// expandQueryTags expands q's tags to include their aliases and descendants.
+// If the tag rules can't be loaded, an error is written to w and false is returned.
+func expandQueryTags(ctx context.Context, w http.ResponseWriter, q *query.SongQuery) bool {
+	if len(q.Tags) == 0 && len(q.NotTags) == 0 {
+		return true
+	}
+	rules, err := tagrules.Get(ctx)
+	if err != nil {
+		log.Errorf(ctx, "Getting tag rules failed: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return false
+	}
+	q.ExpandTags(rules)
+	return true
+}
+
+// parseSongQuery creates a SongQuery from the /query parameters in r.
+// Tags excluded for the requesting user are added to NotTags.
+// If the myPlays parameter is 1, play-based filters are scoped to the requesting user.
+// If a parameter is unparseable, an error is written to w and the ok return value is false.
+func parseSongQuery(ctx context.Context, cfg *config.Config, w http.ResponseWriter,
+	r *http.Request) (q *query.SongQuery, ok bool) {
+	q = &query.SongQuery{
+		Artist:               r.FormValue("artist"),
+		Title:                r.FormValue("title"),
+		Album:                r.FormValue("album"),
+		AlbumID:              r.FormValue("albumId"),
+		Filename:             r.FormValue("filename"),
+		MaxPlays:             -1,
+		Compilation:          r.FormValue("compilation") == "1",
+		IncompleteAlbums:     r.FormValue("incompleteAlbums") == "1",
+		Shuffle:              r.FormValue("shuffle") == "1" || r.FormValue("shuffle") == "transitions",
+		PreferTransitions:    r.FormValue("shuffle") == "transitions",
+		ShuffleAlbums:        r.FormValue("shuffleAlbums") == "1",
+		OrderByLastStartTime: r.FormValue("orderByLastPlayed") == "1",
+		PlayDecay:            time.Duration(cfg.PlayDecayDays * float64(24*time.Hour)),
+	}
+
+	if err := q.ParseKeywords(r.FormValue("keywords")); err != nil {
+		log.Errorf(ctx, "Invalid keywords param: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+	var err error
+	if q.KeywordMatch, err = query.ParseKeywordMatch(r.FormValue("keywordMatch")); err != nil {
+		log.Errorf(ctx, "Invalid keywordMatch param: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+	if q.DateField, err = query.ParseDateField(r.FormValue("dateField")); err != nil {
+		log.Errorf(ctx, "Invalid dateField param: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+
+	if r.FormValue("firstTrack") == "1" {
+		q.Track = 1
+		q.Disc = 1
+	}
+
+	if r.FormValue("rating") != "" {
+		if v, ok := parseIntParam(ctx, w, r, "rating"); !ok {
+			return nil, false
+		} else {
+			q.Rating = int(v)
+		}
+	} else if r.FormValue("minRating") != "" {
+		if v, ok := parseIntParam(ctx, w, r, "minRating"); !ok {
+			return nil, false
+		} else {
+			q.MinRating = int(v)
+		}
+	} else if r.FormValue("maxRating") != "" {
+		if v, ok := parseIntParam(ctx, w, r, "maxRating"); !ok {
+			return nil, false
+		} else {
+			q.MaxRating = int(v)
+		}
+	} else if r.FormValue("unrated") == "1" {
+		q.Unrated = true
+	}
+
+	if len(r.FormValue("maxPlays")) > 0 {
+		if q.MaxPlays, ok = parseIntParam(ctx, w, r, "maxPlays"); !ok {
+			return nil, false
+		}
+	}
+	for name, dst := range map[string]*float64{
+		"minSkipRatio": &q.MinSkipRatio,
+		"maxSkipRatio": &q.MaxSkipRatio,
+		"minBPM":       &q.MinBPM,
+		"maxBPM":       &q.MaxBPM,
+	} {
+		if len(r.FormValue(name)) > 0 {
+			if *dst, ok = parseFloatParam(ctx, w, r, name); !ok {
+				return nil, false
+			}
+		}
+	}
+
+	for name, dst := range map[string]*time.Time{
+		"minDate":        &q.MinDate,
+		"maxDate":        &q.MaxDate,
+		"minFirstPlayed": &q.MinFirstStartTime,
+		"maxLastPlayed":  &q.MaxLastStartTime,
+	} {
+		if len(r.FormValue(name)) > 0 {
+			if *dst, ok = parseDateParam(ctx, w, r, name); !ok {
+				return nil, false
+			}
+		}
+	}
+
+	for _, t := range strings.Fields(r.FormValue("tags")) {
+		if t[0] == '-' {
+			q.NotTags = append(q.NotTags, t[1:len(t)])
+		} else {
+			q.Tags = append(q.Tags, t)
+		}
+	}
+	for _, g := range r.Form["genre"] {
+		if strings.HasPrefix(g, "-") {
+			q.NotGenres = append(q.NotGenres, g[1:])
+		} else if g != "" {
+			q.Genres = append(q.Genres, g)
+		}
+	}
+	user, name := cfg.GetUser(r)
+	if user != nil && len(user.ExcludedTags) > 0 {
+		q.NotTags = append(q.NotTags, user.ExcludedTags...)
+	}
+	if !expandQueryTags(ctx, w, q) {
+		return nil, false
+	}
+	if r.FormValue("myPlays") == "1" {
+		if name == "" {
+			log.Errorf(ctx, "Rejecting myPlays from unidentified user")
+			http.Error(w, "myPlays requires an identified user", http.StatusBadRequest)
+			return nil, false
+		}
+		q.PlaysUser = name
+	}
+
+	lib, ok := getLibrary(ctx, cfg, w, r)
+	if !ok {
+		return nil, false
+	}
+	if lib != "" {
+		q.Library = lib
+	} else {
+		q.NotLibraries = cfg.LibraryNames()
+	}
+
+	return q, true
+}
+
+func handleQueue(ctx context.Context, cfg *config.Config, w http.ResponseWriter, r *http.Request) {
+	_, name := cfg.GetUser(r)
+	q, err := queue.Get(ctx, name)
+	if err != nil {
+		log.Errorf(ctx, "Getting queue for %q failed: %v", name, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		saveQueue(ctx, w, r, name, q)
+		return
+	}
+
+	songs, err := query.SongsByID(ctx, q.SongIDs)
+	if err != nil {
+		log.Errorf(ctx, "Getting %d queued song(s) failed: %v", len(q.SongIDs), err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// Skip songs that have been deleted since the queue was saved (or that have excluded tags
+	// or are in inaccessible libraries).
+	excluded := getExcludedTags(cfg, r)
+	valid := make([]*db.Song, 0, len(songs))
+	keep := make([]bool, len(songs))
+	for i, s := range songs {
+		if s != nil && !excluded.hides(s) && canAccessSong(cfg, r, s) {
+			valid = append(valid, s)
+			keep[i] = true
+		}
+	}
+	index, pos := q.AdjustIndex(keep)
+	res := struct {
+		Songs      []*db.Song `json:"songs"`
+		Index      int        `json:"index,omitempty"`
+		Position   float64    `json:"position,omitempty"`
+		Device     string     `json:"device,omitempty"`
+		Preset     string     `json:"preset,omitempty"`
+		UpdateTime *time.Time `json:"updateTime,omitempty"`
+	}{Songs: valid, Index: index, Position: pos, Device: q.Device, Preset: q.Preset}
+	if !q.UpdateTime.IsZero() {
+		res.UpdateTime = &q.UpdateTime
+	}
+	writeJSONResponse(w, res)
+}
+
+// saveQueue handles a /queue POST request from the user identified by name,
+// replacing q (the user's existing queue) with the songs and position in r.
+func saveQueue(ctx context.Context, w http.ResponseWriter, r *http.Request, name string, q *queue.Queue) {
+	strs := strings.FieldsFunc(r.FormValue("songIds"), func(r rune) bool { return r == ',' || r == ' ' })
+	if len(strs) > maxQueueSize {
+		http.Error(w, fmt.Sprintf("Too many IDs (max %d)", maxQueueSize), http.StatusBadRequest)
+		return
+	}
+	// Preserve the schedule time so that the scheduled preset won't be reevaluated.
+	nq := queue.Queue{
+		SongIDs:      make([]int64, len(strs)),
+		Device:       r.FormValue("device"),
+		ScheduleTime: q.ScheduleTime,
+		UpdateTime:   time.Now(),
+	}
+	for i, str := range strs {
+		var err error
+		if nq.SongIDs[i], err = strconv.ParseInt(str, 10, 64); err != nil {
+			http.Error(w, fmt.Sprintf("Bad ID %q", str), http.StatusBadRequest)
+			return
+		}
+	}
+	if len(nq.Device) > maxQueueDeviceLen {
+		http.Error(w, fmt.Sprintf("Device too long (max %d)", maxQueueDeviceLen), http.StatusBadRequest)
+		return
+	}
+	if r.FormValue("index") != "" {
+		index, ok := parseIntParam(ctx, w, r, "index")
+		if !ok {
+			return
+		} else if index < 0 || (index > 0 && index >= int64(len(nq.SongIDs))) {
+			http.Error(w, "Index out of range", http.StatusBadRequest)
+			return
+		}
+		nq.Index = int(index)
+	}
+	if r.FormValue("position") != "" {
+		var ok bool
+		if nq.Position, ok = parseFloatParam(ctx, w, r, "position"); !ok {
+			return
+		} else if nq.Position < 0 {
+			http.Error(w, "Negative position", http.StatusBadRequest)
+			return
+		}
+	}
+	if err := queue.Put(ctx, name, &nq); err != nil {
+		log.Errorf(ctx, "Saving queue for %q failed: %v", name, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeTextResponse(w, "ok")
+}
+
+func handleRandom(ctx context.Context, cfg *config.Config, w http.ResponseWriter, r *http.Request) {
+	var max, minRating int64
+	var ok bool
+	if r.FormValue("max") != "" {
+		if max, ok = parseIntParam(ctx, w, r, "max"); !ok {
+			return
+		}
+	}
+	if r.FormValue("minRating") != "" {
+		if minRating, ok = parseIntParam(ctx, w, r, "minRating"); !ok {
+			return
+		}
+	}
+	var tags, notTags []string
+	for _, t := range strings.Fields(r.FormValue("tags")) {
+		if t[0] == '-' {
+			notTags = append(notTags, t[1:])
+		} else {
+			tags = append(tags, t)
+		}
+	}
+	if user, _ := cfg.GetUser(r); user != nil {
+		notTags = append(notTags, user.ExcludedTags...)
+	}
+	lib, ok := getLibrary(ctx, cfg, w, r)
+	if !ok {
+		return
+	}
+
+	songs, err := query.RandomSongs(ctx, int(max), int(minRating), tags, notTags, lib)
+	if err != nil {
+		log.Errorf(ctx, "Unable to get random songs: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSONResponse(w, songs)
+}
+
+func handleRateAndTag(ctx context.Context, cfg *config.Config, w http.ResponseWriter, r *http.Request) {
+	id, ok := parseIntParam(ctx, w, r, "songId")
+	if !ok {
+		return
+	}
+
+	var delay time.Duration
+	if len(r.FormValue("updateDelayNsec")) > 0 {
+		if ns, ok := parseIntParam(ctx, w, r, "updateDelayNsec"); !ok {
+			return
+		} else {
+			delay = time.Nanosecond * time.Duration(ns)
+		}
+	}
+
+	var hasRating bool
+	var rating int
+	var tags []string
+	if _, ok := r.Form["rating"]; ok {
+		if v, ok := parseIntParam(ctx, w, r, "rating"); !ok {
+			return
+		} else {
+			rating = int(v)
+		}
+		hasRating = true
+		if rating < 0 {
+			rating = 0
+		} else if rating > 5 {
+			rating = 5
+		}
+	}
+	if _, ok := r.Form["tags"]; ok {
+		tags = strings.Fields(r.FormValue("tags"))
+	}
+	_, hasNotes := r.Form["notes"]
+	notes := r.FormValue("notes")
+	if !hasRating && tags == nil && !hasNotes {
+		http.Error(w, "No rating, tags, or notes supplied", http.StatusBadRequest)
+		return
+	}
+
+	// If the client supplied the song's last-modified time, it wants to avoid overwriting
+	// concurrent updates and expects to receive the song's new state.
+	var ifLastModified time.Time
+	_, checkModified := r.Form["ifLastModifiedNsec"]
+	if checkModified {
+		if ns, ok := parseIntParam(ctx, w, r, "ifLastModifiedNsec"); !ok {
+			return
+		} else if ns > 0 {
+			ifLastModified = time.Unix(0, ns)
+		}
+	}
+
+	if !checkSongAccess(ctx, cfg, w, r, id) {
+		return
+	}
+
+	if forceUpdateFailures && appengine.IsDevAppServer() {
+		http.Error(w, "Returning an error, as requested", http.StatusInternalServerError)
+		return
+	}
+
+	before := songSummary(ctx, id)
+	song, err := update.SetRatingAndTags(ctx, id, hasRating, rating, tags,
+		hasNotes, notes, ifLastModified, delay)
+	if cerr, ok := err.(*update.ConflictError); ok {
+		log.Debugf(ctx, "Not rating/tagging song %d: %v", id, err)
+		query.CleanSong(cerr.Song, id)
+		b, err := json.Marshal(cerr.Song)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusConflict)
+		w.Write(b)
+		return
+	} else if err != nil {
+		log.Errorf(ctx, "Rating/tagging song %d failed: %v", id, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if after := audit.Summarize(song); after != before {
+		recordAudit(ctx, cfg, r, id, before, after)
+	}
+	if checkModified {
+		query.CleanSong(song, id)
+		writeJSONResponse(w, song)
+	} else {
+		writeTextResponse(w, "ok")
+	}
+}
+
+func handleRateLimitStatus(ctx context.Context, cfg *config.Config, w http.ResponseWriter, r *http.Request) {
+	statuses, err := ratelimit.GetStatus(ctx)
+	if err != nil {
+		log.Errorf(ctx, "Getting rate-limiting status failed: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSONResponse(w, statuses)
+}
+
+func handleReindex(ctx context.Context, cfg *config.Config, w http.ResponseWriter, r *http.Request) {
+	cursor, scanned, updated, err := update.ReindexSongs(ctx, r.FormValue("cursor"))
+	if err != nil {
+		log.Errorf(ctx, "Reindexing songs failed: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSONResponse(w, struct {
+		Scanned int    `json:"scanned"`
+		Updated int    `json:"updated"`
+		Cursor  string `json:"cursor"`
+	}{
+		scanned, updated, cursor,
+	})
+}
+
+func handleRevokeAPIToken(ctx context.Context, cfg *config.Config, w http.ResponseWriter, r *http.Request) {
+	id := r.FormValue("id")
+	if err := apitoken.Revoke(ctx, id); err == apitoken.ErrNotFound {
+		http.Error(w, "Token not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Errorf(ctx, "Revoking API token %v failed: %v", id, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeTextResponse(w, "ok")
+}
+
+func handleRunJob(ctx context.Context, cfg *config.Config, w http.ResponseWriter, r *http.Request) {
+	id, ok := parseIntParam(ctx, w, r, "id")
+	if !ok {
+		return
+	}
+	if err := jobs.Run(ctx, id); err != nil {
+		log.Errorf(ctx, "Running job %v failed: %v", id, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeTextResponse(w, "ok")
+}
+
+func handleScheduledPresets(ctx context.Context, cfg *config.Config, w http.ResponseWriter, r *http.Request) {
+	// Find the most-recently-scheduled preset that's due for each user.
+	now := time.Now()
+	due := make(map[string]*config.ScheduledPreset)
+	dueTimes := make(map[string]time.Time)
+	for i := range cfg.ScheduledPresets {
+		sp := &cfg.ScheduledPresets[i]
+		loc, err := sp.Location()
+		if err != nil {
+			log.Errorf(ctx, "Bad time zone for scheduled preset %q: %v", sp.Preset, err)
+			continue
+		}
+		t, err := queue.LastScheduledTime(sp.Times, loc, now)
+		if err != nil {
+			log.Errorf(ctx, "Bad times for scheduled preset %q: %v", sp.Preset, err)
+			continue
+		}
+		// Don't evaluate stale schedules, e.g. after the config was just updated.
+		if now.Sub(t) > maxScheduledPresetDelay {
+			continue
+		}
+		if last, ok := dueTimes[sp.User]; !ok || t.After(last) {
+			due[sp.User] = sp
+			dueTimes[sp.User] = t
+		}
+	}
+
+	var updated []string
+	for name, sp := range due {
+		q, err := queue.Get(ctx, name)
+		if err != nil {
+			log.Errorf(ctx, "Getting queue for %q failed: %v", name, err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		schedTime := dueTimes[name]
+		if !schedTime.After(q.ScheduleTime) {
+			continue // already evaluated
+		}
+
+		user := cfg.UserByName(name)
+		if user == nil {
+			log.Errorf(ctx, "Unknown user %q for scheduled preset %q", name, sp.Preset)
+			continue
+		}
+		preset := user.FindPreset(sp.Preset, cfg.Presets)
+		if preset == nil {
+			log.Errorf(ctx, "Unknown preset %q for %q", sp.Preset, name)
+			continue
+		}
+		sq := presetQuery(preset, now)
+		sq.NotTags = append(sq.NotTags, user.ExcludedTags...)
+		if user.Library != "" {
+			sq.Library = user.Library
+		} else {
+			sq.NotLibraries = cfg.LibraryNames()
+		}
+		songs, err := query.Songs(ctx, sq, 0)
+		if err != nil {
+			log.Errorf(ctx, "Evaluating preset %q for %q failed: %v", sp.Preset, name, err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		nq := queue.Queue{Preset: sp.Preset, ScheduleTime: schedTime, UpdateTime: now}
+		for _, s := range songs {
+			id, err := strconv.ParseInt(s.SongID, 10, 64)
+			if err != nil {
+				log.Errorf(ctx, "Bad song ID %q: %v", s.SongID, err)
+				continue
+			}
+			nq.SongIDs = append(nq.SongIDs, id)
+		}
+		if err := queue.Put(ctx, name, &nq); err != nil {
+			log.Errorf(ctx, "Saving queue for %q failed: %v", name, err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		log.Debugf(ctx, "Queued %d song(s) from preset %q for %q", len(nq.SongIDs), sp.Preset, name)
+		updated = append(updated, name)
+	}
+	sort.Strings(updated)
+	writeJSONResponse(w, struct {
+		Users []string `json:"users"`
+	}{updated})
+}
+
+// maxConfigSize is the maximum size in bytes of configs accepted by /server_config.
+const maxConfigSize = 1024 * 1024
+
+func handleServerConfig(ctx context.Context, cfg *config.Config, w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		saved, err := config.LoadSaved(ctx)
+		if err != nil {
+			log.Errorf(ctx, "Loading config failed: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSONResponse(w, struct {
+			Version     int64           `json:"version"`
+			UpdatedTime time.Time       `json:"updatedTime"`
+			Config      json.RawMessage `json:"config"`
+		}{saved.Version, saved.UpdatedTime, json.RawMessage(saved.JSON)})
+		return
+	}
+
+	version := int64(-1)
+	if r.FormValue("version") != "" {
+		var ok bool
+		if version, ok = parseIntParam(ctx, w, r, "version"); !ok {
+			return
+		}
+	}
+	data, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxConfigSize))
+	if err != nil {
+		log.Errorf(ctx, "Reading config failed: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	newCfg, err := config.Parse(data)
+	if err != nil {
+		log.Errorf(ctx, "Rejecting bad config: %v", err)
+		http.Error(w, fmt.Sprintf("Bad config: %v", err), http.StatusBadRequest)
+		return
+	}
+	// Make sure that the user won't lock themselves out.
+	_, name := cfg.GetUserType(r)
+	if u := newCfg.UserByName(name); u == nil || !u.Admin {
+		log.Errorf(ctx, "Rejecting config without admin user %q", name)
+		http.Error(w, fmt.Sprintf("Config doesn't contain admin user %q", name), http.StatusBadRequest)
+		return
+	}
+
+	newVersion, err := config.Save(ctx, data, version)
+	if errors.Is(err, config.ErrVersionMismatch) {
+		log.Errorf(ctx, "Rejecting config: %v", err)
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	} else if err != nil {
+		log.Errorf(ctx, "Saving config failed: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Infof(ctx, "Saved config version %v", newVersion)
+	recordAudit(ctx, cfg, r, 0, fmt.Sprintf("config version %d", cfg.Version),
+		fmt.Sprintf("config version %d", newVersion))
+
+	// Make all instances reload the config.
+	if err := instanceGen.Bump(ctx); err != nil {
+		log.Errorf(ctx, "Bumping cache generation failed: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSONResponse(w, struct {
+		Version int64 `json:"version"`
+	}{newVersion})
+}
+
+func handleSettings(ctx context.Context, cfg *config.Config, w http.ResponseWriter, r *http.Request) {
+	_, name := cfg.GetUser(r)
+
+	var s *settings.Settings
+	var err error
+	if r.Method == http.MethodPut {
+		data, err := ioutil.ReadAll(io.LimitReader(r.Body, settings.MaxSize+1))
+		if err != nil {
+			log.Errorf(ctx, "Reading settings for %q failed: %v", name, err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := settings.Validate(data); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if s, err = settings.Put(ctx, name, data, time.Now()); err != nil {
+			log.Errorf(ctx, "Saving settings for %q failed: %v", name, err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	} else if s, err = settings.Get(ctx, name); err != nil {
+		log.Errorf(ctx, "Getting settings for %q failed: %v", name, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var res struct {
+		Settings   json.RawMessage `json:"settings,omitempty"`
+		UpdateTime *time.Time      `json:"updateTime,omitempty"`
+	}
+	if s != nil {
+		res.Settings = s.Data
+		res.UpdateTime = &s.UpdateTime
+	}
+	writeJSONResponse(w, res)
+}
+
+func handleShare(ctx context.Context, cfg *config.Config, w http.ResponseWriter, r *http.Request) {
+	kind, id, exp, ok := parseShareParams(ctx, cfg, w, r)
+	if !ok {
+		return
+	}
+	info, err := getShareInfo(ctx, cfg, kind, id, exp)
+	if err != nil {
+		log.Errorf(ctx, "Getting shared %v %q failed: %v", kind, id, err)
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	var b bytes.Buffer
+	if err := share.RenderPage(&b, info); err != nil {
+		log.Errorf(ctx, "Rendering share page failed: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(b.Bytes())
+}
+
+func handleShareCover(ctx context.Context, cfg *config.Config, w http.ResponseWriter, r *http.Request) {
+	kind, id, _, ok := parseShareParams(ctx, cfg, w, r)
+	if !ok {
+		return
+	}
+	s, err := getShareSong(ctx, kind, id)
+	if err != nil || s.CoverFilename == "" {
+		log.Errorf(ctx, "Getting cover for shared %v %q failed: %v", kind, id, err)
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	// cover.Scale will set the Content-Type header.
+	addCacheHeaders(w, cfg.Cache.CoverSec)
+	st := getLibraryStorage(cfg, s.Library)
+	if err := cover.Scale(ctx, st.coverBucket, st.coverBaseURL, st.coverCacheBucket,
+		s.CoverFilename, shareCoverSize, coverJPEGQuality, false, false, w); err != nil {
+		log.Errorf(ctx, "Scaling cover %q failed: %v", s.CoverFilename, err)
+		if os.IsNotExist(err) {
+			http.Error(w, "Not found", http.StatusNotFound)
+		} else {
+			http.Error(w, "Scaling failed", http.StatusInternalServerError)
+		}
+		return
+	}
+}
+
+func handleShareLink(ctx context.Context, cfg *config.Config, w http.ResponseWriter, r *http.Request) {
+	if cfg.ShareSecret == "" {
+		http.Error(w, "Sharing disabled", http.StatusNotFound)
+		return
+	}
+	var kind share.Kind
+	var id string
+	switch {
+	case r.FormValue("songId") != "" && r.FormValue("albumId") == "":
+		kind, id = share.Song, r.FormValue("songId")
+	case r.FormValue("albumId") != "" && r.FormValue("songId") == "":
+		kind, id = share.Album, r.FormValue("albumId")
+	default:
+		http.Error(w, "Exactly one of songId and albumId must be supplied", http.StatusBadRequest)
+		return
+	}
+	if s, err := getShareSong(ctx, kind, id); err == nil && !canAccessSong(cfg, r, s) {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	days := cfg.ShareLinkDays
+	if days == 0 {
+		days = defaultShareLinkDays
+	}
+	exp := time.Now().Add(time.Duration(days) * 24 * time.Hour)
+	info, err := getShareInfo(ctx, cfg, kind, id, exp)
+	if err != nil {
+		log.Errorf(ctx, "Getting shared %v %q failed: %v", kind, id, err)
+		if os.IsNotExist(err) {
+			http.Error(w, "Not found", http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	writeJSONResponse(w, struct {
+		URL     string    `json:"url"`
+		Expires time.Time `json:"expires"`
+	}{info.PageURL, exp.Truncate(time.Second).UTC()})
+}
+
+func handleSimilar(ctx context.Context, cfg *config.Config, w http.ResponseWriter, r *http.Request) {
+	id, ok := parseIntParam(ctx, w, r, "songId")
+	if !ok {
+		return
+	}
+	max := int64(defaultSimilarMax)
+	if r.FormValue("max") != "" {
+		if max, ok = parseIntParam(ctx, w, r, "max"); !ok {
+			return
+		}
+	}
+
+	songs, err := query.SongsByID(ctx, []int64{id})
+	if err != nil {
+		log.Errorf(ctx, "Getting song %v failed: %v", id, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	src := songs[0]
+	if src == nil || getExcludedTags(cfg, r).hides(src) || !canAccessSong(cfg, r, src) {
+		http.Error(w, "Song not found", http.StatusNotFound)
+		return
+	}
+
+	var notTags []string
+	if user, _ := cfg.GetUser(r); user != nil {
+		notTags = user.ExcludedTags
+	}
+	similar, err := query.SimilarSongs(ctx, src, int(max), notTags)
+	if err != nil {
+		log.Errorf(ctx, "Getting songs similar to %v failed: %v", id, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSONResponse(w, similar)
+}
+
+func handleSimulateQuery(ctx context.Context, cfg *config.Config, w http.ResponseWriter, r *http.Request) {
+	t, ok := parseDateParam(ctx, w, r, "time")
+	if !ok {
+		return
+	}
+
+	var cur, hist *query.SongQuery
+	if name := r.FormValue("preset"); name != "" {
+		var preset *config.SearchPreset
+		for i := range cfg.Presets {
+			if cfg.Presets[i].Name == name {
+				preset = &cfg.Presets[i]
+				break
+			}
+		}
+		if preset == nil {
+			log.Errorf(ctx, "Unknown preset %q", name)
+			http.Error(w, "Unknown preset", http.StatusBadRequest)
+			return
+		}
+		// Relative conditions (e.g. "last played") are computed from the time at which
+		// each evaluation would have run.
+		cur, hist = presetQuery(preset, time.Now()), presetQuery(preset, t)
+		if !expandQueryTags(ctx, w, cur) || !expandQueryTags(ctx, w, hist) {
+			return
 		}
-	}
-	if user, _ := cfg.GetUser(r); user != nil && len(user.ExcludedTags) > 0 {
-		q.NotTags = append(q.NotTags, user.ExcludedTags...)
+	} else if cur, ok = parseSongQuery(ctx, cfg, w, r); !ok {
+		return
+	} else {
+		hist = cur
 	}
 
-	songs, err := query.Songs(ctx, &q, flags)
+	res, err := query.Simulate(ctx, cur, hist, t)
 	if err != nil {
-		log.Errorf(ctx, "Unable to query songs: %v", err)
+		log.Errorf(ctx, "Simulating query failed: %v", err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	writeJSONResponse(w, songs)
+	writeJSONResponse(w, res)
 }
 
-func handleRateAndTag(ctx context.Context, cfg *config.Config, w http.ResponseWriter, r *http.Request) {
-	id, ok := parseIntParam(ctx, w, r, "songId")
-	if !ok {
-		return
-	}
+// presetIntervals maps from config.SearchPreset FirstPlayed and LastPlayed values
+// to the corresponding intervals. This matches the web client's <search-view>.
+var presetIntervals = []time.Duration{
+	0,
+	24 * time.Hour,
+	7 * 24 * time.Hour,
+	30 * 24 * time.Hour,
+	90 * 24 * time.Hour,
+	180 * 24 * time.Hour,
+	365 * 24 * time.Hour,
+	3 * 365 * 24 * time.Hour,
+	5 * 365 * 24 * time.Hour,
+}
 
-	var delay time.Duration
-	if len(r.FormValue("updateDelayNsec")) > 0 {
-		if ns, ok := parseIntParam(ctx, w, r, "updateDelayNsec"); !ok {
-			return
+// presetQuery returns a SongQuery corresponding to p as it would be run at now.
+func presetQuery(p *config.SearchPreset, now time.Time) *query.SongQuery {
+	q := query.SongQuery{
+		MinRating:            p.MinRating,
+		Unrated:              p.Unrated,
+		MaxPlays:             int64(p.MaxPlays),
+		MaxSkipRatio:         p.MaxSkipRatio,
+		MinBPM:               p.MinBPM,
+		MaxBPM:               p.MaxBPM,
+		Shuffle:              p.Shuffle,
+		ShuffleAlbums:        p.ShuffleAlbums,
+		OrderByLastStartTime: p.OrderByLastPlayed,
+	}
+	if p.FirstTrack {
+		q.Track = 1
+		q.Disc = 1
+	}
+	if p.FirstPlayed > 0 && p.FirstPlayed < len(presetIntervals) {
+		q.MinFirstStartTime = now.Add(-presetIntervals[p.FirstPlayed])
+	}
+	if p.LastPlayed > 0 && p.LastPlayed < len(presetIntervals) {
+		q.MaxLastStartTime = now.Add(-presetIntervals[p.LastPlayed])
+	}
+	for _, t := range strings.Fields(p.Tags) {
+		if t[0] == '-' {
+			q.NotTags = append(q.NotTags, t[1:])
 		} else {
-			delay = time.Nanosecond * time.Duration(ns)
+			q.Tags = append(q.Tags, t)
 		}
 	}
+	return &q
+}
 
-	var hasRating bool
-	var rating int
-	var tags []string
-	if _, ok := r.Form["rating"]; ok {
-		if v, ok := parseIntParam(ctx, w, r, "rating"); !ok {
-			return
-		} else {
-			rating = int(v)
-		}
-		hasRating = true
-		if rating < 0 {
-			rating = 0
-		} else if rating > 5 {
-			rating = 5
-		}
+// handleSkipped records that the user skipped a song before it finished playing.
+func handleSkipped(ctx context.Context, cfg *config.Config, w http.ResponseWriter, r *http.Request) {
+	id, ok := parseIntParam(ctx, w, r, "songId")
+	if !ok {
+		return
 	}
-	if _, ok := r.Form["tags"]; ok {
-		tags = strings.Fields(r.FormValue("tags"))
+	startTime, ok := parseDateParam(ctx, w, r, "startTime")
+	if !ok {
+		return
+	}
+	pos, ok := parseFloatParam(ctx, w, r, "position")
+	if !ok {
+		return
 	}
-	if !hasRating && tags == nil {
-		http.Error(w, "No rating or tags supplied", http.StatusBadRequest)
+	prevID, ok := parsePrevSongID(ctx, w, r)
+	if !ok {
 		return
 	}
 
-	if forceUpdateFailures && appengine.IsDevAppServer() {
-		http.Error(w, "Returning an error, as requested", http.StatusInternalServerError)
+	if !checkSongAccess(ctx, cfg, w, r, id) {
 		return
 	}
 
-	if err := update.SetRatingAndTags(ctx, id, hasRating, rating, tags, delay); err != nil {
-		log.Errorf(ctx, "Rating/tagging song %d failed: %v", id, err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	if forceUpdateFailures && appengine.IsDevAppServer() {
+		http.Error(w, "Returning an error, as requested", http.StatusInternalServerError)
 		return
 	}
-	writeTextResponse(w, "ok")
-}
 
-func handleReindex(ctx context.Context, cfg *config.Config, w http.ResponseWriter, r *http.Request) {
-	cursor, scanned, updated, err := update.ReindexSongs(ctx, r.FormValue("cursor"))
-	if err != nil {
-		log.Errorf(ctx, "Reindexing songs failed: %v", err)
+	_, user := cfg.GetUser(r)
+	skip := db.Skip{StartTime: startTime, Position: pos, User: user}
+	if err := update.AddSkip(ctx, id, skip); err != nil {
+		log.Errorf(ctx, "Recording skip of %v at %v failed: %v", id, startTime, err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	writeJSONResponse(w, struct {
-		Scanned int    `json:"scanned"`
-		Updated int    `json:"updated"`
-		Cursor  string `json:"cursor"`
-	}{
-		scanned, updated, cursor,
-	})
+	recordTransition(ctx, prevID, id, startTime, true, user)
+	writeTextResponse(w, "ok")
 }
 
 // The existence of this endpoint makes me extremely unhappy, but it seems necessary due to
@@ -604,27 +2529,82 @@ func handleReindex(ctx context.Context, cfg *config.Config, w http.ResponseWrite
 //
 // The Web Audio part of this is particularly frustrating, as the JS doesn't actually need to look
 // at the audio data; it just need to amplify it.
+//
+// Signed URLs (see config.Config.SignedSongURLs) can be used to avoid proxying, since V4 signed
+// URLs are served by storage.googleapis.com, which honors the bucket's CORS configuration.
 func handleSong(ctx context.Context, cfg *config.Config, w http.ResponseWriter, req *http.Request) {
-	if max := cfg.MaxGuestSongRequestsPerHour; max > 0 {
-		if utype, user := cfg.GetUserType(req); utype == config.GuestUser {
-			// TODO: This should probably handle range requests differently.
-			// Maybe we should just count requests that ask for the first byte?
-			if err := ratelimit.Attempt(ctx, user, time.Now(), max, time.Hour); err != nil {
-				log.Errorf(ctx, "Song request from %q rejected: %v", user, err)
-				http.Error(w, "Guest rate limit exceeded", http.StatusTooManyRequests)
+	fn := req.FormValue("filename")
+	if fn == "" {
+		log.Errorf(ctx, "Missing filename in song data request")
+		http.Error(w, "Missing filename", http.StatusBadRequest)
+		return
+	}
+
+	var hls bool
+	switch format := req.FormValue("format"); format {
+	case "":
+	case hlsFormat:
+		hls = true
+	default:
+		log.Errorf(ctx, "Invalid format %q for %q", format, fn)
+		http.Error(w, "Invalid format", http.StatusBadRequest)
+		return
+	}
+
+	// Songs synthesized from cue sheet tracks specify the portion of the file to send.
+	var split bool
+	var start, end float64
+	if req.FormValue("end") != "" {
+		var ok bool
+		if start, ok = parseFloatParam(ctx, w, req, "start"); !ok {
+			return
+		}
+		if end, ok = parseFloatParam(ctx, w, req, "end"); !ok {
+			return
+		}
+		if start < 0 || end <= start {
+			log.Errorf(ctx, "Invalid range [%v, %v] for %q", start, end, fn)
+			http.Error(w, "Invalid start or end", http.StatusBadRequest)
+			return
+		}
+		split = true
+	}
+
+	lib, ok := getLibrary(ctx, cfg, w, req)
+	if !ok {
+		return
+	}
+	if excluded := getExcludedTags(cfg, req); excluded != nil {
+		songs, err := query.SongsByFilename(ctx, fn, lib)
+		if err != nil {
+			log.Errorf(ctx, "Getting songs with filename %q failed: %v", fn, err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		for _, s := range songs {
+			if excluded.hides(s) {
+				log.Errorf(ctx, "Rejecting request for %q with excluded tags", fn)
+				http.Error(w, "Not found", http.StatusNotFound)
 				return
 			}
 		}
 	}
+	st := getLibraryStorage(cfg, lib)
+	if st.songBucket != "" && cfg.UseSignedSongURL(req) && !split && !hls {
+		// Redirected requests aren't included in transfer stats.
+		if u, err := storage.SignedURL(ctx, st.songBucket, fn, signedSongURLExpiration); err != nil {
+			log.Errorf(ctx, "Signing URL for %q failed: %v", fn, err)
+		} else {
+			http.Redirect(w, req, u, http.StatusTemporaryRedirect)
+			return
+		}
+	}
 
-	fn := req.FormValue("filename")
-	if fn == "" {
-		log.Errorf(ctx, "Missing filename in song data request")
-		http.Error(w, "Missing filename", http.StatusBadRequest)
+	if !checkVersion(ctx, cfg, w, req, st.songBucket, fn, cfg.Cache.SongSec) {
 		return
 	}
 
-	r, err := openSong(ctx, cfg, fn)
+	r, err := openSong(ctx, st, fn)
 	if err != nil {
 		log.Errorf(ctx, "Opening song %q failed: %v", fn, err)
 		if os.IsNotExist(err) {
@@ -636,20 +2616,58 @@ func handleSong(ctx context.Context, cfg *config.Config, w http.ResponseWriter,
 	}
 	defer r.Close()
 
-	addLongCacheHeaders(w)
+	var rd io.Reader = r
+	if split {
+		if rd, err = splitSong(r, fn, start, end); err != nil {
+			log.Errorf(ctx, "Splitting song %q failed: %v", fn, err)
+			http.Error(w, fmt.Sprintf("Failed splitting song: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if hls {
+		// Segments are fetched from the same URL (minus the format) via range requests.
+		segs, err := getHLSSegments(rd, hlsSegmentSec)
+		if err != nil {
+			log.Errorf(ctx, "Getting HLS segments for %q failed: %v", fn, err)
+			http.Error(w, fmt.Sprintf("Failed reading song: %v", err), http.StatusInternalServerError)
+			return
+		}
+		u := *req.URL
+		q := u.Query()
+		q.Del("format")
+		u.RawQuery = q.Encode()
+		w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+		w.Write([]byte(makeHLSPlaylist(segs, u.RequestURI())))
+		return
+	}
 
-	if sr, ok := r.(songReader); ok {
-		if err := sendSong(ctx, req, w, sr); err != nil {
+	cw := &countingResponseWriter{ResponseWriter: w}
+	var full bool
+	if sr, ok := rd.(songReader); ok {
+		if err = sendSong(ctx, req, cw, sr); err != nil {
 			log.Errorf(ctx, "Sending song %q failed: %v", fn, err)
 		}
+		full = cw.bytes == sr.Size()
 	} else {
 		// Just send a 200 with the whole file if we're getting it over HTTP rather than from GCS.
 		// This is only used by tests.
-		w.Header().Set("Content-Type", "audio/mpeg")
-		if _, err := io.Copy(w, r); err != nil {
+		w.Header().Set("Content-Type", songContentType(fn))
+		if _, err = io.Copy(cw, rd); err != nil {
 			// Too late to report an HTTP error.
 			log.Errorf(ctx, "Sending song %q failed: %v", fn, err)
 		}
+		full = err == nil
+	}
+
+	metrics.Add(metrics.SongBytes, nil, cw.bytes)
+
+	// Don't count errors or responses without data (e.g. 304 Not Modified).
+	if (cw.code == http.StatusOK || cw.code == http.StatusPartialContent) && cw.bytes > 0 {
+		key := stats.TransferKey(lib, fn)
+		if err := stats.RecordTransfer(ctx, key, isStreamStart(req), full, cw.bytes); err != nil {
+			log.Errorf(ctx, "Recording transfer of %q failed: %v", key, err)
+		}
 	}
 }
 
@@ -675,12 +2693,18 @@ func handleStatic(ctx context.Context, cfg *config.Config, w http.ResponseWriter
 		if v, ok := staticFileETags.Load(p); ok {
 			etag = v.(string)
 		} else {
-			sum := sha1.Sum(b)
-			etag = fmt.Sprintf(`"%s"`, hex.EncodeToString(sum[:]))
+			etag = `"` + hashStaticFile(b) + `"`
 			staticFileETags.Store(p, etag)
 		}
 		w.Header().Set("ETag", etag)
 
+		// Issue a token that the web client will include in state-changing requests.
+		if p == indexFile {
+			if err := setCSRFCookie(w, req); err != nil {
+				log.Errorf(ctx, "Setting CSRF cookie failed: %v", err)
+			}
+		}
+
 		// App Engine seems to always report static file mtimes as 1980:
 		//  https://issuetracker.google.com/issues/168399701
 		//  https://stackoverflow.com/questions/63813692
@@ -689,6 +2713,87 @@ func handleStatic(ctx context.Context, cfg *config.Config, w http.ResponseWriter
 	}
 }
 
+func handleSongsByID(ctx context.Context, cfg *config.Config, w http.ResponseWriter, r *http.Request) {
+	strs := strings.FieldsFunc(r.FormValue("ids"), func(r rune) bool { return r == ',' || r == ' ' })
+	if len(strs) > maxSongsByIDCount {
+		http.Error(w, fmt.Sprintf("Too many IDs (max %d)", maxSongsByIDCount), http.StatusBadRequest)
+		return
+	}
+	ids := make([]int64, len(strs))
+	for i, str := range strs {
+		var err error
+		if ids[i], err = strconv.ParseInt(str, 10, 64); err != nil {
+			http.Error(w, fmt.Sprintf("Bad ID %q", str), http.StatusBadRequest)
+			return
+		}
+	}
+
+	songs, err := query.SongsByID(ctx, ids)
+	if err != nil {
+		log.Errorf(ctx, "Getting %d song(s) by ID failed: %v", len(ids), err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// Report songs with excluded tags or in inaccessible libraries as missing.
+	excluded := getExcludedTags(cfg, r)
+	for i, s := range songs {
+		if s != nil && (excluded.hides(s) || !canAccessSong(cfg, r, s)) {
+			songs[i] = nil
+		}
+	}
+
+	fields := strings.FieldsFunc(r.FormValue("fields"), func(r rune) bool { return r == ',' })
+	if len(fields) == 0 {
+		writeJSONResponse(w, songs)
+		return
+	}
+	projected := make([]map[string]json.RawMessage, len(songs))
+	for i, s := range songs {
+		if s == nil {
+			continue
+		}
+		if projected[i], err = projectJSONFields(s, fields); err != nil {
+			log.Errorf(ctx, "Projecting song %v failed: %v", s.SongID, err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	writeJSONResponse(w, projected)
+}
+
+// projectJSONFields marshals v to a JSON object and returns the properties named by fields.
+// Properties that aren't present in the object are omitted.
+func projectJSONFields(v interface{}, fields []string) (map[string]json.RawMessage, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var all map[string]json.RawMessage
+	if err := json.Unmarshal(b, &all); err != nil {
+		return nil, err
+	}
+	res := make(map[string]json.RawMessage, len(fields))
+	for _, f := range fields {
+		if val, ok := all[f]; ok {
+			res[f] = val
+		}
+	}
+	return res, nil
+}
+
+func handleStartJob(ctx context.Context, cfg *config.Config, w http.ResponseWriter, r *http.Request) {
+	job, err := jobs.Start(ctx, jobs.Type(r.FormValue("type")), r.FormValue("from"), r.FormValue("to"))
+	if err != nil {
+		log.Errorf(ctx, "Starting job failed: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if job.Type == jobs.RenameTagJob {
+		recordAudit(ctx, cfg, r, 0, "tag "+job.From, "tag "+job.To)
+	}
+	writeJSONResponse(w, job)
+}
+
 func handleStats(ctx context.Context, cfg *config.Config, w http.ResponseWriter, req *http.Request) {
 	// Updates would be better suited to POST than to GET, but App Engine cron uses GET per
 	// https://cloud.google.com/appengine/docs/standard/go/scheduling-jobs-with-cron-yaml.
@@ -699,6 +2804,16 @@ func handleStats(ctx context.Context, cfg *config.Config, w http.ResponseWriter,
 			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
 			return
 		}
+		// Stats will be updated when the bulk import session ends.
+		if active, err := update.BulkImportActive(ctx); err != nil {
+			log.Errorf(ctx, "Checking for bulk import failed: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		} else if active {
+			log.Debugf(ctx, "Deferring stats update during bulk import")
+			writeTextResponse(w, "ok")
+			return
+		}
 		if err := stats.Update(ctx); err != nil {
 			log.Errorf(ctx, "Updating stats failed: %v", err)
 			http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -714,32 +2829,220 @@ func handleStats(ctx context.Context, cfg *config.Config, w http.ResponseWriter,
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	// Don't expose other users' plays.
+	userYears := stats.UserYears
+	stats.UserYears = nil
+	if req.FormValue("myPlays") == "1" {
+		_, name := cfg.GetUser(req)
+		if name == "" {
+			log.Errorf(ctx, "Rejecting myPlays from unidentified user")
+			http.Error(w, "myPlays requires an identified user", http.StatusBadRequest)
+			return
+		}
+		stats.Years = userYears[name]
+		if stats.Years == nil {
+			stats.Years = make(map[int]db.PlayStats)
+		}
+	}
+	// Only admins can see other users' preset usage.
+	if utype, name := cfg.GetUserType(req); utype != config.AdminUser {
+		uses := stats.PresetUses[name]
+		stats.PresetUses = nil
+		if len(uses) > 0 {
+			stats.PresetUses = map[string]map[string]db.PresetStats{name: uses}
+		}
+	}
 	writeJSONResponse(w, stats)
 }
 
+func handleSuggest(ctx context.Context, cfg *config.Config, w http.ResponseWriter, r *http.Request) {
+	// Complete the last word in the query.
+	text := r.FormValue("q")
+	before := strings.TrimRightFunc(text, func(r rune) bool { return r != ' ' })
+	excluded := getExcludedTags(cfg, r)
+	user, _ := cfg.GetUser(r)
+	sugs, err := query.Suggest(ctx, text[len(before):], func(s *db.Song) bool {
+		return !excluded.hides(s) && cfg.CanAccessLibrary(user, s.Library)
+	})
+	if err != nil {
+		log.Errorf(ctx, "Getting suggestions for %q failed: %v", text, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	switch r.FormValue("format") {
+	case "", "json":
+		writeJSONResponse(w, sugs)
+	case "opensearch":
+		// See https://github.com/dewitt/opensearch/blob/master/mediawiki/Specifications/OpenSearch/Extensions/Suggestions/1.1/Draft%201.wiki.
+		completions := make([]string, len(sugs.Words))
+		for i, word := range sugs.Words {
+			completions[i] = before + word
+		}
+		w.Header().Set("Content-Type", "application/x-suggestions+json")
+		if err := json.NewEncoder(w).Encode([]interface{}{text, completions}); err != nil {
+			log.Errorf(ctx, "Writing suggestions failed: %v", err)
+		}
+	default:
+		http.Error(w, "Unsupported format", http.StatusBadRequest)
+	}
+}
+
+func handleSync(ctx context.Context, cfg *config.Config, w http.ResponseWriter, r *http.Request) {
+	if cfg.Mirror == nil {
+		// The cron job runs regardless of whether the server is a mirror.
+		if utype, _ := cfg.GetUserType(r); utype == config.CronUser {
+			writeJSONResponse(w, &mirror.Result{Done: true})
+			return
+		}
+		http.Error(w, "Server isn't configured as a mirror", http.StatusBadRequest)
+		return
+	}
+	res, err := mirror.Sync(ctx, cfg.Mirror)
+	if err != nil {
+		log.Errorf(ctx, "Syncing from primary failed: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Debugf(ctx, "Synced %d song(s), %d deleted song(s), and %d play(s) (done: %v)",
+		res.Songs, res.DeletedSongs, res.Plays, res.Done)
+	writeJSONResponse(w, res)
+}
+
+func handleTagRules(ctx context.Context, cfg *config.Config, w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		rules, err := tagrules.Get(ctx)
+		if err != nil {
+			log.Errorf(ctx, "Getting tag rules failed: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSONResponse(w, rules)
+		return
+	}
+
+	action, tag, target := r.FormValue("action"), r.FormValue("tag"), r.FormValue("target")
+	var fn func(*tagrules.Rules) error
+	switch action {
+	case "alias":
+		fn = func(rules *tagrules.Rules) error { return rules.SetAlias(tag, target) }
+	case "parent":
+		fn = func(rules *tagrules.Rules) error { return rules.SetParent(tag, target) }
+	case "remove":
+		fn = func(rules *tagrules.Rules) error { return rules.Remove(tag) }
+	default:
+		http.Error(w, fmt.Sprintf("Invalid action %q", action), http.StatusBadRequest)
+		return
+	}
+	var badReq bool
+	rules, err := tagrules.Update(ctx, func(rules *tagrules.Rules) error {
+		err := fn(rules)
+		badReq = err != nil
+		return err
+	})
+	if err != nil {
+		log.Errorf(ctx, "Updating tag rules (%v %q %q) failed: %v", action, tag, target, err)
+		code := http.StatusInternalServerError
+		if badReq {
+			code = http.StatusBadRequest
+		}
+		http.Error(w, err.Error(), code)
+		return
+	}
+	// Cached query results don't need to be flushed, since queries are cached using their
+	// expanded tags.
+	recordAudit(ctx, cfg, r, 0, "", fmt.Sprintf("tag rule %v %q %q", action, tag, target))
+	writeJSONResponse(w, rules)
+}
+
+func handleTagSuggestions(ctx context.Context, cfg *config.Config, w http.ResponseWriter, r *http.Request) {
+	id, ok := parseIntParam(ctx, w, r, "songId")
+	if !ok {
+		return
+	}
+	max := int64(query.MaxTagSuggestions)
+	if r.FormValue("max") != "" {
+		if max, ok = parseIntParam(ctx, w, r, "max"); !ok {
+			return
+		}
+	}
+
+	songs, err := query.SongsByID(ctx, []int64{id})
+	if err != nil {
+		log.Errorf(ctx, "Getting song %v failed: %v", id, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	excluded := getExcludedTags(cfg, r)
+	src := songs[0]
+	if src == nil || excluded.hides(src) || !canAccessSong(cfg, r, src) {
+		http.Error(w, "Song not found", http.StatusNotFound)
+		return
+	}
+
+	sugs, err := query.TagSuggestions(ctx, src, int(max))
+	if err != nil {
+		log.Errorf(ctx, "Suggesting tags for %v failed: %v", id, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if excluded != nil {
+		var num int
+		for _, sug := range sugs {
+			if !excluded.has(sug.Tag) {
+				sugs[num] = sug
+				num++
+			}
+		}
+		sugs = sugs[:num]
+	}
+	writeJSONResponse(w, sugs)
+}
+
 func handleTags(ctx context.Context, cfg *config.Config, w http.ResponseWriter, req *http.Request) {
-	tags, err := query.Tags(ctx, req.FormValue("requireCache") == "1")
+	user, _ := cfg.GetUser(req)
+	tags, err := query.Tags(ctx, func(lib string) bool { return cfg.CanAccessLibrary(user, lib) },
+		req.FormValue("requireCache") == "1")
 	if err != nil {
 		log.Errorf(ctx, "Querying tags failed: %v", err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 	// Filter out excluded tags.
-	if user, _ := cfg.GetUser(req); user != nil && len(user.ExcludedTags) > 0 {
-		excluded := make(map[string]struct{}, len(user.ExcludedTags))
-		for _, tag := range user.ExcludedTags {
-			excluded[tag] = struct{}{}
-		}
+	if excluded := getExcludedTags(cfg, req); excluded != nil {
 		var num int
 		for _, tag := range tags {
-			if _, ok := excluded[tag]; !ok {
+			if !excluded.has(tag) {
 				tags[num] = tag
 				num++
 			}
 		}
 		tags = tags[:num]
 	}
-	writeJSONResponse(w, tags)
+	if req.FormValue("canonical") == "1" {
+		rules, err := tagrules.Get(ctx)
+		if err != nil {
+			log.Errorf(ctx, "Getting tag rules failed: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSONResponseWithETag(w, req, rules.Annotate(tags))
+		return
+	}
+	writeJSONResponseWithETag(w, req, tags)
+}
+
+func handleUndeleteSong(ctx context.Context, cfg *config.Config, w http.ResponseWriter, r *http.Request) {
+	id, ok := parseIntParam(ctx, w, r, "songId")
+	if !ok {
+		return
+	}
+	if err := update.UndeleteSong(ctx, id); err != nil {
+		log.Errorf(ctx, "Undeleting song %v failed: %v", id, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeTextResponse(w, "ok")
 }
 
 func handleUser(ctx context.Context, cfg *config.Config, w http.ResponseWriter, req *http.Request) {
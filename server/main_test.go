@@ -0,0 +1,49 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/derat/nup/server/config"
+	"github.com/derat/nup/server/query"
+)
+
+func TestPresetQuery(t *testing.T) {
+	p := config.SearchPreset{
+		Tags:         "guitar -banjo",
+		MinRating:    4,
+		MaxPlays:     -1,
+		MaxSkipRatio: 0.5,
+		FirstTrack:   true,
+		Shuffle:      true,
+	}
+	want := query.SongQuery{
+		Tags:         []string{"guitar"},
+		NotTags:      []string{"banjo"},
+		MinRating:    4,
+		MaxPlays:     -1,
+		MaxSkipRatio: 0.5,
+		Track:        1,
+		Disc:         1,
+		Shuffle:      true,
+	}
+	if got := presetQuery(&p, time.Now()); !reflect.DeepEqual(*got, want) {
+		t.Errorf("presetQuery(%+v) = %+v; want %+v", p, *got, want)
+	}
+}
+
+func TestPresetQuery_Relative(t *testing.T) {
+	now := time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC)
+	p := config.SearchPreset{MaxPlays: -1, FirstPlayed: 1, LastPlayed: 2}
+	got := presetQuery(&p, now)
+	if want := now.Add(-24 * time.Hour); !got.MinFirstStartTime.Equal(want) {
+		t.Errorf("MinFirstStartTime = %v; want %v", got.MinFirstStartTime, want)
+	}
+	if want := now.Add(-7 * 24 * time.Hour); !got.MaxLastStartTime.Equal(want) {
+		t.Errorf("MaxLastStartTime = %v; want %v", got.MaxLastStartTime, want)
+	}
+}
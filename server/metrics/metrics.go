@@ -0,0 +1,330 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+// Package metrics collects server metrics and reports them in the Prometheus text format.
+//
+// Each App Engine instance accumulates metrics in memory and periodically saves a snapshot of
+// them to memcache. Write reports the snapshots from all instances, with each series labeled
+// by the instance that produced it, since counters from short-lived instances can't be summed
+// without appearing to go backwards when the instances disappear.
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+
+	"google.golang.org/appengine/v2"
+	"google.golang.org/appengine/v2/log"
+	"google.golang.org/appengine/v2/memcache"
+)
+
+// Metric names.
+const (
+	// Requests counts HTTP requests by handler path and response status code.
+	Requests = "nup_http_requests_total"
+	// RequestDuration is a histogram of HTTP request durations by handler path.
+	RequestDuration = "nup_http_request_duration_seconds"
+	// DatastoreCalls counts datastore API calls by method, e.g. "Get" or "RunQuery".
+	DatastoreCalls = "nup_datastore_calls_total"
+	// CacheLookups counts server/cache lookups by cache type, key, and result ("hit" or "miss").
+	CacheLookups = "nup_cache_lookups_total"
+	// QueryCacheLookups counts lookups of song query results by cache type and result.
+	QueryCacheLookups = "nup_query_cache_lookups_total"
+	// SongBytes counts song data bytes sent by /song.
+	SongBytes = "nup_song_bytes_sent_total"
+)
+
+// families describes all metrics that are reported by Write.
+var families = []struct {
+	name, typ, help string
+}{
+	{CacheLookups, "counter", "Cache lookups by type, key, and result."},
+	{DatastoreCalls, "counter", "Datastore API calls by method."},
+	{RequestDuration, "histogram", "HTTP request durations by handler."},
+	{Requests, "counter", "HTTP requests by handler and status code."},
+	{QueryCacheLookups, "counter", "Song query result cache lookups by type and result."},
+	{SongBytes, "counter", "Song data bytes sent."},
+}
+
+// durationBuckets contains upper bounds in seconds for RequestDuration's buckets.
+var durationBuckets = []float64{0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+const (
+	// flushInterval is the minimum time between Flush saving snapshots to memcache.
+	flushInterval = 10 * time.Second
+
+	instancesKey     = "metrics-instances"  // memcache key for list of instance IDs
+	snapshotPrefix   = "metrics-instance-"  // memcache key prefix for per-instance snapshots
+	snapshotLifetime = 24 * time.Hour       // memcache expiration for snapshots
+	instanceLabel    = "instance"           // label added by Write to identify instances
+	maxCASAttempts   = 5                    // attempts to update list of instance IDs
+	histogramSumUnit = float64(time.Second) // unit of stored histogram sums (i.e. nanoseconds)
+)
+
+var (
+	values     = make(map[string]int64) // cumulative values keyed by series (see seriesKey)
+	dirty      bool                     // true if values changed since last flush
+	lastFlush  time.Time                // time at which values were last flushed
+	registered bool                     // true if the instance is in the list in memcache
+	mu         sync.Mutex               // guards other variables
+)
+
+// Labels contains label names and values for a series.
+type Labels map[string]string
+
+// seriesKey returns a string identifying the series of metric name (optionally suffixed,
+// e.g. by "_bucket") with the supplied labels, formatted as in the Prometheus text format.
+func seriesKey(name string, labels Labels) string {
+	names := make([]string, 0, len(labels))
+	for n := range labels {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	b.WriteString(name)
+	b.WriteByte('{')
+	for i, n := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(n)
+		b.WriteString(`="`)
+		b.WriteString(escapeValue(labels[n]))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+var valueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// escapeValue escapes v for use as a label value.
+func escapeValue(v string) string { return valueEscaper.Replace(v) }
+
+// Add adds delta to the counter identified by name and labels.
+func Add(name string, labels Labels, delta int64) {
+	mu.Lock()
+	values[seriesKey(name, labels)] += delta
+	dirty = true
+	mu.Unlock()
+}
+
+// Observe records a duration for the histogram identified by name and labels.
+func Observe(name string, labels Labels, d time.Duration) {
+	bl := make(Labels, len(labels)+1)
+	for n, v := range labels {
+		bl[n] = v
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	for _, b := range durationBuckets {
+		if d.Seconds() <= b {
+			bl["le"] = strconv.FormatFloat(b, 'f', -1, 64)
+			values[seriesKey(name+"_bucket", bl)]++
+		}
+	}
+	bl["le"] = "+Inf"
+	values[seriesKey(name+"_bucket", bl)]++
+	values[seriesKey(name+"_count", labels)]++
+	values[seriesKey(name+"_sum", labels)] += int64(d)
+	dirty = true
+}
+
+// CountDatastoreCalls returns a copy of ctx that records DatastoreCalls.
+func CountDatastoreCalls(ctx context.Context) context.Context {
+	return appengine.WithAPICallFunc(ctx, func(ctx context.Context, service, method string,
+		in, out proto.Message) error {
+		if service == "datastore_v3" {
+			Add(DatastoreCalls, Labels{"method": method}, 1)
+		}
+		return appengine.APICall(ctx, service, method, in, out)
+	})
+}
+
+// Flush saves a snapshot of this instance's metrics to memcache if they've changed
+// and they haven't been saved recently. If force is true, the snapshot is saved
+// whenever the metrics have changed.
+func Flush(ctx context.Context, force bool) error {
+	mu.Lock()
+	if !dirty || (!force && time.Since(lastFlush) < flushInterval) {
+		mu.Unlock()
+		return nil
+	}
+	snapshot := make(map[string]int64, len(values))
+	for k, v := range values {
+		snapshot[k] = v
+	}
+	dirty = false
+	lastFlush = time.Now()
+	reg := registered
+	mu.Unlock()
+
+	id := appengine.InstanceID()
+	if err := memcache.JSON.Set(ctx, &memcache.Item{
+		Key:        snapshotPrefix + id,
+		Object:     snapshot,
+		Expiration: snapshotLifetime,
+	}); err != nil {
+		return err
+	}
+	if !reg {
+		if err := updateInstances(ctx, func(ids []string) []string {
+			for _, s := range ids {
+				if s == id {
+					return nil
+				}
+			}
+			return append(ids, id)
+		}); err != nil {
+			return err
+		}
+		mu.Lock()
+		registered = true
+		mu.Unlock()
+	}
+	return nil
+}
+
+// updateInstances atomically updates the list of instance IDs in memcache using f.
+// f should return nil if no update is needed.
+func updateInstances(ctx context.Context, f func(ids []string) []string) error {
+	for i := 0; i < maxCASAttempts; i++ {
+		var ids []string
+		item, err := memcache.JSON.Get(ctx, instancesKey, &ids)
+		if err == memcache.ErrCacheMiss {
+			if ids = f(nil); ids == nil {
+				return nil
+			}
+			err = memcache.JSON.Add(ctx, &memcache.Item{Key: instancesKey, Object: ids})
+		} else if err != nil {
+			return err
+		} else {
+			if ids = f(ids); ids == nil {
+				return nil
+			}
+			item.Object = ids
+			err = memcache.JSON.CompareAndSwap(ctx, item)
+		}
+		if err != memcache.ErrNotStored && err != memcache.ErrCASConflict {
+			return err
+		}
+	}
+	return fmt.Errorf("failed updating %q after %d attempts", instancesKey, maxCASAttempts)
+}
+
+// Write writes metrics from all instances to w in the Prometheus text format.
+// Instances whose snapshots have expired from memcache are forgotten.
+func Write(ctx context.Context, w io.Writer) error {
+	var ids []string
+	if _, err := memcache.JSON.Get(ctx, instancesKey, &ids); err != nil && err != memcache.ErrCacheMiss {
+		return err
+	}
+	keys := make([]string, len(ids))
+	for i, id := range ids {
+		keys[i] = snapshotPrefix + id
+	}
+	items, err := memcache.GetMulti(ctx, keys)
+	if err != nil {
+		return err
+	}
+
+	snapshots := make(map[string]map[string]int64, len(items))
+	for _, id := range ids {
+		item, ok := items[snapshotPrefix+id]
+		if !ok {
+			continue
+		}
+		var snapshot map[string]int64
+		if err := memcache.JSON.Unmarshal(item.Value, &snapshot); err != nil {
+			log.Errorf(ctx, "Failed unmarshaling snapshot for instance %q: %v", id, err)
+			continue
+		}
+		snapshots[id] = snapshot
+	}
+
+	if len(snapshots) < len(ids) {
+		if err := updateInstances(ctx, func(ids []string) []string {
+			live := make([]string, 0, len(ids))
+			for _, id := range ids {
+				if _, ok := snapshots[id]; ok {
+					live = append(live, id)
+				}
+			}
+			return live
+		}); err != nil {
+			log.Errorf(ctx, "Failed forgetting expired instances: %v", err)
+		}
+	}
+
+	return writeSnapshots(w, snapshots)
+}
+
+// writeSnapshots writes snapshots (keyed by instance ID) to w in the Prometheus text format.
+func writeSnapshots(w io.Writer, snapshots map[string]map[string]int64) error {
+	ids := make([]string, 0, len(snapshots))
+	for id := range snapshots {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	for _, fam := range families {
+		var lines []string
+		for _, id := range ids {
+			for key, val := range snapshots[id] {
+				suffix, ok := familySuffix(key, fam.name, fam.typ)
+				if !ok {
+					continue
+				}
+				// Insert the instance label at the end of the label list.
+				line := key[:len(key)-1]
+				if !strings.HasSuffix(line, "{") {
+					line += ","
+				}
+				line += instanceLabel + `="` + escapeValue(id) + `"} `
+				if suffix == "_sum" {
+					line += strconv.FormatFloat(float64(val)/histogramSumUnit, 'g', -1, 64)
+				} else {
+					line += strconv.FormatInt(val, 10)
+				}
+				lines = append(lines, line)
+			}
+		}
+		if len(lines) == 0 {
+			continue
+		}
+		sort.Strings(lines)
+		if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s\n",
+			fam.name, fam.help, fam.name, fam.typ, strings.Join(lines, "\n")); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// familySuffix returns the suffix (e.g. "_bucket" or an empty string) if key
+// (see seriesKey) belongs to the metric family with the supplied name and type.
+func familySuffix(key, name, typ string) (suffix string, ok bool) {
+	if !strings.HasPrefix(key, name) {
+		return "", false
+	}
+	rest := key[len(name):]
+	if strings.HasPrefix(rest, "{") {
+		return "", true
+	}
+	if typ == "histogram" {
+		for _, s := range []string{"_bucket", "_count", "_sum"} {
+			if strings.HasPrefix(rest, s+"{") {
+				return s, true
+			}
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,67 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package metrics
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestSeriesKey(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		labels Labels
+		want   string
+	}{
+		{"foo", nil, `foo{}`},
+		{"foo", Labels{"a": "1"}, `foo{a="1"}`},
+		{"foo", Labels{"b": "2", "a": "1"}, `foo{a="1",b="2"}`},
+		{"foo", Labels{"a": "x\"y\\z\n"}, `foo{a="x\"y\\z\n"}`},
+	} {
+		if got := seriesKey(tc.name, tc.labels); got != tc.want {
+			t.Errorf("seriesKey(%q, %v) = %q; want %q", tc.name, tc.labels, got, tc.want)
+		}
+	}
+}
+
+func TestWriteSnapshots(t *testing.T) {
+	dur := seriesKey(RequestDuration+"_bucket", Labels{"handler": "/song", "le": "0.5"})
+	inf := seriesKey(RequestDuration+"_bucket", Labels{"handler": "/song", "le": "+Inf"})
+	snapshots := map[string]map[string]int64{
+		"b": {
+			seriesKey(Requests, Labels{"handler": "/song", "code": "200"}): 3,
+			dur: 2,
+			inf: 2,
+			seriesKey(RequestDuration+"_count", Labels{"handler": "/song"}): 2,
+			seriesKey(RequestDuration+"_sum", Labels{"handler": "/song"}):   int64(750 * time.Millisecond),
+		},
+		"a": {
+			seriesKey(Requests, Labels{"handler": "/song", "code": "200"}): 1,
+			seriesKey(SongBytes, nil):                                      1024,
+			"bogus{}":                                                      5,
+		},
+	}
+	var b bytes.Buffer
+	if err := writeSnapshots(&b, snapshots); err != nil {
+		t.Fatal("writeSnapshots failed: ", err)
+	}
+	const want = `# HELP nup_http_request_duration_seconds HTTP request durations by handler.
+# TYPE nup_http_request_duration_seconds histogram
+nup_http_request_duration_seconds_bucket{handler="/song",le="+Inf",instance="b"} 2
+nup_http_request_duration_seconds_bucket{handler="/song",le="0.5",instance="b"} 2
+nup_http_request_duration_seconds_count{handler="/song",instance="b"} 2
+nup_http_request_duration_seconds_sum{handler="/song",instance="b"} 0.75
+# HELP nup_http_requests_total HTTP requests by handler and status code.
+# TYPE nup_http_requests_total counter
+nup_http_requests_total{code="200",handler="/song",instance="a"} 1
+nup_http_requests_total{code="200",handler="/song",instance="b"} 3
+# HELP nup_song_bytes_sent_total Song data bytes sent.
+# TYPE nup_song_bytes_sent_total counter
+nup_song_bytes_sent_total{instance="a"} 1024
+`
+	if got := b.String(); got != want {
+		t.Errorf("writeSnapshots wrote:\n%s\nwant:\n%s", got, want)
+	}
+}
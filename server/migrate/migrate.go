@@ -0,0 +1,232 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+// Package migrate upgrades Song and Play entities written using older schemas.
+//
+// Migrations are applied lazily whenever entities are loaded from or saved to Datastore
+// (after Install has been called), and stored entities can be upgraded in bulk using Run.
+package migrate
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/derat/nup/server/db"
+
+	"google.golang.org/appengine/v2/datastore"
+	"google.golang.org/appengine/v2/log"
+)
+
+const (
+	batchSize = 500 // max entities to examine in each call to Run
+
+	versionProp = "SchemaVersion" // Song and Play property containing schema version
+)
+
+// Migration describes a change to the schema of Song or Play entities.
+// Migrations must not depend on Datastore and must be safe to apply multiple times.
+type Migration struct {
+	// Version is the schema version produced by the migration.
+	// Versions start at 1 and must be consecutive.
+	Version int
+	// Desc briefly describes the migration.
+	Desc string
+	// Song and Play upgrade entities from the previous version. Either may be nil.
+	Song func(s *db.Song)
+	Play func(p *db.Play)
+}
+
+// migrations contains all registered migrations in ascending order by version.
+var migrations []Migration
+
+// register adds m to migrations. It panics if m.Version isn't the next version.
+func register(m Migration) {
+	if want := len(migrations) + 1; m.Version != want {
+		panic(fmt.Sprintf("migration %q has version %d; want %d", m.Desc, m.Version, want))
+	}
+	migrations = append(migrations, m)
+}
+
+func init() {
+	register(Migration{
+		Version: 1,
+		Desc:    "Set RatingAtLeast* properties from Rating",
+		Song:    func(s *db.Song) { s.SetRating(s.Rating) },
+	})
+	register(Migration{
+		Version: 2,
+		Desc:    "Assign random keys to songs",
+		Song:    func(s *db.Song) { s.AssignRandomKey() },
+	})
+	register(Migration{
+		Version: 3,
+		Desc:    "Set ArtistsLower from ArtistLower",
+		Song: func(s *db.Song) {
+			// Songs written before ArtistCredits was added only have a single artist.
+			if len(s.ArtistsLower) == 0 && s.ArtistLower != "" {
+				s.ArtistsLower = []string{s.ArtistLower}
+			}
+		},
+	})
+}
+
+// CurrentVersion returns the version of the newest migration.
+func CurrentVersion() int { return len(migrations) }
+
+// Install configures the db package to apply migrations to entities as they are
+// loaded and saved.
+func Install() {
+	db.SetMigrators(func(s *db.Song) error {
+		for _, m := range migrations[clampVersion(s.SchemaVersion):] {
+			if m.Song != nil {
+				m.Song(s)
+			}
+		}
+		s.SchemaVersion = CurrentVersion()
+		return nil
+	}, func(p *db.Play) error {
+		for _, m := range migrations[clampVersion(p.SchemaVersion):] {
+			if m.Play != nil {
+				m.Play(p)
+			}
+		}
+		p.SchemaVersion = CurrentVersion()
+		return nil
+	})
+}
+
+// clampVersion returns v clamped to [0, CurrentVersion()].
+func clampVersion(v int) int {
+	if v < 0 {
+		return 0
+	} else if v > CurrentVersion() {
+		return CurrentVersion()
+	}
+	return v
+}
+
+// needsMigration returns true if a migration newer than version v affects entities of kind.
+func needsMigration(kind string, v int) bool {
+	for _, m := range migrations[clampVersion(v):] {
+		if (kind == db.SongKind && m.Song != nil) || (kind == db.PlayKind && m.Play != nil) {
+			return true
+		}
+	}
+	return false
+}
+
+// storedVersion returns the schema version in props, or 0 if it isn't present.
+func storedVersion(props datastore.PropertyList) int {
+	for _, p := range props {
+		if p.Name == versionProp {
+			if v, ok := p.Value.(int64); ok {
+				return int(v)
+			}
+		}
+	}
+	return 0
+}
+
+// Run upgrades up to batchSize entities of the supplied kind (either db.SongKind or
+// db.PlayKind) that were written using older schemas. If nextCursor is non-empty,
+// Run should be called again to continue migrating.
+func Run(ctx context.Context, kind, cursor string) (nextCursor string, scanned, updated int, err error) {
+	var newEntity func() datastore.PropertyLoadSaver
+	switch kind {
+	case db.SongKind:
+		newEntity = func() datastore.PropertyLoadSaver { return &db.Song{} }
+	case db.PlayKind:
+		newEntity = func() datastore.PropertyLoadSaver { return &db.Play{} }
+	default:
+		return "", 0, 0, fmt.Errorf("can't migrate %q entities", kind)
+	}
+
+	q := datastore.NewQuery(kind).KeysOnly()
+	if cursor != "" {
+		dc, err := datastore.DecodeCursor(cursor)
+		if err != nil {
+			return "", 0, 0, fmt.Errorf("decode cursor %q: %v", cursor, err)
+		}
+		q = q.Start(dc)
+	}
+	it := q.Run(ctx)
+	var keys []*datastore.Key
+	for {
+		k, err := it.Next(nil)
+		if err == datastore.Done {
+			break
+		} else if err != nil {
+			return "", 0, 0, err
+		}
+		keys = append(keys, k)
+		if len(keys) == batchSize {
+			nc, err := it.Cursor()
+			if err != nil {
+				return "", 0, 0, fmt.Errorf("get cursor: %v", err)
+			}
+			nextCursor = nc.String()
+			break
+		}
+	}
+
+	for _, k := range keys {
+		scanned++
+		var migrated bool
+		if err := datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+			migrated = false // reset in case the transaction is retried
+			var props datastore.PropertyList
+			if err := datastore.Get(ctx, k, &props); err == datastore.ErrNoSuchEntity {
+				return nil // deleted since the query ran
+			} else if err != nil {
+				return err
+			}
+			if !needsMigration(kind, storedVersion(props)) {
+				return nil
+			}
+			// Loading the entity applies the migrations.
+			ent := newEntity()
+			if err := ent.Load(props); err != nil {
+				return err
+			}
+			if _, err := datastore.Put(ctx, k, ent); err != nil {
+				return err
+			}
+			migrated = true
+			return nil
+		}, nil); err != nil {
+			return "", scanned, updated, fmt.Errorf("%v %v: %v", kind, k.IntID(), err)
+		}
+		if migrated {
+			updated++
+		}
+	}
+	log.Debugf(ctx, "Scanned %d %v entities for migration, updated %d", scanned, kind, updated)
+	return nextCursor, scanned, updated, nil
+}
+
+// CountSongVersions returns the number of songs using each schema version.
+// songs should contain the total number of songs.
+func CountSongVersions(ctx context.Context, songs int) (map[int]int, error) {
+	// Project the property into a PropertyList rather than a Song, since Song.Load
+	// would upgrade the song to the current version.
+	counts := make(map[int]int)
+	it := datastore.NewQuery(db.SongKind).Project(versionProp).Run(ctx)
+	for {
+		var props datastore.PropertyList
+		if _, err := it.Next(&props); err == datastore.Done {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		counts[storedVersion(props)]++
+	}
+	// Songs without SchemaVersion properties aren't returned by the query.
+	var total int
+	for _, cnt := range counts {
+		total += cnt
+	}
+	if missing := songs - total; missing > 0 {
+		counts[0] += missing
+	}
+	return counts, nil
+}
@@ -0,0 +1,68 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package migrate
+
+import (
+	"testing"
+
+	"github.com/derat/nup/server/db"
+
+	"google.golang.org/appengine/v2/datastore"
+)
+
+func TestInstall(t *testing.T) {
+	Install()
+	defer db.SetMigrators(nil, nil)
+
+	// SaveStruct doesn't call Song.Save, so the song is saved without being migrated.
+	props, err := datastore.SaveStruct(&db.Song{Rating: 4})
+	if err != nil {
+		t.Fatal("SaveStruct failed: ", err)
+	}
+	var s db.Song
+	if err := s.Load(props); err != nil {
+		t.Fatal("Load failed: ", err)
+	}
+	if s.SchemaVersion != CurrentVersion() {
+		t.Errorf("SchemaVersion is %v; want %v", s.SchemaVersion, CurrentVersion())
+	}
+	if !s.RatingAtLeast4 {
+		t.Error("RatingAtLeast4 wasn't set")
+	}
+	if s.RandomKey == 0 {
+		t.Error("RandomKey wasn't set")
+	}
+
+	// Migrations shouldn't be reapplied to songs that are already at the current version.
+	s.RatingAtLeast4 = false
+	props, err = datastore.SaveStruct(&s)
+	if err != nil {
+		t.Fatal("SaveStruct failed: ", err)
+	}
+	var s2 db.Song
+	if err := s2.Load(props); err != nil {
+		t.Fatal("Load failed: ", err)
+	}
+	if s2.RatingAtLeast4 {
+		t.Error("Migration was reapplied")
+	}
+}
+
+func TestNeedsMigration(t *testing.T) {
+	for _, tc := range []struct {
+		kind string
+		ver  int
+		want bool
+	}{
+		{db.SongKind, 0, true},
+		{db.SongKind, CurrentVersion() - 1, true},
+		{db.SongKind, CurrentVersion(), false},
+		{db.SongKind, CurrentVersion() + 1, false},
+		{db.PlayKind, 0, false}, // no migrations affect plays yet
+	} {
+		if got := needsMigration(tc.kind, tc.ver); got != tc.want {
+			t.Errorf("needsMigration(%q, %d) = %v; want %v", tc.kind, tc.ver, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,286 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+// Package mirror syncs data from a primary server to a read-only mirror.
+package mirror
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/derat/nup/server/config"
+	"github.com/derat/nup/server/db"
+	"github.com/derat/nup/server/query"
+	"github.com/derat/nup/server/update"
+
+	"google.golang.org/appengine/v2/datastore"
+	"google.golang.org/appengine/v2/log"
+)
+
+const (
+	// exportBatchSize is the maximum number of objects to request from the primary at once.
+	exportBatchSize = 100
+	// maxSyncTime is the approximate maximum duration of a single call to Sync.
+	// App Engine cron requests time out after 10 minutes.
+	maxSyncTime = 5 * time.Minute
+	// httpTimeout is used for HTTP requests to the primary.
+	httpTimeout = time.Minute
+)
+
+// Stages of a sync, in the order in which they're performed.
+const (
+	syncSongs = iota
+	syncDeletedSongs
+	syncPlays
+	numSyncStages
+)
+
+// Result summarizes a call to Sync.
+type Result struct {
+	// Songs is the number of updated songs that were saved.
+	Songs int `json:"songs"`
+	// DeletedSongs is the number of songs that were deleted.
+	DeletedSongs int `json:"deletedSongs"`
+	// Plays is the number of new plays that were saved.
+	Plays int `json:"plays"`
+	// Done is true if the sync completed. If false, Sync should be called again.
+	Done bool `json:"done"`
+}
+
+func stateKey(ctx context.Context) *datastore.Key {
+	return datastore.NewKey(ctx, db.MirrorStateKind, db.MirrorStateKeyName, 0, nil)
+}
+
+// Sync copies songs and plays that have changed since the last sync from the primary server
+// described by cfg to datastore. Progress is saved after each batch, so if the returned
+// Result's Done field is false, Sync should be called again to continue syncing.
+func Sync(ctx context.Context, cfg *config.MirrorConfig) (*Result, error) {
+	var st db.MirrorState
+	if err := datastore.Get(ctx, stateKey(ctx), &st); err != nil && err != datastore.ErrNoSuchEntity {
+		return nil, fmt.Errorf("getting state failed: %v", err)
+	}
+	if st.SyncTime.IsZero() {
+		// Use the primary's clock to avoid missing updates due to clock skew.
+		now, err := getPrimaryTime(ctx, cfg)
+		if err != nil {
+			return nil, fmt.Errorf("getting primary time failed: %v", err)
+		}
+		log.Debugf(ctx, "Starting sync of changes since %v", st.LastSyncTime)
+		st.SyncTime = now
+		st.Stage = syncSongs
+		st.Cursor = ""
+	}
+
+	var res Result
+	start := time.Now()
+	for st.Stage < numSyncStages && time.Since(start) < maxSyncTime {
+		params := make(url.Values)
+		params.Set("max", strconv.Itoa(exportBatchSize))
+		if st.Cursor != "" {
+			params.Set("cursor", st.Cursor)
+		}
+		var process func([]json.RawMessage) error
+		switch st.Stage {
+		case syncSongs, syncDeletedSongs:
+			params.Set("type", "song")
+			params.Set("omit", "plays")
+			if !st.LastSyncTime.IsZero() {
+				params.Set("minLastModifiedNsec", strconv.FormatInt(st.LastSyncTime.UnixNano(), 10))
+			}
+			if st.Stage == syncDeletedSongs {
+				params.Set("deleted", "1")
+				process = func(objs []json.RawMessage) error { return deleteSongs(ctx, objs, &res) }
+			} else {
+				process = func(objs []json.RawMessage) error { return saveSongs(ctx, objs, &res) }
+			}
+		case syncPlays:
+			// Clients can report plays long after they happened (e.g. after being offline),
+			// so request plays by the time at which the primary saved them rather than by
+			// their start times.
+			params.Set("type", "play")
+			if !st.LastSyncTime.IsZero() {
+				params.Set("minReportTimeNsec", strconv.FormatInt(st.LastSyncTime.UnixNano(), 10))
+			}
+			process = func(objs []json.RawMessage) error { return savePlays(ctx, objs, &res) }
+		}
+
+		objs, cursor, err := export(ctx, cfg, params)
+		if err != nil {
+			return nil, err
+		}
+		if err := process(objs); err != nil {
+			return nil, err
+		}
+		if st.Cursor = cursor; cursor == "" {
+			st.Stage++
+		}
+		if st.Stage == numSyncStages {
+			log.Debugf(ctx, "Finished sync of changes since %v", st.LastSyncTime)
+			st.LastSyncTime = st.SyncTime
+			st.SyncTime = time.Time{}
+			st.Stage = syncSongs
+			res.Done = true
+		}
+		if _, err := datastore.Put(ctx, stateKey(ctx), &st); err != nil {
+			return nil, fmt.Errorf("saving state failed: %v", err)
+		}
+		if res.Done {
+			break
+		}
+	}
+
+	if res.Songs > 0 || res.DeletedSongs > 0 || res.Plays > 0 {
+		if err := query.FlushCacheForUpdate(ctx, query.MetadataUpdate); err != nil {
+			return nil, err
+		}
+	}
+	return &res, nil
+}
+
+// saveSongs saves the supplied JSON-marshaled db.Song objects.
+func saveSongs(ctx context.Context, objs []json.RawMessage, res *Result) error {
+	for _, b := range objs {
+		var s db.Song
+		if err := json.Unmarshal(b, &s); err != nil {
+			return fmt.Errorf("unmarshaling song failed: %v", err)
+		}
+		id, err := strconv.ParseInt(s.SongID, 10, 64)
+		if err != nil {
+			return fmt.Errorf("bad song ID %q: %v", s.SongID, err)
+		}
+		if err := update.MirrorSong(ctx, id, &s); err != nil {
+			return err
+		}
+		res.Songs++
+	}
+	return nil
+}
+
+// deleteSongs deletes the songs described by the supplied JSON-marshaled db.Song objects.
+func deleteSongs(ctx context.Context, objs []json.RawMessage, res *Result) error {
+	for _, b := range objs {
+		var s db.Song
+		if err := json.Unmarshal(b, &s); err != nil {
+			return fmt.Errorf("unmarshaling song failed: %v", err)
+		}
+		id, err := strconv.ParseInt(s.SongID, 10, 64)
+		if err != nil {
+			return fmt.Errorf("bad song ID %q: %v", s.SongID, err)
+		}
+		// Skip songs that were already deleted (or that were never synced).
+		key := datastore.NewKey(ctx, db.SongKind, "", id, nil)
+		if err := datastore.Get(ctx, key, &db.Song{}); err == datastore.ErrNoSuchEntity {
+			continue
+		} else if err != nil {
+			return fmt.Errorf("getting song %v failed: %v", id, err)
+		}
+		if err := update.DeleteSong(ctx, id); err != nil {
+			return err
+		}
+		res.DeletedSongs++
+	}
+	return nil
+}
+
+// savePlays saves the supplied JSON-marshaled db.PlayDump objects.
+func savePlays(ctx context.Context, objs []json.RawMessage, res *Result) error {
+	var ids []int64
+	plays := make(map[int64][]db.Play)
+	for _, b := range objs {
+		var pd db.PlayDump
+		if err := json.Unmarshal(b, &pd); err != nil {
+			return fmt.Errorf("unmarshaling play failed: %v", err)
+		}
+		id, err := strconv.ParseInt(pd.SongID, 10, 64)
+		if err != nil {
+			return fmt.Errorf("bad song ID %q: %v", pd.SongID, err)
+		}
+		if _, ok := plays[id]; !ok {
+			ids = append(ids, id)
+		}
+		plays[id] = append(plays[id], pd.Play)
+	}
+	for _, id := range ids {
+		n, err := update.AddMirroredPlays(ctx, id, plays[id])
+		if err == datastore.ErrNoSuchEntity {
+			log.Warningf(ctx, "Skipping %v play(s) for missing song %v", len(plays[id]), id)
+			continue
+		} else if err != nil {
+			return fmt.Errorf("adding plays to song %v failed: %v", id, err)
+		}
+		res.Plays += n
+	}
+	return nil
+}
+
+// getPrimaryTime returns the current time according to the primary server.
+func getPrimaryTime(ctx context.Context, cfg *config.MirrorConfig) (time.Time, error) {
+	b, err := sendRequest(ctx, cfg, "/now", nil)
+	if err != nil {
+		return time.Time{}, err
+	}
+	ns, err := strconv.ParseInt(strings.TrimSpace(string(b)), 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(0, ns), nil
+}
+
+// export sends an /export request with the supplied parameters to the primary server.
+// The JSON-marshaled objects and the cursor for the next batch (if any) are returned.
+func export(ctx context.Context, cfg *config.MirrorConfig, params url.Values) (
+	objs []json.RawMessage, cursor string, err error) {
+	b, err := sendRequest(ctx, cfg, "/export", params)
+	if err != nil {
+		return nil, "", err
+	}
+	sc := bufio.NewScanner(bytes.NewReader(b))
+	sc.Buffer(nil, 1024*1024)
+	for sc.Scan() {
+		line := sc.Bytes()
+		// The final line contains a JSON string with the cursor if there are more objects.
+		if err := json.Unmarshal(line, &cursor); err == nil {
+			continue
+		}
+		objs = append(objs, append(json.RawMessage(nil), line...))
+	}
+	return objs, cursor, sc.Err()
+}
+
+// sendRequest sends a GET request for path to the primary server and returns the body.
+func sendRequest(ctx context.Context, cfg *config.MirrorConfig, path string, params url.Values) (
+	[]byte, error) {
+	u := cfg.PrimaryURL + strings.TrimPrefix(path, "/")
+	if len(params) > 0 {
+		u += "?" + params.Encode()
+	}
+	ctx, cancel := context.WithTimeout(ctx, httpTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.SetBasicAuth(cfg.Username, cfg.Password)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%v: %v", path, resp.Status)
+	}
+	return b, nil
+}
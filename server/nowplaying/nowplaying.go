@@ -0,0 +1,96 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+// Package nowplaying stores the songs that users are currently playing.
+package nowplaying
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"google.golang.org/appengine/v2/datastore"
+)
+
+const (
+	stateKind = "NowPlaying" // datastore kind for State entities
+
+	// idleTimeout is the time after the end of a song (or after the last update
+	// for a paused song) at which the state is no longer considered current.
+	idleTimeout = 5 * time.Minute
+)
+
+// State describes the song that a user is currently playing.
+// State entities are keyed by the user's username or email address.
+type State struct {
+	// SongID contains the ID of the song being played.
+	SongID int64 `datastore:",noindex"`
+	// Position contains the playback position in seconds as of UpdateTime.
+	Position float64 `datastore:",noindex"`
+	// Paused is true if playback is paused.
+	Paused bool `datastore:",noindex"`
+	// UpdateTime contains the time at which the state was reported.
+	UpdateTime time.Time `datastore:",noindex"`
+}
+
+// CurrentPosition returns the estimated playback position in seconds at now
+// for a song with the supplied length in seconds.
+func (s *State) CurrentPosition(now time.Time, length float64) float64 {
+	pos := s.Position
+	if !s.Paused && now.After(s.UpdateTime) {
+		pos += now.Sub(s.UpdateTime).Seconds()
+	}
+	if length > 0 && pos > length {
+		pos = length
+	}
+	return pos
+}
+
+// Active returns true if s still describes current playback at now for a song
+// with the supplied length in seconds.
+func (s *State) Active(now time.Time, length float64) bool {
+	end := s.UpdateTime
+	if !s.Paused && length > s.Position {
+		end = end.Add(time.Duration((length - s.Position) * float64(time.Second)))
+	}
+	return now.Sub(end) < idleTimeout
+}
+
+// Get returns the supplied user's state.
+// Nil is returned if the user hasn't reported a state.
+func Get(ctx context.Context, user string) (*State, error) {
+	var s State
+	key := datastore.NewKey(ctx, stateKind, user, 0, nil)
+	if err := datastore.Get(ctx, key, &s); err == datastore.ErrNoSuchEntity {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// Put saves s as the supplied user's state.
+func Put(ctx context.Context, user string, s *State) error {
+	key := datastore.NewKey(ctx, stateKind, user, 0, nil)
+	_, err := datastore.Put(ctx, key, s)
+	return err
+}
+
+// Delete deletes the supplied user's state, e.g. after playback is stopped.
+func Delete(ctx context.Context, user string) error {
+	key := datastore.NewKey(ctx, stateKind, user, 0, nil)
+	if err := datastore.Delete(ctx, key); err != nil && err != datastore.ErrNoSuchEntity {
+		return err
+	}
+	return nil
+}
+
+// Clear deletes all saved states from datastore for testing.
+func Clear(ctx context.Context) error {
+	if keys, err := datastore.NewQuery(stateKind).KeysOnly().GetAll(ctx, nil); err != nil {
+		return fmt.Errorf("getting %v keys failed: %v", stateKind, err)
+	} else if err := datastore.DeleteMulti(ctx, keys); err != nil {
+		return fmt.Errorf("deleting all %v entities failed: %v", stateKind, err)
+	}
+	return nil
+}
@@ -0,0 +1,36 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package nowplaying
+
+import (
+	"testing"
+	"time"
+)
+
+func TestState(t *testing.T) {
+	t0 := time.Date(2023, 5, 1, 12, 0, 0, 0, time.UTC)
+	const length = 200.0
+	for _, tc := range []struct {
+		s       State
+		elapsed time.Duration
+		pos     float64
+		active  bool
+	}{
+		{State{Position: 10, UpdateTime: t0}, 0, 10, true},
+		{State{Position: 10, UpdateTime: t0}, 30 * time.Second, 40, true},
+		{State{Position: 10, UpdateTime: t0}, 190 * time.Second, length, true},
+		{State{Position: 10, UpdateTime: t0}, 190*time.Second + idleTimeout - time.Second, length, true},
+		{State{Position: 10, UpdateTime: t0}, 190*time.Second + idleTimeout, length, false},
+		{State{Position: 10, Paused: true, UpdateTime: t0}, 30 * time.Second, 10, true},
+		{State{Position: 10, Paused: true, UpdateTime: t0}, idleTimeout, 10, false},
+	} {
+		now := t0.Add(tc.elapsed)
+		if got := tc.s.CurrentPosition(now, length); got != tc.pos {
+			t.Errorf("%+v.CurrentPosition(t0+%v, %v) = %v; want %v", tc.s, tc.elapsed, length, got, tc.pos)
+		}
+		if got := tc.s.Active(now, length); got != tc.active {
+			t.Errorf("%+v.Active(t0+%v, %v) = %v; want %v", tc.s, tc.elapsed, length, got, tc.active)
+		}
+	}
+}
@@ -0,0 +1,184 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+// Package pin stores the songs that users have pinned for offline playback.
+package pin
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"google.golang.org/appengine/v2/datastore"
+)
+
+const (
+	pinsKind = "Pins" // datastore kind for Pins entities
+
+	// MaxSongs is the maximum number of songs that a user can pin.
+	MaxSongs = 2000
+)
+
+// Pins contains the songs that a user has pinned so that the web client's service worker
+// can cache them for offline playback. Pins entities are keyed by the user's username
+// or email address.
+type Pins struct {
+	// SongIDs contains the IDs of pinned songs in the order in which they were pinned.
+	SongIDs []int64 `datastore:",noindex"`
+	// Filenames contains the Song.Filename values corresponding to SongIDs.
+	// These are saved so that requests to the /song endpoint can be checked
+	// without needing to look up songs.
+	Filenames []string `datastore:",noindex"`
+	// Downloaded contains flags corresponding to Filenames indicating whether the songs'
+	// data has already been fetched since they were pinned. It may be shorter than
+	// Filenames, in which case the missing flags are false.
+	Downloaded []bool `datastore:",noindex"`
+	// UpdateTime contains the time at which the pins were last updated.
+	UpdateTime time.Time `datastore:",noindex"`
+}
+
+// Add pins the song with the supplied ID and filename.
+// False is returned if the song was already pinned.
+func (p *Pins) Add(id int64, fn string) bool {
+	for _, pid := range p.SongIDs {
+		if pid == id {
+			return false
+		}
+	}
+	p.SongIDs = append(p.SongIDs, id)
+	p.Filenames = append(p.Filenames, fn)
+	if len(p.Downloaded) > 0 {
+		for len(p.Downloaded) < len(p.Filenames) {
+			p.Downloaded = append(p.Downloaded, false)
+		}
+	}
+	return true
+}
+
+// Remove unpins the song with the supplied ID.
+// False is returned if the song wasn't pinned.
+func (p *Pins) Remove(id int64) bool {
+	for i, pid := range p.SongIDs {
+		if pid == id {
+			p.SongIDs = append(p.SongIDs[:i], p.SongIDs[i+1:]...)
+			if i < len(p.Filenames) {
+				p.Filenames = append(p.Filenames[:i], p.Filenames[i+1:]...)
+			}
+			if i < len(p.Downloaded) {
+				p.Downloaded = append(p.Downloaded[:i], p.Downloaded[i+1:]...)
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// HasFilename returns true if a song with the supplied filename is pinned.
+func (p *Pins) HasFilename(fn string) bool {
+	for _, pfn := range p.Filenames {
+		if pfn == fn {
+			return true
+		}
+	}
+	return false
+}
+
+// IsDownloaded returns true if a song with the supplied filename is pinned and
+// its data has already been fetched (per MarkDownloaded) since it was pinned.
+func (p *Pins) IsDownloaded(fn string) bool {
+	for i, pfn := range p.Filenames {
+		if pfn == fn && i < len(p.Downloaded) && p.Downloaded[i] {
+			return true
+		}
+	}
+	return false
+}
+
+// MarkDownloaded records that the data for pinned songs with the supplied filename
+// has been fetched. False is returned if no unmarked songs with the filename are pinned.
+func (p *Pins) MarkDownloaded(fn string) bool {
+	var changed bool
+	for i, pfn := range p.Filenames {
+		if pfn != fn || (i < len(p.Downloaded) && p.Downloaded[i]) {
+			continue
+		}
+		for len(p.Downloaded) <= i {
+			p.Downloaded = append(p.Downloaded, false)
+		}
+		p.Downloaded[i] = true
+		changed = true
+	}
+	return changed
+}
+
+// Get returns the pinned songs for the supplied user.
+// Empty pins are returned if the user hasn't pinned any songs.
+func Get(ctx context.Context, user string) (*Pins, error) {
+	var p Pins
+	key := datastore.NewKey(ctx, pinsKind, user, 0, nil)
+	if err := datastore.Get(ctx, key, &p); err != nil && err != datastore.ErrNoSuchEntity {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// Update calls fn with the supplied user's pins within a transaction and saves
+// the updated pins if fn returns a nil error. An error is returned if the user
+// would have more than MaxSongs pinned songs.
+func Update(ctx context.Context, user string, now time.Time, fn func(p *Pins) error) (*Pins, error) {
+	var p Pins
+	key := datastore.NewKey(ctx, pinsKind, user, 0, nil)
+	err := datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+		p = Pins{}
+		if err := datastore.Get(ctx, key, &p); err != nil && err != datastore.ErrNoSuchEntity {
+			return fmt.Errorf("get pins: %v", err)
+		}
+		if err := fn(&p); err != nil {
+			return err
+		}
+		if len(p.SongIDs) > MaxSongs {
+			return fmt.Errorf("can't pin more than %d songs", MaxSongs)
+		}
+		p.UpdateTime = now
+		if _, err := datastore.Put(ctx, key, &p); err != nil {
+			return fmt.Errorf("save pins: %v", err)
+		}
+		return nil
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// SetDownloaded calls MarkDownloaded within a transaction to record that the supplied
+// user has fetched the data for their pinned song with the supplied filename.
+// UpdateTime is left unchanged, since the set of pinned songs is the same.
+func SetDownloaded(ctx context.Context, user, fn string) error {
+	key := datastore.NewKey(ctx, pinsKind, user, 0, nil)
+	return datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+		var p Pins
+		if err := datastore.Get(ctx, key, &p); err == datastore.ErrNoSuchEntity {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("get pins: %v", err)
+		}
+		if !p.MarkDownloaded(fn) {
+			return nil
+		}
+		if _, err := datastore.Put(ctx, key, &p); err != nil {
+			return fmt.Errorf("save pins: %v", err)
+		}
+		return nil
+	}, nil)
+}
+
+// Clear deletes all saved pins from datastore for testing.
+func Clear(ctx context.Context) error {
+	if keys, err := datastore.NewQuery(pinsKind).KeysOnly().GetAll(ctx, nil); err != nil {
+		return fmt.Errorf("getting %v keys failed: %v", pinsKind, err)
+	} else if err := datastore.DeleteMulti(ctx, keys); err != nil {
+		return fmt.Errorf("deleting all %v entities failed: %v", pinsKind, err)
+	}
+	return nil
+}
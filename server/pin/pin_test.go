@@ -0,0 +1,70 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package pin
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPins(t *testing.T) {
+	var p Pins
+	if !p.Add(1, "a.mp3") || !p.Add(2, "b.mp3") || !p.Add(3, "c.mp3") {
+		t.Fatal("Add failed for new songs")
+	}
+	if p.Add(2, "b.mp3") {
+		t.Error("Add(2) succeeded for already-pinned song")
+	}
+	if !p.Remove(2) {
+		t.Error("Remove(2) failed for pinned song")
+	}
+	if p.Remove(4) {
+		t.Error("Remove(4) succeeded for unpinned song")
+	}
+	if want := []int64{1, 3}; !reflect.DeepEqual(p.SongIDs, want) {
+		t.Errorf("SongIDs = %v; want %v", p.SongIDs, want)
+	}
+	if want := []string{"a.mp3", "c.mp3"}; !reflect.DeepEqual(p.Filenames, want) {
+		t.Errorf("Filenames = %q; want %q", p.Filenames, want)
+	}
+	for fn, want := range map[string]bool{"a.mp3": true, "b.mp3": false, "c.mp3": true} {
+		if got := p.HasFilename(fn); got != want {
+			t.Errorf("HasFilename(%q) = %v; want %v", fn, got, want)
+		}
+	}
+}
+
+func TestPins_Downloaded(t *testing.T) {
+	var p Pins
+	p.Add(1, "a.mp3")
+	p.Add(2, "b.mp3")
+	if p.IsDownloaded("a.mp3") {
+		t.Error("IsDownloaded(a.mp3) = true before MarkDownloaded")
+	}
+	if !p.MarkDownloaded("a.mp3") {
+		t.Error("MarkDownloaded(a.mp3) = false for unmarked song")
+	}
+	if p.MarkDownloaded("a.mp3") {
+		t.Error("MarkDownloaded(a.mp3) = true for already-marked song")
+	}
+	if p.MarkDownloaded("c.mp3") {
+		t.Error("MarkDownloaded(c.mp3) = true for unpinned song")
+	}
+	p.Add(3, "c.mp3")
+	for fn, want := range map[string]bool{"a.mp3": true, "b.mp3": false, "c.mp3": false} {
+		if got := p.IsDownloaded(fn); got != want {
+			t.Errorf("IsDownloaded(%q) = %v; want %v", fn, got, want)
+		}
+	}
+
+	// Unpinning and re-pinning a song should require it to be downloaded again.
+	p.Remove(1)
+	p.Add(1, "a.mp3")
+	if p.IsDownloaded("a.mp3") {
+		t.Error("IsDownloaded(a.mp3) = true after re-pinning")
+	}
+	if want := []bool{false, false, false}; !reflect.DeepEqual(p.Downloaded, want) {
+		t.Errorf("Downloaded = %v; want %v", p.Downloaded, want)
+	}
+}
@@ -10,6 +10,7 @@ import (
 	"strings"
 
 	"github.com/derat/nup/server/cache"
+	"github.com/derat/nup/server/metrics"
 
 	"google.golang.org/appengine/v2/datastore"
 	"google.golang.org/appengine/v2/log"
@@ -19,10 +20,14 @@ const (
 	cachedQueriesKind = "CachedQueries" // datastore kind for cached query results
 	cachedQueriesKey  = "queries"       // memcache key and datastore ID for cached query results
 
-	cachedTagsKind = "CachedTags" // datastore kind for cached tags
-	cachedTagsKey  = "tags"       // memcache key and datastore ID for cached tags
+	cachedTagsKind = "CachedTags"  // datastore kind for cached tags
+	cachedTagsKey  = "libraryTags" // memcache key and datastore ID for cached tags
 )
 
+// resultsGen is bumped by FlushCacheForUpdate whenever songs are updated.
+// It is used to generate ETags for query results without running queries.
+var resultsGen = cache.NewGeneration("query_results_generation")
+
 // cachedQueriesDatastoreKey returns the datastore key for caching queries.
 func cachedQueriesDatastoreKey(ctx context.Context) *datastore.Key {
 	return datastore.NewKey(ctx, cachedQueriesKind, cachedQueriesKey, 0, nil)
@@ -104,14 +109,20 @@ func getCachedResults(ctx context.Context, q *SongQuery, t cache.Type) ([]int64,
 	if err != nil {
 		return nil, err
 	}
-	if m, err := loadCachedQueries(ctx, t); err != nil {
+	m, err := loadCachedQueries(ctx, t)
+	if err != nil {
 		return nil, err
-	} else if m == nil { // cache miss
+	}
+	cq, ok := m[hash] // m is nil on cache miss
+	result := "miss"
+	if ok {
+		result = "hit"
+	}
+	metrics.Add(metrics.QueryCacheLookups, metrics.Labels{"type": t.String(), "result": result}, 1)
+	if !ok {
 		return nil, nil
-	} else if q, ok := m[hash]; ok { // query among cached queries
-		return q.IDs, nil
 	}
-	return nil, nil // query not among cached queries
+	return cq.IDs, nil
 }
 
 // setCachedResults caches ids as results for query in t.
@@ -126,9 +137,9 @@ func setCachedResults(ctx context.Context, q *SongQuery, ids []int64, t cache.Ty
 	}, t)
 }
 
-// cachedTags holds the list of tags currently in use.
+// cachedTags holds the tags currently in use, keyed by library name.
 // It implements datastore.PropertyLoadSaver.
-type cachedTags []string
+type cachedTags map[string][]string
 
 func (t *cachedTags) Load(props []datastore.Property) error {
 	return cache.LoadJSONProp(props, t)
@@ -137,9 +148,9 @@ func (t *cachedTags) Save() ([]datastore.Property, error) {
 	return cache.SaveJSONProp(t)
 }
 
-// getCachedTags attempts to get the list of in-use tags from t.
+// getCachedTags attempts to get the in-use tags (keyed by library name) from t.
 // On a cache miss, both returned values are nil.
-func getCachedTags(ctx context.Context, t cache.Type) ([]string, error) {
+func getCachedTags(ctx context.Context, t cache.Type) (map[string][]string, error) {
 	var tags cachedTags
 	var ok bool
 	var err error
@@ -155,8 +166,8 @@ func getCachedTags(ctx context.Context, t cache.Type) ([]string, error) {
 	return tags, nil
 }
 
-// setCachedTags saves the list of in-use tags to t.
-func setCachedTags(ctx context.Context, tags []string, t cache.Type) error {
+// setCachedTags saves the in-use tags (keyed by library name) to t.
+func setCachedTags(ctx context.Context, tags map[string][]string, t cache.Type) error {
 	switch t {
 	case cache.Memcache:
 		return cache.SetMemcache(ctx, cachedTagsKey, tags)
@@ -191,6 +202,12 @@ func FlushCacheForUpdate(ctx context.Context, ut UpdateTypes) error {
 		}
 	}
 
+	// Bump the generation even if no cached queries were flushed, since the updated songs'
+	// data may still appear in query results.
+	if err := resultsGen.Bump(ctx); err != nil {
+		errs = append(errs, err.Error())
+	}
+
 	if ut&TagsUpdate != 0 || ut&MetadataUpdate != 0 {
 		log.Debugf(ctx, "Flushing cached tags in response to update of type %v", ut)
 		if err := cache.DeleteMemcache(ctx, cachedTagsKey); err != nil {
@@ -207,6 +224,25 @@ func FlushCacheForUpdate(ctx context.Context, ut UpdateTypes) error {
 	return nil
 }
 
+// ResultsETag returns a quoted ETag identifying the results that Songs would return for q
+// when called with flags. The ETag is derived from q's cache key and a generation number
+// that is bumped whenever songs are updated, so it can be checked without running the query.
+// An empty string is returned if q's results aren't stable (e.g. because they're shuffled).
+func ResultsETag(ctx context.Context, q *SongQuery, flags SongsFlags) (string, error) {
+	if !q.canCache() || q.Shuffle || q.ShuffleAlbums || flags&CacheOnly != 0 {
+		return "", nil
+	}
+	hash, err := q.hash()
+	if err != nil {
+		return "", err
+	}
+	gen, err := resultsGen.Number(ctx)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf(`"%s-%x"`, hash, gen), nil
+}
+
 // FlushCache deletes all cached queries and tags from t.
 func FlushCache(ctx context.Context, t cache.Type) error {
 	switch t {
@@ -0,0 +1,87 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package query
+
+import (
+	"math"
+	"sort"
+	"time"
+
+	"github.com/derat/nup/server/db"
+)
+
+// decayedPlays returns s's number of plays with each play's weight halved
+// for every halfLife that has elapsed between its start time and now.
+//
+// Only the most recent plays are stored in s.RecentPlays. Older plays
+// are assumed to have happened at s.FirstStartTime, which underestimates
+// their weight.
+func decayedPlays(s *db.Song, now time.Time, halfLife time.Duration) float64 {
+	weight := func(t time.Time) float64 {
+		age := now.Sub(t)
+		if age < 0 {
+			age = 0
+		}
+		return math.Pow(0.5, float64(age)/float64(halfLife))
+	}
+
+	var total float64
+	plays := s.RecentPlays
+	if len(plays) == 0 && s.NumPlays > 0 {
+		// RecentPlays may be unset for songs that haven't been updated in a while.
+		plays = []db.Play{{StartTime: s.LastStartTime}}
+	}
+	for _, p := range plays {
+		total += weight(p.StartTime)
+	}
+	if n := s.NumPlays - len(plays); n > 0 {
+		total += float64(n) * weight(s.FirstStartTime)
+	}
+	return total
+}
+
+// applyPlayDecay chooses up to max songs from songs after decaying their old
+// plays using halfLife (see decayedPlays). Songs with fewer decayed plays are
+// considered to be fresher.
+//
+// If shuffle is false, the freshest songs are returned in ascending order by
+// decayed plays (and then by last start time). If shuffle is true, songs are
+// chosen randomly (without replacement) with weights that favor fresher songs,
+// using rnd to generate values in [0, 1). The returned songs' order is unspecified
+// in that case.
+func applyPlayDecay(songs []*db.Song, shuffle bool, now time.Time, halfLife time.Duration,
+	max int, rnd func() float64) []*db.Song {
+	type scored struct {
+		song *db.Song
+		key  float64 // lower is better
+	}
+	ss := make([]scored, len(songs))
+	for i, s := range songs {
+		plays := decayedPlays(s, now, halfLife)
+		if shuffle {
+			// Use the Efraimidis-Spirakis algorithm for weighted sampling without replacement:
+			// each item gets a key of u^(1/w) for a uniformly-distributed u, and the items with
+			// the largest keys are chosen. Negate the key so that lower is better.
+			w := 1 / (1 + plays)
+			ss[i] = scored{s, -math.Pow(rnd(), 1/w)}
+		} else {
+			ss[i] = scored{s, plays}
+		}
+	}
+	sort.SliceStable(ss, func(i, j int) bool {
+		if ss[i].key != ss[j].key {
+			return ss[i].key < ss[j].key
+		}
+		return ss[i].song.LastStartTime.Before(ss[j].song.LastStartTime)
+	})
+
+	if len(ss) > max {
+		ss = ss[:max]
+	}
+	res := make([]*db.Song, len(ss))
+	for i := range ss {
+		res[i] = ss[i].song
+	}
+	return res
+}
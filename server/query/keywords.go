@@ -0,0 +1,187 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package query
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+
+	"github.com/derat/nup/server/db"
+)
+
+// ParseKeywords parses a search string into q's Artist, Title, Album, AlbumID, Keywords,
+// NotKeywords, Phrases, and NotPhrases fields. The following syntax is supported:
+//
+//	word          song contains word (punctuation is treated as a word separator)
+//	-word         song doesn't contain word
+//	"some words"  song contains the consecutive words in its artist, title, album, etc.
+//	-"some words" song doesn't contain the consecutive words
+//	artist:name   song's artist is name (also title:, album:, and albumId:)
+//
+// Field values may be quoted to include spaces, and backslashes escape the following character.
+func (q *SongQuery) ParseKeywords(text string) error {
+	rs := []rune(text)
+	i := 0
+	for {
+		for i < len(rs) && unicode.IsSpace(rs[i]) {
+			i++
+		}
+		if i == len(rs) {
+			break
+		}
+
+		neg := false
+		if rs[i] == '-' && i+1 < len(rs) && !unicode.IsSpace(rs[i+1]) {
+			neg = true
+			i++
+		}
+
+		if field, dst := q.keywordField(string(rs[i:])); dst != nil {
+			if neg {
+				return fmt.Errorf("negated %q terms are unsupported", field)
+			}
+			// Skip over the field name and any following whitespace.
+			i += len([]rune(field)) + 1
+			for i < len(rs) && unicode.IsSpace(rs[i]) {
+				i++
+			}
+			var val string
+			val, i = readKeywordValue(rs, i)
+			*dst = val
+			continue
+		}
+
+		var val string
+		quoted := rs[i] == '"'
+		if quoted {
+			val, i = readKeywordValue(rs, i)
+		} else {
+			start := i
+			for i < len(rs) && !unicode.IsSpace(rs[i]) {
+				i++
+			}
+			val = string(rs[start:i])
+		}
+
+		norm, err := db.Normalize(val)
+		if err != nil {
+			return fmt.Errorf("normalizing %q: %v", val, err)
+		}
+		words := db.KeywordFields(norm)
+		switch {
+		case len(words) == 0:
+			continue
+		case neg && len(words) == 1:
+			q.NotKeywords = append(q.NotKeywords, words[0])
+		case neg:
+			q.NotPhrases = append(q.NotPhrases, strings.Join(words, " "))
+		case quoted && len(words) > 1:
+			q.Phrases = append(q.Phrases, strings.Join(words, " "))
+			q.Keywords = append(q.Keywords, words...) // narrow the datastore query
+		default:
+			q.Keywords = append(q.Keywords, words...)
+		}
+	}
+	return nil
+}
+
+// keywordField checks if s starts with a field-scoped term like "artist:".
+// If so, the field name and a pointer to the corresponding field in q are returned.
+func (q *SongQuery) keywordField(s string) (string, *string) {
+	for _, f := range []struct {
+		name string
+		dst  *string
+	}{
+		{"artist", &q.Artist},
+		{"title", &q.Title},
+		{"albumId", &q.AlbumID},
+		{"album", &q.Album},
+	} {
+		if strings.HasPrefix(s, f.name+":") {
+			return f.name, f.dst
+		}
+	}
+	return "", nil
+}
+
+// readKeywordValue reads a possibly-quoted value from rs starting at index start.
+// The value ends at the first unquoted whitespace character. Backslashes escape the
+// following character. The unescaped value and the index following it are returned.
+func readKeywordValue(rs []rune, start int) (string, int) {
+	var val []rune
+	var inEscape, inQuote bool
+	i := start
+	for ; i < len(rs); i++ {
+		ch := rs[i]
+		switch {
+		case ch == '\\' && !inEscape:
+			inEscape = true
+		case ch == '"' && !inEscape:
+			inQuote = !inQuote
+		case unicode.IsSpace(ch) && !inQuote && !inEscape:
+			return string(val), i
+		default:
+			val = append(val, ch)
+			inEscape = false
+		}
+	}
+	return string(val), i
+}
+
+// matchesPhrases returns true if s contains all of q.Phrases and none of q.NotPhrases.
+func (q *SongQuery) matchesPhrases(s *db.Song) bool {
+	if len(q.Phrases) == 0 && len(q.NotPhrases) == 0 {
+		return true
+	}
+	srcs, err := s.KeywordSources()
+	if err != nil {
+		return false
+	}
+	fields := make([][]string, len(srcs))
+	for i, src := range srcs {
+		fields[i] = db.KeywordFields(src)
+	}
+	has := func(phrase string) bool {
+		words := strings.Fields(phrase)
+		for _, f := range fields {
+			if hasWordSeq(f, words) {
+				return true
+			}
+		}
+		return false
+	}
+
+	for _, p := range q.Phrases {
+		if !has(p) {
+			return false
+		}
+	}
+	for _, p := range q.NotPhrases {
+		if has(p) {
+			return false
+		}
+	}
+	return true
+}
+
+// hasWordSeq returns true if words appears as a consecutive subsequence of field.
+func hasWordSeq(field, words []string) bool {
+	if len(words) == 0 {
+		return true
+	}
+	for i := 0; i+len(words) <= len(field); i++ {
+		match := true
+		for j, w := range words {
+			if field[i+j] != w {
+				match = false
+				break
+			}
+		}
+		if match {
+			return true
+		}
+	}
+	return false
+}
@@ -16,10 +16,16 @@ import (
 	"strconv"
 	"strings"
 	"time"
+	"unicode/utf8"
 
 	"github.com/derat/nup/server/cache"
 	"github.com/derat/nup/server/db"
+	"github.com/derat/nup/server/stats"
 
+	"golang.org/x/text/collate"
+	"golang.org/x/text/language"
+
+	"google.golang.org/appengine/v2"
 	"google.golang.org/appengine/v2/datastore"
 	"google.golang.org/appengine/v2/log"
 )
@@ -28,6 +34,12 @@ const (
 	maxResults        = 100  // max songs to return for query
 	truncateMapThresh = 1000 // max song ID map size for truncateIDsByLastStartTime
 	shuffleSkew       = 0.25 // max offset to skew songs' positions when shuffling
+
+	playDecayCandidates = 3 // multiple of maxResults to load when decaying plays
+
+	songsByIDBatchSize = 500 // max songs to get in each datastore call in SongsByID
+	filterBatchSize    = 500 // max songs to load at once in filterIDs
+	albumBatchSize     = 50  // max songs to load at once in chooseAlbums
 )
 
 // SongQuery describes a query returning a list of Songs.
@@ -38,7 +50,11 @@ type SongQuery struct {
 	AlbumID  string // Song.AlbumID
 	Filename string // song.Filename
 
-	Keywords []string // Song.Keywords
+	Keywords     []string     // Song.Keywords
+	KeywordMatch KeywordMatch // how Keywords are matched
+	NotKeywords  []string     // not present in Song.Keywords
+	Phrases      []string     // space-separated normalized words that must appear consecutively
+	NotPhrases   []string     // space-separated normalized words that must not appear consecutively
 
 	Rating    int  // Song.Rating (0 if unspecified; use Unrated for 0)
 	MinRating int  // Song.Rating (0 if unspecified)
@@ -47,24 +63,156 @@ type SongQuery struct {
 
 	MaxPlays int64 // Song.NumPlays (-1 if unspecified)
 
+	MinSkipRatio float64 // Song.SkipRatio (0 if unspecified)
+	MaxSkipRatio float64 // Song.SkipRatio (0 if unspecified)
+
 	MinFirstStartTime time.Time // Song.FirstStartTime
 	MaxLastStartTime  time.Time // Song.LastStartTime
 
 	Track int64 // Song.Track
 	Disc  int64 // Song.Disc
 
-	MinDate time.Time // Song.Date
-	MaxDate time.Time // Song.Date
+	Compilation bool // Song.Compilation is true
+
+	IncompleteAlbums bool // song is in an album listed by stats.IncompleteAlbums
+
+	MinDate   time.Time // Song.Date (or field specified by DateField)
+	MaxDate   time.Time // Song.Date (or field specified by DateField)
+	DateField DateField // field compared against MinDate and MaxDate
+
+	MinBPM float64 // Song.BPM (0 if unspecified)
+	MaxBPM float64 // Song.BPM (0 if unspecified)
 
-	Tags    []string // present in Song.Tags
-	NotTags []string // not present in Song.Tags
+	Tags    []string   // present in Song.Tags
+	AnyTags [][]string // at least one tag from each group present in Song.Tags (see ExpandTags)
+	NotTags []string   // not present in Song.Tags
+
+	Genres    []string // present in Song.Genres
+	NotGenres []string // not present in Song.Genres
+
+	Library      string   // Song.Library (ignored if empty)
+	NotLibraries []string // not equal to Song.Library
 
 	Shuffle              bool // randomize results set/order
+	PreferTransitions    bool // with Shuffle, follow songs with songs that were played after them
+	ShuffleAlbums        bool // randomize albums in results, keeping each album's songs together
 	OrderByLastStartTime bool // order by Song.LastStartTime
+
+	// PlayDecay contains a half-life for decaying old plays when Shuffle or
+	// OrderByLastStartTime is true. See applyPlayDecay. Disabled if 0.
+	PlayDecay time.Duration
+
+	// PlaysUser contains a Play.User value. If non-empty, MaxPlays and OrderByLastStartTime
+	// only consider plays reported by the user, and PlayDecay is ignored.
+	PlaysUser string
+}
+
+// KeywordMatch describes how SongQuery.Keywords are matched against songs.
+type KeywordMatch int
+
+const (
+	// ExactKeywords matches complete normalized words.
+	ExactKeywords KeywordMatch = iota
+	// PrefixKeywords matches words that start with each keyword, e.g. "radioh" matches "radiohead".
+	// Keywords shorter than db.MinKeywordPrefixLen are matched exactly.
+	PrefixKeywords
+	// FuzzyKeywords matches words that are within a single edit (insertion, deletion,
+	// substitution, or adjacent transposition) of each keyword. Keywords shorter than
+	// db.MinFuzzyKeywordLen are matched exactly. See db.KeywordVariants.
+	FuzzyKeywords
+)
+
+// ParseKeywordMatch parses a KeywordMatch from s ("exact", "prefix", or "fuzzy").
+// An empty string is parsed as ExactKeywords.
+func ParseKeywordMatch(s string) (KeywordMatch, error) {
+	switch s {
+	case "", "exact":
+		return ExactKeywords, nil
+	case "prefix":
+		return PrefixKeywords, nil
+	case "fuzzy":
+		return FuzzyKeywords, nil
+	default:
+		return ExactKeywords, fmt.Errorf("invalid keyword match %q", s)
+	}
+}
+
+// DateField describes which of a song's dates is compared against SongQuery.MinDate and MaxDate.
+type DateField int
+
+const (
+	// DefaultDate compares against Song.Date.
+	DefaultDate DateField = iota
+	// OriginalDate compares against Song.OriginalDate.
+	OriginalDate
+	// ReleaseDate compares against Song.ReleaseDate.
+	ReleaseDate
+)
+
+// ParseDateField parses a DateField from s ("date", "original", or "release").
+// An empty string is parsed as DefaultDate.
+func ParseDateField(s string) (DateField, error) {
+	switch s {
+	case "", "date":
+		return DefaultDate, nil
+	case "original":
+		return OriginalDate, nil
+	case "release":
+		return ReleaseDate, nil
+	default:
+		return DefaultDate, fmt.Errorf("invalid date field %q", s)
+	}
+}
+
+// prop returns the name of the Song property corresponding to f.
+func (f DateField) prop() string {
+	switch f {
+	case OriginalDate:
+		return "OriginalDate"
+	case ReleaseDate:
+		return "ReleaseDate"
+	default:
+		return "Date"
+	}
+}
+
+// get returns s's date corresponding to f.
+func (f DateField) get(s *db.Song) time.Time {
+	switch f {
+	case OriginalDate:
+		return s.OriginalDate
+	case ReleaseDate:
+		return s.ReleaseDate
+	default:
+		return s.Date
+	}
 }
 
 func (q *SongQuery) hasMaxPlays() bool { return q.MaxPlays >= 0 }
 
+func (q *SongQuery) hasSkipRatio() bool { return q.MinSkipRatio > 0 || q.MaxSkipRatio > 0 }
+
+// matchesSkipRatio returns true if s satisfies q.MinSkipRatio and q.MaxSkipRatio.
+func (q *SongQuery) matchesSkipRatio(s *db.Song) bool {
+	r := s.SkipRatio()
+	return (q.MinSkipRatio <= 0 || r >= q.MinSkipRatio) && (q.MaxSkipRatio <= 0 || r <= q.MaxSkipRatio)
+}
+
+// usePlayDecay returns true if applyPlayDecay should be used to choose results.
+func (q *SongQuery) usePlayDecay() bool {
+	return q.PlayDecay > 0 && (q.Shuffle || q.OrderByLastStartTime) && q.PlaysUser == "" &&
+		!q.ShuffleAlbums
+}
+
+// numCandidates returns the number of songs that should be loaded to choose
+// maxResults songs.
+func (q *SongQuery) numCandidates() int {
+	if q.usePlayDecay() {
+		return maxResults * playDecayCandidates
+	}
+	return maxResults
+}
+
 // hash returns a string uniquely identifying q.
 func (q *SongQuery) hash() (string, error) {
 	b, err := json.Marshal(q)
@@ -78,7 +226,7 @@ func (q *SongQuery) hash() (string, error) {
 // canCache returns true if the query's results can be safely cached.
 func (q *SongQuery) canCache() bool {
 	return !q.hasMaxPlays() && q.MinFirstStartTime.IsZero() && q.MaxLastStartTime.IsZero() &&
-		!q.OrderByLastStartTime
+		!q.OrderByLastStartTime && !q.hasSkipRatio() && !q.IncompleteAlbums
 }
 
 // resultsInvalidated returns true if the updates described by ut would
@@ -90,12 +238,19 @@ func (q *SongQuery) resultsInvalidated(ut UpdateTypes) bool {
 	if (ut&RatingUpdate) != 0 && (q.Rating != 0 || q.MinRating != 0 || q.MaxRating != 0 || q.Unrated) {
 		return true
 	}
-	if (ut&TagsUpdate) != 0 && (len(q.Tags) > 0 || len(q.NotTags) > 0) {
+	if (ut&TagsUpdate) != 0 && (len(q.Tags) > 0 || len(q.AnyTags) > 0 || len(q.NotTags) > 0) {
 		return true
 	}
 	if (ut&PlaysUpdate) != 0 &&
 		(q.hasMaxPlays() || !q.MinFirstStartTime.IsZero() || !q.MaxLastStartTime.IsZero() ||
-			q.OrderByLastStartTime) {
+			q.OrderByLastStartTime || q.hasSkipRatio()) {
+		return true
+	}
+	if (ut&SkipsUpdate) != 0 && q.hasSkipRatio() {
+		return true
+	}
+	if (ut&NotesUpdate) != 0 && (len(q.Keywords) > 0 || len(q.NotKeywords) > 0 ||
+		len(q.Phrases) > 0 || len(q.NotPhrases) > 0) {
 		return true
 	}
 	return false
@@ -110,6 +265,8 @@ const (
 	RatingUpdate
 	TagsUpdate
 	PlaysUpdate
+	SkipsUpdate
+	NotesUpdate
 )
 
 // SongsFlags is a bitfield controlling the behavior of the Songs function.
@@ -201,15 +358,24 @@ func Songs(ctx context.Context, query *SongQuery, flags SongsFlags) ([]*db.Song,
 		return []*db.Song{}, nil // ugly: can't return nil slice since it messes up JSON response
 	}
 
-	// Shuffle and truncate the results if needed.
+	// Shuffle and truncate the results if needed. If old plays are being decayed,
+	// load extra candidates so applyPlayDecay can choose between them.
 	numResults := len(ids)
-	if numResults > maxResults {
-		numResults = maxResults
-	}
-	if query.Shuffle {
+	if query.ShuffleAlbums {
 		shufflePartial(ids, numResults)
+		if ids, err = chooseAlbums(ctx, ids, maxResults); err != nil {
+			return nil, err
+		}
+		numResults = len(ids)
+	} else {
+		if numResults > query.numCandidates() {
+			numResults = query.numCandidates()
+		}
+		if query.Shuffle {
+			shufflePartial(ids, numResults)
+		}
+		ids = ids[:numResults]
 	}
-	ids = ids[:numResults]
 
 	// Get the songs from datastore.
 	startTime := time.Now()
@@ -227,17 +393,90 @@ func Songs(ctx context.Context, query *SongQuery, flags SongsFlags) ([]*db.Song,
 	for i, id := range ids {
 		CleanSong(songs[i], id)
 	}
-	if query.Shuffle {
+	if query.usePlayDecay() {
+		songs = applyPlayDecay(songs, query.Shuffle, time.Now(), query.PlayDecay,
+			maxResults, rand.Float64)
+	}
+	switch {
+	case query.ShuffleAlbums:
+		sortAlbumGroups(songs)
+	case query.Shuffle:
 		spreadSongs(songs)
-	} else if query.OrderByLastStartTime {
+		if query.PreferTransitions {
+			counts, err := stats.TransitionCounts(ctx, ids)
+			if err != nil {
+				return nil, err
+			}
+			orderByTransitions(songs, counts, rand.Float64)
+		}
+	case query.usePlayDecay():
+		// applyPlayDecay already ordered the songs.
+	case query.OrderByLastStartTime && query.PlaysUser != "":
+		// runQuery already ordered the IDs by the user's plays.
+	case query.OrderByLastStartTime:
 		sort.Slice(songs, func(i, j int) bool { return songs[i].LastStartTime.Before(songs[j].LastStartTime) })
-	} else {
+	default:
 		sortSongs(songs)
 	}
 
 	return songs, nil
 }
 
+// SongsByID returns the songs identified by ids, prepared as in Songs' results.
+// The returned slice is in the same order as ids and contains nil for missing songs.
+func SongsByID(ctx context.Context, ids []int64) ([]*db.Song, error) {
+	startTime := time.Now()
+	songs := make([]*db.Song, len(ids))
+	for start := 0; start < len(ids); start += songsByIDBatchSize {
+		end := start + songsByIDBatchSize
+		if end > len(ids) {
+			end = len(ids)
+		}
+		keys := make([]*datastore.Key, 0, end-start)
+		for _, id := range ids[start:end] {
+			keys = append(keys, datastore.NewKey(ctx, db.SongKind, "", id, nil))
+		}
+		loaded := make([]db.Song, len(keys))
+		err := datastore.GetMulti(ctx, keys, loaded)
+		merr, _ := err.(appengine.MultiError)
+		if err != nil && merr == nil {
+			return nil, fmt.Errorf("failed to get %v songs: %v", len(keys), err)
+		}
+		for i, k := range keys {
+			if merr != nil && merr[i] != nil {
+				if merr[i] == datastore.ErrNoSuchEntity {
+					continue
+				}
+				return nil, fmt.Errorf("failed to get song %v: %v", k.IntID(), merr[i])
+			}
+			s := &loaded[i]
+			CleanSong(s, k.IntID())
+			songs[start+i] = s
+		}
+	}
+	log.Debugf(ctx, "Fetched %v song(s) by ID in %v ms", len(ids), msecSince(startTime))
+	return songs, nil
+}
+
+// SongsByFilename returns the songs in library (see db.Song.Library) with the supplied
+// filename, prepared as in Songs' results.
+func SongsByFilename(ctx context.Context, fn, library string) ([]*db.Song, error) {
+	var loaded []db.Song
+	keys, err := datastore.NewQuery(db.SongKind).Filter("Filename =", fn).GetAll(ctx, &loaded)
+	if err != nil {
+		return nil, err
+	}
+	var songs []*db.Song
+	for i, k := range keys {
+		// Songs in the main library may lack Library properties, so check it here.
+		if s := &loaded[i]; s.Library == library {
+			CleanSong(s, k.IntID())
+			songs = append(songs, s)
+		}
+	}
+	return songs, nil
+}
+
 // runQueriesAndGetIDs runs the provided queries in parallel and returns the results from each.
 // Each result set (consisting of key integer IDs) is sorted in ascending order.
 func runQueriesAndGetIDs(ctx context.Context, qs []*datastore.Query) ([][]int64, []time.Duration, error) {
@@ -305,6 +544,27 @@ func intersectSortedIDs(a, b []int64) []int64 {
 	return m
 }
 
+// unionSortedIDs returns the union of two sorted arrays that don't have duplicate values.
+func unionSortedIDs(a, b []int64) []int64 {
+	m := make([]int64, 0, len(a)+len(b))
+	var i, j int
+	for i < len(a) || j < len(b) {
+		switch {
+		case j >= len(b) || (i < len(a) && a[i] < b[j]):
+			m = append(m, a[i])
+			i++
+		case i >= len(a) || b[j] < a[i]:
+			m = append(m, b[j])
+			j++
+		default:
+			m = append(m, a[i])
+			i++
+			j++
+		}
+	}
+	return m
+}
+
 // subtractSortedIDs returns values present in a but not in b (i.e. the intersection of a and !b).
 // Both arrays must be sorted.
 func subtractSortedIDs(a, b []int64) []int64 {
@@ -343,13 +603,10 @@ func runQuery(ctx context.Context, query *SongQuery, fallback bool) ([]int64, er
 
 	type term struct{ expr, val string }
 	terms := []term{
-		{"ArtistLower =", query.Artist},
+		{"ArtistsLower =", query.Artist},
 		{"TitleLower =", query.Title},
 		{"AlbumLower =", query.Album},
 	}
-	for _, w := range query.Keywords {
-		terms = append(terms, term{"Keywords =", w})
-	}
 	for _, t := range terms {
 		if t.val != "" {
 			if norm, err := db.Normalize(t.val); err != nil {
@@ -360,6 +617,24 @@ func runQuery(ctx context.Context, query *SongQuery, fallback bool) ([]int64, er
 		}
 	}
 
+	// Fuzzy keywords can't be expressed as equality filters, so each one is
+	// handled later by running a query per variant and unioning the results.
+	var fuzzyWords []string
+	for _, w := range query.Keywords {
+		norm, err := db.Normalize(w)
+		if err != nil {
+			return nil, fmt.Errorf("normalizing %q: %v", w, err)
+		}
+		switch n := utf8.RuneCountInString(norm); {
+		case query.KeywordMatch == PrefixKeywords && n >= db.MinKeywordPrefixLen:
+			eq = eq.Filter("KeywordPrefixes =", norm)
+		case query.KeywordMatch == FuzzyKeywords && n >= db.MinFuzzyKeywordLen:
+			fuzzyWords = append(fuzzyWords, norm)
+		default:
+			eq = eq.Filter("Keywords =", norm)
+		}
+	}
+
 	if query.AlbumID != "" {
 		eq = eq.Filter("AlbumId =", query.AlbumID)
 	}
@@ -409,7 +684,9 @@ func runQuery(ctx context.Context, query *SongQuery, fallback bool) ([]int64, er
 		eq = eq.Filter("Rating =", 0)
 	}
 
-	if query.MaxPlays == 0 {
+	// User-scoped play filters are applied later using the user's Play entities.
+	userPlays := query.PlaysUser != "" && (query.hasMaxPlays() || query.OrderByLastStartTime)
+	if query.MaxPlays == 0 && !userPlays {
 		eq = eq.Filter("NumPlays =", 0)
 	}
 	if query.Track > 0 {
@@ -418,9 +695,19 @@ func runQuery(ctx context.Context, query *SongQuery, fallback bool) ([]int64, er
 	if query.Disc > 0 {
 		eq = eq.Filter("Disc =", query.Disc)
 	}
+	if query.Compilation {
+		eq = eq.Filter("Compilation =", true)
+	}
 	for _, t := range query.Tags {
 		eq = eq.Filter("Tags =", t)
 	}
+	for _, g := range query.Genres {
+		norm, err := db.Normalize(g)
+		if err != nil {
+			return nil, fmt.Errorf("normalizing %q: %v", g, err)
+		}
+		eq = eq.Filter("GenresLower =", norm)
+	}
 
 	var qs []*datastore.Query // underlying queries to run in parallel
 
@@ -441,18 +728,31 @@ func runQuery(ctx context.Context, query *SongQuery, fallback bool) ([]int64, er
 
 	if !query.MinDate.IsZero() || !query.MaxDate.IsZero() {
 		dq := iq
+		prop := query.DateField.prop()
 		if !query.MinDate.IsZero() {
-			dq = dq.Filter("Date >=", query.MinDate)
+			dq = dq.Filter(prop+" >=", query.MinDate)
 		}
 		if !query.MaxDate.IsZero() {
-			dq = dq.Filter("Date <=", query.MaxDate)
+			dq = dq.Filter(prop+" <=", query.MaxDate)
 			if query.MinDate.IsZero() {
-				dq = dq.Filter("Date >", time.Time{}) // exclude unset dates
+				dq = dq.Filter(prop+" >", time.Time{}) // exclude unset dates
 			}
 		}
 		qs = append(qs, dq)
 	}
-	if query.MaxPlays >= 1 {
+	if query.MinBPM > 0 || query.MaxBPM > 0 {
+		bq := iq
+		if query.MinBPM > 0 {
+			bq = bq.Filter("BPM >=", query.MinBPM)
+		} else {
+			bq = bq.Filter("BPM >", 0.0) // exclude unset BPMs
+		}
+		if query.MaxBPM > 0 {
+			bq = bq.Filter("BPM <=", query.MaxBPM)
+		}
+		qs = append(qs, bq)
+	}
+	if query.MaxPlays >= 1 && !userPlays {
 		qs = append(qs, iq.Filter("NumPlays <=", query.MaxPlays))
 	}
 	if !query.MinFirstStartTime.IsZero() {
@@ -466,24 +766,82 @@ func runQuery(ctx context.Context, query *SongQuery, fallback bool) ([]int64, er
 	}
 
 	// If we don't have any queries that incorporate the equality filters and inequality filters,
-	// just run a query with the equality filters by itself.
-	if len(qs) == 0 {
+	// just run a query with the equality filters by itself. The fuzzy and tag group queries also
+	// incorporate the equality filters, so this isn't needed if we have them.
+	scoped := query.Library != "" || len(query.NotLibraries) > 0
+	if len(qs) == 0 && len(fuzzyWords) == 0 && len(query.AnyTags) == 0 {
 		q := eq
 		// Limit the number of the results if we know that we we won't need to intersect multiple
 		// queries or shuffle a big result set.
-		if query.OrderByLastStartTime {
-			q = q.Order("LastStartTime").Limit(maxResults)
-		} else if len(query.NotTags) == 0 && !query.Shuffle {
+		if query.OrderByLastStartTime && !userPlays && !query.hasSkipRatio() &&
+			!query.IncompleteAlbums && !scoped {
+			q = q.Order("LastStartTime").Limit(query.numCandidates())
+		} else if len(query.NotTags) == 0 && len(query.NotKeywords) == 0 &&
+			len(query.NotGenres) == 0 && len(query.Phrases) == 0 && len(query.NotPhrases) == 0 &&
+			!query.Shuffle && !userPlays && !query.hasSkipRatio() && !query.IncompleteAlbums &&
+			!scoped {
 			q = q.Limit(maxResults)
 		}
 		qs = append(qs, q)
 	}
 
+	// Songs in the main library may lack Library properties, so libraries are handled by
+	// intersecting with (or subtracting) separate queries rather than by adding equality
+	// filters. This also avoids needing additional composite indexes.
+	libraryQuery := func(name string) *datastore.Query {
+		return datastore.NewQuery(db.SongKind).KeysOnly().Filter("Library =", name)
+	}
+	if query.Library != "" {
+		qs = append(qs, libraryQuery(query.Library))
+	}
+
+	// Run a query for each variant of each fuzzy keyword. The results for each
+	// keyword are unioned and then intersected with the other results.
+	fuzzyQueryStart := len(qs)
+	var fuzzyGroups [][]int // indexes into qs for each fuzzy keyword and tag group
+	for _, w := range fuzzyWords {
+		var group []int
+		for _, v := range db.KeywordVariants([]string{w}) {
+			group = append(group, len(qs))
+			qs = append(qs, eq.Filter("KeywordVariants =", v))
+		}
+		fuzzyGroups = append(fuzzyGroups, group)
+	}
+	// Tag groups are handled the same way.
+	for _, tags := range query.AnyTags {
+		var group []int
+		for _, t := range tags {
+			group = append(group, len(qs))
+			qs = append(qs, eq.Filter("Tags =", t))
+		}
+		fuzzyGroups = append(fuzzyGroups, group)
+	}
+
 	// Also run a query for each tag that shouldn't be present and subtract it from the results.
 	negativeQueryStart := len(qs)
 	for _, t := range query.NotTags {
 		qs = append(qs, eq.Filter("Tags =", t))
 	}
+	// Do the same for keywords that shouldn't be present.
+	for _, w := range query.NotKeywords {
+		norm, err := db.Normalize(w)
+		if err != nil {
+			return nil, fmt.Errorf("normalizing %q: %v", w, err)
+		}
+		qs = append(qs, eq.Filter("Keywords =", norm))
+	}
+	// And for genres.
+	for _, g := range query.NotGenres {
+		norm, err := db.Normalize(g)
+		if err != nil {
+			return nil, fmt.Errorf("normalizing %q: %v", g, err)
+		}
+		qs = append(qs, eq.Filter("GenresLower =", norm))
+	}
+	// And for libraries.
+	for _, l := range query.NotLibraries {
+		qs = append(qs, libraryQuery(l))
+	}
 
 	start := time.Now()
 	unmerged, times, err := runQueriesAndGetIDs(ctx, qs)
@@ -497,25 +855,73 @@ func runQuery(ctx context.Context, query *SongQuery, fallback bool) ([]int64, er
 	log.Debugf(ctx, "Ran %v query(s) in %v ms: %v",
 		len(qs), msecSince(start), strings.Join(details, ", "))
 
-	// Intersect and subtract the queries to get a single ordered result set.
+	// Intersect, union, and subtract the queries to get a single ordered result set.
 	merged := unmerged[0]
 	if len(unmerged) > 1 {
 		start := time.Now()
-		for i, ids := range unmerged[1:] {
-			if i+1 < negativeQueryStart {
-				merged = intersectSortedIDs(merged, ids)
-			} else {
-				merged = subtractSortedIDs(merged, ids)
+		pos := append([][]int64{}, unmerged[:fuzzyQueryStart]...)
+		for _, group := range fuzzyGroups {
+			var union []int64
+			for _, i := range group {
+				union = unionSortedIDs(union, unmerged[i])
 			}
+			pos = append(pos, union)
+		}
+		merged = pos[0]
+		for _, ids := range pos[1:] {
+			merged = intersectSortedIDs(merged, ids)
+		}
+		for _, ids := range unmerged[negativeQueryStart:] {
+			merged = subtractSortedIDs(merged, ids)
 		}
 		log.Debugf(ctx, "Merged to %d result(s) in %v ms", len(merged), msecSince(start))
 	}
 
+	// Incomplete albums are computed periodically by stats.Update.
+	if query.IncompleteAlbums {
+		albums, err := stats.IncompleteAlbums(ctx)
+		if err != nil {
+			return nil, err
+		}
+		var ids []int64
+		for _, a := range albums {
+			ids = append(ids, a.SongIDs...)
+		}
+		sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+		merged = intersectSortedIDs(merged, ids)
+		log.Debugf(ctx, "Intersected with %d incomplete album(s) to %d result(s)",
+			len(albums), len(merged))
+	}
+
+	// Datastore can't match phrases or compute skip ratios, so check them in memory.
+	if len(query.Phrases) > 0 || len(query.NotPhrases) > 0 || query.hasSkipRatio() {
+		start := time.Now()
+		if merged, err = filterIDs(ctx, merged, func(s *db.Song) bool {
+			return query.matchesPhrases(s) && query.matchesSkipRatio(s)
+		}); err != nil {
+			return nil, err
+		}
+		log.Debugf(ctx, "Filtered in memory to %d result(s) in %v ms", len(merged), msecSince(start))
+	}
+
+	if userPlays {
+		start := time.Now()
+		plays, err := getUserPlays(ctx, query.PlaysUser)
+		if err != nil {
+			return nil, err
+		}
+		merged = filterIDsByUserPlays(merged, plays, query.MaxPlays,
+			query.OrderByLastStartTime, query.numCandidates())
+		log.Debugf(ctx, "Filtered by %v's %d played song(s) to %d result(s) in %v ms",
+			query.PlaysUser, len(plays), len(merged), msecSince(start))
+		return merged, nil
+	}
+
 	// If we weren't able to use datastore to limit the number of results,
 	// do another query to get the correct ordering so we can truncate.
-	if query.OrderByLastStartTime && len(merged) > maxResults {
+	if query.OrderByLastStartTime && len(merged) > query.numCandidates() {
 		start := time.Now()
-		if merged, err = truncateIDsByLastStartTime(ctx, merged); err != nil {
+		if merged, err = truncateIDsByLastStartTime(ctx, merged, query.numCandidates()); err != nil {
 			return nil, err
 		}
 		log.Debugf(ctx, "Truncated by last start time to %d result(s) in %v ms",
@@ -525,11 +931,121 @@ func runQuery(ctx context.Context, query *SongQuery, fallback bool) ([]int64, er
 	return merged, nil
 }
 
-// truncateIDsByLastStartTime returns the first maxResults (at most) of the supplied sorted
+// filterIDs loads the songs identified by ids and returns the IDs of the songs
+// for which keep returns true. This is used for filters that can't be expressed
+// as Datastore queries (e.g. adjacent words).
+func filterIDs(ctx context.Context, ids []int64, keep func(*db.Song) bool) ([]int64, error) {
+	res := make([]int64, 0, len(ids))
+	for start := 0; start < len(ids); start += filterBatchSize {
+		end := start + filterBatchSize
+		if end > len(ids) {
+			end = len(ids)
+		}
+		keys := make([]*datastore.Key, 0, end-start)
+		for _, id := range ids[start:end] {
+			keys = append(keys, datastore.NewKey(ctx, db.SongKind, "", id, nil))
+		}
+		songs := make([]db.Song, len(keys))
+		if err := datastore.GetMulti(ctx, keys, songs); err != nil {
+			return nil, err
+		}
+		for i := range songs {
+			if keep(&songs[i]) {
+				res = append(res, keys[i].IntID())
+			}
+		}
+	}
+	return res, nil
+}
+
+// chooseAlbums returns up to max IDs from ids (which should already be shuffled)
+// such that all of the IDs belonging to each album are grouped together. Albums are
+// ordered by their first appearance in ids, and songs without album IDs are treated
+// as single-song albums. Albums are never split unless the first album has more
+// than max songs.
+func chooseAlbums(ctx context.Context, ids []int64, max int) ([]int64, error) {
+	matched := make(map[int64]struct{}, len(ids))
+	for _, id := range ids {
+		matched[id] = struct{}{}
+	}
+	seen := make(map[string]struct{})
+	res := make([]int64, 0, max)
+	for start := 0; start < len(ids); start += albumBatchSize {
+		end := start + albumBatchSize
+		if end > len(ids) {
+			end = len(ids)
+		}
+		keys := make([]*datastore.Key, 0, end-start)
+		for _, id := range ids[start:end] {
+			keys = append(keys, datastore.NewKey(ctx, db.SongKind, "", id, nil))
+		}
+		songs := make([]db.Song, len(keys))
+		if err := datastore.GetMulti(ctx, keys, songs); err != nil {
+			return nil, err
+		}
+		for i, s := range songs {
+			group := []int64{keys[i].IntID()}
+			if s.AlbumID != "" {
+				if _, ok := seen[s.AlbumID]; ok {
+					continue
+				}
+				seen[s.AlbumID] = struct{}{}
+				albumKeys, err := datastore.NewQuery(db.SongKind).KeysOnly().
+					Filter("AlbumId =", s.AlbumID).GetAll(ctx, nil)
+				if err != nil {
+					return nil, err
+				}
+				group = group[:0]
+				for _, k := range albumKeys {
+					if _, ok := matched[k.IntID()]; ok {
+						group = append(group, k.IntID())
+					}
+				}
+			}
+			if len(res) == 0 && len(group) > max {
+				return group[:max], nil
+			} else if len(res)+len(group) > max {
+				return res, nil
+			}
+			res = append(res, group...)
+		}
+	}
+	return res, nil
+}
+
+// sortAlbumGroups sorts each album's songs by disc and track while preserving the
+// order in which the albums first appear in songs. Songs without album IDs are not moved
+// relative to the albums.
+func sortAlbumGroups(songs []*db.Song) {
+	groups := make(map[*db.Song]int, len(songs))
+	first := make(map[string]int)
+	for i, s := range songs {
+		if s.AlbumID == "" {
+			groups[s] = i
+			continue
+		}
+		if _, ok := first[s.AlbumID]; !ok {
+			first[s.AlbumID] = i
+		}
+		groups[s] = first[s.AlbumID]
+	}
+	sort.SliceStable(songs, func(i, j int) bool {
+		si, sj := songs[i], songs[j]
+		if gi, gj := groups[si], groups[sj]; gi != gj {
+			return gi < gj
+		}
+		if si.Disc != sj.Disc {
+			return si.Disc < sj.Disc
+		}
+		return si.Track < sj.Track
+	})
+}
+
+// truncateIDsByLastStartTime returns the first max (at most) of the supplied sorted
 // IDs after ordering by LastStartTime.
-func truncateIDsByLastStartTime(ctx context.Context, ids []int64) ([]int64, error) {
+func truncateIDsByLastStartTime(ctx context.Context, ids []int64, max int) ([]int64, error) {
 	// If we don't have many IDs, we'll probably need to read a bunch of the LastStartTime
-	// results before get to maxResults songs. Put the IDs into a map so we don't need to
+	// results before get to max songs. Put the IDs into a map so we don't need to
 	// binary search over and over.
 	var check func(int64) bool
 	if len(ids) <= truncateMapThresh {
@@ -549,11 +1065,11 @@ func truncateIDsByLastStartTime(ctx context.Context, ids []int64) ([]int64, erro
 	}
 
 	// This query matches all entities, but its running time fortunately appears to depend on the
-	// number of results that we read (which depends on how soon we encounter maxResults of the
+	// number of results that we read (which depends on how soon we encounter max of the
 	// passed-in songs).
-	res := make([]int64, 0, maxResults)
+	res := make([]int64, 0, max)
 	it := datastore.NewQuery(db.SongKind).KeysOnly().Order("LastStartTime").Run(ctx)
-	for len(res) < maxResults {
+	for len(res) < max {
 		if k, err := it.Next(nil); err == datastore.Done {
 			break
 		} else if err != nil {
@@ -568,10 +1084,69 @@ func truncateIDsByLastStartTime(ctx context.Context, ids []int64) ([]int64, erro
 	return res, nil
 }
 
+// userPlayStats summarizes a single user's plays of a song.
+type userPlayStats struct {
+	numPlays      int64
+	lastStartTime time.Time
+}
+
+// getUserPlays reads all Play entities reported by user and returns
+// stats about them keyed by song ID.
+func getUserPlays(ctx context.Context, user string) (map[int64]userPlayStats, error) {
+	plays := make(map[int64]userPlayStats)
+	it := datastore.NewQuery(db.PlayKind).Filter("User =", user).Project("StartTime").Run(ctx)
+	for {
+		var play db.Play
+		k, err := it.Next(&play)
+		if err == datastore.Done {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("reading plays by %q: %v", user, err)
+		}
+		pk := k.Parent()
+		if pk == nil {
+			return nil, fmt.Errorf("no parent key for play %v", k.IntID())
+		}
+		ps := plays[pk.IntID()]
+		ps.numPlays++
+		if play.StartTime.After(ps.lastStartTime) {
+			ps.lastStartTime = play.StartTime
+		}
+		plays[pk.IntID()] = ps
+	}
+	return plays, nil
+}
+
+// filterIDsByUserPlays returns the IDs from ids with at most maxPlays plays
+// (if maxPlays is non-negative) in plays. If orderByLastStartTime is true,
+// the returned IDs are ordered by their last start times in plays (with unplayed
+// songs first) and truncated to max.
+func filterIDsByUserPlays(ids []int64, plays map[int64]userPlayStats,
+	maxPlays int64, orderByLastStartTime bool, max int) []int64 {
+	res := make([]int64, 0, len(ids))
+	for _, id := range ids {
+		if maxPlays < 0 || plays[id].numPlays <= maxPlays {
+			res = append(res, id)
+		}
+	}
+	if orderByLastStartTime {
+		sort.SliceStable(res, func(i, j int) bool {
+			return plays[res[i]].lastStartTime.Before(plays[res[j]].lastStartTime)
+		})
+		if len(res) > max {
+			res = res[:max]
+		}
+	}
+	return res
+}
+
 // CleanSong prepares s to be returned in results.
 // This is exported so it can be called by tests in other packages.
 func CleanSong(s *db.Song, id int64) {
 	s.SongID = strconv.FormatInt(id, 10)
+	if !s.LastModifiedTime.IsZero() {
+		s.LastModifiedNsec = s.LastModifiedTime.UnixNano()
+	}
 
 	// Create an empty tags slice so that clients don't need to check for null.
 	if s.Tags == nil {
@@ -586,17 +1161,34 @@ func CleanSong(s *db.Song, id int64) {
 
 // sortSongs sorts songs for the client.
 // Songs are sorted by album artist, album release date, album name,
-// and finally by disc and track.
+// and finally by disc and track. Compilations are sorted by album name
+// in place of album artist so that their songs stay together.
+// Artist, album artist, and album sort names are used when available, and names are
+// compared using the Unicode Collation Algorithm rather than byte-by-byte
+// so that e.g. case and diacritics don't affect the order.
 func sortSongs(songs []*db.Song) {
+	albumName := func(s *db.Song) string {
+		if s.AlbumSortName != "" {
+			return s.AlbumSortName
+		}
+		return s.Album
+	}
+
 	albumIDArtists := make(map[string]string)
 	albumIDDates := make(map[string]string)
 	for _, s := range songs {
 		if s.AlbumID == "" {
 			continue
 		}
-		if _, ok := albumIDArtists[s.AlbumID]; !ok {
-			if s.AlbumArtist != "" {
+		if s.Compilation {
+			albumIDArtists[s.AlbumID] = albumName(s)
+		} else if _, ok := albumIDArtists[s.AlbumID]; !ok {
+			if s.AlbumArtistSortName != "" {
+				albumIDArtists[s.AlbumID] = s.AlbumArtistSortName
+			} else if s.AlbumArtist != "" && s.AlbumArtist != s.Artist {
 				albumIDArtists[s.AlbumID] = s.AlbumArtist
+			} else if s.ArtistSortName != "" {
+				albumIDArtists[s.AlbumID] = s.ArtistSortName
 			} else {
 				albumIDArtists[s.AlbumID] = s.Artist
 			}
@@ -606,29 +1198,37 @@ func sortSongs(songs []*db.Song) {
 		}
 	}
 
-	cmp := func(a, b string) int {
-		if a != "" && (b == "" || a < b) {
-			return -1
-		} else if b != "" && (a == "" || b < a) {
+	// Collators aren't safe for concurrent use, so create a new one each time.
+	coll := collate.New(language.Und, collate.Loose, collate.Numeric)
+	cmp := func(a, b string, collated bool) int {
+		switch {
+		case a == "" && b == "":
+			return 0
+		case a == "":
 			return 1
+		case b == "":
+			return -1
+		case collated:
+			return coll.CompareString(a, b)
+		default:
+			return strings.Compare(a, b)
 		}
-		return 0
 	}
 
 	sort.Slice(songs, func(i, j int) bool {
 		si, sj := songs[i], songs[j]
 
-		if res := cmp(albumIDArtists[si.AlbumID], albumIDArtists[sj.AlbumID]); res < 0 {
+		if res := cmp(albumIDArtists[si.AlbumID], albumIDArtists[sj.AlbumID], true); res < 0 {
 			return true
 		} else if res > 0 {
 			return false
 		}
-		if res := cmp(albumIDDates[si.AlbumID], albumIDDates[sj.AlbumID]); res < 0 {
+		if res := cmp(albumIDDates[si.AlbumID], albumIDDates[sj.AlbumID], false); res < 0 {
 			return true
 		} else if res > 0 {
 			return false
 		}
-		if res := cmp(si.AlbumLower, sj.AlbumLower); res < 0 {
+		if res := cmp(albumName(si), albumName(sj), true); res < 0 {
 			return true
 		} else if res > 0 {
 			return false
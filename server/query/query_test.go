@@ -7,6 +7,7 @@ import (
 	"crypto/sha1"
 	"encoding/hex"
 	"fmt"
+	"math"
 	"math/rand"
 	"reflect"
 	"strconv"
@@ -15,6 +16,7 @@ import (
 	"time"
 
 	"github.com/derat/nup/server/db"
+	"github.com/derat/nup/server/tagrules"
 )
 
 func TestIntersectSortedIDs(t *testing.T) {
@@ -47,6 +49,132 @@ func TestSubtractSortedIDs(t *testing.T) {
 	}
 }
 
+func TestUnionSortedIDs(t *testing.T) {
+	for _, tc := range []struct{ a, b, want []int64 }{
+		{nil, nil, []int64{}},
+		{[]int64{1, 2}, nil, []int64{1, 2}},
+		{nil, []int64{1, 2}, []int64{1, 2}},
+		{[]int64{1, 2}, []int64{1, 2}, []int64{1, 2}},
+		{[]int64{0, 1, 2, 3}, []int64{1, 2}, []int64{0, 1, 2, 3}},
+		{[]int64{0, 1, 2, 3, 4}, []int64{-1, 1, 3, 5}, []int64{-1, 0, 1, 2, 3, 4, 5}},
+	} {
+		if got := unionSortedIDs(tc.a, tc.b); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("unionSortedIDs(%v, %v) = %v; want %v", tc.a, tc.b, got, tc.want)
+		}
+	}
+}
+
+func TestParseKeywordMatch(t *testing.T) {
+	for _, tc := range []struct {
+		s    string
+		want KeywordMatch
+		ok   bool
+	}{
+		{"", ExactKeywords, true},
+		{"exact", ExactKeywords, true},
+		{"prefix", PrefixKeywords, true},
+		{"fuzzy", FuzzyKeywords, true},
+		{"bogus", ExactKeywords, false},
+	} {
+		got, err := ParseKeywordMatch(tc.s)
+		if !tc.ok && err == nil {
+			t.Errorf("ParseKeywordMatch(%q) unexpectedly succeeded", tc.s)
+		} else if tc.ok && err != nil {
+			t.Errorf("ParseKeywordMatch(%q) failed: %v", tc.s, err)
+		} else if got != tc.want {
+			t.Errorf("ParseKeywordMatch(%q) = %v; want %v", tc.s, got, tc.want)
+		}
+	}
+}
+
+func TestParseDateField(t *testing.T) {
+	for _, tc := range []struct {
+		s    string
+		want DateField
+		ok   bool
+	}{
+		{"", DefaultDate, true},
+		{"date", DefaultDate, true},
+		{"original", OriginalDate, true},
+		{"release", ReleaseDate, true},
+		{"bogus", DefaultDate, false},
+	} {
+		got, err := ParseDateField(tc.s)
+		if !tc.ok && err == nil {
+			t.Errorf("ParseDateField(%q) unexpectedly succeeded", tc.s)
+		} else if tc.ok && err != nil {
+			t.Errorf("ParseDateField(%q) failed: %v", tc.s, err)
+		} else if got != tc.want {
+			t.Errorf("ParseDateField(%q) = %v; want %v", tc.s, got, tc.want)
+		}
+	}
+}
+
+func TestSongQuery_ParseKeywords(t *testing.T) {
+	for _, tc := range []struct {
+		text string
+		want SongQuery
+		ok   bool
+	}{
+		{"", SongQuery{}, true},
+		{"  foo  BAR ", SongQuery{Keywords: []string{"foo", "bar"}}, true},
+		{"don't-stop", SongQuery{Keywords: []string{"don", "t", "stop"}}, true},
+		{"foo -bar", SongQuery{Keywords: []string{"foo"}, NotKeywords: []string{"bar"}}, true},
+		{"a - b", SongQuery{Keywords: []string{"a", "b"}}, true},
+		{`"Love  Song" x`, SongQuery{
+			Keywords: []string{"love", "song", "x"},
+			Phrases:  []string{"love song"},
+		}, true},
+		{`"single"`, SongQuery{Keywords: []string{"single"}}, true},
+		{`foo -"live version"`, SongQuery{
+			Keywords:   []string{"foo"},
+			NotPhrases: []string{"live version"},
+		}, true},
+		{`artist:"The Artist" title: foo\ bar album:al1 albumId:123 x`, SongQuery{
+			Artist:   "The Artist",
+			Title:    `foo bar`,
+			Album:    "al1",
+			AlbumID:  "123",
+			Keywords: []string{"x"},
+		}, true},
+		{"-artist:foo", SongQuery{}, false},
+	} {
+		var got SongQuery
+		if err := got.ParseKeywords(tc.text); err != nil {
+			if tc.ok {
+				t.Errorf("ParseKeywords(%q) failed: %v", tc.text, err)
+			}
+		} else if !tc.ok {
+			t.Errorf("ParseKeywords(%q) unexpectedly succeeded", tc.text)
+		} else if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("ParseKeywords(%q) = %+v; want %+v", tc.text, got, tc.want)
+		}
+	}
+}
+
+func TestSongQuery_ExpandTags(t *testing.T) {
+	rules := tagrules.NewRules()
+	if err := rules.SetAlias("no-vocals", "instrumental"); err != nil {
+		t.Fatal("SetAlias failed:", err)
+	}
+	if err := rules.SetParent("bebop", "jazz"); err != nil {
+		t.Fatal("SetParent failed:", err)
+	}
+	q := SongQuery{
+		Tags:    []string{"rock", "no-vocals"},
+		NotTags: []string{"jazz", "bebop", "live"},
+	}
+	q.ExpandTags(rules)
+	want := SongQuery{
+		Tags:    []string{"rock"},
+		AnyTags: [][]string{{"instrumental", "no-vocals"}},
+		NotTags: []string{"bebop", "jazz", "live"},
+	}
+	if !reflect.DeepEqual(q, want) {
+		t.Errorf("ExpandTags produced %+v; want %+v", q, want)
+	}
+}
+
 func TestSortSongs(t *testing.T) {
 	makeSong := func(artist, album string, setAlbumID bool,
 		date string, disc, track int) *db.Song {
@@ -65,6 +193,7 @@ func TestSortSongs(t *testing.T) {
 		return &db.Song{
 			AlbumID:     albumID,
 			AlbumArtist: artist,
+			Album:       album,
 			AlbumLower:  album,
 			Date:        tm,
 			Disc:        disc,
@@ -76,6 +205,8 @@ func TestSortSongs(t *testing.T) {
 	want := []*db.Song{
 		// Songs with album IDs should be sorted by artist name, then album release date,
 		// then album name, and finally disc and track number.
+		// Names should be compared without regard to case.
+		makeSong("aardwolf", "Den", true, "2010", 1, 1),
 		makeSong("Alphabets", "Our First Album", true, "2001", 1, 1),
 		makeSong("Alphabets", "Our First Album", true, "2001", 1, 2),
 		makeSong("Alphabets", "Number 2", true, "2002", 1, 1),
@@ -83,6 +214,18 @@ func TestSortSongs(t *testing.T) {
 		makeSong("Alphabets", "Drei", true, "2005", 2, 1),
 		makeSong("Alphabets", "Same Year?!", true, "2005", 1, 1),
 		makeSong("Balcony", "Album", true, "1998", 1, 1),
+		// Artist sort names should be used when available.
+		{AlbumID: "beatles", Artist: "The Beatles", ArtistSortName: "Beatles, The", Album: "Help!",
+			AlbumLower: "help!", Disc: 1, Track: 1},
+		// Album artist sort names should be used for albums with distinct album artists.
+		{AlbumID: "beatlesque", Artist: "Various", AlbumArtist: "The Beatlesque Band",
+			AlbumArtistSortName: "Beatlesque Band, The", Album: "Covers",
+			AlbumLower: "covers", Disc: 1, Track: 1},
+		// Compilations should be sorted by album name rather than by artist.
+		{AlbumID: "comp", Artist: "Zither", Album: "Best of the Bs", Compilation: true, Disc: 1, Track: 1},
+		{AlbumID: "comp", Artist: "Aardvark", Album: "Best of the Bs", Compilation: true, Disc: 1, Track: 2},
+		// Diacritics shouldn't put names after unaccented ones.
+		{AlbumID: "bjork", Artist: "Björk", Album: "Debut", AlbumLower: "debut", Disc: 1, Track: 1},
 		makeSong("Cakewalk", "Hello", true, "2008", 1, 1),
 		// Songs without album IDs should appear at the end, sorted by album name.
 		makeSong("Aardvark", "Animals", false, "", 1, 1),
@@ -183,6 +326,322 @@ func TestSpreadSongs_AlbumArtist(t *testing.T) {
 	}
 }
 
+func TestSortAlbumGroups(t *testing.T) {
+	mk := func(album string, disc, track int) *db.Song {
+		return &db.Song{
+			SongID:  fmt.Sprintf("%s-%d-%d", album, disc, track),
+			AlbumID: album,
+			Disc:    disc,
+			Track:   track,
+		}
+	}
+	songs := []*db.Song{
+		mk("b", 1, 2),
+		mk("b", 2, 1),
+		mk("", 0, 5),
+		mk("a", 1, 3),
+		mk("b", 1, 1),
+		mk("a", 1, 1),
+		mk("", 0, 1),
+	}
+	sortAlbumGroups(songs)
+	var got []string
+	for _, s := range songs {
+		got = append(got, s.SongID)
+	}
+	want := []string{"b-1-1", "b-1-2", "b-2-1", "-0-5", "a-1-1", "a-1-3", "-0-1"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("sortAlbumGroups produced %q; want %q", got, want)
+	}
+}
+
+func TestDecayedPlays(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	const year = 365 * 24 * time.Hour
+	ago := func(d time.Duration) time.Time { return now.Add(-d) }
+
+	for _, tc := range []struct {
+		name string
+		song db.Song
+		want float64
+	}{
+		{"unplayed", db.Song{}, 0},
+		{"recent", db.Song{
+			NumPlays:    2,
+			RecentPlays: []db.Play{{StartTime: ago(year)}, {StartTime: now}},
+		}, 1.5},
+		{"old", db.Song{
+			NumPlays:       3,
+			FirstStartTime: ago(2 * year),
+			RecentPlays:    []db.Play{{StartTime: ago(year)}},
+		}, 1},
+		{"no_recent", db.Song{
+			NumPlays:       2,
+			FirstStartTime: ago(3 * year),
+			LastStartTime:  ago(year),
+		}, 0.625},
+	} {
+		if got := decayedPlays(&tc.song, now, year); math.Abs(got-tc.want) > 0.0001 {
+			t.Errorf("decayedPlays(%v) = %v; want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestApplyPlayDecay(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	const year = 365 * 24 * time.Hour
+	mk := func(artist string, numPlays int, age time.Duration) *db.Song {
+		s := &db.Song{Artist: artist, NumPlays: numPlays}
+		for i := 0; i < numPlays; i++ {
+			s.RecentPlays = append(s.RecentPlays, db.Play{StartTime: now.Add(-age)})
+		}
+		if numPlays > 0 {
+			s.FirstStartTime = now.Add(-age)
+			s.LastStartTime = now.Add(-age)
+		}
+		return s
+	}
+	heavy := mk("heavy", 10, 5*year) // 0.3125 decayed plays
+	recent := mk("recent", 1, time.Hour)
+	never := mk("never", 0, 0)
+	medium := mk("medium", 1, 2*year) // 0.25 decayed plays
+
+	artists := func(songs []*db.Song) []string {
+		var res []string
+		for _, s := range songs {
+			res = append(res, s.Artist)
+		}
+		return res
+	}
+	songs := []*db.Song{heavy, recent, never, medium}
+	fixed := func(vals ...float64) func() float64 {
+		return func() float64 {
+			v := vals[0]
+			vals = vals[1:]
+			return v
+		}
+	}
+
+	for _, tc := range []struct {
+		shuffle bool
+		max     int
+		rnd     func() float64
+		want    []string
+	}{
+		// Ordering by decayed plays should put the heavily-played song after
+		// the song that was played once more recently.
+		{false, 10, nil, []string{"never", "medium", "heavy", "recent"}},
+		{false, 2, nil, []string{"never", "medium"}},
+		// With equal random values, fresher songs should be chosen first.
+		{true, 3, fixed(0.5, 0.5, 0.5, 0.5), []string{"never", "medium", "heavy"}},
+		// A large random value can still beat a fresher song.
+		{true, 1, fixed(0.1, 0.9, 0.1, 0.1), []string{"recent"}},
+	} {
+		in := append([]*db.Song{}, songs...)
+		got := artists(applyPlayDecay(in, tc.shuffle, now, year, tc.max, tc.rnd))
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("applyPlayDecay(shuffle=%v, max=%v) = %q; want %q", tc.shuffle, tc.max, got, tc.want)
+		}
+	}
+}
+
+func TestFilterIDsByUserPlays(t *testing.T) {
+	t1 := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	t2 := t1.Add(time.Hour)
+	plays := map[int64]userPlayStats{
+		1: {2, t2},
+		2: {1, t1},
+		4: {5, t1},
+	}
+	ids := []int64{1, 2, 3, 4}
+	for _, tc := range []struct {
+		maxPlays int64
+		order    bool
+		max      int
+		want     []int64
+	}{
+		{-1, false, 10, []int64{1, 2, 3, 4}},
+		{0, false, 10, []int64{3}},
+		{2, false, 10, []int64{1, 2, 3}},
+		{-1, true, 10, []int64{3, 2, 4, 1}},
+		{-1, true, 2, []int64{3, 2}},
+		{1, true, 10, []int64{3, 2}},
+	} {
+		got := filterIDsByUserPlays(append([]int64{}, ids...), plays, tc.maxPlays, tc.order, tc.max)
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("filterIDsByUserPlays(%v, %v, %v, %v) = %v; want %v",
+				ids, tc.maxPlays, tc.order, tc.max, got, tc.want)
+		}
+	}
+}
+
+func TestSongQuery_Matches(t *testing.T) {
+	t1 := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	t2 := t1.Add(24 * time.Hour)
+	t3 := t2.Add(24 * time.Hour)
+
+	song := &db.Song{
+		ArtistLower:    "the artist feat. guest",
+		ArtistsLower:   []string{"guest", "the artist", "the artist feat. guest"},
+		TitleLower:     "the title",
+		AlbumLower:     "the album",
+		Keywords:       []string{"album", "artist", "the", "title"},
+		AlbumID:        "album-id",
+		Filename:       "foo.mp3",
+		Track:          1,
+		Disc:           1,
+		Date:           t2,
+		OriginalDate:   t1,
+		Rating:         4,
+		FirstStartTime: t1,
+		LastStartTime:  t2,
+		NumPlays:       3,
+		NumSkips:       1,
+		Tags:           []string{"guitar", "rock"},
+		GenresLower:    []string{"hard rock", "metal"},
+		BPM:            128,
+	}
+	song.KeywordPrefixes = db.KeywordPrefixes(song.Keywords)
+	song.KeywordVariants = db.KeywordVariants(song.Keywords)
+
+	for _, tc := range []struct {
+		q    SongQuery
+		want bool
+	}{
+		{SongQuery{MaxPlays: -1}, true},
+		{SongQuery{Artist: "The Artist", MaxPlays: -1}, true},
+		{SongQuery{Artist: "Guest", MaxPlays: -1}, true},
+		{SongQuery{Artist: "The Artist feat. Guest", MaxPlays: -1}, true},
+		{SongQuery{Artist: "Someone Else", MaxPlays: -1}, false},
+		{SongQuery{Keywords: []string{"Artist", "TITLE"}, MaxPlays: -1}, true},
+		{SongQuery{Keywords: []string{"artist", "bogus"}, MaxPlays: -1}, false},
+		{SongQuery{Keywords: []string{"art"}, MaxPlays: -1}, false},
+		{SongQuery{Keywords: []string{"art", "tit"}, KeywordMatch: PrefixKeywords, MaxPlays: -1}, true},
+		{SongQuery{Keywords: []string{"art", "alb"}, KeywordMatch: PrefixKeywords, MaxPlays: -1}, true},
+		{SongQuery{Keywords: []string{"arx"}, KeywordMatch: PrefixKeywords, MaxPlays: -1}, false},
+		{SongQuery{Keywords: []string{"artst"}, KeywordMatch: FuzzyKeywords, MaxPlays: -1}, true},
+		{SongQuery{Keywords: []string{"artiste"}, KeywordMatch: FuzzyKeywords, MaxPlays: -1}, true},
+		{SongQuery{Keywords: []string{"arrist"}, KeywordMatch: FuzzyKeywords, MaxPlays: -1}, true},
+		{SongQuery{Keywords: []string{"atrist"}, KeywordMatch: FuzzyKeywords, MaxPlays: -1}, true},
+		{SongQuery{Keywords: []string{"tle"}, KeywordMatch: FuzzyKeywords, MaxPlays: -1}, false},
+		{SongQuery{Keywords: []string{"arxxst"}, KeywordMatch: FuzzyKeywords, MaxPlays: -1}, false},
+		{SongQuery{AlbumID: "album-id", MaxPlays: -1}, true},
+		{SongQuery{AlbumID: "other-id", MaxPlays: -1}, false},
+		{SongQuery{Rating: 4, MaxPlays: -1}, true},
+		{SongQuery{Rating: 5, MaxPlays: -1}, false},
+		{SongQuery{MinRating: 4, MaxPlays: -1}, true},
+		{SongQuery{MinRating: 5, MaxPlays: -1}, false},
+		{SongQuery{MaxRating: 4, MaxPlays: -1}, true},
+		{SongQuery{MaxRating: 3, MaxPlays: -1}, false},
+		{SongQuery{Unrated: true, MaxPlays: -1}, false},
+		{SongQuery{MaxPlays: 3}, true},
+		{SongQuery{MaxPlays: 2}, false},
+		{SongQuery{MinSkipRatio: 0.25, MaxPlays: -1}, true},
+		{SongQuery{MinSkipRatio: 0.5, MaxPlays: -1}, false},
+		{SongQuery{MaxSkipRatio: 0.25, MaxPlays: -1}, true},
+		{SongQuery{MaxSkipRatio: 0.2, MaxPlays: -1}, false},
+		{SongQuery{MinFirstStartTime: t1, MaxPlays: -1}, true},
+		{SongQuery{MinFirstStartTime: t2, MaxPlays: -1}, false},
+		{SongQuery{MaxLastStartTime: t2, MaxPlays: -1}, true},
+		{SongQuery{MaxLastStartTime: t1, MaxPlays: -1}, false},
+		{SongQuery{Track: 1, Disc: 1, MaxPlays: -1}, true},
+		{SongQuery{Track: 2, MaxPlays: -1}, false},
+		{SongQuery{Compilation: true, MaxPlays: -1}, false},
+		{SongQuery{MinDate: t1, MaxDate: t3, MaxPlays: -1}, true},
+		{SongQuery{MinDate: t3, MaxPlays: -1}, false},
+		{SongQuery{MaxDate: t1, MaxPlays: -1}, false},
+		{SongQuery{MaxDate: t1, DateField: OriginalDate, MaxPlays: -1}, true},
+		{SongQuery{MinDate: t2, DateField: OriginalDate, MaxPlays: -1}, false},
+		{SongQuery{MinDate: t1, DateField: ReleaseDate, MaxPlays: -1}, false}, // unset
+		{SongQuery{MinBPM: 120, MaxBPM: 130, MaxPlays: -1}, true},
+		{SongQuery{MinBPM: 128, MaxPlays: -1}, true},
+		{SongQuery{MinBPM: 130, MaxPlays: -1}, false},
+		{SongQuery{MaxBPM: 120, MaxPlays: -1}, false},
+		{SongQuery{Tags: []string{"rock", "guitar"}, MaxPlays: -1}, true},
+		{SongQuery{Tags: []string{"rock", "vocals"}, MaxPlays: -1}, false},
+		{SongQuery{AnyTags: [][]string{{"jazz", "rock"}}, MaxPlays: -1}, true},
+		{SongQuery{AnyTags: [][]string{{"jazz", "rock"}, {"piano", "vocals"}}, MaxPlays: -1}, false},
+		{SongQuery{NotTags: []string{"vocals"}, MaxPlays: -1}, true},
+		{SongQuery{NotTags: []string{"guitar"}, MaxPlays: -1}, false},
+		{SongQuery{Genres: []string{"Hard Rock"}, MaxPlays: -1}, true},
+		{SongQuery{Genres: []string{"metal", "jazz"}, MaxPlays: -1}, false},
+		{SongQuery{NotGenres: []string{"Jazz"}, MaxPlays: -1}, true},
+		{SongQuery{NotGenres: []string{"Métal"}, MaxPlays: -1}, false},
+		{SongQuery{Library: "other", MaxPlays: -1}, false},
+		{SongQuery{NotLibraries: []string{"other"}, MaxPlays: -1}, true},
+		{SongQuery{NotKeywords: []string{"bogus"}, MaxPlays: -1}, true},
+		{SongQuery{NotKeywords: []string{"title"}, MaxPlays: -1}, false},
+		{SongQuery{Phrases: []string{"the artist"}, MaxPlays: -1}, true},
+		{SongQuery{Phrases: []string{"artist the"}, MaxPlays: -1}, false},
+		{SongQuery{Phrases: []string{"artist title"}, MaxPlays: -1}, false},
+		{SongQuery{NotPhrases: []string{"the album"}, MaxPlays: -1}, false},
+		{SongQuery{NotPhrases: []string{"album the"}, MaxPlays: -1}, true},
+	} {
+		if got := tc.q.matches(song); got != tc.want {
+			t.Errorf("%+v matches song = %v; want %v", tc.q, got, tc.want)
+		}
+	}
+
+	// Songs with unset dates shouldn't match queries with only a max date.
+	unset := *song
+	unset.Date = time.Time{}
+	if q := (SongQuery{MaxDate: t3, MaxPlays: -1}); q.matches(&unset) {
+		t.Errorf("%+v matches song with unset date", q)
+	}
+}
+
+func TestSimulateSongs(t *testing.T) {
+	now := time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC)
+	then := now.Add(-30 * 24 * time.Hour)
+	day := 24 * time.Hour
+
+	// Song 1 was last played recently, while song 2 was last played shortly before then.
+	// Song 3 was deleted after then.
+	mk := func(plays ...time.Time) *simSong {
+		ss := &simSong{song: &db.Song{}}
+		for _, p := range plays {
+			ss.plays = append(ss.plays, db.Play{StartTime: p})
+		}
+		ss.song.RebuildPlayStats(ss.plays)
+		return ss
+	}
+	songs := map[int64]*simSong{
+		1: mk(then.Add(-10*day), now.Add(-day/2)),
+		2: mk(then.Add(-day / 2)),
+	}
+	deleted := map[int64]*simSong{3: mk(then.Add(-10 * day))}
+	deleted[3].song.LastModifiedTime = then.Add(day)
+
+	// Emulate a preset that matches songs that haven't been played in the last week.
+	week := 7 * day
+	cur := &SongQuery{MaxPlays: -1, MaxLastStartTime: now.Add(-week)}
+	hist := &SongQuery{MaxPlays: -1, MaxLastStartTime: then.Add(-week)}
+	got := simulateSongs(songs, deleted, cur, hist, then, nil)
+	want := &SimulateResult{
+		Time:       then,
+		Current:    []string{"2"},
+		Historical: []string{"1", "3"},
+		Added:      []string{"2"},
+		Removed:    []string{"1", "3"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("simulateSongs returned %+v; want %+v", got, want)
+	}
+
+	// Only songs in incomplete albums should be matched if requested.
+	got = simulateSongs(songs, deleted, cur, hist, then, map[int64]struct{}{1: {}})
+	want = &SimulateResult{
+		Time:       then,
+		Current:    []string{},
+		Historical: []string{"1"},
+		Added:      []string{},
+		Removed:    []string{"1"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("simulateSongs with incomplete albums returned %+v; want %+v", got, want)
+	}
+}
+
 func shuffleSongsForTest(songs []*db.Song) {
 	rand.Seed(0xbeefface)
 	for i := 0; i < len(songs)-1; i++ {
@@ -190,3 +649,51 @@ func shuffleSongsForTest(songs []*db.Song) {
 		songs[i], songs[j] = songs[j], songs[i]
 	}
 }
+
+func TestBuildSuggestions(t *testing.T) {
+	mk := func(artist, title, album string) *db.Song {
+		s := &db.Song{Artist: artist, Title: title, Album: album}
+		seen := make(map[string]struct{})
+		for _, str := range []string{artist, title, album} {
+			norm, err := db.Normalize(str)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, w := range db.KeywordFields(norm) {
+				if _, ok := seen[w]; !ok {
+					s.Keywords = append(s.Keywords, w)
+					seen[w] = struct{}{}
+				}
+			}
+		}
+		return s
+	}
+	songs := []*db.Song{
+		mk("Radiohead", "Airbag", "OK Computer"),
+		mk("Radiohead", "Paranoid Android", "OK Computer"),
+		mk("Rádio Brasil", "Radio Song", "Other"),
+	}
+	got := buildSuggestions(songs, "radi", nil)
+	want := &Suggestions{
+		Words:   []string{"radiohead", "radio"},
+		Artists: []string{"Radiohead", "Rádio Brasil"},
+		Albums:  []string{},
+		Titles:  []string{"Radio Song"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("buildSuggestions returned %+v; want %+v", got, want)
+	}
+
+	// Songs rejected by the include function shouldn't contribute suggestions.
+	songs[2].Library = "other"
+	got = buildSuggestions(songs, "radi", func(s *db.Song) bool { return s.Library == "" })
+	want = &Suggestions{
+		Words:   []string{"radiohead"},
+		Artists: []string{"Radiohead"},
+		Albums:  []string{},
+		Titles:  []string{},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("buildSuggestions with include func returned %+v; want %+v", got, want)
+	}
+}
@@ -0,0 +1,183 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package query
+
+import (
+	"context"
+	"errors"
+	"math"
+	"math/rand"
+	"sort"
+	"time"
+
+	"github.com/derat/nup/server/db"
+
+	"google.golang.org/appengine/v2/datastore"
+	"google.golang.org/appengine/v2/log"
+)
+
+const (
+	// RadioSize is the number of songs returned by RadioSongs.
+	RadioSize = 50
+
+	radioSeedFraction  = 0.25               // fraction of returned songs taken from the seed
+	radioSeedLimit     = 200                // max seed songs to load
+	radioProfileTags   = 5                  // max tags in the seed's profile
+	radioPoolFactor    = 2                  // adjacent songs are chosen from the top RadioSize*factor
+	radioRecentPlayAge = 3 * 24 * time.Hour // songs played more recently than this are skipped
+)
+
+// RadioSeed describes the songs used to seed RadioSongs.
+// Exactly one of the fields should be set.
+type RadioSeed struct {
+	Artist  string // Song.Artist (matched after normalization)
+	AlbumID string // Song.AlbumID
+}
+
+// RadioSongs returns up to RadioSize songs in library (see db.Song.Library) and without any
+// of notTags for a "radio" station based on seed. Most of the songs are by other artists
+// and share tags and eras with the seed's songs, while radioSeedFraction of them are
+// taken from the seed itself. Songs played within radioRecentPlayAge of now are skipped,
+// and songs are returned in a random order.
+func RadioSongs(ctx context.Context, seed RadioSeed, notTags []string,
+	library string, now time.Time) ([]*db.Song, error) {
+	startTime := time.Now()
+	q := datastore.NewQuery(db.SongKind).Limit(radioSeedLimit)
+	switch {
+	case seed.Artist != "":
+		norm, err := db.Normalize(seed.Artist)
+		if err != nil {
+			return nil, err
+		}
+		q = q.Filter("ArtistsLower =", norm)
+	case seed.AlbumID != "":
+		q = q.Filter("AlbumId =", seed.AlbumID)
+	default:
+		return nil, errors.New("empty radio seed")
+	}
+
+	keep := songFilter(library, notTags)
+	seedSongs, err := loadSongs(ctx, []*datastore.Query{q}, keep)
+	if err != nil {
+		return nil, err
+	}
+	if len(seedSongs) == 0 {
+		return []*db.Song{}, nil
+	}
+
+	// Find songs similar to the seed, excluding the seed's artists.
+	profile := radioProfile(seedSongs)
+	seedArtists := make(map[string]struct{})
+	for _, s := range seedSongs {
+		seedArtists[s.ArtistLower] = struct{}{}
+	}
+	cands, err := loadSongs(ctx, similarQueries(profile), func(s *db.Song) bool {
+		_, ok := seedArtists[s.ArtistLower]
+		return !ok && keep(s)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	rnd := rand.New(rand.NewSource(now.UnixNano()))
+	songs := mixRadio(seedSongs, cands, profile, RadioSize, now, rnd)
+	log.Debugf(ctx, "Chose %v radio song(s) from %v seed and %v adjacent song(s) in %v ms",
+		len(songs), len(seedSongs), len(cands), msecSince(startTime))
+	return songs, nil
+}
+
+// radioProfile returns a synthetic song summarizing seed for use with scoreSimilarity.
+// It contains seed's most common tags, median date, and average rating.
+// The artist is left empty so that candidates aren't matched by artist.
+func radioProfile(seed []*db.Song) *db.Song {
+	var profile db.Song
+
+	tagCounts := make(map[string]int)
+	for _, s := range seed {
+		for _, t := range s.Tags {
+			tagCounts[t]++
+		}
+	}
+	for t := range tagCounts {
+		profile.Tags = append(profile.Tags, t)
+	}
+	sort.Slice(profile.Tags, func(i, j int) bool {
+		ti, tj := profile.Tags[i], profile.Tags[j]
+		if ci, cj := tagCounts[ti], tagCounts[tj]; ci != cj {
+			return ci > cj
+		}
+		return ti < tj
+	})
+	if len(profile.Tags) > radioProfileTags {
+		profile.Tags = profile.Tags[:radioProfileTags]
+	}
+
+	var dates []time.Time
+	var ratingSum, numRated int
+	for _, s := range seed {
+		if !s.Date.IsZero() {
+			dates = append(dates, s.Date)
+		}
+		if s.Rating > 0 {
+			ratingSum += s.Rating
+			numRated++
+		}
+	}
+	if len(dates) > 0 {
+		sort.Slice(dates, func(i, j int) bool { return dates[i].Before(dates[j]) })
+		profile.Date = dates[len(dates)/2]
+	}
+	if numRated > 0 {
+		profile.Rating = int(math.Round(float64(ratingSum) / float64(numRated)))
+	}
+	return &profile
+}
+
+// mixRadio returns up to max songs in a random order, with radioSeedFraction of them chosen
+// randomly from seed and the rest chosen randomly from the adjacent songs most similar to
+// profile. If either list doesn't have enough songs, more are taken from the other one.
+// Duplicate songs and songs played within radioRecentPlayAge of now are skipped.
+func mixRadio(seed, adjacent []*db.Song, profile *db.Song, max int,
+	now time.Time, rnd *rand.Rand) []*db.Song {
+	seen := make(map[string]struct{})
+	filter := func(songs []*db.Song) []*db.Song {
+		var res []*db.Song
+		for _, s := range songs {
+			if _, ok := seen[s.SongID]; ok {
+				continue
+			}
+			if !s.LastStartTime.IsZero() && now.Sub(s.LastStartTime) < radioRecentPlayAge {
+				continue
+			}
+			seen[s.SongID] = struct{}{}
+			res = append(res, s)
+		}
+		return res
+	}
+	seed = filter(seed)
+	adjacent = filter(rankSimilar(profile, adjacent, max*radioPoolFactor))
+	rnd.Shuffle(len(seed), func(i, j int) { seed[i], seed[j] = seed[j], seed[i] })
+	rnd.Shuffle(len(adjacent), func(i, j int) { adjacent[i], adjacent[j] = adjacent[j], adjacent[i] })
+
+	numSeed := int(math.Round(float64(max) * radioSeedFraction))
+	if numSeed > len(seed) {
+		numSeed = len(seed)
+	}
+	numAdjacent := max - numSeed
+	if numAdjacent > len(adjacent) {
+		numAdjacent = len(adjacent)
+	}
+	if numSeed+numAdjacent < max {
+		numSeed = max - numAdjacent
+		if numSeed > len(seed) {
+			numSeed = len(seed)
+		}
+	}
+
+	songs := make([]*db.Song, 0, numSeed+numAdjacent)
+	songs = append(songs, seed[:numSeed]...)
+	songs = append(songs, adjacent[:numAdjacent]...)
+	rnd.Shuffle(len(songs), func(i, j int) { songs[i], songs[j] = songs[j], songs[i] })
+	return songs
+}
@@ -0,0 +1,83 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package query
+
+import (
+	"fmt"
+	"math/rand"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/derat/nup/server/db"
+)
+
+func TestRadioProfile(t *testing.T) {
+	date := func(y int) time.Time { return time.Date(y, 1, 1, 0, 0, 0, 0, time.UTC) }
+	profile := radioProfile([]*db.Song{
+		{ArtistLower: "a", Tags: []string{"rock", "guitar"}, Date: date(1990), Rating: 4},
+		{ArtistLower: "a", Tags: []string{"rock"}, Date: date(1994), Rating: 5},
+		{ArtistLower: "a", Tags: []string{"rock", "slow"}, Date: date(1992)},
+	})
+	if want := []string{"rock", "guitar", "slow"}; !reflect.DeepEqual(profile.Tags, want) {
+		t.Errorf("radioProfile returned tags %q; want %q", profile.Tags, want)
+	}
+	if want := date(1992); !profile.Date.Equal(want) {
+		t.Errorf("radioProfile returned date %v; want %v", profile.Date, want)
+	}
+	if profile.Rating != 5 {
+		t.Errorf("radioProfile returned rating %v; want 5", profile.Rating)
+	}
+	if profile.ArtistLower != "" {
+		t.Errorf("radioProfile returned artist %q; want empty", profile.ArtistLower)
+	}
+}
+
+func TestMixRadio(t *testing.T) {
+	now := time.Date(2023, 5, 1, 0, 0, 0, 0, time.UTC)
+	makeSongs := func(prefix string, n int, tags ...string) []*db.Song {
+		songs := make([]*db.Song, n)
+		for i := range songs {
+			songs[i] = &db.Song{SongID: fmt.Sprintf("%s%d", prefix, i), Tags: tags}
+		}
+		return songs
+	}
+	profile := &db.Song{Tags: []string{"rock"}}
+	count := func(songs []*db.Song, prefix string) int {
+		var n int
+		for _, s := range songs {
+			if s.SongID[:len(prefix)] == prefix {
+				n++
+			}
+		}
+		return n
+	}
+	rnd := rand.New(rand.NewSource(1))
+
+	seed := makeSongs("s", 20, "rock")
+	seed[0].LastStartTime = now.Add(-time.Hour) // played recently
+	adjacent := append(makeSongs("a", 30, "rock"), makeSongs("x", 30)...)
+	songs := mixRadio(seed, adjacent, profile, 20, now, rnd)
+	if len(songs) != 20 {
+		t.Fatalf("mixRadio returned %d songs; want 20", len(songs))
+	}
+	if n := count(songs, "s"); n != 5 {
+		t.Errorf("mixRadio returned %d seed songs; want 5", n)
+	}
+	if n := count(songs, "a"); n != 15 {
+		t.Errorf("mixRadio returned %d adjacent songs; want 15", n)
+	}
+	for _, s := range songs {
+		if s.SongID == "s0" {
+			t.Error("mixRadio returned recently-played song")
+		}
+	}
+
+	// If there aren't enough adjacent songs, more seed songs should be used.
+	songs = mixRadio(seed, makeSongs("a", 3, "rock"), profile, 10, now, rnd)
+	if len(songs) != 10 || count(songs, "a") != 3 || count(songs, "s") != 7 {
+		t.Errorf("mixRadio with few adjacent songs returned %d songs (%d seed, %d adjacent)",
+			len(songs), count(songs, "s"), count(songs, "a"))
+	}
+}
@@ -0,0 +1,112 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package query
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/derat/nup/server/db"
+
+	"google.golang.org/appengine/v2/datastore"
+	"google.golang.org/appengine/v2/log"
+)
+
+const (
+	maxRandomSongs   = 100 // max songs to return from RandomSongs
+	randomScanFactor = 10  // multiple of requested songs to scan when excluding songs
+)
+
+// RandomSongs returns up to max songs chosen randomly from the songs in library (see
+// db.Song.Library) with ratings of at least minRating (if positive) that have all of tags
+// and none of notTags.
+//
+// Unlike Songs, this doesn't build (or cache) the full list of matching songs. Instead, it
+// returns consecutive songs ordered by db.Song.RandomKey starting at a random position, so
+// its cost is proportional to max rather than to the size of the library. Songs that
+// haven't been assigned random keys yet (see update.ReindexSongs) are never returned.
+func RandomSongs(ctx context.Context, max, minRating int, tags, notTags []string,
+	library string) ([]*db.Song, error) {
+	startTime := time.Now()
+	if max <= 0 || max > maxRandomSongs {
+		max = maxRandomSongs
+	}
+
+	base := datastore.NewQuery(db.SongKind)
+	switch minRating {
+	case 0:
+	case 1:
+		base = base.Filter("RatingAtLeast1 =", true)
+	case 2:
+		base = base.Filter("RatingAtLeast2 =", true)
+	case 3:
+		base = base.Filter("RatingAtLeast3 =", true)
+	case 4:
+		base = base.Filter("RatingAtLeast4 =", true)
+	case 5:
+		base = base.Filter("Rating =", 5)
+	default:
+		return nil, fmt.Errorf("min rating %v not in [1, 5]", minRating)
+	}
+	for _, t := range tags {
+		base = base.Filter("Tags =", t)
+	}
+
+	excluded := make(map[string]struct{}, len(notTags))
+	for _, t := range notTags {
+		excluded[t] = struct{}{}
+	}
+	keep := func(s *db.Song) bool {
+		if s.Library != library {
+			return false
+		}
+		for _, t := range s.Tags {
+			if _, ok := excluded[t]; ok {
+				return false
+			}
+		}
+		return true
+	}
+
+	// Bound the number of songs that we'll load, since some of them may be excluded.
+	// Songs in the main library may lack Library properties, so libraries are handled
+	// by keep rather than by filtering the query, and any song can be excluded.
+	maxScanned := max * randomScanFactor
+
+	// Scan upward from a random position and then wrap around to the start of the key space.
+	start := rand.Float64()
+	songs := make([]*db.Song, 0, max)
+	scanned := 0
+	for _, q := range []*datastore.Query{
+		base.Filter("RandomKey >=", start).Order("RandomKey"),
+		base.Filter("RandomKey <", start).Order("RandomKey"),
+	} {
+		it := q.Limit(maxScanned - scanned).Run(ctx)
+		for len(songs) < max {
+			var s db.Song
+			k, err := it.Next(&s)
+			if err == datastore.Done {
+				break
+			} else if err != nil {
+				return nil, err
+			}
+			scanned++
+			if keep(&s) {
+				CleanSong(&s, k.IntID())
+				songs = append(songs, &s)
+			}
+		}
+		if len(songs) == max || scanned == maxScanned {
+			break
+		}
+	}
+
+	// Songs with adjacent keys would otherwise be returned in the same order by later calls.
+	rand.Shuffle(len(songs), func(i, j int) { songs[i], songs[j] = songs[j], songs[i] })
+	log.Debugf(ctx, "Chose %v random song(s) after scanning %v in %v ms",
+		len(songs), scanned, msecSince(startTime))
+	return songs, nil
+}
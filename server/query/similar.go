@@ -0,0 +1,223 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package query
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"sort"
+	"time"
+
+	"github.com/derat/nup/server/db"
+
+	"google.golang.org/appengine/v2/datastore"
+	"google.golang.org/appengine/v2/log"
+)
+
+const (
+	// MaxSimilarSongs is the maximum number of songs returned by SimilarSongs.
+	MaxSimilarSongs = 100
+
+	similarArtistLimit = 200 // max songs loaded by the same artist
+	similarTagLimit    = 100 // max songs loaded for each tag
+	similarMaxTags     = 5   // max tags used to find candidates
+	similarEraLimit    = 100 // max songs loaded from the same era
+	similarEraYears    = 5   // max difference in years for songs from the same era
+)
+
+// similarityScorer returns a score in the range [0, 1] describing how similar cand is to src.
+type similarityScorer func(src, cand *db.Song) float64
+
+// similarityScorers contains the weighted scorers that are summed by scoreSimilarity.
+// Other scorers (e.g. comparing audio embeddings) can be added here later.
+var similarityScorers = []struct {
+	weight float64
+	fn     similarityScorer
+}{
+	{4, sharedTagsScore},
+	{3, sameArtistScore},
+	{2, eraScore},
+	{1, ratingScore},
+}
+
+// scoreSimilarity returns a score describing how similar cand is to src.
+// Higher scores indicate more-similar songs.
+func scoreSimilarity(src, cand *db.Song) float64 {
+	var score float64
+	for _, sc := range similarityScorers {
+		score += sc.weight * sc.fn(src, cand)
+	}
+	return score
+}
+
+// sharedTagsScore returns the Jaccard index of src's and cand's tags.
+func sharedTagsScore(src, cand *db.Song) float64 {
+	if len(src.Tags) == 0 || len(cand.Tags) == 0 {
+		return 0
+	}
+	tags := make(map[string]bool, len(src.Tags))
+	for _, t := range src.Tags {
+		tags[t] = false
+	}
+	var shared int
+	union := len(tags)
+	for _, t := range cand.Tags {
+		if seen, ok := tags[t]; !ok {
+			union++
+		} else if !seen {
+			tags[t] = true
+			shared++
+		}
+	}
+	return float64(shared) / float64(union)
+}
+
+// sameArtistScore returns 1 if src and cand have the same artist or album artist.
+func sameArtistScore(src, cand *db.Song) float64 {
+	if src.ArtistLower != "" && src.ArtistLower == cand.ArtistLower {
+		return 1
+	}
+	if src.AlbumArtist != "" && src.AlbumArtist == cand.AlbumArtist {
+		return 1
+	}
+	return 0
+}
+
+// eraScore returns a score that decreases linearly as the difference between
+// src's and cand's dates approaches similarEraYears.
+func eraScore(src, cand *db.Song) float64 {
+	if src.Date.IsZero() || cand.Date.IsZero() {
+		return 0
+	}
+	years := math.Abs(src.Date.Sub(cand.Date).Hours()) / (24 * 365.25)
+	return math.Max(0, 1-years/similarEraYears)
+}
+
+// ratingScore returns a score that decreases linearly with the difference between
+// src's and cand's ratings. Unrated songs receive 0.
+func ratingScore(src, cand *db.Song) float64 {
+	if src.Rating <= 0 || cand.Rating <= 0 {
+		return 0
+	}
+	return 1 - math.Abs(float64(src.Rating-cand.Rating))/4
+}
+
+// rankSimilar returns up to max songs from cands in descending order by their similarity
+// to src. src itself and duplicate songs are skipped. Ties are broken by song ID.
+func rankSimilar(src *db.Song, cands []*db.Song, max int) []*db.Song {
+	type scored struct {
+		song  *db.Song
+		score float64
+	}
+	seen := map[string]struct{}{src.SongID: {}}
+	ranked := make([]scored, 0, len(cands))
+	for _, s := range cands {
+		if _, ok := seen[s.SongID]; ok {
+			continue
+		}
+		seen[s.SongID] = struct{}{}
+		if score := scoreSimilarity(src, s); score > 0 {
+			ranked = append(ranked, scored{s, score})
+		}
+	}
+	sort.Slice(ranked, func(i, j int) bool {
+		if ranked[i].score != ranked[j].score {
+			return ranked[i].score > ranked[j].score
+		}
+		return ranked[i].song.SongID < ranked[j].song.SongID
+	})
+	if len(ranked) > max {
+		ranked = ranked[:max]
+	}
+	songs := make([]*db.Song, len(ranked))
+	for i, r := range ranked {
+		songs[i] = r.song
+	}
+	return songs
+}
+
+// SimilarSongs returns up to max songs that are similar to src (e.g. as returned by SongsByID),
+// in descending order by similarity. Candidates are songs in src's library by the same artist,
+// with some of the same tags, or released around the same time, excluding songs with any of
+// notTags.
+func SimilarSongs(ctx context.Context, src *db.Song, max int, notTags []string) ([]*db.Song, error) {
+	startTime := time.Now()
+	if max <= 0 || max > MaxSimilarSongs {
+		max = MaxSimilarSongs
+	}
+
+	cands, err := loadSongs(ctx, similarQueries(src), songFilter(src.Library, notTags))
+	if err != nil {
+		return nil, err
+	}
+	songs := rankSimilar(src, cands, max)
+	log.Debugf(ctx, "Chose %v similar song(s) from %v candidate(s) in %v ms",
+		len(songs), len(cands), msecSince(startTime))
+	return songs, nil
+}
+
+// similarQueries returns queries for finding candidate songs similar to src: songs by the
+// same artist, songs with some of the same tags, and songs released around the same time.
+func similarQueries(src *db.Song) []*datastore.Query {
+	var queries []*datastore.Query
+	base := datastore.NewQuery(db.SongKind)
+	if src.ArtistLower != "" {
+		queries = append(queries, base.Filter("ArtistLower =", src.ArtistLower).Limit(similarArtistLimit))
+	}
+	// Start at random positions so that different songs are considered for popular tags.
+	for i, t := range src.Tags {
+		if i == similarMaxTags {
+			break
+		}
+		queries = append(queries, base.Filter("Tags =", t).
+			Filter("RandomKey >=", rand.Float64()).Order("RandomKey").Limit(similarTagLimit))
+	}
+	if !src.Date.IsZero() {
+		d := time.Duration(similarEraYears*365.25*24) * time.Hour
+		queries = append(queries, base.Filter("Date >=", src.Date.Add(-d)).
+			Filter("Date <=", src.Date.Add(d)).Limit(similarEraLimit))
+	}
+	return queries
+}
+
+// songFilter returns a function that returns true for songs in library (see db.Song.Library)
+// that don't have any of notTags.
+func songFilter(library string, notTags []string) func(s *db.Song) bool {
+	excluded := make(map[string]struct{}, len(notTags))
+	for _, t := range notTags {
+		excluded[t] = struct{}{}
+	}
+	return func(s *db.Song) bool {
+		if s.Library != library {
+			return false
+		}
+		for _, t := range s.Tags {
+			if _, ok := excluded[t]; ok {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// loadSongs runs queries and returns the songs for which keep returns true,
+// prepared as in Songs' results. Songs returned by multiple queries are duplicated.
+func loadSongs(ctx context.Context, queries []*datastore.Query, keep func(*db.Song) bool) ([]*db.Song, error) {
+	var res []*db.Song
+	for _, q := range queries {
+		var songs []*db.Song
+		keys, err := q.GetAll(ctx, &songs)
+		if err != nil {
+			return nil, err
+		}
+		for i, s := range songs {
+			if keep(s) {
+				CleanSong(s, keys[i].IntID())
+				res = append(res, s)
+			}
+		}
+	}
+	return res, nil
+}
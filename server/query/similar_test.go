@@ -0,0 +1,58 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package query
+
+import (
+	"math"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/derat/nup/server/db"
+)
+
+func TestScoreSimilarity(t *testing.T) {
+	date := func(y int) time.Time { return time.Date(y, 1, 1, 0, 0, 0, 0, time.UTC) }
+	src := &db.Song{ArtistLower: "artist", Tags: []string{"a", "b"}, Date: date(1990), Rating: 4}
+	for _, tc := range []struct {
+		cand *db.Song
+		want float64
+	}{
+		{&db.Song{}, 0},
+		{&db.Song{ArtistLower: "artist"}, 3},
+		{&db.Song{Tags: []string{"a", "b"}}, 4},
+		{&db.Song{Tags: []string{"b", "c", "d"}}, 1},    // 1 shared of 4 total
+		{&db.Song{Date: date(1990)}, 2},                 // same year
+		{&db.Song{Date: date(2000)}, 0},                 // too far apart
+		{&db.Song{Rating: 2}, 0.5},                      // 2 stars apart
+		{&db.Song{ArtistLower: "artist", Rating: 4}, 4}, // same artist and rating
+	} {
+		if got := scoreSimilarity(src, tc.cand); math.Abs(got-tc.want) > 0.01 {
+			t.Errorf("scoreSimilarity(%+v) = %v; want %v", tc.cand, got, tc.want)
+		}
+	}
+}
+
+func TestRankSimilar(t *testing.T) {
+	src := &db.Song{SongID: "1", ArtistLower: "artist", Tags: []string{"a", "b"}}
+	song := func(id, artist string, tags ...string) *db.Song {
+		return &db.Song{SongID: id, ArtistLower: artist, Tags: tags}
+	}
+	cands := []*db.Song{
+		song("1", "artist", "a", "b"), // src itself
+		song("2", "other", "a"),
+		song("3", "artist", "a", "b"),
+		song("4", "other"), // not similar
+		song("5", "artist"),
+		song("3", "artist", "a", "b"), // duplicate
+		song("6", "other", "b"),
+	}
+	var ids []string
+	for _, s := range rankSimilar(src, cands, 3) {
+		ids = append(ids, s.SongID)
+	}
+	if want := []string{"3", "5", "2"}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("rankSimilar returned %v; want %v", ids, want)
+	}
+}
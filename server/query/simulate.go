@@ -0,0 +1,369 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package query
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"time"
+	"unicode/utf8"
+
+	"github.com/derat/nup/server/db"
+	"github.com/derat/nup/server/stats"
+
+	"google.golang.org/appengine/v2/datastore"
+	"google.golang.org/appengine/v2/log"
+)
+
+// matches returns true if s satisfies all of q's filters.
+//
+// This mirrors the filters applied by runQuery, but it is evaluated in memory
+// rather than by Datastore. Shuffle, ShuffleAlbums, and OrderByLastStartTime are
+// ignored, as is MaxPlays if PlaysUser is set (since s doesn't contain per-user
+// play counts). IncompleteAlbums is also ignored since it depends on s's ID.
+func (q *SongQuery) matches(s *db.Song) bool {
+	if q.Artist != "" {
+		// Songs that haven't been migrated yet may lack ArtistsLower.
+		if norm, err := db.Normalize(q.Artist); err != nil ||
+			(norm != s.ArtistLower && !hasString(s.ArtistsLower, norm)) {
+			return false
+		}
+	}
+	for _, t := range []struct{ want, got string }{
+		{q.Title, s.TitleLower},
+		{q.Album, s.AlbumLower},
+	} {
+		if t.want == "" {
+			continue
+		}
+		if norm, err := db.Normalize(t.want); err != nil || norm != t.got {
+			return false
+		}
+	}
+	for _, w := range q.Keywords {
+		norm, err := db.Normalize(w)
+		if err != nil || !q.keywordMatches(s, norm) {
+			return false
+		}
+	}
+	for _, w := range q.NotKeywords {
+		norm, err := db.Normalize(w)
+		if err != nil || hasString(s.Keywords, norm) {
+			return false
+		}
+	}
+	if !q.matchesPhrases(s) {
+		return false
+	}
+
+	if q.AlbumID != "" && q.AlbumID != s.AlbumID {
+		return false
+	}
+	if q.Filename != "" && q.Filename != s.Filename {
+		return false
+	}
+
+	switch {
+	case q.Rating != 0:
+		if s.Rating != q.Rating {
+			return false
+		}
+	case q.MinRating != 0:
+		if s.Rating < q.MinRating {
+			return false
+		}
+	case q.MaxRating != 0:
+		if s.Rating < 1 || s.Rating > q.MaxRating {
+			return false
+		}
+	case q.Unrated:
+		if s.Rating != 0 {
+			return false
+		}
+	}
+
+	if q.hasMaxPlays() && q.PlaysUser == "" && int64(s.NumPlays) > q.MaxPlays {
+		return false
+	}
+	if !q.matchesSkipRatio(s) {
+		return false
+	}
+	if !q.MinFirstStartTime.IsZero() && s.FirstStartTime.Before(q.MinFirstStartTime) {
+		return false
+	}
+	if !q.MaxLastStartTime.IsZero() && s.LastStartTime.After(q.MaxLastStartTime) {
+		return false
+	}
+	if q.Track > 0 && int64(s.Track) != q.Track {
+		return false
+	}
+	if q.Disc > 0 && int64(s.Disc) != q.Disc {
+		return false
+	}
+	if q.Compilation && !s.Compilation {
+		return false
+	}
+	if date := q.DateField.get(s); !q.MinDate.IsZero() && date.Before(q.MinDate) {
+		return false
+	} else if !q.MaxDate.IsZero() && (date.After(q.MaxDate) || (q.MinDate.IsZero() && date.IsZero())) {
+		return false
+	}
+
+	if q.MinBPM > 0 && s.BPM < q.MinBPM {
+		return false
+	}
+	if q.MaxBPM > 0 && (s.BPM > q.MaxBPM || (q.MinBPM <= 0 && s.BPM <= 0)) {
+		return false
+	}
+
+	for _, t := range q.Tags {
+		if !hasString(s.Tags, t) {
+			return false
+		}
+	}
+	for _, group := range q.AnyTags {
+		var found bool
+		for _, t := range group {
+			if hasString(s.Tags, t) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	for _, t := range q.NotTags {
+		if hasString(s.Tags, t) {
+			return false
+		}
+	}
+	for _, g := range q.Genres {
+		norm, err := db.Normalize(g)
+		if err != nil || !hasString(s.GenresLower, norm) {
+			return false
+		}
+	}
+	for _, g := range q.NotGenres {
+		norm, err := db.Normalize(g)
+		if err != nil || hasString(s.GenresLower, norm) {
+			return false
+		}
+	}
+	if q.Library != "" && s.Library != q.Library {
+		return false
+	}
+	if hasString(q.NotLibraries, s.Library) {
+		return false
+	}
+	return true
+}
+
+// keywordMatches returns true if normalized keyword w matches s per q.KeywordMatch.
+func (q *SongQuery) keywordMatches(s *db.Song, w string) bool {
+	switch n := utf8.RuneCountInString(w); {
+	case q.KeywordMatch == PrefixKeywords && n >= db.MinKeywordPrefixLen:
+		return hasString(s.KeywordPrefixes, w)
+	case q.KeywordMatch == FuzzyKeywords && n >= db.MinFuzzyKeywordLen:
+		for _, v := range db.KeywordVariants([]string{w}) {
+			if hasString(s.KeywordVariants, v) {
+				return true
+			}
+		}
+		return false
+	default:
+		return hasString(s.Keywords, w)
+	}
+}
+
+// hasString returns true if vals contains s.
+func hasString(vals []string, s string) bool {
+	for _, v := range vals {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// SimulateResult describes the results of evaluating a SongQuery at two different times.
+type SimulateResult struct {
+	// Time is the historical time at which the query was evaluated.
+	Time time.Time `json:"time"`
+	// Current contains IDs of songs matched by the query against the current library.
+	Current []string `json:"current"`
+	// Historical contains IDs of songs matched by the query against the library as of Time.
+	Historical []string `json:"historical"`
+	// Added contains IDs of songs in Current but not in Historical.
+	Added []string `json:"added"`
+	// Removed contains IDs of songs in Historical but not in Current.
+	Removed []string `json:"removed"`
+}
+
+// Simulate evaluates cur against the current library and hist against the library as it
+// existed at t and returns both sets of matching song IDs along with their differences.
+// The queries typically only differ in relative conditions (e.g. a preset's "last played"
+// interval), which should be computed relative to the current time for cur and relative
+// to t for hist.
+//
+// Song metadata, ratings, and tags aren't versioned, so their current values are used
+// for the historical evaluation. Play-derived fields (NumPlays, FirstStartTime, and
+// LastStartTime) are rebuilt from plays that started at or before t, and songs that
+// were deleted after t are included. Songs that were added after t can't be identified
+// and are also included. The current list of incomplete albums is used for both evaluations.
+//
+// All songs and plays are loaded, so this is slow and only intended for admin use.
+func Simulate(ctx context.Context, cur, hist *SongQuery, t time.Time) (*SimulateResult, error) {
+	startTime := time.Now()
+	songs, err := loadSongsForSimulation(ctx, db.SongKind, db.PlayKind)
+	if err != nil {
+		return nil, err
+	}
+	deleted, err := loadSongsForSimulation(ctx, db.DeletedSongKind, db.DeletedPlayKind)
+	if err != nil {
+		return nil, err
+	}
+	log.Debugf(ctx, "Loaded %v song(s) and %v deleted song(s) in %v ms",
+		len(songs), len(deleted), msecSince(startTime))
+
+	var incomplete map[int64]struct{} // nil if neither query sets IncompleteAlbums
+	if cur.IncompleteAlbums || hist.IncompleteAlbums {
+		albums, err := stats.IncompleteAlbums(ctx)
+		if err != nil {
+			return nil, err
+		}
+		incomplete = make(map[int64]struct{})
+		for _, a := range albums {
+			for _, id := range a.SongIDs {
+				incomplete[id] = struct{}{}
+			}
+		}
+	}
+	return simulateSongs(songs, deleted, cur, hist, t, incomplete), nil
+}
+
+// simulateSongs evaluates cur against songs and hist against songs and deleted as they
+// existed at t. If incomplete is non-nil, only songs with IDs in it are matched.
+func simulateSongs(songs, deleted map[int64]*simSong, cur, hist *SongQuery, t time.Time,
+	incomplete map[int64]struct{}) *SimulateResult {
+	res := SimulateResult{
+		Time:       t,
+		Current:    make([]string, 0),
+		Historical: make([]string, 0),
+		Added:      make([]string, 0),
+		Removed:    make([]string, 0),
+	}
+	curIDs := make(map[int64]struct{})
+	histIDs := make(map[int64]struct{})
+
+	inIncompleteAlbum := func(id int64) bool {
+		if incomplete == nil {
+			return true
+		}
+		_, ok := incomplete[id]
+		return ok
+	}
+
+	for id, ss := range songs {
+		if !inIncompleteAlbum(id) {
+			continue
+		}
+		if cur.matches(ss.song) {
+			curIDs[id] = struct{}{}
+		}
+		if hs := ss.at(t); hist.matches(hs) {
+			histIDs[id] = struct{}{}
+		}
+	}
+	for id, ss := range deleted {
+		// DeletedSong entities' LastModifiedTime fields hold their deletion times.
+		if !ss.song.LastModifiedTime.After(t) || !inIncompleteAlbum(id) {
+			continue
+		}
+		if hs := ss.at(t); hist.matches(hs) {
+			histIDs[id] = struct{}{}
+		}
+	}
+
+	for id := range curIDs {
+		res.Current = append(res.Current, strconv.FormatInt(id, 10))
+		if _, ok := histIDs[id]; !ok {
+			res.Added = append(res.Added, strconv.FormatInt(id, 10))
+		}
+	}
+	for id := range histIDs {
+		res.Historical = append(res.Historical, strconv.FormatInt(id, 10))
+		if _, ok := curIDs[id]; !ok {
+			res.Removed = append(res.Removed, strconv.FormatInt(id, 10))
+		}
+	}
+	for _, ids := range [][]string{res.Current, res.Historical, res.Added, res.Removed} {
+		sortIDStrings(ids)
+	}
+	return &res
+}
+
+// simSong holds a song and its plays for Simulate.
+type simSong struct {
+	song  *db.Song
+	plays []db.Play
+}
+
+// at returns a copy of ss.song with play-derived fields reflecting only plays
+// that started at or before t.
+func (ss *simSong) at(t time.Time) *db.Song {
+	s := *ss.song
+	var plays []db.Play
+	for _, p := range ss.plays {
+		if !p.StartTime.After(t) {
+			plays = append(plays, p)
+		}
+	}
+	s.RebuildPlayStats(plays)
+	return &s
+}
+
+// loadSongsForSimulation loads all songKind entities and their playKind children.
+// The returned map is keyed by song ID.
+func loadSongsForSimulation(ctx context.Context, songKind, playKind string) (map[int64]*simSong, error) {
+	songs := make(map[int64]*simSong)
+	it := datastore.NewQuery(songKind).Run(ctx)
+	for {
+		var s db.Song
+		k, err := it.Next(&s)
+		if err == datastore.Done {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		songs[k.IntID()] = &simSong{song: &s}
+	}
+
+	it = datastore.NewQuery(playKind).Run(ctx)
+	for {
+		var p db.Play
+		k, err := it.Next(&p)
+		if err == datastore.Done {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		if pk := k.Parent(); pk != nil {
+			if ss, ok := songs[pk.IntID()]; ok {
+				ss.plays = append(ss.plays, p)
+			}
+		}
+	}
+	return songs, nil
+}
+
+// sortIDStrings sorts ids (containing base-10 integer song IDs) numerically.
+func sortIDStrings(ids []string) {
+	sort.Slice(ids, func(i, j int) bool {
+		a, _ := strconv.ParseInt(ids[i], 10, 64)
+		b, _ := strconv.ParseInt(ids[j], 10, 64)
+		return a < b
+	})
+}
@@ -0,0 +1,127 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package query
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/derat/nup/server/db"
+
+	"google.golang.org/appengine/v2/datastore"
+	"google.golang.org/appengine/v2/log"
+)
+
+const (
+	maxSuggestSongs = 200 // max songs to load when generating suggestions
+	maxSuggestions  = 10  // max suggestions of each type
+)
+
+// Suggestions contains completions for a partial keyword.
+type Suggestions struct {
+	// Words contains normalized keywords that start with the partial keyword.
+	Words []string `json:"words"`
+	// Artists, Albums, and Titles contain artist names, album titles, and song titles
+	// containing words that start with the partial keyword.
+	Artists []string `json:"artists"`
+	Albums  []string `json:"albums"`
+	Titles  []string `json:"titles"`
+}
+
+// Suggest returns suggestions for completing the supplied partial keyword.
+// Songs are found using the Song.KeywordPrefixes index, which is updated whenever
+// songs' metadata is updated. Empty suggestions are returned if partial is shorter
+// than db.MinKeywordPrefixLen. If include is non-nil, only songs for which it returns
+// true are used.
+func Suggest(ctx context.Context, partial string, include func(s *db.Song) bool) (*Suggestions, error) {
+	norm, err := db.Normalize(strings.TrimSpace(partial))
+	if err != nil {
+		return nil, err
+	}
+	if utf8.RuneCountInString(norm) < db.MinKeywordPrefixLen {
+		return &Suggestions{[]string{}, []string{}, []string{}, []string{}}, nil
+	}
+
+	startTime := time.Now()
+	var songs []*db.Song
+	q := datastore.NewQuery(db.SongKind).Filter("KeywordPrefixes =", norm).Limit(maxSuggestSongs)
+	if _, err := q.GetAll(ctx, &songs); err != nil {
+		return nil, err
+	}
+	log.Debugf(ctx, "Loaded %d song(s) for suggestions in %v ms", len(songs), msecSince(startTime))
+	return buildSuggestions(songs, norm, include), nil
+}
+
+// buildSuggestions returns suggestions for completing the normalized partial keyword
+// prefix using songs for which include returns true (or all songs if include is nil).
+// Suggestions are ordered by descending frequency.
+func buildSuggestions(songs []*db.Song, prefix string, include func(s *db.Song) bool) *Suggestions {
+	hasPrefix := func(s string) bool {
+		norm, err := db.Normalize(s)
+		if err != nil {
+			return false
+		}
+		for _, w := range db.KeywordFields(norm) {
+			if strings.HasPrefix(w, prefix) {
+				return true
+			}
+		}
+		return false
+	}
+
+	words := make(map[string]int)
+	artists := make(map[string]int)
+	albums := make(map[string]int)
+	titles := make(map[string]int)
+	for _, s := range songs {
+		if include != nil && !include(s) {
+			continue
+		}
+		for _, w := range s.Keywords {
+			if strings.HasPrefix(w, prefix) {
+				words[w]++
+			}
+		}
+		for _, a := range []string{s.Artist, s.AlbumArtist} {
+			if a != "" && hasPrefix(a) {
+				artists[a]++
+			}
+		}
+		if s.Album != "" && hasPrefix(s.Album) {
+			albums[s.Album]++
+		}
+		if s.Title != "" && hasPrefix(s.Title) {
+			titles[s.Title]++
+		}
+	}
+
+	return &Suggestions{
+		Words:   topSuggestions(words),
+		Artists: topSuggestions(artists),
+		Albums:  topSuggestions(albums),
+		Titles:  topSuggestions(titles),
+	}
+}
+
+// topSuggestions returns up to maxSuggestions keys from counts in descending order by count.
+// Ties are broken alphabetically.
+func topSuggestions(counts map[string]int) []string {
+	res := make([]string, 0, len(counts))
+	for s := range counts {
+		res = append(res, s)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if ci, cj := counts[res[i]], counts[res[j]]; ci != cj {
+			return ci > cj
+		}
+		return res[i] < res[j]
+	})
+	if len(res) > maxSuggestions {
+		res = res[:maxSuggestions]
+	}
+	return res
+}
@@ -11,17 +11,19 @@ import (
 
 	"github.com/derat/nup/server/cache"
 	"github.com/derat/nup/server/db"
+	"github.com/derat/nup/server/tagrules"
 
 	"google.golang.org/appengine/v2/datastore"
 	"google.golang.org/appengine/v2/log"
 )
 
-// Tags returns the full set of tags present across all songs.
+// Tags returns the set of tags present across songs in the libraries (see db.Song.Library)
+// for which include returns true.
 // It attempts to return cached data before falling back to scanning all songs.
 // If songs are scanned, the resulting tags are cached.
 // If requireCache is true, an error is returned if tags aren't cached.
-func Tags(ctx context.Context, requireCache bool) ([]string, error) {
-	var tags []string
+func Tags(ctx context.Context, include func(library string) bool, requireCache bool) ([]string, error) {
+	var tags map[string][]string // keyed by library
 	var err error
 
 	// Check memcache first and then datastore.
@@ -34,7 +36,8 @@ func Tags(ctx context.Context, requireCache bool) ([]string, error) {
 			log.Debugf(ctx, "Cache miss from %v took %v ms", t, msecSince(startTime))
 			cacheWriteTypes = append(cacheWriteTypes, t)
 		} else {
-			log.Debugf(ctx, "Got %v cached tag(s) from %v in %v ms", len(tags), t, msecSince(startTime))
+			log.Debugf(ctx, "Got cached tags for %v library(s) from %v in %v ms",
+				len(tags), t, msecSince(startTime))
 			break
 		}
 	}
@@ -42,30 +45,14 @@ func Tags(ctx context.Context, requireCache bool) ([]string, error) {
 		return nil, errors.New("tags not cached")
 	}
 
-	// If tags weren't cached, fall back to running a slow query across all songs.
+	// If tags weren't cached, fall back to running slow queries across all songs.
 	if tags == nil {
 		startTime := time.Now()
-		tagMap := make(map[string]struct{})
-		it := datastore.NewQuery(db.SongKind).Project("Tags").Distinct().Run(ctx)
-		for {
-			var song db.Song
-			if _, err := it.Next(&song); err == datastore.Done {
-				break
-			} else if err != nil {
-				return nil, err
-			}
-			for _, t := range song.Tags {
-				tagMap[t] = struct{}{}
-			}
+		if tags, err = loadLibraryTags(ctx); err != nil {
+			return nil, err
 		}
-		tags = make([]string, len(tagMap))
-		i := 0
-		for t := range tagMap {
-			tags[i] = t
-			i++
-		}
-		sort.Strings(tags)
-		log.Debugf(ctx, "Queried %v tag(s) from datastore in %v ms", len(tags), msecSince(startTime))
+		log.Debugf(ctx, "Queried tags for %v library(s) from datastore in %v ms",
+			len(tags), msecSince(startTime))
 	}
 
 	// Write the tags to any caches that didn't have them already.
@@ -91,5 +78,100 @@ func Tags(ctx context.Context, requireCache bool) ([]string, error) {
 		log.Debugf(ctx, "Waited %v ms for cache write(s)", msecSince(startTime))
 	}
 
+	return mergeLibraryTags(tags, include), nil
+}
+
+// loadLibraryTags scans all songs and returns their tags keyed by library name.
+func loadLibraryTags(ctx context.Context) (map[string][]string, error) {
+	// Songs in the main library may lack Library properties, so find the libraries of
+	// the songs that have them and then assign the other songs' tags to the main library.
+	libs := make(map[int64]string)
+	it := datastore.NewQuery(db.SongKind).Project("Library").Run(ctx)
+	for {
+		var song db.Song
+		if k, err := it.Next(&song); err == datastore.Done {
+			break
+		} else if err != nil {
+			return nil, err
+		} else if song.Library != "" {
+			libs[k.IntID()] = song.Library
+		}
+	}
+
+	// Without Distinct, a result is returned for each of each song's tags.
+	tagMaps := make(map[string]map[string]struct{})
+	it = datastore.NewQuery(db.SongKind).Project("Tags").Run(ctx)
+	for {
+		var song db.Song
+		k, err := it.Next(&song)
+		if err == datastore.Done {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		lib := libs[k.IntID()]
+		if tagMaps[lib] == nil {
+			tagMaps[lib] = make(map[string]struct{})
+		}
+		for _, t := range song.Tags {
+			tagMaps[lib][t] = struct{}{}
+		}
+	}
+
+	tags := make(map[string][]string, len(tagMaps))
+	for lib, m := range tagMaps {
+		lt := make([]string, 0, len(m))
+		for t := range m {
+			lt = append(lt, t)
+		}
+		sort.Strings(lt)
+		tags[lib] = lt
+	}
 	return tags, nil
 }
+
+// mergeLibraryTags returns the sorted union of the tags in libTags (keyed by library name)
+// from libraries for which include returns true.
+func mergeLibraryTags(libTags map[string][]string, include func(library string) bool) []string {
+	seen := make(map[string]struct{})
+	tags := make([]string, 0)
+	for lib, lt := range libTags {
+		if !include(lib) {
+			continue
+		}
+		for _, t := range lt {
+			if _, ok := seen[t]; !ok {
+				seen[t] = struct{}{}
+				tags = append(tags, t)
+			}
+		}
+	}
+	sort.Strings(tags)
+	return tags
+}
+
+// ExpandTags rewrites q's Tags and NotTags to also match the aliases and descendants of
+// each tag as described by rules. Tags that have expansions are moved from Tags to AnyTags.
+func (q *SongQuery) ExpandTags(rules *tagrules.Rules) {
+	var tags []string
+	for _, t := range q.Tags {
+		if exp := rules.Expand(t); len(exp) > 1 {
+			q.AnyTags = append(q.AnyTags, exp)
+		} else {
+			tags = append(tags, t)
+		}
+	}
+	q.Tags = tags
+
+	var notTags []string
+	seen := make(map[string]struct{})
+	for _, t := range q.NotTags {
+		for _, e := range rules.Expand(t) {
+			if _, ok := seen[e]; !ok {
+				notTags = append(notTags, e)
+				seen[e] = struct{}{}
+			}
+		}
+	}
+	q.NotTags = notTags
+}
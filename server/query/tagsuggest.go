@@ -0,0 +1,129 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package query
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/derat/nup/server/db"
+	"github.com/derat/nup/server/stats"
+
+	"google.golang.org/appengine/v2/datastore"
+	"google.golang.org/appengine/v2/log"
+)
+
+const (
+	// MaxTagSuggestions is the maximum number of tags returned by TagSuggestions.
+	MaxTagSuggestions = 20
+
+	tagSuggestLimit = 200 // max songs to load from the same album or by the same artist
+
+	// Weights applied to the different sources of suggestions. The album and artist weights
+	// are multiplied by the fraction of the album's or artist's songs that have each tag, and
+	// the co-occurrence weight is multiplied by the average fraction of songs with each of the
+	// source song's tags that also have the suggested tag.
+	tagSuggestAlbumWeight        = 2
+	tagSuggestArtistWeight       = 1
+	tagSuggestCooccurrenceWeight = 3
+)
+
+// TagSuggestion describes a tag suggested for a song.
+type TagSuggestion struct {
+	Tag   string  `json:"tag"`
+	Score float64 `json:"score"` // higher is better
+}
+
+// TagSuggestions returns up to max tags that src doesn't already have, based on the tags of
+// songs from the same album and by the same artist and on tag co-occurrence counts computed
+// by stats.Update. Suggestions are sorted by descending score.
+func TagSuggestions(ctx context.Context, src *db.Song, max int) ([]TagSuggestion, error) {
+	startTime := time.Now()
+	keep := songFilter(src.Library, nil)
+	var album, artist []*db.Song
+	var err error
+	if src.AlbumID != "" {
+		q := datastore.NewQuery(db.SongKind).Filter("AlbumId =", src.AlbumID).Limit(tagSuggestLimit)
+		if album, err = loadSongs(ctx, []*datastore.Query{q}, keep); err != nil {
+			return nil, err
+		}
+	}
+	if src.ArtistLower != "" {
+		q := datastore.NewQuery(db.SongKind).Filter("ArtistLower =", src.ArtistLower).
+			Limit(tagSuggestLimit)
+		if artist, err = loadSongs(ctx, []*datastore.Query{q}, keep); err != nil {
+			return nil, err
+		}
+	}
+	cooc, err := stats.TagCooccurrence(ctx)
+	if err != nil {
+		return nil, err
+	}
+	sugs := scoreTagSuggestions(src, album, artist, cooc, max)
+	log.Debugf(ctx, "Suggested %v tag(s) using %v album and %v artist song(s) in %v ms",
+		len(sugs), len(album), len(artist), msecSince(startTime))
+	return sugs, nil
+}
+
+// scoreTagSuggestions returns up to max tags that src doesn't have, scored using the tags
+// of album and artist (songs from src's album and by src's artist) and cooc (see
+// stats.TagCooccurrence).
+func scoreTagSuggestions(src *db.Song, album, artist []*db.Song,
+	cooc map[string]map[string]int, max int) []TagSuggestion {
+	scores := make(map[string]float64)
+
+	// Add weight times the fraction of songs (other than src) with each tag.
+	addSongs := func(songs []*db.Song, weight float64) {
+		var n int
+		counts := make(map[string]int)
+		for _, s := range songs {
+			if s.SongID == src.SongID {
+				continue
+			}
+			n++
+			for _, t := range s.Tags {
+				counts[t]++
+			}
+		}
+		for t, c := range counts {
+			scores[t] += weight * float64(c) / float64(n)
+		}
+	}
+	addSongs(album, tagSuggestAlbumWeight)
+	addSongs(artist, tagSuggestArtistWeight)
+
+	for _, t := range src.Tags {
+		total := cooc[t][t]
+		if total == 0 {
+			continue
+		}
+		for u, c := range cooc[t] {
+			if u != t {
+				scores[u] += tagSuggestCooccurrenceWeight * float64(c) / float64(total) /
+					float64(len(src.Tags))
+			}
+		}
+	}
+
+	for _, t := range src.Tags {
+		delete(scores, t)
+	}
+	sugs := make([]TagSuggestion, 0, len(scores))
+	for t, sc := range scores {
+		if sc > 0 {
+			sugs = append(sugs, TagSuggestion{t, sc})
+		}
+	}
+	sort.Slice(sugs, func(i, j int) bool {
+		if sugs[i].Score != sugs[j].Score {
+			return sugs[i].Score > sugs[j].Score
+		}
+		return sugs[i].Tag < sugs[j].Tag
+	})
+	if len(sugs) > max {
+		sugs = sugs[:max]
+	}
+	return sugs
+}
@@ -0,0 +1,45 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package query
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/derat/nup/server/db"
+)
+
+func TestScoreTagSuggestions(t *testing.T) {
+	src := &db.Song{SongID: "1", Tags: []string{"rock"}}
+	album := []*db.Song{
+		src,
+		{SongID: "2", Tags: []string{"rock", "guitar"}},
+		{SongID: "3", Tags: []string{"guitar", "live"}},
+	}
+	artist := append(album, &db.Song{SongID: "4", Tags: []string{"piano"}})
+	cooc := map[string]map[string]int{
+		"rock":   {"rock": 4, "guitar": 2, "drums": 1},
+		"guitar": {"guitar": 3, "rock": 2},
+	}
+
+	// guitar: 2*2/2 + 1*2/3 + 3*2/4 = 2 + 0.667 + 1.5
+	// live:   2*1/2 + 1*1/3         = 1 + 0.333
+	// drums:  3*1/4                 = 0.75
+	// piano:  1*1/3                 = 0.333
+	got := scoreTagSuggestions(src, album, artist, cooc, 3)
+	var tags []string
+	for _, s := range got {
+		tags = append(tags, s.Tag)
+	}
+	if want := []string{"guitar", "live", "drums"}; !reflect.DeepEqual(tags, want) {
+		t.Errorf("scoreTagSuggestions returned %q; want %q", tags, want)
+	}
+	if len(got) > 0 && (got[0].Score < 4.16 || got[0].Score > 4.17) {
+		t.Errorf("scoreTagSuggestions gave %q score %v; want ~4.167", got[0].Tag, got[0].Score)
+	}
+
+	if got := scoreTagSuggestions(&db.Song{SongID: "5"}, nil, nil, cooc, 3); len(got) != 0 {
+		t.Errorf("scoreTagSuggestions without data returned %v", got)
+	}
+}
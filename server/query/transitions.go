@@ -0,0 +1,66 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package query
+
+import (
+	"strconv"
+
+	"github.com/derat/nup/server/db"
+	"github.com/derat/nup/server/stats"
+)
+
+// orderByTransitions reorders songs, which should already be shuffled, so that each song is
+// preferentially followed by a song that was previously played through after it rather than
+// skipped. counts is keyed by the previous and next songs' IDs (see stats.TransitionCounts).
+//
+// If any remaining songs were played through after the previous song more often than they
+// were skipped, one of them is chosen randomly with weight proportional to the difference,
+// using rnd to generate values in [0, 1). Otherwise, the shuffled order is kept, except that
+// songs that were usually skipped after the previous song are moved later if possible.
+func orderByTransitions(songs []*db.Song, counts map[int64]map[int64]stats.TransitionCount,
+	rnd func() float64) {
+	ids := make([]int64, len(songs))
+	for i, s := range songs {
+		ids[i], _ = strconv.ParseInt(s.SongID, 10, 64)
+	}
+	swap := func(i, j int) {
+		songs[i], songs[j] = songs[j], songs[i]
+		ids[i], ids[j] = ids[j], ids[i]
+	}
+
+	for i := 1; i < len(songs); i++ {
+		next := counts[ids[i-1]]
+		if len(next) == 0 {
+			continue
+		}
+
+		var total int
+		for j := i; j < len(songs); j++ {
+			if c := next[ids[j]]; c.Plays > c.Skips {
+				total += c.Plays - c.Skips
+			}
+		}
+		if total > 0 {
+			v := int(rnd() * float64(total))
+			for j := i; j < len(songs); j++ {
+				if c := next[ids[j]]; c.Plays > c.Skips {
+					if v -= c.Plays - c.Skips; v < 0 {
+						swap(i, j)
+						break
+					}
+				}
+			}
+			continue
+		}
+
+		if c := next[ids[i]]; c.Skips > c.Plays {
+			for j := i + 1; j < len(songs); j++ {
+				if c := next[ids[j]]; c.Skips <= c.Plays {
+					swap(i, j)
+					break
+				}
+			}
+		}
+	}
+}
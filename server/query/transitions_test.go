@@ -0,0 +1,84 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package query
+
+import (
+	"reflect"
+	"strconv"
+	"testing"
+
+	"github.com/derat/nup/server/db"
+	"github.com/derat/nup/server/stats"
+)
+
+func TestOrderByTransitions(t *testing.T) {
+	makeSongs := func(ids ...int64) []*db.Song {
+		songs := make([]*db.Song, len(ids))
+		for i, id := range ids {
+			songs[i] = &db.Song{SongID: strconv.FormatInt(id, 10)}
+		}
+		return songs
+	}
+	getIDs := func(songs []*db.Song) []string {
+		ids := make([]string, len(songs))
+		for i, s := range songs {
+			ids[i] = s.SongID
+		}
+		return ids
+	}
+
+	for _, tc := range []struct {
+		desc   string
+		ids    []int64
+		counts map[int64]map[int64]stats.TransitionCount
+		rnd    float64
+		want   []string
+	}{
+		{
+			desc: "no counts",
+			ids:  []int64{1, 2, 3, 4},
+			want: []string{"1", "2", "3", "4"},
+		},
+		{
+			desc: "played through",
+			ids:  []int64{1, 2, 3, 4},
+			counts: map[int64]map[int64]stats.TransitionCount{
+				1: {4: {Plays: 3}},
+				4: {3: {Plays: 2, Skips: 1}},
+			},
+			want: []string{"1", "4", "3", "2"},
+		},
+		{
+			desc: "weighted choice",
+			ids:  []int64{1, 2, 3, 4},
+			counts: map[int64]map[int64]stats.TransitionCount{
+				1: {3: {Plays: 1}, 4: {Plays: 3}},
+			},
+			rnd:  0.2, // 0.2*4 = 0.8 selects 3
+			want: []string{"1", "3", "2", "4"},
+		},
+		{
+			desc: "skipped moved later",
+			ids:  []int64{1, 2, 3, 4},
+			counts: map[int64]map[int64]stats.TransitionCount{
+				1: {2: {Skips: 2}, 3: {Plays: 1, Skips: 1}},
+			},
+			want: []string{"1", "3", "2", "4"},
+		},
+		{
+			desc: "only skipped remaining",
+			ids:  []int64{1, 2},
+			counts: map[int64]map[int64]stats.TransitionCount{
+				1: {2: {Skips: 2}},
+			},
+			want: []string{"1", "2"},
+		},
+	} {
+		songs := makeSongs(tc.ids...)
+		orderByTransitions(songs, tc.counts, func() float64 { return tc.rnd })
+		if got := getIDs(songs); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: orderByTransitions produced %v; want %v", tc.desc, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+// Package queue stores users' server-side song queues.
+package queue
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"google.golang.org/appengine/v2/datastore"
+)
+
+const (
+	queueKind = "Queue" // datastore kind for Queue entities
+
+	// TimeOfDayLayout is a time layout for 24-hour times of day, e.g. "07:30".
+	TimeOfDayLayout = "15:04"
+)
+
+// Queue contains a list of songs queued for a user.
+// Queues are either filled by scheduled search presets or saved periodically by clients
+// so that playback can be resumed on another device.
+// Queue entities are keyed by the user's username or email address.
+type Queue struct {
+	// SongIDs contains the IDs of queued songs in the order in which they should be played.
+	SongIDs []int64 `datastore:",noindex"`
+	// Index contains the index in SongIDs of the song that was being played when a client
+	// saved the queue. It is 0 for queues filled by scheduled presets.
+	Index int `datastore:",noindex"`
+	// Position contains the playback position in seconds within the song at Index.
+	Position float64 `datastore:",noindex"`
+	// Device contains a client-supplied description of the device that saved the queue.
+	Device string `datastore:",noindex"`
+	// Preset contains the name of the scheduled search preset that produced SongIDs.
+	// It is empty if the queue was saved by a client.
+	Preset string `datastore:",noindex"`
+	// ScheduleTime contains the scheduled time at which Preset was evaluated.
+	ScheduleTime time.Time `datastore:",noindex"`
+	// UpdateTime contains the time at which the queue was last updated.
+	UpdateTime time.Time `datastore:",noindex"`
+}
+
+// Get returns the queue for the supplied user.
+// An empty queue is returned if the user doesn't have a saved queue.
+func Get(ctx context.Context, user string) (*Queue, error) {
+	var q Queue
+	key := datastore.NewKey(ctx, queueKind, user, 0, nil)
+	if err := datastore.Get(ctx, key, &q); err != nil && err != datastore.ErrNoSuchEntity {
+		return nil, err
+	}
+	return &q, nil
+}
+
+// Put saves q as the supplied user's queue.
+func Put(ctx context.Context, user string, q *Queue) error {
+	key := datastore.NewKey(ctx, queueKind, user, 0, nil)
+	_, err := datastore.Put(ctx, key, q)
+	return err
+}
+
+// AdjustIndex returns q.Index and q.Position adjusted for the removal of songs from
+// q.SongIDs. keep should contain an entry for each song in q.SongIDs indicating whether it's
+// being kept (e.g. it hasn't been deleted). If the song at q.Index is removed, the following
+// kept song (or the last kept song, if there are no following songs) is used instead and
+// the position is reset to 0.
+func (q *Queue) AdjustIndex(keep []bool) (index int, pos float64) {
+	var numKept int
+	for i, k := range keep {
+		if i == q.Index {
+			if k {
+				return numKept, q.Position
+			}
+			index = numKept
+		}
+		if k {
+			numKept++
+		}
+	}
+	if q.Index >= len(keep) || index >= numKept {
+		index = numKept - 1
+	}
+	if index < 0 {
+		index = 0
+	}
+	return index, 0
+}
+
+// Clear deletes all saved queues from datastore for testing.
+func Clear(ctx context.Context) error {
+	if keys, err := datastore.NewQuery(queueKind).KeysOnly().GetAll(ctx, nil); err != nil {
+		return fmt.Errorf("getting %v keys failed: %v", queueKind, err)
+	} else if err := datastore.DeleteMulti(ctx, keys); err != nil {
+		return fmt.Errorf("deleting all %v entities failed: %v", queueKind, err)
+	}
+	return nil
+}
+
+// LastScheduledTime returns the latest time at or before now that matches one of times,
+// each formatted as TimeOfDayLayout in loc.
+// The zero time is returned if times is empty.
+func LastScheduledTime(times []string, loc *time.Location, now time.Time) (time.Time, error) {
+	now = now.In(loc)
+	var last time.Time
+	for _, s := range times {
+		tod, err := time.Parse(TimeOfDayLayout, s)
+		if err != nil {
+			return time.Time{}, err
+		}
+		t := time.Date(now.Year(), now.Month(), now.Day(), tod.Hour(), tod.Minute(), 0, 0, loc)
+		if t.After(now) {
+			t = time.Date(now.Year(), now.Month(), now.Day()-1, tod.Hour(), tod.Minute(), 0, 0, loc)
+		}
+		if t.After(last) {
+			last = t
+		}
+	}
+	return last, nil
+}
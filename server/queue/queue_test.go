@@ -0,0 +1,74 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package queue
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLastScheduledTime(t *testing.T) {
+	loc, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+	date := func(day, hour, min int) time.Time { return time.Date(2023, 3, day, hour, min, 0, 0, loc) }
+
+	for _, tc := range []struct {
+		times []string
+		now   time.Time
+		want  time.Time
+	}{
+		{nil, date(10, 8, 0), time.Time{}},
+		{[]string{"07:30"}, date(10, 8, 0), date(10, 7, 30)},
+		{[]string{"07:30"}, date(10, 7, 30), date(10, 7, 30)},
+		{[]string{"07:30"}, date(10, 7, 29), date(9, 7, 30)},
+		{[]string{"07:30", "18:00"}, date(10, 20, 0), date(10, 18, 0)},
+		{[]string{"18:00", "07:30"}, date(10, 12, 0), date(10, 7, 30)},
+		{[]string{"23:00"}, date(1, 1, 0), time.Date(2023, 2, 28, 23, 0, 0, 0, loc)},
+		// The supplied time should be converted to loc.
+		{[]string{"07:30"}, time.Date(2023, 3, 10, 12, 45, 0, 0, time.UTC), date(10, 7, 30)},
+	} {
+		if got, err := LastScheduledTime(tc.times, loc, tc.now); err != nil {
+			t.Errorf("LastScheduledTime(%q, %v, %v) failed: %v", tc.times, loc, tc.now, err)
+		} else if !got.Equal(tc.want) {
+			t.Errorf("LastScheduledTime(%q, %v, %v) = %v; want %v", tc.times, loc, tc.now, got, tc.want)
+		}
+	}
+
+	for _, s := range []string{"", "7", "7:60", "24:00", "-1:00", "07:30:00", "a:b"} {
+		if _, err := LastScheduledTime([]string{s}, loc, date(10, 8, 0)); err == nil {
+			t.Errorf("LastScheduledTime(%q, ...) unexpectedly succeeded", s)
+		}
+	}
+}
+
+func TestQueue_AdjustIndex(t *testing.T) {
+	const (
+		y = true
+		n = false
+	)
+	for _, tc := range []struct {
+		keep      []bool
+		index     int
+		pos       float64
+		wantIndex int
+		wantPos   float64
+	}{
+		{[]bool{y, y, y}, 1, 12.5, 1, 12.5},
+		{[]bool{n, y, y}, 1, 12.5, 0, 12.5},
+		{[]bool{n, n, y, y}, 3, 12.5, 1, 12.5},
+		{[]bool{y, n, y}, 1, 12.5, 1, 0},
+		{[]bool{y, y, n}, 2, 12.5, 1, 0},
+		{[]bool{n, n, n}, 1, 12.5, 0, 0},
+		{[]bool{y, y}, 5, 12.5, 1, 0},
+		{nil, 0, 12.5, 0, 0},
+	} {
+		q := Queue{Index: tc.index, Position: tc.pos}
+		if index, pos := q.AdjustIndex(tc.keep); index != tc.wantIndex || pos != tc.wantPos {
+			t.Errorf("AdjustIndex(%v) with index %d and pos %v = (%d, %v); want (%d, %v)",
+				tc.keep, tc.index, tc.pos, index, pos, tc.wantIndex, tc.wantPos)
+		}
+	}
+}
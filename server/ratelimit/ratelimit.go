@@ -6,8 +6,8 @@ package ratelimit
 
 import (
 	"context"
-	"errors"
 	"fmt"
+	"sort"
 	"time"
 
 	"google.golang.org/appengine/v2/datastore"
@@ -21,11 +21,22 @@ type rateInfo struct {
 	Times []time.Time
 }
 
-// Attempt determines if a new request by the client identified by user is allowed.
-// An error is returned if max or more successful attempts were already made in interval.
+// ExceededError is returned by Attempt when a request is rejected.
+type ExceededError struct {
+	// RetryAfter contains the time until the next request will be allowed.
+	RetryAfter time.Duration
+}
+
+func (e *ExceededError) Error() string {
+	return fmt.Sprintf("request rate exceeded (retry after %v)", e.RetryAfter)
+}
+
+// Attempt determines if a new request by the client identified by id is allowed.
+// id should identify both the client and the limit being enforced, e.g. "user /query 1h0m0s".
+// An *ExceededError is returned if max or more successful attempts were already made in interval.
 // Errors can also be returned for datastore failures.
-func Attempt(ctx context.Context, user string, now time.Time, max int, interval time.Duration) error {
-	key := datastore.NewKey(ctx, rateInfoKind, user, 0, nil)
+func Attempt(ctx context.Context, id string, now time.Time, max int, interval time.Duration) error {
+	key := datastore.NewKey(ctx, rateInfoKind, id, 0, nil)
 	return datastore.RunInTransaction(ctx, func(ctx context.Context) error {
 		var info rateInfo
 		if err := datastore.Get(ctx, key, &info); err != nil && err != datastore.ErrNoSuchEntity {
@@ -42,7 +53,13 @@ func Attempt(ctx context.Context, user string, now time.Time, max int, interval
 			}
 		}
 		if count >= max {
-			return errors.New("request rate exceeded")
+			// Times are saved in ascending order, so another request will be allowed
+			// once enough of the oldest ones have fallen out of the interval.
+			var retry time.Duration
+			if max > 0 {
+				retry = info.Times[count-max].Add(interval).Sub(now)
+			}
+			return &ExceededError{RetryAfter: retry}
 		}
 
 		// Only update the saved info if the attempt was successful.
@@ -54,6 +71,30 @@ func Attempt(ctx context.Context, user string, now time.Time, max int, interval
 	}, nil)
 }
 
+// Status describes a single client's recent requests.
+type Status struct {
+	// ID contains the ID that was passed to Attempt.
+	ID string `json:"id"`
+	// Times contains the times of successful requests, in ascending order.
+	Times []time.Time `json:"times"`
+}
+
+// GetStatus returns the saved status of all clients for debugging, sorted by ID.
+// Times can include requests that are too old to count against the client's limit.
+func GetStatus(ctx context.Context) ([]Status, error) {
+	var infos []rateInfo
+	keys, err := datastore.NewQuery(rateInfoKind).GetAll(ctx, &infos)
+	if err != nil {
+		return nil, err
+	}
+	statuses := make([]Status, len(keys))
+	for i, key := range keys {
+		statuses[i] = Status{ID: key.StringID(), Times: infos[i].Times}
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].ID < statuses[j].ID })
+	return statuses, nil
+}
+
 // Clear deletes all rate-limiting information from datastore for testing.
 func Clear(ctx context.Context) error {
 	if keys, err := datastore.NewQuery(rateInfoKind).KeysOnly().GetAll(ctx, nil); err != nil {
@@ -0,0 +1,99 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"google.golang.org/appengine/v2"
+)
+
+// requestIDHeader is the response header containing the ID assigned to each request.
+const requestIDHeader = "X-Nup-Request-Id"
+
+// newRequestID returns an ID identifying the request associated with ctx.
+// The App Engine request log ID is used if available.
+func newRequestID(ctx context.Context) string {
+	if id := appengine.RequestID(ctx); id != "" {
+		return id
+	}
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// requestLogEntry is a structured log entry describing a handled request.
+// Cloud Logging parses JSON objects written to stdout, using the "severity" and "message"
+// fields and grouping entries by the "logging.googleapis.com/trace" field:
+// https://cloud.google.com/logging/docs/structured-logging
+type requestLogEntry struct {
+	Severity   string  `json:"severity"`
+	Message    string  `json:"message"`
+	Trace      string  `json:"logging.googleapis.com/trace,omitempty"`
+	RequestID  string  `json:"requestId"`
+	Method     string  `json:"method"`
+	Path       string  `json:"path"`
+	User       string  `json:"user,omitempty"`
+	Status     int     `json:"status"`
+	DurationMs float64 `json:"durationMs"`
+}
+
+// newRequestLogEntry returns an entry describing r, which was sent by user (possibly empty)
+// and assigned id. status is the response's status code and dur is the time spent handling it.
+// project contains the GCP project ID, used to associate the entry with the request's trace.
+func newRequestLogEntry(r *http.Request, id, user, project string, status int,
+	dur time.Duration) *requestLogEntry {
+	e := &requestLogEntry{
+		Severity:   "INFO",
+		RequestID:  id,
+		Method:     r.Method,
+		Path:       r.URL.Path,
+		User:       user,
+		Status:     status,
+		DurationMs: float64(dur) / float64(time.Millisecond),
+	}
+	switch {
+	case status >= 500:
+		e.Severity = "ERROR"
+	case status >= 400:
+		e.Severity = "WARNING"
+	}
+	e.Message = fmt.Sprintf("%s %s %d (%.1f ms)", e.Method, e.Path, e.Status, e.DurationMs)
+
+	// The header has the form "TRACE_ID/SPAN_ID;o=TRACE_TRUE".
+	if tc := r.Header.Get("X-Cloud-Trace-Context"); tc != "" && project != "" {
+		if i := strings.IndexByte(tc, '/'); i > 0 {
+			tc = tc[:i]
+		}
+		e.Trace = fmt.Sprintf("projects/%s/traces/%s", project, tc)
+	}
+	return e
+}
+
+// logRequest writes a structured entry describing r to stdout.
+// See newRequestLogEntry for a description of the arguments.
+func logRequest(r *http.Request, id, user string, status int, dur time.Duration) {
+	e := newRequestLogEntry(r, id, user, os.Getenv("GOOGLE_CLOUD_PROJECT"), status, dur)
+	if b, err := json.Marshal(e); err == nil {
+		os.Stdout.Write(append(b, '\n'))
+	}
+}
+
+// writeErrorRequestID appends id to w's body if it contains a plain-text error (e.g. written
+// by http.Error) so that client-side failures can be correlated with server logs.
+func writeErrorRequestID(w *countingResponseWriter, r *http.Request, id string) {
+	if w.code < 400 || r.Method == http.MethodHead ||
+		!strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain") {
+		return
+	}
+	fmt.Fprintf(w, "Request ID: %s\n", id)
+}
@@ -0,0 +1,49 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package main
+
+import (
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestNewRequestLogEntry(t *testing.T) {
+	const (
+		id      = "abc"
+		project = "my-project"
+	)
+	for _, tc := range []struct {
+		method, url, trace string
+		user               string
+		status             int
+		dur                time.Duration
+		want               requestLogEntry
+	}{
+		{"GET", "/query?artist=foo", "", "user", 200, 1500 * time.Microsecond, requestLogEntry{
+			Severity: "INFO", Message: "GET /query 200 (1.5 ms)", RequestID: id,
+			Method: "GET", Path: "/query", User: "user", Status: 200, DurationMs: 1.5,
+		}},
+		{"POST", "/played", "0123abc/456;o=1", "", 403, 2 * time.Millisecond, requestLogEntry{
+			Severity: "WARNING", Message: "POST /played 403 (2.0 ms)",
+			Trace: "projects/" + project + "/traces/0123abc", RequestID: id,
+			Method: "POST", Path: "/played", Status: 403, DurationMs: 2,
+		}},
+		{"GET", "/song", "0123abc", "user", 500, time.Second, requestLogEntry{
+			Severity: "ERROR", Message: "GET /song 500 (1000.0 ms)",
+			Trace: "projects/" + project + "/traces/0123abc", RequestID: id,
+			Method: "GET", Path: "/song", User: "user", Status: 500, DurationMs: 1000,
+		}},
+	} {
+		r := httptest.NewRequest(tc.method, tc.url, nil)
+		if tc.trace != "" {
+			r.Header.Set("X-Cloud-Trace-Context", tc.trace)
+		}
+		got := newRequestLogEntry(r, id, tc.user, project, tc.status, tc.dur)
+		if !reflect.DeepEqual(*got, tc.want) {
+			t.Errorf("newRequestLogEntry for %v %v returned %+v; want %+v", tc.method, tc.url, *got, tc.want)
+		}
+	}
+}
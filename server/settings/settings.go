@@ -0,0 +1,81 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+// Package settings stores users' web client settings.
+package settings
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"google.golang.org/appengine/v2/datastore"
+)
+
+const (
+	settingsKind = "Settings" // datastore kind for Settings entities
+
+	// MaxSize is the maximum size in bytes of a user's JSON-encoded settings.
+	MaxSize = 16 * 1024
+)
+
+// Settings contains a user's web client settings (e.g. theme, gain type, pre-amp, and volume).
+// The server doesn't interpret the settings; it just stores them so that they can be shared
+// across devices. Settings entities are keyed by the user's username or email address.
+type Settings struct {
+	// Data contains a JSON object describing the settings.
+	Data []byte `datastore:",noindex"`
+	// UpdateTime contains the time at which the settings were last saved.
+	UpdateTime time.Time `datastore:",noindex"`
+}
+
+// Validate returns an error if data isn't a JSON object of at most MaxSize bytes.
+func Validate(data []byte) error {
+	if len(data) > MaxSize {
+		return fmt.Errorf("settings exceed %d bytes", MaxSize)
+	}
+	if !json.Valid(data) {
+		return errors.New("settings aren't valid JSON")
+	}
+	if trimmed := bytes.TrimSpace(data); len(trimmed) == 0 || trimmed[0] != '{' {
+		return errors.New("settings aren't a JSON object")
+	}
+	return nil
+}
+
+// Get returns the supplied user's settings.
+// Nil is returned if the user hasn't saved any settings.
+func Get(ctx context.Context, user string) (*Settings, error) {
+	var s Settings
+	key := datastore.NewKey(ctx, settingsKind, user, 0, nil)
+	if err := datastore.Get(ctx, key, &s); err == datastore.ErrNoSuchEntity {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// Put saves data as the supplied user's settings, replacing any existing settings.
+// data should have already been checked using Validate.
+func Put(ctx context.Context, user string, data []byte, now time.Time) (*Settings, error) {
+	s := Settings{Data: data, UpdateTime: now}
+	key := datastore.NewKey(ctx, settingsKind, user, 0, nil)
+	if _, err := datastore.Put(ctx, key, &s); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// Clear deletes all saved settings from datastore for testing.
+func Clear(ctx context.Context) error {
+	if keys, err := datastore.NewQuery(settingsKind).KeysOnly().GetAll(ctx, nil); err != nil {
+		return fmt.Errorf("getting %v keys failed: %v", settingsKind, err)
+	} else if err := datastore.DeleteMulti(ctx, keys); err != nil {
+		return fmt.Errorf("deleting all %v entities failed: %v", settingsKind, err)
+	}
+	return nil
+}
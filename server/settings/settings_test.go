@@ -0,0 +1,31 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package settings
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	for _, tc := range []struct {
+		data string
+		ok   bool
+	}{
+		{`{}`, true},
+		{` {"theme": 2, "preAmp": -3.5} `, true},
+		{`{"name": "` + strings.Repeat("a", MaxSize) + `"}`, false},
+		{``, false},
+		{`{"theme": `, false},
+		{`[1, 2]`, false},
+		{`"str"`, false},
+		{`null`, false},
+	} {
+		if err := Validate([]byte(tc.data)); err == nil && !tc.ok {
+			t.Errorf("Validate(%q) unexpectedly succeeded", tc.data)
+		} else if err != nil && tc.ok {
+			t.Errorf("Validate(%q) failed: %v", tc.data, err)
+		}
+	}
+}
@@ -0,0 +1,260 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/derat/nup/server/config"
+	"github.com/derat/nup/server/db"
+	"github.com/derat/nup/server/query"
+	"github.com/derat/nup/server/share"
+
+	"google.golang.org/appengine/v2"
+	"google.golang.org/appengine/v2/log"
+	"google.golang.org/appengine/v2/memcache"
+)
+
+const (
+	shareCoverSize = 400 // size of cover images in share pages and oEmbed responses
+
+	// accessCacheExpiration is the maximum duration for which an access token's permission to
+	// fetch a file is cached. Successful checks are cached since browsers send many range
+	// requests while playing a song.
+	accessCacheExpiration = 10 * time.Minute
+)
+
+// getBaseURL returns the server's public base URL (without a trailing slash) for share links.
+// The request's Host header isn't used since it's supplied by the client.
+func getBaseURL(ctx context.Context, cfg *config.Config) string {
+	if cfg.ShareBaseURL != "" {
+		return strings.TrimSuffix(cfg.ShareBaseURL, "/")
+	}
+	scheme := "https"
+	if appengine.IsDevAppServer() {
+		scheme = "http"
+	}
+	return scheme + "://" + appengine.DefaultVersionHostname(ctx)
+}
+
+// getShareSong returns a song describing the shared item of the supplied kind and ID.
+// For albums, the first song in the album is returned.
+// An error satisfying os.IsNotExist is returned if the item doesn't exist.
+func getShareSong(ctx context.Context, kind share.Kind, id string) (*db.Song, error) {
+	switch kind {
+	case share.Song:
+		sid, err := strconv.ParseInt(id, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		songs, err := query.SongsByID(ctx, []int64{sid})
+		if err != nil {
+			return nil, err
+		}
+		if songs[0] == nil {
+			return nil, os.ErrNotExist
+		}
+		return songs[0], nil
+	case share.Album:
+		songs, err := query.Songs(ctx, &query.SongQuery{AlbumID: id, MaxPlays: -1}, 0)
+		if err != nil {
+			return nil, err
+		}
+		if len(songs) == 0 {
+			return nil, os.ErrNotExist
+		}
+		return songs[0], nil
+	default:
+		return nil, errors.New("bad kind")
+	}
+}
+
+// getShareInfo returns information describing the shared item of the supplied kind and ID.
+// The returned URLs contain tokens that expire at exp.
+func getShareInfo(ctx context.Context, cfg *config.Config, kind share.Kind, id string,
+	exp time.Time) (share.Info, error) {
+	s, err := getShareSong(ctx, kind, id)
+	if err != nil {
+		return share.Info{}, err
+	}
+
+	base := getBaseURL(ctx, cfg)
+	params := share.Params(cfg.ShareSecret, cfg.ShareKeyGeneration, kind, id, exp)
+	pageURL := base + share.PagePath + "?" + params.Encode()
+	info := share.Info{
+		PageURL:   pageURL,
+		OEmbedURL: base + share.OEmbedPath + "?" + url.Values{"url": {pageURL}}.Encode(),
+	}
+	if kind == share.Album {
+		info.Title = s.Album
+		info.Artist = s.AlbumArtist
+		if info.Artist == "" {
+			info.Artist = s.Artist
+		}
+	} else {
+		info.Title = s.Title
+		info.Artist = s.Artist
+		info.Album = s.Album
+	}
+	if s.CoverFilename != "" {
+		info.CoverURL = base + share.CoverPath + "?" + params.Encode()
+		info.CoverSize = shareCoverSize
+	}
+	return info, nil
+}
+
+// parseShareParams verifies that share links are enabled and extracts the shared item and
+// the link's expiration time from r. If false is returned, an error was written to w.
+func parseShareParams(ctx context.Context, cfg *config.Config, w http.ResponseWriter,
+	r *http.Request) (kind share.Kind, id string, exp time.Time, ok bool) {
+	if cfg.ShareSecret == "" {
+		http.Error(w, "Sharing disabled", http.StatusNotFound)
+		return "", "", time.Time{}, false
+	}
+	kind, id, exp, err := share.ParseParams(cfg.ShareSecret, cfg.ShareKeyGeneration,
+		r.URL.Query(), time.Now())
+	if err != nil {
+		log.Errorf(ctx, "Rejecting share request for %v: %v", r.URL.String(), err)
+		http.Error(w, "Invalid share link", http.StatusForbidden)
+		return "", "", time.Time{}, false
+	}
+	return kind, id, exp, true
+}
+
+// accessPaths contains the paths of endpoints that accept access tokens (see share.Access)
+// in place of user credentials.
+var accessPaths = map[string]bool{
+	"/cover": true,
+	"/query": true,
+	"/song":  true,
+}
+
+// parseAccessToken verifies that access tokens are enabled and extracts r's token.
+// If false is returned, an error was written to w.
+func parseAccessToken(ctx context.Context, cfg *config.Config, w http.ResponseWriter,
+	r *http.Request) (*share.Access, bool) {
+	if cfg.ShareSecret == "" {
+		http.Error(w, "Sharing disabled", http.StatusNotFound)
+		return nil, false
+	}
+	a, err := share.ParseAccessToken(cfg.ShareSecret, cfg.ShareKeyGeneration,
+		r.FormValue(share.AccessParam), time.Now())
+	if err != nil {
+		log.Errorf(ctx, "Rejecting access token for %v: %v", r.URL.String(), err)
+		http.Error(w, "Invalid access token", http.StatusForbidden)
+		return nil, false
+	}
+	return a, true
+}
+
+// checkAccess verifies that r's access token grants read-only access to path.
+// /query requests are accepted here and limited to the token's songs by handleQuery.
+// If false is returned, an error was written to w.
+func checkAccess(ctx context.Context, cfg *config.Config, w http.ResponseWriter,
+	r *http.Request, path string) bool {
+	a, ok := parseAccessToken(ctx, cfg, w, r)
+	if !ok {
+		return false
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "Access tokens are read-only", http.StatusForbidden)
+		return false
+	}
+	if path == "/query" {
+		return true
+	}
+
+	fn := r.FormValue("filename")
+	key := accessCacheKey(r.FormValue(share.AccessParam), path, fn)
+	if _, err := memcache.Get(ctx, key); err == nil {
+		return true
+	} else if err != memcache.ErrCacheMiss {
+		log.Errorf(ctx, "Getting cached access for %q failed: %v", fn, err)
+	}
+
+	songs, ok := getAccessSongs(ctx, cfg, w, r, a)
+	if !ok {
+		return false
+	}
+	for _, s := range songs {
+		if (path == "/song" && s.Filename == fn) || (path == "/cover" && s.CoverFilename == fn) {
+			exp := accessCacheExpiration
+			if d := time.Until(a.Expires); d < exp {
+				exp = d
+			}
+			if err := memcache.Set(ctx, &memcache.Item{Key: key, Value: []byte{1}, Expiration: exp}); err != nil {
+				log.Errorf(ctx, "Caching access for %q failed: %v", fn, err)
+			}
+			return true
+		}
+	}
+	log.Errorf(ctx, "Rejecting access token for %v: %q not in scope", r.URL.String(), fn)
+	http.Error(w, "Not in access token's scope", http.StatusForbidden)
+	return false
+}
+
+// accessCacheKey returns the memcache key used to record that an access token
+// grants access to the file fn at path.
+func accessCacheKey(token, path, fn string) string {
+	sum := sha256.Sum256([]byte(token + "\x00" + path + "\x00" + fn))
+	return "access." + hex.EncodeToString(sum[:])
+}
+
+// accessTokenName returns a short name identifying an access token for rate-limiting
+// and logging.
+func accessTokenName(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return "access:" + hex.EncodeToString(sum[:8])
+}
+
+// getAccessSongs returns the songs that a (from unauthenticated request r) grants access to.
+// If false is returned, an error was written to w.
+func getAccessSongs(ctx context.Context, cfg *config.Config, w http.ResponseWriter,
+	r *http.Request, a *share.Access) ([]*db.Song, bool) {
+	if len(a.SongIDs) > 0 {
+		loaded, err := query.SongsByID(ctx, a.SongIDs)
+		if err != nil {
+			log.Errorf(ctx, "Getting %d shared song(s) failed: %v", len(a.SongIDs), err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return nil, false
+		}
+		songs := make([]*db.Song, 0, len(loaded))
+		for _, s := range loaded {
+			if s != nil {
+				songs = append(songs, s)
+			}
+		}
+		return songs, true
+	}
+
+	vals, err := url.ParseQuery(a.Query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+	// parseSongQuery reads parameters from a request, so replace r's parameters with the
+	// token's. r has no credentials, so user-specific parameters are rejected.
+	qr := r.Clone(r.Context())
+	qr.Form = vals
+	q, ok := parseSongQuery(ctx, cfg, w, qr)
+	if !ok {
+		return nil, false
+	}
+	songs, err := query.Songs(ctx, q, 0)
+	if err != nil {
+		log.Errorf(ctx, "Querying shared songs failed: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil, false
+	}
+	return songs, true
+}
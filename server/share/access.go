@@ -0,0 +1,103 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package share
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// AccessParam is the name of the URL query parameter containing an access token.
+const AccessParam = "access"
+
+// Access describes read-only access to a limited set of songs granted by an access token.
+// Exactly one of Query and SongIDs must be set.
+type Access struct {
+	// Expires is the time at which the token stops being valid.
+	Expires time.Time `json:"exp"`
+	// Generation contains the config's key generation at the time that the token was created.
+	// The token is only valid while the generation is unchanged.
+	Generation int `json:"gen,omitempty"`
+	// Query contains encoded /query parameters matching the accessible songs.
+	Query string `json:"q,omitempty"`
+	// SongIDs contains the IDs of the accessible songs (e.g. a playlist).
+	SongIDs []int64 `json:"ids,omitempty"`
+}
+
+// check returns an error if a's scope is invalid.
+func (a *Access) check() error {
+	if (a.Query == "") == (len(a.SongIDs) == 0) {
+		return errors.New("exactly one of query and song IDs must be supplied")
+	}
+	if a.Query != "" {
+		if _, err := url.ParseQuery(a.Query); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AccessToken returns a URL-safe token granting the access described by a.
+// secret is used as an HMAC key and must be non-empty.
+func AccessToken(secret string, a Access) (string, error) {
+	if secret == "" {
+		return "", errors.New("no secret")
+	}
+	if err := a.check(); err != nil {
+		return "", err
+	}
+	b, err := json.Marshal(a)
+	if err != nil {
+		return "", err
+	}
+	payload := base64.RawURLEncoding.EncodeToString(b)
+	return payload + "." + accessMAC(secret, payload), nil
+}
+
+// ParseAccessToken verifies a token returned by AccessToken and returns the access that it
+// grants. An error is returned if the token is invalid, was created for a key generation
+// other than gen, or has expired as of now.
+func ParseAccessToken(secret string, gen int, token string, now time.Time) (*Access, error) {
+	if secret == "" {
+		return nil, errors.New("no secret")
+	}
+	parts := strings.SplitN(token, ".", 2)
+	if len(parts) != 2 || !hmac.Equal([]byte(parts[1]), []byte(accessMAC(secret, parts[0]))) {
+		return nil, errors.New("invalid token")
+	}
+	b, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, err
+	}
+	var a Access
+	if err := json.Unmarshal(b, &a); err != nil {
+		return nil, err
+	}
+	if err := a.check(); err != nil {
+		return nil, err
+	}
+	if a.Generation != gen {
+		return nil, fmt.Errorf("token from key generation %d (current is %d)", a.Generation, gen)
+	}
+	if !now.Before(a.Expires) {
+		return nil, errors.New("token expired")
+	}
+	return &a, nil
+}
+
+// accessMAC returns an encoded HMAC of an access token's payload.
+// A prefix is used to avoid collisions with tokens returned by Token.
+func accessMAC(secret, payload string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	io.WriteString(mac, "access:"+payload)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
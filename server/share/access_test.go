@@ -0,0 +1,58 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package share
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestAccessTokens(t *testing.T) {
+	const (
+		secret = "secret"
+		gen    = 3
+	)
+	now := time.Date(2023, 5, 1, 12, 0, 0, 0, time.UTC)
+	want := Access{Expires: now.Add(time.Hour), Generation: gen, SongIDs: []int64{5, 2, 8}}
+	tok, err := AccessToken(secret, want)
+	if err != nil {
+		t.Fatal("AccessToken failed: ", err)
+	}
+	if got, err := ParseAccessToken(secret, gen, tok, now); err != nil {
+		t.Errorf("ParseAccessToken(%q) failed: %v", tok, err)
+	} else if !got.Expires.Equal(want.Expires) || !reflect.DeepEqual(got.SongIDs, want.SongIDs) {
+		t.Errorf("ParseAccessToken(%q) = %+v; want %+v", tok, *got, want)
+	}
+
+	for _, tc := range []struct {
+		secret string
+		gen    int
+		token  string
+		now    time.Time
+	}{
+		{"other", gen, tok, now},
+		{"", gen, tok, now},
+		{secret, gen + 1, tok, now},                                           // revoked
+		{secret, gen, tok, now.Add(time.Hour)},                                // expired
+		{secret, gen, tok[1:], now},                                           // modified payload
+		{secret, gen, tok[:len(tok)-1], now},                                  // truncated MAC
+		{secret, gen, Token(secret, gen, Song, "5", now.Add(time.Hour)), now}, // share token
+	} {
+		if _, err := ParseAccessToken(tc.secret, tc.gen, tc.token, tc.now); err == nil {
+			t.Errorf("ParseAccessToken(%q, %v, %q, %v) unexpectedly succeeded",
+				tc.secret, tc.gen, tc.token, tc.now)
+		}
+	}
+
+	for _, a := range []Access{
+		{Expires: now},
+		{Expires: now, Query: "artist=foo", SongIDs: []int64{1}},
+		{Expires: now, Query: "artist=%zz"},
+	} {
+		if _, err := AccessToken(secret, a); err == nil {
+			t.Errorf("AccessToken(%+v) unexpectedly succeeded", a)
+		}
+	}
+}
@@ -0,0 +1,203 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+// Package share generates and verifies tokens for publicly-shareable song and album links
+// and renders the minimal pages that are served for them.
+package share
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Kind describes the type of item that is shared.
+type Kind string
+
+const (
+	Song  Kind = "song"  // id is a song ID
+	Album Kind = "album" // id is an album ID
+
+	tokenLen = 16 // number of HMAC bytes included in tokens
+
+	// PagePath, CoverPath, and OEmbedPath contain the paths of the server's share endpoints.
+	PagePath   = "/share"
+	CoverPath  = "/share_cover"
+	OEmbedPath = "/oembed"
+)
+
+// Token returns a URL-safe token granting access to the item of the supplied kind and ID
+// until expires. secret is used as an HMAC key and must be non-empty. gen contains the
+// config's key generation; incrementing it invalidates all previously-returned tokens.
+// The expiration time and generation are included in the token and covered by the HMAC.
+func Token(secret string, gen int, kind Kind, id string, expires time.Time) string {
+	payload := strconv.FormatInt(expires.Unix(), 10) + "." + strconv.Itoa(gen)
+	return payload + "." + tokenMAC(secret, kind, id, payload)
+}
+
+// tokenMAC returns an encoded HMAC of a token's payload for the item of the supplied kind and ID.
+func tokenMAC(secret string, kind Kind, id, payload string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	io.WriteString(mac, string(kind)+":"+id+":"+payload)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil)[:tokenLen])
+}
+
+// checkToken verifies that token was returned by Token for the supplied item and key generation
+// and that it hasn't expired as of now. The token's expiration time is returned.
+func checkToken(secret string, gen int, kind Kind, id, token string, now time.Time) (time.Time, error) {
+	if secret == "" || id == "" {
+		return time.Time{}, errors.New("no secret or ID")
+	}
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return time.Time{}, errors.New("malformed token")
+	}
+	payload := parts[0] + "." + parts[1]
+	if !hmac.Equal([]byte(parts[2]), []byte(tokenMAC(secret, kind, id, payload))) {
+		return time.Time{}, errors.New("invalid token")
+	}
+	sec, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if tgen, err := strconv.Atoi(parts[1]); err != nil {
+		return time.Time{}, err
+	} else if tgen != gen {
+		return time.Time{}, fmt.Errorf("token from key generation %d (current is %d)", tgen, gen)
+	}
+	expires := time.Unix(sec, 0)
+	if !now.Before(expires) {
+		return time.Time{}, errors.New("token expired")
+	}
+	return expires, nil
+}
+
+// Params returns URL query parameters identifying the supplied item.
+// See Token for a description of the other arguments.
+func Params(secret string, gen int, kind Kind, id string, expires time.Time) url.Values {
+	return url.Values{
+		"kind":  {string(kind)},
+		"id":    {id},
+		"token": {Token(secret, gen, kind, id, expires)},
+	}
+}
+
+// ParseParams extracts the item identified by vals (see Params) and verifies its token
+// against gen and now. The token's expiration time is also returned so that equivalent
+// parameters can be regenerated via Params.
+func ParseParams(secret string, gen int, vals url.Values, now time.Time) (
+	kind Kind, id string, expires time.Time, err error) {
+	kind = Kind(vals.Get("kind"))
+	if kind != Song && kind != Album {
+		return "", "", time.Time{}, fmt.Errorf("bad kind %q", kind)
+	}
+	id = vals.Get("id")
+	if expires, err = checkToken(secret, gen, kind, id, vals.Get("token"), now); err != nil {
+		return "", "", time.Time{}, err
+	}
+	return kind, id, expires, nil
+}
+
+// ParsePageURL is like ParseParams but parses a share page URL as passed to the oEmbed endpoint.
+func ParsePageURL(secret string, gen int, pageURL string, now time.Time) (
+	kind Kind, id string, expires time.Time, err error) {
+	u, err := url.Parse(pageURL)
+	if err != nil {
+		return "", "", time.Time{}, err
+	}
+	if u.Path != PagePath {
+		return "", "", time.Time{}, fmt.Errorf("bad path %q", u.Path)
+	}
+	return ParseParams(secret, gen, u.Query(), now)
+}
+
+// Info describes a shared item.
+type Info struct {
+	Title     string // song or album title
+	Artist    string // song or album artist
+	Album     string // album containing song (empty for albums)
+	PageURL   string // absolute URL of share page
+	CoverURL  string // absolute URL of cover image (empty if no cover)
+	CoverSize int    // width and height of cover image in pixels
+	OEmbedURL string // absolute URL of oEmbed endpoint for PageURL
+}
+
+// description returns a short human-readable description of info.
+func (info *Info) description() string {
+	if info.Album != "" {
+		return info.Artist + " · " + info.Album
+	}
+	return info.Artist
+}
+
+var pageTmpl = template.Must(template.New("").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<meta property="og:type" content="music.{{if .Album}}song{{else}}album{{end}}">
+<meta property="og:title" content="{{.Title}}">
+<meta property="og:description" content="{{.Description}}">
+<meta property="og:url" content="{{.PageURL}}">
+{{- if .CoverURL}}
+<meta property="og:image" content="{{.CoverURL}}">
+<meta property="og:image:width" content="{{.CoverSize}}">
+<meta property="og:image:height" content="{{.CoverSize}}">
+{{- end}}
+<meta name="twitter:card" content="summary">
+<link rel="alternate" type="application/json+oembed" href="{{.OEmbedURL}}" title="{{.Title}}">
+</head>
+<body>
+<h1>{{.Title}}</h1>
+<p>{{.Description}}</p>
+{{- if .CoverURL}}
+<img src="{{.CoverURL}}" width="{{.CoverSize}}" height="{{.CoverSize}}" alt="">
+{{- end}}
+</body>
+</html>
+`))
+
+// RenderPage writes an HTML page containing Open Graph metadata describing info to w.
+func RenderPage(w io.Writer, info Info) error {
+	return pageTmpl.Execute(w, struct {
+		Info
+		Description string
+	}{info, info.description()})
+}
+
+// OEmbed is an oEmbed (https://oembed.com/) response describing a shared item.
+type OEmbed struct {
+	Version         string `json:"version"`
+	Type            string `json:"type"`
+	Title           string `json:"title"`
+	AuthorName      string `json:"author_name,omitempty"`
+	ProviderName    string `json:"provider_name"`
+	ThumbnailURL    string `json:"thumbnail_url,omitempty"`
+	ThumbnailWidth  int    `json:"thumbnail_width,omitempty"`
+	ThumbnailHeight int    `json:"thumbnail_height,omitempty"`
+}
+
+// NewOEmbed returns an oEmbed "link" response describing info.
+func NewOEmbed(info Info) *OEmbed {
+	oe := &OEmbed{
+		Version:      "1.0",
+		Type:         "link",
+		Title:        info.Title,
+		AuthorName:   info.Artist,
+		ProviderName: "nup",
+	}
+	if info.CoverURL != "" {
+		oe.ThumbnailURL = info.CoverURL
+		oe.ThumbnailWidth = info.CoverSize
+		oe.ThumbnailHeight = info.CoverSize
+	}
+	return oe
+}
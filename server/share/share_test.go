@@ -0,0 +1,101 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package share
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTokens(t *testing.T) {
+	const (
+		secret = "secret"
+		gen    = 2
+	)
+	now := time.Date(2023, 5, 1, 12, 0, 0, 0, time.UTC)
+	exp := now.Add(time.Hour)
+	tok := Token(secret, gen, Song, "123", exp)
+	if got, err := checkToken(secret, gen, Song, "123", tok, now); err != nil {
+		t.Errorf("Token %q not valid for song 123: %v", tok, err)
+	} else if !got.Equal(exp) {
+		t.Errorf("Token %q has expiration %v; want %v", tok, got, exp)
+	}
+	for _, tc := range []struct {
+		secret string
+		gen    int
+		kind   Kind
+		id     string
+		token  string
+		now    time.Time
+	}{
+		{"other", gen, Song, "123", tok, now},
+		{"", gen, Song, "123", tok, now},
+		{secret, gen, Album, "123", tok, now},
+		{secret, gen, Song, "124", tok, now},
+		{secret, gen + 1, Song, "123", tok, now},                                // revoked
+		{secret, gen, Song, "123", tok, exp},                                    // expired
+		{secret, gen, Song, "123", Token(secret, gen+1, Song, "123", exp), now}, // future generation
+		{secret, gen, Song, "123", "9" + tok, now},                              // modified expiration
+		{secret, gen, Song, "123", strings.Replace(tok, ".2.", ".3.", 1), now},  // modified generation
+		{secret, gen, Song, "123", tok[strings.Index(tok, ".")+1:], now},        // truncated
+	} {
+		if _, err := checkToken(tc.secret, tc.gen, tc.kind, tc.id, tc.token, tc.now); err == nil {
+			t.Errorf("Token %q unexpectedly valid for %q %v %v %q at %v",
+				tc.token, tc.secret, tc.gen, tc.kind, tc.id, tc.now)
+		}
+	}
+
+	vals := Params(secret, gen, Album, "abc", exp)
+	if kind, id, e, err := ParseParams(secret, gen, vals, now); err != nil {
+		t.Errorf("ParseParams(%q) failed: %v", vals.Encode(), err)
+	} else if kind != Album || id != "abc" || !e.Equal(exp) {
+		t.Errorf("ParseParams(%q) = %v, %q, %v; want %v, %q, %v",
+			vals.Encode(), kind, id, e, Album, "abc", exp)
+	} else if regen := Params(secret, gen, kind, id, e); regen.Encode() != vals.Encode() {
+		t.Errorf("Regenerated params %q don't match original %q", regen.Encode(), vals.Encode())
+	}
+	vals.Set("id", "abd")
+	if _, _, _, err := ParseParams(secret, gen, vals, now); err == nil {
+		t.Errorf("ParseParams(%q) unexpectedly succeeded", vals.Encode())
+	}
+
+	u := "https://example.org" + PagePath + "?" + Params(secret, gen, Song, "5", exp).Encode()
+	if kind, id, _, err := ParsePageURL(secret, gen, u, now); err != nil {
+		t.Errorf("ParsePageURL(%q) failed: %v", u, err)
+	} else if kind != Song || id != "5" {
+		t.Errorf("ParsePageURL(%q) = %v, %q; want %v, %q", u, kind, id, Song, "5")
+	}
+	u = "https://example.org/query?" + Params(secret, gen, Song, "5", exp).Encode()
+	if _, _, _, err := ParsePageURL(secret, gen, u, now); err == nil {
+		t.Errorf("ParsePageURL(%q) unexpectedly succeeded", u)
+	}
+}
+
+func TestRenderPage(t *testing.T) {
+	var b bytes.Buffer
+	if err := RenderPage(&b, Info{
+		Title:     `Song <"Title">`,
+		Artist:    "Artist",
+		Album:     "Album",
+		PageURL:   "https://example.org/share?id=1",
+		CoverURL:  "https://example.org/share_cover?id=1",
+		CoverSize: 400,
+		OEmbedURL: "https://example.org/oembed?url=x",
+	}); err != nil {
+		t.Fatal("RenderPage failed:", err)
+	}
+	page := b.String()
+	for _, want := range []string{
+		`<meta property="og:title" content="Song &lt;&#34;Title&#34;&gt;">`,
+		`<meta property="og:description" content="Artist · Album">`,
+		`<meta property="og:image" content="https://example.org/share_cover?id=1">`,
+		`type="application/json+oembed"`,
+	} {
+		if !strings.Contains(page, want) {
+			t.Errorf("RenderPage output doesn't contain %q:\n%s", want, page)
+		}
+	}
+}
@@ -14,10 +14,10 @@ import (
 	"path/filepath"
 	"regexp"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
-	"github.com/derat/nup/server/config"
 	"github.com/derat/nup/server/storage"
 
 	"google.golang.org/appengine/v2/log"
@@ -34,6 +34,10 @@ const (
 	// App Engine permits 32 MB responses, but we need to reserve a bit of extra space
 	// to make sure we don't go over the limit with headers.
 	maxFileRangeSize = 32*1024*1024 - 32*1024
+
+	// Lifetime of signed song URLs returned when config.Config.SignedSongURLs is set.
+	// URLs only need to remain valid until the client starts reading the object.
+	signedSongURLExpiration = 15 * time.Minute
 )
 
 var (
@@ -42,7 +46,7 @@ var (
 	// avoid reading the same bytes from GCS multiple times. Returning stale objects hopefully isn't
 	// a concern, since clients will probably already have a bad time if a song changes while
 	// they're in the process of playing it.
-	lastSongName    string     // name of object in lastSongData
+	lastSongName    string     // bucket and name of object in lastSongData
 	lastSongData    []byte     // contents of last object from openSong
 	lastSongModTime time.Time  // object's last-modified time
 	lastSongMutex   sync.Mutex // guards other lastSong variables
@@ -99,35 +103,36 @@ func (br *bytesSongReader) Size() int64        { return br.r.Size() }
 
 var _ songReader = (*bytesSongReader)(nil) // verify that interface is implemented
 
-// openSong opens the song at fn (using either Cloud Storage or HTTP).
+// openSong opens the song at fn in st (using either Cloud Storage or HTTP).
 // The returned reader will also implement songReader when reading from Cloud Storage
 // or serving an in-memory song that was previously read from Cloud Storage.
 // os.ErrNotExist is returned if the file is not present.
-func openSong(ctx context.Context, cfg *config.Config, fn string) (io.ReadCloser, error) {
+func openSong(ctx context.Context, st libraryStorage, fn string) (io.ReadCloser, error) {
 	switch {
-	case cfg.SongBucket != "":
+	case st.songBucket != "":
 		// If we already have the song in memory, return it.
-		if b, t := getSongData(fn); b != nil {
-			log.Debugf(ctx, "Using in-memory copy of %q", fn)
+		name := st.songBucket + "/" + fn
+		if b, t := getSongData(name); b != nil {
+			log.Debugf(ctx, "Using in-memory copy of %q", name)
 			return newBytesSongReader(b, fn, t), nil
 		}
-		or, err := storage.NewObjectReader(ctx, cfg.SongBucket, fn)
+		or, err := storage.NewObjectReader(ctx, st.songBucket, fn)
 		if err != nil {
 			return nil, err
 		} else if or.Size() > maxSongMemSize {
 			return or, nil // too big to load into memory
 		}
-		log.Debugf(ctx, "Reading %q into memory", fn)
+		log.Debugf(ctx, "Reading %q into memory", name)
 		defer or.Close()
 		setSongData("", nil, time.Time{}) // clear old buffer
 		b := make([]byte, or.Size())
 		if _, err := io.ReadFull(or, b); err != nil {
 			return nil, err
 		}
-		setSongData(fn, b, or.LastMod())
+		setSongData(name, b, or.LastMod())
 		return newBytesSongReader(b, fn, or.LastMod()), nil
-	case cfg.SongBaseURL != "":
-		u := cfg.SongBaseURL + fn
+	case st.songBaseURL != "":
+		u := st.songBaseURL + fn
 		log.Debugf(ctx, "Opening %v", u)
 		if resp, err := http.Get(u); err != nil {
 			return nil, err
@@ -148,6 +153,8 @@ func openSong(ctx context.Context, cfg *config.Config, fn string) (io.ReadCloser
 // sendSong copies data from r to w, handling range requests and setting any necessary headers.
 // If the request can't be satisfied, writes an HTTP error to w.
 func sendSong(ctx context.Context, req *http.Request, w http.ResponseWriter, r songReader) error {
+	w.Header().Set("Content-Type", songContentType(r.Name()))
+
 	// If the file fits within App Engine's limit, just use http.ServeContent,
 	// which handles range requests and last-modified/conditional stuff.
 	size := r.Size()
@@ -196,7 +203,6 @@ func sendSong(ctx context.Context, req *http.Request, w http.ResponseWriter, r s
 
 	w.Header().Set("Accept-Ranges", "bytes")
 	w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, size))
-	w.Header().Set("Content-Type", "audio/mpeg")
 	w.Header().Set("Last-Modified", r.LastMod().UTC().Format(time.RFC1123))
 	w.WriteHeader(http.StatusPartialContent)
 
@@ -204,6 +210,55 @@ func sendSong(ctx context.Context, req *http.Request, w http.ResponseWriter, r s
 	return err
 }
 
+// songContentType returns the Content-Type to use when sending the song file named fn.
+// Songs are usually MP3s, but lossless files may have been transcoded to Opus by
+// "nup update -upload".
+func songContentType(fn string) string {
+	if strings.ToLower(filepath.Ext(fn)) == ".opus" {
+		return "audio/ogg"
+	}
+	return "audio/mpeg"
+}
+
+// isStreamStart returns true if req requests the beginning of a song's data, i.e. it either has
+// no Range header or requests a range starting at the first byte. Browsers typically send
+// additional range requests while buffering or seeking within a song that's already playing.
+func isStreamStart(req *http.Request) bool {
+	start, _, ok := parseRangeHeader(req.Header.Get("Range"))
+	return ok && start == 0
+}
+
+// countingResponseWriter wraps an http.ResponseWriter and records the response's status code
+// and the number of bytes written to its body.
+type countingResponseWriter struct {
+	http.ResponseWriter
+	code  int   // status code, or 0 if nothing has been written
+	bytes int64 // body bytes written
+}
+
+func (w *countingResponseWriter) WriteHeader(code int) {
+	if w.code == 0 {
+		w.code = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *countingResponseWriter) Write(b []byte) (int, error) {
+	if w.code == 0 {
+		w.code = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// Flush implements http.Flusher.
+func (w *countingResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
 var rangeRegexp = regexp.MustCompile(`^bytes=(\d+)-(\d+)?$`)
 
 // parseRangeHeader parses an HTTP request Range header in the form "bytes=123-" or
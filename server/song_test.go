@@ -3,7 +3,11 @@
 
 package main
 
-import "testing"
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
 
 func TestParseRangeHeader(t *testing.T) {
 	for _, tc := range []struct {
@@ -25,3 +29,50 @@ func TestParseRangeHeader(t *testing.T) {
 		}
 	}
 }
+
+func TestIsStreamStart(t *testing.T) {
+	for _, tc := range []struct {
+		head string
+		want bool
+	}{
+		{"", true},
+		{"bytes=0-", true},
+		{"bytes=0-1023", true},
+		{"bytes=1024-", false},
+		{"bytes=-456", false},
+	} {
+		req := httptest.NewRequest("GET", "/song?filename=foo.mp3", nil)
+		if tc.head != "" {
+			req.Header.Set("Range", tc.head)
+		}
+		if got := isStreamStart(req); got != tc.want {
+			t.Errorf("isStreamStart() with Range %q = %v; want %v", tc.head, got, tc.want)
+		}
+	}
+}
+
+func TestSongContentType(t *testing.T) {
+	for fn, want := range map[string]string{
+		"artist/album/01-song.mp3":  "audio/mpeg",
+		"artist/album/01-song.opus": "audio/ogg",
+		"artist/album/01-song.OPUS": "audio/ogg",
+	} {
+		if got := songContentType(fn); got != want {
+			t.Errorf("songContentType(%q) = %q; want %q", fn, got, want)
+		}
+	}
+}
+
+func TestCountingResponseWriter(t *testing.T) {
+	rec := httptest.NewRecorder()
+	w := &countingResponseWriter{ResponseWriter: rec}
+	w.WriteHeader(http.StatusPartialContent)
+	w.Write([]byte("abc"))
+	w.Write([]byte("de"))
+	if w.code != http.StatusPartialContent || w.bytes != 5 {
+		t.Errorf("Got code %v and %v byte(s); want %v and 5", w.code, w.bytes, http.StatusPartialContent)
+	}
+	if got := rec.Body.String(); got != "abcde" {
+		t.Errorf("Wrote %q; want %q", got, "abcde")
+	}
+}
@@ -0,0 +1,204 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"time"
+)
+
+// MPEG audio versions from bits 19-20 of frame headers.
+const (
+	mpegVersion25 = 0
+	mpegVersion2  = 2
+	mpegVersion1  = 3
+)
+
+// mpegLayer3 is the Layer III value from bits 17-18 of frame headers.
+const mpegLayer3 = 1
+
+var (
+	// Layer III bitrates in kbit/sec indexed by bits 12-15 of frame headers.
+	mpeg1Bitrates = [...]int{0, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320}
+	mpeg2Bitrates = [...]int{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160}
+
+	// Sample rates in Hz indexed by bits 10-11 of frame headers.
+	mpeg1SampleRates  = [...]int{44100, 48000, 32000}
+	mpeg2SampleRates  = [...]int{22050, 24000, 16000}
+	mpeg25SampleRates = [...]int{11025, 12000, 8000}
+)
+
+// parseFrameHeader parses the 4-byte MPEG Layer III frame header in b.
+// The frame's size in bytes (including the header) and its duration in seconds are returned.
+// ok is false if b doesn't contain a valid header.
+func parseFrameHeader(b []byte) (size int, dur float64, ok bool) {
+	if len(b) < 4 || b[0] != 0xff || b[1]&0xe0 != 0xe0 {
+		return 0, 0, false
+	}
+	version := int(b[1]>>3) & 0x3
+	layer := int(b[1]>>1) & 0x3
+	bitrateIdx := int(b[2] >> 4)
+	rateIdx := int(b[2]>>2) & 0x3
+	padding := int(b[2]>>1) & 0x1
+	if layer != mpegLayer3 || bitrateIdx == 0 || bitrateIdx == 0xf || rateIdx == 3 {
+		return 0, 0, false
+	}
+
+	var bitrate, rate, samples int
+	switch version {
+	case mpegVersion1:
+		bitrate, rate, samples = mpeg1Bitrates[bitrateIdx], mpeg1SampleRates[rateIdx], 1152
+	case mpegVersion2:
+		bitrate, rate, samples = mpeg2Bitrates[bitrateIdx], mpeg2SampleRates[rateIdx], 576
+	case mpegVersion25:
+		bitrate, rate, samples = mpeg2Bitrates[bitrateIdx], mpeg25SampleRates[rateIdx], 576
+	default:
+		return 0, 0, false
+	}
+	size = samples/8*bitrate*1000/rate + padding
+	return size, float64(samples) / float64(rate), true
+}
+
+// walkFrames reads the MP3 data in r and calls fn with the byte offset, size, starting time,
+// and duration (in seconds) of each MPEG audio frame. If fn returns false, walkFrames stops.
+// A leading ID3v2 tag is skipped, and the audio data is assumed to end at the first invalid
+// frame header (e.g. an ID3v1 tag). The offset and time of the end of the last-visited
+// frame are returned.
+func walkFrames(r io.Reader, fn func(off int64, size int, pos, dur float64) bool) (
+	end int64, endPos float64, err error) {
+	br := bufio.NewReader(r)
+	var off int64
+	if head, err := br.Peek(10); err == nil && string(head[:3]) == "ID3" {
+		size := 10 + (int64(head[6]&0x7f)<<21 | int64(head[7]&0x7f)<<14 |
+			int64(head[8]&0x7f)<<7 | int64(head[9]&0x7f))
+		if head[5]&0x10 != 0 {
+			size += 10 // footer
+		}
+		if _, err := br.Discard(int(size)); err != nil {
+			return 0, 0, fmt.Errorf("skipping ID3v2 tag: %v", err)
+		}
+		off = size
+	}
+
+	var pos float64 // starting time of current frame
+	for {
+		head, _ := br.Peek(4)
+		size, dur, ok := parseFrameHeader(head)
+		if !ok || !fn(off, size, pos, dur) {
+			break
+		}
+		if n, _ := br.Discard(size); n < size {
+			break // truncated frame
+		}
+		off += int64(size)
+		pos += dur
+	}
+	return off, pos, nil
+}
+
+// findAudioRange returns the byte offsets within the MP3 data in r of the frames
+// spanning start to end (in seconds). The end offset is exclusive. Frames are split
+// at the boundaries nearest to the requested times.
+func findAudioRange(r io.Reader, start, end float64) (startOff, endOff int64, err error) {
+	startOff, endOff = -1, -1
+	last, lastPos, err := walkFrames(r, func(off int64, size int, pos, dur float64) bool {
+		mid := pos + dur/2
+		if startOff < 0 && mid >= start {
+			startOff = off
+		}
+		if startOff >= 0 && mid >= end {
+			endOff = off
+			return false
+		}
+		return true
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	if startOff < 0 {
+		return 0, 0, fmt.Errorf("start %.3f is past end of audio at %.3f", start, lastPos)
+	}
+	if endOff < 0 {
+		endOff = last
+	}
+	return startOff, endOff, nil
+}
+
+// sectionSongReader wraps a songReader and only exposes a range of its bytes.
+type sectionSongReader struct {
+	songReader
+	start int64 // starting offset in underlying reader
+	size  int64 // size of section
+	pos   int64 // current position relative to start
+}
+
+func newSectionSongReader(r songReader, start, size int64) (*sectionSongReader, error) {
+	if _, err := r.Seek(start, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return &sectionSongReader{songReader: r, start: start, size: size}, nil
+}
+
+func (sr *sectionSongReader) Read(b []byte) (int, error) {
+	if sr.pos >= sr.size {
+		return 0, io.EOF
+	}
+	if rem := sr.size - sr.pos; int64(len(b)) > rem {
+		b = b[:rem]
+	}
+	n, err := sr.songReader.Read(b)
+	sr.pos += int64(n)
+	return n, err
+}
+
+func (sr *sectionSongReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += sr.pos
+	case io.SeekEnd:
+		offset += sr.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	if _, err := sr.songReader.Seek(sr.start+offset, io.SeekStart); err != nil {
+		return 0, err
+	}
+	sr.pos = offset
+	return offset, nil
+}
+
+func (sr *sectionSongReader) Size() int64 { return sr.size }
+
+var _ songReader = (*sectionSongReader)(nil) // verify that interface is implemented
+
+// splitSong returns a songReader containing the frames of the MP3 data in r
+// spanning start to end (in seconds). This is used to serve songs synthesized from
+// cue sheet tracks. Since MP3 frames can depend on data from earlier frames, there may
+// be a brief glitch at the beginning of the returned audio.
+// r is consumed and should still be closed by the caller.
+func splitSong(r io.Reader, name string, start, end float64) (songReader, error) {
+	sr, ok := r.(songReader)
+	if !ok {
+		// Just read the whole file into memory if we're getting it over HTTP rather than
+		// from GCS. This is only used by tests.
+		b, err := ioutil.ReadAll(r)
+		if err != nil {
+			return nil, err
+		}
+		sr = newBytesSongReader(b, name, time.Time{})
+	}
+	startOff, endOff, err := findAudioRange(sr, start, end)
+	if err != nil {
+		return nil, err
+	}
+	return newSectionSongReader(sr, startOff, endOff-startOff)
+}
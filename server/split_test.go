@@ -0,0 +1,120 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+const (
+	testFrameSize = 417                 // 128 kbps MPEG-1 Layer III frame at 44.1 kHz
+	testFrameDur  = 1152.0 / 44100      // duration of a single frame in seconds
+	testTagSize   = 20                  // size of ID3v2 tag in makeTestMP3
+	testTrailer   = "TAG ID3v1 trailer" // appended after frames by makeTestMP3
+)
+
+// makeTestMP3 returns MP3 data containing a short ID3v2 tag followed by n frames
+// and a fake ID3v1 tag. Each frame's data after its header is filled with its index.
+func makeTestMP3(n int) []byte {
+	b := append([]byte("ID3\x04\x00\x00\x00\x00\x00\x0a"), make([]byte, testTagSize-10)...)
+	for i := 0; i < n; i++ {
+		b = append(b, 0xff, 0xfb, 0x90, 0x00)
+		b = append(b, bytes.Repeat([]byte{byte(i)}, testFrameSize-4)...)
+	}
+	return append(b, testTrailer...)
+}
+
+func TestParseFrameHeader(t *testing.T) {
+	for _, tc := range []struct {
+		head string
+		size int
+		dur  float64
+		ok   bool
+	}{
+		{"\xff\xfb\x90\x00", 417, 1152.0 / 44100, true}, // MPEG-1, 128 kbps, 44.1 kHz
+		{"\xff\xfb\x92\x00", 418, 1152.0 / 44100, true}, // padded
+		{"\xff\xfb\xe4\x00", 960, 1152.0 / 48000, true}, // MPEG-1, 320 kbps, 48 kHz
+		{"\xff\xf3\x80\x00", 208, 576.0 / 22050, true},  // MPEG-2, 64 kbps, 22.05 kHz
+		{"\xff\xe3\x80\x00", 417, 576.0 / 11025, true},  // MPEG-2.5, 64 kbps, 11.025 kHz
+		{"\xff\xfd\x90\x00", 0, 0, false},               // Layer II
+		{"\xff\xfb\xf0\x00", 0, 0, false},               // bad bitrate
+		{"\xff\xfb\x9c\x00", 0, 0, false},               // bad sample rate
+		{"TAG\x00", 0, 0, false},                        // ID3v1 tag
+		{"\xff\xfb", 0, 0, false},                       // truncated
+	} {
+		size, dur, ok := parseFrameHeader([]byte(tc.head))
+		if size != tc.size || dur != tc.dur || ok != tc.ok {
+			t.Errorf("parseFrameHeader(%q) = (%v, %v, %v); want (%v, %v, %v)",
+				tc.head, size, dur, ok, tc.size, tc.dur, tc.ok)
+		}
+	}
+}
+
+func TestFindAudioRange(t *testing.T) {
+	const numFrames = 100
+	data := makeTestMP3(numFrames)
+	frameOff := func(i int) int64 { return int64(testTagSize + i*testFrameSize) }
+
+	for _, tc := range []struct {
+		start, end float64
+		startFrame int
+		endFrame   int
+	}{
+		{0, 10, 0, numFrames},
+		{0, 0.5, 0, 19},
+		{0.5, 1.0, 19, 38},
+		{20 * testFrameDur, 30 * testFrameDur, 20, 30},
+		{2.0, 10, 77, numFrames},
+	} {
+		start, end, err := findAudioRange(bytes.NewReader(data), tc.start, tc.end)
+		if err != nil {
+			t.Errorf("findAudioRange(..., %v, %v) failed: %v", tc.start, tc.end, err)
+		} else if start != frameOff(tc.startFrame) || end != frameOff(tc.endFrame) {
+			t.Errorf("findAudioRange(..., %v, %v) = (%v, %v); want (%v, %v)", tc.start, tc.end,
+				start, end, frameOff(tc.startFrame), frameOff(tc.endFrame))
+		}
+	}
+
+	if _, _, err := findAudioRange(bytes.NewReader(data), 10, 20); err == nil {
+		t.Error("findAudioRange unexpectedly succeeded for range past end")
+	}
+}
+
+func TestSplitSong(t *testing.T) {
+	data := makeTestMP3(100)
+	for _, r := range []io.Reader{
+		newBytesSongReader(data, "song.mp3", time.Time{}),
+		bytes.NewReader(data), // not a songReader
+	} {
+		sr, err := splitSong(r, "song.mp3", 10*testFrameDur, 12*testFrameDur)
+		if err != nil {
+			t.Fatal("splitSong failed:", err)
+		}
+		want := data[testTagSize+10*testFrameSize : testTagSize+12*testFrameSize]
+		if sr.Size() != int64(len(want)) {
+			t.Errorf("Size() = %v; want %v", sr.Size(), len(want))
+		}
+		if got, err := ioutil.ReadAll(sr); err != nil {
+			t.Error("Reading split song failed:", err)
+		} else if !bytes.Equal(got, want) {
+			t.Errorf("Split song has %v byte(s) starting with %q; want %v starting with %q",
+				len(got), got[:8], len(want), want[:8])
+		}
+
+		// Seeking should be relative to the start of the section.
+		if pos, err := sr.Seek(-4, io.SeekEnd); err != nil {
+			t.Error("Seek failed:", err)
+		} else if pos != int64(len(want)-4) {
+			t.Errorf("Seek returned %v; want %v", pos, len(want)-4)
+		} else if got, err := ioutil.ReadAll(sr); err != nil {
+			t.Error("Reading after seek failed:", err)
+		} else if !bytes.Equal(got, want[len(want)-4:]) {
+			t.Errorf("Read %q after seek; want %q", got, want[len(want)-4:])
+		}
+	}
+}
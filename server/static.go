@@ -6,10 +6,14 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
 
@@ -270,3 +274,100 @@ func buildBundle() (js, sourceMap []byte, err error) {
 
 	return esbuild.Bundle(td, []string{bundleEntryPoint}, bundleFile, true /* minify */)
 }
+
+// precacheExts contains the extensions of static files that are listed in the precache manifest.
+var precacheExts = map[string]bool{
+	".css":   true,
+	".html":  true,
+	".ico":   true,
+	".js":    true,
+	".json":  true,
+	".png":   true,
+	".svg":   true,
+	".ts":    true,
+	".woff":  true,
+	".woff2": true,
+}
+
+// precacheSkipFiles contains static files that aren't needed by the web client.
+var precacheSkipFiles = map[string]bool{
+	"fontello-config.json": true,
+	"global.d.ts":          true,
+}
+
+// precacheAsset describes a single file in a precacheManifest.
+type precacheAsset struct {
+	URL  string `json:"url"`  // absolute request path, e.g. "/bundle.js"
+	Hash string `json:"hash"` // hex-encoded SHA-1 hash of the file's content
+}
+
+// precacheManifest lists the static files that the web client's service worker should
+// cache so that the interface can be loaded while offline.
+type precacheManifest struct {
+	// Version is a hash of Assets that changes whenever any file changes.
+	Version string          `json:"version"`
+	Assets  []precacheAsset `json:"assets"`
+}
+
+// precacheManifests maps from a bool minify arg passed to getPrecacheManifest
+// to the previously-generated *precacheManifest.
+var precacheManifests sync.Map
+
+// getPrecacheManifest returns a manifest listing the static files served to the web client.
+// If minify is true, bundleFile is listed instead of individual JS files.
+func getPrecacheManifest(minify bool) (*precacheManifest, error) {
+	if m, ok := precacheManifests.Load(minify); ok {
+		return m.(*precacheManifest), nil
+	}
+
+	fis, err := ioutil.ReadDir(staticDir)
+	if err != nil {
+		return nil, err
+	}
+	var paths []string
+	for _, fi := range fis {
+		p := fi.Name()
+		ext := filepath.Ext(p)
+		if fi.IsDir() || !precacheExts[ext] || precacheSkipFiles[p] {
+			continue
+		}
+		if ext == ".ts" {
+			// TypeScript files are served as transpiled JS or bundled.
+			if minify {
+				continue
+			}
+			p = replaceSuffix(p, ".ts", ".js")
+		}
+		paths = append(paths, p)
+	}
+	if minify {
+		paths = append(paths, bundleFile)
+	}
+	sort.Strings(paths)
+
+	m := &precacheManifest{Assets: make([]precacheAsset, 0, len(paths))}
+	all := sha1.New()
+	for _, p := range paths {
+		b, err := getStaticFile(p, minify)
+		if err != nil {
+			return nil, fmt.Errorf("%v: %v", p, err)
+		}
+		u := "/" + p
+		if p == indexFile {
+			u = "/"
+		}
+		asset := precacheAsset{URL: u, Hash: hashStaticFile(b)}
+		m.Assets = append(m.Assets, asset)
+		io.WriteString(all, asset.URL+" "+asset.Hash+"\n")
+	}
+	m.Version = hex.EncodeToString(all.Sum(nil))
+
+	precacheManifests.Store(minify, m)
+	return m, nil
+}
+
+// hashStaticFile returns a hex-encoded SHA-1 hash of b, the contents of a static file.
+func hashStaticFile(b []byte) string {
+	sum := sha1.Sum(b)
+	return hex.EncodeToString(sum[:])
+}
@@ -12,9 +12,9 @@ import (
 	"golang.org/x/net/html"
 )
 
-// callGetStaticFile moves to the repository root, calls getStaticFile,
-// and moves back to the original directory before returning the result.
-func callGetStaticFile(t *testing.T, p string, minify bool) []byte {
+// inRepoRoot moves to the repository root, calls fn,
+// and moves back to the original directory before returning.
+func inRepoRoot(t *testing.T, fn func()) {
 	dir, err := os.Getwd()
 	if err != nil {
 		t.Fatal(err)
@@ -27,11 +27,18 @@ func callGetStaticFile(t *testing.T, p string, minify bool) []byte {
 			t.Fatal(err)
 		}
 	}()
+	fn()
+}
 
-	b, err := getStaticFile(p, minify)
-	if err != nil {
-		t.Fatalf("getStaticFile(%q, %v) failed: %v", p, minify, err)
-	}
+// callGetStaticFile calls getStaticFile from the repository root and returns the result.
+func callGetStaticFile(t *testing.T, p string, minify bool) []byte {
+	var b []byte
+	inRepoRoot(t, func() {
+		var err error
+		if b, err = getStaticFile(p, minify); err != nil {
+			t.Fatalf("getStaticFile(%q, %v) failed: %v", p, minify, err)
+		}
+	})
 	return b
 }
 
@@ -87,6 +94,44 @@ func TestGetStaticFile_Transform(t *testing.T) {
 	}
 }
 
+func TestGetPrecacheManifest(t *testing.T) {
+	for _, minify := range []bool{true, false} {
+		var m *precacheManifest
+		inRepoRoot(t, func() {
+			var err error
+			if m, err = getPrecacheManifest(minify); err != nil {
+				t.Fatalf("getPrecacheManifest(%v) failed: %v", minify, err)
+			}
+		})
+		urls := make(map[string]string, len(m.Assets))
+		for _, a := range m.Assets {
+			urls[a.URL] = a.Hash
+		}
+		index := "/" + replaceSuffix(bundleEntryPoint, ".ts", ".js")
+		for u, want := range map[string]bool{
+			"/":                     true,
+			"/" + indexFile:         false,
+			"/" + bundleFile:        minify,
+			index:                   !minify,
+			"/" + commonFn:          !minify,
+			"/manifest.json":        true,
+			"/fontello-config.json": false,
+			"/global.d.js":          false,
+		} {
+			if _, got := urls[u]; got != want {
+				t.Errorf("getPrecacheManifest(%v) includes %v: %v; want %v", minify, u, got, want)
+			}
+		}
+		want := hashStaticFile(callGetStaticFile(t, indexFile, minify))
+		if got := urls["/"]; got != want {
+			t.Errorf("getPrecacheManifest(%v) has hash %q for /; want %q", minify, got, want)
+		}
+		if m.Version == "" {
+			t.Errorf("getPrecacheManifest(%v) has empty version", minify)
+		}
+	}
+}
+
 func TestMinifyAndTransformData(t *testing.T) {
 	for _, tc := range []struct {
 		in, ctype, want string
@@ -0,0 +1,154 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package stats
+
+import (
+	"context"
+	"sort"
+	"strconv"
+
+	"github.com/derat/nup/server/cache"
+	"github.com/derat/nup/server/db"
+
+	"google.golang.org/appengine/v2/datastore"
+	"google.golang.org/appengine/v2/log"
+)
+
+// incompleteAlbumsKey returns the key for the list of db.IncompleteAlbum structs in datastore.
+func incompleteAlbumsKey(ctx context.Context) *datastore.Key {
+	return datastore.NewKey(ctx, db.IncompleteAlbumsKind, db.IncompleteAlbumsKeyName, 0, nil)
+}
+
+// cachedAlbums wraps a list of db.IncompleteAlbum structs and implements
+// datastore.PropertyLoadSaver.
+type cachedAlbums struct{ Albums []db.IncompleteAlbum }
+
+func (a *cachedAlbums) Load(props []datastore.Property) error {
+	return cache.LoadJSONProp(props, a)
+}
+func (a *cachedAlbums) Save() ([]datastore.Property, error) {
+	return cache.SaveJSONProp(a)
+}
+
+// IncompleteAlbums returns the albums that were found to be missing tracks by
+// the last call to Update. An empty list is returned if Update hasn't been called.
+func IncompleteAlbums(ctx context.Context) ([]db.IncompleteAlbum, error) {
+	var albums cachedAlbums
+	if ok, err := cache.GetMemcache(ctx, db.IncompleteAlbumsKeyName, &albums); err != nil {
+		log.Errorf(ctx, "Failed getting incomplete albums from memcache: %v", err)
+	} else if ok {
+		return albums.Albums, nil
+	}
+	if err := datastore.Get(ctx, incompleteAlbumsKey(ctx), &albums); err == datastore.ErrNoSuchEntity {
+		return []db.IncompleteAlbum{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := cache.SetMemcache(ctx, db.IncompleteAlbumsKeyName, &albums); err != nil {
+		log.Errorf(ctx, "Failed saving incomplete albums to memcache: %v", err)
+	}
+	return albums.Albums, nil
+}
+
+// saveIncompleteAlbums saves albums to datastore and clears the memcache copy.
+func saveIncompleteAlbums(ctx context.Context, albums []db.IncompleteAlbum) error {
+	if err := cache.DeleteMemcache(ctx, db.IncompleteAlbumsKeyName); err != nil {
+		log.Errorf(ctx, "Failed deleting incomplete albums from memcache: %v", err)
+	}
+	_, err := datastore.Put(ctx, incompleteAlbumsKey(ctx), &cachedAlbums{albums})
+	return err
+}
+
+// albumSong contains album-related fields from a single song.
+type albumSong struct {
+	albumID     string
+	library     string
+	disc, track int
+	totalTracks int
+	totalDiscs  int
+}
+
+// findIncompleteAlbums returns the albums in songs (keyed by song ID) that are missing tracks.
+// Albums are skipped if none of their songs have TotalTracks values. Songs with a zero disc
+// number are treated as being on the first disc. Albums are sorted by ID.
+func findIncompleteAlbums(songs map[int64]*albumSong) []db.IncompleteAlbum {
+	type discInfo struct {
+		tracks      map[int]struct{} // track numbers present on the disc
+		totalTracks int              // expected number of tracks
+	}
+	type albumInfo struct {
+		songIDs    []int64
+		library    string
+		discs      map[int]*discInfo
+		totalDiscs int
+		hasTotals  bool // at least one song has a TotalTracks value
+	}
+
+	albums := make(map[string]*albumInfo)
+	for id, s := range songs {
+		if s.albumID == "" {
+			continue
+		}
+		ai := albums[s.albumID]
+		if ai == nil {
+			ai = &albumInfo{discs: make(map[int]*discInfo)}
+			albums[s.albumID] = ai
+		}
+		ai.songIDs = append(ai.songIDs, id)
+		if s.library != "" {
+			ai.library = s.library
+		}
+
+		disc := s.disc
+		if disc <= 0 {
+			disc = 1
+		}
+		di := ai.discs[disc]
+		if di == nil {
+			di = &discInfo{tracks: make(map[int]struct{})}
+			ai.discs[disc] = di
+		}
+		di.tracks[s.track] = struct{}{}
+		if s.totalTracks > di.totalTracks {
+			di.totalTracks = s.totalTracks
+		}
+		if s.totalTracks > 0 {
+			ai.hasTotals = true
+		}
+		if s.totalDiscs > ai.totalDiscs {
+			ai.totalDiscs = s.totalDiscs
+		}
+		if disc > ai.totalDiscs {
+			ai.totalDiscs = disc
+		}
+	}
+
+	res := make([]db.IncompleteAlbum, 0)
+	for albumID, ai := range albums {
+		if !ai.hasTotals {
+			continue
+		}
+		var missing []string
+		for disc := 1; disc <= ai.totalDiscs; disc++ {
+			di := ai.discs[disc]
+			if di == nil {
+				missing = append(missing, strconv.Itoa(disc))
+				continue
+			}
+			for track := 1; track <= di.totalTracks; track++ {
+				if _, ok := di.tracks[track]; !ok {
+					missing = append(missing, strconv.Itoa(disc)+"-"+strconv.Itoa(track))
+				}
+			}
+		}
+		if len(missing) == 0 {
+			continue
+		}
+		sort.Slice(ai.songIDs, func(i, j int) bool { return ai.songIDs[i] < ai.songIDs[j] })
+		res = append(res, db.IncompleteAlbum{AlbumID: albumID, Library: ai.library,
+			SongIDs: ai.songIDs, Missing: missing})
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].AlbumID < res[j].AlbumID })
+	return res
+}
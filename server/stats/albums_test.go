@@ -0,0 +1,36 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package stats
+
+import (
+	"testing"
+
+	"github.com/derat/nup/server/db"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestFindIncompleteAlbums(t *testing.T) {
+	songs := map[int64]*albumSong{
+		// Complete single-disc album.
+		1: {albumID: "complete", disc: 1, track: 1, totalTracks: 2, totalDiscs: 1},
+		2: {albumID: "complete", disc: 1, track: 2, totalTracks: 2, totalDiscs: 1},
+		// Single-disc album missing its second track. The disc number is unset.
+		3: {albumID: "missing-track", track: 1, totalTracks: 3},
+		4: {albumID: "missing-track", track: 3, totalTracks: 3},
+		// Two-disc album missing its first disc.
+		5: {albumID: "missing-disc", library: "other", disc: 2, track: 1, totalTracks: 1, totalDiscs: 2},
+		// Album without any track counts.
+		6: {albumID: "unknown", disc: 1, track: 5},
+		// Song without an album.
+		7: {track: 1, totalTracks: 10},
+	}
+	got := findIncompleteAlbums(songs)
+	want := []db.IncompleteAlbum{
+		{AlbumID: "missing-disc", Library: "other", SongIDs: []int64{5}, Missing: []string{"1"}},
+		{AlbumID: "missing-track", SongIDs: []int64{3, 4}, Missing: []string{"1-2"}},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Error("findIncompleteAlbums returned bad results:\n" + diff)
+	}
+}
@@ -0,0 +1,98 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package stats
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/derat/nup/server/db"
+
+	"google.golang.org/appengine/v2/datastore"
+)
+
+const (
+	changesKind = "Changes" // datastore kind for changeCounts entities
+	monthLayout = "2006-01" // time layout for keys in db.Stats.Months
+)
+
+// changeCounts counts changes made to songs' user data in a single month.
+// changeCounts entities are keyed by the month formatted using monthLayout.
+// These counts can't be derived from Song entities, so they're maintained
+// by RecordChanges as changes are made.
+type changeCounts struct {
+	Retagged int `datastore:",noindex"`
+	Rerated  int `datastore:",noindex"`
+}
+
+// monthKey returns the key used in db.Stats.Months for the month containing t.
+func monthKey(t time.Time) string { return t.Local().Format(monthLayout) }
+
+// RecordChanges increments the number of songs whose ratings and tags were changed
+// in the month containing t.
+func RecordChanges(ctx context.Context, t time.Time, rerated, retagged bool) error {
+	if !rerated && !retagged {
+		return nil
+	}
+	return datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+		key := datastore.NewKey(ctx, changesKind, monthKey(t), 0, nil)
+		var counts changeCounts
+		if err := datastore.Get(ctx, key, &counts); err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		if rerated {
+			counts.Rerated++
+		}
+		if retagged {
+			counts.Retagged++
+		}
+		_, err := datastore.Put(ctx, key, &counts)
+		return err
+	}, nil)
+}
+
+// addChanges adds previously-recorded changes to stats.Months.
+func addChanges(ctx context.Context, stats *db.Stats) error {
+	var counts []changeCounts
+	keys, err := datastore.NewQuery(changesKind).GetAll(ctx, &counts)
+	if err != nil {
+		return fmt.Errorf("failed reading %v: %v", changesKind, err)
+	}
+	for i, key := range keys {
+		ms := stats.Months[key.StringID()]
+		ms.Retagged += counts[i].Retagged
+		ms.Rerated += counts[i].Rerated
+		stats.Months[key.StringID()] = ms
+	}
+	return nil
+}
+
+// addDeletions adds the number of deleted songs to stats.Months.
+func addDeletions(ctx context.Context, stats *db.Stats) error {
+	it := datastore.NewQuery(db.DeletedSongKind).Project("LastModifiedTime").Run(ctx)
+	for {
+		var s db.Song
+		if _, err := it.Next(&s); err == datastore.Done {
+			break
+		} else if err != nil {
+			return fmt.Errorf("failed reading %v.LastModifiedTime: %v", db.DeletedSongKind, err)
+		}
+		month := monthKey(s.LastModifiedTime)
+		ms := stats.Months[month]
+		ms.Deleted++
+		stats.Months[month] = ms
+	}
+	return nil
+}
+
+// clearChanges deletes all changeCounts entities from datastore.
+func clearChanges(ctx context.Context) error {
+	if keys, err := datastore.NewQuery(changesKind).KeysOnly().GetAll(ctx, nil); err != nil {
+		return fmt.Errorf("getting %v keys failed: %v", changesKind, err)
+	} else if err := datastore.DeleteMulti(ctx, keys); err != nil {
+		return fmt.Errorf("deleting all %v entities failed: %v", changesKind, err)
+	}
+	return nil
+}
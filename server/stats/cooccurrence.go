@@ -0,0 +1,79 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package stats
+
+import (
+	"context"
+
+	"github.com/derat/nup/server/cache"
+	"github.com/derat/nup/server/db"
+
+	"google.golang.org/appengine/v2/datastore"
+	"google.golang.org/appengine/v2/log"
+)
+
+// tagCooccurrenceKey returns the key for tag co-occurrence counts in datastore.
+func tagCooccurrenceKey(ctx context.Context) *datastore.Key {
+	return datastore.NewKey(ctx, db.TagCooccurrenceKind, db.TagCooccurrenceKeyName, 0, nil)
+}
+
+// cachedCooccurrence wraps tag co-occurrence counts and implements datastore.PropertyLoadSaver.
+type cachedCooccurrence struct{ Counts map[string]map[string]int }
+
+func (c *cachedCooccurrence) Load(props []datastore.Property) error {
+	return cache.LoadJSONProp(props, c)
+}
+func (c *cachedCooccurrence) Save() ([]datastore.Property, error) {
+	return cache.SaveJSONProp(c)
+}
+
+// TagCooccurrence returns the number of songs that had each pair of tags as of the last call
+// to Update. The returned map is keyed by both tags, so counts[a][b] equals counts[b][a], and
+// counts[a][a] contains the number of songs with a. An empty map is returned if Update hasn't
+// been called.
+func TagCooccurrence(ctx context.Context) (map[string]map[string]int, error) {
+	var c cachedCooccurrence
+	if ok, err := cache.GetMemcache(ctx, db.TagCooccurrenceKeyName, &c); err != nil {
+		log.Errorf(ctx, "Failed getting tag co-occurrence from memcache: %v", err)
+	} else if ok {
+		return c.Counts, nil
+	}
+	if err := datastore.Get(ctx, tagCooccurrenceKey(ctx), &c); err == datastore.ErrNoSuchEntity {
+		return map[string]map[string]int{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := cache.SetMemcache(ctx, db.TagCooccurrenceKeyName, &c); err != nil {
+		log.Errorf(ctx, "Failed saving tag co-occurrence to memcache: %v", err)
+	}
+	return c.Counts, nil
+}
+
+// saveTagCooccurrence saves counts to datastore and clears the memcache copy.
+func saveTagCooccurrence(ctx context.Context, counts map[string]map[string]int) error {
+	if err := cache.DeleteMemcache(ctx, db.TagCooccurrenceKeyName); err != nil {
+		log.Errorf(ctx, "Failed deleting tag co-occurrence from memcache: %v", err)
+	}
+	_, err := datastore.Put(ctx, tagCooccurrenceKey(ctx), &cachedCooccurrence{counts})
+	return err
+}
+
+// countTagCooccurrence counts the songs with each pair of tags in songTags,
+// which is keyed by song ID. See TagCooccurrence.
+func countTagCooccurrence(songTags map[int64][]string) map[string]map[string]int {
+	counts := make(map[string]map[string]int)
+	for _, tags := range songTags {
+		for _, a := range tags {
+			m := counts[a]
+			if m == nil {
+				m = make(map[string]int)
+				counts[a] = m
+			}
+			for _, b := range tags {
+				m[b]++
+			}
+		}
+	}
+	return counts
+}
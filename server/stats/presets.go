@@ -0,0 +1,78 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package stats
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/derat/nup/server/db"
+
+	"google.golang.org/appengine/v2/datastore"
+)
+
+const presetUsesKind = "PresetUses" // datastore kind for presetUses entities
+
+// presetUses counts a single user's queries using a single search preset.
+// presetUses entities are keyed by presetUsesKey. Like transferCounts, these
+// are maintained by RecordPresetUse as requests are handled.
+type presetUses struct {
+	User     string    `datastore:",noindex"`
+	Preset   string    `datastore:",noindex"`
+	Count    int       `datastore:",noindex"`
+	LastTime time.Time `datastore:",noindex"`
+}
+
+// presetUsesKey returns the key name of the presetUses entity for user and preset.
+func presetUsesKey(user, preset string) string {
+	return strconv.Quote(user) + ":" + strconv.Quote(preset)
+}
+
+// RecordPresetUse records a query by user at time t using the search preset named preset.
+func RecordPresetUse(ctx context.Context, user, preset string, t time.Time) error {
+	return datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+		key := datastore.NewKey(ctx, presetUsesKind, presetUsesKey(user, preset), 0, nil)
+		var uses presetUses
+		if err := datastore.Get(ctx, key, &uses); err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		uses.User = user
+		uses.Preset = preset
+		uses.Count++
+		if t.After(uses.LastTime) {
+			uses.LastTime = t
+		}
+		_, err := datastore.Put(ctx, key, &uses)
+		return err
+	}, nil)
+}
+
+// addPresetUses adds previously-recorded preset uses to stats.PresetUses.
+func addPresetUses(ctx context.Context, stats *db.Stats) error {
+	var uses []presetUses
+	if _, err := datastore.NewQuery(presetUsesKind).GetAll(ctx, &uses); err != nil {
+		return fmt.Errorf("failed reading %v: %v", presetUsesKind, err)
+	}
+	for _, u := range uses {
+		m := stats.PresetUses[u.User]
+		if m == nil {
+			m = make(map[string]db.PresetStats)
+			stats.PresetUses[u.User] = m
+		}
+		m[u.Preset] = db.PresetStats{Queries: u.Count, LastTime: u.LastTime}
+	}
+	return nil
+}
+
+// clearPresetUses deletes all presetUses entities from datastore.
+func clearPresetUses(ctx context.Context) error {
+	if keys, err := datastore.NewQuery(presetUsesKind).KeysOnly().GetAll(ctx, nil); err != nil {
+		return fmt.Errorf("getting %v keys failed: %v", presetUsesKind, err)
+	} else if err := datastore.DeleteMulti(ctx, keys); err != nil {
+		return fmt.Errorf("deleting all %v entities failed: %v", presetUsesKind, err)
+	}
+	return nil
+}
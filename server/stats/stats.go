@@ -10,6 +10,7 @@ import (
 
 	"github.com/derat/nup/server/cache"
 	"github.com/derat/nup/server/db"
+	"github.com/derat/nup/server/migrate"
 
 	"google.golang.org/appengine/v2/datastore"
 	"google.golang.org/appengine/v2/log"
@@ -53,7 +54,9 @@ func Get(ctx context.Context) (*db.Stats, error) {
 	return &stats, nil
 }
 
-// Update reads all songs and plays and saves stats to datastore.
+// Update reads all songs, plays, deleted songs, and recorded changes, transfers, and preset
+// uses and saves stats to datastore. Transitions recorded by RecordTransition are also
+// aggregated for TransitionCounts.
 //
 // This uses projection queries, which are counted as "small" datastore operations
 // and are free in most (all?) regions, but it's still slow and should be called
@@ -65,6 +68,29 @@ func Update(ctx context.Context) error {
 	songLengths := make(map[int64]float64) // keys are song IDs
 	firstPlays := make(map[int]int)        // keys are years
 	lastPlays := make(map[int]int)         // keys are years
+	added := make(map[string]int)          // keys are months
+
+	// Album-related fields from each song, keyed by song ID. These are used to find
+	// incomplete albums. Each query writes to its own map to avoid locking.
+	albumIDs := make(map[int64]string)
+	libraries := make(map[int64]string)
+	discs := make(map[int64]int)
+	tracks := make(map[int64]int)
+	totalTracks := make(map[int64]int)
+	totalDiscs := make(map[int64]int)
+
+	// Normalized names from each song, keyed by song ID. These are used to find top artists
+	// and albums.
+	artistLowers := make(map[int64]string)
+	albumLowers := make(map[int64]string)
+
+	// Dates from each song, keyed by song ID. Songs are counted in SongDecades using their
+	// original release dates when available so that reissues are counted in the right decade.
+	dates := make(map[int64]time.Time)
+	origDates := make(map[int64]time.Time)
+
+	// Tags from each song, keyed by song ID. These are used to count tag co-occurrence.
+	songTags := make(map[int64][]string)
 
 	// Datastore doesn't seem to return any results when trying to project all of these properties
 	// at once (probably because Tags is array-valued), and including multiple properties also
@@ -78,8 +104,35 @@ func Update(ctx context.Context) error {
 		{"AlbumId", true, func(id int64, s *db.Song) {
 			stats.Albums++
 		}},
+		{"AlbumId", false, func(id int64, s *db.Song) {
+			albumIDs[id] = s.AlbumID
+		}},
+		{"AlbumLower", false, func(id int64, s *db.Song) {
+			albumLowers[id] = s.AlbumLower
+		}},
+		{"ArtistLower", false, func(id int64, s *db.Song) {
+			artistLowers[id] = s.ArtistLower
+		}},
+		{"BPM", false, func(id int64, s *db.Song) {
+			if s.BPM > 0 {
+				stats.BPMs[int(s.BPM)/10*10]++
+			}
+		}},
+		{"CreatedTime", false, func(id int64, s *db.Song) {
+			if !s.CreatedTime.IsZero() {
+				added[monthKey(s.CreatedTime)]++
+			}
+		}},
+		{"Disc", false, func(id int64, s *db.Song) {
+			discs[id] = s.Disc
+		}},
 		{"Date", false, func(id int64, s *db.Song) {
-			stats.SongDecades[s.Date.Year()/10*10]++
+			dates[id] = s.Date
+		}},
+		{"OriginalDate", false, func(id int64, s *db.Song) {
+			if !s.OriginalDate.IsZero() {
+				origDates[id] = s.OriginalDate
+			}
 		}},
 		{"FirstStartTime", false, func(id int64, s *db.Song) {
 			if !s.FirstStartTime.IsZero() {
@@ -91,11 +144,19 @@ func Update(ctx context.Context) error {
 				lastPlays[s.LastStartTime.Local().Year()]++
 			}
 		}},
+		{"GenresLower", false, func(id int64, s *db.Song) {
+			for _, g := range s.GenresLower {
+				stats.Genres[g]++
+			}
+		}},
 		{"Length", false, func(id int64, s *db.Song) {
 			stats.Songs++
 			stats.TotalSec += s.Length
 			songLengths[id] = s.Length
 		}},
+		{"Library", false, func(id int64, s *db.Song) {
+			libraries[id] = s.Library
+		}},
 		{"Rating", false, func(id int64, s *db.Song) {
 			stats.Ratings[s.Rating]++
 		}},
@@ -103,6 +164,16 @@ func Update(ctx context.Context) error {
 			for _, t := range s.Tags {
 				stats.Tags[t]++
 			}
+			songTags[id] = append(songTags[id], s.Tags...)
+		}},
+		{"TotalDiscs", false, func(id int64, s *db.Song) {
+			totalDiscs[id] = s.TotalDiscs
+		}},
+		{"TotalTracks", false, func(id int64, s *db.Song) {
+			totalTracks[id] = s.TotalTracks
+		}},
+		{"Track", false, func(id int64, s *db.Song) {
+			tracks[id] = s.Track
 		}},
 	}
 
@@ -162,6 +233,33 @@ func Update(ctx context.Context) error {
 		yearStats.LastPlays = plays
 		stats.Years[year] = yearStats
 	}
+	for month, cnt := range added {
+		monthStats := stats.Months[month]
+		monthStats.Added = cnt
+		stats.Months[month] = monthStats
+	}
+	if err := addDeletions(ctx, stats); err != nil {
+		return err
+	}
+	if err := addChanges(ctx, stats); err != nil {
+		return err
+	}
+	if err := addTransfers(ctx, stats); err != nil {
+		return err
+	}
+	if err := addPresetUses(ctx, stats); err != nil {
+		return err
+	}
+	if err := updateTransitions(ctx); err != nil {
+		return err
+	}
+
+	for id, date := range dates {
+		if orig, ok := origDates[id]; ok {
+			date = orig
+		}
+		stats.SongDecades[date.Year()/10*10]++
+	}
 
 	// Hack: old Song entities that don't have Date properties apparently aren't counted
 	// in the projection query on Song.Date, so manually add them to the 0 bucket.
@@ -173,23 +271,18 @@ func Update(ctx context.Context) error {
 		stats.SongDecades[0] += missing
 	}
 
+	versions, err := migrate.CountSongVersions(ctx, stats.Songs)
+	if err != nil {
+		return err
+	}
+	stats.SchemaVersion = migrate.CurrentVersion()
+	stats.SchemaVersions = versions
+
 	// Read Play.StartTime after the Song.Length query is done, since we need to
 	// have the length of each song to compute playtimes.
-	start := time.Now()
-	q := datastore.NewQuery(db.PlayKind).Project("StartTime")
-	qstart := time.Now()
-	it := q.Run(ctx)
-	for {
-		var play db.Play
-		key, err := it.Next(&play)
-		if err == datastore.Done {
-			break
-		} else if err != nil {
-			return err
-		}
-
+	addPlay := func(years map[int]db.PlayStats, key *datastore.Key, play *db.Play) error {
 		year := play.StartTime.Local().Year()
-		yearStats := stats.Years[year]
+		yearStats := years[year]
 		yearStats.Plays++
 
 		var songID int64
@@ -204,7 +297,91 @@ func Update(ctx context.Context) error {
 			yearStats.TotalSec += sec
 		}
 
-		stats.Years[year] = yearStats
+		years[year] = yearStats
+		return nil
+	}
+	songPlays := make(map[int64]int) // keys are song IDs
+	if err := runPlayQuery(ctx, datastore.NewQuery(db.PlayKind).Project("StartTime"),
+		func(key *datastore.Key, play *db.Play) error {
+			t := play.StartTime.Local()
+			stats.Hours[t.Hour()]++
+			stats.Weekdays[t.Weekday()]++
+			if pk := key.Parent(); pk != nil {
+				songPlays[pk.IntID()]++
+			}
+			return addPlay(stats.Years, key, play)
+		}); err != nil {
+		return err
+	}
+	// Old plays without User properties aren't returned by this query.
+	if err := runPlayQuery(ctx, datastore.NewQuery(db.PlayKind).Project("User", "StartTime"),
+		func(key *datastore.Key, play *db.Play) error {
+			if play.User == "" {
+				return nil
+			}
+			years, ok := stats.UserYears[play.User]
+			if !ok {
+				years = make(map[int]db.PlayStats)
+				stats.UserYears[play.User] = years
+			}
+			return addPlay(years, key, play)
+		}); err != nil {
+		return err
+	}
+
+	if err := addTopItems(ctx, stats, &topSongInfo{
+		plays:        songPlays,
+		lengths:      songLengths,
+		artistLowers: artistLowers,
+		albumLowers:  albumLowers,
+		albumIDs:     albumIDs,
+	}); err != nil {
+		return err
+	}
+
+	albumSongs := make(map[int64]*albumSong, len(albumIDs))
+	for id, albumID := range albumIDs {
+		albumSongs[id] = &albumSong{
+			albumID:     albumID,
+			library:     libraries[id],
+			disc:        discs[id],
+			track:       tracks[id],
+			totalTracks: totalTracks[id],
+			totalDiscs:  totalDiscs[id],
+		}
+	}
+	albums := findIncompleteAlbums(albumSongs)
+	log.Debugf(ctx, "Found %d incomplete album(s)", len(albums))
+	if err := saveIncompleteAlbums(ctx, albums); err != nil {
+		return err
+	}
+	if err := saveTagCooccurrence(ctx, countTagCooccurrence(songTags)); err != nil {
+		return err
+	}
+
+	if err := cache.DeleteMemcache(ctx, db.StatsKeyName); err != nil {
+		log.Errorf(ctx, "Failed deleting stats from memcache: %v", err)
+	}
+	_, err = datastore.Put(ctx, statsKey(ctx), &cachedStats{stats})
+	return err
+}
+
+// runPlayQuery runs q and passes each returned Play to fn.
+func runPlayQuery(ctx context.Context, q *datastore.Query, fn func(*datastore.Key, *db.Play) error) error {
+	start := time.Now()
+	qstart := time.Now()
+	it := q.Run(ctx)
+	for {
+		var play db.Play
+		key, err := it.Next(&play)
+		if err == datastore.Done {
+			break
+		} else if err != nil {
+			return err
+		}
+		if err := fn(key, &play); err != nil {
+			return err
+		}
 
 		// Use a cursor to start a new query to avoid datastore query timeouts.
 		if elapsed := time.Now().Sub(qstart); elapsed > maxQueryTime {
@@ -218,17 +395,36 @@ func Update(ctx context.Context) error {
 		}
 	}
 	log.Debugf(ctx, "Computing Play stats took %v ms", time.Now().Sub(start).Milliseconds())
-
-	if err := cache.DeleteMemcache(ctx, db.StatsKeyName); err != nil {
-		log.Errorf(ctx, "Failed deleting stats from memcache: %v", err)
-	}
-	_, err := datastore.Put(ctx, statsKey(ctx), &cachedStats{stats})
-	return err
+	return nil
 }
 
-// Clear deletes previously-computed stats from datastore and memcache.
+// Clear deletes previously-computed stats, incomplete albums, and tag co-occurrence, changes
+// recorded by RecordChanges, transfers recorded by RecordTransfer, preset uses recorded by
+// RecordPresetUse, and transitions recorded by RecordTransition from datastore and memcache.
 func Clear(ctx context.Context) error {
-	if err := datastore.Delete(ctx, statsKey(ctx)); err != nil && err != datastore.ErrNoSuchEntity {
+	if err := clearChanges(ctx); err != nil {
+		return err
+	}
+	if err := clearTransfers(ctx); err != nil {
+		return err
+	}
+	if err := clearPresetUses(ctx); err != nil {
+		return err
+	}
+	if err := clearTransitions(ctx); err != nil {
+		return err
+	}
+	for _, key := range []*datastore.Key{
+		statsKey(ctx), incompleteAlbumsKey(ctx), tagCooccurrenceKey(ctx),
+	} {
+		if err := datastore.Delete(ctx, key); err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+	}
+	if err := cache.DeleteMemcache(ctx, db.IncompleteAlbumsKeyName); err != nil {
+		return err
+	}
+	if err := cache.DeleteMemcache(ctx, db.TagCooccurrenceKeyName); err != nil {
 		return err
 	}
 	return cache.DeleteMemcache(ctx, db.StatsKeyName)
@@ -0,0 +1,183 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package stats
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/derat/nup/server/db"
+
+	"google.golang.org/appengine/v2"
+	"google.golang.org/appengine/v2/datastore"
+)
+
+// maxTopItems is the maximum number of artists or albums to include in db.Stats.TopArtists
+// and db.Stats.TopAlbums by each of play count and playtime.
+const maxTopItems = 20
+
+// playCount accumulates plays of a group of songs, e.g. an artist's songs.
+type playCount struct {
+	plays     int     // total plays of songs in the group
+	sec       float64 // total playtime of songs in the group
+	songID    int64   // ID of the most-played song in the group
+	songPlays int     // plays of songID
+}
+
+// addPlayCount adds plays of the song identified by id with total playtime sec
+// to the group identified by key in counts.
+func addPlayCount(counts map[string]*playCount, key string, id int64, plays int, sec float64) {
+	pc := counts[key]
+	if pc == nil {
+		pc = &playCount{}
+		counts[key] = pc
+	}
+	pc.plays += plays
+	pc.sec += sec
+	if plays > pc.songPlays || (plays == pc.songPlays && id < pc.songID) {
+		pc.songID = id
+		pc.songPlays = plays
+	}
+}
+
+// topKeys returns the keys of the up-to-n groups in counts with the most plays and the
+// up-to-n groups with the most playtime. Keys are sorted by descending play count.
+func topKeys(counts map[string]*playCount, n int) []string {
+	keys := make([]string, 0, len(counts))
+	for k := range counts {
+		keys = append(keys, k)
+	}
+	less := func(byTime bool) func(i, j int) bool {
+		return func(i, j int) bool {
+			a, b := counts[keys[i]], counts[keys[j]]
+			if byTime && a.sec != b.sec {
+				return a.sec > b.sec
+			}
+			if a.plays != b.plays {
+				return a.plays > b.plays
+			}
+			if a.sec != b.sec {
+				return a.sec > b.sec
+			}
+			return keys[i] < keys[j]
+		}
+	}
+
+	sort.Slice(keys, less(true))
+	top := make(map[string]struct{})
+	for i := 0; i < n && i < len(keys); i++ {
+		top[keys[i]] = struct{}{}
+	}
+	sort.Slice(keys, less(false))
+	for i := 0; i < n && i < len(keys); i++ {
+		top[keys[i]] = struct{}{}
+	}
+
+	res := make([]string, 0, len(top))
+	for _, k := range keys {
+		if _, ok := top[k]; ok {
+			res = append(res, k)
+		}
+	}
+	return res
+}
+
+// topSongInfo contains per-song information needed by addTopItems.
+// Maps are keyed by song ID.
+type topSongInfo struct {
+	plays        map[int64]int     // number of plays
+	lengths      map[int64]float64 // Song.Length
+	artistLowers map[int64]string  // Song.ArtistLower
+	albumLowers  map[int64]string  // Song.AlbumLower
+	albumIDs     map[int64]string  // Song.AlbumID
+}
+
+// addTopItems sets stats.TopArtists and stats.TopAlbums using info.
+func addTopItems(ctx context.Context, stats *db.Stats, info *topSongInfo) error {
+	artists := make(map[string]*playCount)
+	albums := make(map[string]*playCount)
+	for id, plays := range info.plays {
+		sec := float64(plays) * info.lengths[id]
+		if artist := info.artistLowers[id]; artist != "" {
+			addPlayCount(artists, artist, id, plays, sec)
+		}
+		// Fall back to the artist and album names for songs without album IDs.
+		if albumID := info.albumIDs[id]; albumID != "" {
+			addPlayCount(albums, albumID, id, plays, sec)
+		} else if album := info.albumLowers[id]; album != "" {
+			addPlayCount(albums, info.artistLowers[id]+"\n"+album, id, plays, sec)
+		}
+	}
+
+	// Load the most-played song from each group to get canonical (i.e. non-lowercase) names.
+	artistKeys := topKeys(artists, maxTopItems)
+	albumKeys := topKeys(albums, maxTopItems)
+	var ids []int64
+	for _, k := range artistKeys {
+		ids = append(ids, artists[k].songID)
+	}
+	for _, k := range albumKeys {
+		ids = append(ids, albums[k].songID)
+	}
+	songs, err := getSongs(ctx, ids)
+	if err != nil {
+		return err
+	}
+
+	stats.TopArtists = make([]db.PlayedItem, 0, len(artistKeys))
+	for _, k := range artistKeys {
+		pc := artists[k]
+		if s := songs[pc.songID]; s != nil {
+			stats.TopArtists = append(stats.TopArtists, db.PlayedItem{
+				Artist:   s.Artist,
+				Plays:    pc.plays,
+				TotalSec: pc.sec,
+			})
+		}
+	}
+	stats.TopAlbums = make([]db.PlayedItem, 0, len(albumKeys))
+	for _, k := range albumKeys {
+		pc := albums[k]
+		if s := songs[pc.songID]; s != nil {
+			artist := s.AlbumArtist
+			if artist == "" {
+				artist = s.Artist
+			}
+			stats.TopAlbums = append(stats.TopAlbums, db.PlayedItem{
+				Artist:   artist,
+				Album:    s.Album,
+				AlbumID:  s.AlbumID,
+				Plays:    pc.plays,
+				TotalSec: pc.sec,
+			})
+		}
+	}
+	return nil
+}
+
+// getSongs fetches the songs identified by ids. Songs that no longer exist are omitted.
+func getSongs(ctx context.Context, ids []int64) (map[int64]*db.Song, error) {
+	keys := make([]*datastore.Key, len(ids))
+	for i, id := range ids {
+		keys[i] = datastore.NewKey(ctx, db.SongKind, "", id, nil)
+	}
+	loaded := make([]db.Song, len(keys))
+	err := datastore.GetMulti(ctx, keys, loaded)
+	merr, _ := err.(appengine.MultiError)
+	if err != nil && merr == nil {
+		return nil, fmt.Errorf("failed to get %v songs: %v", len(keys), err)
+	}
+	songs := make(map[int64]*db.Song, len(keys))
+	for i, k := range keys {
+		if merr != nil && merr[i] != nil {
+			if merr[i] == datastore.ErrNoSuchEntity {
+				continue
+			}
+			return nil, fmt.Errorf("failed to get song %v: %v", k.IntID(), merr[i])
+		}
+		songs[k.IntID()] = &loaded[i]
+	}
+	return songs, nil
+}
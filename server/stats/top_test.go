@@ -0,0 +1,37 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package stats
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTopKeys(t *testing.T) {
+	counts := make(map[string]*playCount)
+	addPlayCount(counts, "a", 1, 10, 100)
+	addPlayCount(counts, "a", 2, 5, 500) // more playtime, but fewer plays than song 1
+	addPlayCount(counts, "b", 3, 20, 200)
+	addPlayCount(counts, "c", 4, 3, 3000)
+	addPlayCount(counts, "d", 5, 1, 10)
+
+	want := &playCount{plays: 15, sec: 600, songID: 1, songPlays: 10}
+	if got := counts["a"]; !reflect.DeepEqual(got, want) {
+		t.Errorf("counts[%q] = %+v; want %+v", "a", got, want)
+	}
+
+	for _, tc := range []struct {
+		n    int
+		want []string
+	}{
+		{0, []string{}},
+		{1, []string{"b", "c"}},            // "b" has the most plays and "c" the most playtime
+		{2, []string{"b", "a", "c"}},       // sorted by plays
+		{10, []string{"b", "a", "c", "d"}}, // all keys
+	} {
+		if got := topKeys(counts, tc.n); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("topKeys(counts, %d) = %q; want %q", tc.n, got, tc.want)
+		}
+	}
+}
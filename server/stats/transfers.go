@@ -0,0 +1,87 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package stats
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/derat/nup/server/db"
+
+	"google.golang.org/appengine/v2/datastore"
+)
+
+const transfersKind = "Transfers" // datastore kind for transferCounts entities
+
+// transferCounts counts requests for a single song's data.
+// transferCounts entities are keyed by the song's key in db.Stats.Transfers.
+// Like changeCounts, these are maintained by RecordTransfer as requests are handled.
+type transferCounts struct {
+	Starts  int   `datastore:",noindex"`
+	Full    int   `datastore:",noindex"`
+	Partial int   `datastore:",noindex"`
+	Bytes   int64 `datastore:",noindex"`
+}
+
+// TransferKey returns the key used in db.Stats.Transfers for the song at fn in the
+// library named lib (empty for the main library).
+func TransferKey(lib, fn string) string {
+	if lib == "" {
+		return fn
+	}
+	return lib + ":" + fn
+}
+
+// RecordTransfer records a request for the song identified by key (see TransferKey).
+// start is true if the request was for the beginning of the song's data, and full is
+// true if the entire song was sent. n is the number of bytes that were sent.
+func RecordTransfer(ctx context.Context, key string, start, full bool, n int64) error {
+	return datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+		dkey := datastore.NewKey(ctx, transfersKind, key, 0, nil)
+		var counts transferCounts
+		if err := datastore.Get(ctx, dkey, &counts); err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		if start {
+			counts.Starts++
+		}
+		if full {
+			counts.Full++
+		} else {
+			counts.Partial++
+		}
+		counts.Bytes += n
+		_, err := datastore.Put(ctx, dkey, &counts)
+		return err
+	}, nil)
+}
+
+// addTransfers adds previously-recorded transfers to stats.Transfers.
+func addTransfers(ctx context.Context, stats *db.Stats) error {
+	var counts []transferCounts
+	keys, err := datastore.NewQuery(transfersKind).GetAll(ctx, &counts)
+	if err != nil {
+		return fmt.Errorf("failed reading %v: %v", transfersKind, err)
+	}
+	for i, key := range keys {
+		c := counts[i]
+		stats.Transfers[key.StringID()] = db.TransferStats{
+			Starts:  c.Starts,
+			Full:    c.Full,
+			Partial: c.Partial,
+			Bytes:   c.Bytes,
+		}
+	}
+	return nil
+}
+
+// clearTransfers deletes all transferCounts entities from datastore.
+func clearTransfers(ctx context.Context) error {
+	if keys, err := datastore.NewQuery(transfersKind).KeysOnly().GetAll(ctx, nil); err != nil {
+		return fmt.Errorf("getting %v keys failed: %v", transfersKind, err)
+	} else if err := datastore.DeleteMulti(ctx, keys); err != nil {
+		return fmt.Errorf("deleting all %v entities failed: %v", transfersKind, err)
+	}
+	return nil
+}
@@ -0,0 +1,200 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package stats
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"google.golang.org/appengine/v2"
+	"google.golang.org/appengine/v2/datastore"
+	"google.golang.org/appengine/v2/log"
+)
+
+const (
+	transitionKind       = "Transition"       // datastore kind for transition entities
+	transitionCountsKind = "TransitionCounts" // datastore kind for transitionCounts entities
+
+	transitionBatchSize = 500 // max entities to put or delete in a single call
+)
+
+// transition records a song being played or skipped immediately after another song.
+// transition entities are keyed by transitionKey and are written by RecordTransition
+// as requests are handled. They're aggregated into transitionCounts entities by Update.
+type transition struct {
+	Prev      int64     `datastore:",noindex"` // previous song's ID
+	Next      int64     `datastore:",noindex"` // next song's ID
+	StartTime time.Time `datastore:",noindex"` // time at which Next started
+	Skipped   bool      `datastore:",noindex"` // Next was skipped
+	User      string    `datastore:",noindex"`
+}
+
+// transitionKey returns the key name of the transition entity for a transition
+// from prev to next at t. This lets repeated reports of the same transition be ignored.
+func transitionKey(prev, next int64, t time.Time) string {
+	return fmt.Sprintf("%d:%d:%d", prev, next, t.UnixNano())
+}
+
+// TransitionCount describes how often a song was played through or skipped
+// immediately after another song.
+type TransitionCount struct {
+	Plays int
+	Skips int
+}
+
+// transitionCounts contains aggregated transitions from a single song.
+// transitionCounts entities are keyed by the previous song's ID.
+// The slices are parallel; datastore doesn't support maps.
+type transitionCounts struct {
+	Next  []int64 `datastore:",noindex"`
+	Plays []int   `datastore:",noindex"`
+	Skips []int   `datastore:",noindex"`
+}
+
+// RecordTransition records that the song identified by next was started at t by user
+// immediately after the song identified by prev. skipped is true if next was skipped.
+func RecordTransition(ctx context.Context, prev, next int64, t time.Time, skipped bool, user string) error {
+	key := datastore.NewKey(ctx, transitionKind, transitionKey(prev, next, t.UTC()), 0, nil)
+	_, err := datastore.Put(ctx, key, &transition{
+		Prev:      prev,
+		Next:      next,
+		StartTime: t.UTC(),
+		Skipped:   skipped,
+		User:      user,
+	})
+	return err
+}
+
+// TransitionCounts returns aggregated transitions (as of the last call to Update) from
+// each of the songs identified by ids. The returned map is keyed by the previous and next
+// songs' IDs. Songs without any transitions are omitted.
+func TransitionCounts(ctx context.Context, ids []int64) (map[int64]map[int64]TransitionCount, error) {
+	keys := make([]*datastore.Key, len(ids))
+	for i, id := range ids {
+		keys[i] = datastore.NewKey(ctx, transitionCountsKind, "", id, nil)
+	}
+	loaded := make([]transitionCounts, len(keys))
+	err := datastore.GetMulti(ctx, keys, loaded)
+	merr, _ := err.(appengine.MultiError)
+	if err != nil && merr == nil {
+		return nil, fmt.Errorf("failed to get %v transition counts: %v", len(keys), err)
+	}
+	counts := make(map[int64]map[int64]TransitionCount)
+	for i, k := range keys {
+		if merr != nil && merr[i] != nil {
+			if merr[i] == datastore.ErrNoSuchEntity {
+				continue
+			}
+			return nil, fmt.Errorf("failed to get transition counts for %v: %v", k.IntID(), merr[i])
+		}
+		tc := &loaded[i]
+		m := make(map[int64]TransitionCount, len(tc.Next))
+		for j, next := range tc.Next {
+			if j < len(tc.Plays) && j < len(tc.Skips) {
+				m[next] = TransitionCount{Plays: tc.Plays[j], Skips: tc.Skips[j]}
+			}
+		}
+		counts[k.IntID()] = m
+	}
+	return counts, nil
+}
+
+// aggregateTransitions counts ts by their previous and next songs.
+func aggregateTransitions(ts []transition) map[int64]map[int64]TransitionCount {
+	counts := make(map[int64]map[int64]TransitionCount)
+	for _, t := range ts {
+		m := counts[t.Prev]
+		if m == nil {
+			m = make(map[int64]TransitionCount)
+			counts[t.Prev] = m
+		}
+		c := m[t.Next]
+		if t.Skipped {
+			c.Skips++
+		} else {
+			c.Plays++
+		}
+		m[t.Next] = c
+	}
+	return counts
+}
+
+// updateTransitions aggregates transition entities into transitionCounts entities,
+// deleting transitionCounts entities for songs that no longer have any transitions.
+func updateTransitions(ctx context.Context) error {
+	start := time.Now()
+	var ts []transition
+	if _, err := datastore.NewQuery(transitionKind).GetAll(ctx, &ts); err != nil {
+		return fmt.Errorf("failed reading %v: %v", transitionKind, err)
+	}
+	counts := aggregateTransitions(ts)
+
+	var keys []*datastore.Key
+	var ents []*transitionCounts
+	for prev, m := range counts {
+		tc := &transitionCounts{}
+		for next, c := range m {
+			tc.Next = append(tc.Next, next)
+			tc.Plays = append(tc.Plays, c.Plays)
+			tc.Skips = append(tc.Skips, c.Skips)
+		}
+		keys = append(keys, datastore.NewKey(ctx, transitionCountsKind, "", prev, nil))
+		ents = append(ents, tc)
+	}
+	for len(keys) > 0 {
+		n := len(keys)
+		if n > transitionBatchSize {
+			n = transitionBatchSize
+		}
+		if _, err := datastore.PutMulti(ctx, keys[:n], ents[:n]); err != nil {
+			return fmt.Errorf("failed writing %v: %v", transitionCountsKind, err)
+		}
+		keys, ents = keys[n:], ents[n:]
+	}
+
+	oldKeys, err := datastore.NewQuery(transitionCountsKind).KeysOnly().GetAll(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("getting %v keys failed: %v", transitionCountsKind, err)
+	}
+	var stale []*datastore.Key
+	for _, k := range oldKeys {
+		if _, ok := counts[k.IntID()]; !ok {
+			stale = append(stale, k)
+		}
+	}
+	if err := deleteInBatches(ctx, stale); err != nil {
+		return fmt.Errorf("deleting stale %v entities failed: %v", transitionCountsKind, err)
+	}
+	log.Debugf(ctx, "Aggregated %d transition(s) from %d song(s) in %v ms",
+		len(ts), len(counts), time.Now().Sub(start).Milliseconds())
+	return nil
+}
+
+// clearTransitions deletes all transition and transitionCounts entities from datastore.
+func clearTransitions(ctx context.Context) error {
+	for _, kind := range []string{transitionKind, transitionCountsKind} {
+		if keys, err := datastore.NewQuery(kind).KeysOnly().GetAll(ctx, nil); err != nil {
+			return fmt.Errorf("getting %v keys failed: %v", kind, err)
+		} else if err := deleteInBatches(ctx, keys); err != nil {
+			return fmt.Errorf("deleting all %v entities failed: %v", kind, err)
+		}
+	}
+	return nil
+}
+
+// deleteInBatches deletes keys from datastore in batches of transitionBatchSize.
+func deleteInBatches(ctx context.Context, keys []*datastore.Key) error {
+	for len(keys) > 0 {
+		n := len(keys)
+		if n > transitionBatchSize {
+			n = transitionBatchSize
+		}
+		if err := datastore.DeleteMulti(ctx, keys[:n]); err != nil {
+			return err
+		}
+		keys = keys[n:]
+	}
+	return nil
+}
@@ -0,0 +1,26 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package stats
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestAggregateTransitions(t *testing.T) {
+	got := aggregateTransitions([]transition{
+		{Prev: 1, Next: 2},
+		{Prev: 1, Next: 2},
+		{Prev: 1, Next: 2, Skipped: true},
+		{Prev: 1, Next: 3, Skipped: true},
+		{Prev: 2, Next: 1},
+	})
+	want := map[int64]map[int64]TransitionCount{
+		1: {2: {Plays: 2, Skips: 1}, 3: {Skips: 1}},
+		2: {1: {Plays: 1}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("aggregateTransitions returned %v; want %v", got, want)
+	}
+}
@@ -0,0 +1,29 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package storage
+
+import (
+	"context"
+	"errors"
+
+	"google.golang.org/appengine/v2"
+
+	"cloud.google.com/go/storage"
+)
+
+// CheckBucket returns an error if the Cloud Storage bucket can't be accessed.
+func CheckBucket(ctx context.Context, bucket string) error {
+	// Tests shouldn't be trying to access Cloud Storage.
+	if appengine.IsDevAppServer() {
+		return errors.New("accessing bucket from test")
+	}
+
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	_, err = client.Bucket(bucket).Attrs(ctx)
+	return err
+}
@@ -0,0 +1,39 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package storage
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"google.golang.org/appengine/v2"
+
+	"cloud.google.com/go/storage"
+)
+
+// SignedURL returns a V4 signed URL that can be used to read the Cloud Storage object
+// identified by bucket and name for the next exp. The URL is signed using the App Engine
+// app's default service account.
+func SignedURL(ctx context.Context, bucket, name string, exp time.Duration) (string, error) {
+	// Tests shouldn't be trying to access Cloud Storage.
+	if appengine.IsDevAppServer() {
+		return "", errors.New("signing URL from test")
+	}
+
+	acct, err := appengine.ServiceAccount(ctx)
+	if err != nil {
+		return "", err
+	}
+	return storage.SignedURL(bucket, name, &storage.SignedURLOptions{
+		GoogleAccessID: acct,
+		SignBytes: func(b []byte) ([]byte, error) {
+			_, sig, err := appengine.SignBytes(ctx, b)
+			return sig, err
+		},
+		Method:  "GET",
+		Expires: time.Now().Add(exp),
+		Scheme:  storage.SigningSchemeV4,
+	})
+}
@@ -0,0 +1,39 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+
+	"google.golang.org/appengine/v2"
+
+	"cloud.google.com/go/storage"
+)
+
+// ObjectVersion returns a short string identifying the current contents of the Cloud Storage
+// object identified by bucket and name. The version is derived from the object's CRC32C
+// checksum, so it changes whenever the object is replaced with different data.
+// os.ErrNotExist is returned if the object does not exist.
+func ObjectVersion(ctx context.Context, bucket, name string) (string, error) {
+	// Tests shouldn't be trying to access Cloud Storage.
+	if appengine.IsDevAppServer() {
+		return "", errors.New("accessing bucket from test")
+	}
+
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer client.Close()
+	attrs, err := client.Bucket(bucket).Object(name).Attrs(ctx)
+	if err == storage.ErrObjectNotExist {
+		return "", os.ErrNotExist
+	} else if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%08x", attrs.CRC32C), nil
+}
@@ -0,0 +1,260 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+// Package tagrules stores aliases and parent/child relations between tags.
+package tagrules
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/derat/nup/server/cache"
+
+	"google.golang.org/appengine/v2/datastore"
+	"google.golang.org/appengine/v2/log"
+)
+
+const (
+	rulesKind    = "TagRules" // datastore kind for the Rules singleton
+	rulesKeyName = "rules"    // key name for the Rules singleton in datastore and memcache
+)
+
+// Rules describes relations between tags.
+type Rules struct {
+	// Aliases maps from alias tags to their canonical tags, e.g. "no-vocals" to "instrumental".
+	// Canonical tags are never themselves aliases.
+	Aliases map[string]string `json:"aliases"`
+	// Parents maps from canonical child tags to their canonical parent tags,
+	// e.g. "bebop" to "jazz".
+	Parents map[string]string `json:"parents"`
+}
+
+// NewRules returns an empty Rules object.
+func NewRules() *Rules {
+	return &Rules{
+		Aliases: make(map[string]string),
+		Parents: make(map[string]string),
+	}
+}
+
+// Load and Save implement datastore.PropertyLoadSaver, since datastore doesn't support maps.
+func (r *Rules) Load(props []datastore.Property) error {
+	if err := cache.LoadJSONProp(props, r); err != nil {
+		return err
+	}
+	if r.Aliases == nil {
+		r.Aliases = make(map[string]string)
+	}
+	if r.Parents == nil {
+		r.Parents = make(map[string]string)
+	}
+	return nil
+}
+func (r *Rules) Save() ([]datastore.Property, error) {
+	return cache.SaveJSONProp(r)
+}
+
+// Canonical returns the canonical name of tag.
+func (r *Rules) Canonical(tag string) string {
+	if c, ok := r.Aliases[tag]; ok {
+		return c
+	}
+	return tag
+}
+
+// AliasesOf returns the sorted aliases of tag's canonical name.
+func (r *Rules) AliasesOf(tag string) []string {
+	c := r.Canonical(tag)
+	var aliases []string
+	for a, t := range r.Aliases {
+		if t == c {
+			aliases = append(aliases, a)
+		}
+	}
+	sort.Strings(aliases)
+	return aliases
+}
+
+// Expand returns tag's canonical name, the canonical names of all of its descendants,
+// and all of their aliases in sorted order. A song with any of the returned tags should
+// be treated as having tag. If there aren't any rules involving tag, only tag is returned.
+func (r *Rules) Expand(tag string) []string {
+	children := make(map[string][]string)
+	for c, p := range r.Parents {
+		children[p] = append(children[p], c)
+	}
+	seen := make(map[string]struct{})
+	var add func(string)
+	add = func(t string) {
+		if _, ok := seen[t]; ok {
+			return
+		}
+		seen[t] = struct{}{}
+		for _, a := range r.AliasesOf(t) {
+			seen[a] = struct{}{}
+		}
+		for _, c := range children[t] {
+			add(c)
+		}
+	}
+	add(r.Canonical(tag))
+
+	tags := make([]string, 0, len(seen))
+	for t := range seen {
+		tags = append(tags, t)
+	}
+	sort.Strings(tags)
+	return tags
+}
+
+// checkTag returns an error if tag isn't a valid tag name.
+func checkTag(tag string) error {
+	if tag == "" {
+		return errors.New("empty tag")
+	}
+	if strings.HasPrefix(tag, "-") || strings.ContainsAny(tag, " \t\n") {
+		return fmt.Errorf("invalid tag %q", tag)
+	}
+	return nil
+}
+
+// SetAlias makes alias an alias of canonical (or of canonical's canonical name, if it's
+// already an alias). An error is returned if alias has its own aliases or relations.
+func (r *Rules) SetAlias(alias, canonical string) error {
+	if err := checkTag(alias); err != nil {
+		return err
+	}
+	if err := checkTag(canonical); err != nil {
+		return err
+	}
+	canonical = r.Canonical(canonical)
+	if alias == canonical {
+		return fmt.Errorf("%q can't be an alias of itself", alias)
+	}
+	for _, t := range r.Aliases {
+		if t == alias {
+			return fmt.Errorf("%q has its own aliases", alias)
+		}
+	}
+	if _, ok := r.Parents[alias]; ok {
+		return fmt.Errorf("%q has a parent", alias)
+	}
+	for _, p := range r.Parents {
+		if p == alias {
+			return fmt.Errorf("%q has children", alias)
+		}
+	}
+	r.Aliases[alias] = canonical
+	return nil
+}
+
+// SetParent makes parent the parent of child. Both tags are replaced by their canonical
+// names. An error is returned if the relation would introduce a cycle.
+func (r *Rules) SetParent(child, parent string) error {
+	if err := checkTag(child); err != nil {
+		return err
+	}
+	if err := checkTag(parent); err != nil {
+		return err
+	}
+	child, parent = r.Canonical(child), r.Canonical(parent)
+	for t := parent; t != ""; t = r.Parents[t] {
+		if t == child {
+			return fmt.Errorf("making %q a parent of %q would create a cycle", parent, child)
+		}
+	}
+	r.Parents[child] = parent
+	return nil
+}
+
+// Remove removes tag's alias and parent rules. Rules involving tag's aliases and
+// children are preserved. An error is returned if tag doesn't have any rules.
+func (r *Rules) Remove(tag string) error {
+	_, isAlias := r.Aliases[tag]
+	_, hasParent := r.Parents[tag]
+	if !isAlias && !hasParent {
+		return fmt.Errorf("%q doesn't have an alias or parent", tag)
+	}
+	delete(r.Aliases, tag)
+	delete(r.Parents, tag)
+	return nil
+}
+
+// TagInfo describes a canonical tag.
+type TagInfo struct {
+	Name    string   `json:"name"`
+	Aliases []string `json:"aliases,omitempty"`
+	Parent  string   `json:"parent,omitempty"`
+}
+
+// Annotate returns sorted information about the canonical names of tags.
+func (r *Rules) Annotate(tags []string) []TagInfo {
+	seen := make(map[string]struct{})
+	var infos []TagInfo
+	for _, t := range tags {
+		c := r.Canonical(t)
+		if _, ok := seen[c]; ok {
+			continue
+		}
+		seen[c] = struct{}{}
+		infos = append(infos, TagInfo{Name: c, Aliases: r.AliasesOf(c), Parent: r.Parents[c]})
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	return infos
+}
+
+func rulesKey(ctx context.Context) *datastore.Key {
+	return datastore.NewKey(ctx, rulesKind, rulesKeyName, 0, nil)
+}
+
+// Get returns the current rules. Empty rules are returned if none have been saved.
+func Get(ctx context.Context) (*Rules, error) {
+	r := NewRules()
+	if ok, err := cache.GetMemcache(ctx, rulesKeyName, r); err != nil {
+		log.Errorf(ctx, "Failed getting tag rules from memcache: %v", err)
+	} else if ok {
+		return r, nil
+	}
+	if err := datastore.Get(ctx, rulesKey(ctx), r); err != nil && err != datastore.ErrNoSuchEntity {
+		return nil, err
+	}
+	if err := cache.SetMemcache(ctx, rulesKeyName, r); err != nil {
+		log.Errorf(ctx, "Failed saving tag rules to memcache: %v", err)
+	}
+	return r, nil
+}
+
+// Update transactionally loads the current rules, passes them to fn, and saves them.
+// If fn returns an error, the rules aren't saved. The updated rules are returned.
+func Update(ctx context.Context, fn func(r *Rules) error) (*Rules, error) {
+	var r *Rules
+	if err := datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+		r = NewRules() // the transaction may be retried
+		key := rulesKey(ctx)
+		if err := datastore.Get(ctx, key, r); err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		if err := fn(r); err != nil {
+			return err
+		}
+		_, err := datastore.Put(ctx, key, r)
+		return err
+	}, nil); err != nil {
+		return nil, err
+	}
+	if err := cache.DeleteMemcache(ctx, rulesKeyName); err != nil {
+		log.Errorf(ctx, "Failed deleting tag rules from memcache: %v", err)
+	}
+	return r, nil
+}
+
+// Clear deletes all rules from datastore and memcache.
+func Clear(ctx context.Context) error {
+	if err := datastore.Delete(ctx, rulesKey(ctx)); err != nil && err != datastore.ErrNoSuchEntity {
+		return err
+	}
+	return cache.DeleteMemcache(ctx, rulesKeyName)
+}
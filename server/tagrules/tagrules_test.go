@@ -0,0 +1,91 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package tagrules
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRules(t *testing.T) {
+	r := NewRules()
+	for _, a := range [][2]string{
+		{"no-vocals", "instrumental"},
+		{"instr", "no-vocals"}, // should use "instrumental"
+		{"swing", "jazz"},
+	} {
+		if err := r.SetAlias(a[0], a[1]); err != nil {
+			t.Fatalf("SetAlias(%q, %q) failed: %v", a[0], a[1], err)
+		}
+	}
+	for _, p := range [][2]string{
+		{"bebop", "jazz"},
+		{"hard-bop", "bebop"},
+		{"big-band", "swing"}, // should use "jazz"
+	} {
+		if err := r.SetParent(p[0], p[1]); err != nil {
+			t.Fatalf("SetParent(%q, %q) failed: %v", p[0], p[1], err)
+		}
+	}
+
+	for _, tc := range []struct{ tag, canon string }{
+		{"instrumental", "instrumental"},
+		{"no-vocals", "instrumental"},
+		{"instr", "instrumental"},
+		{"rock", "rock"},
+	} {
+		if got := r.Canonical(tc.tag); got != tc.canon {
+			t.Errorf("Canonical(%q) = %q; want %q", tc.tag, got, tc.canon)
+		}
+	}
+
+	for _, tc := range []struct {
+		tag  string
+		want []string
+	}{
+		{"instrumental", []string{"instr", "instrumental", "no-vocals"}},
+		{"no-vocals", []string{"instr", "instrumental", "no-vocals"}},
+		{"jazz", []string{"bebop", "big-band", "hard-bop", "jazz", "swing"}},
+		{"bebop", []string{"bebop", "hard-bop"}},
+		{"rock", []string{"rock"}},
+	} {
+		if got := r.Expand(tc.tag); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("Expand(%q) = %q; want %q", tc.tag, got, tc.want)
+		}
+	}
+
+	for _, tc := range []struct{ a, b string }{
+		{"instrumental", "vocals"}, // has aliases
+		{"bebop", "jazz"},          // has a parent
+		{"jazz", "music"},          // has children
+		{"jazz", "swing"},          // alias of itself
+		{"-bad", "jazz"},
+		{"two words", "jazz"},
+	} {
+		if err := r.SetAlias(tc.a, tc.b); err == nil {
+			t.Errorf("SetAlias(%q, %q) unexpectedly succeeded", tc.a, tc.b)
+		}
+	}
+	if err := r.SetParent("jazz", "hard-bop"); err == nil {
+		t.Error("SetParent created a cycle")
+	}
+
+	if got, want := r.Annotate([]string{"rock", "no-vocals", "hard-bop", "instrumental"}), []TagInfo{
+		{Name: "hard-bop", Parent: "bebop"},
+		{Name: "instrumental", Aliases: []string{"instr", "no-vocals"}},
+		{Name: "rock"},
+	}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Annotate returned %+v; want %+v", got, want)
+	}
+
+	if err := r.Remove("bebop"); err != nil {
+		t.Error("Remove failed:", err)
+	}
+	if got, want := r.Expand("jazz"), []string{"big-band", "jazz", "swing"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("After Remove, Expand(%q) = %q; want %q", "jazz", got, want)
+	}
+	if err := r.Remove("rock"); err == nil {
+		t.Error("Remove of tag without rules unexpectedly succeeded")
+	}
+}
@@ -0,0 +1,132 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package update
+
+import (
+	"context"
+	"time"
+
+	"github.com/derat/nup/server/db"
+	"github.com/derat/nup/server/query"
+
+	"google.golang.org/appengine/v2/datastore"
+	"google.golang.org/appengine/v2/log"
+)
+
+// defaultBulkImportTimeout is the amount of time after the last request in a bulk import session
+// after which the session is assumed to have been abandoned (e.g. due to the client crashing).
+const defaultBulkImportTimeout = time.Hour
+
+// bulkImportTimeout is the timeout currently in use. It can be changed by tests.
+var bulkImportTimeout = defaultBulkImportTimeout
+
+// SetBulkImportTimeout sets the amount of time after which bulk import sessions are
+// considered abandoned. The default timeout is restored if d is zero. Used by tests.
+func SetBulkImportTimeout(d time.Duration) {
+	if d <= 0 {
+		d = defaultBulkImportTimeout
+	}
+	bulkImportTimeout = d
+}
+
+func bulkImportKey(ctx context.Context) *datastore.Key {
+	return datastore.NewKey(ctx, db.BulkImportKind, db.BulkImportKeyName, 0, nil)
+}
+
+// getBulkImport returns the current bulk import session, or nil if there isn't one.
+func getBulkImport(ctx context.Context) (*db.BulkImport, error) {
+	var bi db.BulkImport
+	if err := datastore.Get(ctx, bulkImportKey(ctx), &bi); err == datastore.ErrNoSuchEntity {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return &bi, nil
+}
+
+// NoteBulkImport starts a new bulk import session or extends the existing one.
+// numSongs is added to the number of songs imported in the session.
+// Callers should not flush cached queries after importing songs in a session.
+// If the existing session was abandoned, a new session is started and cached queries
+// are flushed so that they reflect the songs imported in the abandoned session.
+func NoteBulkImport(ctx context.Context, numSongs int) error {
+	var abandoned bool
+	if err := datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+		abandoned = false
+		now := time.Now()
+		bi, err := getBulkImport(ctx)
+		if err != nil {
+			return err
+		}
+		if bi != nil && !now.Before(bi.UpdateTime.Add(bulkImportTimeout)) {
+			log.Warningf(ctx, "Replacing bulk import session abandoned at %v with %v song(s)",
+				bi.UpdateTime, bi.NumSongs)
+			abandoned = true
+			bi = nil
+		}
+		if bi == nil {
+			log.Debugf(ctx, "Starting bulk import session")
+			bi = &db.BulkImport{StartTime: now}
+		}
+		bi.UpdateTime = now
+		bi.NumSongs += numSongs
+		_, err = datastore.Put(ctx, bulkImportKey(ctx), bi)
+		return err
+	}, nil); err != nil {
+		return err
+	}
+	if abandoned {
+		return query.FlushCacheForUpdate(ctx, query.MetadataUpdate)
+	}
+	return nil
+}
+
+// BulkImportActive returns true if a bulk import session is in progress.
+// If an abandoned session is found, it is ended and cached queries are flushed.
+func BulkImportActive(ctx context.Context) (bool, error) {
+	var active, abandoned bool
+	if err := datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+		active, abandoned = false, false
+		bi, err := getBulkImport(ctx)
+		if err != nil || bi == nil {
+			return err
+		}
+		if time.Now().Before(bi.UpdateTime.Add(bulkImportTimeout)) {
+			active = true
+			return nil
+		}
+		log.Warningf(ctx, "Ending bulk import session abandoned at %v with %v song(s)",
+			bi.UpdateTime, bi.NumSongs)
+		abandoned = true
+		return datastore.Delete(ctx, bulkImportKey(ctx))
+	}, nil); err != nil {
+		return false, err
+	}
+	if abandoned {
+		return false, query.FlushCacheForUpdate(ctx, query.MetadataUpdate)
+	}
+	return active, nil
+}
+
+// EndBulkImport ends the current bulk import session (if any) and flushes cached queries
+// that were affected by the imported songs. The number of songs imported during the
+// session is returned. Stats should be updated by the caller afterward if needed.
+func EndBulkImport(ctx context.Context) (int, error) {
+	var numSongs int
+	if err := datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+		bi, err := getBulkImport(ctx)
+		if err != nil || bi == nil {
+			return err
+		}
+		numSongs = bi.NumSongs
+		log.Debugf(ctx, "Ending bulk import session started at %v with %v song(s)",
+			bi.StartTime, bi.NumSongs)
+		return datastore.Delete(ctx, bulkImportKey(ctx))
+	}, nil); err != nil {
+		return 0, err
+	}
+	// Flush the cache even if there wasn't a session, since the caller may have
+	// skipped flushing after its final import request.
+	return numSongs, query.FlushCacheForUpdate(ctx, query.MetadataUpdate)
+}
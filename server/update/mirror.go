@@ -0,0 +1,66 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package update
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/derat/nup/server/db"
+
+	"google.golang.org/appengine/v2/datastore"
+	"google.golang.org/appengine/v2/log"
+)
+
+// MirrorSong saves src (received from a primary server) to datastore using the supplied ID.
+// Src's metadata, rating, and tags are copied, but the existing song's play stats are
+// preserved, since they're synced separately by AddMirroredPlays.
+// Cached queries are not flushed.
+func MirrorSong(ctx context.Context, id int64, src *db.Song) error {
+	return datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+		key := datastore.NewKey(ctx, db.SongKind, "", id, nil)
+		var song db.Song
+		if err := datastore.Get(ctx, key, &song); err != nil && err != datastore.ErrNoSuchEntity {
+			return fmt.Errorf("getting song %v failed: %v", id, err)
+		}
+		if err := song.Update(src, false); err != nil {
+			return err
+		}
+		song.SetRating(src.Rating)
+		song.Tags = append([]string(nil), src.Tags...)
+		song.Clean()
+		song.AssignRandomKey()
+		song.LastModifiedTime = time.Now()
+		if _, err := datastore.Put(ctx, key, &song); err != nil { // must pass pointer
+			return fmt.Errorf("putting %v failed: %v", id, err)
+		}
+		return nil
+	}, nil)
+}
+
+// AddMirroredPlays adds plays (received from a primary server) to the song identified by id.
+// Plays that the song already has are skipped. The number of added plays is returned.
+// Cached queries are not flushed.
+func AddMirroredPlays(ctx context.Context, id int64, plays []db.Play) (int, error) {
+	var added int
+	err := updateExistingSong(ctx, id, func(ctx context.Context, s *db.Song) error {
+		added = 0 // reset in case the transaction is retried
+		songKey := datastore.NewKey(ctx, db.SongKind, "", id, nil)
+		for _, p := range plays {
+			p.StartTime = p.StartTime.UTC()
+			if ok, err := addPlay(ctx, songKey, s, p); err != nil {
+				return err
+			} else if ok {
+				added++
+			}
+		}
+		if added == 0 {
+			return errUnmodified
+		}
+		log.Debugf(ctx, "Added %v mirrored play(s) to song %v", added, id)
+		return nil
+	}, 0, false)
+	return added, err
+}
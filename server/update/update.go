@@ -13,6 +13,7 @@ import (
 
 	"github.com/derat/nup/server/db"
 	"github.com/derat/nup/server/query"
+	"github.com/derat/nup/server/stats"
 
 	"google.golang.org/appengine/v2"
 	"google.golang.org/appengine/v2/datastore"
@@ -24,42 +25,161 @@ var errUnmodified = errors.New("object wasn't modified")
 const reindexBatchSize = 1000
 
 // AddPlay adds a play report to the song identified by id in datastore.
-func AddPlay(ctx context.Context, id int64, startTime time.Time, ip string) error {
+// user identifies the user who reported the play and may be empty.
+func AddPlay(ctx context.Context, id int64, startTime time.Time, ip, user string) error {
+	play := db.NewPlay(startTime.UTC(), ip)
+	play.User = user
 	err := updateExistingSong(ctx, id, func(ctx context.Context, s *db.Song) error {
 		songKey := datastore.NewKey(ctx, db.SongKind, "", id, nil)
-		existingKeys, err := datastore.NewQuery(db.PlayKind).Ancestor(songKey).KeysOnly().
-			Filter("StartTime =", startTime).Filter("IpAddress =", ip).GetAll(ctx, nil)
-		if err != nil {
-			return fmt.Errorf("querying for existing play failed: %v", err)
-		} else if len(existingKeys) > 0 {
+		if added, err := addPlay(ctx, songKey, s, play); err != nil {
+			return err
+		} else if !added {
 			log.Debugf(ctx, "Already have play for song %v starting at %v from %v", id, startTime, ip)
 			return errUnmodified
 		}
+		return nil
+	}, 0, true)
+	if err != nil {
+		return err
+	}
+	return query.FlushCacheForUpdate(ctx, query.PlaysUpdate)
+}
 
-		s.UpdatePlayStats(startTime)
+// AddPlays adds multiple play reports to the song identified by id in datastore.
+// Plays that the song already has are skipped, and the number of added plays is returned.
+// All plays are added in a single transaction, so the caller should limit len(plays).
+func AddPlays(ctx context.Context, id int64, plays []db.Play) (int, error) {
+	var added int
+	err := updateExistingSong(ctx, id, func(ctx context.Context, s *db.Song) error {
+		added = 0 // the transaction may be retried
+		songKey := datastore.NewKey(ctx, db.SongKind, "", id, nil)
+		// Plays put in this transaction won't be returned by addPlay's queries,
+		// so also check for duplicates within plays.
+		type playKey struct {
+			start int64 // UnixNano
+			ip    string
+		}
+		seen := make(map[playKey]struct{}, len(plays))
+		for _, play := range plays {
+			play.StartTime = play.StartTime.UTC()
+			pk := playKey{play.StartTime.UnixNano(), play.IPAddress}
+			if _, ok := seen[pk]; ok {
+				continue
+			}
+			seen[pk] = struct{}{}
+			if ok, err := addPlay(ctx, songKey, s, play); err != nil {
+				return err
+			} else if ok {
+				added++
+			}
+		}
+		if added == 0 {
+			return errUnmodified
+		}
+		return nil
+	}, 0, true)
+	if err != nil {
+		return 0, err
+	}
+	if added > 0 {
+		if err := query.FlushCacheForUpdate(ctx, query.PlaysUpdate); err != nil {
+			return added, err
+		}
+	}
+	return added, nil
+}
 
-		newKey := datastore.NewIncompleteKey(ctx, db.PlayKind, songKey)
-		if _, err = datastore.Put(ctx, newKey, &db.Play{ // must pass pointer
-			StartTime: startTime.UTC(),
-			IPAddress: ip,
-		}); err != nil {
-			return fmt.Errorf("putting play failed: %v", err)
+// AddSkip records a skip of the song identified by id in datastore.
+func AddSkip(ctx context.Context, id int64, skip db.Skip) error {
+	skip.StartTime = skip.StartTime.UTC()
+	err := updateExistingSong(ctx, id, func(ctx context.Context, s *db.Song) error {
+		if !s.AddSkip(skip) {
+			log.Debugf(ctx, "Already have skip for song %v starting at %v", id, skip.StartTime)
+			return errUnmodified
 		}
 		return nil
 	}, 0, true)
 	if err != nil {
 		return err
 	}
-	return query.FlushCacheForUpdate(ctx, query.PlaysUpdate)
+	return query.FlushCacheForUpdate(ctx, query.SkipsUpdate)
+}
+
+// addPlay adds play to s (identified by songKey) and puts a new Play entity.
+// The caller is responsible for putting s. false is returned if s already has the play.
+// This must be called within a transaction.
+func addPlay(ctx context.Context, songKey *datastore.Key, s *db.Song, play db.Play) (bool, error) {
+	// Populate the song's recent plays if they haven't been written yet.
+	if !s.RecentPlaysValid() {
+		if err := loadRecentPlays(ctx, songKey, s); err != nil {
+			return false, err
+		}
+	}
+
+	// Check the recent plays first, and only fall back to querying Play entities
+	// if the play is older than all of the recent plays.
+	dup := s.HasRecentPlay(&play)
+	if !dup && !s.HasAllPlays() && !play.StartTime.After(s.RecentPlays[0].StartTime) {
+		existingKeys, err := datastore.NewQuery(db.PlayKind).Ancestor(songKey).KeysOnly().
+			Filter("StartTime =", play.StartTime).Filter("IpAddress =", play.IPAddress).GetAll(ctx, nil)
+		if err != nil {
+			return false, fmt.Errorf("querying for existing play failed: %v", err)
+		}
+		dup = len(existingKeys) > 0
+	}
+	if dup {
+		return false, nil
+	}
+
+	play.ReportTime = time.Now()
+	s.UpdatePlayStats(play.StartTime)
+	s.AddRecentPlay(play)
+
+	newKey := datastore.NewIncompleteKey(ctx, db.PlayKind, songKey)
+	if _, err := datastore.Put(ctx, newKey, &play); err != nil { // must pass pointer
+		return false, fmt.Errorf("putting play failed: %v", err)
+	}
+	return true, nil
+}
+
+// loadRecentPlays rebuilds s's play stats (including RecentPlays) from the Play
+// entities descended from songKey.
+func loadRecentPlays(ctx context.Context, songKey *datastore.Key, s *db.Song) error {
+	var plays []db.Play
+	if _, err := datastore.NewQuery(db.PlayKind).Ancestor(songKey).GetAll(ctx, &plays); err != nil {
+		return fmt.Errorf("getting plays for song %v failed: %v", songKey.IntID(), err)
+	}
+	s.RebuildPlayStats(plays)
+	return nil
+}
+
+// ConflictError is returned by SetRatingAndTags if the song was modified after the time
+// supplied by the caller.
+type ConflictError struct {
+	// Song contains the song's current state.
+	Song *db.Song
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("song was modified at %v", e.Song.LastModifiedTime)
 }
 
-// SetRatingAndTags updates the rating and tags of the song identified by id in datastore.
-// The rating is only updated if hasRating is true, and tags are not updated if tags is nil.
+// SetRatingAndTags updates the rating, tags, and notes of the song identified by id in datastore.
+// The rating is only updated if hasRating is true, tags are not updated if tags is nil,
+// and notes are only updated if hasNotes is true.
+// If ifLastModified is non-zero and the song's LastModifiedTime doesn't match it, the song
+// isn't updated and a *ConflictError is returned.
 // If delay is nonzero, the server will wait before writing to datastore.
+// The song's updated state is returned.
 func SetRatingAndTags(ctx context.Context, id int64, hasRating bool, rating int,
-	tags []string, delay time.Duration) error {
+	tags []string, hasNotes bool, notes string, ifLastModified time.Time,
+	delay time.Duration) (*db.Song, error) {
 	var ut query.UpdateTypes
+	var updated db.Song
 	err := updateExistingSong(ctx, id, func(ctx context.Context, s *db.Song) error {
+		ut = 0 // reset in case the transaction is retried
+		orig := *s
+		defer func() { updated = *s }()
 		if hasRating && rating != s.Rating {
 			s.SetRating(rating)
 			ut |= query.RatingUpdate
@@ -72,20 +192,145 @@ func SetRatingAndTags(ctx context.Context, id int64, hasRating bool, rating int,
 				ut |= query.TagsUpdate
 			}
 		}
+		if hasNotes {
+			oldNotes := s.Notes
+			if err := s.SetNotes(notes); err != nil {
+				return err
+			}
+			if s.Notes != oldNotes {
+				ut |= query.NotesUpdate
+			}
+		}
 		if ut == 0 {
 			return errUnmodified
 		}
+		// Only report a conflict if the song would actually be changed.
+		if !ifLastModified.IsZero() && !orig.LastModifiedTime.Equal(ifLastModified) {
+			return &ConflictError{Song: &orig}
+		}
 		s.LastModifiedTime = time.Now()
 		return nil
 	}, delay, true)
 
 	if err != nil {
-		return err
+		return nil, err
 	}
 	if ut != 0 {
-		return query.FlushCacheForUpdate(ctx, ut)
+		if err := stats.RecordChanges(ctx, time.Now(),
+			ut&query.RatingUpdate != 0, ut&query.TagsUpdate != 0); err != nil {
+			log.Errorf(ctx, "Failed recording changes to song %v: %v", id, err)
+		}
+		if err := query.FlushCacheForUpdate(ctx, ut); err != nil {
+			return nil, err
+		}
 	}
-	return nil
+	return &updated, nil
+}
+
+// SongEdit describes metadata changes made by EditSong. Nil fields are left unchanged.
+type SongEdit struct {
+	Artist *string
+	Title  *string
+	Album  *string
+	Date   *time.Time
+	Track  *int
+	Disc   *int
+}
+
+// apply copies e's non-nil fields to s.
+func (e *SongEdit) apply(s *db.Song) {
+	// Credits and sort names describe the original strings.
+	if e.Artist != nil && *e.Artist != s.Artist {
+		s.Artist = *e.Artist
+		s.ArtistCredits = nil
+		s.ArtistSortName = ""
+	}
+	if e.Title != nil {
+		s.Title = *e.Title
+	}
+	if e.Album != nil && *e.Album != s.Album {
+		s.Album = *e.Album
+		s.AlbumSortName = ""
+	}
+	if e.Date != nil {
+		s.Date = e.Date.UTC()
+	}
+	if e.Track != nil {
+		s.Track = *e.Track
+	}
+	if e.Disc != nil {
+		s.Disc = *e.Disc
+	}
+}
+
+// EditSong applies edit to the song identified by id in datastore, updating derived
+// fields like keywords and flushing cached queries. Note that the changes will be
+// overwritten if the song's file is reimported.
+// The song's original and updated states are returned.
+func EditSong(ctx context.Context, id int64, edit *SongEdit) (orig, updated *db.Song, err error) {
+	var before, after db.Song
+	var changed bool
+	if err := updateExistingSong(ctx, id, func(ctx context.Context, s *db.Song) error {
+		before, changed = *s, false // reset in case the transaction is retried
+		defer func() { after = *s }()
+		edited := *s
+		edit.apply(&edited)
+		if edited.MetadataEquals(s) {
+			return errUnmodified
+		}
+		if err := s.Update(&edited, false); err != nil {
+			return err
+		}
+		s.LastModifiedTime = time.Now()
+		changed = true
+		return nil
+	}, 0, true); err != nil {
+		return nil, nil, err
+	}
+
+	if changed {
+		if err := query.FlushCacheForUpdate(ctx, query.MetadataUpdate); err != nil {
+			return nil, nil, err
+		}
+	}
+	return &before, &after, nil
+}
+
+// RenameTag replaces tag from with to in up to max songs. It should be called repeatedly until
+// done is true. Songs that already have to just have from removed.
+func RenameTag(ctx context.Context, from, to string, max int) (updated int, done bool, err error) {
+	keys, err := datastore.NewQuery(db.SongKind).KeysOnly().
+		Filter("Tags =", from).Limit(max).GetAll(ctx, nil)
+	if err != nil {
+		return 0, false, err
+	}
+	for _, k := range keys {
+		if err := updateExistingSong(ctx, k.IntID(), func(ctx context.Context, s *db.Song) error {
+			tags := make([]string, 0, len(s.Tags))
+			for _, t := range s.Tags {
+				if t == from {
+					t = to
+				}
+				tags = append(tags, t)
+			}
+			s.Tags = tags
+			s.Clean() // sort and dedupe
+			s.LastModifiedTime = time.Now()
+			return nil
+		}, 0, false); err != nil {
+			return updated, false, fmt.Errorf("song %d: %v", k.IntID(), err)
+		}
+		updated++
+		if err := stats.RecordChanges(ctx, time.Now(), false, true); err != nil {
+			log.Errorf(ctx, "Failed recording changes to song %v: %v", k.IntID(), err)
+		}
+	}
+	if updated > 0 {
+		if err := query.FlushCacheForUpdate(ctx, query.TagsUpdate); err != nil {
+			return updated, false, err
+		}
+	}
+	return updated, len(keys) < max, nil
 }
 
 // UserDataPolicy indicates what UpdateOrInsertSong should do with existing user data
@@ -112,16 +357,37 @@ const (
 	UpdateByFilename
 )
 
+// findSongKeys returns the keys of songs in library (see db.Song.Library) with the
+// supplied value for the named property.
+func findSongKeys(ctx context.Context, prop string, val interface{}, library string) (
+	[]*datastore.Key, error) {
+	// Songs in the main library may lack Library properties, so filter the results in memory.
+	// Few songs should share a property value, so there's no need to use a keys-only query.
+	var songs []db.Song
+	keys, err := datastore.NewQuery(db.SongKind).Filter(prop+" =", val).GetAll(ctx, &songs)
+	if err != nil {
+		return nil, err
+	}
+	var matched []*datastore.Key
+	for i, k := range keys {
+		if songs[i].Library == library {
+			matched = append(matched, k)
+		}
+	}
+	return matched, nil
+}
+
 // UpdateOrInsertSong stores the supplied song in datastore.
+// Existing songs are only matched if they belong to the same library as updated.
 // If delay is nonzero, the server will wait before writing to datastore.
-func UpdateOrInsertSong(ctx context.Context, updated *db.Song,
-	dataPolicy UserDataPolicy, keyType UpdateKeyType, delay time.Duration) error {
-	base := datastore.NewQuery(db.SongKind).KeysOnly()
-	queryKeys, err := base.Filter("Sha1 =", updated.SHA1).GetAll(ctx, nil)
+// The song's ID is returned, along with its previous state if it was already present.
+func UpdateOrInsertSong(ctx context.Context, updated *db.Song, dataPolicy UserDataPolicy,
+	keyType UpdateKeyType, delay time.Duration) (id int64, prev *db.Song, err error) {
+	queryKeys, err := findSongKeys(ctx, "Sha1", updated.SHA1, updated.Library)
 	if err != nil {
-		return fmt.Errorf("querying for SHA1 %v failed: %v", updated.SHA1, err)
+		return 0, nil, fmt.Errorf("querying for SHA1 %v failed: %v", updated.SHA1, err)
 	} else if len(queryKeys) > 1 {
-		return fmt.Errorf("found %v songs with SHA1 %v", len(queryKeys), updated.SHA1)
+		return 0, nil, fmt.Errorf("found %v songs with SHA1 %v", len(queryKeys), updated.SHA1)
 	}
 
 	if keyType == UpdateByFilename {
@@ -129,19 +395,20 @@ func UpdateOrInsertSong(ctx context.Context, updated *db.Song,
 		if len(queryKeys) > 0 {
 			oldKey = queryKeys[0]
 		}
-		if queryKeys, err = base.Filter("Filename =", updated.Filename).GetAll(ctx, nil); err != nil {
-			return fmt.Errorf("querying for %q failed: %v", updated.Filename, err)
+		if queryKeys, err = findSongKeys(ctx, "Filename", updated.Filename, updated.Library); err != nil {
+			return 0, nil, fmt.Errorf("querying for %q failed: %v", updated.Filename, err)
 		} else if len(queryKeys) > 1 {
-			return fmt.Errorf("found %v songs with filename %q", len(queryKeys), updated.Filename)
+			return 0, nil, fmt.Errorf("found %v songs with filename %q", len(queryKeys), updated.Filename)
 		} else if oldKey != nil && (len(queryKeys) == 0 || queryKeys[0].IntID() != oldKey.IntID()) {
 			// If the song's SHA1 is already present in the database with a different filename,
 			// avoid inserting or updating another entity to have the same SHA1.
-			return fmt.Errorf("existing song %v already has SHA1 %v", oldKey.IntID(), updated.SHA1)
+			return 0, nil, fmt.Errorf("existing song %v already has SHA1 %v", oldKey.IntID(), updated.SHA1)
 		}
 	}
 
 	replace := dataPolicy == ReplaceUserData
-	return datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+	err = datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+		prev = nil // reset in case the transaction is retried
 		var key *datastore.Key
 		var song db.Song
 		if len(queryKeys) == 1 {
@@ -153,11 +420,23 @@ func UpdateOrInsertSong(ctx context.Context, updated *db.Song,
 				if err := datastore.Get(ctx, key, &song); err != nil {
 					return fmt.Errorf("getting song %v failed: %v", key.IntID(), err)
 				}
+				old := song
+				prev = &old
+			} else {
+				// Otherwise, just preserve the time at which the song was added.
+				var old db.Song
+				if err := datastore.Get(ctx, key, &old); err != nil {
+					return fmt.Errorf("getting song %v failed: %v", key.IntID(), err)
+				}
+				song.CreatedTime = old.CreatedTime
+				song.RandomKey = old.RandomKey
+				prev = &old
 			}
 		} else {
 			log.Debugf(ctx, "Inserting song with SHA1 %v and filename %q",
 				updated.SHA1, updated.Filename)
 			key = datastore.NewIncompleteKey(ctx, db.SongKind, nil)
+			song.CreatedTime = time.Now()
 		}
 
 		if err := song.Update(updated, replace); err != nil {
@@ -166,6 +445,7 @@ func UpdateOrInsertSong(ctx context.Context, updated *db.Song,
 		if replace {
 			song.RebuildPlayStats(updated.Plays)
 		}
+		song.AssignRandomKey()
 		song.LastModifiedTime = time.Now()
 
 		time.Sleep(delay)
@@ -174,6 +454,7 @@ func UpdateOrInsertSong(ctx context.Context, updated *db.Song,
 			return fmt.Errorf("putting %v failed: %v", key.IntID(), err)
 		}
 		log.Debugf(ctx, "Put song %v", key.IntID())
+		id = key.IntID()
 
 		if replace {
 			if err := replacePlays(ctx, key, updated.Plays); err != nil {
@@ -182,6 +463,10 @@ func UpdateOrInsertSong(ctx context.Context, updated *db.Song,
 		}
 		return nil
 	}, nil)
+	if err != nil {
+		return 0, nil, err
+	}
+	return id, prev, nil
 }
 
 // DeleteSong deletes the song identified by id from datastore.
@@ -228,8 +513,102 @@ func DeleteSong(ctx context.Context, id int64) error {
 	return query.FlushCacheForUpdate(ctx, query.MetadataUpdate)
 }
 
+// UndeleteSong restores the song identified by id (along with its plays) from the trash
+// after it was deleted by DeleteSong.
+func UndeleteSong(ctx context.Context, id int64) error {
+	if err := datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+		delSongKey := datastore.NewKey(ctx, db.DeletedSongKind, "", id, nil)
+		var song db.Song
+		if err := datastore.Get(ctx, delSongKey, &song); err != nil {
+			return fmt.Errorf("getting deleted song %v failed: %v", id, err)
+		}
+		plays := make([]db.Play, 0)
+		delPlayKeys, err := datastore.NewQuery(db.DeletedPlayKind).Ancestor(delSongKey).GetAll(ctx, &plays)
+		if err != nil {
+			return fmt.Errorf("getting deleted plays for song %v failed: %v", id, err)
+		}
+
+		songKey := datastore.NewKey(ctx, db.SongKind, "", id, nil)
+		if err := datastore.Get(ctx, songKey, &db.Song{}); err == nil {
+			return fmt.Errorf("song %v already exists", id)
+		} else if err != datastore.ErrNoSuchEntity {
+			return fmt.Errorf("checking for song %v failed: %v", id, err)
+		}
+
+		// Delete the deleted song and plays.
+		if err := datastore.Delete(ctx, delSongKey); err != nil {
+			return fmt.Errorf("deleting deleted song %v failed: %v", id, err)
+		}
+		if err := datastore.DeleteMulti(ctx, delPlayKeys); err != nil {
+			return fmt.Errorf("deleting %v deleted play(s) for song %v failed: %v", len(delPlayKeys), id, err)
+		}
+
+		// Put the restored song and plays. The modification time is updated so that
+		// clients that sync songs incrementally will see the song again.
+		song.LastModifiedTime = time.Now()
+		if _, err := datastore.Put(ctx, songKey, &song); err != nil { // must pass pointer
+			return fmt.Errorf("putting song %v failed: %v", id, err)
+		}
+		now := time.Now()
+		playKeys := make([]*datastore.Key, len(plays))
+		for i := range plays {
+			playKeys[i] = datastore.NewIncompleteKey(ctx, db.PlayKind, songKey)
+			plays[i].ReportTime = now
+		}
+		if _, err = datastore.PutMulti(ctx, playKeys, plays); err != nil {
+			return fmt.Errorf("putting %v play(s) for song %v failed: %v", len(plays), id, err)
+		}
+
+		return nil
+	}, &datastore.TransactionOptions{XG: true}); err != nil {
+		return err
+	}
+
+	return query.FlushCacheForUpdate(ctx, query.MetadataUpdate)
+}
+
+// PurgeDeletedSong permanently deletes the song identified by id (along with its plays)
+// from the trash.
+func PurgeDeletedSong(ctx context.Context, id int64) error {
+	return datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+		delSongKey := datastore.NewKey(ctx, db.DeletedSongKind, "", id, nil)
+		if err := datastore.Get(ctx, delSongKey, &db.Song{}); err != nil {
+			return fmt.Errorf("getting deleted song %v failed: %v", id, err)
+		}
+		delPlayKeys, err := datastore.NewQuery(db.DeletedPlayKind).Ancestor(delSongKey).
+			KeysOnly().GetAll(ctx, nil)
+		if err != nil {
+			return fmt.Errorf("getting deleted plays for song %v failed: %v", id, err)
+		}
+		if err := datastore.DeleteMulti(ctx, delPlayKeys); err != nil {
+			return fmt.Errorf("deleting %v deleted play(s) for song %v failed: %v", len(delPlayKeys), id, err)
+		}
+		if err := datastore.Delete(ctx, delSongKey); err != nil {
+			return fmt.Errorf("deleting deleted song %v failed: %v", id, err)
+		}
+		return nil
+	}, nil)
+}
+
+// PurgeDeletedSongs permanently deletes songs (along with their plays) that were moved to
+// the trash before the supplied time. The number of purged songs is returned.
+func PurgeDeletedSongs(ctx context.Context, before time.Time) (int, error) {
+	keys, err := datastore.NewQuery(db.DeletedSongKind).KeysOnly().
+		Filter("LastModifiedTime <", before).GetAll(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	for i, k := range keys {
+		if err := PurgeDeletedSong(ctx, k.IntID()); err != nil {
+			return i, err
+		}
+	}
+	return len(keys), nil
+}
+
 // ReindexSongs regenerates various fields for all songs in the database and updates songs that
 // were changed. If nextCursor is non-empty, ReindexSongs should be called again to continue reindexing.
+// Songs' RecentPlays and RandomKey fields are also populated if needed.
 func ReindexSongs(ctx context.Context, cursor string) (nextCursor string, scanned, updated int, err error) {
 	q := datastore.NewQuery(db.SongKind).KeysOnly()
 	if len(cursor) > 0 {
@@ -269,11 +648,28 @@ func ReindexSongs(ctx context.Context, cursor string) (nextCursor string, scanne
 				return err
 			}
 
-			// The Keywords field is derived from ArtistLower, TitleLower, and AlbumLower,
-			// so it will only change if one or more of those fields changed.
-			if up.ArtistLower == s.ArtistLower &&
+			// Populate the song's recent plays if they haven't been written yet.
+			recentPlaysChanged := false
+			if !s.RecentPlaysValid() {
+				songKey := datastore.NewKey(ctx, db.SongKind, "", id, nil)
+				if err := loadRecentPlays(ctx, songKey, s); err != nil {
+					return err
+				}
+				recentPlaysChanged = true
+			}
+
+			// The Keywords fields are also derived from other fields like AlbumArtist and
+			// Composer, so compare them directly to pick up newly-indexed fields.
+			if !recentPlaysChanged &&
+				s.RandomKey != 0 &&
+				up.ArtistLower == s.ArtistLower &&
+				reflect.DeepEqual(up.ArtistsLower, s.ArtistsLower) &&
 				up.TitleLower == s.TitleLower &&
 				up.AlbumLower == s.AlbumLower &&
+				reflect.DeepEqual(up.GenresLower, s.GenresLower) &&
+				reflect.DeepEqual(up.Keywords, s.Keywords) &&
+				reflect.DeepEqual(up.KeywordPrefixes, s.KeywordPrefixes) &&
+				reflect.DeepEqual(up.KeywordVariants, s.KeywordVariants) &&
 				up.RatingAtLeast1 == s.RatingAtLeast1 &&
 				up.RatingAtLeast2 == s.RatingAtLeast2 &&
 				up.RatingAtLeast3 == s.RatingAtLeast3 &&
@@ -284,14 +680,19 @@ func ReindexSongs(ctx context.Context, cursor string) (nextCursor string, scanne
 
 			// LastModifiedTime isn't updated since these fields aren't exposed to clients.
 			s.ArtistLower = up.ArtistLower
+			s.ArtistsLower = up.ArtistsLower
 			s.TitleLower = up.TitleLower
 			s.AlbumLower = up.AlbumLower
+			s.GenresLower = up.GenresLower
 			s.Keywords = up.Keywords
+			s.KeywordPrefixes = up.KeywordPrefixes
+			s.KeywordVariants = up.KeywordVariants
 			s.RatingAtLeast1 = up.RatingAtLeast1
 			s.RatingAtLeast2 = up.RatingAtLeast2
 			s.RatingAtLeast3 = up.RatingAtLeast3
 			s.RatingAtLeast4 = up.RatingAtLeast4
 			s.Tags = up.Tags
+			s.AssignRandomKey()
 
 			update = true
 			return nil
@@ -315,7 +716,7 @@ func ClearData(ctx context.Context) error {
 	}
 
 	log.Debugf(ctx, "Clearing all data")
-	for _, kind := range []string{db.SongKind, db.PlayKind} {
+	for _, kind := range []string{db.SongKind, db.PlayKind, db.BulkImportKind} {
 		keys, err := datastore.NewQuery(kind).KeysOnly().GetAll(ctx, nil)
 		if err != nil {
 			return fmt.Errorf("getting all %v keys failed: %v", kind, err)
@@ -348,9 +749,11 @@ func replacePlays(ctx context.Context, songKey *datastore.Key, plays []db.Play)
 		return err
 	}
 
+	now := time.Now()
 	playKeys = make([]*datastore.Key, len(plays))
 	for i := range plays {
 		playKeys[i] = datastore.NewIncompleteKey(ctx, db.PlayKind, songKey)
+		plays[i].ReportTime = now
 	}
 	if _, err = datastore.PutMulti(ctx, playKeys, plays); err != nil {
 		return err
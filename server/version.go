@@ -0,0 +1,111 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/derat/nup/server/cache"
+	"github.com/derat/nup/server/config"
+	"github.com/derat/nup/server/storage"
+
+	"google.golang.org/appengine/v2/log"
+	"google.golang.org/appengine/v2/memcache"
+)
+
+const (
+	versionParam = "v" // query parameter containing an object version in versioned URLs
+
+	versionKeyPrefix  = "objver"         // memcache key prefix for object versions
+	versionExpiration = 30 * time.Minute // memcache expiration for object versions
+)
+
+// versionKey returns the memcache key used to cache the version of the object named fn in bucket.
+func versionKey(bucket, fn string) string {
+	// Memcache keys are limited to 250 bytes, so hash the object's name.
+	return fmt.Sprintf("%s-%x", versionKeyPrefix, sha1.Sum([]byte(bucket+"/"+fn)))
+}
+
+// getObjectVersion returns the version (see storage.ObjectVersion) of the object named fn
+// in bucket, using memcache if possible.
+func getObjectVersion(ctx context.Context, bucket, fn string) (string, error) {
+	key := versionKey(bucket, fn)
+	if item, err := memcache.Get(ctx, key); err == nil {
+		return string(item.Value), nil
+	} else if err != memcache.ErrCacheMiss {
+		log.Errorf(ctx, "Getting cached version of %q failed: %v", fn, err) // swallow error
+	}
+	ver, err := storage.ObjectVersion(ctx, bucket, fn)
+	if err != nil {
+		return "", err
+	}
+	if err := memcache.Set(ctx, &memcache.Item{
+		Key:        key,
+		Value:      []byte(ver),
+		Expiration: versionExpiration,
+	}); err != nil {
+		log.Errorf(ctx, "Caching version of %q failed: %v", fn, err) // swallow error
+	}
+	return ver, nil
+}
+
+// forgetObjectVersion deletes the cached version of the object named fn in bucket.
+func forgetObjectVersion(ctx context.Context, bucket, fn string) error {
+	return cache.DeleteMemcache(ctx, versionKey(bucket, fn))
+}
+
+// useVersionedURLs returns true if /cover and /song requests for objects in bucket should
+// be redirected to versioned URLs (see config.CacheConfig.VersionedSec).
+func useVersionedURLs(cfg *config.Config, bucket string) bool {
+	return bucket != "" && cfg.Cache != nil && cfg.Cache.VersionedSec > 0
+}
+
+// needsSongVersionRedirect returns true if the /song request r will be redirected to
+// a versioned URL by checkVersion because it lacks a version parameter.
+func needsSongVersionRedirect(cfg *config.Config, r *http.Request) bool {
+	// Other libraries always use buckets, so only the main library needs to be checked.
+	return useVersionedURLs(cfg, cfg.SongBucket) && r.FormValue(versionParam) == "" &&
+		!cfg.UseSignedSongURL(r)
+}
+
+// checkVersion sets caching headers in w for a response containing the object named fn
+// in bucket. maxAge contains the lifetime in seconds for unversioned responses.
+// If versioned URLs are enabled and r's version parameter doesn't match the object's
+// current version, r is redirected to the object's versioned URL and false is returned.
+// False is also returned if an error was written to w.
+func checkVersion(ctx context.Context, cfg *config.Config, w http.ResponseWriter,
+	r *http.Request, bucket, fn string, maxAge int) bool {
+	if !useVersionedURLs(cfg, bucket) {
+		addCacheHeaders(w, maxAge)
+		return true
+	}
+
+	ver, err := getObjectVersion(ctx, bucket, fn)
+	if err != nil {
+		log.Errorf(ctx, "Getting version of %q failed: %v", fn, err)
+		if os.IsNotExist(err) {
+			http.Error(w, "Not found", http.StatusNotFound)
+		} else {
+			http.Error(w, "Failed getting version", http.StatusInternalServerError)
+		}
+		return false
+	}
+	if r.FormValue(versionParam) == ver {
+		addCacheHeaders(w, cfg.Cache.VersionedSec)
+		return true
+	}
+
+	u := *r.URL
+	q := u.Query()
+	q.Set(versionParam, ver)
+	u.RawQuery = q.Encode()
+	addCacheHeaders(w, maxAge)
+	http.Redirect(w, r, u.String(), http.StatusFound)
+	return false
+}
@@ -5,7 +5,9 @@
 package e2e
 
 import (
+	"archive/tar"
 	"bytes"
+	"compress/gzip"
 	"encoding/json"
 	"flag"
 	"fmt"
@@ -24,6 +26,8 @@ import (
 
 	"github.com/derat/nup/server/config"
 	"github.com/derat/nup/server/db"
+	"github.com/derat/nup/server/dump"
+	"github.com/derat/nup/server/migrate"
 	"github.com/derat/nup/server/query"
 	"github.com/derat/nup/test"
 
@@ -36,6 +40,11 @@ const (
 	guestUsername    = "guest"
 	guestPassword    = "guestpw"
 	maxGuestRequests = 3
+
+	normalUsername = "normal" // non-admin, non-guest user
+	normalPassword = "normalpw"
+
+	otherLibrary = "other" // name of additional library in config
 )
 
 var (
@@ -48,8 +57,9 @@ var (
 	LegacySong1   = test.LegacySong1
 	LegacySong2   = test.LegacySong2
 
-	appURL string // URL of App Engine app
-	outDir string // base directory for temp files and logs
+	appURL    string // URL of App Engine app
+	outDir    string // base directory for temp files and logs
+	coversDir string // directory served as the server's cover base URL
 
 	guestExcludedTags = []string{"rock"}
 	guestPresets      = []config.SearchPreset{{Name: "custom", MinRating: 4}}
@@ -98,6 +108,21 @@ func runTests(m *testing.M) (res int, err error) {
 	songsSrv := test.ServeFiles(songsDir)
 	defer songsSrv.Close()
 
+	// Serve a directory where tests can write cover images for the server's /cover and
+	// /covers_bundle endpoints.
+	coversDir = filepath.Join(outDir, "covers")
+	if err := os.MkdirAll(coversDir, 0755); err != nil {
+		return -1, err
+	}
+	coversSrv := test.ServeFiles(coversDir)
+	defer coversSrv.Close()
+
+	// Choose the app's port up front so share links can be built from a configured base URL.
+	ports, err := test.FindUnusedPorts(1)
+	if err != nil {
+		return -1, err
+	}
+
 	cfg := &config.Config{
 		Users: []config.User{
 			{Username: test.Username, Password: test.Password, Admin: true},
@@ -108,13 +133,24 @@ func runTests(m *testing.M) (res int, err error) {
 				Presets:      guestPresets,
 				ExcludedTags: guestExcludedTags,
 			},
+			{Username: normalUsername, Password: normalPassword},
 		},
 		SongBaseURL:                 songsSrv.URL,
-		CoverBaseURL:                songsSrv.URL, // bogus, but no tests request covers
+		CoverBaseURL:                coversSrv.URL,
 		MaxGuestSongRequestsPerHour: maxGuestRequests,
+		RateLimits: []config.RateLimit{
+			{Path: "/now", Users: []string{guestUsername}, MaxRequests: maxGuestRequests, IntervalSec: 3600},
+		},
+		ShareSecret:  "share-secret",
+		ShareBaseURL: fmt.Sprintf("http://localhost:%d/", ports[0]),
+		Libraries: []config.Library{
+			// Bogus buckets, but no tests request the library's songs or covers.
+			{Name: otherLibrary, SongBucket: "other-song-bucket", CoverBucket: "other-cover-bucket"},
+		},
 	}
 	storageDir := filepath.Join(outDir, "app_storage")
-	srv, err := test.NewDevAppserver(cfg, storageDir, appLog, test.DevAppserverCreateIndexes(*createIndexes))
+	srv, err := test.NewDevAppserver(cfg, storageDir, appLog,
+		test.DevAppserverPort(ports[0]), test.DevAppserverCreateIndexes(*createIndexes))
 	if err != nil {
 		return -1, fmt.Errorf("dev_appserver: %v", err)
 	}
@@ -162,6 +198,7 @@ func compareQueryResults(expected, actual []db.Song, order test.OrderPolicy) err
 			return fmt.Errorf("song %v (%v) has no ID", i, s.Filename)
 		}
 		s.SongID = ""
+		s.LastModifiedNsec = 0
 
 		if len(s.Tags) == 0 {
 			s.Tags = nil
@@ -252,6 +289,7 @@ func TestUserData(tt *testing.T) {
 		db.NewPlay(test.Date(2014, 9, 15, 2, 13, 4), "127.0.0.1"),
 	}
 	for i, p := range s.Plays {
+		s.Plays[i].User = test.Username // recorded by the server
 		if i < len(s.Plays)-1 {
 			t.ReportPlayed(id, p.StartTime) // RFC 3339
 		} else {
@@ -612,6 +650,87 @@ func TestCaching(tt *testing.T) {
 	}
 }
 
+func TestAbandonedBulkImport(tt *testing.T) {
+	t, done := initTest(tt)
+	defer done()
+
+	t.SetBulkImportTimeout(time.Second)
+	defer t.SetBulkImportTimeout(0)
+
+	log.Print("Posting and querying a song")
+	const cacheParam = "cacheOnly=1"
+	s1, s2, s3 := LegacySong1, LegacySong2, Song0s
+	t.PostSongs([]db.Song{s1}, true, 0)
+	if err := compareQueryResults([]db.Song{s1}, t.QuerySongs(), test.IgnoreOrder); err != nil {
+		tt.Error("Bad results before bulk import: ", err)
+	}
+
+	// Cached queries shouldn't be flushed while the bulk import session is in progress.
+	log.Print("Starting bulk import")
+	t.PostSongsBulk([]db.Song{s2})
+	if err := compareQueryResults([]db.Song{s1}, t.QuerySongs(cacheParam), test.IgnoreOrder); err != nil {
+		tt.Error("Bad cached results during bulk import: ", err)
+	}
+
+	// After the session is abandoned, the next bulk import request should start a new
+	// session and flush cached queries so the songs from the old session are returned.
+	log.Print("Abandoning bulk import and starting a new one")
+	time.Sleep(2 * time.Second)
+	t.PostSongsBulk([]db.Song{s3})
+	if err := compareQueryResults([]db.Song{s1, s2, s3}, t.QuerySongs(), test.IgnoreOrder); err != nil {
+		tt.Error("Bad results after replacing abandoned session: ", err)
+	}
+
+	// Stats updates should also end abandoned sessions and flush cached queries.
+	log.Print("Abandoning bulk import and updating stats")
+	s4 := Song1s
+	t.PostSongsBulk([]db.Song{s4})
+	time.Sleep(2 * time.Second)
+	t.UpdateStats()
+	if err := compareQueryResults([]db.Song{s1, s2, s3, s4}, t.QuerySongs(), test.IgnoreOrder); err != nil {
+		tt.Error("Bad results after updating stats: ", err)
+	}
+}
+
+func TestExportPlaysByReportTime(tt *testing.T) {
+	t, done := initTest(tt)
+	defer done()
+
+	s := Song0s
+	t.PostSongs([]db.Song{s}, true, 0)
+	id := t.SongID(s.SHA1)
+
+	// Report a play that started long before it was reported (e.g. by an offline client).
+	log.Print("Reporting delayed play")
+	now := t.GetNowFromServer()
+	start := now.Add(-30 * 24 * time.Hour).Truncate(time.Second)
+	t.ReportPlayed(id, start)
+
+	checkPlays := func(param string, want []time.Time) {
+		var got []time.Time
+		for _, pd := range t.ExportPlays(param) {
+			if pd.SongID == id {
+				got = append(got, pd.Play.StartTime)
+			}
+		}
+		if len(got) != len(want) {
+			tt.Errorf("Exporting with %q returned %v; want %v", param, got, want)
+			return
+		}
+		for i := range want {
+			if !got[i].Equal(want[i]) {
+				tt.Errorf("Exporting with %q returned %v; want %v", param, got, want)
+				return
+			}
+		}
+	}
+	nowNsec := strconv.FormatInt(now.UnixNano(), 10)
+	checkPlays("minReportTimeNsec="+nowNsec, []time.Time{start})
+	checkPlays("minStartTimeNsec="+nowNsec, nil)
+	later := strconv.FormatInt(t.GetNowFromServer().Add(time.Second).UnixNano(), 10)
+	checkPlays("minReportTimeNsec="+later, nil)
+}
+
 func TestAndroid(tt *testing.T) {
 	t, done := initTest(tt)
 	defer done()
@@ -646,6 +765,7 @@ func TestAndroid(tt *testing.T) {
 	// Reporting a play shouldn't update the song's last-modified time.
 	log.Print("Reporting play")
 	p := db.NewPlay(test.Date(2014, 9, 15, 2, 5, 18), "127.0.0.1")
+	p.User = test.Username
 	updatedLegacySong1.Plays = append(updatedLegacySong1.Plays, p)
 	now = t.GetNowFromServer()
 	t.ReportPlayed(id, p.StartTime)
@@ -695,6 +815,61 @@ func TestTags(tt *testing.T) {
 	}
 }
 
+func TestETags(tt *testing.T) {
+	t, done := initTest(tt)
+	defer done()
+
+	// send sends a GET request for path with the supplied If-None-Match header
+	// and returns the status code and ETag.
+	send := func(path, inm string) (int, string) {
+		req := t.NewRequest("GET", path, nil)
+		if inm != "" {
+			req.Header.Set("If-None-Match", inm)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			tt.Fatalf("Request for %v failed: %v", path, err)
+		}
+		defer resp.Body.Close()
+		if _, err := io.ReadAll(resp.Body); err != nil {
+			tt.Fatalf("Failed reading %v body: %v", path, err)
+		}
+		return resp.StatusCode, resp.Header.Get("ETag")
+	}
+
+	log.Print("Posting song")
+	t.PostSongs([]db.Song{LegacySong1}, true, 0)
+	id := t.SongID(LegacySong1.SHA1)
+
+	for _, path := range []string{"query?artist=" + url.QueryEscape(LegacySong1.Artist), "tags"} {
+		log.Printf("Checking /%v ETags", path)
+		code, etag := send(path, "")
+		if code != http.StatusOK || etag == "" {
+			tt.Fatalf("Initial request for /%v returned %v with ETag %q", path, code, etag)
+		}
+		if code, _ := send(path, etag); code != http.StatusNotModified {
+			tt.Errorf("Request for /%v with matching ETag returned %v; want %v",
+				path, code, http.StatusNotModified)
+		}
+		if code, _ := send(path, `"bogus"`); code != http.StatusOK {
+			tt.Errorf("Request for /%v with bogus ETag returned %v; want %v", path, code, http.StatusOK)
+		}
+
+		// The ETag should change after the song is updated.
+		t.RateAndTag(id, -1, []string{"tag-for-" + strings.Split(path, "?")[0]})
+		if code, newEtag := send(path, etag); code != http.StatusOK || newEtag == etag {
+			tt.Errorf("Request for /%v after update returned %v with ETag %q", path, code, newEtag)
+		}
+	}
+
+	// Shuffled and cache-only results can differ between requests, so they shouldn't have ETags.
+	for _, path := range []string{"query?shuffle=1", "query?shuffleAlbums=1", "query?cacheOnly=1"} {
+		if code, etag := send(path, ""); code != http.StatusOK || etag != "" {
+			tt.Errorf("Request for /%v returned %v with ETag %q", path, code, etag)
+		}
+	}
+}
+
 func TestCovers(tt *testing.T) {
 	t, done := initTest(tt)
 	defer done()
@@ -784,7 +959,9 @@ func TestJSONImport(tt *testing.T) {
 	id := t.SongID(us.SHA1)
 	st := test.Date(2014, 9, 15, 2, 5, 18)
 	t.ReportPlayed(id, st)
-	us.Plays = append(us.Plays, db.NewPlay(st, "127.0.0.1"))
+	p := db.NewPlay(st, "127.0.0.1")
+	p.User = test.Username
+	us.Plays = append(us.Plays, p)
 	if err := test.CompareSongs([]db.Song{us, LegacySong2},
 		t.DumpSongs(test.StripIDs), test.IgnoreOrder); err != nil {
 		tt.Error("Bad songs after reporting play: ", err)
@@ -951,6 +1128,15 @@ func TestDeleteSong(tt *testing.T) {
 		tt.Errorf("Deleted song's ID (%v) didn't match original id (%v)",
 			deletedSongs[0].SongID, id2)
 	}
+
+	log.Print("Restoring first song")
+	t.RestoreSong(id1)
+	if err := compareQueryResults([]db.Song{LegacySong1}, t.QuerySongs(), test.IgnoreOrder); err != nil {
+		tt.Error("Bad results after restoring song: ", err)
+	}
+	if got := t.SongID(LegacySong1.SHA1); got != id1 {
+		tt.Errorf("Restored song's ID (%v) didn't match original id (%v)", got, id1)
+	}
 }
 
 func TestMergeSongs(tt *testing.T) {
@@ -1030,12 +1216,33 @@ func TestStats(tt *testing.T) {
 	s2 := Song5s
 	s2.Rating = 5
 	s2.Tags = []string{"guitar", "vocals"}
+	s2.Genres = []string{"Rock", "Post-Rock"}
 	s2.Plays = []db.Play{
 		db.NewPlay(test.Date(2013, 9, 15, 2, 5, 18), "127.0.0.1"),
 		db.NewPlay(test.Date(2014, 9, 15, 2, 5, 18), "127.0.0.1"),
 	}
 	s3 := Song10s
 	t.PostSongs([]db.Song{s1, s2, s3}, true, 0)
+	month := time.Now().Format("2006-01")
+
+	log.Print("Rating, tagging, and deleting songs")
+	t.RateAndTag(t.SongID(s3.SHA1), 3, []string{"drums"})
+	t.RateAndTag(t.SongID(s2.SHA1), 4, nil)
+	t.DeleteSong(t.SongID(s1.SHA1))
+
+	log.Print("Fetching song data")
+	resp, err := http.DefaultClient.Do(
+		t.NewRequest("GET", "song?filename="+url.QueryEscape(s3.Filename), nil))
+	if err != nil {
+		tt.Fatal("Fetching song failed: ", err)
+	}
+	data, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		tt.Fatal("Reading song failed: ", err)
+	} else if resp.StatusCode != http.StatusOK {
+		tt.Fatalf("Fetching song returned %v", resp.StatusCode)
+	}
 
 	log.Print("Updating stats")
 	t.UpdateStats()
@@ -1046,23 +1253,173 @@ func TestStats(tt *testing.T) {
 		tt.Error("Stats update time is zero")
 	}
 	want := db.Stats{
-		Songs:       3,
-		Albums:      3,
-		TotalSec:    s1.Length + s2.Length + s3.Length,
-		Ratings:     map[int]int{0: 1, 4: 1, 5: 1},
-		SongDecades: map[int]int{0: 1, 2000: 1, 2010: 1},
-		Tags:        map[string]int{"guitar": 2, "instrumental": 1, "vocals": 1},
+		Songs:       2,
+		Albums:      2,
+		TotalSec:    s2.Length + s3.Length,
+		Ratings:     map[int]int{3: 1, 4: 1},
+		SongDecades: map[int]int{0: 1, 2010: 1},
+		BPMs:        map[int]int{},
+		Tags:        map[string]int{"drums": 1, "guitar": 1, "vocals": 1},
+		Genres:      map[string]int{"post-rock": 1, "rock": 1},
+		// Songs are upgraded to the current schema when they're saved.
+		SchemaVersion:  migrate.CurrentVersion(),
+		SchemaVersions: map[int]int{migrate.CurrentVersion(): 2},
 		Years: map[int]db.PlayStats{
 			2013: {Plays: 1, TotalSec: s2.Length, FirstPlays: 1},
-			2014: {Plays: 2, TotalSec: s1.Length + s2.Length, FirstPlays: 1, LastPlays: 2},
+			2014: {Plays: 1, TotalSec: s2.Length, LastPlays: 1},
+		},
+		Months: map[string]db.ChangeStats{
+			month: {Added: 3, Deleted: 1, Retagged: 1, Rerated: 2},
+		},
+		TopArtists: []db.PlayedItem{{Artist: s2.Artist, Plays: 2, TotalSec: 2 * s2.Length}},
+		TopAlbums: []db.PlayedItem{
+			{Artist: s2.Artist, Album: s2.Album, AlbumID: s2.AlbumID, Plays: 2, TotalSec: 2 * s2.Length},
+		},
+		Hours:    got.Hours,    // checked below
+		Weekdays: got.Weekdays, // checked below
+		Transfers: map[string]db.TransferStats{
+			s3.Filename: {Starts: 1, Full: 1, Bytes: int64(len(data))},
 		},
 		UpdateTime: got.UpdateTime, // checked for non-zero earlier
 	}
+	// The server's time zone may differ from ours, so just check the totals.
+	var hours, weekdays int
+	for _, n := range got.Hours {
+		hours += n
+	}
+	for _, n := range got.Weekdays {
+		weekdays += n
+	}
+	if hours != 2 || weekdays != 2 {
+		tt.Errorf("Got %v play(s) in hours and %v in weekdays; want 2", hours, weekdays)
+	}
 	if !reflect.DeepEqual(got, want) {
 		tt.Errorf("Got %+v, want %+v", got, want)
 	}
 }
 
+func TestAudit(tt *testing.T) {
+	t, done := initTest(tt)
+	defer done()
+
+	log.Print("Posting, rating, and deleting song")
+	t.PostSongs([]db.Song{Song0s}, true, 0)
+	id := t.SongID(Song0s.SHA1)
+	t.RateAndTag(id, 3, []string{"drums"})
+	t.DeleteSong(id)
+
+	log.Print("Checking audit entries")
+	entries := t.GetAudit("songId=" + id)
+	var endpoints []string
+	for _, e := range entries {
+		endpoints = append(endpoints, e.Endpoint)
+		if strconv.FormatInt(e.SongID, 10) != id {
+			tt.Errorf("%v entry has song ID %v; want %v", e.Endpoint, e.SongID, id)
+		}
+	}
+	if want := []string{"/delete_song", "/rate_and_tag", "/import"}; !reflect.DeepEqual(endpoints, want) {
+		tt.Fatalf("Got endpoints %q; want %q", endpoints, want)
+	}
+	if e := entries[1]; !strings.Contains(e.After, "rating=3 tags=[drums]") {
+		tt.Errorf("Rating entry has after %q", e.After)
+	}
+	if e := entries[0]; e.Before != entries[1].After || e.After != "deleted" {
+		tt.Errorf("Deletion entry has before %q and after %q", e.Before, e.After)
+	}
+}
+
+func TestEditSong(tt *testing.T) {
+	t, done := initTest(tt)
+	defer done()
+
+	log.Print("Posting and editing song")
+	t.PostSongs([]db.Song{Song0s}, true, 0)
+	id := t.SongID(Song0s.SHA1)
+	t.EditSong(id, "title="+url.QueryEscape("Fixed Title")+"&track=3&date=2001-02-03T00:00:00Z")
+
+	s := Song0s
+	s.Title = "Fixed Title"
+	s.Track = 3
+	s.Date = test.Date(2001, 2, 3)
+	for _, tc := range []struct {
+		query string
+		want  []db.Song
+	}{
+		{"keywords=fixed", []db.Song{s}},
+		{"keywords=zero", []db.Song{}},
+		{"title=fixed+title", []db.Song{s}},
+		{"artist=" + url.QueryEscape(Song0s.Artist), []db.Song{s}},
+	} {
+		if err := compareQueryResults(tc.want, t.QuerySongs(tc.query), test.IgnoreOrder); err != nil {
+			tt.Errorf("%v: %v", tc.query, err)
+		}
+	}
+
+	log.Print("Checking audit entry")
+	entries := t.GetAudit("songId=" + id)
+	if len(entries) == 0 || entries[0].Endpoint != "/edit_song" {
+		tt.Fatalf("Didn't get /edit_song audit entry: %+v", entries)
+	}
+	if e := entries[0]; !strings.Contains(e.Before, `title="Zero Seconds"`) ||
+		!strings.Contains(e.After, `title="Fixed Title" album="First Album" date=2001-02-03 track=3`) {
+		tt.Errorf("Edit entry has before %q and after %q", e.Before, e.After)
+	}
+}
+
+func TestRateAndTagConflict(tt *testing.T) {
+	t, done := initTest(tt)
+	defer done()
+
+	log.Print("Posting song")
+	t.PostSongs([]db.Song{Song0s}, false, 0)
+	id := t.SongID(Song0s.SHA1)
+	orig := t.GetSongsByID([]string{id}, "")[0]
+	if orig.LastModifiedNsec == 0 {
+		tt.Fatal("Song has no last-modified time")
+	}
+
+	send := func(params string) (int, db.Song) {
+		req := t.NewRequest("POST", "rate_and_tag?songId="+id+params, nil)
+		req.SetBasicAuth(test.Username, test.Password)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			tt.Fatalf("Request with %q failed: %v", params, err)
+		}
+		defer resp.Body.Close()
+		var s db.Song
+		if err := json.NewDecoder(resp.Body).Decode(&s); err != nil {
+			tt.Fatalf("Failed decoding song from request with %q: %v", params, err)
+		}
+		return resp.StatusCode, s
+	}
+
+	log.Print("Tagging song with precondition")
+	since := fmt.Sprintf("&ifLastModifiedNsec=%d", orig.LastModifiedNsec)
+	code, s := send("&tags=electronic" + since)
+	if code != http.StatusOK {
+		tt.Fatalf("First update returned %v; want %v", code, http.StatusOK)
+	} else if !reflect.DeepEqual(s.Tags, []string{"electronic"}) || s.LastModifiedNsec <= orig.LastModifiedNsec {
+		tt.Errorf("First update returned tags %q and last-modified %v", s.Tags, s.LastModifiedNsec)
+	}
+
+	log.Print("Tagging song with stale precondition")
+	code, cur := send("&tags=instrumental" + since)
+	if code != http.StatusConflict {
+		tt.Fatalf("Stale update returned %v; want %v", code, http.StatusConflict)
+	} else if !reflect.DeepEqual(cur.Tags, s.Tags) || cur.LastModifiedNsec != s.LastModifiedNsec {
+		tt.Errorf("Stale update returned tags %q and last-modified %v; want %q and %v",
+			cur.Tags, cur.LastModifiedNsec, s.Tags, s.LastModifiedNsec)
+	}
+
+	log.Print("Retrying with current precondition")
+	code, s = send(fmt.Sprintf("&tags=electronic+instrumental&ifLastModifiedNsec=%d", cur.LastModifiedNsec))
+	if code != http.StatusOK {
+		tt.Fatalf("Retried update returned %v; want %v", code, http.StatusOK)
+	} else if want := []string{"electronic", "instrumental"}; !reflect.DeepEqual(s.Tags, want) {
+		tt.Errorf("Retried update returned tags %q; want %q", s.Tags, want)
+	}
+}
+
 func TestUpdateError(tt *testing.T) {
 	t, done := initTest(tt)
 	defer done()
@@ -1095,6 +1452,67 @@ func TestUpdateError(tt *testing.T) {
 	}
 }
 
+func TestAPITokens(tt *testing.T) {
+	t, done := initTest(tt)
+	defer done()
+
+	log.Print("Posting song")
+	t.PostSongs([]db.Song{Song0s}, false, 0)
+	songID := t.SongID(Song0s.SHA1)
+
+	send := func(method, path, token string) int {
+		req, err := http.NewRequest(method, appURL+path, nil)
+		if err != nil {
+			tt.Fatalf("Failed creating %v request for %v: %v", method, path, err)
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			tt.Fatalf("%v request for %v failed: %v", method, path, err)
+		}
+		defer resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	log.Print("Creating tokens")
+	readID, readTok := t.CreateAPIToken("read")
+	_, updateTok := t.CreateAPIToken("update")
+	_, adminTok := t.CreateAPIToken("admin")
+
+	const queryPath = "query?artist=First+Artist"
+	ratePath := "rate_and_tag?songId=" + songID + "&rating=4"
+	for _, tc := range []struct {
+		scope, token string
+		method, path string
+		want         int
+	}{
+		{"read", readTok, "GET", queryPath, http.StatusOK},
+		{"read", readTok, "POST", ratePath, http.StatusForbidden},
+		{"read", readTok, "POST", "queue", http.StatusForbidden},
+		{"read", readTok, "PUT", "settings", http.StatusForbidden},
+		{"read", readTok, "GET", "jobs", http.StatusForbidden},
+		{"update", updateTok, "GET", queryPath, http.StatusOK},
+		{"update", updateTok, "POST", ratePath, http.StatusOK},
+		{"update", updateTok, "GET", "jobs", http.StatusForbidden},
+		{"admin", adminTok, "GET", "jobs", http.StatusOK},
+		{"bogus", "bogus", "GET", queryPath, http.StatusUnauthorized},
+	} {
+		if got := send(tc.method, tc.path, tc.token); got != tc.want {
+			tt.Errorf("%v %v with %v token returned %v; want %v", tc.method, tc.path, tc.scope, got, tc.want)
+		}
+	}
+
+	log.Print("Revoking token")
+	t.RevokeAPIToken(readID)
+	if got := send("GET", queryPath, readTok); got != http.StatusUnauthorized {
+		tt.Errorf("GET %v with revoked token returned %v; want %v", queryPath, got, http.StatusUnauthorized)
+	}
+	if got := send("GET", queryPath, updateTok); got != http.StatusOK {
+		tt.Errorf("GET %v with update token returned %v after revoking read token; want %v",
+			queryPath, got, http.StatusOK)
+	}
+}
+
 func TestGuestUser(tt *testing.T) {
 	t, done := initTest(tt)
 	defer done()
@@ -1188,16 +1606,35 @@ func TestGuestUser(tt *testing.T) {
 		tt.Fatalf("Guest request for /query returned %q; want %q", got, want)
 	}
 
+	log.Print("Checking that songs with excluded tags are hidden")
+	if code, got := send("GET", "songs_by_id?ids="+songID, guestUsername, guestPassword); code != http.StatusOK {
+		tt.Fatalf("Guest request for /songs_by_id returned %v; want %v", code, http.StatusOK)
+	} else if want := "[null]"; string(got) != want {
+		tt.Fatalf("Guest request for /songs_by_id returned %q; want %q", got, want)
+	}
+	songPath := "song?filename=" + url.QueryEscape(Song0s.Filename)
+	for _, path := range []string{"dump_song?songId=" + songID, songPath} {
+		if code, _ := send("GET", path, guestUsername, guestPassword); code != http.StatusNotFound {
+			tt.Fatalf("Guest request for /%v returned %v; want %v", path, code, http.StatusNotFound)
+		}
+	}
+
+	// Remove the excluded tag so the guest user can fetch the song.
+	retagPath := "rate_and_tag?songId=" + songID + "&tags=drums+guitar"
+	if code, _ := send("POST", retagPath, test.Username, test.Password); code != http.StatusOK {
+		tt.Fatalf("Normal request for /%v returned %v; want %v", retagPath, code, http.StatusOK)
+	}
+
 	// Normal (or admin) users should be able to go above the guest rate limit for /song.
 	log.Print("Checking /song rate-limiting")
-	songPath := "song?filename=" + url.QueryEscape(Song0s.Filename)
 	for i := 0; i <= maxGuestRequests; i++ {
 		if code, _ := send("GET", songPath, test.Username, test.Password); code != http.StatusOK {
 			tt.Fatalf("Normal request %v for /%v returned %v; want %v", i, songPath, code, http.StatusOK)
 		}
 	}
 	// The guest user should get an error when they exceed the limit.
-	for i := 0; i <= maxGuestRequests; i++ {
+	// The earlier request for the song with an excluded tag also counted against the limit.
+	for i := 1; i <= maxGuestRequests; i++ {
 		want := http.StatusOK
 		if i == maxGuestRequests {
 			want = http.StatusTooManyRequests
@@ -1207,3 +1644,725 @@ func TestGuestUser(tt *testing.T) {
 		}
 	}
 }
+
+func TestGuestPinnedSongs(tt *testing.T) {
+	t, done := initTest(tt)
+	defer done()
+
+	log.Print("Posting songs")
+	t.PostSongs([]db.Song{Song0s, Song1s}, true, 0)
+	id0 := t.SongID(Song0s.SHA1)
+
+	send := func(method, path string) int {
+		req := t.NewRequest(method, path, nil)
+		req.SetBasicAuth(guestUsername, guestPassword)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			tt.Fatalf("Guest %v request for /%v failed: %v", method, path, err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	log.Print("Pinning song")
+	if code := send("POST", "pin?songIds="+id0); code != http.StatusOK {
+		tt.Fatalf("Guest request to pin %v returned %v", id0, code)
+	}
+
+	// The first fetch of the pinned song should count against the guest limit,
+	// but later fetches shouldn't.
+	log.Print("Fetching pinned song")
+	path0 := "song?filename=" + url.QueryEscape(Song0s.Filename)
+	for i := 0; i < maxGuestRequests; i++ {
+		if code := send("GET", path0); code != http.StatusOK {
+			tt.Fatalf("Guest request %v for /%v returned %v; want %v", i, path0, code, http.StatusOK)
+		}
+	}
+	log.Print("Fetching unpinned song")
+	path1 := "song?filename=" + url.QueryEscape(Song1s.Filename)
+	for i := 1; i <= maxGuestRequests; i++ {
+		want := http.StatusOK
+		if i == maxGuestRequests {
+			want = http.StatusTooManyRequests
+		}
+		if code := send("GET", path1); code != want {
+			tt.Fatalf("Guest request %v for /%v returned %v; want %v", i, path1, code, want)
+		}
+	}
+	if code := send("GET", path0); code != http.StatusOK {
+		tt.Errorf("Guest request for /%v after exceeding limit returned %v; want %v",
+			path0, code, http.StatusOK)
+	}
+}
+
+func TestRateLimits(tt *testing.T) {
+	t, done := initTest(tt)
+	defer done()
+
+	send := func(user, pass string) *http.Response {
+		req := t.NewRequest("GET", "now", nil)
+		req.SetBasicAuth(user, pass)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			tt.Fatalf("Request for /now from %q failed: %v", user, err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	log.Print("Checking /now rate-limiting")
+	for i := 0; i <= maxGuestRequests; i++ {
+		if resp := send(test.Username, test.Password); resp.StatusCode != http.StatusOK {
+			tt.Fatalf("Normal request %v for /now returned %v; want %v", i, resp.StatusCode, http.StatusOK)
+		}
+	}
+	for i := 0; i <= maxGuestRequests; i++ {
+		want := http.StatusOK
+		if i == maxGuestRequests {
+			want = http.StatusTooManyRequests
+		}
+		resp := send(guestUsername, guestPassword)
+		if resp.StatusCode != want {
+			tt.Fatalf("Guest request %v for /now returned %v; want %v", i, resp.StatusCode, want)
+		}
+		if want == http.StatusTooManyRequests {
+			if sec, err := strconv.Atoi(resp.Header.Get("Retry-After")); err != nil || sec <= 0 || sec > 3600 {
+				tt.Errorf("Rejected request has bad Retry-After header %q", resp.Header.Get("Retry-After"))
+			}
+		}
+	}
+
+	log.Print("Checking /ratelimit_status")
+	if statuses := t.GetRateLimitStatus(); len(statuses) != 1 || statuses[0].ID != guestUsername+" /now 1h0m0s" ||
+		len(statuses[0].Times) != maxGuestRequests {
+		tt.Errorf("/ratelimit_status returned %+v", statuses)
+	}
+}
+
+func TestPlayHistory(tt *testing.T) {
+	t, done := initTest(tt)
+	defer done()
+
+	log.Print("Importing songs and reporting plays")
+	test.Must(tt, test.CopySongs(t.MusicDir, Song0s.Filename, Song1s.Filename))
+	t.UpdateSongs()
+	id0 := t.SongID(Song0s.SHA1)
+	id1 := t.SongID(Song1s.SHA1)
+	t1 := test.Date(2014, 9, 15, 2, 5, 18)
+	t2 := test.Date(2014, 9, 16, 2, 5, 18)
+	t3 := test.Date(2014, 9, 17, 2, 5, 18)
+	t.ReportPlayed(id0, t1)
+	t.ReportPlayed(id1, t2)
+	t.ReportPlayed(id0, t3)
+
+	// Plays reported by other users shouldn't be returned.
+	t4 := test.Date(2014, 9, 18, 2, 5, 18)
+	otherPath := fmt.Sprintf("played?songId=%v&startTime=%v", id1, url.QueryEscape(t4.Format(time.RFC3339)))
+	req := t.NewRequest("POST", otherPath, nil)
+	req.SetBasicAuth(normalUsername, normalPassword)
+	if resp, err := http.DefaultClient.Do(req); err != nil {
+		tt.Fatalf("Reporting play as %q failed: %v", normalUsername, err)
+	} else if resp.Body.Close(); resp.StatusCode != http.StatusOK {
+		tt.Fatalf("Reporting play as %q returned %v", normalUsername, resp.StatusCode)
+	}
+
+	type play struct {
+		id string
+		t  time.Time
+	}
+	getPlays := func(params ...string) (plays []play, cursor string) {
+		hps, cursor := t.GetPlays(params...)
+		for _, hp := range hps {
+			if hp.Song.SongID == id0 && hp.Song.SHA1 != Song0s.SHA1 {
+				tt.Errorf("Play for song %v has SHA1 %q; want %q", id0, hp.Song.SHA1, Song0s.SHA1)
+			}
+			plays = append(plays, play{hp.Song.SongID, hp.StartTime.UTC()})
+		}
+		return plays, cursor
+	}
+
+	for _, tc := range []struct {
+		params []string
+		want   []play
+	}{
+		{nil, []play{{id0, t3}, {id1, t2}, {id0, t1}}},
+		{[]string{"songId=" + id0}, []play{{id0, t3}, {id0, t1}}},
+		{[]string{"minStartTime=" + url.QueryEscape(t2.Format(time.RFC3339))}, []play{{id0, t3}, {id1, t2}}},
+		{[]string{"maxStartTime=" + url.QueryEscape(t2.Format(time.RFC3339))}, []play{{id0, t1}}},
+	} {
+		if got, _ := getPlays(tc.params...); !reflect.DeepEqual(got, tc.want) {
+			tt.Errorf("/plays with %q returned %v; want %v", tc.params, got, tc.want)
+		}
+	}
+
+	log.Print("Paginating play history")
+	var got []play
+	var cursor string
+	for i := 0; i < 5; i++ {
+		params := []string{"max=2"}
+		if cursor != "" {
+			params = append(params, "cursor="+url.QueryEscape(cursor))
+		}
+		var plays []play
+		plays, cursor = getPlays(params...)
+		got = append(got, plays...)
+		if cursor == "" {
+			break
+		}
+	}
+	if want := []play{{id0, t3}, {id1, t2}, {id0, t1}}; !reflect.DeepEqual(got, want) {
+		tt.Errorf("Paginated /plays returned %v; want %v", got, want)
+	}
+
+	log.Print("Checking other user's play history")
+	req = t.NewRequest("GET", "plays", nil)
+	req.SetBasicAuth(normalUsername, normalPassword)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		tt.Fatalf("/plays request from %q failed: %v", normalUsername, err)
+	}
+	defer resp.Body.Close()
+	var res struct {
+		Plays []dump.HistoryPlay `json:"plays"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		tt.Fatalf("Failed decoding /plays response for %q: %v", normalUsername, err)
+	}
+	got = nil
+	for _, hp := range res.Plays {
+		got = append(got, play{hp.Song.SongID, hp.StartTime.UTC()})
+	}
+	if want := []play{{id1, t4}}; !reflect.DeepEqual(got, want) {
+		tt.Errorf("/plays for %q returned %v; want %v", normalUsername, got, want)
+	}
+}
+
+func TestUserPlays(tt *testing.T) {
+	t, done := initTest(tt)
+	defer done()
+
+	log.Print("Posting songs and reporting play")
+	const otherUser = "other"
+	s0 := Song0s
+	p0 := db.NewPlay(test.Date(2014, 9, 17, 2, 5, 18), "127.0.0.1")
+	p0.User = otherUser
+	s0.Plays = []db.Play{p0}
+	s1 := Song1s
+	t.PostSongs([]db.Song{s0, s1}, true, 0)
+	p1 := db.NewPlay(test.Date(2014, 9, 16, 2, 5, 18), "127.0.0.1")
+	p1.User = test.Username
+	t.ReportPlayed(t.SongID(s1.SHA1), p1.StartTime)
+	s1.Plays = []db.Play{p1}
+	if err := test.CompareSongs([]db.Song{s0, s1}, t.DumpSongs(test.StripIDs), test.IgnoreOrder); err != nil {
+		tt.Fatal("Bad songs after reporting play: ", err)
+	}
+
+	for _, tc := range []struct {
+		params string
+		want   []db.Song
+		order  test.OrderPolicy
+	}{
+		{"maxPlays=0", []db.Song{}, test.IgnoreOrder},
+		{"maxPlays=0&myPlays=1", []db.Song{s0}, test.IgnoreOrder},
+		{"maxPlays=1&myPlays=1", []db.Song{s0, s1}, test.IgnoreOrder},
+		{"orderByLastPlayed=1", []db.Song{s1, s0}, test.CompareOrder},
+		{"orderByLastPlayed=1&myPlays=1", []db.Song{s0, s1}, test.CompareOrder},
+	} {
+		if err := compareQueryResults(tc.want, t.QuerySongs(tc.params), tc.order); err != nil {
+			tt.Errorf("Bad results for %q: %v", tc.params, err)
+		}
+	}
+
+	log.Print("Checking user stats")
+	t.UpdateStats()
+	got := t.GetStats("myPlays=1")
+	want := map[int]db.PlayStats{2014: {Plays: 1, TotalSec: s1.Length}}
+	if !reflect.DeepEqual(got.Years, want) {
+		tt.Errorf("Got user years %+v; want %+v", got.Years, want)
+	}
+}
+
+func TestSongsByID(tt *testing.T) {
+	t, done := initTest(tt)
+	defer done()
+
+	log.Print("Posting songs")
+	t.PostSongs([]db.Song{Song0s, Song1s}, true, 0)
+	id0 := t.SongID(Song0s.SHA1)
+	id1 := t.SongID(Song1s.SHA1)
+	const missingID = "123456789"
+
+	log.Print("Getting songs by ID")
+	filenames := func(songs []*db.Song) []string {
+		var res []string
+		for _, s := range songs {
+			if s == nil {
+				res = append(res, "")
+			} else {
+				res = append(res, s.Filename)
+			}
+		}
+		return res
+	}
+	got := t.GetSongsByID([]string{id1, missingID, id0}, "")
+	if want := []string{Song1s.Filename, "", Song0s.Filename}; !reflect.DeepEqual(filenames(got), want) {
+		tt.Errorf("/songs_by_id returned %q; want %q", filenames(got), want)
+	} else if got[0].Artist != Song1s.Artist || got[0].SongID != id1 {
+		tt.Errorf("/songs_by_id returned %+v for %v", *got[0], id1)
+	}
+
+	log.Print("Getting projected songs by ID")
+	got = t.GetSongsByID([]string{id0}, "songId,filename")
+	if len(got) != 1 || got[0] == nil {
+		tt.Fatalf("/songs_by_id with fields returned %v; want 1 song", got)
+	}
+	if want := (db.Song{SongID: id0, Filename: Song0s.Filename}); !reflect.DeepEqual(*got[0], want) {
+		tt.Errorf("/songs_by_id with fields returned %+v; want %+v", *got[0], want)
+	}
+}
+
+func TestSkips(tt *testing.T) {
+	t, done := initTest(tt)
+	defer done()
+
+	log.Print("Posting songs and reporting skips")
+	s0 := Song0s
+	s0.Plays = []db.Play{db.NewPlay(test.Date(2014, 9, 15, 2, 5, 18), "127.0.0.1")}
+	s1 := Song1s
+	t.PostSongs([]db.Song{s0, s1}, true, 0)
+	id0 := t.SongID(s0.SHA1)
+	st := test.Date(2014, 9, 16, 2, 5, 18)
+	t.ReportSkipped(id0, st, 10.5)
+	t.ReportSkipped(id0, st, 10.5) // duplicate should be ignored
+	t.ReportSkipped(id0, st.Add(time.Hour), 3)
+	s0.NumSkips = 2
+	if err := test.CompareSongs([]db.Song{s0, s1}, t.DumpSongs(test.StripIDs), test.IgnoreOrder); err != nil {
+		tt.Fatal("Bad songs after reporting skips: ", err)
+	}
+
+	// s0 has been skipped 2 out of 3 times.
+	for _, tc := range []struct {
+		params string
+		want   []db.Song
+	}{
+		{"maxSkipRatio=0.5", []db.Song{s1}},
+		{"maxSkipRatio=0.7", []db.Song{s0, s1}},
+		{"minSkipRatio=0.5", []db.Song{s0}},
+	} {
+		if err := compareQueryResults(tc.want, t.QuerySongs(tc.params), test.IgnoreOrder); err != nil {
+			tt.Errorf("Bad results for %q: %v", tc.params, err)
+		}
+	}
+}
+
+func TestShare(tt *testing.T) {
+	t, done := initTest(tt)
+	defer done()
+
+	log.Print("Posting song")
+	t.PostSongs([]db.Song{Song0s}, true, 0)
+	id := t.SongID(Song0s.SHA1)
+
+	// Share pages shouldn't require credentials.
+	get := func(u string) (int, string) {
+		resp, err := http.Get(u)
+		if err != nil {
+			tt.Fatalf("GET %v failed: %v", u, err)
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			tt.Fatalf("Failed reading body from %v: %v", u, err)
+		}
+		return resp.StatusCode, string(body)
+	}
+
+	log.Print("Checking song share page")
+	songURL := t.GetShareLink("songId", id)
+	if !strings.HasPrefix(songURL, appURL+"share?") {
+		tt.Errorf("Share link %v doesn't use configured base URL %v", songURL, appURL)
+	}
+	if code, body := get(songURL); code != http.StatusOK {
+		tt.Errorf("GET %v returned %v", songURL, code)
+	} else if want := `<meta property="og:title" content="` + Song0s.Title + `">`; !strings.Contains(body, want) {
+		tt.Errorf("GET %v returned page without %q:\n%s", songURL, want, body)
+	}
+
+	log.Print("Checking oEmbed response")
+	oeURL := appURL + "oembed?" + url.Values{"url": {songURL}}.Encode()
+	var oe struct {
+		Type       string `json:"type"`
+		Title      string `json:"title"`
+		AuthorName string `json:"author_name"`
+	}
+	if code, body := get(oeURL); code != http.StatusOK {
+		tt.Errorf("GET %v returned %v", oeURL, code)
+	} else if err := json.Unmarshal([]byte(body), &oe); err != nil {
+		tt.Errorf("Failed decoding oEmbed response %q: %v", body, err)
+	} else if oe.Type != "link" || oe.Title != Song0s.Title || oe.AuthorName != Song0s.Artist {
+		tt.Errorf("GET %v returned %+v", oeURL, oe)
+	}
+
+	log.Print("Checking album share page")
+	albumURL := t.GetShareLink("albumId", Song0s.AlbumID)
+	if code, body := get(albumURL); code != http.StatusOK {
+		tt.Errorf("GET %v returned %v", albumURL, code)
+	} else if want := `<meta property="og:title" content="` + Song0s.Album + `">`; !strings.Contains(body, want) {
+		tt.Errorf("GET %v returned page without %q:\n%s", albumURL, want, body)
+	}
+
+	log.Print("Checking share page with bad token")
+	badURL := strings.Replace(songURL, "id="+id, "id=1"+id, 1)
+	if code, _ := get(badURL); code != http.StatusForbidden {
+		tt.Errorf("GET %v returned %v; want %v", badURL, code, http.StatusForbidden)
+	}
+}
+
+func TestAccessToken(tt *testing.T) {
+	t, done := initTest(tt)
+	defer done()
+
+	log.Print("Posting songs")
+	t.PostSongs([]db.Song{Song0s, Song1s, Song5s}, true, 0)
+	id0 := t.SongID(Song0s.SHA1)
+	id5 := t.SongID(Song5s.SHA1)
+
+	// Access tokens should be usable without credentials.
+	get := func(path string, vals url.Values) (int, []byte) {
+		u := appURL + path + "?" + vals.Encode()
+		resp, err := http.Get(u)
+		if err != nil {
+			tt.Fatalf("GET %v failed: %v", u, err)
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			tt.Fatalf("Failed reading body from %v: %v", u, err)
+		}
+		return resp.StatusCode, body
+	}
+	checkQuery := func(token string, want []db.Song) {
+		// The token's scope should be used instead of the supplied parameters.
+		code, body := get("query", url.Values{"access": {token}, "artist": {Song1s.Artist}})
+		var got []db.Song
+		if code != http.StatusOK {
+			tt.Errorf("/query returned %v", code)
+		} else if err := json.Unmarshal(body, &got); err != nil {
+			tt.Errorf("Failed decoding /query response %q: %v", body, err)
+		} else if err := compareQueryResults(want, got, test.IgnoreOrder); err != nil {
+			tt.Error("Bad /query results: ", err)
+		}
+	}
+	checkSong := func(token, fn string, want int) {
+		if code, _ := get("song", url.Values{"access": {token}, "filename": {fn}}); code != want {
+			tt.Errorf("/song for %v returned %v; want %v", fn, code, want)
+		}
+	}
+
+	log.Print("Checking playlist token")
+	listTok := t.GetAccessToken(url.Values{"songIds": {id5 + "," + id0}})
+	checkQuery(listTok, []db.Song{Song0s, Song5s})
+	checkSong(listTok, Song0s.Filename, http.StatusOK)
+	checkSong(listTok, Song1s.Filename, http.StatusForbidden)
+
+	log.Print("Checking query token")
+	queryTok := t.GetAccessToken(url.Values{"query": {"artist=" + url.QueryEscape(Song5s.Artist)}})
+	checkQuery(queryTok, []db.Song{Song5s})
+	checkSong(queryTok, Song5s.Filename, http.StatusOK)
+	checkSong(queryTok, Song0s.Filename, http.StatusForbidden)
+
+	// Song requests using tokens should be subject to the guest limit, tracked per token.
+	// The playlist token was already used to fetch one song.
+	log.Print("Checking token rate-limiting")
+	for i := 2; i <= maxGuestRequests; i++ {
+		checkSong(listTok, Song0s.Filename, http.StatusOK)
+	}
+	checkSong(listTok, Song0s.Filename, http.StatusTooManyRequests)
+	checkSong(queryTok, Song5s.Filename, http.StatusOK)
+
+	log.Print("Checking bad tokens")
+	checkSong(listTok[1:], Song0s.Filename, http.StatusForbidden)
+	if code, _ := get("plays", url.Values{"access": {listTok}}); code != http.StatusUnauthorized {
+		tt.Errorf("/plays returned %v; want %v", code, http.StatusUnauthorized)
+	}
+}
+
+func TestCoversBundle(tt *testing.T) {
+	t, done := initTest(tt)
+	defer done()
+
+	log.Print("Writing covers and posting songs")
+	covers := make(map[string][]byte)
+	var songs []db.Song
+	for i, s := range []db.Song{Song0s, Song1s, Song5s} {
+		s.CoverFilename = fmt.Sprintf("bundle-%d.jpg", i)
+		data := []byte(fmt.Sprintf("fake cover %d", i)) // not scaled, so needn't be valid
+		test.Must(tt, os.WriteFile(filepath.Join(coversDir, s.CoverFilename), data, 0644))
+		covers[s.CoverFilename] = data
+		songs = append(songs, s)
+	}
+	t.PostSongs(songs, true, 0)
+
+	log.Print("Fetching bundles")
+	got := make(map[string][]byte)
+	var cursor string
+	for i := 0; i < 5; i++ {
+		path := "covers_bundle?max=2"
+		if cursor != "" {
+			path += "&cursor=" + url.QueryEscape(cursor)
+		}
+		resp, err := http.DefaultClient.Do(t.NewRequest("GET", path, nil))
+		if err != nil {
+			tt.Fatalf("Request for /%v failed: %v", path, err)
+		} else if resp.StatusCode != http.StatusOK {
+			tt.Fatalf("Request for /%v returned %v", path, resp.Status)
+		}
+		gr, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			tt.Fatal("Failed decompressing bundle: ", err)
+		}
+		tr := tar.NewReader(gr)
+		var n int
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				tt.Fatal("Failed reading bundle: ", err)
+			}
+			if got[hdr.Name], err = io.ReadAll(tr); err != nil {
+				tt.Fatalf("Failed reading %v from bundle: %v", hdr.Name, err)
+			}
+			n++
+		}
+		resp.Body.Close()
+		if n > 2 {
+			tt.Errorf("Bundle contained %d covers; want at most 2", n)
+		}
+		if cursor = resp.Header.Get("X-Nup-Cursor"); cursor == "" {
+			break
+		}
+	}
+	if !reflect.DeepEqual(got, covers) {
+		tt.Errorf("Bundles contained %q; want %q", got, covers)
+	}
+}
+
+func TestLibraries(tt *testing.T) {
+	t, done := initTest(tt)
+	defer done()
+
+	// Songs with the same SHA1 should be stored separately in different libraries.
+	log.Print("Posting songs to multiple libraries")
+	other0s := Song0s
+	other0s.Library = otherLibrary
+	other1s := Song1s
+	other1s.Library = otherLibrary
+	t.PostSongs([]db.Song{Song0s, Song5s, other0s, other1s}, true, 0)
+
+	log.Print("Checking queries")
+	if err := compareQueryResults([]db.Song{Song0s, Song5s},
+		t.QuerySongs(), test.IgnoreOrder); err != nil {
+		tt.Error("Bad main library results: ", err)
+	}
+	if err := compareQueryResults([]db.Song{other0s, other1s},
+		t.QuerySongs("library="+otherLibrary), test.IgnoreOrder); err != nil {
+		tt.Error("Bad other library results: ", err)
+	}
+	if err := compareQueryResults([]db.Song{other1s},
+		t.QuerySongs("library="+otherLibrary, "artist="+url.QueryEscape(Song1s.Artist)),
+		test.IgnoreOrder); err != nil {
+		tt.Error("Bad other library artist results: ", err)
+	}
+
+	log.Print("Checking dumps")
+	if err := test.CompareSongs([]db.Song{Song0s, Song5s},
+		t.DumpSongs(test.StripIDs), test.IgnoreOrder); err != nil {
+		tt.Error("Bad main library dump: ", err)
+	}
+	if err := test.CompareSongs([]db.Song{other0s, other1s},
+		t.DumpSongs(test.StripIDs, "-library="+otherLibrary), test.IgnoreOrder); err != nil {
+		tt.Error("Bad other library dump: ", err)
+	}
+
+	send := func(method, path, user, pass string) (int, []byte) {
+		req := t.NewRequest(method, path, nil)
+		req.SetBasicAuth(user, pass)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			tt.Fatalf("%v request for /%v from %q failed: %v", method, path, user, err)
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			tt.Fatalf("Failed reading body from %v request for /%v from %q: %v", method, path, user, err)
+		}
+		return resp.StatusCode, body
+	}
+
+	log.Print("Checking access")
+	for _, path := range []string{
+		"query?library=" + otherLibrary,
+		"export?type=song&library=" + otherLibrary,
+	} {
+		if code, _ := send("GET", path, guestUsername, guestPassword); code != http.StatusForbidden {
+			tt.Errorf("Guest request for /%v returned %v; want %v", path, code, http.StatusForbidden)
+		}
+	}
+
+	// Songs in inaccessible libraries should be treated as nonexistent by endpoints that take IDs.
+	log.Print("Checking access to songs by ID")
+	var otherID string
+	for _, s := range t.DumpSongs(test.KeepIDs, "-library="+otherLibrary) {
+		if s.SHA1 == other1s.SHA1 {
+			otherID = s.SongID
+		}
+	}
+	if otherID == "" {
+		tt.Fatalf("Failed finding ID for %v in %q library", other1s.SHA1, otherLibrary)
+	}
+	for _, tc := range []struct{ user, pass, method, path string }{
+		{guestUsername, guestPassword, "GET", "dump_song?songId=" + otherID},
+		{guestUsername, guestPassword, "GET", "similar?songId=" + otherID},
+		{guestUsername, guestPassword, "POST", "pin?songIds=" + otherID},
+		{normalUsername, normalPassword, "GET", "dump_song?songId=" + otherID},
+		{normalUsername, normalPassword, "GET", "tag_suggestions?songId=" + otherID},
+		{normalUsername, normalPassword, "POST", "rate_and_tag?songId=" + otherID + "&rating=5"},
+		{normalUsername, normalPassword, "POST", "played?songId=" + otherID + "&startTime=2020-04-01T00:00:00Z"},
+	} {
+		if code, _ := send(tc.method, tc.path, tc.user, tc.pass); code != http.StatusNotFound {
+			tt.Errorf("%v request for /%v from %q returned %v; want %v",
+				tc.method, tc.path, tc.user, code, http.StatusNotFound)
+		}
+	}
+	if code, body := send("GET", "songs_by_id?ids="+otherID, guestUsername, guestPassword); code != http.StatusOK {
+		tt.Errorf("Guest request for /songs_by_id returned %v; want %v", code, http.StatusOK)
+	} else if got := strings.TrimSpace(string(body)); got != "[null]" {
+		tt.Errorf("Guest request for /songs_by_id returned %q; want %q", got, "[null]")
+	}
+
+	// Tags should only be listed for accessible libraries.
+	log.Print("Checking tags")
+	const otherTag = "other-tag"
+	if code, _ := send("POST", "rate_and_tag?songId="+otherID+"&tags="+otherTag,
+		test.Username, test.Password); code != http.StatusOK {
+		tt.Fatalf("Tagging %v returned %v", otherID, code)
+	}
+	for _, tc := range []struct {
+		user, pass string
+		want       bool
+	}{
+		{test.Username, test.Password, true},
+		{guestUsername, guestPassword, false},
+		{normalUsername, normalPassword, false},
+	} {
+		code, body := send("GET", "tags", tc.user, tc.pass)
+		if code != http.StatusOK {
+			tt.Errorf("/tags request from %q returned %v", tc.user, code)
+			continue
+		}
+		var tags []string
+		if err := json.Unmarshal(body, &tags); err != nil {
+			tt.Errorf("Failed unmarshaling /tags response %q for %q: %v", body, tc.user, err)
+			continue
+		}
+		var found bool
+		for _, tag := range tags {
+			found = found || tag == otherTag
+		}
+		if found != tc.want {
+			tt.Errorf("/tags response for %q was %q; want %q present: %v", tc.user, tags, otherTag, tc.want)
+		}
+	}
+}
+
+func TestShuffleAlbums(tt *testing.T) {
+	t, done := initTest(tt)
+	defer done()
+
+	log.Print("Posting songs")
+	songs := []db.Song{Song0s, Song1s, Song5s, Song10s}
+	t.PostSongs(songs, true, 0)
+
+	log.Print("Querying with shuffled albums")
+	for i := 0; i < 5; i++ {
+		got := t.QuerySongs("shuffleAlbums=1")
+		if err := compareQueryResults(songs, got, test.IgnoreOrder); err != nil {
+			tt.Fatal("Bad results: ", err)
+		}
+		// Song0s and Song1s are on the same album, so they should be adjacent and in track order.
+		for j, s := range got {
+			if s.SHA1 == Song0s.SHA1 {
+				if j == len(got)-1 || got[j+1].SHA1 != Song1s.SHA1 {
+					tt.Fatalf("%v isn't followed by %v in results", Song0s.Filename, Song1s.Filename)
+				}
+				break
+			}
+		}
+	}
+}
+
+func TestSuggest(tt *testing.T) {
+	t, done := initTest(tt)
+	defer done()
+
+	log.Print("Posting songs")
+	t.PostSongs([]db.Song{Song0s, Song1s, Song5s}, true, 0)
+
+	for _, tc := range []struct {
+		partial string
+		want    query.Suggestions
+	}{
+		{"fi", query.Suggestions{
+			Words:   []string{"first", "five"},
+			Artists: []string{Song0s.Artist},
+			Albums:  []string{Song0s.Album},
+			Titles:  []string{Song5s.Title},
+		}},
+		{"Seco", query.Suggestions{
+			Words:   []string{"seconds", "second"},
+			Artists: []string{Song1s.Artist},
+			Albums:  []string{},
+			Titles:  []string{Song5s.Title, Song1s.Title, Song0s.Title},
+		}},
+		{"s", query.Suggestions{Words: []string{}, Artists: []string{}, Albums: []string{}, Titles: []string{}}},
+	} {
+		if got := t.GetSuggestions(tc.partial); !reflect.DeepEqual(got, tc.want) {
+			tt.Errorf("Suggestions for %q are %+v; want %+v", tc.partial, got, tc.want)
+		}
+	}
+
+	// Guests shouldn't get suggestions from songs with excluded tags or in inaccessible libraries.
+	log.Print("Checking guest suggestions")
+	rockSong := Song10s
+	rockSong.Title = "Hidden Rock"
+	rockSong.Tags = []string{"rock"}
+	otherSong := Song10s
+	otherSong.Title = "Hidden Other"
+	otherSong.Library = otherLibrary
+	t.PostSongs([]db.Song{rockSong, otherSong}, true, 0)
+	want := query.Suggestions{
+		Words:   []string{"hidden"},
+		Artists: []string{},
+		Albums:  []string{},
+		Titles:  []string{otherSong.Title, rockSong.Title},
+	}
+	if got := t.GetSuggestions("hidd"); !reflect.DeepEqual(got, want) {
+		tt.Errorf("Suggestions for %q are %+v; want %+v", "hidd", got, want)
+	}
+	req := t.NewRequest("GET", "suggest?q=hidd", nil)
+	req.SetBasicAuth(guestUsername, guestPassword)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		tt.Fatal("Guest suggest request failed: ", err)
+	}
+	defer resp.Body.Close()
+	var got query.Suggestions
+	if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+		tt.Fatal("Failed decoding guest suggestions: ", err)
+	}
+	want = query.Suggestions{Words: []string{}, Artists: []string{}, Albums: []string{}, Titles: []string{}}
+	if !reflect.DeepEqual(got, want) {
+		tt.Errorf("Guest suggestions for %q are %+v; want %+v", "hidd", got, want)
+	}
+}
@@ -14,6 +14,10 @@ const (
 	TrackGain = -6.7
 	AlbumGain = -6.3
 	PeakAmp   = 1.05
+
+	// CoverFLACFile is a FLAC file in SongsDir without any audio frames. It contains PICTURE
+	// metadata blocks holding a 1x1 PNG back cover followed by a 1x1 JPEG front cover.
+	CoverFLACFile = "cover.flac"
 )
 
 // The expected sorted order for these songs (per sortSongs in server/query) is:
@@ -35,7 +39,10 @@ var Song0s = db.Song{
 	RecordingID: "392cea06-94c2-416b-80aa-f5b1e7d0fb1c",
 	Track:       1,
 	Disc:        1, // 0 in file, but automatically set to 1
+	TotalTracks: 2,
+	Genres:      []string{"Alternative"},
 	Date:        Date(1992, 1, 1),
+	ReleaseDate: Date(1992, 1, 1),
 	Length:      0.026,
 	TrackGain:   TrackGain,
 	AlbumGain:   AlbumGain,
@@ -43,20 +50,24 @@ var Song0s = db.Song{
 }
 
 var Song0sUpdated = db.Song{
-	SHA1:        Song0s.SHA1,
-	Filename:    "0s-updated.mp3",
-	Artist:      Song0s.Artist,
-	Title:       "Zero Seconds (Remix)",
-	Album:       Song0s.Album,
-	AlbumID:     Song0s.AlbumID,
-	RecordingID: "271a81af-6c2d-44cf-a0b8-a25ad74c82f9",
-	Track:       Song0s.Track,
-	Disc:        Song0s.Disc,
-	Date:        Date(1995, 4, 3, 13, 17, 59),
-	Length:      Song0s.Length,
-	TrackGain:   TrackGain,
-	AlbumGain:   AlbumGain,
-	PeakAmp:     PeakAmp,
+	SHA1:         Song0s.SHA1,
+	Filename:     "0s-updated.mp3",
+	Artist:       Song0s.Artist,
+	Title:        "Zero Seconds (Remix)",
+	Album:        Song0s.Album,
+	AlbumID:      Song0s.AlbumID,
+	RecordingID:  "271a81af-6c2d-44cf-a0b8-a25ad74c82f9",
+	Track:        Song0s.Track,
+	Disc:         Song0s.Disc,
+	TotalTracks:  Song0s.TotalTracks,
+	Genres:       Song0s.Genres,
+	Date:         Date(1995, 4, 3, 13, 17, 59),
+	OriginalDate: Date(1995, 4, 3, 13, 17, 59),
+	ReleaseDate:  Date(1992, 1, 1),
+	Length:       Song0s.Length,
+	TrackGain:    TrackGain,
+	AlbumGain:    AlbumGain,
+	PeakAmp:      PeakAmp,
 }
 
 var Song1s = db.Song{
@@ -70,7 +81,10 @@ var Song1s = db.Song{
 	RecordingID: "5d7e41b2-ec4b-44dd-b25a-a576d7a08adb",
 	Track:       2,
 	Disc:        1, // 0 in file, but automatically set to 1
+	TotalTracks: 2,
+	Genres:      []string{"Southern Rock"},
 	Date:        Date(2004, 1, 1),
+	ReleaseDate: Date(2004, 1, 1),
 	Length:      1.071,
 	TrackGain:   TrackGain,
 	AlbumGain:   AlbumGain,
@@ -87,7 +101,11 @@ var Song5s = db.Song{
 	AlbumID:     "a1d2405b-afe0-4e28-a935-b5b256f68131",
 	Track:       1,
 	Disc:        2,
+	TotalTracks: 1,
+	TotalDiscs:  2,
+	Genres:      []string{"Thrash Metal"},
 	Date:        Date(2014, 1, 1),
+	ReleaseDate: Date(2014, 1, 1),
 	Length:      5.041,
 	TrackGain:   TrackGain,
 	AlbumGain:   AlbumGain,
@@ -23,6 +23,9 @@ import (
 
 	"github.com/derat/nup/cmd/nup/client"
 	"github.com/derat/nup/server/db"
+	"github.com/derat/nup/server/dump"
+	"github.com/derat/nup/server/query"
+	"github.com/derat/nup/server/ratelimit"
 )
 
 const (
@@ -269,6 +272,19 @@ func (t *Tester) DeleteSong(songID string) {
 	}
 }
 
+// RestoreSong restores the specified deleted song using 'nup trash'.
+func (t *Tester) RestoreSong(songID string) {
+	if _, stderr, err := runCommand(
+		"nup",
+		"-config="+t.configFile,
+		"trash",
+		"restore",
+		songID,
+	); err != nil {
+		t.fatalf("Failed restoring song %v: %v\nstderr: %v", songID, err, stderr)
+	}
+}
+
 const DeleteAfterMergeFlag = "-delete-after-merge"
 
 // MergeSongs merges one song's user data into another song using 'nup update'.
@@ -344,6 +360,21 @@ func (t *Tester) PingServer() {
 
 // PostSongs posts the supplied songs directly to the server.
 func (t *Tester) PostSongs(songs []db.Song, replaceUserData bool, updateDelay time.Duration) {
+	path := fmt.Sprintf("import?updateDelayNsec=%v", int64(updateDelay*time.Nanosecond))
+	if replaceUserData {
+		path += "&replaceUserData=1"
+	}
+	t.postSongs(path, songs)
+}
+
+// PostSongsBulk is like PostSongs, but the songs are imported as part of a bulk import
+// session (so cached queries aren't flushed until the session ends).
+func (t *Tester) PostSongsBulk(songs []db.Song) {
+	t.postSongs("import?bulk=1", songs)
+}
+
+// postSongs posts songs to the supplied import path.
+func (t *Tester) postSongs(path string, songs []db.Song) {
 	var buf bytes.Buffer
 	e := json.NewEncoder(&buf)
 	for _, s := range songs {
@@ -351,10 +382,6 @@ func (t *Tester) PostSongs(songs []db.Song, replaceUserData bool, updateDelay ti
 			t.fatal("Encoding songs failed: ", err)
 		}
 	}
-	path := fmt.Sprintf("import?updateDelayNsec=%v", int64(updateDelay*time.Nanosecond))
-	if replaceUserData {
-		path += "&replaceUserData=1"
-	}
 	t.doPost(path, &buf)
 }
 
@@ -370,6 +397,97 @@ func (t *Tester) QuerySongs(params ...string) []db.Song {
 	return songs
 }
 
+// GetSongsByID gets the songs identified by ids from the server's /songs_by_id endpoint
+// via a POST request. Missing songs are returned as nil.
+func (t *Tester) GetSongsByID(ids []string, fields string) []*db.Song {
+	form := url.Values{"ids": {strings.Join(ids, ",")}, "fields": {fields}}
+	req := t.NewRequest("POST", "songs_by_id", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp := t.sendRequest(req)
+	defer resp.Body.Close()
+
+	var songs []*db.Song
+	if err := json.NewDecoder(resp.Body).Decode(&songs); err != nil {
+		t.fatal("Decoding songs failed: ", err)
+	}
+	return songs
+}
+
+// GetShareLink returns a /share URL for the song or album identified by param
+// (either "songId" or "albumId") and id.
+func (t *Tester) GetShareLink(param, id string) string {
+	resp := t.sendRequest(t.NewRequest("GET", "share_link?"+url.Values{param: {id}}.Encode(), nil))
+	defer resp.Body.Close()
+
+	var res struct {
+		URL string `json:"url"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		t.fatal("Decoding share link failed: ", err)
+	}
+	return res.URL
+}
+
+// GetAccessToken returns a token from /access_token for the supplied parameters.
+func (t *Tester) GetAccessToken(params url.Values) string {
+	resp := t.sendRequest(t.NewRequest("GET", "access_token?"+params.Encode(), nil))
+	defer resp.Body.Close()
+
+	var res struct {
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		t.fatal("Decoding access token failed: ", err)
+	}
+	return res.Token
+}
+
+// CreateAPIToken creates an API token for the test user with the supplied scope
+// and returns its ID and the token.
+func (t *Tester) CreateAPIToken(scope string) (id, token string) {
+	resp := t.sendRequest(t.NewRequest("POST", "create_api_token?"+
+		url.Values{"scope": {scope}}.Encode(), nil))
+	defer resp.Body.Close()
+
+	var res struct {
+		ID    string `json:"id"`
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		t.fatal("Decoding API token failed: ", err)
+	}
+	return res.ID, res.Token
+}
+
+// RevokeAPIToken revokes the API token with the supplied ID.
+func (t *Tester) RevokeAPIToken(id string) {
+	t.doPost("revoke_api_token?"+url.Values{"id": {id}}.Encode(), nil)
+}
+
+// GetSuggestions returns the server's suggestions for completing partial.
+func (t *Tester) GetSuggestions(partial string) query.Suggestions {
+	resp := t.sendRequest(t.NewRequest("GET", "suggest?"+url.Values{"q": {partial}}.Encode(), nil))
+	defer resp.Body.Close()
+
+	var sugs query.Suggestions
+	if err := json.NewDecoder(resp.Body).Decode(&sugs); err != nil {
+		t.fatal("Decoding suggestions failed: ", err)
+	}
+	return sugs
+}
+
+// GetRateLimitStatus returns the server's saved rate-limiting information.
+func (t *Tester) GetRateLimitStatus() []ratelimit.Status {
+	resp := t.sendRequest(t.NewRequest("GET", "ratelimit_status", nil))
+	defer resp.Body.Close()
+
+	var statuses []ratelimit.Status
+	if err := json.NewDecoder(resp.Body).Decode(&statuses); err != nil {
+		t.fatal("Decoding rate-limiting status failed: ", err)
+	}
+	return statuses
+}
+
 // ClearData clears all songs from the server.
 func (t *Tester) ClearData() {
 	t.doPost("clear", nil)
@@ -419,12 +537,24 @@ func (t *Tester) RateAndTag(songID string, rating int, tags []string) {
 	}
 }
 
+// EditSong edits the specified song's metadata using the supplied URL-encoded
+// parameters (e.g. "title=New+Title&track=2").
+func (t *Tester) EditSong(songID, params string) {
+	t.doPost("edit_song?songId="+songID+"&"+params, nil)
+}
+
 // ReportPlayed sends a playback report to the server.
 func (t *Tester) ReportPlayed(songID string, startTime time.Time) {
 	t.doPost(fmt.Sprintf("played?songId=%v&startTime=%v",
 		url.QueryEscape(songID), url.QueryEscape(startTime.Format(time.RFC3339))), nil)
 }
 
+// ReportSkipped sends a skip report to the server.
+func (t *Tester) ReportSkipped(songID string, startTime time.Time, pos float64) {
+	t.doPost(fmt.Sprintf("skipped?songId=%v&startTime=%v&position=%v",
+		url.QueryEscape(songID), url.QueryEscape(startTime.Format(time.RFC3339)), pos), nil)
+}
+
 // ReportPlayedUnix is like ReportPlayed, but sends the time as fractional
 // seconds since the Unix epoch instead.
 func (t *Tester) ReportPlayedUnix(songID string, startTime time.Time) {
@@ -432,6 +562,61 @@ func (t *Tester) ReportPlayedUnix(songID string, startTime time.Time) {
 	t.doPost(fmt.Sprintf("played?songId=%v&startTime=%.3f", url.QueryEscape(songID), sec), nil)
 }
 
+// GetPlays gets play history from the server's /plays endpoint using the supplied
+// parameters. A cursor is returned if more plays are available.
+func (t *Tester) GetPlays(params ...string) (plays []dump.HistoryPlay, cursor string) {
+	resp := t.sendRequest(t.NewRequest("GET", "plays?"+strings.Join(params, "&"), nil))
+	defer resp.Body.Close()
+
+	var res struct {
+		Plays  []dump.HistoryPlay `json:"plays"`
+		Cursor string             `json:"cursor"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		t.fatal("Decoding plays failed: ", err)
+	}
+	return res.Plays, res.Cursor
+}
+
+// ExportPlays exports plays from the server's /export endpoint using the supplied
+// parameters. Additional batches are requested until all plays have been returned.
+func (t *Tester) ExportPlays(params ...string) []db.PlayDump {
+	plays := make([]db.PlayDump, 0)
+	var cursor string
+	for {
+		path := "export?" + strings.Join(append([]string{"type=play"}, params...), "&")
+		if cursor != "" {
+			path += "&cursor=" + cursor
+		}
+		resp := t.sendRequest(t.NewRequest("GET", path, nil))
+		defer resp.Body.Close()
+
+		// We receive a sequence of marshaled plays optionally followed by a cursor.
+		cursor = ""
+		dec := json.NewDecoder(resp.Body)
+		for {
+			var msg json.RawMessage
+			if err := dec.Decode(&msg); err == io.EOF {
+				break
+			} else if err != nil {
+				t.fatal("Decoding message failed: ", err)
+			}
+			var pd db.PlayDump
+			if err := json.Unmarshal(msg, &cursor); err == nil {
+				break
+			} else if err := json.Unmarshal(msg, &pd); err == nil {
+				plays = append(plays, pd)
+			} else {
+				t.fatal("Unmarshaling play failed: ", err)
+			}
+		}
+		if cursor == "" {
+			break
+		}
+	}
+	return plays
+}
+
 // GetNowFromServer queries the server for the current time.
 func (t *Tester) GetNowFromServer() time.Time {
 	resp := t.sendRequest(t.NewRequest("GET", "now", nil))
@@ -513,9 +698,9 @@ func (t *Tester) GetSongsForAndroid(minLastModified time.Time, deleted DeletionP
 	return songs
 }
 
-// GetStats gets current stats from the server.
-func (t *Tester) GetStats() db.Stats {
-	resp := t.sendRequest(t.NewRequest("GET", "stats", nil))
+// GetStats gets current stats from the server using the supplied parameters.
+func (t *Tester) GetStats(params ...string) db.Stats {
+	resp := t.sendRequest(t.NewRequest("GET", "stats?"+strings.Join(params, "&"), nil))
 	defer resp.Body.Close()
 
 	var stats db.Stats
@@ -525,6 +710,18 @@ func (t *Tester) GetStats() db.Stats {
 	return stats
 }
 
+// GetAudit returns audit entries from the server.
+func (t *Tester) GetAudit(params ...string) []db.AuditEntry {
+	resp := t.sendRequest(t.NewRequest("GET", "audit?"+strings.Join(params, "&"), nil))
+	defer resp.Body.Close()
+
+	var entries []db.AuditEntry
+	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		t.fatal("Decoding audit entries failed: ", err)
+	}
+	return entries
+}
+
 // UpdateStats instructs the server to update stats.
 func (t *Tester) UpdateStats() {
 	resp := t.sendRequest(t.NewRequest("GET", "stats?update=1", nil))
@@ -532,6 +729,7 @@ func (t *Tester) UpdateStats() {
 }
 
 // ForceUpdateFailures configures the server to reject or allow updates.
+// This also restores the default bulk import timeout (see SetBulkImportTimeout).
 func (t *Tester) ForceUpdateFailures(fail bool) {
 	val := "0"
 	if fail {
@@ -539,3 +737,10 @@ func (t *Tester) ForceUpdateFailures(fail bool) {
 	}
 	t.doPost("config?forceUpdateFailures="+val, nil)
 }
+
+// SetBulkImportTimeout configures the server to consider bulk import sessions abandoned
+// after d. The default timeout is restored if d is zero.
+// This also clears any earlier ForceUpdateFailures setting.
+func (t *Tester) SetBulkImportTimeout(d time.Duration) {
+	t.doPost(fmt.Sprintf("config?bulkImportTimeoutSec=%v", d.Seconds()), nil)
+}
@@ -48,6 +48,7 @@ func withLength(l float64) songField      { return func(s *db.Song) { s.Length =
 func withRating(r int) songField          { return func(s *db.Song) { s.Rating = r } }
 func withTags(t ...string) songField      { return func(s *db.Song) { s.Tags = t } }
 func withTrack(t int) songField           { return func(s *db.Song) { s.Track = t } }
+func withTotalTracks(n int) songField     { return func(s *db.Song) { s.TotalTracks = n } }
 func withPlays(ts ...time.Time) songField {
 	return func(s *db.Song) {
 		for _, t := range ts {
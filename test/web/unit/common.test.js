@@ -6,6 +6,7 @@ import {
   createElement,
   formatDuration,
   formatRelativeTime,
+  getCSRFHeaders,
   getRatingString,
   moveItem,
   wrapString,
@@ -85,6 +86,18 @@ suite('common', () => {
     }
   });
 
+  test('getCSRFHeaders', () => {
+    const clear = () =>
+      (document.cookie = 'nup_csrf=; expires=Thu, 01 Jan 1970 00:00:00 GMT');
+    clear();
+    expectEq(getCSRFHeaders(), {}, 'No cookie');
+    document.cookie = 'other=foo';
+    document.cookie = 'nup_csrf=abc123';
+    expectEq(getCSRFHeaders(), { 'X-Nup-CSRF-Token': 'abc123' }, 'Cookie');
+    clear();
+    document.cookie = 'other=; expires=Thu, 01 Jan 1970 00:00:00 GMT';
+  });
+
   test('getRatingString', () => {
     for (const [args, want] of [
       [[0], 'Unrated'],
@@ -32,10 +32,13 @@ suite('updater', () => {
       `&startTime=${encodeURIComponent(startTime.toISOString())}`
     );
   }
-  function rateAndTagUrl(songId, rating, tags) {
+  function rateAndTagUrl(songId, rating, tags, lastModifiedNsec = null) {
     let url = `rate_and_tag?songId=${songId}`;
     if (rating != null) url += `&rating=${rating}`;
     if (tags != null) url += `&tags=${encodeURIComponent(tags.join(' '))}`;
+    if (lastModifiedNsec != null) {
+      url += `&ifLastModifiedNsec=${lastModifiedNsec}`;
+    }
     return url;
   }
 
@@ -215,6 +218,65 @@ suite('updater', () => {
     expectEq(w.numTimeouts, 0, 'numTimeouts');
   });
 
+  test('rateAndTag (conflict)', async () => {
+    initUpdater();
+
+    // Add a tag and have the server report that another client modified the
+    // song's tags in the meantime.
+    const base = { lastModifiedNsec: '100', tags: ['a', 'b'] };
+    const cur = {
+      songId: '123',
+      tags: ['a', 'b', 'c'],
+      lastModifiedNsec: '200',
+    };
+    w.expectFetch(
+      rateAndTagUrl('123', 4, ['b', 'd'], '100'),
+      'POST',
+      JSON.stringify(cur),
+      409
+    );
+    // The update should be merged into the current tags and sent again.
+    const updated = { ...cur, tags: ['b', 'c', 'd'], lastModifiedNsec: '300' };
+    w.expectFetch(
+      rateAndTagUrl('123', 4, ['b', 'c', 'd'], '200'),
+      'POST',
+      JSON.stringify(updated)
+    );
+    await updater.rateAndTag('123', 4, ['b', 'd'], base);
+    expectEq(w.numTimeouts, 0, 'numTimeouts');
+  });
+
+  test('rateAndTag (superseded base)', async () => {
+    initUpdater();
+
+    // After a successful update, later updates made using the song's original
+    // last-modified time should use the time from the update instead.
+    const song = { songId: '123', tags: ['a', 'b'], lastModifiedNsec: '200' };
+    w.expectFetch(
+      rateAndTagUrl('123', null, ['a', 'b'], '100'),
+      'POST',
+      JSON.stringify(song)
+    );
+    await updater.rateAndTag('123', null, ['a', 'b'], {
+      lastModifiedNsec: '100',
+      tags: ['a'],
+    });
+    w.expectFetch(
+      rateAndTagUrl('123', null, ['a', 'b', 'c'], '200'),
+      'POST',
+      JSON.stringify({
+        ...song,
+        tags: ['a', 'b', 'c'],
+        lastModifiedNsec: '300',
+      })
+    );
+    await updater.rateAndTag('123', null, ['a', 'b', 'c'], {
+      lastModifiedNsec: '100',
+      tags: ['a', 'b'],
+    });
+    expectEq(w.numTimeouts, 0, 'numTimeouts');
+  });
+
   test('rateAndTag (retry at startup)', async () => {
     // Make the initial attempt fail.
     initUpdater();
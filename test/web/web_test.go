@@ -1098,7 +1098,7 @@ func TestSongInfo(t *testing.T) {
 	song1 := newSong("a", "t1", "al1", withTrack(1), withLength(123),
 		withDate(test.Date(2015, 4, 3, 12, 13, 14)),
 		withRating(5), withTags("guitar", "instrumental"))
-	song2 := newSong("a", "t2", "al2", withTrack(5), withDisc(2),
+	song2 := newSong("a", "t2", "al2", withTrack(5), withTotalTracks(12), withDisc(2),
 		withDiscSubtitle("Second Disc"), withLength(52))
 	importSongs(song1, song2)
 
@@ -1127,7 +1127,7 @@ func TestSongInfo(t *testing.T) {
 	page.checkText(infoTitle, song2.Title)
 	page.checkText(infoAlbum, song2.Album)
 	page.checkText(infoDisc, fmt.Sprintf("%d (%s)", song2.Disc, song2.DiscSubtitle))
-	page.checkText(infoTrack, strconv.Itoa(song2.Track))
+	page.checkText(infoTrack, fmt.Sprintf("%d of %d", song2.Track, song2.TotalTracks))
 	page.checkText(infoDate, "")
 	page.checkText(infoLength, "0:52")
 	page.checkText(infoRating, "Unrated")
@@ -0,0 +1,102 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+// Decoder for BlurHash strings (https://blurha.sh/) as generated for
+// Song.coverBlurHash by cmd/nup/update/blurhash.go.
+
+const chars =
+  '0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~';
+
+function decode83(str: string) {
+  let val = 0;
+  for (const ch of str) {
+    const digit = chars.indexOf(ch);
+    if (digit < 0) throw new Error(`Invalid character ${ch}`);
+    val = val * 83 + digit;
+  }
+  return val;
+}
+
+function srgbToLinear(v: number) {
+  const f = v / 255;
+  return f <= 0.04045 ? f / 12.92 : Math.pow((f + 0.055) / 1.055, 2.4);
+}
+
+function linearToSrgb(v: number) {
+  const f = Math.max(0, Math.min(1, v));
+  return f <= 0.0031308
+    ? Math.round(f * 12.92 * 255)
+    : Math.round((1.055 * Math.pow(f, 1 / 2.4) - 0.055) * 255);
+}
+
+const signPow = (v: number, exp: number) =>
+  Math.sign(v) * Math.pow(Math.abs(v), exp);
+
+// Decodes |hash| into a |width|x|height| RGBA pixel array.
+// An error is thrown if |hash| is invalid.
+export function decodeBlurHash(hash: string, width: number, height: number) {
+  if (hash.length < 6) throw new Error('Hash too short');
+  const sizeFlag = decode83(hash[0]);
+  const numY = Math.floor(sizeFlag / 9) + 1;
+  const numX = (sizeFlag % 9) + 1;
+  if (hash.length !== 4 + 2 * numX * numY) {
+    throw new Error(`Expected ${4 + 2 * numX * numY} chars`);
+  }
+
+  const maxVal = (decode83(hash[1]) + 1) / 166;
+  const colors: number[][] = [];
+  const dc = decode83(hash.substring(2, 6));
+  colors.push([dc >> 16, (dc >> 8) & 255, dc & 255].map(srgbToLinear));
+  for (let i = 1; i < numX * numY; i++) {
+    const ac = decode83(hash.substring(4 + i * 2, 6 + i * 2));
+    colors.push(
+      [Math.floor(ac / 361), Math.floor(ac / 19) % 19, ac % 19].map(
+        (q) => signPow((q - 9) / 9, 2) * maxVal
+      )
+    );
+  }
+
+  const pixels = new Uint8ClampedArray(width * height * 4);
+  for (let y = 0; y < height; y++) {
+    for (let x = 0; x < width; x++) {
+      let r = 0;
+      let g = 0;
+      let b = 0;
+      for (let j = 0; j < numY; j++) {
+        for (let i = 0; i < numX; i++) {
+          const basis =
+            Math.cos((Math.PI * x * i) / width) *
+            Math.cos((Math.PI * y * j) / height);
+          const c = colors[i + j * numX];
+          r += c[0] * basis;
+          g += c[1] * basis;
+          b += c[2] * basis;
+        }
+      }
+      const idx = 4 * (x + y * width);
+      pixels[idx] = linearToSrgb(r);
+      pixels[idx + 1] = linearToSrgb(g);
+      pixels[idx + 2] = linearToSrgb(b);
+      pixels[idx + 3] = 255;
+    }
+  }
+  return pixels;
+}
+
+// Returns a data: URL containing a small PNG image decoded from |hash|,
+// or null if |hash| is invalid.
+export function getBlurHashUrl(hash: string, size = 32): string | null {
+  try {
+    const pixels = decodeBlurHash(hash, size, size);
+    const canvas = document.createElement('canvas');
+    canvas.width = size;
+    canvas.height = size;
+    const ctx = canvas.getContext('2d');
+    if (!ctx) return null;
+    ctx.putImageData(new ImageData(pixels, size, size), 0, 0);
+    return canvas.toDataURL();
+  } catch (err) {
+    console.error(`Failed decoding BlurHash ${hash}: ${err}`);
+    return null;
+  }
+}
@@ -103,10 +103,24 @@ export function createTemplate(html: string) {
   return template;
 }
 
-// Returns an absolute URL for the song specified by |filename| (corresponding
-// to a song's |filename| property).
-export const getSongUrl = (filename: string) =>
-  getAbsUrl(`/song?filename=${encodeURIComponent(filename)}`);
+// Returns an absolute URL for |song|'s audio data. Songs synthesized from
+// cue sheet tracks only request their portion of the underlying file.
+export function getSongUrl(song: Song) {
+  let path = `/song?filename=${encodeURIComponent(song.filename)}`;
+  if (song.fileEnd) path += `&start=${song.fileStart ?? 0}&end=${song.fileEnd}`;
+  return getAbsUrl(path);
+}
+
+// Returns the segment in |song| containing position |pos| in seconds, or null
+// if |song| doesn't have segments or |pos| precedes the first segment.
+export function getSegmentAt(song: Song, pos: number) {
+  let found: Segment | null = null;
+  for (const seg of song.segments ?? []) {
+    if (seg.start > pos) break;
+    found = seg;
+  }
+  return found;
+}
 
 // Image sizes that can be passed to getCoverUrl().
 export const smallCoverSize = 256;
@@ -144,6 +158,19 @@ export function handleFetchError(response: Response) {
   return response;
 }
 
+// Returns headers that should be included in state-changing requests to the
+// server. The server issues a CSRF token in a cookie along with the index page
+// and verifies that it's echoed back in a header.
+export function getCSRFHeaders(): Record<string, string> {
+  const prefix = 'nup_csrf='; // csrfCookie in server/csrf.go
+  const cookie = document.cookie
+    .split(';')
+    .map((c) => c.trim())
+    .find((c) => c.startsWith(prefix));
+  // csrfHeader in server/csrf.go
+  return cookie ? { 'X-Nup-CSRF-Token': cookie.slice(prefix.length) } : {};
+}
+
 // Converts a rating in the range [0, 5] (0 for unrated) to a string.
 export function getRatingString(rating: number) {
   rating = clamp(Math.round(rating), 0, 5);
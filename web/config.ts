@@ -7,6 +7,7 @@ export enum Pref {
   FULLSCREEN_MODE = 'fullscreenMode',
   GAIN_TYPE = 'gainType',
   PRE_AMP = 'preAmp',
+  LOUDNESS_TARGET = 'loudnessTarget',
 }
 
 // Values for Pref.THEME.
@@ -28,12 +29,13 @@ export enum GainType {
   TRACK = 1,
   NONE = 2,
   AUTO = 3,
+  LOUDNESS = 4, // normalize songs' EBU R128 loudness to Pref.LOUDNESS_TARGET
 }
 
 // localStorage key; exported for tests.
 export const ConfigKey = 'config';
 
-const FLOAT_NAMES = new Set([Pref.PRE_AMP]);
+const FLOAT_NAMES = new Set([Pref.PRE_AMP, Pref.LOUDNESS_TARGET]);
 const INT_NAMES = new Set([Pref.THEME, Pref.FULLSCREEN_MODE, Pref.GAIN_TYPE]);
 
 // Config provides persistent storage for preferences.
@@ -44,6 +46,7 @@ export class Config {
     [Pref.FULLSCREEN_MODE]: FullscreenMode.SCREEN,
     [Pref.GAIN_TYPE]: GainType.AUTO,
     [Pref.PRE_AMP]: 0,
+    [Pref.LOUDNESS_TARGET]: -14, // LUFS
   };
 
   constructor() {
@@ -7,21 +7,59 @@ declare interface Song {
   songId: string;
   filename: string;
   coverFilename?: string;
+  coverBlurHash?: string;
+  coverPalette?: string[];
   artist: string;
+  artistCredits?: ArtistCredit[];
+  artistSortName?: string;
   title: string;
   album: string;
   albumArtist?: string;
+  albumSortName?: string;
+  albumArtistSortName?: string;
+  composer?: string;
+  conductor?: string;
+  performer?: string;
   discSubtitle?: string;
+  genres?: string[];
+  compilation?: boolean;
   albumId?: string;
   track: number;
   disc: number;
+  totalTracks?: number;
+  totalDiscs?: number;
   date?: string;
+  originalDate?: string;
+  releaseDate?: string;
   length: number;
+  fileStart?: number;
+  fileEnd?: number;
+  segments?: Segment[];
+  bpm?: number;
+  key?: string;
   trackGain: number;
   albumGain: number;
   peakAmp: number;
+  loudness?: number;
+  truePeak?: number;
+  leadingSilence?: number;
+  trailingSilence?: number;
   rating: number;
   tags: string[];
+  notes?: string;
+  lastModifiedNsec?: string;
+}
+
+// Corresponds to Segment in server/db/song.go.
+declare interface ArtistCredit {
+  name: string;
+  mbid?: string;
+  joinPhrase?: string;
+}
+
+declare interface Segment {
+  title: string;
+  start: number;
 }
 
 // Corresponds to SearchPreset in server/config/config.go.
@@ -34,8 +72,12 @@ declare interface SearchPreset {
   lastPlayed: number;
   orderByLastPlayed: boolean;
   maxPlays: number;
+  maxSkipRatio?: number;
+  minBpm?: number;
+  maxBpm?: number;
   firstTrack: boolean;
   shuffle: boolean;
+  shuffleAlbums?: boolean;
   play: boolean;
 }
 
@@ -59,6 +59,28 @@ const fetchServerTags = () =>
     });
 fetchServerTags();
 
+// localStorage key holding the update time of the last server-side queue that
+// was loaded on this device.
+const lastQueueTimeKey = 'lastQueueTime';
+
+// Load songs from the server-side queue if it was filled by a scheduled preset
+// and has been updated since it was last loaded. Queues saved by other devices
+// for handoff aren't loaded automatically.
+fetch('queue', { method: 'GET' })
+  .then((res) => handleFetchError(res))
+  .then((res) => res.json())
+  .then((queue: { songs: Song[]; preset?: string; updateTime?: string }) => {
+    const time = queue.updateTime;
+    if (!queue.songs.length || !time || !queue.preset) return;
+    if (time === localStorage.getItem(lastQueueTimeKey)) return;
+    localStorage.setItem(lastQueueTimeKey, time);
+    console.log(`Loading ${queue.songs.length} song(s) from ${queue.preset}`);
+    playView.enqueueSongs(queue.songs, true, false);
+  })
+  .catch((err) => {
+    console.error(`Failed loading queue: ${err}`);
+  });
+
 // Use the cover art as the favicon.
 playView.addEventListener('cover', ((e: CustomEvent) => {
   const favicon = $('favicon') as HTMLLinkElement;
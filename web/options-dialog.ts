@@ -65,12 +65,27 @@ const template = createTemplate(`
         <option value="3">Auto</option>
         <option value="0">Album</option>
         <option value="1">Track</option>
+        <option value="4">Loudness</option>
         <option value="2">None</option>
       </select></span
     >
   </label>
 </div>
 
+<div class="row">
+  <label for="loudness-target-select">
+    <span class="label-col">Loudness target</span>
+    <span class="select-wrapper">
+      <select id="loudness-target-select">
+        <option value="-23">-23 LUFS</option>
+        <option value="-18">-18 LUFS</option>
+        <option value="-16">-16 LUFS</option>
+        <option value="-14">-14 LUFS</option>
+      </select></span
+    >
+  </label>
+</div>
+
 <div class="row">
   <label for="pre-amp-range">
     <span class="label-col">Pre-amp</span>
@@ -114,6 +129,15 @@ export function showOptionsDialog() {
     config.set(Pref.GAIN_TYPE, gainTypeSelect.value)
   );
 
+  const loudnessTargetSelect = $(
+    'loudness-target-select',
+    shadow
+  ) as HTMLSelectElement;
+  loudnessTargetSelect.value = config.get(Pref.LOUDNESS_TARGET).toString();
+  loudnessTargetSelect.addEventListener('change', () =>
+    config.set(Pref.LOUDNESS_TARGET, loudnessTargetSelect.value)
+  );
+
   const preAmpSpan = $('pre-amp-span', shadow);
   const updatePreAmpSpan = (v: number) =>
     (preAmpSpan.innerText = `${v > 0 ? '+' : ''}${v} dB`);
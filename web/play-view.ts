@@ -2,6 +2,7 @@
 // All rights reserved.
 
 import type { AudioWrapper } from './audio-wrapper.js';
+import { getBlurHashUrl } from './blurhash.js';
 import {
   $,
   clamp,
@@ -13,6 +14,7 @@ import {
   getCoverUrl,
   getDumpSongUrl,
   getRatingString,
+  getSegmentAt,
   getSongUrl,
   moveItem,
   preloadImage,
@@ -71,6 +73,7 @@ const template = createTemplate(`
     outline-offset: -1px;
   }
   #cover-img {
+    background-size: cover;
     cursor: pointer;
     height: 70px;
     object-fit: cover;
@@ -124,6 +127,12 @@ const template = createTemplate(`
   #title {
     font-style: italic;
   }
+  #segment {
+    opacity: 0.7;
+  }
+  #segment:empty {
+    display: none;
+  }
   #time {
     opacity: 0.7;
     /* Add a layout boundary since we update this frequently:
@@ -171,6 +180,7 @@ const template = createTemplate(`
   <div id="details">
     <div id="artist"></div>
     <div id="title"></div>
+    <div id="segment"></div>
     <div id="album"></div>
     <div id="time"></div>
   </div>
@@ -234,6 +244,8 @@ export class PlayView extends HTMLElement {
   #currentIndex = -1; // index into #songs of current track
   #startTime: Date | null = null; // time at which current track started playing
   #reportedCurrentTrack = false; // already reported current as played?
+  #prevPlayedSongId: string | null = null; // song started before current
+  #startedSongId: string | null = null; // song that set |#startTime|
   #reachedEndOfSongs = false; // did we hit end of last song?
   #updateDialog: UpdateDialog | null = null; // edit rating and tags
   #notification: Notification | null = null; // displays song changes
@@ -243,7 +255,7 @@ export class PlayView extends HTMLElement {
   #lastUpdatePosition = 0; // audio position in last #updatePosition()
   #updatePositionTimeoutId: number | null = null;
   #autoGainType = GainType.TRACK; // what to use for GainType.AUTO
-  #songUrls = new Map(); // cache of filename -> absolute URL
+  #songUrls = new Map(); // cache of song ID -> absolute URL
 
   #shadow = createShadow(this, template);
   #overlay = this.#shadow.querySelector(
@@ -258,6 +270,7 @@ export class PlayView extends HTMLElement {
   #ratingOverlay = $('rating-overlay', this.#shadow);
   #artistDiv = $('artist', this.#shadow);
   #titleDiv = $('title', this.#shadow);
+  #segmentDiv = $('segment', this.#shadow);
   #albumDiv = $('album', this.#shadow);
   #timeDiv = $('time', this.#shadow);
   #prevButton = $('prev', this.#shadow) as HTMLButtonElement;
@@ -274,7 +287,9 @@ export class PlayView extends HTMLElement {
     // We're leaking this callback, but it doesn't matter in practice since
     // play-view never gets removed from the DOM.
     this.#config.addCallback((name, value) => {
-      if ([Pref.GAIN_TYPE, Pref.PRE_AMP].includes(name)) {
+      if (
+        [Pref.GAIN_TYPE, Pref.PRE_AMP, Pref.LOUDNESS_TARGET].includes(name)
+      ) {
         this.#updateGain();
       }
     });
@@ -284,9 +299,12 @@ export class PlayView extends HTMLElement {
     const menuButton = $('menu-button', this.#shadow);
     menuButton.addEventListener('click', () => {
       const rect = menuButton.getBoundingClientRect();
+      const x = rect.right + 12; // compensate for right padding
+      const y = rect.bottom;
+      const segments = this.#currentSong?.segments ?? [];
       createMenu(
-        rect.right + 12, // compensate for right padding
-        rect.bottom,
+        x,
+        y,
         [
           {
             id: 'fullscreen',
@@ -315,6 +333,15 @@ export class PlayView extends HTMLElement {
             },
             hotkey: 'Alt+I',
           },
+          ...(segments.length
+            ? [
+                {
+                  id: 'chapters',
+                  text: 'Chapters…',
+                  cb: () => this.#showChaptersMenu(x, y, segments),
+                },
+              ]
+            : []),
           {
             id: 'debug',
             text: 'Debug…',
@@ -549,16 +576,16 @@ export class PlayView extends HTMLElement {
     return this.#songs[this.#currentIndex + 1] ?? null;
   }
 
-  // Returns the absolute URL corresponding to |filename| just like
+  // Returns the absolute URL corresponding to |song| just like
   // getSongUrl() in common.ts, but caches results to make calls cheap.
-  #getSongUrl(filename: string) {
+  #getSongUrl(song: Song) {
     const urls = this.#songUrls;
-    let url = urls.get(filename);
+    let url = urls.get(song.songId);
     if (url) return url;
 
-    url = getSongUrl(filename);
+    url = getSongUrl(song);
     while (urls.size >= MAX_SONG_URLS) urls.delete(urls.keys().next().value);
-    urls.set(filename, url);
+    urls.set(song.songId, url);
     return url;
   }
 
@@ -656,6 +683,7 @@ export class PlayView extends HTMLElement {
     index = clamp(index, 0, this.#songs.length - 1);
     if (index === this.#currentIndex) return;
 
+    this.#maybeReportSkip();
     this.#playlistTable.setRowActive(this.#currentIndex, false);
     this.#playlistTable.setRowActive(index, true);
     this.#playlistTable.scrollToRow(index);
@@ -668,6 +696,21 @@ export class PlayView extends HTMLElement {
     if (document.hidden) this.#showNotification();
   }
 
+  // Reports the current song as skipped if it was played briefly but not long
+  // enough to be reported as played.
+  #maybeReportSkip() {
+    const song = this.#currentSong;
+    if (!song || !this.#startTime || this.#reportedCurrentTrack) return;
+    if (this.#audio.playtime <= 0) return;
+    this.#updater?.reportSkip(
+      song.songId,
+      this.#startTime,
+      this.#audio.currentTime,
+      this.#prevPlayedSongId
+    );
+    this.#startTime = null;
+  }
+
   // Updates the view in response to a playlist change.
   // |currentChanged| indicates whether |#currentSong| also changed.
   #handlePlaylistChange(currentChanged: boolean) {
@@ -699,6 +742,7 @@ export class PlayView extends HTMLElement {
 
     this.#artistDiv.innerText = song ? song.artist : '';
     this.#titleDiv.innerText = song ? song.title : '';
+    this.#segmentDiv.innerText = '';
     this.#albumDiv.innerText = song ? song.album : '';
     this.#timeDiv.innerText = '';
 
@@ -708,10 +752,18 @@ export class PlayView extends HTMLElement {
 
     if (song && song.coverFilename) {
       const url = getCoverUrl(song.coverFilename, smallCoverSize);
+      // Display a placeholder behind the image while it's loading.
+      const placeholder = song.coverBlurHash
+        ? getBlurHashUrl(song.coverBlurHash)
+        : null;
+      this.#coverImage.style.backgroundImage = placeholder
+        ? `url(${placeholder})`
+        : '';
       this.#coverImage.src = url;
       this.#coverDiv.classList.remove('empty');
       this.dispatchEvent(new CustomEvent('cover', { detail: { url } }));
     } else {
+      this.#coverImage.style.backgroundImage = '';
       this.#coverImage.src = emptyImg;
       this.#coverDiv.classList.add('empty');
       this.dispatchEvent(new CustomEvent('cover', { detail: { url: null } }));
@@ -866,7 +918,7 @@ export class PlayView extends HTMLElement {
 
     // Get an absolute URL since that's what we'll get from the <audio>
     // element: https://stackoverflow.com/a/44547904
-    const url = this.#getSongUrl(song.filename);
+    const url = this.#getSongUrl(song);
     if (this.#audio.src !== url || this.#reachedEndOfSongs) {
       console.log(`Starting ${song.songId} (${url})`);
       this.#audio.src = url;
@@ -874,6 +926,10 @@ export class PlayView extends HTMLElement {
 
       this.#startTime = new Date();
       this.#reportedCurrentTrack = false;
+      if (this.#startedSongId !== song.songId) {
+        this.#prevPlayedSongId = this.#startedSongId;
+        this.#startedSongId = song.songId;
+      }
       this.#reachedEndOfSongs = false;
       this.#lastUpdatePosition = 0;
       this.#updateGain();
@@ -907,6 +963,26 @@ export class PlayView extends HTMLElement {
     this.#audio.paused ? this.#play() : this.#pause();
   }
 
+  // Displays a menu at (x, y) for seeking to |segments| in the current song.
+  #showChaptersMenu(x: number, y: number, segments: Segment[]) {
+    createMenu(
+      x,
+      y,
+      segments.map((seg, i) => ({
+        id: `chapter-${i}`,
+        text: `${formatDuration(seg.start)} ${seg.title}`,
+        cb: () => this.#seekTo(seg.start),
+      })),
+      true /* alignRight */
+    );
+  }
+
+  #seekTo(pos: number) {
+    if (!this.#audio.seekable) return;
+    this.#audio.currentTime = pos;
+    this.#updatePosition();
+  }
+
   #seek(seconds: number) {
     if (!this.#audio.seekable) return;
     const newTime = Math.max(this.#audio.currentTime + seconds, 0);
@@ -961,7 +1037,11 @@ export class PlayView extends HTMLElement {
     const dur = song.length;
 
     if (!this.#reportedCurrentTrack && (played >= 240 || played > dur / 2)) {
-      this.#updater?.reportPlay(song.songId, this.#startTime!);
+      this.#updater?.reportPlay(
+        song.songId,
+        this.#startTime!,
+        this.#prevPlayedSongId
+      );
       this.#reportedCurrentTrack = true;
     }
 
@@ -971,11 +1051,18 @@ export class PlayView extends HTMLElement {
     if (!document.hidden) {
       const str = dur ? `${formatDuration(pos)} / ${formatDuration(dur)}` : '';
       if (this.#timeDiv.innerText !== str) this.#timeDiv.innerText = str;
+
+      const seg = getSegmentAt(song, pos);
+      const title = seg ? seg.title : '';
+      if (this.#segmentDiv.innerText !== title) {
+        this.#segmentDiv.innerText = title;
+        updateTitleAttributeForTruncation(this.#segmentDiv, title);
+      }
     }
 
     // Preload the next song once we're nearing the end of this one.
     if (pos >= dur - PRELOAD_SEC && this.#nextSong) {
-      const url = this.#getSongUrl(this.#nextSong.filename);
+      const url = this.#getSongUrl(this.#nextSong);
       if (this.#audio.preloadSrc !== url) {
         console.log(`Preloading ${this.#nextSong.songId} (${url})`);
         this.#audio.preloadSrc = url;
@@ -1023,7 +1110,10 @@ export class PlayView extends HTMLElement {
 
         if (rating === null && tags === null) return;
 
-        this.#updater?.rateAndTag(song.songId, rating, tags);
+        const base = song.lastModifiedNsec
+          ? { lastModifiedNsec: song.lastModifiedNsec, tags: song.tags }
+          : null;
+        this.#updater?.rateAndTag(song.songId, rating, tags, base);
 
         const isCurrent = song === this.#currentSong;
 
@@ -1052,12 +1142,22 @@ export class PlayView extends HTMLElement {
     let adj = this.#config.get(Pref.PRE_AMP); // decibels
 
     let reason = '';
+    let maxScale = Infinity;
     const song = this.#currentSong;
     if (song) {
       let gainType = this.#config.get(Pref.GAIN_TYPE);
       if (gainType === GainType.AUTO) gainType = this.#autoGainType;
+      // Fall back to ReplayGain for songs whose loudness wasn't measured.
+      if (gainType === GainType.LOUDNESS && !song.loudness) {
+        gainType = GainType.TRACK;
+      }
 
-      if (gainType === GainType.ALBUM) {
+      if (gainType === GainType.LOUDNESS) {
+        const target = this.#config.get(Pref.LOUDNESS_TARGET);
+        adj += target - song.loudness!;
+        reason = ` for ${target} LUFS`;
+        maxScale = 10 ** (-(song.truePeak ?? 0) / 20);
+      } else if (gainType === GainType.ALBUM) {
         adj += song.albumGain ?? 0;
         reason = ' for album';
       } else if (gainType === GainType.TRACK) {
@@ -1069,7 +1169,8 @@ export class PlayView extends HTMLElement {
     let scale = 10 ** (adj / 20);
 
     // TODO: Add an option to prevent clipping instead of always doing this?
-    if (song?.peakAmp) scale = Math.min(scale, 1 / song.peakAmp);
+    if (maxScale !== Infinity) scale = Math.min(scale, maxScale);
+    else if (song?.peakAmp) scale = Math.min(scale, 1 / song.peakAmp);
 
     console.log(`Scaling amplitude by ${scale.toFixed(3)}${reason}`);
     this.#audio.gain = scale;
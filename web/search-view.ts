@@ -88,6 +88,10 @@ const template = createTemplate(`
   #min-date-input {
     margin-right: 6px;
   }
+  #date-field-select-wrapper {
+    margin-left: 6px;
+    margin-right: 0;
+  }
   #first-track-checkbox {
     margin-left: var(--margin);
   }
@@ -150,12 +154,15 @@ const template = createTemplate(`
 <form id="search-form" autocomplete="off">
   <div class="heading">Search</div>
   <div class="row">
-    <input
-      id="keywords-input"
-      type="text"
-      placeholder="Keywords"
-      title="Space-separated words from artists, titles, and albums"
-    />
+    <tag-suggester id="keywords-suggester" tab-advances-focus>
+      <input
+        id="keywords-input"
+        slot="text"
+        type="text"
+        placeholder="Keywords"
+        title="Space-separated words from artists, titles, and albums"
+      />
+    </tag-suggester>
     <svg id="keywords-clear" title="Clear text"></svg>
   </div>
 
@@ -187,6 +194,13 @@ const template = createTemplate(`
       placeholder="max date"
       title="Maximum song date (YYYY-MM-DD or YYYY)"
     />
+    <span id="date-field-select-wrapper" class="select-wrapper">
+      <select id="date-field-select" title="Date to compare against">
+        <option value="">date</option>
+        <option value="original">original</option>
+        <option value="release">release</option>
+      </select></span
+    >
   </div>
 
   <div class="row">
@@ -351,6 +365,9 @@ const template = createTemplate(`
 <svg id="spinner"></svg>
 `);
 
+const suggestDelayMs = 300; // delay after typing before fetching suggestions
+const minSuggestLength = 2; // see db.MinKeywordPrefixLen
+
 // <search-view> displays a form for sending queries to the server and
 // displays the results in a <song-table>. It provides controls for enqueuing
 // some or all of the results.
@@ -370,10 +387,12 @@ export class SearchView extends HTMLElement {
   #getButton = (id: string) => $(id, this.#shadow) as HTMLButtonElement;
 
   #keywordsInput = this.#getInput('keywords-input');
+  #keywordSuggester = $('keywords-suggester', this.#shadow) as TagSuggester;
   #tagSuggester = $('tags-suggester', this.#shadow) as TagSuggester;
   #tagsInput = this.#getInput('tags-input');
   #minDateInput = this.#getInput('min-date-input');
   #maxDateInput = this.#getInput('max-date-input');
+  #dateFieldSelect = this.#getSelect('date-field-select');
   #shuffleCheckbox = this.#getInput('shuffle-checkbox');
   #firstTrackCheckbox = this.#getInput('first-track-checkbox');
   #unratedCheckbox = this.#getInput('unrated-checkbox');
@@ -388,6 +407,11 @@ export class SearchView extends HTMLElement {
   #resultsTable = $('results-table', this.#shadow) as SongTable;
   #spinner = $('spinner', this.#shadow);
   #presets: SearchPreset[] = [];
+  #maxSkipRatio = 0; // from selected preset; 0 if unrestricted
+  #minBpm = 0; // from selected preset; 0 if unrestricted
+  #maxBpm = 0; // from selected preset; 0 if unrestricted
+  #shuffleAlbums = false; // from selected preset
+  #suggestTimeout: number | undefined = undefined; // for #fetchSuggestions
 
   constructor() {
     super();
@@ -395,6 +419,13 @@ export class SearchView extends HTMLElement {
     this.#shadow.adoptedStyleSheets = [commonStyles];
 
     this.#keywordsInput.addEventListener('keydown', this.#onFormKeyDown);
+    this.#keywordsInput.addEventListener('input', () => {
+      window.clearTimeout(this.#suggestTimeout);
+      this.#suggestTimeout = window.setTimeout(
+        () => this.#fetchSuggestions(),
+        suggestDelayMs
+      );
+    });
     setIcon($('keywords-clear', this.#shadow), xIcon).addEventListener(
       'click',
       () => (this.#keywordsInput.value = '')
@@ -543,10 +574,13 @@ export class SearchView extends HTMLElement {
       });
   }
 
-  #submitQuery(appendToQueue: boolean) {
+  // Submits a query using the values from the search form. If |preset| is
+  // supplied, it is reported to the server so it can track preset usage.
+  #submitQuery(appendToQueue: boolean, preset?: string) {
     const params = new URLSearchParams();
+    // The server parses operators like 'artist:' and '-' in keywords.
     if (this.#keywordsInput.value.trim()) {
-      parseKeywords(this.#keywordsInput.value, params);
+      params.set('keywords', this.#keywordsInput.value.trim());
     }
     if (this.#tagsInput.value.trim()) {
       params.set('tags', this.#tagsInput.value.trim());
@@ -565,6 +599,12 @@ export class SearchView extends HTMLElement {
         params.set('maxDate', new Date(s).toISOString());
       }
     }
+    if (
+      (params.has('minDate') || params.has('maxDate')) &&
+      this.#dateFieldSelect.value
+    ) {
+      params.set('dateField', this.#dateFieldSelect.value);
+    }
     if (
       !this.#ratingOpSelect.disabled &&
       !this.#ratingStarsSelect.disabled &&
@@ -587,6 +627,12 @@ export class SearchView extends HTMLElement {
     if (parseInt(this.#maxPlaysInput.value) >= 0) {
       params.set('maxPlays', parseInt(this.#maxPlaysInput.value).toString());
     }
+    if (this.#maxSkipRatio > 0) {
+      params.set('maxSkipRatio', this.#maxSkipRatio.toString());
+    }
+    if (this.#minBpm > 0) params.set('minBPM', this.#minBpm.toString());
+    if (this.#maxBpm > 0) params.set('maxBPM', this.#maxBpm.toString());
+    if (this.#shuffleAlbums) params.set('shuffleAlbums', '1');
     const firstPlayed = parseInt(this.#firstPlayedSelect.value);
     if (firstPlayed !== 0) {
       const date = new Date(Date.now() - firstPlayed * 1000);
@@ -597,8 +643,14 @@ export class SearchView extends HTMLElement {
       const date = new Date(Date.now() - lastPlayed * 1000);
       params.set('maxLastPlayed', date.toISOString());
     }
+    if (preset) params.set('preset', preset);
+
+    this.#fetchSongs('query?' + params.toString(), appendToQueue);
+  }
 
-    const url = 'query?' + params.toString();
+  // Fetches songs from |url| and displays them in the results table.
+  // If |appendToQueue| is true, the songs are also enqueued.
+  #fetchSongs(url: string, appendToQueue: boolean) {
     console.log(`Sending query: ${url}`);
 
     this.#fetchController?.abort();
@@ -666,6 +718,7 @@ export class SearchView extends HTMLElement {
     this.#tagsInput.value = '';
     this.#minDateInput.value = '';
     this.#maxDateInput.value = '';
+    this.#dateFieldSelect.selectedIndex = 0;
     this.#shuffleCheckbox.checked = false;
     this.#firstTrackCheckbox.checked = false;
     this.#ratingOpSelect.selectedIndex = 0;
@@ -673,6 +726,10 @@ export class SearchView extends HTMLElement {
     this.#unratedCheckbox.checked = false;
     this.#orderByLastPlayedCheckbox.checked = false;
     this.#maxPlaysInput.value = '';
+    this.#maxSkipRatio = 0;
+    this.#minBpm = 0;
+    this.#maxBpm = 0;
+    this.#shuffleAlbums = false;
     this.#firstPlayedSelect.selectedIndex = 0;
     this.#lastPlayedSelect.selectedIndex = 0;
     this.#presetSelect.selectedIndex = 0;
@@ -683,6 +740,29 @@ export class SearchView extends HTMLElement {
     this.scrollIntoView();
   }
 
+  // Fetches completions from the server for the word being typed into the
+  // keywords input and passes them to the suggester.
+  #fetchSuggestions() {
+    this.#suggestTimeout = undefined;
+    const text = this.#keywordsInput.value;
+    const caret = this.#keywordsInput.selectionStart ?? text.length;
+    const word = text.slice(0, caret).split(' ').pop() ?? '';
+    // Skip short words, excluded words, phrases, and terms like 'artist:foo'.
+    if (word.length < minSuggestLength || /^[-"]|:/.test(word)) return;
+
+    fetch('suggest?q=' + encodeURIComponent(word.toLowerCase()), {
+      method: 'GET',
+    })
+      .then((res) => handleFetchError(res))
+      .then((res) => res.json())
+      .then((sugs: { words: string[] }) => {
+        this.#keywordSuggester.words = sugs.words;
+      })
+      .catch((err) => {
+        console.error(`Failed fetching suggestions: ${err}`);
+      });
+  }
+
   // Handles the "I'm Feeling Lucky" button being clicked.
   #doLuckySearch() {
     if (
@@ -701,6 +781,9 @@ export class SearchView extends HTMLElement {
       this.#shuffleCheckbox.checked = true;
       this.#ratingOpSelect.selectedIndex = 0; // at least
       this.#ratingStarsSelect.selectedIndex = 4; // 4 stars
+      // The server can choose random songs without running a full query.
+      this.#fetchSongs('random?minRating=4', true);
+      return;
     }
     this.#submitQuery(true);
   }
@@ -736,6 +819,10 @@ export class SearchView extends HTMLElement {
     this.#lastPlayedSelect.selectedIndex = preset.lastPlayed;
     this.#maxPlaysInput.value =
       preset.maxPlays >= 0 ? preset.maxPlays.toString() : '';
+    this.#maxSkipRatio = preset.maxSkipRatio ?? 0;
+    this.#minBpm = preset.minBpm ?? 0;
+    this.#maxBpm = preset.maxBpm ?? 0;
+    this.#shuffleAlbums = preset.shuffleAlbums ?? false;
     this.#firstTrackCheckbox.checked = preset.firstTrack;
     this.#shuffleCheckbox.checked = preset.shuffle;
 
@@ -745,7 +832,7 @@ export class SearchView extends HTMLElement {
     // presets.
     this.#presetSelect.blur();
 
-    this.#submitQuery(preset.play);
+    this.#submitQuery(preset.play, preset.name);
   };
 
   #onBodyKeyDown = (e: KeyboardEvent) => {
@@ -760,58 +847,3 @@ export class SearchView extends HTMLElement {
 }
 
 customElements.define('search-view', SearchView);
-
-// Parses a value from the keywords input field into |params|.
-// Terms prefixed with 'artist:', 'title:', 'albumId:', or 'album:'
-// are mapped to the associated parameters and remaining terms
-// are assigned to the 'keywords' parameter.
-function parseKeywords(text: string, params: URLSearchParams) {
-  const keywords: string[] = [];
-
-  text = text.trim();
-  while (text.length) {
-    if (
-      text.startsWith('artist:') ||
-      text.startsWith('title:') ||
-      text.startsWith('albumId:') ||
-      text.startsWith('album:')
-    ) {
-      const key = text.substring(0, text.indexOf(':'));
-
-      // Skip over key and leading whitespace.
-      let index = key.length + 1;
-      for (; index < text.length && text[index] === ' '; index++);
-
-      let value = '';
-      let inEscape = false;
-      let inQuote = false;
-      for (; index < text.length; index++) {
-        const ch = text[index];
-        if (ch === '\\' && !inEscape) {
-          inEscape = true;
-        } else if (ch === '"' && !inEscape) {
-          inQuote = !inQuote;
-        } else if (ch === ' ' && !inQuote) {
-          break;
-        } else {
-          value += ch;
-          inEscape = false;
-        }
-      }
-
-      if (value.length) params.set(key, value);
-      text = text.substring(index);
-    } else {
-      const match = text.match(/^(\S+)(.*)/);
-      // The server splits on non-alphanumeric characters to make keywords.
-      // Split on miscellaneous punctuation here to at least handle some of this.
-      keywords.push(
-        ...match![1].split(/[-_+=~!?@#$%^&*()'".,:;]+/).filter((s) => s.length)
-      );
-      text = match![2];
-    }
-    text = text.trim();
-  }
-
-  if (keywords.length) params.set('keywords', keywords.join(' '));
-}
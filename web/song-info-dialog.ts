@@ -68,6 +68,9 @@ const template = createTemplate(`
   #rating.rated {
     letter-spacing: 3px;
   }
+  .info-table tr.hidden {
+    display: none;
+  }
 </style>
 
 <div class="title">Song info</div>
@@ -82,10 +85,17 @@ const template = createTemplate(`
     <tr><td>Artist</td><td id="artist"></td></tr>
     <tr><td>Title</td><td id="title"></td></tr>
     <tr><td>Album</td><td><a id="album"></a></td></tr>
+    <tr id="album-artist-row"><td>Album artist</td><td id="album-artist"></td></tr>
+    <tr id="composer-row"><td>Composer</td><td id="composer"></td></tr>
+    <tr id="conductor-row"><td>Conductor</td><td id="conductor"></td></tr>
+    <tr id="performer-row"><td>Performer</td><td id="performer"></td></tr>
     <tr><td>Disc</td><td id="disc"></td></tr>
     <tr><td>Track</td><td id="track"></td></tr>
     <tr><td>Date</td><td id="date"></td></tr>
+    <tr id="genres-row"><td>Genres</td><td id="genres"></td></tr>
     <tr><td>Length</td><td id="length"></td></tr>
+    <tr id="bpm-row"><td>BPM</td><td id="bpm"></td></tr>
+    <tr id="key-row"><td>Key</td><td id="key"></td></tr>
     <tr><td>Rating</td><td id="rating"></td></tr>
     <tr><td>Tags</td><td id="tags"></td></tr>
   </table>
@@ -132,10 +142,23 @@ export function showSongInfoDialog(song: Song, isCurrent = false) {
     link.href = 'https://musicbrainz.org/release/' + song.albumId;
     link.target = '_blank';
   }
+  // Only show additional credits and metadata if they're set.
+  for (const [id, val] of [
+    ['album-artist', song.albumArtist],
+    ['composer', song.composer],
+    ['conductor', song.conductor],
+    ['performer', song.performer],
+    ['genres', song.genres?.join(', ')],
+    ['bpm', song.bpm ? `${Math.round(song.bpm * 10) / 10}` : undefined],
+    ['key', song.key],
+  ] as [string, string | undefined][]) {
+    if (val) $(id, shadow).innerText = val;
+    else $(`${id}-row`, shadow).classList.add('hidden');
+  }
   $('disc', shadow).innerText =
-    (song.disc >= 1 ? song.disc.toString() : '') +
+    formatPosition(song.disc, song.totalDiscs) +
     (song.discSubtitle ? ` (${song.discSubtitle})` : '');
-  $('track', shadow).innerText = song.track >= 1 ? song.track.toString() : '';
+  $('track', shadow).innerText = formatPosition(song.track, song.totalTracks);
   $('date', shadow).innerText = song.date?.substring(0, 10) ?? '';
   $('length', shadow).innerText = formatDuration(song.length);
   $('rating', shadow).innerText = getRatingString(song.rating);
@@ -143,3 +166,10 @@ export function showSongInfoDialog(song: Song, isCurrent = false) {
   $('tags', shadow).innerText = song.tags?.join(' ') ?? '';
   $('dismiss-button', shadow).addEventListener('click', () => dialog.close());
 }
+
+// Formats a 1-based track or disc number, e.g. "3" or "3 of 12".
+// An empty string is returned if |pos| is unset.
+function formatPosition(pos: number, total?: number) {
+  if (pos < 1) return '';
+  return total ? `${pos} of ${total}` : pos.toString();
+}
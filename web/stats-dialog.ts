@@ -42,6 +42,9 @@ const template = createTemplate(`
     display: flex;
     margin-bottom: var(--margin);
   }
+  .chart-wrapper.hidden {
+    display: none;
+  }
   .chart-wrapper .label {
     min-width: 5em;
   }
@@ -64,19 +67,38 @@ const template = createTemplate(`
     user-select: none;
   }
 
-  #years-div {
+  #plays-wrapper.hidden {
+    display: none;
+  }
+  .histogram {
+    align-items: flex-end;
+    display: flex;
+    gap: 1px;
+    height: 24px;
+    width: 100%;
+  }
+  .histogram span {
+    background-color: rgba(var(--chart-bar-rgb), 0.8);
+    flex: 1;
+    min-height: 1px;
+  }
+
+  .table-div {
     line-height: 1.2em;
     margin-bottom: var(--margin);
     max-height: 180px;
     overflow: scroll;
     width: 100%;
   }
-  #years-table {
+  .table-div.hidden {
+    display: none;
+  }
+  .table-div table {
     border-spacing: 0;
     table-layout: fixed;
     width: 100%;
   }
-  #years-table th {
+  .table-div th {
     background-color: var(--bg-color);
     position: sticky;
     top: 0;
@@ -84,7 +106,7 @@ const template = createTemplate(`
   }
   /* Gross hack from https://stackoverflow.com/a/57170489/6882947 to keep
    * border from scrolling along with table contents. */
-  #years-table th:after {
+  .table-div th:after {
     border-bottom: solid 1px var(--border-color);
     border-collapse: collapse;
     bottom: 0;
@@ -93,15 +115,27 @@ const template = createTemplate(`
     left: 0;
     width: 100%;
   }
-  #years-table th,
-  #years-div td {
+  .table-div th,
+  .table-div td {
     text-align: right;
   }
-  #years-table th:first-child,
-  #years-div td:first-child {
+  .table-div th:first-child,
+  .table-div td:first-child {
     text-align: left;
+  }
+  #years-table th:first-child {
     width: 2.5em;
   }
+  #top-artists-table th:first-child,
+  #top-albums-table th:first-child {
+    width: 55%;
+  }
+  #top-artists-table td:first-child,
+  #top-albums-table td:first-child {
+    overflow: hidden;
+    text-overflow: ellipsis;
+    white-space: nowrap;
+  }
 
   #updated-div {
     font-size: 90%;
@@ -129,7 +163,24 @@ const template = createTemplate(`
     <div id="ratings-chart" class="chart"></div>
   </div>
 
-  <div id="years-div">
+  <div id="genres-wrapper" class="chart-wrapper">
+    <span class="label">Genres:</span>
+    <div id="genres-chart" class="chart"></div>
+  </div>
+
+  <div id="plays-wrapper">
+    <div class="chart-wrapper">
+      <span class="label">Hours:</span>
+      <div id="hours-chart" class="histogram"></div>
+    </div>
+
+    <div class="chart-wrapper">
+      <span class="label">Days:</span>
+      <div id="weekdays-chart" class="histogram"></div>
+    </div>
+  </div>
+
+  <div class="table-div">
     <table id="years-table">
       <thead>
         <tr>
@@ -143,6 +194,32 @@ const template = createTemplate(`
       <tbody></tbody>
     </table>
   </div>
+
+  <div id="top-artists-div" class="table-div">
+    <table id="top-artists-table">
+      <thead>
+        <tr>
+          <th>Artist</th>
+          <th>Plays</th>
+          <th>Playtime</th>
+        </tr>
+      </thead>
+      <tbody></tbody>
+    </table>
+  </div>
+
+  <div id="top-albums-div" class="table-div">
+    <table id="top-albums-table">
+      <thead>
+        <tr>
+          <th>Album</th>
+          <th>Plays</th>
+          <th>Playtime</th>
+        </tr>
+      </thead>
+      <tbody></tbody>
+    </table>
+  </div>
 </div>
 
 <div id="updated-div">Loading stats...</div>
@@ -186,10 +263,23 @@ interface Stats {
   ratings: Record<string, number>;
   songDecades: Record<string, number>;
   tags: Record<string, number>;
+  genres?: Record<string, number>;
   years: Record<string, PlayStats>;
+  topArtists?: PlayedItem[];
+  topAlbums?: PlayedItem[];
+  hours?: number[];
+  weekdays?: number[];
   updateTime: string;
 }
 
+interface PlayedItem {
+  artist: string;
+  album?: string;
+  albumId?: string;
+  plays: number;
+  totalSec: number;
+}
+
 interface PlayStats {
   plays: number;
   totalSec: number;
@@ -199,7 +289,16 @@ interface PlayStats {
 
 let cachedStats: Stats | null = null;
 
+// Maximum number of genres to display individually in the genres chart.
+// Less-common genres are combined into a single "Other" span.
+const maxChartGenres = 7;
+
 const formatDays = (sec: number) => `${(sec / 86400).toFixed(1)} days`;
+const formatHours = (sec: number) => `${(sec / 3600).toFixed(1)} hours`;
+const formatPlays = (n: number) =>
+  `${n.toLocaleString()} ${n !== 1 ? 'plays' : 'play'}`;
+
+const weekdayNames = ['Sun', 'Mon', 'Tue', 'Wed', 'Thu', 'Fri', 'Sat'];
 
 // Fetches stats from the server.
 const fetchStats = () =>
@@ -239,6 +338,22 @@ function updateDialog(shadow: ShadowRoot, stats: Stats) {
     )
   );
 
+  const genres = Object.entries(stats.genres ?? {}).sort(
+    ([ga, ca], [gb, cb]) => cb - ca || ga.localeCompare(gb)
+  );
+  if (genres.length > maxChartGenres + 1) {
+    const other = genres.splice(maxChartGenres);
+    genres.push(['Other', other.reduce((sum, [_, c]) => sum + c, 0)]);
+  }
+  $('genres-wrapper', shadow).classList.toggle('hidden', !genres.length);
+  fillChart(
+    $('genres-chart', shadow),
+    genres.map(([_, c]) => c),
+    genres.reduce((sum, [_, c]) => sum + c, 0),
+    genres.map(([g, _]) => g),
+    genres.map(([g, c]) => `${g} - ${c} ${c !== 1 ? 'songs' : 'song'}`)
+  );
+
   const tbody = shadow.querySelector('#years-table tbody') as HTMLElement;
   while (tbody.lastChild) tbody.removeChild(tbody.lastChild);
   for (const [year, ystats] of Object.entries(stats.years).sort()) {
@@ -253,6 +368,34 @@ function updateDialog(shadow: ShadowRoot, stats: Stats) {
     tbody.lastElementChild?.scrollIntoView(false /* alignToTop */)
   );
 
+  const hours = stats.hours ?? [];
+  const weekdays = stats.weekdays ?? [];
+  $('plays-wrapper', shadow).classList.toggle(
+    'hidden',
+    !hours.some((n) => n > 0)
+  );
+  fillHistogram(
+    $('hours-chart', shadow),
+    hours,
+    hours.map((n, i) => `${i}:00 - ${formatPlays(n)}`)
+  );
+  fillHistogram(
+    $('weekdays-chart', shadow),
+    weekdays,
+    weekdays.map((n, i) => `${weekdayNames[i]} - ${formatPlays(n)}`)
+  );
+
+  fillTopTable(
+    $('top-artists-div', shadow),
+    stats.topArtists ?? [],
+    (item) => item.artist
+  );
+  fillTopTable(
+    $('top-albums-div', shadow),
+    stats.topAlbums ?? [],
+    (item) => `${item.album} - ${item.artist}`
+  );
+
   const updateTime = formatRelativeTime(
     (Date.parse(stats.updateTime) - Date.now()) / 1000
   );
@@ -261,6 +404,37 @@ function updateDialog(shadow: ShadowRoot, stats: Stats) {
   $('stats-div', shadow).classList.add('ready');
 }
 
+// Adds rows to the table within |div| describing |items|. |getName| returns the
+// name to display for each item. |div| is hidden if |items| is empty.
+function fillTopTable(
+  div: HTMLElement,
+  items: PlayedItem[],
+  getName: (item: PlayedItem) => string
+) {
+  div.classList.toggle('hidden', !items.length);
+  const tbody = div.querySelector('tbody') as HTMLElement;
+  while (tbody.lastChild) tbody.removeChild(tbody.lastChild);
+  for (const item of items) {
+    const row = createElement('tr', null, tbody);
+    const name = getName(item);
+    createElement('td', null, row, name).title = name;
+    createElement('td', null, row, item.plays.toLocaleString());
+    createElement('td', null, row, formatHours(item.totalSec));
+  }
+}
+
+// Adds bars within |div| with heights proportional to |vals|.
+function fillHistogram(div: HTMLElement, vals: number[], titles: string[]) {
+  while (div.lastChild) div.removeChild(div.lastChild);
+  const max = Math.max(0, ...vals);
+  if (max <= 0) return;
+  for (let i = 0; i < vals.length; i++) {
+    const el = createElement('span', null, div);
+    el.style.height = `${(100 * vals[i]) / max}%`;
+    el.title = titles[i];
+  }
+}
+
 // Adds spans within |div| corresponding to |vals| and |titles|.
 function fillChart(
   div: HTMLElement,
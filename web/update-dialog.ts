@@ -6,6 +6,7 @@ import {
   clamp,
   createTemplate,
   emptyStarIcon,
+  handleFetchError,
   setIcon,
   starIcon,
   xIcon,
@@ -62,6 +63,22 @@ const template = createTemplate(`
     resize: none;
     width: 260px;
   }
+  #suggested-tags {
+    font-size: 12px;
+    margin-top: 6px;
+    max-width: 260px;
+  }
+  #suggested-tags:empty {
+    display: none;
+  }
+  #suggested-tags a {
+    cursor: pointer;
+    margin-right: 6px;
+    opacity: 0.7;
+  }
+  #suggested-tags a:hover {
+    opacity: 1;
+  }
   #tag-suggester {
     bottom: 52px;
     left: 4px;
@@ -88,8 +105,11 @@ const template = createTemplate(`
 <tag-suggester id="tag-suggester">
   <textarea id="tags-textarea" slot="text" placeholder="Tags"></textarea>
 </tag-suggester>
+<div id="suggested-tags"></div>
 `);
 
+const maxSuggestedTags = 8; // max suggested tags to display
+
 // UpdateDialog displays a dialog to update a song's rating and tags.
 export default class UpdateDialog {
   #song: Song;
@@ -147,6 +167,8 @@ export default class UpdateDialog {
       this.#tagsTextarea.value.length;
 
     document.body.addEventListener('keydown', this.#onBodyKeyDown);
+
+    this.#fetchSuggestedTags();
   }
 
   focusRating() {
@@ -189,6 +211,40 @@ export default class UpdateDialog {
     this.#callback(this.#song, rating, tags);
   }
 
+  // Fetches suggested tags for the song from the server and displays them as
+  // links that add the tag to the textarea when clicked.
+  #fetchSuggestedTags() {
+    const div = $('suggested-tags', this.#shadow);
+    fetch(
+      `tag_suggestions?songId=${encodeURIComponent(this.#song.songId)}` +
+        `&max=${maxSuggestedTags}`,
+      { method: 'GET' }
+    )
+      .then((res) => handleFetchError(res))
+      .then((res) => res.json())
+      .then((sugs: { tag: string; score: number }[]) => {
+        for (const { tag } of sugs) {
+          const a = document.createElement('a');
+          a.innerText = tag;
+          a.title = 'Add tag';
+          a.addEventListener('click', () => {
+            const text = this.#tagsTextarea.value;
+            const words = text.trim().split(/\s+/);
+            if (!words.includes(tag)) {
+              const sep = text === '' || text.endsWith(' ') ? '' : ' ';
+              this.#tagsTextarea.value = text + sep + tag + ' ';
+            }
+            a.remove();
+            this.#tagsTextarea.focus();
+          });
+          div.appendChild(a);
+        }
+      })
+      .catch((err) => {
+        console.error(`Failed fetching suggested tags: ${err}`);
+      });
+  }
+
   #setRating(rating: number) {
     this.#rating = rating;
     for (let i = 1; i <= 5; i++) {
@@ -1,7 +1,7 @@
 // Copyright 2015 Daniel Erat.
 // All rights reserved.
 
-import { handleFetchError, underTest } from './common.js';
+import { getCSRFHeaders, handleFetchError, underTest } from './common.js';
 
 // localStorage prefixes.
 const QUEUED_PLAYS = 'queued_plays';
@@ -19,6 +19,8 @@ export default class Updater {
   #suffix = '.' + Math.random().toString().slice(2, 10).toString();
   #sendTimeoutId: number | null = null; // for #doSend()
   #lastSendDelayMs = 0; // used by #scheduleSend()
+  // Last-modified times of songs that we updated, keyed by song ID.
+  #superseded: Record<string, { from: string; to: string }> = {};
   #initialSendDone: Promise<void>;
 
   // Adopt records regardless of their age when running in tests.
@@ -49,19 +51,25 @@ export default class Updater {
   }
 
   // Asynchronously notifies the server that song |songId| was played starting
-  // at |startTime|. Returns a promise that is resolved once the reporting
-  // attempt is completed (possibly unsuccessfully).
-  reportPlay(songId: string, startTime: Date): Promise<void> {
+  // at |startTime|. |prevSongId| identifies the song that was played
+  // immediately before it, if any. Returns a promise that is resolved once the
+  // reporting attempt is completed (possibly unsuccessfully).
+  reportPlay(
+    songId: string,
+    startTime: Date,
+    prevSongId: string | null = null
+  ): Promise<void> {
     // Move from queued (if present) to active.
-    this.#addPlay(ACTIVE_PLAYS, songId, startTime);
+    this.#addPlay(ACTIVE_PLAYS, songId, startTime, prevSongId);
     this.#removePlay(QUEUED_PLAYS, songId, startTime);
 
-    const url =
+    let url =
       `played?songId=${encodeURIComponent(songId)}` +
       `&startTime=${encodeURIComponent(startTime.toISOString())}`;
+    if (prevSongId) url += `&prevSongId=${encodeURIComponent(prevSongId)}`;
     console.log(`Reporting play: ${url}`);
 
-    return fetch(url, { method: 'POST' })
+    return fetch(url, { method: 'POST', headers: getCSRFHeaders() })
       .then((res) => handleFetchError(res))
       .then(() => {
         // Success: remove it from active and try to send more.
@@ -71,47 +79,99 @@ export default class Updater {
       .catch((err) => {
         // Failed: move it from active to queued and schedule a retry.
         console.error(`Reporting to ${url} failed: ${err}`);
-        this.#addPlay(QUEUED_PLAYS, songId, startTime);
+        this.#addPlay(QUEUED_PLAYS, songId, startTime, prevSongId);
         this.#removePlay(ACTIVE_PLAYS, songId, startTime);
         this.#scheduleSend();
       });
   }
 
+  // Asynchronously notifies the server that song |songId|, which started
+  // playing at |startTime| after |prevSongId| (if non-null), was skipped at
+  // |position| seconds. Skips are reported on a best-effort basis and aren't
+  // retried.
+  reportSkip(
+    songId: string,
+    startTime: Date,
+    position: number,
+    prevSongId: string | null = null
+  ): Promise<void> {
+    let url =
+      `skipped?songId=${encodeURIComponent(songId)}` +
+      `&startTime=${encodeURIComponent(startTime.toISOString())}` +
+      `&position=${position.toFixed(1)}`;
+    if (prevSongId) url += `&prevSongId=${encodeURIComponent(prevSongId)}`;
+    console.log(`Reporting skip: ${url}`);
+    return fetch(url, { method: 'POST', headers: getCSRFHeaders() })
+      .then((res) => handleFetchError(res))
+      .then(() => {})
+      .catch((err) => console.error(`Reporting to ${url} failed: ${err}`));
+  }
+
   // Asynchronously notifies the server that song |songId| was given |rating|
   // (int in [1, 5] or 0 for unrated) and |tags| (string array). Either |rating|
   // or |tags| can be null to leave them unchanged. Returns a promise that is
   // resolved once the update attempt is completed (possibly unsuccessfully).
+  //
+  // If |base| is supplied, it should describe the song as last seen by the
+  // caller. If the song was modified on the server since then, the changes
+  // from |base.tags| to |tags| are merged into the song's current tags and the
+  // update is retried.
   rateAndTag(
     songId: string,
     rating: number | null,
-    tags: string[] | null
+    tags: string[] | null,
+    base: SongBase | null = null
   ): Promise<void> {
     if (rating === null && tags === null) return Promise.resolve();
 
     // If there's a queued update for the same song, incorporate its data.
+    // The queued update's base is older, so prefer it.
     const queued = this.#readUpdates(QUEUED_UPDATES)[songId];
     if (queued) {
       rating = rating ?? queued.rating;
       tags = tags ?? queued.tags;
+      base = queued.base ?? base;
       this.#removeUpdate(QUEUED_UPDATES, songId);
     }
 
     // If there's an active update for the song, queue this update.
     if (this.#readUpdates(ACTIVE_UPDATES)[songId]) {
-      this.#addUpdate(QUEUED_UPDATES, songId, rating, tags, true);
+      this.#addUpdate(QUEUED_UPDATES, songId, rating, tags, base, true);
       return Promise.resolve();
     }
 
-    this.#addUpdate(ACTIVE_UPDATES, songId, rating, tags, true);
+    // If the base predates an earlier update that we made, use the song's
+    // last-modified time from after that update instead.
+    const sup = this.#superseded[songId];
+    if (base && sup && sup.from === base.lastModifiedNsec) {
+      base = { lastModifiedNsec: sup.to, tags: base.tags };
+    }
+
+    this.#addUpdate(ACTIVE_UPDATES, songId, rating, tags, base, true);
     let url = `rate_and_tag?songId=${encodeURIComponent(songId)}`;
     if (rating !== null) url += `&rating=${rating}`;
     if (tags !== null) url += `&tags=${encodeURIComponent(tags.join(' '))}`;
+    if (base) url += `&ifLastModifiedNsec=${base.lastModifiedNsec}`;
     console.log(`Rating/tagging song: ${url}`);
-    return fetch(url, { method: 'POST' })
-      .then((res) => handleFetchError(res))
-      .then(() => {
+    return fetch(url, { method: 'POST', headers: getCSRFHeaders() })
+      .then(async (res) => {
+        if (res.status === 409) {
+          const cur: Song = await res.json();
+          return this.#retryAfterConflict(songId, rating, tags, base, cur);
+        }
+        await handleFetchError(res);
+
         // Success: remove the update from the active map and immediately look
         // for more stuff to send.
+        if (base) {
+          const updated: Song = await res.json();
+          if (updated.lastModifiedNsec) {
+            this.#superseded[songId] = {
+              from: base.lastModifiedNsec,
+              to: updated.lastModifiedNsec,
+            };
+          }
+        }
         this.#removeUpdate(ACTIVE_UPDATES, songId);
         this.#scheduleSend(0);
       })
@@ -119,12 +179,37 @@ export default class Updater {
         // Failure: queue the update and retry. If another update was queued in
         // the meantime, merge our data into it.
         console.log(`Rating/tagging to ${url} failed: ${err}`);
-        this.#addUpdate(QUEUED_UPDATES, songId, rating, tags, false);
+        this.#addUpdate(QUEUED_UPDATES, songId, rating, tags, base, false);
         this.#removeUpdate(ACTIVE_UPDATES, songId);
         this.#scheduleSend();
       });
   }
 
+  // Merges an update that was rejected because song |songId| was modified
+  // after |base| into the song's current state |cur| and sends it again, along
+  // with any update that was queued in the meantime.
+  #retryAfterConflict(
+    songId: string,
+    rating: number | null,
+    tags: string[] | null,
+    base: SongBase | null,
+    cur: Song
+  ): Promise<void> {
+    console.log(`Song ${songId} was modified; merging update`);
+    this.#removeUpdate(ACTIVE_UPDATES, songId);
+    const queued = this.#readUpdates(QUEUED_UPDATES)[songId];
+    if (queued) {
+      rating = queued.rating ?? rating;
+      tags = queued.tags ?? tags;
+      this.#removeUpdate(QUEUED_UPDATES, songId);
+    }
+    if (tags !== null && base) tags = mergeTags(cur.tags, base.tags, tags);
+    const curBase = cur.lastModifiedNsec
+      ? { lastModifiedNsec: cur.lastModifiedNsec, tags: cur.tags }
+      : null;
+    return this.rateAndTag(songId, rating, tags, curBase);
+  }
+
   #onOnline = () => {
     // Automatically try to send queued updates when we come back online.
     const delayMs = underTest() ? 0 : this.#getOnlineSendDelayMs();
@@ -184,11 +269,18 @@ export default class Updater {
 
     const update = Object.entries(this.#readUpdates(QUEUED_UPDATES))[0] ?? null;
     if (update) {
-      return this.rateAndTag(update[0], update[1].rating, update[1].tags);
+      const { rating, tags, base } = update[1];
+      return this.rateAndTag(update[0], rating, tags, base ?? null);
     }
 
     const play = this.#readPlays(QUEUED_PLAYS)[0] ?? null;
-    if (play) return this.reportPlay(play.songId, new Date(play.startTime));
+    if (play) {
+      return this.reportPlay(
+        play.songId,
+        new Date(play.startTime),
+        play.prevSongId ?? null
+      );
+    }
 
     return Promise.resolve();
   }
@@ -257,9 +349,16 @@ export default class Updater {
   }
 
   // Saves a single play report to localStorage.
-  #addPlay(prefix: string, songId: string, startTime: Date | string) {
+  #addPlay(
+    prefix: string,
+    songId: string,
+    startTime: Date | string,
+    prevSongId: string | null = null
+  ) {
     if (typeof startTime !== 'string') startTime = startTime.toISOString();
-    this.#addPlays(prefix, [{ songId, startTime }]);
+    const play: PlayReport = { songId, startTime };
+    if (prevSongId) play.prevSongId = prevSongId;
+    this.#addPlays(prefix, [play]);
   }
 
   // Removes a single play report from localStorage.
@@ -273,17 +372,20 @@ export default class Updater {
 
   // Saves |updates| to localStorage.
   // If |overwrite| is true, the new values are preferred if a song already has
-  // an entry; otherwise the existing entries are preferred.
+  // an entry; otherwise the existing entries are preferred. The older base
+  // (i.e. the existing one if |overwrite| is true) is always preferred.
   #addUpdates(prefix: string, updates: SongUpdateMap, overwrite: boolean) {
     const existing = this.#readUpdates(prefix);
-    for (const [songId, { rating, tags }] of Object.entries(updates)) {
+    for (const [songId, { rating, tags, base }] of Object.entries(updates)) {
       const update = (existing[songId] ||= { rating: null, tags: null });
       if (overwrite) {
         update.rating = rating ?? update.rating;
         update.tags = tags ?? update.tags;
+        update.base = update.base ?? base ?? null;
       } else {
         update.rating = update.rating ?? rating;
         update.tags = update.tags ?? tags;
+        update.base = base ?? update.base ?? null;
       }
     }
     this.#writeObject(prefix, existing);
@@ -295,9 +397,10 @@ export default class Updater {
     songId: string,
     rating: number | null,
     tags: string[] | null,
+    base: SongBase | null,
     overwrite: boolean
   ) {
-    this.#addUpdates(prefix, { [songId]: { rating, tags } }, overwrite);
+    this.#addUpdates(prefix, { [songId]: { rating, tags, base } }, overwrite);
   }
 
   // Removes |songId|'s rating and/or tags update from localStorage.
@@ -326,12 +429,29 @@ export default class Updater {
 interface PlayReport {
   songId: string;
   startTime: string; // ISO 8601
+  prevSongId?: string; // song played immediately before
 }
 
 // SongUpdate contains an update to a song's rating and/or tags.
 interface SongUpdate {
   rating: number | null; // int in [1, 5] or 0 for unrated
   tags: string[] | null;
+  base?: SongBase | null; // song's state when the update was made
+}
+
+// SongBase describes a song's state as seen by the client.
+export interface SongBase {
+  lastModifiedNsec: string; // from Song
+  tags: string[];
+}
+
+// Returns |cur| with the changes from |oldTags| to |newTags| applied.
+export function mergeTags(cur: string[], oldTags: string[], newTags: string[]) {
+  const added = newTags.filter((t) => !oldTags.includes(t));
+  const removed = oldTags.filter((t) => !newTags.includes(t));
+  return [
+    ...new Set([...cur.filter((t) => !removed.includes(t)), ...added]),
+  ].sort();
 }
 
 // SongUpdateMap holds multiple song updates keyed by song ID.